@@ -16,39 +16,19 @@
 package gocw
 
 import (
-	"bytes"
-	"encoding/binary"
+	"context"
 	"fmt"
 	"math"
 	"sync"
 	"time"
 
+	"github.com/google/gocw/internal/regmap"
+
 	"github.com/golang/glog"
 )
 
-const (
-	addrGain       Address = 0
-	addrSettings   Address = 1
-	addrStatus     Address = 2
-	addrAdcData    Address = 3
-	addrEcho       Address = 4
-	addrFreq       Address = 5
-	addrAdvClk     Address = 6
-	addrSysFreq    Address = 7
-	addrAdcFreq    Address = 8
-	addrPhase      Address = 9
-	addrVersions   Address = 10
-	addrOffset     Address = 26
-	addrDecimate   Address = 15
-	addrSamples    Address = 16
-	addrPresamples Address = 17
-	addrBytestorx  Address = 18
-	addrTriggerDur Address = 20
-	addrMultiEcho  Address = 34
-	addrTrigSrc    Address = 39
-	addrExtClk     Address = 38
-	addrIoRoute    Address = 55
-)
+// Read before the register map is selected, so it can't be part of it.
+const addrVersions Address = 10
 
 const (
 	settingsReset    uint8 = 0x01
@@ -74,15 +54,36 @@ const (
 )
 
 const (
+	pinTnrst uint8 = 0x02
 	pinRtio1 uint8 = 0x04
 	pinRtio2 uint8 = 0x08
 	pinRtio3 uint8 = 0x10
 	pinRtio4 uint8 = 0x20
 	modeOr   uint8 = 0x00
 	modeAnd  uint8 = 0x01
-	modenand uint8 = 0x02
+	modeNand uint8 = 0x02
+	// Bit offset of the mode in the trigger source register.
+	modeShift = 6
 )
 
+// Trigger source register bits of each pin, in TriggerTargetIoPins order.
+var triggerPinBits = []struct {
+	pin TriggerTargetIoPin
+	bit uint8
+}{
+	{TriggerTargetIoPin1, pinRtio1},
+	{TriggerTargetIoPin2, pinRtio2},
+	{TriggerTargetIoPin3, pinRtio3},
+	{TriggerTargetIoPin4, pinRtio4},
+	{TriggerTargetIoPinNrst, pinTnrst},
+}
+
+var triggerPinLogicModes = map[TriggerPinLogic]uint8{
+	TriggerPinOr:   modeOr,
+	TriggerPinAnd:  modeAnd,
+	TriggerPinNand: modeNand,
+}
+
 const (
 	ioRouteHighZ   uint8 = 0x00
 	ioRouteSTX     uint8 = 0x01
@@ -104,6 +105,10 @@ const (
 
 var unknownHwVersion = HwVersion{0, HwUnknown, 0}
 
+// Number of consecutive trigger timeouts or empty trace reads, after which the
+// ADC is considered stuck and is reset instead of forcing another trigger.
+const adcWatchdogLimit = 3
+
 type AdvClkSettings struct {
 	SrcAndStatus uint8
 	Mul          uint8
@@ -113,11 +118,31 @@ type AdvClkSettings struct {
 
 var clkReadMask = []byte{0x1f, 0xff, 0xff, 0xfd}
 
+// An Adc may be used concurrently with the Usart and other users of the
+// device, as each register access locks the device, see Memory. The Adc
+// itself, with its sticky Error, is used by one goroutine at a time.
 type Adc struct {
 	fpga         *Fpga
 	err          error
 	hwMaxSamples uint32
 	extClockFreq uint32
+	// Consecutive failed captures, see adcWatchdogLimit.
+	stuckCount int
+	diag       AdcDiagnostics
+	// USB serial number of the device, if known. Keys the device profile.
+	serial string
+	caps   Capabilities
+	regMap *regmap.Map
+	regs   adcRegisters
+	// TIO pins captured alongside ADC samples, see SetLogicCapture.
+	logicChannels LogicChannels
+	// Triggers recorded per arm, see SetSegments.
+	segments int
+	// See SetTraceReadPadding.
+	readPadding int
+	lastRead    TraceRead
+	// Pre-trigger samples kept by the trace decoder.
+	presamples uint32
 }
 
 func (c *Adc) Close() error {
@@ -151,12 +176,14 @@ func (c *Adc) SysFreq() uint32 {
 		return 0
 	}
 	var freq uint32
-	if c.err = c.fpga.Mem.Read(addrSysFreq, &freq); c.err != nil {
+	if c.err = c.fpga.Mem.Read(c.regs.sysFreq, &freq); c.err != nil {
 		return 0
 	}
 	return freq
 }
 
+// Returns the sample buffer size, read from the bitstream at reset: about
+// 24k samples on the ChipWhisperer-Lite, and 98k on the ChipWhisperer-Pro.
 func (c *Adc) MaxSamples() uint32 {
 	return c.hwMaxSamples
 }
@@ -185,7 +212,7 @@ func (c *Adc) Gain() uint8 {
 		return 0
 	}
 	var gain uint8
-	if c.err = c.fpga.Mem.Read(addrGain, &gain); c.err != nil {
+	if c.err = c.fpga.Mem.Read(c.regs.gain, &gain); c.err != nil {
 		return 0
 	}
 	return gain
@@ -195,11 +222,11 @@ func (c *Adc) SetGain(gain uint8) {
 	if c.err != nil {
 		return
 	}
-	if gain > 78 {
-		c.err = fmt.Errorf("Invalid gain (%v), range 0-78 only", gain)
+	if gain > GainMax {
+		c.err = fmt.Errorf("Invalid gain (%v), range 0-%d only", gain, GainMax)
 		return
 	}
-	c.err = c.fpga.Mem.Write(addrGain, &gain, true, nil)
+	c.err = c.fpga.Mem.Write(c.regs.gain, &gain, true, nil)
 }
 
 //
@@ -244,7 +271,7 @@ func (c *Adc) TriggerOffset() uint32 {
 		return 0
 	}
 	var offset uint32
-	if c.err = c.fpga.Mem.Read(addrOffset, &offset); c.err != nil {
+	if c.err = c.fpga.Mem.Read(c.regs.offset, &offset); c.err != nil {
 		return 0
 	}
 	return offset
@@ -254,7 +281,7 @@ func (c *Adc) SetTriggerOffset(offset uint32) {
 	if c.err != nil {
 		return
 	}
-	c.err = c.fpga.Mem.Write(addrOffset, offset, true, nil)
+	c.err = c.fpga.Mem.Write(c.regs.offset, offset, true, nil)
 }
 
 func (c *Adc) PreTriggerSamples() uint32 {
@@ -262,7 +289,7 @@ func (c *Adc) PreTriggerSamples() uint32 {
 		return 0
 	}
 	var samples uint32
-	if c.err = c.fpga.Mem.Read(addrPresamples, &samples); c.err != nil {
+	if c.err = c.fpga.Mem.Read(c.regs.presamples, &samples); c.err != nil {
 		return 0
 	}
 	ver := c.Version()
@@ -286,7 +313,15 @@ func (c *Adc) SetPreTriggerSamples(samples uint32) {
 		c.err = fmt.Errorf("Not reliable on hardware")
 		return
 	}
-	c.err = c.fpga.Mem.Write(addrPresamples, samples, true, nil)
+	// The register counts words of 3 samples.
+	if samples%3 != 0 {
+		glog.Warningf("Pre-trigger samples %d rounded down to a multiple of 3", samples)
+	}
+	words := samples / 3
+	if c.err = c.fpga.Mem.Write(c.regs.presamples, words, true, nil); c.err != nil {
+		return
+	}
+	c.presamples = 3 * words
 }
 
 func (c *Adc) TotalSamples() uint32 {
@@ -313,7 +348,7 @@ func (c *Adc) ActiveCount() uint32 {
 		return 0
 	}
 	var count uint32
-	if c.err = c.fpga.Mem.Read(addrTriggerDur, &count); c.err != nil {
+	if c.err = c.fpga.Mem.Read(c.regs.triggerDur, &count); c.err != nil {
 		return 0
 	}
 	return count
@@ -400,7 +435,7 @@ func (c *Adc) AdcFreq() uint32 {
 	}
 
 	var adcFreq uint32
-	if c.err = c.fpga.Mem.Read(addrAdcFreq, &adcFreq); c.err != nil {
+	if c.err = c.fpga.Mem.Read(c.regs.adcFreq, &adcFreq); c.err != nil {
 		return 0
 	}
 
@@ -421,6 +456,53 @@ func (c *Adc) DcmLocked() bool {
 	return (c.advClock().SrcAndStatus&0x40 > 0)
 }
 
+// Range of the ADC sample clock phase adjustment.
+const (
+	AdcPhaseMin = -255
+	AdcPhaseMax = 255
+)
+
+// Flags of the high byte of the phase register.
+const (
+	phaseSign  = 0x01
+	phaseValid = 0x02
+)
+
+func (c *Adc) AdcPhase() int {
+	if c.err != nil {
+		return 0
+	}
+	buf := make([]byte, 2)
+	if c.err = c.fpga.Mem.Read(c.regs.phase, buf); c.err != nil {
+		return 0
+	}
+	if buf[1]&phaseValid == 0 {
+		glog.Warning("ADC phase invalid, the ADC clock may not go through the DCM")
+		return 0
+	}
+	// 9 bit two's complement.
+	phase := int(buf[0])
+	if buf[1]&phaseSign > 0 {
+		phase -= 512
+	}
+	return phase
+}
+
+func (c *Adc) SetAdcPhase(phase int) {
+	if c.err != nil {
+		return
+	}
+	if phase < AdcPhaseMin || phase > AdcPhaseMax {
+		c.err = fmt.Errorf("ADC phase %d outside [%d, %d]", phase, AdcPhaseMin, AdcPhaseMax)
+		return
+	}
+	if phase < 0 {
+		phase += 512
+	}
+	buf := []byte{uint8(phase), uint8(phase>>8)&phaseSign | phaseValid}
+	c.err = c.fpga.Mem.Write(c.regs.phase, buf, false, nil)
+}
+
 func (c *Adc) FreqCounter() uint32 {
 	if c.err != nil {
 		return 0
@@ -431,7 +513,7 @@ func (c *Adc) FreqCounter() uint32 {
 	}
 
 	var extFreq uint32
-	if c.err = c.fpga.Mem.Read(addrFreq, &extFreq); c.err != nil {
+	if c.err = c.fpga.Mem.Read(c.regs.freq, &extFreq); c.err != nil {
 		return 0
 	}
 
@@ -527,9 +609,14 @@ func (c *Adc) SetClkGenOutputFreq(freq uint32) {
 	case ClkGenInputSystem:
 		inpFreq = c.SysFreq()
 	}
-	mul, div := calcClkGenMulDiv(int(freq), int(inpFreq))
-	c.setClkGenMul(uint32(mul))
-	c.setClkGenDiv(uint32(div))
+	var setting ClkGenSetting
+	if setting, c.err = CalcClkGenMulDiv(freq, inpFreq, ClkGenLimitsFor(c.caps.Hw.HwType)); c.err != nil {
+		return
+	}
+	glog.V(1).Infof("[adc] CLKGEN mul = %d, div = %d, error = %.0fHz",
+		setting.Mul, setting.Div, setting.ErrorHz)
+	c.setClkGenMul(uint32(setting.Mul))
+	c.setClkGenDiv(uint32(setting.Div))
 	c.resetClkGen()
 	c.resetAdc()
 }
@@ -542,51 +629,80 @@ func (c *Adc) ClkGenDcmLocked() bool {
 // Trigger settings.
 //
 
-// TODO(cfir): add boolean operations support.
+func (c *Adc) triggerSrc() uint8 {
+	if c.err != nil {
+		return 0
+	}
+	var src uint8
+	c.err = c.fpga.Mem.Read(c.regs.trigSrc, &src)
+	return src
+}
+
 func (c *Adc) TriggerTargetIoPins() []TriggerTargetIoPin {
 	var res []TriggerTargetIoPin
+	src := c.triggerSrc()
 	if c.err != nil {
 		return res
 	}
-	var pins uint8
-	if c.err = c.fpga.Mem.Read(addrTrigSrc, &pins); c.err != nil {
-		return res
-	}
-	if pins&pinRtio1 > 0 {
-		res = append(res, TriggerTargetIoPin1)
-	}
-	if pins&pinRtio2 > 0 {
-		res = append(res, TriggerTargetIoPin2)
+	for _, p := range triggerPinBits {
+		if src&p.bit > 0 {
+			res = append(res, p.pin)
+		}
 	}
-	if pins&pinRtio3 > 0 {
-		res = append(res, TriggerTargetIoPin3)
+	return res
+}
+
+// Returns how the trigger pins are combined.
+func (c *Adc) TriggerPinLogic() TriggerPinLogic {
+	src := c.triggerSrc()
+	if c.err != nil {
+		return TriggerPinOr
 	}
-	if pins&pinRtio4 > 0 {
-		res = append(res, TriggerTargetIoPin4)
+	mode := src >> modeShift
+	for logic, m := range triggerPinLogicModes {
+		if m == mode {
+			return logic
+		}
 	}
-	return res
+	c.err = fmt.Errorf("Unknown trigger pin mode %v", mode)
+	return TriggerPinOr
 }
 
+// Triggers on a single pin.
 func (c *Adc) SetTriggerTargetIoPin(pin TriggerTargetIoPin) {
+	c.SetTriggerTargetIoPins([]TriggerTargetIoPin{pin}, TriggerPinOr)
+}
+
+// Triggers on a boolean combination of pins, e.g. TIO4 AND nRST.
+func (c *Adc) SetTriggerTargetIoPins(pins []TriggerTargetIoPin, logic TriggerPinLogic) {
 	if c.err != nil {
 		return
 	}
-	var pins uint8
-	switch pin {
-	case TriggerTargetIoPin1:
-		pins |= pinRtio1
-	case TriggerTargetIoPin2:
-		pins |= pinRtio2
-	case TriggerTargetIoPin3:
-		pins |= pinRtio3
-	case TriggerTargetIoPin4:
-		pins |= pinRtio4
-	default:
-		c.err = fmt.Errorf("Invalid pin %v", pin)
+	if len(pins) == 0 {
+		c.err = fmt.Errorf("No trigger pins")
+		return
+	}
+	mode, ok := triggerPinLogicModes[logic]
+	if !ok {
+		c.err = fmt.Errorf("Invalid trigger pin logic %v", logic)
 		return
 	}
-	pins |= (modeOr << 6)
-	c.err = c.fpga.Mem.Write(addrTrigSrc, &pins, true, nil)
+	var src uint8
+	for _, pin := range pins {
+		found := false
+		for _, p := range triggerPinBits {
+			if p.pin == pin {
+				src |= p.bit
+				found = true
+			}
+		}
+		if !found {
+			c.err = fmt.Errorf("Invalid pin %v", pin)
+			return
+		}
+	}
+	src |= mode << modeShift
+	c.err = c.fpga.Mem.Write(c.regs.trigSrc, &src, true, nil)
 }
 
 //
@@ -606,6 +722,69 @@ func (c *Adc) SetTargetIo2(mode TargetIoMode) {
 	c.setTargetIo(1, mode)
 }
 
+func (c *Adc) TargetIo3() TargetIoMode {
+	return c.targetIo(2)
+}
+func (c *Adc) SetTargetIo3(mode TargetIoMode) {
+	c.setTargetIo(2, mode)
+}
+
+func (c *Adc) TargetIo4() TargetIoMode {
+	return c.targetIo(3)
+}
+func (c *Adc) SetTargetIo4(mode TargetIoMode) {
+	c.setTargetIo(3, mode)
+}
+
+// Implements TargetGpio. Routes a TIO pin to GPIO, or enables a special pin.
+func (c *Adc) SetTargetPin(pin TargetIoPin, high bool) {
+	mode := GpioLow
+	if high {
+		mode = GpioHigh
+	}
+	if pin.special() {
+		c.setSpecialGpio(int(pin), mode)
+		return
+	}
+	if c.err != nil || SkipWrite("TargetIO %d to %v", pin, mode) {
+		return
+	}
+	buf := make([]byte, 8)
+	if c.err = c.fpga.Mem.Read(c.regs.ioRoute, buf); c.err != nil {
+		return
+	}
+	buf[pin] = ioRouteGpioE
+	if high {
+		buf[pin] |= ioRouteGpio
+	}
+	c.err = c.fpga.Mem.Write(c.regs.ioRoute, buf, true, nil)
+}
+
+// Implements TargetGpio.
+func (c *Adc) ReleaseTargetPin(pin TargetIoPin) {
+	if pin.special() {
+		c.setSpecialGpio(int(pin), GpioDisabled)
+		return
+	}
+	c.setTio(int(pin), ioRouteHighZ)
+}
+
+// Implements TargetGpio. Only the TIO pins are read back.
+func (c *Adc) TargetPinLevel(pin TargetIoPin) bool {
+	if c.err != nil {
+		return false
+	}
+	if pin.special() {
+		c.err = fmt.Errorf("%v can't be read", pin)
+		return false
+	}
+	buf := make([]byte, 1)
+	if c.err = c.fpga.Mem.Read(c.regs.ioRead, buf); c.err != nil {
+		return false
+	}
+	return buf[0]&(1<<uint(pin)) != 0
+}
+
 func (c *Adc) NRST() GpioMode {
 	return c.specialGpio(nrstPinNum)
 }
@@ -650,10 +829,17 @@ func (c *Adc) SetHs2(mode Hs2Mode) {
 	case Hs2ModeClkGen:
 		c.setTargetClkOut(2)
 	case Hs2ModeGlitch:
+		if c.err = c.caps.Require(FeatureGlitch); c.err != nil {
+			return
+		}
 		c.setTargetClkOut(3)
 	}
 }
 
+func (c *Adc) Capabilities() Capabilities {
+	return c.caps
+}
+
 //
 // Capture settings.
 //
@@ -665,19 +851,60 @@ func (c *Adc) SetArmOff() {
 	c.setSettings(c.settings() & ^settingsArm, true)
 }
 
+// Triggers an armed capture immediately, regardless of the trigger input.
+func (c *Adc) ForceTrigger() {
+	if c.err != nil {
+		return
+	}
+	initial := c.settings()
+	c.setSettings(initial|settingsTrigNow, true)
+	c.setSettings(initial & ^settingsTrigNow, true)
+}
+
+// Arms, forces a trigger after delay, and returns the samples. For probing and
+// free-running diagnostics without a target. Captures a single segment, and
+// restores the segment count after.
+func (c *Adc) CaptureOnce(delay time.Duration) []Sample {
+	if c.err != nil {
+		return nil
+	}
+	if segments := c.Segments(); segments > 1 {
+		c.SetSegments(1)
+		defer c.SetSegments(segments)
+	}
+	c.SetArmOn()
+	time.Sleep(delay)
+	c.ForceTrigger()
+	c.WaitForTigger()
+	return c.TraceData()
+}
+
 func (c *Adc) WaitForTigger() bool {
+	return c.WaitForTriggerContext(context.Background())
+}
+
+// Same as WaitForTigger, returning early when ctx is done. The ADC is then
+// disarmed, and Error returns the context error.
+func (c *Adc) WaitForTriggerContext(ctx context.Context) bool {
 	var wg sync.WaitGroup
 	timedOut := time.NewTimer(2 * time.Second)
-	var ret bool
+	defer timedOut.Stop()
+	var ret, cancelled bool
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		for {
 			select {
+			case <-ctx.Done():
+				cancelled = true
+				return
 			case <-timedOut.C:
-				glog.Warning("Timed out waiting for trigger. Forcing trigger")
-				c.setTriggerNow()
+				c.diag.TriggerTimeouts++
+				if !c.watchdog() {
+					glog.Warning("Timed out waiting for trigger. Forcing trigger")
+					c.ForceTrigger()
+				}
 				ret = true
 				return
 			default:
@@ -691,50 +918,139 @@ func (c *Adc) WaitForTigger() bool {
 		}
 	}()
 	wg.Wait()
+	if cancelled {
+		c.Disarm()
+		if c.err == nil {
+			c.err = ctx.Err()
+		}
+		return false
+	}
 	c.SetArmOff()
 	return ret
 }
 
-func (c *Adc) TraceData() []float64 {
-	var pending uint32
-	if c.err = c.fpga.Mem.Read(addrBytestorx, &pending); c.err != nil {
-		return nil
+// Disarms the ADC even after an error, e.g. when a capture was cancelled
+// while armed. The error is kept.
+func (c *Adc) Disarm() {
+	err := c.err
+	c.err = nil
+	c.SetArmOff()
+	if err != nil {
+		c.err = err
 	}
-	if pending == 0 {
+}
+
+// Reads the samples of the last capture. Returns fewer samples than requested
+// if the FIFO or the bulk read came up short, see LastTraceRead, which also
+// reports clipped samples and FIFO overflows.
+func (c *Adc) TraceData() []Sample {
+	return c.TraceDataContext(context.Background())
+}
+
+// Same as TraceData, returning early when ctx is done. Error then returns the
+// context error.
+func (c *Adc) TraceDataContext(ctx context.Context) []Sample {
+	samples, toRead := c.traceReadSize()
+	if toRead == 0 {
 		return nil
 	}
-	// If pending is huge, we only read what is needed
-	// Bytes get packed 3 samples / 4 bytes
-	// Add some extra in case needed
-	samples := c.numSamples()
-	toRead := samples
-	if toRead%3 != 0 {
-		toRead += 3 - toRead%3
-	}
-	toRead = (toRead*4)/3 + 256
-	if pending < toRead {
-		toRead = pending
-	}
 
 	glog.V(1).Infof("Reading trace data. samples: %v, toRead: %v", samples, toRead)
 	data := make([]byte, toRead)
-	if c.err = c.fpga.Mem.Read(addrAdcData, data); c.err != nil {
-		c.err = fmt.Errorf("Failed reading trace data: %v", c.err)
+	n, err := c.fpga.Mem.ReadBytesContext(ctx, c.regs.adcData, data)
+	c.lastRead.BytesRead = n
+	if ctx.Err() != nil {
+		c.err = ctx.Err()
+		return nil
+	}
+	if err != nil {
+		if _, ok := err.(*ShortReadError); !ok {
+			c.err = fmt.Errorf("Failed reading trace data: %v", err)
+			return nil
+		}
+		// Decode the full words that were read.
+		c.diag.ShortReads++
+		glog.Warningf("Failed reading trace data: %v. Decoding partial data", err)
+		data = data[:n&^3]
+	}
+	if len(data) == 0 {
 		return nil
 	}
 
-	measurements := c.ProcessTraceData(data)
-	if c.err != nil {
+	var measurements []Sample
+	if measurements, c.err = NewTraceDataDecoder(c.TraceDataDecoderConfig()).Decode(data); c.err != nil {
 		return nil
 	}
 
-	if len(measurements) > int(samples) {
+	if len(measurements) > samples {
 		measurements = measurements[:samples]
 	}
-
+	c.lastRead.Decoded = len(measurements)
+	if len(measurements) < samples {
+		glog.Warningf("Decoded %d of %d samples", len(measurements), samples)
+	}
+	if c.lastRead.Clipped = ClippedSamples(measurements); c.lastRead.Clipped > 0 {
+		c.diag.ClippedReads++
+		glog.Warningf("%d samples clipped, the gain (%d) may be too high", c.lastRead.Clipped, c.Gain())
+	}
 	return measurements
 }
 
+// Checks the FIFO before reading the samples of the last capture. Returns the
+// number of samples expected, and of bytes to read, zero if there is nothing
+// to read.
+func (c *Adc) traceReadSize() (samples, toRead int) {
+	c.lastRead = TraceRead{}
+	var pending uint32
+	if c.err = c.fpga.Mem.Read(c.regs.bytesToRx, &pending); c.err != nil {
+		return 0, 0
+	}
+	if pending == 0 {
+		c.diag.EmptyReads++
+		c.watchdog()
+		return 0, 0
+	}
+	c.stuckCount = 0
+	if c.status()&statusOverflowMask != 0 {
+		c.lastRead.Overflow = true
+		c.diag.Overflows++
+		glog.Warning("ADC FIFO overflowed")
+	}
+	// Samples are packed 3 per 4 byte word, after a sync byte. The extra word
+	// covers the sync byte, and the padding covers words before the trigger
+	// beyond the pre-trigger samples, which are skipped. Reads are a multiple
+	// of 4 bytes, as the last 3 bytes can't hold a full word.
+	samples = int(c.numSamples()) * c.Segments()
+	words := (samples + 2) / 3
+	padding := (c.readPadding + 3) &^ 3
+	toRead = 4*(words+1) + padding
+	if int(pending) < toRead {
+		toRead = int(pending) &^ 3
+	}
+	c.lastRead.Samples = samples
+	c.lastRead.Bytes = toRead
+	return samples, toRead
+}
+
+// Sets the number of extra bytes read after the expected samples, covering
+// the samples before the trigger which are skipped. Rounded up to a multiple
+// of 4 bytes (3 samples).
+func (c *Adc) SetTraceReadPadding(bytes int) {
+	if bytes < 0 {
+		bytes = 0
+	}
+	c.readPadding = bytes
+}
+
+func (c *Adc) TraceReadPadding() int {
+	return c.readPadding
+}
+
+// Returns the sizes of the last TraceData read.
+func (c *Adc) LastTraceRead() TraceRead {
+	return c.lastRead
+}
+
 //
 // Support functions.
 //
@@ -743,7 +1059,7 @@ func (c *Adc) status() uint8 {
 		return 0
 	}
 	var status uint8
-	if c.err = c.fpga.Mem.Read(addrStatus, &status); c.err != nil {
+	if c.err = c.fpga.Mem.Read(c.regs.status, &status); c.err != nil {
 		return 0
 	}
 	return status
@@ -754,7 +1070,7 @@ func (c *Adc) settings() uint8 {
 		return 0
 	}
 	var settings uint8
-	c.err = c.fpga.Mem.Read(addrSettings, &settings)
+	c.err = c.fpga.Mem.Read(c.regs.settings, &settings)
 	return settings
 }
 
@@ -762,7 +1078,7 @@ func (c *Adc) setSettings(settings uint8, validate bool) {
 	if c.err != nil {
 		return
 	}
-	c.err = c.fpga.Mem.Write(addrSettings, &settings, validate, nil)
+	c.err = c.fpga.Mem.Write(c.regs.settings, &settings, validate, nil)
 }
 
 func (c *Adc) numSamples() uint32 {
@@ -770,7 +1086,7 @@ func (c *Adc) numSamples() uint32 {
 		return 0
 	}
 	var samples uint32
-	if c.err = c.fpga.Mem.Read(addrSamples, &samples); c.err != nil {
+	if c.err = c.fpga.Mem.Read(c.regs.samples, &samples); c.err != nil {
 		return 0
 	}
 	return samples
@@ -780,7 +1096,7 @@ func (c *Adc) setNumSamples(n uint32) {
 	if c.err != nil {
 		return
 	}
-	c.err = c.fpga.Mem.Write(addrSamples, &n, true, nil)
+	c.err = c.fpga.Mem.Write(c.regs.samples, &n, true, nil)
 }
 
 func (c *Adc) decimate() uint16 {
@@ -788,7 +1104,7 @@ func (c *Adc) decimate() uint16 {
 		return 0
 	}
 	var n uint16
-	if c.err = c.fpga.Mem.Read(addrDecimate, &n); c.err != nil {
+	if c.err = c.fpga.Mem.Read(c.regs.decimate, &n); c.err != nil {
 		return 0
 	}
 	return n + 1
@@ -799,7 +1115,7 @@ func (c *Adc) setDecimate(n uint16) {
 		return
 	}
 	n -= 1
-	c.err = c.fpga.Mem.Write(addrDecimate, &n, true, nil)
+	c.err = c.fpga.Mem.Write(c.regs.decimate, &n, true, nil)
 }
 
 func (c *Adc) advClock() AdvClkSettings {
@@ -807,7 +1123,7 @@ func (c *Adc) advClock() AdvClkSettings {
 	if c.err != nil {
 		return settings
 	}
-	if c.err = c.fpga.Mem.Read(addrAdvClk, &settings); c.err != nil {
+	if c.err = c.fpga.Mem.Read(c.regs.advClk, &settings); c.err != nil {
 		return settings
 	}
 	return settings
@@ -817,7 +1133,7 @@ func (c *Adc) setAdvClock(settings AdvClkSettings, validate bool) {
 	if c.err != nil {
 		return
 	}
-	c.err = c.fpga.Mem.Write(addrAdvClk, &settings, validate, clkReadMask)
+	c.err = c.fpga.Mem.Write(c.regs.advClk, &settings, validate, clkReadMask)
 }
 
 // The multiplier in the CLKGEN DCM.
@@ -936,33 +1252,84 @@ func (c *Adc) setClkGenDiv(div uint32) {
 	c.setAdvClock(settings, true)
 }
 
-// Calculate Multiply & Divide settings based on input frequency.
-func calcClkGenMulDiv(freq, inpFreq int) (int, int) {
-	var bestMul, bestDiv int
+// DCM_CLKGEN constraints of the FPGA (Spartan-6 datasheet, DS162).
+type ClkGenLimits struct {
+	MinMul, MaxMul int
+	MinDiv, MaxDiv int
+	// Minimal CLKIN / D frequency, enforced for inputs below
+	// PfdLimitInput.
+	MinPfd        float64
+	PfdLimitInput float64
+	// CLKFX output range.
+	MinOut, MaxOut float64
+}
 
-	// Max setting for divide is 60 (see datasheet)
-	// Multiply is 2-256
-	lowError := 1e99
+var defaultClkGenLimits = ClkGenLimits{
+	MinMul: 2, MaxMul: 256,
+	MinDiv: 1, MaxDiv: 60,
+	MinPfd: 0.5e6, PfdLimitInput: 52e6,
+	MinOut: 5e6, MaxOut: 333e6,
+}
 
-	var maxDiv int
-	// From datasheet, if input freq is < 52MHz limit max divide
-	if inpFreq < 52e6 {
-		maxDiv = int(inpFreq / 0.5E6)
-	} else {
-		maxDiv = 256
+var clkGenLimits = map[HwType]ClkGenLimits{
+	HwChipWhispererLite:   defaultClkGenLimits,
+	HwChipWhispererCw1200: defaultClkGenLimits,
+}
+
+// Returns the CLKGEN constraints of the given hardware.
+func ClkGenLimitsFor(hw HwType) ClkGenLimits {
+	if l, ok := clkGenLimits[hw]; ok {
+		return l
 	}
+	return defaultClkGenLimits
+}
 
-	for mul := 2; mul < 257; mul++ {
-		for div := 1; div < maxDiv; div++ {
-			err := math.Abs(float64(freq - ((inpFreq * mul) / div)))
-			if err < lowError {
-				lowError = err
-				bestMul, bestDiv = mul, div
-			}
+// A CLKGEN multiply / divide setting.
+type ClkGenSetting struct {
+	Mul, Div int
+	// Output frequency in Hz, and its difference from the requested one.
+	Freq    float64
+	ErrorHz float64
+}
+
+// Calculates the CLKGEN multiply & divide settings closest to freq, given the
+// input frequency. On ties, lower settings are preferred since they have less
+// jitter.
+func CalcClkGenMulDiv(freq, inpFreq uint32, limits ClkGenLimits) (ClkGenSetting, error) {
+	maxDiv := limits.MaxDiv
+	if float64(inpFreq) < limits.PfdLimitInput {
+		if d := int(float64(inpFreq) / limits.MinPfd); d < maxDiv {
+			maxDiv = d
 		}
 	}
 
-	return bestMul, bestDiv
+	best := ClkGenSetting{ErrorHz: math.Inf(1)}
+	consider := func(mul, div int) {
+		if mul < limits.MinMul || mul > limits.MaxMul {
+			return
+		}
+		out := float64(inpFreq) * float64(mul) / float64(div)
+		if out < limits.MinOut || out > limits.MaxOut {
+			return
+		}
+		e := out - float64(freq)
+		if math.Abs(e) < math.Abs(best.ErrorHz) ||
+			(math.Abs(e) == math.Abs(best.ErrorHz) && mul < best.Mul) {
+			best = ClkGenSetting{mul, div, out, e}
+		}
+	}
+	// For each divider, only the two multipliers around the ideal ratio can
+	// be closest.
+	for div := limits.MinDiv; div <= maxDiv; div++ {
+		ideal := float64(freq) * float64(div) / float64(inpFreq)
+		consider(int(math.Floor(ideal)), div)
+		consider(int(math.Ceil(ideal)), div)
+	}
+
+	if math.IsInf(best.ErrorHz, 1) {
+		return best, fmt.Errorf("No CLKGEN setting for %dHz from %dHz input", freq, inpFreq)
+	}
+	return best, nil
 }
 
 func (c *Adc) tio(pinnum int) uint8 {
@@ -970,7 +1337,7 @@ func (c *Adc) tio(pinnum int) uint8 {
 		return 0
 	}
 	buf := make([]byte, 8)
-	if c.err = c.fpga.Mem.Read(addrIoRoute, buf); c.err != nil {
+	if c.err = c.fpga.Mem.Read(c.regs.ioRoute, buf); c.err != nil {
 		return 0
 	}
 	// Don't include GPIO state in mode check
@@ -988,11 +1355,11 @@ func (c *Adc) setTio(pinnum int, mode uint8) {
 		return
 	}
 	buf := make([]byte, 8)
-	if c.err = c.fpga.Mem.Read(addrIoRoute, buf); c.err != nil {
+	if c.err = c.fpga.Mem.Read(c.regs.ioRoute, buf); c.err != nil {
 		return
 	}
 	buf[pinnum] = mode
-	c.err = c.fpga.Mem.Write(addrIoRoute, buf, true, nil)
+	c.err = c.fpga.Mem.Write(c.regs.ioRoute, buf, true, nil)
 }
 
 func (c *Adc) gpio(pinnum int) GpioMode {
@@ -1000,7 +1367,7 @@ func (c *Adc) gpio(pinnum int) GpioMode {
 		return 0
 	}
 	buf := make([]byte, 8)
-	if c.err = c.fpga.Mem.Read(addrIoRoute, buf); c.err != nil {
+	if c.err = c.fpga.Mem.Read(c.regs.ioRoute, buf); c.err != nil {
 		return 0
 	}
 	if buf[pinnum]&ioRouteGpioE == 0 {
@@ -1018,7 +1385,7 @@ func (c *Adc) setGpio(pinnum int, mode GpioMode) {
 		return
 	}
 	buf := make([]byte, 8)
-	if c.err = c.fpga.Mem.Read(addrIoRoute, buf); c.err != nil {
+	if c.err = c.fpga.Mem.Read(c.regs.ioRoute, buf); c.err != nil {
 		return
 	}
 	if buf[pinnum]&ioRouteGpioE == 0 {
@@ -1031,7 +1398,7 @@ func (c *Adc) setGpio(pinnum int, mode GpioMode) {
 	case GpioLow:
 		buf[pinnum] &= ^ioRouteGpio
 	}
-	c.err = c.fpga.Mem.Write(addrIoRoute, buf, true, nil)
+	c.err = c.fpga.Mem.Write(c.regs.ioRoute, buf, true, nil)
 }
 
 // Special GPIO nRST, PDID, PDIC.
@@ -1040,7 +1407,7 @@ func (c *Adc) specialGpio(pinnum int) GpioMode {
 		return 0
 	}
 	buf := make([]byte, 8)
-	if c.err = c.fpga.Mem.Read(addrIoRoute, buf); c.err != nil {
+	if c.err = c.fpga.Mem.Read(c.regs.ioRoute, buf); c.err != nil {
 		return 0
 	}
 	var bitnum uint
@@ -1067,7 +1434,7 @@ func (c *Adc) setSpecialGpio(pinnum int, mode GpioMode) {
 		return
 	}
 	buf := make([]byte, 8)
-	if c.err = c.fpga.Mem.Read(addrIoRoute, buf); c.err != nil {
+	if c.err = c.fpga.Mem.Read(c.regs.ioRoute, buf); c.err != nil {
 		return
 	}
 
@@ -1091,7 +1458,10 @@ func (c *Adc) setSpecialGpio(pinnum int, mode GpioMode) {
 		buf[6] |= (1 << bitnum)
 		buf[6] &= ^uint8(1 << (bitnum + 1))
 	}
-	c.err = c.fpga.Mem.Write(addrIoRoute, buf, true, nil)
+	if SkipWrite("special GPIO %d to %v", pinnum, mode) {
+		return
+	}
+	c.err = c.fpga.Mem.Write(c.regs.ioRoute, buf, true, nil)
 }
 
 func (c *Adc) targetIo(pinnum int) TargetIoMode {
@@ -1115,6 +1485,8 @@ func (c *Adc) targetIo(pinnum int) TargetIoMode {
 			return TargetIoModeSerialTx
 		case ioRouteSRX:
 			return TargetIoModeSerialRx
+		case ioRouteHighZ:
+			return TargetIoModeHighZ
 		default:
 			c.err = fmt.Errorf("Unsupported tio mode %v", tioMode)
 		}
@@ -1126,11 +1498,17 @@ func (c *Adc) setTargetIo(pinnum int, mode TargetIoMode) {
 	if c.err != nil {
 		return
 	}
+	if (mode == TargetIoModeGpioLow || mode == TargetIoModeGpioHigh) &&
+		SkipWrite("TargetIO %d to %v", pinnum, mode) {
+		return
+	}
 	switch mode {
 	case TargetIoModeSerialRx:
 		c.setTio(pinnum, ioRouteSRX)
 	case TargetIoModeSerialTx:
 		c.setTio(pinnum, ioRouteSTX)
+	case TargetIoModeHighZ:
+		c.setTio(pinnum, ioRouteHighZ)
 	case TargetIoModeGpioLow:
 		c.setTio(pinnum, ioRouteGpioE)
 		c.setGpio(pinnum, GpioLow)
@@ -1147,7 +1525,7 @@ func (c *Adc) targetClkOut() uint8 {
 		return 0
 	}
 	var data uint8
-	if c.err = c.fpga.Mem.Read(addrExtClk, &data); c.err != nil {
+	if c.err = c.fpga.Mem.Read(c.regs.extClk, &data); c.err != nil {
 		return 0
 	}
 
@@ -1159,89 +1537,96 @@ func (c *Adc) setTargetClkOut(clkout uint8) {
 		return
 	}
 	var data uint8
-	if c.err = c.fpga.Mem.Read(addrExtClk, &data); c.err != nil {
+	if c.err = c.fpga.Mem.Read(c.regs.extClk, &data); c.err != nil {
 		return
 	}
 	data &= ^uint8(3 << 5)
 	data |= clkout << 5
-	c.err = c.fpga.Mem.Write(addrExtClk, &data, true, nil)
+	c.err = c.fpga.Mem.Write(c.regs.extClk, &data, true, nil)
 }
 
-func (c *Adc) setTriggerNow() {
-	if c.err != nil {
-		return
+// Limits of the decoded samples, see TraceDataDecoder.
+const (
+	SampleMin Sample = -0.5
+	SampleMax Sample = 1023.0/1024.0 - 0.5
+)
+
+// Returns the number of samples at the limits of the ADC range.
+func ClippedSamples(samples []Sample) int {
+	n := 0
+	for _, s := range samples {
+		if s <= SampleMin || s >= SampleMax {
+			n++
+		}
 	}
-	initial := c.settings()
-	c.setSettings(initial|settingsTrigNow, true)
-	c.setSettings(initial & ^settingsTrigNow, true)
+	return n
 }
 
-// Converts encoded data samples to float measurements.
-// Exported for testing.
-func (c *Adc) ProcessTraceData(data []byte) []float64 {
-	glog.V(1).Infof("Processing %d trace data samples", len(data))
+// Converts encoded data samples to float measurements, keeping the
+// pre-trigger samples set with SetPreTriggerSamples.
+// Exported for testing. Deprecated: use TraceDataDecoder, configured with
+// TraceDataDecoderConfig.
+func (c *Adc) ProcessTraceData(data []byte) []Sample {
+	var measurements []Sample
+	measurements, c.err = DecodeTraceData(data, int(c.presamples))
+	return measurements
+}
 
-	offset := float64(0.5)
-	glog.V(1).Infof("Trigger offset (hardcoded): %v", offset)
+// Returns the trace decoder configuration of the current settings.
+func (c *Adc) TraceDataDecoderConfig() TraceDataDecoderConfig {
+	cfg := DefaultTraceDataDecoderConfig()
+	cfg.PreTriggerSamples = int(c.presamples)
+	return cfg
+}
 
-	if len(data) < 4 || len(data)%4 != 0 {
-		c.err = fmt.Errorf("Unexpected data length (%v)", len(data))
-		return nil
-	}
+func (c *Adc) Diagnostics() AdcDiagnostics {
+	return c.diag
+}
 
-	if data[0] != 0xac {
-		c.err = fmt.Errorf("Unexpected sync byte %x", data[0])
-		return nil
+// Counts a failed capture, and recovers the ADC once it appears to be stuck
+// (armed but never fires, or the FIFO never fills).
+// Returns true if the ADC was reset.
+func (c *Adc) watchdog() bool {
+	c.stuckCount++
+	if c.stuckCount < adcWatchdogLimit {
+		return false
 	}
+	glog.Warningf("ADC stuck for %d captures. Resetting", c.stuckCount)
+	c.recover()
+	return true
+}
 
-	var measurements []float64
-	triggerFound := false
-	for i := 1; i < len(data)-3; i += 4 {
-		// Read off 4 bytes
-		var word uint32
-		r := bytes.NewReader(data[i : i+4])
-		if c.err = binary.Read(r, binary.BigEndian, &word); c.err != nil {
-			return nil
-		}
+// Resets the ADC state machine, and re-locks the DCMs if needed.
+// Capture settings are restored after the reset.
+func (c *Adc) recover() {
+	c.stuckCount = 0
+	c.diag.Resets++
 
-		// Convert to float samples.
-		w1 := word & 0x3ff
-		w2 := (word >> 10) & 0x3ff
-		w3 := (word >> 20) & 0x3ff
-
-		m1 := float64(w1)/1024.0 - offset
-		m2 := float64(w2)/1024.0 - offset
-		m3 := float64(w3)/1024.0 - offset
-
-		// Skip samples before the trigger.
-		trigger := word >> 30
-		if !triggerFound {
-			// trigger = 3 -> []
-			// trigger = 2 -> [m3]
-			// trigger = 1 -> [m2, m3]
-			// trigger = 0 -> [m1, m2, m3]
-			if trigger == 3 {
-				glog.V(2).Infof("Skipping sample %d (%x) before trigger", i, word)
-				continue
-			}
-			if trigger < 3 {
-				measurements = append(measurements, m3)
-			}
-			if trigger < 2 {
-				measurements = append(measurements, m2)
-			}
-			if trigger < 1 {
-				measurements = append(measurements, m1)
-			}
-			triggerFound = true
-			continue
-		}
-		measurements = append(measurements, m1)
-		measurements = append(measurements, m2)
-		measurements = append(measurements, m3)
+	samples := c.TotalSamples()
+	offset := c.TriggerOffset()
+	presamples := c.PreTriggerSamples()
+	decimate := c.DownsampleFactor()
+	segments := c.Segments()
+
+	c.SetArmOff()
+	c.setResetOn()
+	c.setResetOff()
+	if !c.DcmLocked() || !c.ClkGenDcmLocked() {
+		glog.Warning("DCM unlocked. Resetting clocks")
+		c.diag.DcmRelocks++
+		c.resetClkGen()
+		c.resetAdc()
+	}
+
+	c.SetTotalSamples(samples)
+	c.SetTriggerOffset(offset)
+	c.SetPreTriggerSamples(presamples)
+	c.SetDownsampleFactor(decimate)
+	c.segments = 0
+	c.SetSegments(segments)
+	if c.err != nil {
+		c.err = fmt.Errorf("ADC recovery failed: %v", c.err)
 	}
-	// TODO: handle PreTriggerSamples.
-	return measurements
 }
 
 func (c *Adc) setResetOn() {
@@ -1250,7 +1635,14 @@ func (c *Adc) setResetOn() {
 
 	// HACK: adjust max samples, since the number should be smaller than what
 	// is being returned.
-	c.hwMaxSamples = c.numSamples() - 45
+	// The samples register holds the buffer size after a reset. Kept as is if
+	// the read failed, rather than wrapping around.
+	if max := c.numSamples(); max > 45 {
+		c.hwMaxSamples = max - 45
+	} else if c.err == nil {
+		c.err = fmt.Errorf("Unexpected sample buffer size %d", max)
+		return
+	}
 	c.setNumSamples(c.hwMaxSamples)
 }
 
@@ -1275,15 +1667,21 @@ func (c *Adc) refreshParams() {
 	c.SetClkGenOutputFreq(c.ClkGenOutputFreq())
 }
 
-func (c *Adc) defaultSetup() {
-	if c.Version().HwType == HwChipWhispererLite {
-		glog.V(1).Infof("[adc] default setup for CWLite")
-		c.SetGain(45)
+// Gain and clocks are left as is if they were set from a device profile.
+func (c *Adc) defaultSetup(fromProfile bool) {
+	// Same defaults as the ChipWhisperer-Lite on the ChipWhisperer-Pro.
+	if hw := c.Version().HwType; hw == HwChipWhispererLite || hw == HwChipWhispererCw1200 {
+		glog.V(1).Infof("[adc] default setup for %v", hw)
+		if !fromProfile {
+			c.SetGain(45)
+		}
 		c.SetTotalSamples(3000)
 		c.SetTriggerOffset(0)
 		c.SetTriggerMode(TriggerModeRisingEdge)
-		c.SetClkGenOutputFreq(7370000)
-		c.SetAdcClockSource(AdcSrcClkGenX4ViaDcm)
+		if !fromProfile {
+			c.SetClkGenOutputFreq(7370000)
+			c.SetAdcClockSource(AdcSrcClkGenX4ViaDcm)
+		}
 		c.SetTriggerTargetIoPin(TriggerTargetIoPin4)
 		c.SetTargetIo1(TargetIoModeSerialRx)
 		c.SetTargetIo2(TargetIoModeSerialTx)
@@ -1291,16 +1689,74 @@ func (c *Adc) defaultSetup() {
 	}
 }
 
-func NewAdc(fpga *Fpga) (*Adc, error) {
-	c := &Adc{fpga, nil, 0, 10e6}
+// Applies the saved device profile, if there is one.
+// Returns false if no profile was applied.
+func (c *Adc) loadProfile() bool {
+	if c.err != nil || len(c.serial) == 0 {
+		return false
+	}
+	p, err := LoadDeviceProfile(c.serial)
+	if err != nil {
+		glog.Warningf("Ignoring device profile: %v", err)
+		return false
+	}
+	if p == nil {
+		return false
+	}
+	if !c.applyProfile(p) {
+		glog.Warningf("DCMs did not lock with saved profile. Using default setup")
+		c.err = nil
+		return false
+	}
+	glog.V(1).Infof("[adc] applied profile of device %s", c.serial)
+	return true
+}
 
+func NewAdc(fpga *Fpga) (*Adc, error) {
+	c, err := AttachAdc(fpga)
+	if err != nil {
+		return nil, err
+	}
 	c.setResetOn()
 	c.setResetOff()
 	c.refreshParams()
-	c.defaultSetup()
+	c.defaultSetup(c.loadProfile())
 
 	if c.err != nil {
 		return nil, c.err
 	}
 	return c, nil
 }
+
+// Returns the ADC without resetting or setting it up, e.g. to inspect the
+// settings left by the last capture (see DeviceState).
+func AttachAdc(fpga *Fpga) (*Adc, error) {
+	c := &Adc{fpga: fpga, extClockFreq: 10e6, readPadding: DefaultTraceReadPadding}
+	if d, ok := fpga.dev.(serialNumberer); ok {
+		if serial, err := d.SerialNumber(); err == nil {
+			c.serial = serial
+		} else {
+			glog.Warningf("Failed reading device serial number: %v", err)
+		}
+	}
+
+	c.caps.Hw = c.Version()
+	if err := fpga.dev.ControlIn(ReqFwVersion, 0, &c.caps.Fw); err != nil {
+		return nil, fmt.Errorf("Failed reading FW version: %v", err)
+	}
+	glog.V(1).Infof("[adc] hardware %+v, firmware %+v", c.caps.Hw, c.caps.Fw)
+	if model := modelOf(fpga.dev); c.caps.Hw.HwType != deviceSpec(model).HwType {
+		glog.Warningf("Bitstream reports hardware type %v, expected %v for %v",
+			c.caps.Hw.HwType, deviceSpec(model).HwType, model)
+	}
+
+	var err error
+	if c.regMap, err = regmap.Load(int(c.caps.Hw.HwType), c.caps.Hw.RegVersion); err != nil {
+		return nil, err
+	}
+	if c.regs, err = newAdcRegisters(c.regMap); err != nil {
+		return nil, err
+	}
+	glog.V(1).Infof("[adc] using register map %s", c.regMap.Name)
+	return c, nil
+}
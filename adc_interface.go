@@ -16,23 +16,28 @@
 package gocw
 
 import (
+	"context"
 	"io"
+	"time"
+
+	"github.com/google/gocw/types"
 )
 
-//go:generate stringer -type HwType
-type HwType int
+// Enums of the ADC settings. They are defined in package types, with parsing
+// and text marshaling.
+type HwType = types.HwType
 
 const (
-	HwUnknown               HwType = iota
-	HwLx9MicroBoard         HwType = iota
-	HwSaseboW               HwType = iota
-	HwChipWhispererRev2Lx25 HwType = iota
-	HwReserved              HwType = iota
-	HwZedBoard              HwType = iota
-	HwPapilioPro            HwType = iota
-	HwSakuraG               HwType = iota
-	HwChipWhispererLite     HwType = iota
-	HwChipWhispererCw1200   HwType = iota
+	HwUnknown               = types.HwUnknown
+	HwLx9MicroBoard         = types.HwLx9MicroBoard
+	HwSaseboW               = types.HwSaseboW
+	HwChipWhispererRev2Lx25 = types.HwChipWhispererRev2Lx25
+	HwReserved              = types.HwReserved
+	HwZedBoard              = types.HwZedBoard
+	HwPapilioPro            = types.HwPapilioPro
+	HwSakuraG               = types.HwSakuraG
+	HwChipWhispererLite     = types.HwChipWhispererLite
+	HwChipWhispererCw1200   = types.HwChipWhispererCw1200
 )
 
 type HwVersion struct {
@@ -41,38 +46,34 @@ type HwVersion struct {
 	HwVersion  uint8
 }
 
-//go:generate stringer -type GainMode
-type GainMode int
+type GainMode = types.GainMode
 
 const (
-	GainModeHigh GainMode = iota
-	GainModeLow  GainMode = iota
+	GainModeHigh = types.GainModeHigh
+	GainModeLow  = types.GainModeLow
 )
 
-//go:generate stringer -type TriggerMode
-type TriggerMode int
+type TriggerMode = types.TriggerMode
 
 const (
-	TriggerModeRisingEdge  TriggerMode = iota
-	TriggerModeFallingEdge TriggerMode = iota
-	TriggerModeLow         TriggerMode = iota
-	TriggerModeHigh        TriggerMode = iota
+	TriggerModeRisingEdge  = types.TriggerModeRisingEdge
+	TriggerModeFallingEdge = types.TriggerModeFallingEdge
+	TriggerModeLow         = types.TriggerModeLow
+	TriggerModeHigh        = types.TriggerModeHigh
 )
 
-//go:generate stringer -type AdcSrc
-type AdcSrc int
+type AdcSrc = types.AdcSrc
 
 const (
-	AdcSrcDcm    AdcSrc = iota
-	AdcSrcExtClk AdcSrc = iota
+	AdcSrcDcm    = types.AdcSrcDcm
+	AdcSrcExtClk = types.AdcSrcExtClk
 )
 
-//go:generate stringer -type DcmInput
-type DcmInput int
+type DcmInput = types.DcmInput
 
 const (
-	DcmInputClkGen DcmInput = iota
-	DcmInputExtClk DcmInput = iota
+	DcmInputClkGen = types.DcmInputClkGen
+	DcmInputExtClk = types.DcmInputExtClk
 )
 
 type AdcSrcTuple struct {
@@ -98,62 +99,104 @@ var AdcSrcClkGenX1ViaDcm = AdcSrcTuple{
 	AdcSrcDcm, 1, DcmInputClkGen,
 }
 
-//go:generate stringer -type FreqCounterSrc
-type FreqCounterSrc int
+type FreqCounterSrc = types.FreqCounterSrc
+
+const (
+	FreqCounterExtClkInput  = types.FreqCounterExtClkInput
+	FreqCounterClkGenOutput = types.FreqCounterClkGenOutput
+)
+
+type ClkGenInputSrc = types.ClkGenInputSrc
 
 const (
-	FreqCounterExtClkInput  FreqCounterSrc = iota
-	FreqCounterClkGenOutput FreqCounterSrc = iota
+	ClkGenInputSystem = types.ClkGenInputSystem
+	ClkGenInputExtClk = types.ClkGenInputExtClk
 )
 
-//go:generate stringer -type ClkGenInputSrc
-type ClkGenInputSrc int
+type TriggerTargetIoPin = types.TriggerTargetIoPin
 
 const (
-	ClkGenInputSystem ClkGenInputSrc = iota
-	ClkGenInputExtClk ClkGenInputSrc = iota
+	TriggerTargetIoPin1 = types.TriggerTargetIoPin1
+	TriggerTargetIoPin2 = types.TriggerTargetIoPin2
+	TriggerTargetIoPin3 = types.TriggerTargetIoPin3
+	TriggerTargetIoPin4 = types.TriggerTargetIoPin4
+	// Target nRST.
+	TriggerTargetIoPinNrst = types.TriggerTargetIoPinNrst
 )
 
-//go:generate stringer -type TriggerTargetIoPin
-type TriggerTargetIoPin int
+type TriggerPinLogic = types.TriggerPinLogic
 
 const (
-	TriggerTargetIoPin1 TriggerTargetIoPin = iota
-	TriggerTargetIoPin2 TriggerTargetIoPin = iota
-	TriggerTargetIoPin3 TriggerTargetIoPin = iota
-	TriggerTargetIoPin4 TriggerTargetIoPin = iota
+	TriggerPinOr   = types.TriggerPinOr
+	TriggerPinAnd  = types.TriggerPinAnd
+	TriggerPinNand = types.TriggerPinNand
 )
 
-//go:generate stringer -type TargetIoMode
-type TargetIoMode int
+type TargetIoMode = types.TargetIoMode
 
 const (
-	TargetIoModeSerialRx     TargetIoMode = iota
-	TargetIoModeSerialTx     TargetIoMode = iota
-	TargetIoModeHighZ        TargetIoMode = iota
-	TargetIoModeGpioLow      TargetIoMode = iota
-	TargetIoModeGpioHigh     TargetIoMode = iota
-	TargetIoModeGpioDisabled TargetIoMode = iota
+	TargetIoModeSerialRx     = types.TargetIoModeSerialRx
+	TargetIoModeSerialTx     = types.TargetIoModeSerialTx
+	TargetIoModeHighZ        = types.TargetIoModeHighZ
+	TargetIoModeGpioLow      = types.TargetIoModeGpioLow
+	TargetIoModeGpioHigh     = types.TargetIoModeGpioHigh
+	TargetIoModeGpioDisabled = types.TargetIoModeGpioDisabled
 )
 
-//go:generate stringer -type Hs2Mode
-type Hs2Mode int
+type Hs2Mode = types.Hs2Mode
 
 const (
-	Hs2ModeDisabled Hs2Mode = iota
-	Hs2ModeClkGen   Hs2Mode = iota
-	Hs2ModeGlitch   Hs2Mode = iota
+	Hs2ModeDisabled = types.Hs2ModeDisabled
+	Hs2ModeClkGen   = types.Hs2ModeClkGen
+	Hs2ModeGlitch   = types.Hs2ModeGlitch
 )
 
-//go:generate stringer -type GpioMode
-type GpioMode int
+type GpioMode = types.GpioMode
 
 const (
-	GpioLow      GpioMode = iota
-	GpioHigh     GpioMode = iota
-	GpioDisabled GpioMode = iota
+	GpioLow      = types.GpioLow
+	GpioHigh     = types.GpioHigh
+	GpioDisabled = types.GpioDisabled
 )
 
+// Counters of capture failures handled by the ADC watchdog.
+type AdcDiagnostics struct {
+	// Captures where the trigger did not fire in time.
+	TriggerTimeouts int
+	// Trace reads that found the FIFO empty.
+	EmptyReads int
+	// Times the ADC state machine was reset after getting stuck.
+	Resets int
+	// Times an unlocked DCM was reset during recovery.
+	DcmRelocks int
+	// Clock checks during a capture that found an unlocked DCM or a drifted
+	// ADC frequency.
+	ClockUnlocks int
+	// Trace reads that stayed short after retries, see ShortReadError.
+	ShortReads int
+	// Trace reads after a FIFO overflow.
+	Overflows int
+	// Trace reads with clipped samples, see TraceRead.Clipped.
+	ClippedReads int
+}
+
+// Default extra bytes read by TraceData, see SetTraceReadPadding.
+const DefaultTraceReadPadding = 256
+
+// Sizes of a TraceData read.
+type TraceRead struct {
+	// Samples requested (all segments).
+	Samples int
+	// Bytes requested, and actually read.
+	Bytes, BytesRead int
+	// Valid samples decoded. Fewer than Samples if the read came up short.
+	Decoded int
+	// Samples at the limits of the ADC range, i.e. the gain is too high.
+	Clipped int
+	// The FIFO overflowed during the capture, samples may be garbage.
+	Overflow bool
+}
+
 //go:generate mockgen -destination=mocks/adc.go -package=mocks github.com/google/gocw AdcInterface
 type AdcInterface interface {
 	io.Closer
@@ -162,6 +205,8 @@ type AdcInterface interface {
 	// Hardware information.
 	//
 	Version() HwVersion
+	// Features supported by the hardware and firmware.
+	Capabilities() Capabilities
 	SysFreq() uint32
 	MaxSamples() uint32
 	//
@@ -175,8 +220,11 @@ type AdcInterface interface {
 	Gain() uint8
 	// Sets the AD8331 gain value.
 	// This is a unitless number which ranges from 0 (minimum) to 78 (maximum).
-	// The resulting gain in dB is given in the "calculated" output.
+	// The resulting gain in dB is given by GainDb.
 	SetGain(gain uint8)
+	// Gain in dB, set with the closest gain mode and gain, see GainSetting.
+	GainDb() float64
+	SetGainDb(db float64)
 	// Gives the status of the digital signal being used as the trigger signal,
 	// either high or low.
 	TriggerPinState() bool
@@ -239,6 +287,13 @@ type AdcInterface interface {
 	// ADC Sample Rate. Takes account of decimation factor (if set).
 	AdcSampleRate() uint32
 	DcmLocked() bool
+	// Fine phase adjustment of the ADC sample clock relative to its DCM input,
+	// e.g. the target clock, in DCM phase shift steps
+	// [AdcPhaseMin, AdcPhaseMax]. Tuning it moves the sampling points away
+	// from the clock edges. Only applies to the DCM sources of
+	// AdcClockSource.
+	AdcPhase() int
+	SetAdcPhase(phase int)
 	// Freq Counter: Frequency of clock measured on EXTCLOCK pin in Hz.
 	FreqCounter() uint32
 	FreqCounterSource() FreqCounterSrc
@@ -275,6 +330,10 @@ type AdcInterface interface {
 	ClkGenOutputFreq() uint32
 	SetClkGenOutputFreq(freq uint32)
 	ClkGenDcmLocked() bool
+	// Drives the target clock from CLKGEN on HS2 (XMEGA targets), and tunes
+	// CLKGEN until the clock measured by the frequency counter is within
+	// tolerance (relative) of freq. Reports the achieved frequency.
+	SetTargetClock(freq uint32, tolerance float64) (TargetClock, error)
 	// The logical input into the trigger module.
 	//
 	// The trigger module uses some combination of the scope's I/O pins to
@@ -283,7 +342,17 @@ type AdcInterface interface {
 	// different boolean operations.
 	//
 	TriggerTargetIoPins() []TriggerTargetIoPin
+	TriggerPinLogic() TriggerPinLogic
+	// Triggers on a single pin.
 	SetTriggerTargetIoPin(pin TriggerTargetIoPin)
+	// Triggers on a boolean combination of pins.
+	SetTriggerTargetIoPins(pins []TriggerTargetIoPin, logic TriggerPinLogic)
+	// Module driving the capture trigger, see TriggerModule.
+	TriggerModule() TriggerModule
+	SetTriggerModule(m TriggerModule)
+	// Serial data pattern trigger (CW1200 only), see DecodeTrigger.
+	DecodeTrigger() DecodeTrigger
+	SetDecodeTrigger(t DecodeTrigger)
 	//
 	// GPIO settings.
 	//
@@ -293,6 +362,12 @@ type AdcInterface interface {
 	// Thr function of the Target IO2 pin.
 	TargetIo2() TargetIoMode
 	SetTargetIo2(mode TargetIoMode)
+	// The function of the Target IO3 and IO4 pins, e.g. serial RX for the
+	// target debug output, see StartDebugOutput.
+	TargetIo3() TargetIoMode
+	SetTargetIo3(mode TargetIoMode)
+	TargetIo4() TargetIoMode
+	SetTargetIo4(mode TargetIoMode)
 	// Special GPIO: NRST
 	NRST() GpioMode
 	SetNRST(mode GpioMode)
@@ -305,11 +380,64 @@ type AdcInterface interface {
 	// The clock signal routed to the HS2 high speed output pin.
 	Hs2() Hs2Mode
 	SetHs2(mode Hs2Mode)
+	// Pulse on trigger, for external fault injection probes. Uses HS2.
+	TriggerPulse() TriggerPulse
+	SetTriggerPulse(p TriggerPulse)
+	DisableTriggerPulse()
+	// Clock glitch module, see Glitch.
+	Glitch() Glitch
+	SetGlitch(g Glitch)
+	ManualGlitch()
+	DisableGlitch()
+	// Voltage glitches, see Crowbar.
+	Crowbar(m Crowbar) bool
+	SetCrowbar(m Crowbar, enabled bool)
+	SetVoltageGlitch(g Glitch, crowbars ...Crowbar)
+	// Target supply, see PowerCycle.
+	TargetPowered() bool
+	PowerOn()
+	PowerOff()
+	// Switches the target off for the given time, and on again.
+	PowerCycle(off time.Duration)
 	//
 	// Capture settings.
 	//
 	SetArmOn()
 	SetArmOff()
+	// Disarms even after an error, keeping the error.
+	Disarm()
+	// Triggers an armed capture immediately.
+	ForceTrigger()
+	// Arms, forces a trigger after delay, and returns the samples.
+	CaptureOnce(delay time.Duration) []Sample
+	// Waits for the trigger, and returns true if it timed out. Forces a
+	// trigger on timeout, or resets the ADC if it appears to be stuck.
 	WaitForTigger() bool
-	TraceData() []float64
+	// Same as WaitForTigger, returning early and disarming when ctx is done.
+	// Error then returns the context error.
+	WaitForTriggerContext(ctx context.Context) bool
+	// Reads the samples of the last capture, see LastTraceRead for short
+	// reads, clipping and FIFO overflows.
+	TraceData() []Sample
+	TraceDataContext(ctx context.Context) []Sample
+	// Same as TraceDataContext, delivering the samples over a channel as
+	// they are read and decoded. The Adc must not be used until the channel
+	// is closed.
+	TraceDataStream(ctx context.Context) <-chan []Sample
+	SetTraceReadPadding(bytes int)
+	TraceReadPadding() int
+	LastTraceRead() TraceRead
+	// Logic capture of the TIO pins, where supported by the bitstream.
+	SetLogicCapture(ch LogicChannels)
+	LogicCapture() LogicChannels
+	LogicData() []uint8
+	// Segmented capture, where supported by the bitstream.
+	SetSegments(n int)
+	Segments() int
+	// Reads the samples of the last capture, one trace per segment.
+	SegmentData() [][]Sample
+	SegmentDataContext(ctx context.Context) [][]Sample
+	Diagnostics() AdcDiagnostics
+	ClockStatus() ClockStatus
+	DeviceState() DeviceState
 }
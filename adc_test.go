@@ -16,6 +16,8 @@ package gocw_test
 
 import (
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"reflect"
 	"testing"
 
@@ -38,7 +40,7 @@ func TestProcessData(t *testing.T) {
 		"0ea047c1fea65966389d6836699f37f9d4a5d8f207a119b269a00759dca40829f3a6b9a25e9de786" +
 		"0f9e77c9f3a58899dfa749966a9fe852369fe7b9dda00855caa598da1ba6493a58a488e634a0d8e6" +
 		"4e9f7912139f7809faa368fa16a4786a15a047f1faa4186df8a1a84635a017fa4aa1b7f207a1b8e2"
-	var expected = []float64{
+	var expected = []gocw.Sample{
 		0.0302734375, 0.0283203125, 0.013671875, 0.052734375, 0.021484375, 0.0087890625,
 		0.015625, -0.0205078125, 0.009765625, 0.0302734375, 0.0, 0.005859375, 0.001953125,
 		0.0537109375, 0.0615234375, -0.0068359375, -0.025390625, -0.0302734375, 0.044921875,
@@ -96,3 +98,162 @@ func TestProcessData(t *testing.T) {
 		t.Errorf("Actual processed data did not match expected")
 	}
 }
+
+func TestDecodeTraceDataPreTrigger(t *testing.T) {
+	// Sample values are their index, trigger at sample 7 (word 2, position 1).
+	data := []byte{0xac}
+	for w := 0; w < 4; w++ {
+		pos := uint32(3)
+		if w == 2 {
+			pos = 1
+		} else if w > 2 {
+			pos = 0
+		}
+		word := pos<<30 | uint32(3*w+2)<<20 | uint32(3*w+1)<<10 | uint32(3*w)
+		data = append(data, byte(word>>24), byte(word>>16), byte(word>>8), byte(word))
+	}
+	// Pads to a multiple of 4 bytes, as read from the FIFO.
+	data = append(data, 0, 0, 0)
+	samples := func(first, last int) []gocw.Sample {
+		var res []gocw.Sample
+		for i := first; i <= last; i++ {
+			res = append(res, gocw.Sample(float64(i)/1024.0-0.5))
+		}
+		return res
+	}
+
+	for _, tc := range []struct {
+		presamples int
+		expected   []gocw.Sample
+	}{
+		{0, samples(7, 11)},
+		{1, samples(6, 11)},
+		{4, samples(3, 11)},
+		{7, samples(0, 11)},
+		// Fewer pre-trigger samples were recorded.
+		{9, samples(0, 11)},
+	} {
+		actual, err := gocw.DecodeTraceData(data, tc.presamples)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("Decoded %v with %d pre-trigger samples, expected %v",
+				actual, tc.presamples, tc.expected)
+		}
+	}
+
+	// No trigger.
+	noTrigger := append(append([]byte(nil), data[:9]...), 0, 0, 0)
+	if actual, err := gocw.DecodeTraceData(noTrigger, 3); err != nil || actual != nil {
+		t.Errorf("Decoded %v, %v without trigger, expected no samples", actual, err)
+	}
+}
+
+func TestClippedSamples(t *testing.T) {
+	// Codes 0 and 0x3ff are the limits of the ADC range.
+	data := []byte{0xac}
+	word := uint32(0)<<30 | 0x3ff<<20 | 0x200<<10 | 0x000
+	data = append(data, byte(word>>24), byte(word>>16), byte(word>>8), byte(word), 0, 0, 0)
+	samples, err := gocw.DecodeTraceData(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []gocw.Sample{gocw.SampleMin, 0, gocw.SampleMax}
+	if !reflect.DeepEqual(samples, expected) {
+		t.Errorf("Decoded %v, expected %v", samples, expected)
+	}
+	if n := gocw.ClippedSamples(samples); n != 2 {
+		t.Errorf("%d clipped samples, expected 2", n)
+	}
+}
+
+func TestSplitSegments(t *testing.T) {
+	samples := []gocw.Sample{0, 1, 2, 3, 4, 5, 6}
+	want := [][]gocw.Sample{{0, 1, 2}, {3, 4, 5}}
+	segments := gocw.SplitSegments(samples, 3)
+	if !reflect.DeepEqual(segments, want) {
+		t.Errorf("SplitSegments(%v, 3) = %v, want %v", samples, segments, want)
+	}
+	// Segments don't share capacity, so appending to one doesn't overwrite
+	// the next one.
+	segments[0] = append(segments[0], 9)
+	if segments[1][0] != 3 {
+		t.Errorf("Appending to segment 0 modified segment 1: %v", segments[1])
+	}
+	if segments := gocw.SplitSegments(samples, 0); segments != nil {
+		t.Errorf("SplitSegments(%v, 0) = %v, want nil", samples, segments)
+	}
+}
+
+// A programmed FPGA reporting hwType, with all other registers reading zero.
+// Fails register writes.
+type versionDevice struct {
+	hwType gocw.HwType
+	addr   uint32
+	writes int
+}
+
+func (d *versionDevice) Read(p []byte) (int, error)  { return 0, fmt.Errorf("Unexpected bulk read") }
+func (d *versionDevice) Write(p []byte) (int, error) { return 0, fmt.Errorf("Unexpected bulk write") }
+func (d *versionDevice) Close() error                { return nil }
+
+func (d *versionDevice) ControlIn(request gocw.Request, val uint16, data interface{}) error {
+	switch v := data.(type) {
+	case *uint32:
+		*v = 1
+	case *gocw.FwVersion:
+		*v = gocw.FwVersion{Major: 0, Minor: 11}
+	case []byte:
+		for i := range v {
+			v[i] = 0
+		}
+		if d.addr == 10 && len(v) > 1 {
+			v[1] = byte(d.hwType) << 3
+		}
+	}
+	return nil
+}
+
+func (d *versionDevice) ControlOut(request gocw.Request, val uint16, data interface{}) error {
+	switch request {
+	case gocw.ReqMemReadCtrl:
+		d.addr = data.(*gocw.AddressBlock).Addr
+	case gocw.ReqMemWriteCtrl, gocw.ReqMemWriteBulk:
+		d.writes++
+		return fmt.Errorf("Unexpected register write")
+	}
+	return nil
+}
+
+func TestSetSegmentsNeedsRegister(t *testing.T) {
+	for _, hw := range []gocw.HwType{gocw.HwChipWhispererLite, gocw.HwChipWhispererCw1200} {
+		m, err := gocw.LoadRegisterMap(hw, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.Lookup("segments"); err == nil {
+			t.Skipf("The %v register map has a segments register", hw)
+		}
+
+		dev := &versionDevice{hwType: hw}
+		fpga, err := gocw.AttachFpga(dev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		adc, err := gocw.AttachAdc(fpga)
+		if err != nil {
+			t.Fatal(err)
+		}
+		adc.SetSegments(2)
+		if err := adc.Error(); !errors.Is(err, gocw.ErrNotSupported) {
+			t.Errorf("%v SetSegments(2) = %v, want ErrNotSupported", hw, err)
+		}
+		if dev.writes != 0 {
+			t.Errorf("%v SetSegments(2) wrote %d registers", hw, dev.writes)
+		}
+		if adc.Segments() != 1 {
+			t.Errorf("%v has %d segments after a failed SetSegments, want 1", hw, adc.Segments())
+		}
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis_test
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/google/gocw/analysis"
+)
+
+func TestKeySchedule(t *testing.T) {
+	// FIPS-197 appendix A.1.
+	var key [16]byte
+	hex.Decode(key[:], []byte("2b7e151628aed2a6abf7158809cf4f3c"))
+	rk := analysis.ExpandKey(key)
+	if actual := hex.EncodeToString(rk[10][:]); actual != "d014f9a8c9ee2589e13f0cc8b6630ca6" {
+		t.Errorf("Round 10 key %s did not match expected", actual)
+	}
+	for r := 0; r <= 10; r++ {
+		if actual := analysis.InvertKeySchedule(rk[r], r); actual != key {
+			t.Errorf("Key recovered from round %d key: %x", r, actual)
+		}
+	}
+}
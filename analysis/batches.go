@@ -0,0 +1,209 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Shuffled mini-batches of a capture, for training models.
+// A BatchIterator reads traces from a TraceSource, e.g. a gocw.CaptureSet too
+// large for memory, and yields Datasets of a sample window and the labels of
+// each trace. Batches are prepared ahead in the background.
+// Shuffling uses a buffer of ShuffleBuffer traces filled in index order, so a
+// CaptureSet loads each of its files once per epoch. A buffer as large as
+// the capture shuffles it completely.
+package analysis
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/google/gocw"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// Random access to traces. Implemented by *gocw.CaptureSet and CaptureSource.
+type TraceSource interface {
+	Len() (int, error)
+	Trace(i int) (*gocw.Trace, error)
+}
+
+// Adapts an in-memory capture to TraceSource.
+type CaptureSource gocw.Capture
+
+func (c CaptureSource) Len() (int, error) {
+	return len(c), nil
+}
+
+func (c CaptureSource) Trace(i int) (*gocw.Trace, error) {
+	if i < 0 || i >= len(c) {
+		return nil, fmt.Errorf("Trace index %d out of range", i)
+	}
+	return &c[i], nil
+}
+
+type BatchOptions struct {
+	// Traces per batch. The last batch may be smaller.
+	Size int
+	// Sample window [Start, End). End zero for the end of the traces.
+	Start, End int
+	Labelers   []Labeler
+	// Shuffles the traces with Rng, unless nil. Rng is used by the
+	// background goroutine until the iterator is done.
+	Rng           *rand.Rand
+	ShuffleBuffer int
+	// Number of batches prepared ahead.
+	Prefetch int
+}
+
+func DefaultBatchOptions() BatchOptions {
+	return BatchOptions{Size: 256, ShuffleBuffer: 10000, Prefetch: 2}
+}
+
+type batchResult struct {
+	batch *Dataset
+	err   error
+}
+
+// Yields the batches of one epoch. Baseline traces are skipped.
+type BatchIterator struct {
+	batches chan batchResult
+	done    chan struct{}
+}
+
+func NewBatchIterator(src TraceSource, opts BatchOptions) (*BatchIterator, error) {
+	if opts.Size <= 0 {
+		return nil, fmt.Errorf("Invalid batch size %d", opts.Size)
+	}
+	if opts.Start < 0 || (opts.End > 0 && opts.End <= opts.Start) {
+		return nil, fmt.Errorf("Invalid sample window [%d, %d)", opts.Start, opts.End)
+	}
+	if opts.ShuffleBuffer < 1 || opts.Rng == nil {
+		opts.ShuffleBuffer = 1
+	}
+	if opts.Prefetch < 0 {
+		opts.Prefetch = 0
+	}
+	n, err := src.Len()
+	if err != nil {
+		return nil, err
+	}
+	it := &BatchIterator{
+		batches: make(chan batchResult, opts.Prefetch),
+		done:    make(chan struct{}),
+	}
+	go it.run(src, n, opts)
+	return it, nil
+}
+
+// Sends a result, unless the iterator was closed. Returns false if closed.
+func (it *BatchIterator) send(r batchResult) bool {
+	select {
+	case it.batches <- r:
+		return true
+	case <-it.done:
+		return false
+	}
+}
+
+func (it *BatchIterator) run(src TraceSource, n int, opts BatchOptions) {
+	defer close(it.batches)
+	var buffer, batch gocw.Capture
+	// Takes a trace from the shuffle buffer into the batch, and sends the
+	// batch once full.
+	take := func() bool {
+		i := len(buffer) - 1
+		if opts.Rng != nil {
+			i = opts.Rng.Intn(len(buffer))
+		}
+		batch = append(batch, buffer[i])
+		buffer[i] = buffer[len(buffer)-1]
+		buffer = buffer[:len(buffer)-1]
+		if len(batch) < opts.Size {
+			return true
+		}
+		b, err := newBatch(batch, opts)
+		batch = nil
+		return it.send(batchResult{b, err}) && err == nil
+	}
+	for i := 0; i < n; i++ {
+		t, err := src.Trace(i)
+		if err != nil {
+			it.send(batchResult{nil, err})
+			return
+		}
+		if t.Baseline {
+			continue
+		}
+		buffer = append(buffer, *t)
+		if len(buffer) == opts.ShuffleBuffer && !take() {
+			return
+		}
+	}
+	// Without shuffling, the buffer holds a single trace.
+	for len(buffer) > 0 {
+		if !take() {
+			return
+		}
+	}
+	if len(batch) > 0 {
+		b, err := newBatch(batch, opts)
+		it.send(batchResult{b, err})
+	}
+}
+
+func newBatch(c gocw.Capture, opts BatchOptions) (*Dataset, error) {
+	end := opts.End
+	if end == 0 {
+		end = len(c[0].PowerMeasurements)
+		if end <= opts.Start {
+			return nil, fmt.Errorf("Trace with %d samples, window starts at %d", end, opts.Start)
+		}
+	}
+	cols := end - opts.Start
+	data := make([]float64, len(c)*cols)
+	for i := range c {
+		if len(c[i].PowerMeasurements) < end {
+			return nil, fmt.Errorf("Trace with %d samples, window ends at %d", len(c[i].PowerMeasurements), end)
+		}
+		for j, s := range c[i].PowerMeasurements[opts.Start:end] {
+			data[i*cols+j] = float64(s)
+		}
+	}
+	d := &Dataset{X: mat.NewDense(len(c), cols, data), Traces: c}
+	if len(opts.Labelers) > 0 {
+		d.Y = mat.NewDense(len(c), len(opts.Labelers), nil)
+		for i := range c {
+			for j, l := range opts.Labelers {
+				d.Y.Set(i, j, l(&c[i]))
+			}
+		}
+	}
+	return d, nil
+}
+
+// Returns the next batch, or nil at the end of the epoch.
+func (it *BatchIterator) Next() (*Dataset, error) {
+	r, ok := <-it.batches
+	if !ok {
+		return nil, nil
+	}
+	return r.batch, r.err
+}
+
+// Stops preparing batches. Required unless Next returned nil or an error.
+func (it *BatchIterator) Close() {
+	select {
+	case <-it.done:
+	default:
+		close(it.done)
+	}
+}
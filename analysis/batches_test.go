@@ -0,0 +1,126 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis_test
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/google/gocw"
+	"github.com/google/gocw/analysis"
+)
+
+func collectBatches(t *testing.T, src analysis.TraceSource, opts analysis.BatchOptions) []*analysis.Dataset {
+	it, err := analysis.NewBatchIterator(src, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	var batches []*analysis.Dataset
+	for {
+		b, err := it.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b == nil {
+			return batches
+		}
+		batches = append(batches, b)
+	}
+}
+
+func TestBatchIteratorOrdered(t *testing.T) {
+	c := datasetCapture(10)
+	c = append(c, gocw.Trace{Baseline: true, PowerMeasurements: []gocw.Sample{0, 0}})
+	opts := analysis.DefaultBatchOptions()
+	opts.Size = 4
+	opts.Start = 1
+	opts.Labelers = []analysis.Labeler{analysis.KnownKeyLabeler(analysis.SboxOutput, 0)}
+	batches := collectBatches(t, analysis.CaptureSource(c), opts)
+	if len(batches) != 3 || batches[2].Len() != 2 {
+		t.Fatalf("Got %d batches, want 4+4+2 traces", len(batches))
+	}
+	for b, batch := range batches {
+		if _, cols := batch.X.Dims(); cols != 1 {
+			t.Fatalf("Batch %d has %d samples, want 1", b, cols)
+		}
+		for i := 0; i < batch.Len(); i++ {
+			n := b*4 + i
+			if got := batch.X.At(i, 0); got != float64(-n) {
+				t.Errorf("Batch %d row %d sample %v, want %d", b, i, got, -n)
+			}
+			if got, want := batch.Y.At(i, 0), float64(analysis.Sbox[byte(n)^0x2b]); got != want {
+				t.Errorf("Batch %d row %d label %v, want %v", b, i, got, want)
+			}
+		}
+	}
+}
+
+func TestBatchIteratorShuffled(t *testing.T) {
+	opts := analysis.DefaultBatchOptions()
+	opts.Size = 3
+	opts.ShuffleBuffer = 4
+	opts.Rng = rand.New(rand.NewSource(1))
+	batches := collectBatches(t, analysis.CaptureSource(datasetCapture(20)), opts)
+	var seen []int
+	ordered := true
+	for _, batch := range batches {
+		for i := 0; i < batch.Len(); i++ {
+			n := int(batch.X.At(i, 0))
+			if len(seen) > 0 && n < seen[len(seen)-1] {
+				ordered = false
+			}
+			seen = append(seen, n)
+		}
+	}
+	if ordered {
+		t.Error("Traces were not shuffled")
+	}
+	sort.Ints(seen)
+	for i, n := range seen {
+		if n != i {
+			t.Fatalf("Traces %v, want each of 0-19 once", seen)
+		}
+	}
+}
+
+func TestBatchIteratorClose(t *testing.T) {
+	opts := analysis.DefaultBatchOptions()
+	opts.Size = 1
+	opts.Prefetch = 0
+	it, err := analysis.NewBatchIterator(analysis.CaptureSource(datasetCapture(10)), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := it.Next(); err != nil || b == nil {
+		t.Fatalf("Next returned %v, %v", b, err)
+	}
+	// Doesn't block the producer.
+	it.Close()
+}
+
+func TestBatchIteratorWindowPastTraces(t *testing.T) {
+	opts := analysis.DefaultBatchOptions()
+	opts.Start = 2
+	it, err := analysis.NewBatchIterator(analysis.CaptureSource(datasetCapture(3)), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	if b, err := it.Next(); err == nil {
+		t.Errorf("Got a batch of %d traces, want an error", b.Len())
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Streaming correlation power analysis.
+// Traces are accumulated one at a time, so the correlation can be queried at
+// any point, e.g. to follow the convergence of an attack while capturing.
+package analysis
+
+import (
+	"crypto/aes"
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"sync"
+
+	"github.com/google/gocw"
+)
+
+// Predicts the leakage of a trace for a guess of key byte keyIdx.
+type LeakModel func(t *gocw.Trace, keyIdx int, guess byte) float64
+
+// Trace input a leak model reads, checked by CPA.Add.
+type ModelInput int
+
+const (
+	// One plaintext byte per key byte.
+	PlaintextInput ModelInput = iota
+	// The whole AES ciphertext block, e.g. to undo ShiftRows.
+	CiphertextInput
+)
+
+func (in ModelInput) String() string {
+	if in == CiphertextInput {
+		return "ciphertext"
+	}
+	return "plaintext"
+}
+
+// Returns the input of t, and the number of its bytes read to guess numBytes
+// key bytes.
+func (in ModelInput) of(t *gocw.Trace, numBytes int) ([]byte, int) {
+	if in == CiphertextInput {
+		return t.Ct, aes.BlockSize
+	}
+	return t.Pt, numBytes
+}
+
+// Hamming weight of the first round AES sbox output.
+// See cmd/attack_sbox_cpa.go for details.
+func SboxHammingWeight(t *gocw.Trace, keyIdx int, guess byte) float64 {
+	return float64(bits.OnesCount8(Sbox[t.Pt[keyIdx]^guess]))
+}
+
+// Hamming distance between the state register before and after the last AES
+// round, for a guess of byte keyIdx of the last round key. Models hardware
+// AES cores (e.g. on FPGA targets), where the state register is overwritten
+// by each round. Reads the ciphertext, so CPAs using it take CiphertextInput
+// and traces don't need the plaintext.
+func LastRoundHammingDistance(t *gocw.Trace, keyIdx int, guess byte) float64 {
+	before := InvSbox[t.Ct[keyIdx]^guess]
+	after := t.Ct[invShiftRows[keyIdx]]
+	return float64(bits.OnesCount8(before ^ after))
+}
+
+// Accumulates the sums needed to compute the Pearson correlation between the
+// power measurements and the leak model of every key guess.
+type CPA struct {
+	model      LeakModel
+	input      ModelInput
+	numBytes   int
+	numSamples int
+	numTraces  int
+	// Samples correlated, see NewMaskedCPA.
+	selected []int
+
+	// Per selected sample.
+	sumY, sumYY []float64
+	// Per key byte and guess.
+	sumX, sumXX [][256]float64
+	// Per key byte, guess and selected sample.
+	sumXY [][256][]float64
+}
+
+// Best candidate for a key byte.
+type KeyGuess struct {
+	Key byte
+	// Absolute correlation at Location.
+	Corr float64
+	// Sample index with the highest absolute correlation.
+	Location int
+}
+
+func (g KeyGuess) String() string {
+	return fmt.Sprintf("<Key:0x%02x, Corr:%f, Loc: %d>", g.Key, g.Corr, g.Location)
+}
+
+// The input is the one model reads, e.g. CiphertextInput for
+// LastRoundHammingDistance.
+func NewCPA(model LeakModel, input ModelInput, numBytes, numSamples int) *CPA {
+	return NewMaskedCPA(model, input, numBytes, numSamples, nil)
+}
+
+// Same as NewCPA, but only correlates the samples selected by mask, e.g. to
+// exclude serial I/O bursts. Correlations and locations still index the trace
+// samples, and masked out samples have a zero correlation.
+func NewMaskedCPA(model LeakModel, input ModelInput, numBytes, numSamples int, mask *gocw.SampleMask) *CPA {
+	selected := mask.Indices(numSamples)
+	c := &CPA{
+		model:      model,
+		input:      input,
+		numBytes:   numBytes,
+		numSamples: numSamples,
+		selected:   selected,
+		sumY:       make([]float64, len(selected)),
+		sumYY:      make([]float64, len(selected)),
+		sumX:       make([][256]float64, numBytes),
+		sumXX:      make([][256]float64, numBytes),
+		sumXY:      make([][256][]float64, numBytes),
+	}
+	for b := 0; b < numBytes; b++ {
+		for k := 0; k < 256; k++ {
+			c.sumXY[b][k] = make([]float64, len(selected))
+		}
+	}
+	return c
+}
+
+func (c *CPA) NumTraces() int {
+	return c.numTraces
+}
+
+func (c *CPA) NumSamples() int {
+	return c.numSamples
+}
+
+// Adds traces to the accumulated sums.
+// Traces must have at least NumSamples power measurements, and the input of
+// the leak model; extra samples are ignored.
+func (c *CPA) Add(traces ...gocw.Trace) error {
+	input := c.input
+	for i := range traces {
+		if len(traces[i].PowerMeasurements) < c.numSamples {
+			return fmt.Errorf("Trace has %d samples, expected %d",
+				len(traces[i].PowerMeasurements), c.numSamples)
+		}
+		if b, n := input.of(&traces[i], c.numBytes); len(b) < n {
+			return fmt.Errorf("Trace has %d %v bytes, expected %d", len(b), input, n)
+		}
+	}
+
+	y := make([][]float64, len(traces))
+	for i := range traces {
+		y[i] = make([]float64, len(c.selected))
+		for j, k := range c.selected {
+			v := float64(traces[i].PowerMeasurements[k])
+			y[i][j] = v
+			c.sumY[j] += v
+			c.sumYY[j] += v * v
+		}
+	}
+
+	// Key bytes are independent, so update them in parallel.
+	var wg sync.WaitGroup
+	wg.Add(c.numBytes)
+	for b := 0; b < c.numBytes; b++ {
+		go func(b int) {
+			defer wg.Done()
+			for i := range traces {
+				for k := 0; k < 256; k++ {
+					x := c.model(&traces[i], b, byte(k))
+					c.sumX[b][k] += x
+					c.sumXX[b][k] += x * x
+					if x == 0 {
+						continue
+					}
+					xy := c.sumXY[b][k]
+					for j, v := range y[i] {
+						xy[j] += x * v
+					}
+				}
+			}
+		}(b)
+	}
+	wg.Wait()
+	c.numTraces += len(traces)
+	return nil
+}
+
+// Returns the correlation of each sample with the leak model of guess.
+func (c *CPA) Correlation(keyIdx int, guess byte) []float64 {
+	n := float64(c.numTraces)
+	sx, sxx := c.sumX[keyIdx][guess], c.sumXX[keyIdx][guess]
+	varX := n*sxx - sx*sx
+	res := make([]float64, c.numSamples)
+	for j, k := range c.selected {
+		varY := n*c.sumYY[j] - c.sumY[j]*c.sumY[j]
+		if varX <= 0 || varY <= 0 {
+			continue
+		}
+		res[k] = (n*c.sumXY[keyIdx][guess][j] - sx*c.sumY[j]) / math.Sqrt(varX*varY)
+	}
+	return res
+}
+
+// Returns all guesses of a key byte, sorted by decreasing absolute correlation.
+func (c *CPA) Ranking(keyIdx int) []KeyGuess {
+	res := make([]KeyGuess, 256)
+	for k := 0; k < 256; k++ {
+		res[k] = KeyGuess{Key: byte(k)}
+		for j, pcc := range c.Correlation(keyIdx, byte(k)) {
+			if pcc = math.Abs(pcc); pcc > res[k].Corr {
+				res[k].Corr = pcc
+				res[k].Location = j
+			}
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Corr > res[j].Corr })
+	return res
+}
+
+// Returns the best guess of each key byte.
+func (c *CPA) BestGuesses() []KeyGuess {
+	res := make([]KeyGuess, c.numBytes)
+	for b := range res {
+		res[b] = c.Ranking(b)[0]
+	}
+	return res
+}
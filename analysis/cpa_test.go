@@ -0,0 +1,148 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis_test
+
+import (
+	"crypto/aes"
+	"math/bits"
+	"math/rand"
+	"testing"
+
+	"github.com/google/gocw"
+	"github.com/google/gocw/analysis"
+)
+
+// Simulates a target that leaks the sbox output of key byte i at sample i+1.
+func simulatedCapture(key []byte, numTraces int) gocw.Capture {
+	r := rand.New(rand.NewSource(1))
+	var c gocw.Capture
+	for n := 0; n < numTraces; n++ {
+		t := gocw.Trace{Key: key, Pt: make([]byte, len(key))}
+		r.Read(t.Pt)
+		t.PowerMeasurements = make([]gocw.Sample, len(key)+2)
+		for j := range t.PowerMeasurements {
+			t.PowerMeasurements[j] = gocw.Sample(r.NormFloat64())
+		}
+		for i := range key {
+			hw := bits.OnesCount8(analysis.Sbox[t.Pt[i]^key[i]])
+			t.PowerMeasurements[i+1] += gocw.Sample(hw)
+		}
+		c = append(c, t)
+	}
+	return c
+}
+
+func TestCPARecoversKey(t *testing.T) {
+	key := []byte{0x2b, 0x7e, 0x15}
+	c := simulatedCapture(key, 200)
+
+	cpa := analysis.NewCPA(analysis.SboxHammingWeight, analysis.PlaintextInput, len(key), len(c[0].PowerMeasurements))
+	// Adding in batches must be equivalent to adding all traces at once.
+	if err := cpa.Add(c[:50]...); err != nil {
+		t.Fatal(err)
+	}
+	if err := cpa.Add(c[50:]...); err != nil {
+		t.Fatal(err)
+	}
+	if cpa.NumTraces() != len(c) {
+		t.Errorf("NumTraces is %d, expected %d", cpa.NumTraces(), len(c))
+	}
+
+	for i, g := range cpa.BestGuesses() {
+		if g.Key != key[i] || g.Location != i+1 {
+			t.Errorf("Best guess for index %d is %v, expected key 0x%02x at %d", i, g, key[i], i+1)
+		}
+	}
+}
+
+func TestMaskedCPAReportsTraceLocations(t *testing.T) {
+	key := []byte{0x2b, 0x7e, 0x15}
+	c := simulatedCapture(key, 200)
+
+	// Excludes the leak of key byte 0, at sample 1.
+	mask := &gocw.SampleMask{Exclude: []gocw.SampleRange{{Start: 0, End: 2}}}
+	cpa := analysis.NewMaskedCPA(analysis.SboxHammingWeight, analysis.PlaintextInput, len(key), len(c[0].PowerMeasurements), mask)
+	if err := cpa.Add(c...); err != nil {
+		t.Fatal(err)
+	}
+	for i, g := range cpa.BestGuesses()[1:] {
+		if g.Key != key[i+1] || g.Location != i+2 {
+			t.Errorf("Best guess for index %d is %v, expected key 0x%02x at %d", i+1, g, key[i+1], i+2)
+		}
+	}
+	if corr := cpa.Correlation(0, key[0]); len(corr) != len(c[0].PowerMeasurements) || corr[1] != 0 {
+		t.Errorf("Masked out samples should have a zero correlation: %v", corr)
+	}
+}
+
+// Simulates a hardware AES core that leaks the hamming distance of the last
+// round state update of byte i at sample i.
+func simulatedLastRoundCapture(key [16]byte, numTraces int) gocw.Capture {
+	r := rand.New(rand.NewSource(1))
+	block, _ := aes.NewCipher(key[:])
+	var c gocw.Capture
+	for n := 0; n < numTraces; n++ {
+		t := gocw.Trace{Key: key[:], Pt: make([]byte, 16), Ct: make([]byte, 16)}
+		r.Read(t.Pt)
+		block.Encrypt(t.Ct, t.Pt)
+		t.PowerMeasurements = make([]gocw.Sample, 16)
+		for j := range t.PowerMeasurements {
+			t.PowerMeasurements[j] = gocw.Sample(r.NormFloat64())
+		}
+		c = append(c, t)
+	}
+	rk := analysis.ExpandKey(key)
+	for i := range c {
+		for j := 0; j < 16; j++ {
+			c[i].PowerMeasurements[j] += gocw.Sample(analysis.LastRoundHammingDistance(&c[i], j, rk[10][j]))
+		}
+	}
+	return c
+}
+
+func TestLastRoundCPARecoversKey(t *testing.T) {
+	key := [16]byte{0x2b, 0x7e, 0x15, 0x16, 0x28, 0xae, 0xd2, 0xa6,
+		0xab, 0xf7, 0x15, 0x88, 0x09, 0xcf, 0x4f, 0x3c}
+	c := simulatedLastRoundCapture(key, 300)
+
+	cpa := analysis.NewCPA(analysis.LastRoundHammingDistance, analysis.CiphertextInput, 16, 16)
+	if err := cpa.Add(c...); err != nil {
+		t.Fatal(err)
+	}
+	var roundKey [16]byte
+	for i, g := range cpa.BestGuesses() {
+		roundKey[i] = g.Key
+	}
+	if actual := analysis.InvertKeySchedule(roundKey, 10); actual != key {
+		t.Errorf("Recovered key %x, expected %x", actual, key)
+	}
+}
+
+func TestCPAChecksModelInput(t *testing.T) {
+	key := [16]byte{0x2b, 0x7e, 0x15, 0x16}
+	c := simulatedLastRoundCapture(key, 2)
+	// The last round model doesn't need the plaintext.
+	c[0].Pt = nil
+	if err := analysis.NewCPA(analysis.LastRoundHammingDistance, analysis.CiphertextInput, 16, 16).Add(c[0]); err != nil {
+		t.Errorf("Add without plaintext failed: %v", err)
+	}
+	if err := analysis.NewCPA(analysis.SboxHammingWeight, analysis.PlaintextInput, 16, 16).Add(c[0]); err == nil {
+		t.Error("Add without plaintext succeeded for the sbox model")
+	}
+	c[1].Ct = c[1].Ct[:4]
+	if err := analysis.NewCPA(analysis.LastRoundHammingDistance, analysis.CiphertextInput, 4, 16).Add(c[1]); err == nil {
+		t.Error("Add with a short ciphertext succeeded for the last round model")
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Captures as labeled datasets, for profiling attacks and classifiers.
+package analysis
+
+import (
+	"math/rand"
+
+	"github.com/google/gocw"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// Computes a label of a trace, e.g. an intermediate value or its hamming
+// weight class.
+type Labeler func(t *gocw.Trace) float64
+
+// Labels traces with the leak model of a fixed key guess.
+func GuessLabeler(model LeakModel, keyIdx int, guess byte) Labeler {
+	return func(t *gocw.Trace) float64 {
+		return model(t, keyIdx, guess)
+	}
+}
+
+// Labels traces with the leak model of the key the trace was captured with.
+func KnownKeyLabeler(model LeakModel, keyIdx int) Labeler {
+	return func(t *gocw.Trace) float64 {
+		return model(t, keyIdx, t.Key[keyIdx])
+	}
+}
+
+// First round AES sbox output. Used as a label for profiling on the
+// intermediate value itself (256 classes).
+func SboxOutput(t *gocw.Trace, keyIdx int, guess byte) float64 {
+	return float64(Sbox[t.Pt[keyIdx]^guess])
+}
+
+// Sample matrix of a capture, with a label vector per labeler.
+// X and Y are nil for an empty dataset, since gonum has no empty matrices.
+type Dataset struct {
+	// One row per trace, one column per sample.
+	X *mat.Dense
+	// One row per trace, one column per labeler. Nil without labelers.
+	Y *mat.Dense
+	// Traces the rows were taken from.
+	Traces gocw.Capture
+}
+
+func NewDataset(c gocw.Capture, labelers ...Labeler) *Dataset {
+	d := &Dataset{Traces: c}
+	if len(c) == 0 {
+		return d
+	}
+	d.X = mat.DenseCopyOf(c.SamplesMatrix())
+	if len(labelers) > 0 {
+		d.Y = mat.NewDense(len(c), len(labelers), nil)
+		for i := range c {
+			for j, l := range labelers {
+				d.Y.Set(i, j, l(&c[i]))
+			}
+		}
+	}
+	return d
+}
+
+// Number of traces.
+func (d *Dataset) Len() int {
+	return len(d.Traces)
+}
+
+// Returns the label vector of labeler j.
+func (d *Dataset) Labels(j int) []float64 {
+	return mat.Col(nil, j, d.Y)
+}
+
+// Returns the labels of labeler j as class indices, e.g. for SNR.
+func (d *Dataset) Classes(j int) []int {
+	labels := d.Labels(j)
+	classes := make([]int, len(labels))
+	for i, l := range labels {
+		classes[i] = int(l)
+	}
+	return classes
+}
+
+// Returns the dataset of the traces listed in idx. Rows are copied.
+func (d *Dataset) Subset(idx []int) *Dataset {
+	if len(idx) == 0 {
+		return &Dataset{}
+	}
+	s := &Dataset{X: SelectRows(d.X, idx)}
+	if d.Y != nil {
+		s.Y = SelectRows(d.Y, idx)
+	}
+	s.Traces = make(gocw.Capture, len(idx))
+	for i, r := range idx {
+		s.Traces[i] = d.Traces[r]
+	}
+	return s
+}
+
+// Returns the dataset of traces [i, j). Rows are shared with d.
+func (d *Dataset) Slice(i, j int) *Dataset {
+	if i == j {
+		return &Dataset{Traces: d.Traces[i:j]}
+	}
+	_, cols := d.X.Dims()
+	s := &Dataset{X: d.X.Slice(i, j, 0, cols).(*mat.Dense), Traces: d.Traces[i:j]}
+	if d.Y != nil {
+		_, labels := d.Y.Dims()
+		s.Y = d.Y.Slice(i, j, 0, labels).(*mat.Dense)
+	}
+	return s
+}
+
+// Splits the dataset into a training set with the given fraction of the
+// traces, and a test set with the rest. Traces are shuffled with rng first,
+// unless it is nil.
+func (d *Dataset) Split(trainFraction float64, rng *rand.Rand) (train, test *Dataset) {
+	n := int(float64(d.Len()) * trainFraction)
+	if rng == nil {
+		return d.Slice(0, n), d.Slice(n, d.Len())
+	}
+	perm := rng.Perm(d.Len())
+	return d.Subset(perm[:n]), d.Subset(perm[n:])
+}
+
+// Number of batches of the given size. The last batch may be smaller.
+func (d *Dataset) NumBatches(size int) int {
+	return (d.Len() + size - 1) / size
+}
+
+// Returns batch i of the given size. Rows are shared with d.
+func (d *Dataset) Batch(i, size int) *Dataset {
+	end := (i + 1) * size
+	if end > d.Len() {
+		end = d.Len()
+	}
+	return d.Slice(i*size, end)
+}
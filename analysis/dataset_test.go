@@ -0,0 +1,108 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis_test
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/google/gocw"
+	"github.com/google/gocw/analysis"
+)
+
+func datasetCapture(n int) gocw.Capture {
+	var c gocw.Capture
+	for i := 0; i < n; i++ {
+		c = append(c, gocw.Trace{
+			Key:               []byte{0x2b},
+			Pt:                []byte{byte(i)},
+			PowerMeasurements: []gocw.Sample{gocw.Sample(i), gocw.Sample(-i)},
+		})
+	}
+	return c
+}
+
+func TestDatasetLabels(t *testing.T) {
+	d := analysis.NewDataset(datasetCapture(4),
+		analysis.KnownKeyLabeler(analysis.SboxOutput, 0),
+		analysis.KnownKeyLabeler(analysis.SboxHammingWeight, 0))
+	for i := 0; i < d.Len(); i++ {
+		v := analysis.Sbox[byte(i)^0x2b]
+		if d.Y.At(i, 0) != float64(v) {
+			t.Errorf("Trace %d: intermediate label %v, expected %v", i, d.Y.At(i, 0), v)
+		}
+	}
+	expected := []int{5, 5, 4, 3}
+	if actual := d.Classes(1); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("HW classes (%v) did not match expected (%v)", actual, expected)
+	}
+}
+
+func TestDatasetSplit(t *testing.T) {
+	d := analysis.NewDataset(datasetCapture(10), analysis.GuessLabeler(analysis.SboxOutput, 0, 0))
+
+	train, test := d.Split(0.8, nil)
+	if train.Len() != 8 || test.Len() != 2 || test.X.At(0, 0) != 8 || test.Traces[0].Pt[0] != 8 {
+		t.Errorf("Ordered split: train %d, test %d traces, test starts at %v",
+			train.Len(), test.Len(), test.X.At(0, 0))
+	}
+
+	train, test = d.Split(0.7, rand.New(rand.NewSource(1)))
+	var seen []int
+	for _, s := range []*analysis.Dataset{train, test} {
+		for i := 0; i < s.Len(); i++ {
+			pt := int(s.Traces[i].Pt[0])
+			if s.X.At(i, 0) != float64(pt) || s.Y.At(i, 0) != float64(analysis.Sbox[pt]) {
+				t.Errorf("Row %d does not match trace %d", i, pt)
+			}
+			seen = append(seen, pt)
+		}
+	}
+	sort.Ints(seen)
+	if train.Len() != 7 || !reflect.DeepEqual(seen, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}) {
+		t.Errorf("Shuffled split lost traces: %v", seen)
+	}
+}
+
+func TestDatasetBatches(t *testing.T) {
+	d := analysis.NewDataset(datasetCapture(10))
+	if n := d.NumBatches(4); n != 3 {
+		t.Fatalf("NumBatches(4) = %d, expected 3", n)
+	}
+	var sizes []int
+	for i := 0; i < d.NumBatches(4); i++ {
+		b := d.Batch(i, 4)
+		if b.X.At(0, 0) != float64(4*i) {
+			t.Errorf("Batch %d starts at %v", i, b.X.At(0, 0))
+		}
+		sizes = append(sizes, b.Len())
+	}
+	if !reflect.DeepEqual(sizes, []int{4, 4, 2}) {
+		t.Errorf("Batch sizes (%v) did not match expected", sizes)
+	}
+}
+
+func TestDatasetEmptySplit(t *testing.T) {
+	d := analysis.NewDataset(datasetCapture(3))
+	train, test := d.Split(1, nil)
+	if train.Len() != 3 || test.Len() != 0 || test.X != nil {
+		t.Errorf("Split(1) = %d / %d traces", train.Len(), test.Len())
+	}
+	if _, test = d.Split(1, rand.New(rand.NewSource(1))); test.Len() != 0 {
+		t.Errorf("Shuffled Split(1) test set has %d traces", test.Len())
+	}
+}
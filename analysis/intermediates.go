@@ -0,0 +1,179 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Precomputed leak model tables.
+// A table holds the leak model of every trace, key byte and key guess, so
+// repeated attack runs and profiling don't recompute them from Pt/Ct.
+// Values are stored as bytes, one chunk per key byte laid out as
+// [trace][guess], which covers intermediate values, hamming weights and
+// hamming distances.
+package analysis
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/google/gocw"
+)
+
+// Leak models by name, for commands and tables.
+var LeakModels = map[string]LeakModel{
+	"sbox":          SboxOutput,
+	"sbox_hw":       SboxHammingWeight,
+	"last_round_hd": LastRoundHammingDistance,
+}
+
+// Returns the names of LeakModels, sorted.
+func LeakModelNames() []string {
+	var names []string
+	for name := range LeakModels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type IntermediateTable struct {
+	Model     string `json:"model"`
+	NumTraces int    `json:"num_traces"`
+	// Digest of the trace inputs the table was computed from, see
+	// InputsDigest.
+	InputsDigest string `json:"inputs_digest"`
+	// One chunk per key byte, numTraces * 256 values.
+	Chunks [][]byte `json:"chunks"`
+}
+
+// Hashes the keys, plaintexts and ciphertexts of a capture.
+func InputsDigest(c gocw.Capture) string {
+	h := sha256.New()
+	field := func(b []byte) {
+		binary.Write(h, binary.LittleEndian, uint64(len(b)))
+		h.Write(b)
+	}
+	for i := range c {
+		field(c[i].Key)
+		field(c[i].Pt)
+		field(c[i].Ct)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Computes the named leak model for the first numBytes key bytes.
+func NewIntermediateTable(c gocw.Capture, model string, numBytes int) (*IntermediateTable, error) {
+	leak, ok := LeakModels[model]
+	if !ok {
+		return nil, fmt.Errorf("Unknown leak model %q. Valid values %v", model, LeakModelNames())
+	}
+	t := &IntermediateTable{
+		Model:        model,
+		NumTraces:    len(c),
+		InputsDigest: InputsDigest(c),
+		Chunks:       make([][]byte, numBytes),
+	}
+	for b := range t.Chunks {
+		chunk := make([]byte, len(c)*256)
+		for i := range c {
+			for g := 0; g < 256; g++ {
+				v := leak(&c[i], b, byte(g))
+				if v < 0 || v > 255 || v != float64(int(v)) {
+					return nil, fmt.Errorf("Leak model %s value %v does not fit a byte", model, v)
+				}
+				chunk[i*256+g] = byte(v)
+			}
+		}
+		t.Chunks[b] = chunk
+	}
+	return t, nil
+}
+
+func (t *IntermediateTable) NumBytes() int {
+	return len(t.Chunks)
+}
+
+// Returns the leak model of a trace for a guess of key byte keyIdx.
+func (t *IntermediateTable) Value(trace, keyIdx int, guess byte) byte {
+	return t.Chunks[keyIdx][trace*256+int(guess)]
+}
+
+// Returns the leak model of all traces for a guess of key byte keyIdx.
+func (t *IntermediateTable) Labels(keyIdx int, guess byte) []float64 {
+	labels := make([]float64, t.NumTraces)
+	for i := range labels {
+		labels[i] = float64(t.Value(i, keyIdx, guess))
+	}
+	return labels
+}
+
+// Returns an error if the table was not computed from the capture.
+func (t *IntermediateTable) Check(c gocw.Capture) error {
+	if t.NumTraces != len(c) || t.InputsDigest != InputsDigest(c) {
+		return fmt.Errorf("Intermediate table does not match the capture")
+	}
+	return nil
+}
+
+// Exported for testing.
+func (t *IntermediateTable) SaveIo(dst io.Writer) error {
+	zipper := gzip.NewWriter(dst)
+	if err := json.NewEncoder(zipper).Encode(t); err != nil {
+		return fmt.Errorf("JSON encoder failed %v", err)
+	}
+	if err := zipper.Close(); err != nil {
+		return fmt.Errorf("gzip close failed %v", err)
+	}
+	return nil
+}
+
+func (t *IntermediateTable) Save(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("Error creating table file: %v", err)
+	}
+	defer f.Close()
+	return t.SaveIo(f)
+}
+
+// Exported for testing.
+func LoadIntermediateTableIo(src io.Reader) (*IntermediateTable, error) {
+	zipper, err := gzip.NewReader(src)
+	if err != nil {
+		return nil, fmt.Errorf("gzip NewReader failed %v", err)
+	}
+	t := &IntermediateTable{}
+	if err = json.NewDecoder(zipper).Decode(t); err != nil {
+		return nil, fmt.Errorf("JSON decoder failed %v", err)
+	}
+	for b, chunk := range t.Chunks {
+		if len(chunk) != t.NumTraces*256 {
+			return nil, fmt.Errorf("Chunk %d has %d values, expected %d", b, len(chunk), t.NumTraces*256)
+		}
+	}
+	return t, nil
+}
+
+func LoadIntermediateTable(filename string) (*IntermediateTable, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening table file: %v", err)
+	}
+	defer f.Close()
+	return LoadIntermediateTableIo(f)
+}
@@ -0,0 +1,77 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/google/gocw/analysis"
+)
+
+func TestIntermediateTable(t *testing.T) {
+	c := datasetCapture(4)
+	table, err := analysis.NewIntermediateTable(c, "sbox", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.NumBytes() != 1 || table.NumTraces != 4 {
+		t.Fatalf("Got %d bytes / %d traces, expected 1 / 4", table.NumBytes(), table.NumTraces)
+	}
+	for i := range c {
+		for _, g := range []byte{0, 0x2b, 0xff} {
+			if got, want := table.Value(i, 0, g), analysis.SboxOutput(&c[i], 0, g); float64(got) != want {
+				t.Errorf("Value(%d, 0, %#x) = %d, expected %v", i, g, got, want)
+			}
+		}
+	}
+	want := analysis.NewDataset(c, analysis.GuessLabeler(analysis.SboxOutput, 0, 0x2b)).Labels(0)
+	if got := table.Labels(0, 0x2b); !reflect.DeepEqual(got, want) {
+		t.Errorf("Labels() = %v, expected %v", got, want)
+	}
+}
+
+func TestIntermediateTableSaveLoad(t *testing.T) {
+	c := datasetCapture(3)
+	table, err := analysis.NewIntermediateTable(c, "sbox_hw", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = table.SaveIo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := analysis.LoadIntermediateTableIo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, table) {
+		t.Errorf("Loaded table differs from saved table")
+	}
+	if err = loaded.Check(c); err != nil {
+		t.Errorf("Check() = %v, expected nil", err)
+	}
+	c[1].Pt[0] ^= 1
+	if err = loaded.Check(c); err == nil {
+		t.Errorf("Check() of a modified capture = nil, expected an error")
+	}
+}
+
+func TestIntermediateTableUnknownModel(t *testing.T) {
+	if _, err := analysis.NewIntermediateTable(datasetCapture(1), "nope", 1); err == nil {
+		t.Errorf("NewIntermediateTable() = nil error, expected an error")
+	}
+}
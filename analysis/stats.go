@@ -0,0 +1,180 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Per-sample statistics over a set of power traces.
+// Traces are stored in the rows of the samples matrix, see Capture.SamplesMatrix.
+package analysis
+
+import (
+	"math"
+	"sort"
+
+	"gonum.org/v1/gonum/mat"
+	"gonum.org/v1/gonum/stat"
+)
+
+//go:generate stringer -type Estimator
+type Estimator int
+
+const (
+	// Mean / standard deviation. Optimal for gaussian noise.
+	EstimatorMean Estimator = iota
+	// Median / median absolute deviation. Robust to a fraction of corrupted
+	// traces, e.g. due to USB glitches.
+	EstimatorMedian Estimator = iota
+)
+
+// Scales the median absolute deviation to estimate the standard deviation of
+// normally distributed data.
+const madScale = 1.4826
+
+// Returns the median of x. x is not modified.
+func Median(x []float64) float64 {
+	if len(x) == 0 {
+		return math.NaN()
+	}
+	sorted := make([]float64, len(x))
+	copy(sorted, x)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// Returns the median absolute deviation of x, scaled to be consistent with the
+// standard deviation of normally distributed data.
+func MAD(x []float64) float64 {
+	med := Median(x)
+	dev := make([]float64, len(x))
+	for i, v := range x {
+		dev[i] = math.Abs(v - med)
+	}
+	return madScale * Median(dev)
+}
+
+// Applies f on each column (sample) of M.
+func columnStat(M mat.Matrix, f func(col []float64) float64) []float64 {
+	rows, cols := M.Dims()
+	res := make([]float64, cols)
+	col := make([]float64, rows)
+	for j := 0; j < cols; j++ {
+		mat.Col(col, j, M)
+		res[j] = f(col)
+	}
+	return res
+}
+
+// Returns the location (mean or median) of each sample.
+func AverageTrace(M mat.Matrix, est Estimator) []float64 {
+	if est == EstimatorMedian {
+		return columnStat(M, Median)
+	}
+	return columnStat(M, func(col []float64) float64 { return stat.Mean(col, nil) })
+}
+
+// Returns the spread (standard deviation or scaled MAD) of each sample.
+func SpreadTrace(M mat.Matrix, est Estimator) []float64 {
+	if est == EstimatorMedian {
+		return columnStat(M, MAD)
+	}
+	return columnStat(M, func(col []float64) float64 { return stat.StdDev(col, nil) })
+}
+
+// Returns the indices of traces that are not outliers.
+// Each trace is scored by its median absolute distance from the median trace.
+// Traces whose score is more than threshold MADs above the median score are
+// rejected. A threshold of 3-5 is typical.
+func RejectOutliers(M mat.Matrix, threshold float64) []int {
+	rows, cols := M.Dims()
+	med := AverageTrace(M, EstimatorMedian)
+	scores := make([]float64, rows)
+	dist := make([]float64, cols)
+	for i := 0; i < rows; i++ {
+		for j := 0; j < cols; j++ {
+			dist[j] = math.Abs(M.At(i, j) - med[j])
+		}
+		scores[i] = Median(dist)
+	}
+
+	center := Median(scores)
+	spread := MAD(scores)
+	if spread == 0 {
+		// More than half of the scores are identical. Fall back to the mean
+		// absolute deviation, scaled to be consistent with the standard
+		// deviation of normally distributed data.
+		for _, s := range scores {
+			spread += math.Abs(s - center)
+		}
+		spread *= math.Sqrt(math.Pi/2) / float64(rows)
+	}
+	var keep []int
+	for i, s := range scores {
+		if s-center <= threshold*spread {
+			keep = append(keep, i)
+		}
+	}
+	return keep
+}
+
+// Returns the matrix rows listed in idx.
+func SelectRows(M mat.Matrix, idx []int) *mat.Dense {
+	_, cols := M.Dims()
+	res := mat.NewDense(len(idx), cols, nil)
+	row := make([]float64, cols)
+	for i, r := range idx {
+		mat.Row(row, r, M)
+		res.SetRow(i, row)
+	}
+	return res
+}
+
+// Computes the signal-to-noise ratio of each sample, given a class label per
+// trace (e.g. the hamming weight of an intermediate value).
+// SNR is the variance of the class averages, divided by the average of the
+// class variances. With EstimatorMedian, class medians and MADs are used.
+func SNR(M mat.Matrix, labels []int, est Estimator) []float64 {
+	classes := make(map[int][]int)
+	for i, l := range labels {
+		classes[l] = append(classes[l], i)
+	}
+
+	_, cols := M.Dims()
+	var avgs, noise [][]float64
+	for _, idx := range classes {
+		C := SelectRows(M, idx)
+		avgs = append(avgs, AverageTrace(C, est))
+		noise = append(noise, SpreadTrace(C, est))
+	}
+
+	res := make([]float64, cols)
+	col := make([]float64, len(avgs))
+	for j := 0; j < cols; j++ {
+		var n float64
+		for k := range avgs {
+			col[k] = avgs[k][j]
+			n += noise[k][j] * noise[k][j]
+		}
+		n /= float64(len(avgs))
+		var signal float64
+		if est == EstimatorMedian {
+			signal = MAD(col)
+		} else {
+			signal = stat.StdDev(col, nil)
+		}
+		res[j] = signal * signal / n
+	}
+	return res
+}
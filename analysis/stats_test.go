@@ -0,0 +1,53 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/gocw/analysis"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+func TestMedianTraceIgnoresGlitch(t *testing.T) {
+	M := mat.NewDense(5, 2, []float64{
+		1, 2,
+		1, 2,
+		1, 2,
+		1, 2,
+		100, -100, // glitched trace
+	})
+	expected := []float64{1, 2}
+	if actual := analysis.AverageTrace(M, analysis.EstimatorMedian); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Median trace (%v) did not match expected (%v)", actual, expected)
+	}
+}
+
+func TestRejectOutliers(t *testing.T) {
+	M := mat.NewDense(6, 3, []float64{
+		1.02, 2.07, 2.95,
+		1.13, 2.11, 3.08,
+		0.91, 1.86, 2.97,
+		0.97, 2.21, 3.04,
+		1.08, 1.93, 3.12,
+		9.00, -5.0, 7.00, // glitched trace
+	})
+	expected := []int{0, 1, 2, 3, 4}
+	if actual := analysis.RejectOutliers(M, 4); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Kept traces (%v) did not match expected (%v)", actual, expected)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Test vector leakage assessment (TVLA).
+// Compares two sets of traces, e.g. fixed vs. random plaintext, with Welch's
+// t-test. Samples where |t| exceeds TVLAThreshold indicate leakage.
+// https://csrc.nist.gov/csrc/media/events/non-invasive-attack-testing-workshop/documents/08_goodwill.pdf
+package analysis
+
+import (
+	"math"
+
+	"gonum.org/v1/gonum/mat"
+	"gonum.org/v1/gonum/stat"
+)
+
+// Conventional |t| threshold for a leakage assessment failure.
+const TVLAThreshold = 4.5
+
+// Returns the difference of means (A - B) of each sample.
+func MeanDiff(A, B mat.Matrix) []float64 {
+	a := AverageTrace(A, EstimatorMean)
+	b := AverageTrace(B, EstimatorMean)
+	res := make([]float64, len(a))
+	for j := range res {
+		res[j] = a[j] - b[j]
+	}
+	return res
+}
+
+// Returns Welch's t-statistic of each sample.
+// A and B must have the same number of columns, and at least two rows each.
+func WelchT(A, B mat.Matrix) []float64 {
+	na, _ := A.Dims()
+	nb, _ := B.Dims()
+	varA := columnStat(A, func(col []float64) float64 { return stat.Variance(col, nil) })
+	varB := columnStat(B, func(col []float64) float64 { return stat.Variance(col, nil) })
+	res := MeanDiff(A, B)
+	for j := range res {
+		se := math.Sqrt(varA[j]/float64(na) + varB[j]/float64(nb))
+		if se == 0 {
+			res[j] = 0
+			continue
+		}
+		res[j] /= se
+	}
+	return res
+}
+
+// Returns the indices of samples where |t| exceeds threshold.
+func LeakingSamples(t []float64, threshold float64) []int {
+	var res []int
+	for j, v := range t {
+		if math.Abs(v) > threshold {
+			res = append(res, j)
+		}
+	}
+	return res
+}
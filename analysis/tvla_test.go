@@ -0,0 +1,50 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis_test
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/google/gocw/analysis"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+func TestWelchT(t *testing.T) {
+	A := mat.NewDense(3, 2, []float64{
+		1, 10,
+		2, 11,
+		3, 12,
+	})
+	B := mat.NewDense(4, 2, []float64{
+		1, 1,
+		2, 2,
+		3, 1,
+		2, 2,
+	})
+	// Sample 0: equal means. Sample 1: mean diff 9.5, se sqrt(1/3 + 1/12).
+	expected := []float64{0, 9.5 / math.Sqrt(1.0/3+1.0/12)}
+	actual := analysis.WelchT(A, B)
+	for j := range expected {
+		if math.Abs(actual[j]-expected[j]) > 1e-9 {
+			t.Errorf("t[%d] = %v, expected %v", j, actual[j], expected[j])
+		}
+	}
+	if leaks := analysis.LeakingSamples(actual, analysis.TVLAThreshold); !reflect.DeepEqual(leaks, []int{1}) {
+		t.Errorf("Leaking samples (%v) did not match expected ([1])", leaks)
+	}
+}
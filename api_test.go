@@ -0,0 +1,343 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/gocw"
+)
+
+var updateApi = flag.Bool("update_api", false, "Rewrite the api/ files with the current exported API")
+
+// Packages of the stable API, and their API files. The register maps live in
+// internal/ and aren't listed.
+var stablePackages = map[string]string{
+	".":          "api/gocw.txt",
+	"analysis":   "api/analysis.txt",
+	"attack":     "api/attack.txt",
+	"preprocess": "api/preprocess.txt",
+	"types":      "api/types.txt",
+}
+
+// Register-level hardware plumbing that stable packages still export, for
+// custom bitstreams and the tools in cmd/. It may change with any bitstream,
+// so it's left out of the API files. Types are listed with their fields and
+// methods, methods and fields as Type.Name.
+var unstableApi = map[string][]string{
+	".": {
+		"Address", "AddressBlock", "AdvClkSettings", "BitRange", "Memory", "NewMemory",
+		"RegisterField", "RegisterInfo", "RegisterMap", "LoadRegisterMap", "ParseRegisterMap",
+		"Adc.RegisterMap", "Fpga.Mem", "Fpga.RawRead", "Fpga.RawWrite",
+		"Fpga.ReadRegister", "Fpga.WriteRegister", "Fpga.DumpRegisters",
+	},
+}
+
+// Returns the identifiers an exportedApi line declares: the type and member
+// of fields and methods, or the name and type of other declarations.
+func apiNames(line string) []string {
+	f := strings.Fields(line)
+	if len(f) < 2 {
+		return nil
+	}
+	switch f[0] {
+	case "field":
+		typ := strings.SplitN(f[1], ".", 2)[0]
+		return []string{typ, f[1]}
+	case "method", "embedded":
+		typ := strings.Trim(f[1], "(*)")
+		name := strings.SplitN(strings.Join(f[2:], " "), "(", 2)[0]
+		return []string{typ, typ + "." + name}
+	case "func":
+		return []string{strings.SplitN(f[1], "(", 2)[0]}
+	case "const", "var":
+		if len(f) > 2 {
+			return []string{f[1], f[2]}
+		}
+	}
+	return f[1:2]
+}
+
+// Drops the unstable identifiers of dir from api.
+func stableApi(dir string, api []string) []string {
+	unstable := make(map[string]bool)
+	for _, name := range unstableApi[dir] {
+		unstable[name] = true
+	}
+	var res []string
+	for _, line := range api {
+		keep := true
+		for _, name := range apiNames(line) {
+			if unstable[name] {
+				keep = false
+			}
+		}
+		if keep {
+			res = append(res, line)
+		}
+	}
+	return res
+}
+
+func isGenerated(f *ast.File) bool {
+	for _, g := range f.Comments {
+		if g.Pos() > f.Package {
+			break
+		}
+		if strings.HasPrefix(g.Text(), "Code generated") {
+			return true
+		}
+	}
+	return false
+}
+
+func receiverName(expr ast.Expr) (string, bool) {
+	switch e := expr.(type) {
+	case *ast.StarExpr:
+		name, ok := receiverName(e.X)
+		return "*" + name, ok
+	case *ast.Ident:
+		return e.Name, e.IsExported()
+	}
+	return "", false
+}
+
+func fieldNames(f *ast.Field) []string {
+	if len(f.Names) > 0 {
+		var names []string
+		for _, n := range f.Names {
+			names = append(names, n.Name)
+		}
+		return names
+	}
+	// Embedded field.
+	name, _ := receiverName(f.Type)
+	if sel, ok := f.Type.(*ast.SelectorExpr); ok {
+		name = sel.Sel.Name
+	}
+	return []string{strings.TrimPrefix(name, "*")}
+}
+
+func exprString(fset *token.FileSet, expr ast.Expr) string {
+	if f, ok := expr.(*ast.FuncType); ok {
+		return "func" + signature(fset, f)
+	}
+	var buf bytes.Buffer
+	printer.Fprint(&buf, fset, expr)
+	return buf.String()
+}
+
+// Returns the types of a parameter or result list, without the names, which
+// aren't part of the API.
+func fieldTypes(fset *token.FileSet, fields *ast.FieldList) []string {
+	if fields == nil {
+		return nil
+	}
+	var types []string
+	for _, f := range fields.List {
+		t := exprString(fset, f.Type)
+		types = append(types, t)
+		for i := 1; i < len(f.Names); i++ {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+func signature(fset *token.FileSet, f *ast.FuncType) string {
+	sig := "(" + strings.Join(fieldTypes(fset, f.Params), ", ") + ")"
+	results := fieldTypes(fset, f.Results)
+	switch {
+	case len(results) == 1:
+		sig += " " + results[0]
+	case len(results) > 1:
+		sig += " (" + strings.Join(results, ", ") + ")"
+	}
+	return sig
+}
+
+// Returns the kind of a type declaration: the underlying type, or only
+// struct and interface whose members are listed separately.
+func typeKind(fset *token.FileSet, s *ast.TypeSpec) string {
+	switch s.Type.(type) {
+	case *ast.StructType:
+		return "struct"
+	case *ast.InterfaceType:
+		return "interface"
+	}
+	if s.Assign.IsValid() {
+		return "= " + exprString(fset, s.Type)
+	}
+	return exprString(fset, s.Type)
+}
+
+// Returns the exported identifiers of the package in dir with their
+// signatures, one per line: functions, methods, types, struct fields,
+// interface methods, constants and variables. Constants and variables carry
+// their type when it's declared. Tests and generated files are skipped.
+func exportedApi(dir string) ([]string, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	var api []string
+	for _, pkg := range pkgs {
+		for _, f := range pkg.Files {
+			if isGenerated(f) {
+				continue
+			}
+			for _, decl := range f.Decls {
+				switch d := decl.(type) {
+				case *ast.FuncDecl:
+					if !d.Name.IsExported() {
+						continue
+					}
+					sig := signature(fset, d.Type)
+					if d.Recv == nil {
+						api = append(api, fmt.Sprintf("func %s%s", d.Name.Name, sig))
+					} else if recv, ok := receiverName(d.Recv.List[0].Type); ok {
+						api = append(api, fmt.Sprintf("method (%s) %s%s", recv, d.Name.Name, sig))
+					}
+				case *ast.GenDecl:
+					// Constants without a type or a value repeat those of
+					// the previous spec, as with iota.
+					var valueType ast.Expr
+					for _, spec := range d.Specs {
+						switch s := spec.(type) {
+						case *ast.TypeSpec:
+							if !s.Name.IsExported() {
+								continue
+							}
+							api = append(api, fmt.Sprintf("type %s %s", s.Name.Name, typeKind(fset, s)))
+							switch t := s.Type.(type) {
+							case *ast.StructType:
+								for _, field := range t.Fields.List {
+									for _, name := range fieldNames(field) {
+										if ast.IsExported(name) {
+											api = append(api, fmt.Sprintf("field %s.%s %s", s.Name.Name, name, exprString(fset, field.Type)))
+										}
+									}
+								}
+							case *ast.InterfaceType:
+								for _, m := range t.Methods.List {
+									ft, ok := m.Type.(*ast.FuncType)
+									if !ok {
+										// Embedded interface.
+										api = append(api, fmt.Sprintf("embedded (%s) %s", s.Name.Name, exprString(fset, m.Type)))
+										continue
+									}
+									for _, name := range fieldNames(m) {
+										if ast.IsExported(name) {
+											api = append(api, fmt.Sprintf("method (%s) %s%s", s.Name.Name, name, signature(fset, ft)))
+										}
+									}
+								}
+							}
+						case *ast.ValueSpec:
+							if s.Type != nil || len(s.Values) > 0 {
+								valueType = s.Type
+							}
+							for _, n := range s.Names {
+								if !n.IsExported() {
+									continue
+								}
+								if valueType != nil {
+									api = append(api, fmt.Sprintf("%s %s %s", d.Tok, n.Name, exprString(fset, valueType)))
+								} else {
+									api = append(api, fmt.Sprintf("%s %s", d.Tok, n.Name))
+								}
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	sort.Strings(api)
+	return api, nil
+}
+
+// Removing, renaming or changing the signature of anything listed in api/
+// breaks downstream tools, and requires a new major version. Additions require a new minor version, and
+// updating api/ with -update_api.
+func TestApiCompatibility(t *testing.T) {
+	for dir, apiFile := range stablePackages {
+		api, err := exportedApi(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		api = stableApi(dir, api)
+		if *updateApi {
+			if err = ioutil.WriteFile(apiFile, []byte(strings.Join(api, "\n")+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		buf, err := ioutil.ReadFile(apiFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		current := make(map[string]bool)
+		for _, line := range api {
+			current[line] = true
+		}
+		want := make(map[string]bool)
+		for _, line := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+			want[line] = true
+			if !current[line] {
+				t.Errorf("%s: %q was removed, which breaks compatibility", apiFile, line)
+			}
+		}
+		for _, line := range api {
+			if !want[line] {
+				t.Errorf("%s: %q is new, run go test -run TestApiCompatibility -update_api", apiFile, line)
+			}
+		}
+	}
+}
+
+// Captures saved by earlier versions must still load.
+func TestCaptureFormatCompatibility(t *testing.T) {
+	c, err := gocw.LoadCapture(filepath.Join("captures", "xmega_aes_t50_s5000.json.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c) != 50 {
+		t.Fatalf("Loaded %d traces, want 50", len(c))
+	}
+	for i, trace := range c {
+		if len(trace.Key) != 16 || len(trace.Pt) != 16 || len(trace.Ct) != 16 {
+			t.Errorf("Trace %d has key, pt, ct lengths %d, %d, %d", i, len(trace.Key), len(trace.Pt), len(trace.Ct))
+		}
+		if len(trace.PowerMeasurements) != 5000 {
+			t.Errorf("Trace %d has %d samples, want 5000", i, len(trace.PowerMeasurements))
+		}
+	}
+}
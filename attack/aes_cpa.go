@@ -0,0 +1,284 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// One-call AES CPA attack.
+// RunAesCpa chains the usual steps of a first attack on a capture: dropping
+// baselines and traces with invalid outputs, aligning the traces if they
+// jitter, narrowing the attack to the samples around the correlation peaks,
+// streaming CPA, and checking the recovered key against the ciphertexts. The
+// cmd/attack_* tools and the analysis and preprocess packages give finer
+// control over each step.
+package attack
+
+import (
+	"bytes"
+	"crypto/aes"
+	"fmt"
+	"strings"
+
+	"github.com/google/gocw"
+	"github.com/google/gocw/analysis"
+	"github.com/google/gocw/preprocess"
+
+	"github.com/golang/glog"
+)
+
+// AES-128 key size.
+const keySize = 16
+
+// Number of traces encrypted to verify the recovered key.
+const verifyTraces = 16
+
+type AesCpaOptions struct {
+	// Leak model, e.g. analysis.SboxHammingWeight for software AES or
+	// analysis.LastRoundHammingDistance for hardware cores.
+	Model analysis.LeakModel
+	// Trace input read by Model, e.g. analysis.CiphertextInput for
+	// analysis.LastRoundHammingDistance.
+	Input analysis.ModelInput
+	// Round of the key bytes guessed by Model: 0 for the first round key
+	// (the AES key), 10 for the last round key.
+	KeyRound int
+	// Samples to attack. Selected automatically if nil, see WindowTraces.
+	Window *preprocess.Window
+	// Traces of a first CPA pass over all samples, whose correlation peaks
+	// select the attacked window, widened by WindowMargin samples.
+	WindowTraces int
+	WindowMargin int
+	// Largest trace shift searched by the alignment. Traces are only
+	// aligned if some shifts are needed. Zero disables alignment.
+	AlignMaxShift int
+	// Minimal correlation of a trace with the first one to be shifted.
+	AlignMinCorrelation float64
+	// Threshold of analysis.RejectOutliers. Zero disables outlier rejection,
+	// which needs the whole capture as a matrix.
+	OutlierThreshold float64
+	// Time base of the capture, to report sample locations as time, see
+	// gocw.LoadTimeBase.
+	TimeBase gocw.TimeBase
+}
+
+func DefaultAesCpaOptions() AesCpaOptions {
+	return AesCpaOptions{
+		Model:               analysis.SboxHammingWeight,
+		Input:               analysis.PlaintextInput,
+		KeyRound:            0,
+		WindowTraces:        500,
+		WindowMargin:        50,
+		AlignMaxShift:       10,
+		AlignMinCorrelation: 0.5,
+	}
+}
+
+type AesCpaReport struct {
+	// Traces and samples per trace attacked.
+	NumTraces  int
+	NumSamples int
+	// Samples attacked.
+	Window preprocess.Window
+	// Shift of each trace, see preprocess.Align.Shifts. Nil if the traces
+	// were not aligned.
+	Shifts []int
+	// Best guess of each byte of the round key, with locations in capture
+	// sample indices.
+	Guesses []analysis.KeyGuess
+	// Ratio of the best to the second best correlation of each byte. Close to
+	// 1 for bytes that need more traces.
+	Confidence []float64
+	RoundKey   [keySize]byte
+	Key        [keySize]byte
+	// Number of traces whose plaintext the recovered key encrypts to their
+	// ciphertext, out of VerifyTraces checked. VerifyTraces is zero if the
+	// traces have no plaintext or ciphertext.
+	Verified     int
+	VerifyTraces int
+	TimeBase     gocw.TimeBase
+}
+
+// Returns true if the recovered key was checked against ciphertexts, and
+// matched all of them.
+func (r *AesCpaReport) KeyVerified() bool {
+	return r.VerifyTraces > 0 && r.Verified == r.VerifyTraces
+}
+
+func (r *AesCpaReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Attacked %d traces, from %s to %s\n", r.NumTraces,
+		r.TimeBase.Format(r.Window.Start), r.TimeBase.Format(r.Window.End))
+	if r.Shifts != nil {
+		fmt.Fprintf(&b, "Aligned traces\n")
+	}
+	for i, g := range r.Guesses {
+		fmt.Fprintf(&b, "Byte %2d: %v at %s, confidence %.2f\n",
+			i, g, r.TimeBase.Format(g.Location), r.Confidence[i])
+	}
+	fmt.Fprintf(&b, "Key: %x", r.Key)
+	if r.VerifyTraces > 0 {
+		fmt.Fprintf(&b, " (verified on %d/%d traces)", r.Verified, r.VerifyTraces)
+	}
+	return b.String()
+}
+
+// Recovers the AES-128 key of a capture, e.g. the one returned by
+// gocw.NewCapture, see AesCpaOptions.
+func RunAesCpa(c gocw.Capture, opts AesCpaOptions) (*AesCpaReport, error) {
+	if opts.Model == nil {
+		return nil, fmt.Errorf("No leak model")
+	}
+	c = usableTraces(c)
+	if len(c) == 0 {
+		return nil, fmt.Errorf("No traces to attack")
+	}
+	numSamples := len(c[0].PowerMeasurements)
+	for i := range c {
+		if len(c[i].PowerMeasurements) != numSamples {
+			return nil, fmt.Errorf("Trace %d has %d samples, expected %d",
+				i, len(c[i].PowerMeasurements), numSamples)
+		}
+	}
+	report := &AesCpaReport{TimeBase: opts.TimeBase}
+	var err error
+
+	if opts.OutlierThreshold > 0 {
+		if c, err = (preprocess.RejectOutliers{Threshold: opts.OutlierThreshold}).Apply(c); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.AlignMaxShift > 0 && numSamples > 2*opts.AlignMaxShift {
+		align := preprocess.Align{
+			Start:          opts.AlignMaxShift,
+			End:            numSamples - opts.AlignMaxShift,
+			MaxShift:       opts.AlignMaxShift,
+			MinCorrelation: opts.AlignMinCorrelation,
+		}
+		shifts, err := align.Shifts(c)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range shifts {
+			if s != 0 {
+				report.Shifts = shifts
+				break
+			}
+		}
+		if report.Shifts != nil {
+			if c, err = align.Apply(c); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if opts.Window != nil {
+		report.Window = *opts.Window
+	} else {
+		if report.Window, err = selectWindow(c, opts); err != nil {
+			return nil, err
+		}
+		glog.V(1).Infof("Selected samples [%d, %d)", report.Window.Start, report.Window.End)
+	}
+	if c, err = report.Window.Apply(c); err != nil {
+		return nil, err
+	}
+
+	cpa := analysis.NewCPA(opts.Model, opts.Input, keySize, report.Window.End-report.Window.Start)
+	if err = cpa.Add(c...); err != nil {
+		return nil, err
+	}
+	report.NumTraces = cpa.NumTraces()
+	report.NumSamples = cpa.NumSamples()
+	for i := 0; i < keySize; i++ {
+		ranking := cpa.Ranking(i)
+		g := ranking[0]
+		g.Location += report.Window.Start
+		report.Guesses = append(report.Guesses, g)
+		confidence := 1.0
+		if ranking[1].Corr > 0 {
+			confidence = ranking[0].Corr / ranking[1].Corr
+		}
+		report.Confidence = append(report.Confidence, confidence)
+		report.RoundKey[i] = g.Key
+	}
+	report.Key = analysis.InvertKeySchedule(report.RoundKey, opts.KeyRound)
+	report.Verified, report.VerifyTraces = verifyKey(c, report.Key)
+	return report, nil
+}
+
+// Drops baselines and traces with invalid target outputs, which have no
+// meaningful inputs.
+func usableTraces(c gocw.Capture) gocw.Capture {
+	res := make(gocw.Capture, 0, len(c))
+	for _, t := range c.WithoutBaselines() {
+		if !t.InvalidOutput {
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+// Runs CPA over all samples of the first traces, and returns the window
+// spanning the correlation peaks of the best guesses.
+func selectWindow(c gocw.Capture, opts AesCpaOptions) (preprocess.Window, error) {
+	numSamples := len(c[0].PowerMeasurements)
+	n := opts.WindowTraces
+	if n <= 0 || n > len(c) {
+		n = len(c)
+	}
+	cpa := analysis.NewCPA(opts.Model, opts.Input, keySize, numSamples)
+	if err := cpa.Add(c[:n]...); err != nil {
+		return preprocess.Window{}, err
+	}
+	start, end := numSamples, 0
+	for _, g := range cpa.BestGuesses() {
+		if g.Location < start {
+			start = g.Location
+		}
+		if g.Location+1 > end {
+			end = g.Location + 1
+		}
+	}
+	start -= opts.WindowMargin
+	end += opts.WindowMargin
+	if start < 0 {
+		start = 0
+	}
+	if end > numSamples {
+		end = numSamples
+	}
+	return preprocess.Window{Start: start, End: end}, nil
+}
+
+// Encrypts the plaintexts of the first traces with key, and returns the
+// number of matching ciphertexts and of traces checked.
+func verifyKey(c gocw.Capture, key [keySize]byte) (verified, checked int) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return 0, 0
+	}
+	ct := make([]byte, aes.BlockSize)
+	for _, t := range c {
+		if checked == verifyTraces {
+			break
+		}
+		if len(t.Pt) != aes.BlockSize || len(t.Ct) != aes.BlockSize {
+			continue
+		}
+		checked++
+		block.Encrypt(ct, t.Pt)
+		if bytes.Equal(ct, t.Ct) {
+			verified++
+		}
+	}
+	return verified, checked
+}
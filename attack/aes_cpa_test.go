@@ -0,0 +1,101 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package attack_test
+
+import (
+	"crypto/aes"
+	"math/bits"
+	"math/rand"
+	"testing"
+
+	"github.com/google/gocw"
+	"github.com/google/gocw/analysis"
+	"github.com/google/gocw/attack"
+)
+
+// Simulates a software AES target leaking the sbox output of key byte i at
+// sample 100+2i, with a trigger jitter of up to jitter samples. The power
+// measurements follow a fixed pattern plus noise, so traces can be aligned.
+func simulatedCapture(key []byte, numTraces, jitter int) gocw.Capture {
+	r := rand.New(rand.NewSource(1))
+	block, _ := aes.NewCipher(key)
+	pattern := make([]float64, 200)
+	for j := range pattern {
+		pattern[j] = 4 * r.NormFloat64()
+	}
+	var c gocw.Capture
+	for n := 0; n < numTraces; n++ {
+		t := gocw.Trace{Key: key, Pt: make([]byte, 16), Ct: make([]byte, 16)}
+		r.Read(t.Pt)
+		block.Encrypt(t.Ct, t.Pt)
+		samples := make([]float64, len(pattern))
+		for j := range samples {
+			samples[j] = pattern[j] + 0.5*r.NormFloat64()
+		}
+		for i := range key {
+			samples[100+2*i] += float64(bits.OnesCount8(analysis.Sbox[t.Pt[i]^key[i]]))
+		}
+		s := 0
+		if jitter > 0 {
+			s = r.Intn(2*jitter+1) - jitter
+		}
+		t.PowerMeasurements = make([]gocw.Sample, len(samples))
+		for j := range t.PowerMeasurements {
+			k := j - s
+			if k < 0 || k >= len(samples) {
+				k = j
+			}
+			t.PowerMeasurements[j] = gocw.Sample(samples[k])
+		}
+		c = append(c, t)
+	}
+	// Baselines and invalid outputs must be ignored.
+	c = append(c, gocw.Trace{PowerMeasurements: make([]gocw.Sample, len(pattern)), Baseline: true})
+	c = append(c, gocw.Trace{Key: key, Pt: make([]byte, 16), Ct: make([]byte, 16),
+		PowerMeasurements: make([]gocw.Sample, len(pattern)), InvalidOutput: true})
+	return c
+}
+
+func TestRunAesCpa(t *testing.T) {
+	key := []byte{0x2b, 0x7e, 0x15, 0x16, 0x28, 0xae, 0xd2, 0xa6,
+		0xab, 0xf7, 0x15, 0x88, 0x09, 0xcf, 0x4f, 0x3c}
+	for _, jitter := range []int{0, 3} {
+		c := simulatedCapture(key, 300, jitter)
+		report, err := attack.RunAesCpa(c, attack.DefaultAesCpaOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(report.Key[:]) != string(key) {
+			t.Errorf("Jitter %d: recovered key %x, expected %x", jitter, report.Key, key)
+		}
+		if !report.KeyVerified() {
+			t.Errorf("Jitter %d: key verified on %d/%d traces", jitter, report.Verified, report.VerifyTraces)
+		}
+		if report.NumTraces != 300 {
+			t.Errorf("Jitter %d: attacked %d traces, expected 300", jitter, report.NumTraces)
+		}
+		if (report.Shifts != nil) != (jitter > 0) {
+			t.Errorf("Jitter %d: unexpected alignment %v", jitter, report.Shifts)
+		}
+		if report.Window.Start > 100 || report.Window.End <= 130 || report.Window.End-report.Window.Start >= 200 {
+			t.Errorf("Jitter %d: selected window %+v", jitter, report.Window)
+		}
+		for i, g := range report.Guesses {
+			if g.Location != 100+2*i {
+				t.Errorf("Jitter %d: byte %d leaks at sample %d, expected %d", jitter, i, g.Location, 100+2*i)
+			}
+		}
+	}
+}
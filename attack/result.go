@@ -0,0 +1,134 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Saved results of key recovery attacks.
+// An AttackResult keeps the best guesses of each key byte with their scores,
+// not just the best one, so a key whose best guess is wrong for a byte or two
+// can still be found by enumerating the runner-up guesses.
+package attack
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Attack names of AttackResult.
+const (
+	AttackSboxCpa = "sbox-cpa"
+	AttackSboxDpa = "sbox-dpa"
+)
+
+// Guess of a key byte.
+type GuessScore struct {
+	Key byte `json:"key"`
+	// Score of the attack, e.g. the absolute correlation for CPA. Higher is
+	// better.
+	Score float64 `json:"score"`
+	// Difference to the score of the next best guess.
+	Gap float64 `json:"gap"`
+	// Sample index of the score.
+	Location int `json:"location"`
+}
+
+// Best guesses of a key byte, by decreasing score.
+type ByteResult struct {
+	Index   int          `json:"index"`
+	Guesses []GuessScore `json:"guesses"`
+}
+
+// Returns the best topK guesses of a key byte given the score and location
+// of each of the 256 guesses. The gap of the last guess is to the first one
+// left out.
+func RankGuesses(index int, scores [256]float64, locations [256]int, topK int) ByteResult {
+	all := make([]GuessScore, 256)
+	for k := range all {
+		all[k] = GuessScore{Key: byte(k), Score: scores[k], Location: locations[k]}
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Score > all[j].Score })
+	for i := 0; i < len(all)-1; i++ {
+		all[i].Gap = all[i].Score - all[i+1].Score
+	}
+	if topK <= 0 || topK > len(all) {
+		topK = len(all)
+	}
+	return ByteResult{Index: index, Guesses: all[:topK]}
+}
+
+// Returns the best guess.
+func (b ByteResult) Best() GuessScore {
+	return b.Guesses[0]
+}
+
+func (b ByteResult) String() string {
+	var s strings.Builder
+	for i, g := range b.Guesses {
+		if i > 0 {
+			s.WriteString(", ")
+		}
+		fmt.Fprintf(&s, "0x%02x %f (+%f)", g.Key, g.Score, g.Gap)
+	}
+	return s.String()
+}
+
+type AttackResult struct {
+	// Attack, e.g. AttackSboxCpa.
+	Attack string `json:"attack"`
+	// Capture attacked.
+	Input     string       `json:"input"`
+	NumTraces int          `json:"num_traces"`
+	Bytes     []ByteResult `json:"bytes"`
+}
+
+// Returns the key of the best guesses.
+func (r *AttackResult) Key() []byte {
+	key := make([]byte, len(r.Bytes))
+	for i, b := range r.Bytes {
+		key[i] = b.Best().Key
+	}
+	return key
+}
+
+// Loads a JSON encoded result from file.
+func LoadAttackResult(filename string) (*AttackResult, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening attack result file: %v", err)
+	}
+	defer f.Close()
+	r := &AttackResult{}
+	if err = json.NewDecoder(f).Decode(r); err != nil {
+		return nil, fmt.Errorf("JSON decoder failed %v", err)
+	}
+	for _, b := range r.Bytes {
+		if len(b.Guesses) == 0 {
+			return nil, fmt.Errorf("No guesses for key byte %d", b.Index)
+		}
+	}
+	return r, nil
+}
+
+// Saves the result as JSON, replacing any previous file.
+func (r *AttackResult) Save(filename string) error {
+	buf, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("JSON encoder failed %v", err)
+	}
+	if err = os.WriteFile(filename, append(buf, '\n'), 0644); err != nil {
+		return fmt.Errorf("Error writing attack result file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package attack_test
+
+import (
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/google/gocw/attack"
+)
+
+func TestRankGuesses(t *testing.T) {
+	var scores [256]float64
+	var locations [256]int
+	scores[0x2b], locations[0x2b] = 0.9, 10
+	scores[0x2a], locations[0x2a] = 0.6, 11
+	scores[0x10], locations[0x10] = 0.5, 12
+	scores[0x11] = 0.1
+
+	b := attack.RankGuesses(3, scores, locations, 3)
+	want := attack.ByteResult{Index: 3, Guesses: []attack.GuessScore{
+		{Key: 0x2b, Score: 0.9, Gap: 0.9 - 0.6, Location: 10},
+		{Key: 0x2a, Score: 0.6, Gap: 0.6 - 0.5, Location: 11},
+		{Key: 0x10, Score: 0.5, Gap: 0.5 - 0.1, Location: 12},
+	}}
+	if b.Index != want.Index || len(b.Guesses) != len(want.Guesses) {
+		t.Fatalf("Got %+v, want %+v", b, want)
+	}
+	for i, g := range b.Guesses {
+		w := want.Guesses[i]
+		if g.Key != w.Key || g.Score != w.Score || math.Abs(g.Gap-w.Gap) > 1e-9 || g.Location != w.Location {
+			t.Errorf("Guess %d is %+v, want %+v", i, g, w)
+		}
+	}
+	if b.Best().Key != 0x2b {
+		t.Errorf("Best guess 0x%02x, want 0x2b", b.Best().Key)
+	}
+	if all := attack.RankGuesses(3, scores, locations, 0); len(all.Guesses) != 256 {
+		t.Errorf("Got %d guesses, want 256", len(all.Guesses))
+	}
+}
+
+func TestAttackResultSaveLoad(t *testing.T) {
+	var scores [256]float64
+	var locations [256]int
+	r := &attack.AttackResult{Attack: attack.AttackSboxCpa, Input: "c.json.gz", NumTraces: 50}
+	for i := 0; i < 16; i++ {
+		scores[i] = 1
+		r.Bytes = append(r.Bytes, attack.RankGuesses(i, scores, locations, 2))
+		scores[i] = 0
+	}
+	filename := filepath.Join(t.TempDir(), "result.json")
+	if err := r.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := attack.LoadAttackResult(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, r) {
+		t.Errorf("Loaded %+v, want %+v", loaded, r)
+	}
+	want := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	if key := loaded.Key(); !reflect.DeepEqual(key, want) {
+		t.Errorf("Key %x, want %x", key, want)
+	}
+}
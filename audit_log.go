@@ -0,0 +1,210 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Append-only audit log of capture sessions.
+// One JSON event per line, written alongside the capture file. Each event is
+// synced to disk before returning, so the log survives crashes and can be
+// used for post-mortem analysis of questionable captures. Unlike glog output,
+// the log is not rotated or filtered by verbosity.
+package gocw
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type AuditEvent struct {
+	Time  time.Time   `json:"time"`
+	Event string      `json:"event"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+type AuditLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// Returns the audit log filename of a capture file,
+// e.g. aes.json.gz -> aes.audit.jsonl.
+func AuditLogFilename(captureFile string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(captureFile, ".gz"), ".json") + ".audit.jsonl"
+}
+
+// Opens the log for appending, creating it if needed.
+func OpenAuditLog(filename string) (*AuditLog, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening audit log: %v", err)
+	}
+	return &AuditLog{f: f}, nil
+}
+
+// Appends an event. Logging to a nil log is a no-op, so callers don't need to
+// check whether auditing is enabled.
+func (l *AuditLog) Log(event string, data interface{}) error {
+	if l == nil {
+		return nil
+	}
+	buf, err := json.Marshal(AuditEvent{Time: time.Now(), Event: event, Data: data})
+	if err != nil {
+		return fmt.Errorf("JSON encoder failed %v", err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// A single write per line, so a crash leaves at most one partial line.
+	if _, err = l.f.Write(append(buf, '\n')); err != nil {
+		return fmt.Errorf("Error writing audit log: %v", err)
+	}
+	return l.f.Sync()
+}
+
+func (l *AuditLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.f.Close()
+}
+
+// Reads the events of a log. A truncated last line, left by a crash, is
+// ignored. Data is decoded as generic JSON.
+func ReadAuditLog(r io.Reader) ([]AuditEvent, error) {
+	var events []AuditEvent
+	decoder := json.NewDecoder(r)
+	for {
+		var e AuditEvent
+		err := decoder.Decode(&e)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return events, nil
+		}
+		if err != nil {
+			return events, fmt.Errorf("JSON decoder failed %v", err)
+		}
+		events = append(events, e)
+	}
+}
+
+// Returns the hex SHA-256 of a file, e.g. the target firmware.
+func FileDigest(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Scope settings recorded at the start of a capture session.
+type ScopeConfig struct {
+	Serial         string
+	Hw             HwVersion
+	Fw             FwVersion
+	RegisterMap    string
+	GainMode       GainMode
+	Gain           uint8
+	TriggerMode    TriggerMode
+	TotalSamples   uint32
+	TriggerOffset  uint32
+	PreSamples     uint32
+	Decimate       uint16
+	AdcClockSource AdcSrcTuple
+	AdcFreq        uint32
+	ClkGenMul      uint32
+	ClkGenDiv      uint32
+	// Trigger pins, target IO and HS2 output. Nil for other ADCs than the
+	// ChipWhisperer one.
+	Io *ScopeIo `json:",omitempty"`
+	// Nil without a glitch module.
+	Glitch *Glitch `json:",omitempty"`
+}
+
+// Pin settings of a ScopeConfig.
+type ScopeIo struct {
+	TriggerPins     []TriggerTargetIoPin
+	TriggerPinLogic TriggerPinLogic
+	// TIO1 to TIO4.
+	TargetIo [4]TargetIoMode
+	Hs2      Hs2Mode
+}
+
+// Returns the amplifier gain in dB, to compare captures recorded with
+// different gain settings.
+func (c ScopeConfig) GainDb() float64 {
+	return GainDb(c.GainMode, c.Gain)
+}
+
+// Settings of adc. Other ADCs than the ChipWhisperer one leave the serial
+// number, register map and clock generator settings empty.
+func scopeConfigOf(adc AdcInterface) ScopeConfig {
+	if c, ok := adc.(*Adc); ok {
+		return c.scopeConfig()
+	}
+	caps := adc.Capabilities()
+	return ScopeConfig{
+		Hw:             caps.Hw,
+		Fw:             caps.Fw,
+		GainMode:       adc.GainMode(),
+		Gain:           adc.Gain(),
+		TriggerMode:    adc.TriggerMode(),
+		TotalSamples:   adc.TotalSamples(),
+		TriggerOffset:  adc.TriggerOffset(),
+		PreSamples:     adc.PreTriggerSamples(),
+		Decimate:       adc.DownsampleFactor(),
+		AdcClockSource: adc.AdcClockSource(),
+		AdcFreq:        adc.AdcFreq(),
+	}
+}
+
+func (c *Adc) scopeConfig() ScopeConfig {
+	cfg := ScopeConfig{
+		Serial:         c.serial,
+		Hw:             c.caps.Hw,
+		Fw:             c.caps.Fw,
+		GainMode:       c.GainMode(),
+		Gain:           c.Gain(),
+		TriggerMode:    c.TriggerMode(),
+		TotalSamples:   c.TotalSamples(),
+		TriggerOffset:  c.TriggerOffset(),
+		PreSamples:     c.PreTriggerSamples(),
+		Decimate:       c.DownsampleFactor(),
+		AdcClockSource: c.AdcClockSource(),
+		AdcFreq:        c.AdcFreq(),
+		ClkGenMul:      c.clkGenMul(),
+		ClkGenDiv:      c.clkGenDiv(),
+	}
+	if c.regMap != nil {
+		cfg.RegisterMap = c.regMap.Name
+	}
+	cfg.Io = &ScopeIo{
+		TriggerPins:     c.TriggerTargetIoPins(),
+		TriggerPinLogic: c.TriggerPinLogic(),
+		TargetIo:        [4]TargetIoMode{c.TargetIo1(), c.TargetIo2(), c.TargetIo3(), c.TargetIo4()},
+		Hs2:             c.Hs2(),
+	}
+	if c.caps.Supports(FeatureGlitch) {
+		g := c.Glitch()
+		cfg.Glitch = &g
+	}
+	return cfg
+}
@@ -0,0 +1,82 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/gocw"
+)
+
+func TestAuditLogFilename(t *testing.T) {
+	for in, expected := range map[string]string{
+		"captures/aes.json.gz": "captures/aes.audit.jsonl",
+		"aes.json":             "aes.audit.jsonl",
+		"aes":                  "aes.audit.jsonl",
+	} {
+		if actual := gocw.AuditLogFilename(in); actual != expected {
+			t.Errorf("AuditLogFilename(%s) = %s, expected %s", in, actual, expected)
+		}
+	}
+}
+
+func TestAuditLogAppendsAndSurvivesTruncation(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "c.audit.jsonl")
+	for session := 0; session < 2; session++ {
+		l, err := gocw.OpenAuditLog(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = l.Log("retry", map[string]int{"Trace": session}); err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+	}
+
+	// Simulate a crash in the middle of a write.
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"time":"2019-01-01T00:00:00Z","event":"bat`)
+	f.Close()
+
+	f, err = os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	events, err := gocw.ReadAuditLog(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("Read %d events, expected 2", len(events))
+	}
+	for i, e := range events {
+		if e.Event != "retry" || e.Data.(map[string]interface{})["Trace"] != float64(i) {
+			t.Errorf("Event %d: %+v", i, e)
+		}
+	}
+}
+
+func TestNilAuditLog(t *testing.T) {
+	var l *gocw.AuditLog
+	if err := l.Log("event", nil); err != nil {
+		t.Errorf("Log on nil log failed: %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Idle target baseline traces.
+// Long campaigns show a slow baseline drift (temperature, supply), which adds
+// a varying offset to the measurements and hurts correlation. Captures can
+// interleave baseline traces, recorded with a forced trigger while the target
+// is idle, and tagged with Trace.Baseline (see
+// CaptureOptions.BaselineInterval). preprocess.SubtractBaseline removes the
+// drift they measure.
+package gocw
+
+// Returns the indices of the baseline traces.
+func (c Capture) Baselines() []int {
+	var idx []int
+	for i := range c {
+		if c[i].Baseline {
+			idx = append(idx, i)
+		}
+	}
+	return idx
+}
+
+// Returns the capture without its baseline traces, e.g. before running an
+// attack.
+func (c Capture) WithoutBaselines() Capture {
+	res := make(Capture, 0, len(c))
+	for i := range c {
+		if !c[i].Baseline {
+			res = append(res, c[i])
+		}
+	}
+	return res
+}
+
+// A baseline trace recorded before trace pos of a capture.
+type baselineAt struct {
+	pos   int
+	trace Trace
+}
+
+// Inserts baseline traces at their recorded positions.
+func interleaveBaselines(c Capture, baselines []baselineAt) Capture {
+	if len(baselines) == 0 {
+		return c
+	}
+	res := make(Capture, 0, len(c)+len(baselines))
+	next := 0
+	for i := 0; i <= len(c); i++ {
+		for ; next < len(baselines) && baselines[next].pos == i; next++ {
+			res = append(res, baselines[next].trace)
+		}
+		if i < len(c) {
+			res = append(res, c[i])
+		}
+	}
+	return res
+}
@@ -0,0 +1,45 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/google/gocw"
+)
+
+func TestCaptureBaselines(t *testing.T) {
+	baseline := gocw.Trace{PowerMeasurements: make([]gocw.Sample, 2), Baseline: true}
+	c := gocw.Capture{baseline, setTrace(0, 2), setTrace(1, 2), baseline}
+	if idx := c.Baselines(); !reflect.DeepEqual(idx, []int{0, 3}) {
+		t.Errorf("Baselines() = %v, expected [0 3]", idx)
+	}
+	if ops := c.WithoutBaselines(); len(ops) != 2 || ops[0].Pt[0] != 0 || ops[1].Pt[0] != 1 {
+		t.Errorf("WithoutBaselines() = %v", ops)
+	}
+
+	// Baselines have no inputs, but don't break the capture set shape.
+	dir := t.TempDir()
+	saveCaptures(t, dir, map[string]gocw.Capture{"b.json.gz": c})
+	s, err := gocw.OpenCaptureSet(filepath.Join(dir, "*.json.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.Len(); err != nil || n != 4 {
+		t.Errorf("Len() = %d, %v, expected 4", n, err)
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Campaign templates for the common starter-kit targets.
+// A template in templates/ records a complete experiment: firmware, target
+// clock, capture settings, attack, and the key the attack must recover. Run
+// programs the target, captures, attacks and checks the key, which validates
+// the whole stack on fresh hardware, see cmd/run.go.
+package campaign
+
+import (
+	"bytes"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/google/gocw"
+	"github.com/google/gocw/attack"
+	"github.com/google/gocw/util"
+
+	"github.com/golang/glog"
+)
+
+//go:embed templates/*.json
+var templateFiles embed.FS
+
+// Supported Template.Attack values.
+const AttackAesCpa = "aes-cpa"
+
+type Template struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// PLATFORM the firmware is built for, see the README.
+	Platform string `json:"platform"`
+	// Intel-Hex firmware, relative to the working directory. Empty to skip
+	// programming.
+	Firmware string `json:"firmware"`
+	// Target clock, and ADC gain.
+	ClockHz uint32 `json:"clock_hz"`
+	Gain    uint8  `json:"gain"`
+	Samples int    `json:"samples"`
+	Offset  int    `json:"offset"`
+	Traces  int    `json:"traces"`
+	// Hex AES key set on the target, which the attack must recover.
+	Key    string `json:"key"`
+	Attack string `json:"attack"`
+}
+
+func (t *Template) validate() error {
+	if t.Attack != AttackAesCpa {
+		return fmt.Errorf("Template %s: unsupported attack %q", t.Name, t.Attack)
+	}
+	if t.Samples <= 0 || t.Traces <= 0 {
+		return fmt.Errorf("Template %s: invalid samples (%d) or traces (%d)", t.Name, t.Samples, t.Traces)
+	}
+	if t.Gain > gocw.GainMax {
+		return fmt.Errorf("Template %s: gain %d above %d", t.Name, t.Gain, gocw.GainMax)
+	}
+	if key, err := hex.DecodeString(t.Key); err != nil || len(key) != 16 {
+		return fmt.Errorf("Template %s: key %q is not a hex AES-128 key", t.Name, t.Key)
+	}
+	return nil
+}
+
+// Returns the embedded templates, by name.
+func Templates() (map[string]*Template, error) {
+	entries, err := templateFiles.ReadDir("templates")
+	if err != nil {
+		return nil, err
+	}
+	templates := make(map[string]*Template)
+	for _, e := range entries {
+		buf, err := templateFiles.ReadFile(path.Join("templates", e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		t := &Template{}
+		if err = json.Unmarshal(buf, t); err != nil {
+			return nil, fmt.Errorf("%s: %v", e.Name(), err)
+		}
+		if err = t.validate(); err != nil {
+			return nil, err
+		}
+		if _, ok := templates[t.Name]; ok {
+			return nil, fmt.Errorf("Template %s defined twice", t.Name)
+		}
+		templates[t.Name] = t
+	}
+	return templates, nil
+}
+
+// Returns the sorted names of the embedded templates.
+func Names() ([]string, error) {
+	templates, err := Templates()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Returns the named template.
+func Lookup(name string) (*Template, error) {
+	templates, err := Templates()
+	if err != nil {
+		return nil, err
+	}
+	t, ok := templates[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown template %q", name)
+	}
+	return t, nil
+}
+
+// Runs a template: programs the target, captures, saves the capture to
+// output unless empty, and attacks it. Fails if the attack doesn't recover
+// the template key.
+func Run(t *Template, output string) (*attack.AesCpaReport, error) {
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+	key, _ := hex.DecodeString(t.Key)
+
+	if len(t.Firmware) > 0 {
+		glog.Infof("Programming %s", t.Firmware)
+		if err := util.ProgramFlashFile(t.Firmware); err != nil {
+			return nil, fmt.Errorf("Failed programming %s (built with PLATFORM=%s?): %v",
+				t.Firmware, t.Platform, err)
+		}
+	}
+
+	opts := gocw.DefaultCaptureOptions()
+	// A wrong output means a broken setup, rather than a glitch to retry.
+	opts.Validator = gocw.AesValidator
+	opts.ValidationPolicy = gocw.ValidationTag
+	configured := false
+	opts.BeforeTrace = func(s *gocw.CaptureSession, i int, trace *gocw.Trace) error {
+		if configured {
+			return nil
+		}
+		configured = true
+		if t.ClockHz > 0 {
+			s.Adc.SetClkGenOutputFreq(t.ClockHz)
+		}
+		s.Adc.SetGain(t.Gain)
+		return s.Adc.Error()
+	}
+	glog.Infof("Capturing %d traces of %d samples", t.Traces, t.Samples)
+	capture, err := gocw.NewCaptureWithOptions(key, gocw.RandGen(16), t.Samples, t.Traces, t.Offset, opts)
+	if err != nil {
+		return nil, err
+	}
+	invalid := 0
+	for _, trace := range capture {
+		if trace.InvalidOutput {
+			invalid++
+		}
+	}
+	if invalid > 0 {
+		return nil, fmt.Errorf("The target returned wrong ciphertexts for %d of %d traces", invalid, len(capture))
+	}
+	if len(output) > 0 {
+		if err = capture.Save(output); err != nil {
+			return nil, err
+		}
+		glog.Infof("Saved %s", output)
+	}
+
+	report, err := attack.RunAesCpa(capture, attack.DefaultAesCpaOptions())
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(report.Key[:], key) {
+		return report, fmt.Errorf("Recovered key %x, expected %x", report.Key, key)
+	}
+	return report, nil
+}
@@ -0,0 +1,41 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package campaign_test
+
+import (
+	"testing"
+
+	"github.com/google/gocw/campaign"
+)
+
+func TestTemplates(t *testing.T) {
+	names, err := campaign.Names()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"aes-cpa-quickstart", "aes-cpa-quickstart-xmega"} {
+		tmpl, err := campaign.Lookup(want)
+		if err != nil {
+			t.Errorf("Lookup(%s) failed: %v. Templates: %v", want, err, names)
+			continue
+		}
+		if tmpl.Attack != campaign.AttackAesCpa || len(tmpl.Firmware) == 0 {
+			t.Errorf("Template %s = %+v", want, tmpl)
+		}
+	}
+	if _, err := campaign.Lookup("missing"); err == nil {
+		t.Error("Lookup(missing) succeeded")
+	}
+}
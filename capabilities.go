@@ -0,0 +1,134 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Features supported by each hardware / firmware combination.
+// APIs check the table before touching feature registers, since writes to
+// registers missing from the bitstream are silently ignored.
+package gocw
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/gocw/internal/regmap"
+)
+
+//go:generate stringer -type Feature
+type Feature int
+
+const (
+	// Streams samples over USB while capturing.
+	FeatureStreamMode Feature = iota
+	// Sum-of-absolute-differences trigger.
+	FeatureSadTrigger Feature = iota
+	// Clock / voltage glitch generator.
+	FeatureGlitch Feature = iota
+	// Pulse output on trigger, for external fault injection probes.
+	FeatureTriggerPulse Feature = iota
+	// Logic capture of the TIO pins alongside ADC samples.
+	FeatureLogicCapture Feature = iota
+	// Multiple triggers recorded per arm, see SetSegments.
+	FeatureSegmentedCapture Feature = iota
+	// Serial data pattern trigger, see SetDecodeTrigger.
+	FeatureDecodeTrigger Feature = iota
+)
+
+// Returned (wrapped) when a feature is not supported by the hardware.
+var ErrNotSupported = errors.New("Feature not supported")
+
+type capability struct {
+	hwTypes []HwType
+	// Minimal FPGA register map version.
+	minRegVersion uint8
+	// Minimal NAEUSB firmware version.
+	minFw FwVersion
+	// Registers the bitstream must have, looked up in its register map.
+	registers []string
+}
+
+var capabilityTable = map[Feature]capability{
+	FeatureStreamMode:   {[]HwType{HwChipWhispererCw1200}, 0, FwVersion{0, 11, 0}, nil},
+	FeatureSadTrigger:   {[]HwType{HwChipWhispererCw1200}, 0, FwVersion{0, 11, 0}, nil},
+	FeatureGlitch:       {[]HwType{HwChipWhispererLite, HwChipWhispererCw1200}, 0, FwVersion{0, 11, 0}, nil},
+	FeatureTriggerPulse: {[]HwType{HwChipWhispererLite, HwChipWhispererCw1200}, 0, FwVersion{0, 11, 0}, nil},
+	// None of the embedded register maps has the logic analyzer registers
+	// yet, so this is unsupported until the bitstream's map describes them.
+	FeatureLogicCapture: {[]HwType{HwChipWhispererCw1200}, 0, FwVersion{0, 11, 0}, []string{"logic_capture", "logic_data"}},
+	// None of the embedded register maps has the "segments" register yet, so
+	// this is unsupported until the bitstream's map describes it.
+	FeatureSegmentedCapture: {[]HwType{HwChipWhispererCw1200}, 0, FwVersion{0, 11, 0}, []string{"segments"}},
+	FeatureDecodeTrigger:    {[]HwType{HwChipWhispererCw1200}, 0, FwVersion{0, 11, 0}, nil},
+}
+
+// Hardware and firmware versions of a device.
+type Capabilities struct {
+	Hw HwVersion
+	Fw FwVersion
+}
+
+func fwAtLeast(v, min FwVersion) bool {
+	if v.Major != min.Major {
+		return v.Major > min.Major
+	}
+	return v.Minor >= min.Minor
+}
+
+func (c Capabilities) Supports(f Feature) bool {
+	entry, ok := capabilityTable[f]
+	return ok && c.versionSupports(entry) && c.missingRegister(entry) == ""
+}
+
+func (c Capabilities) versionSupports(entry capability) bool {
+	if c.Hw.RegVersion < entry.minRegVersion || !fwAtLeast(c.Fw, entry.minFw) {
+		return false
+	}
+	for _, t := range entry.hwTypes {
+		if t == c.Hw.HwType {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the first register required by entry that is not in the register
+// map of the hardware, or "" if all are.
+func (c Capabilities) missingRegister(entry capability) string {
+	if len(entry.registers) == 0 {
+		return ""
+	}
+	m, err := regmap.Load(int(c.Hw.HwType), c.Hw.RegVersion)
+	if err != nil {
+		return entry.registers[0]
+	}
+	for _, name := range entry.registers {
+		if _, err := m.Register(name); err != nil {
+			return name
+		}
+	}
+	return ""
+}
+
+// Returns an error wrapping ErrNotSupported if f is not supported.
+func (c Capabilities) Require(f Feature) error {
+	if c.Supports(f) {
+		return nil
+	}
+	entry := capabilityTable[f]
+	if c.versionSupports(entry) {
+		return fmt.Errorf("%v needs the %q register, which is not in the register map of %v (register version %d): %w",
+			f, c.missingRegister(entry), c.Hw.HwType, c.Hw.RegVersion, ErrNotSupported)
+	}
+	return fmt.Errorf("%v is not supported by %v (register version %d, firmware %d.%d): %w",
+		f, c.Hw.HwType, c.Hw.RegVersion, c.Fw.Major, c.Fw.Minor, ErrNotSupported)
+}
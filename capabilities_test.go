@@ -0,0 +1,76 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/gocw"
+)
+
+func TestCapabilities(t *testing.T) {
+	lite := gocw.Capabilities{
+		Hw: gocw.HwVersion{HwType: gocw.HwChipWhispererLite},
+		Fw: gocw.FwVersion{Major: 0, Minor: 11},
+	}
+	if err := lite.Require(gocw.FeatureGlitch); err != nil {
+		t.Errorf("CW-Lite should support glitching: %v", err)
+	}
+	if err := lite.Require(gocw.FeatureStreamMode); !errors.Is(err, gocw.ErrNotSupported) {
+		t.Errorf("CW-Lite should not support stream mode, got %v", err)
+	}
+	if lite.Supports(gocw.FeatureLogicCapture) {
+		t.Errorf("CW-Lite should not support logic capture")
+	}
+
+	oldFw := lite
+	oldFw.Fw.Minor = 10
+	if oldFw.Supports(gocw.FeatureGlitch) {
+		t.Errorf("Glitching should require firmware 0.11")
+	}
+}
+
+func TestFeaturesNeedRegisters(t *testing.T) {
+	for f, registers := range map[gocw.Feature][]string{
+		gocw.FeatureSegmentedCapture: {"segments"},
+		gocw.FeatureLogicCapture:     {"logic_capture", "logic_data"},
+	} {
+		for _, hw := range []gocw.HwType{gocw.HwChipWhispererLite, gocw.HwChipWhispererCw1200} {
+			caps := gocw.Capabilities{
+				Hw: gocw.HwVersion{HwType: hw},
+				Fw: gocw.FwVersion{Major: 0, Minor: 11},
+			}
+			m, err := gocw.LoadRegisterMap(hw, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := hw == gocw.HwChipWhispererCw1200
+			for _, name := range registers {
+				if _, err := m.Lookup(name); err != nil {
+					want = false
+				}
+			}
+			if got := caps.Supports(f); got != want {
+				t.Errorf("%v supports %v: %v, want %v", hw, f, got, want)
+			}
+			if err := caps.Require(f); want != (err == nil) {
+				t.Errorf("%v Require(%v) = %v", hw, f, err)
+			} else if err != nil && !errors.Is(err, gocw.ErrNotSupported) {
+				t.Errorf("%v Require(%v) = %v, want ErrNotSupported", hw, f, err)
+			}
+		}
+	}
+}
@@ -17,117 +17,755 @@ package gocw
 
 import (
 	"compress/gzip"
+	"context"
 	"crypto/rand"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"time"
 
 	"github.com/golang/glog"
 	"gonum.org/v1/gonum/mat"
 )
 
 type Trace struct {
-	Key               []byte    `json:"k"`
-	Pt                []byte    `json:"pt"`
-	Ct                []byte    `json:"ct"`
-	PowerMeasurements []float64 `json:"pm"`
+	Key               []byte   `json:"k"`
+	Pt                []byte   `json:"pt"`
+	Ct                []byte   `json:"ct"`
+	PowerMeasurements []Sample `json:"pm"`
+	// Set if the ADC clock was found unlocked after this trace's batch.
+	ClockUnlocked bool `json:"cu,omitempty"`
+	// State of the TIO pins at each sample, see LogicChannels. Empty unless
+	// logic capture was enabled.
+	Logic []uint8 `json:"lg,omitempty"`
+	// Set for traces recorded with the target idle, which have no key,
+	// plaintext or ciphertext. See CaptureOptions.BaselineInterval.
+	Baseline bool `json:"bl,omitempty"`
+	// Set if CaptureOptions.Validator rejected the target output and the
+	// ValidationPolicy is ValidationTag.
+	InvalidOutput bool `json:"io,omitempty"`
+	// Amplifier gain the trace was recorded with, see GainDb.
+	GainDb float64 `json:"gdb"`
 }
 
 type Capture []Trace
 
 type PtGen func() ([]byte, error)
 
-// Generates random plaintext for each trace.
+// Generates random plaintext for each trace, from crypto/rand. See
+// SeededRandGen for reproducible campaigns.
 func RandGen(numBytes int) PtGen {
-	return func() ([]byte, error) {
-		buf := make([]byte, numBytes)
-		if _, err := rand.Read(buf); err != nil {
-			return nil, err
-		}
-		return buf, nil
+	return RandGenFrom(rand.Reader, numBytes)
+}
+
+// Default number of traces between clock checks.
+const DefaultClockCheckInterval = 10
+
+type CaptureOptions struct {
+	// What to do when the ADC clock is found unlocked.
+	ClockPolicy ClockPolicy
+	// Number of traces between clock checks.
+	ClockCheckInterval int
+	// Optional audit log of the session, see OpenAuditLog.
+	AuditLog *AuditLog
+	// Name of the registered target protocol. Empty for simple-serial.
+	TargetProtocol string
+	// TIO pins to record alongside the power measurements. Fails the capture
+	// if the hardware has no logic capture.
+	LogicChannels LogicChannels
+	// Optional hooks, e.g. to toggle GPIOs, rotate keys or log external
+	// instrument readings. BeforeTrace runs before arming, after the
+	// plaintext was generated. AfterTrace runs once the measurements were
+	// read. Both run again for retried traces. An error aborts the capture.
+	BeforeTrace TraceHook
+	AfterTrace  TraceHook
+	// Traces captured per arm. Values above 1 send the plaintexts in a
+	// single burst and use segmented capture, and require a BatchTarget.
+	BatchSize int
+	// Number of traces between idle baseline traces, see Trace.Baseline.
+	// Baselines are also recorded before the first and after the last trace,
+	// and are not counted in numTraces. Zero disables them.
+	BaselineInterval int
+	// Optional latency histograms of the USB transfers and serial round
+	// trips of the session.
+	LatencyStats *LatencyStats
+	// Describes the plaintext generator in the audit log, e.g.
+	// SeededRand.String(), so the campaign can be regenerated.
+	RandSource string
+	// Optional check of the target output of each trace, e.g. AesValidator.
+	// ValidationPolicy tells what to do with the traces it rejects.
+	Validator        TraceValidator
+	ValidationPolicy ValidationPolicy
+	// Lowers the ADC gain and captures again the traces that clipped the ADC
+	// (see TraceRead.Clipped). Otherwise they are kept, and logged.
+	AutoGain bool
+	// Peak amplitude (see PeakAmplitude) to keep traces at by adjusting the
+	// gain mode and gain between arms, e.g. 0.7. The gain of each trace is
+	// recorded in Trace.GainDb. 0 disables auto-ranging.
+	TargetAmplitude float64
+	// Acquires the traces instead of the ChipWhisperer ADC, see
+	// ScopeInterface. Closed with the capture.
+	Scope ScopeInterface
+	// Captures with these handles instead of opening the ChipWhisperer, e.g.
+	// with the simulator (see sim.Simulator.CaptureDevice). They are not
+	// closed, and can't be combined with Reconnect.
+	Device *CaptureDevice
+	// Optional provenance of the capture, recorded in the audit log. Saving
+	// it alongside the capture file is up to the caller, see
+	// Provenance.Save.
+	Provenance *Provenance
+	// Power-cycles the target after this many consecutive trigger timeouts,
+	// e.g. when it crashed, and sets the key again. Zero disables it.
+	PowerCycleAfterTimeouts int
+	// Reconnects when the device drops off the bus, and resumes the capture
+	// with the ADC settings of the last clock check. Nil disables it.
+	Reconnect *ReconnectPolicy
+	// Serial settings of the target. Nil uses DefaultUsartConfig.
+	Usart *UsartConfig
+	// Measures the length of the target operation on a pilot trace, and sets
+	// the downsample factor and samples per trace covering all of it within
+	// the ADC FIFO, see Adc.FitOperation. numSamples only applies to the
+	// pilot trace. The trigger must stay active during the operation.
+	AdaptiveDecimation bool
+	// Optional trace stream the traces are written to as the capture goes,
+	// after each clock check, so tools can follow the capture, e.g. the
+	// viewer's live attacks. Baseline traces are only in the returned
+	// capture. A write error aborts the capture.
+	Stream *TraceEncoder
+}
+
+// Auto-ranging adjusts the gain when the peak amplitude is off target by more
+// than this fraction of the target.
+const autoRangeTolerance = 0.1
+
+// Consecutive retryable target errors (see IsRetryableTargetError) after
+// which a capture fails.
+const maxTargetErrorRetries = 10
+
+// Consecutive traces discarded by ValidationDiscard after which a capture
+// fails, e.g. when the target runs with another key.
+const MaxValidationDiscards = 10
+
+// Device handles a capture runs on, see CaptureOptions.Device.
+type CaptureDevice struct {
+	Dev   UsbDeviceInterface
+	Adc   AdcInterface
+	Usart UsartInterface
+}
+
+// Device handles of a capture, passed to hooks.
+type CaptureSession struct {
+	Dev UsbDeviceInterface
+	// Nil with CaptureOptions.Device.
+	Fpga   *Fpga
+	Adc    AdcInterface
+	Usart  UsartInterface
+	Target Target
+	// Set with CaptureOptions.Scope.
+	Scope ScopeInterface
+}
+
+// Called with the index the trace will have in the capture. The hook may
+// modify the trace, e.g. set its Key after loading a new key into the target.
+type TraceHook func(s *CaptureSession, index int, trace *Trace) error
+
+func (o CaptureOptions) audit(event string, data interface{}) {
+	if err := o.AuditLog.Log(event, data); err != nil {
+		glog.Warningf("Failed writing audit log: %v", err)
+	}
+}
+
+func DefaultCaptureOptions() CaptureOptions {
+	return CaptureOptions{
+		ClockPolicy:        ClockPolicyAbort,
+		ClockCheckInterval: DefaultClockCheckInterval,
 	}
 }
 
 // Captures a set traces.
 // Retries on transient errors.
 func NewCapture(key []byte, ptGen PtGen, numSamples, numTraces, offset int) (Capture, error) {
-	var err error
+	return NewCaptureWithOptions(key, ptGen, numSamples, numTraces, offset, DefaultCaptureOptions())
+}
 
-	var dev UsbDeviceInterface
-	if dev, err = OpenCwLiteUsbDevice(); err != nil {
-		return nil, err
+// Same as NewCapture, with explicit options.
+func NewCaptureWithOptions(key []byte, ptGen PtGen, numSamples, numTraces, offset int,
+	opts CaptureOptions) (Capture, error) {
+	return NewCaptureContext(context.Background(), key, ptGen, numSamples, numTraces, offset, opts)
+}
+
+// Same as NewCaptureWithOptions, stopping when ctx is done, e.g. on Ctrl-C.
+// The ADC is disarmed, and the context error returned.
+func NewCaptureContext(ctx context.Context, key []byte, ptGen PtGen, numSamples, numTraces, offset int,
+	opts CaptureOptions) (Capture, error) {
+	if opts.ClockCheckInterval < 1 {
+		opts.ClockCheckInterval = DefaultClockCheckInterval
 	}
-	defer dev.Close()
 
-	var fpga *Fpga
-	if fpga, err = NewFpga(dev); err != nil {
+	start := time.Now()
+	capture, err := newCapture(ctx, key, ptGen, numSamples, numTraces, offset, opts)
+	end := struct {
+		Traces  int
+		Seconds float64
+		Error   string `json:",omitempty"`
+	}{Traces: len(capture), Seconds: time.Since(start).Seconds()}
+	if err != nil {
+		end.Error = err.Error()
+	}
+	opts.audit("session_end", end)
+	return capture, err
+}
+
+// Time the target firmware takes to boot after power-up.
+const targetBootTime = 100 * time.Millisecond
+
+// Power-cycles the target, and sets the key again once it booted.
+func restartTarget(adc AdcInterface, usart UsartInterface, target Target, key []byte) error {
+	adc.PowerCycle(DefaultPowerOffTime)
+	if err := adc.Error(); err != nil {
+		return err
+	}
+	time.Sleep(targetBootTime)
+	if err := usart.Flush(); err != nil {
+		return fmt.Errorf("Flush failed: %v", err)
+	}
+	if err := target.SetKey(key); err != nil {
+		return fmt.Errorf("Failed setting the key after power-cycling the target: %v", err)
+	}
+	return nil
+}
+
+// ChipWhisperer handles opened by a capture.
+type chipWhisperer struct {
+	dev   *UsbDevice
+	fpga  *Fpga
+	adc   *Adc
+	usart *Usart
+}
+
+// Opens the ChipWhisperer, and sets up the ADC and the target USART with
+// conf.
+func openChipWhisperer(conf *UsartConfig) (*chipWhisperer, error) {
+	dev, err := OpenUsbDevice()
+	if err != nil {
+		return nil, err
+	}
+	if info, err := dev.Info(); err == nil {
+		glog.Infof("Capturing with %v", info)
+	}
+	cw := &chipWhisperer{dev: dev}
+	if cw.fpga, err = NewFpga(dev); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	if cw.adc, err = NewAdc(cw.fpga); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	if cw.usart, err = NewUsart(dev, conf); err != nil {
+		cw.close()
 		return nil, err
 	}
+	return cw, nil
+}
+
+func (cw *chipWhisperer) close() {
+	cw.adc.Close()
+	cw.dev.Close()
+}
 
-	var adc *Adc
-	if adc, err = NewAdc(fpga); err != nil {
+func newCapture(ctx context.Context, key []byte, ptGen PtGen, numSamples, numTraces, offset int,
+	opts CaptureOptions) (Capture, error) {
+	var err error
+	scope := opts.Scope
+	if scope != nil {
+		defer scope.Close()
+	}
+	if err = opts.checkScope(); err != nil {
 		return nil, err
 	}
-	defer adc.Close()
 
-	adc.SetTotalSamples(uint32(numSamples))
-	adc.SetTriggerOffset(uint32(offset))
+	session := &CaptureSession{Scope: scope}
+	// Nil with CaptureOptions.Device.
+	var cw *chipWhisperer
+	if opts.Device != nil {
+		if opts.Reconnect != nil {
+			return nil, fmt.Errorf("Reconnect needs the ChipWhisperer, not CaptureOptions.Device")
+		}
+		session.Dev, session.Adc, session.Usart = opts.Device.Dev, opts.Device.Adc, opts.Device.Usart
+	} else {
+		if cw, err = openChipWhisperer(opts.Usart); err != nil {
+			return nil, err
+		}
+		defer cw.close()
+		session.Dev, session.Fpga, session.Adc, session.Usart = cw.dev, cw.fpga, cw.adc, cw.usart
+		// Device setup is not recorded.
+		cw.fpga.Mem.SetLatencyStats(opts.LatencyStats)
+		cw.usart.SetLatencyStats(opts.LatencyStats)
+	}
+	adc := session.Adc
+	// Cancelled captures may stop anywhere between arming and reading.
+	defer func() {
+		if ctx.Err() != nil {
+			adc.Disarm()
+		}
+	}()
 
-	var usart *Usart
-	if usart, err = NewUsart(dev, nil); err != nil {
+	if scope != nil {
+		if err = scope.Configure(numSamples, offset); err != nil {
+			return nil, err
+		}
+	} else {
+		adc.SetTotalSamples(uint32(numSamples))
+		adc.SetTriggerOffset(uint32(offset))
+	}
+	if opts.LogicChannels != 0 {
+		adc.SetLogicCapture(opts.LogicChannels)
+	}
+
+	var target Target
+	if target, err = OpenTarget(opts.TargetProtocol, session.Usart); err != nil {
 		return nil, err
 	}
+	// Targets with their own device, e.g. the CW305, close it.
+	if closer, ok := target.(io.Closer); ok {
+		defer closer.Close()
+	}
 
-	var ser *SimpleSerial
-	if ser, err = NewSimpleSerial(usart); err != nil {
+	if err = target.SetKey(key); err != nil {
 		return nil, err
 	}
+	session.Target = target
 
-	if err = ser.WriteKey(key); err != nil {
+	// The pilot plaintext is reused by the first trace, so seeded campaigns
+	// don't depend on the pilot.
+	var pilotPt []byte
+	var activeCycles uint32
+	if opts.AdaptiveDecimation {
+		if pilotPt, err = ptGen(); err != nil {
+			return nil, err
+		}
+		if activeCycles, err = fitPilotTrace(ctx, adc, target, pilotPt); err != nil {
+			return nil, fmt.Errorf("Failed measuring the target operation: %v", err)
+		}
+		numSamples = int(adc.TotalSamples())
+		glog.Infof("Target operation lasts %d cycles. Capturing %d samples downsampled by %d",
+			activeCycles, numSamples, adc.DownsampleFactor())
+	}
+
+	// Reference for detecting ADC frequency drift.
+	refClock := adc.ClockStatus()
+	if err = adc.Error(); err != nil {
+		return nil, err
+	}
+	if err = refClock.Check(0); err != nil {
 		return nil, err
 	}
+	glog.V(1).Infof("Clock status at start: %+v", refClock)
+	opts.audit("session_start", struct {
+		Scope          ScopeConfig
+		Clock          ClockStatus
+		NumTraces      int
+		NumSamples     int
+		TargetProtocol string
+		RandSource     string `json:",omitempty"`
+		ExternalScope  bool   `json:",omitempty"`
+	}{scopeConfigOf(adc), refClock, numTraces, numSamples, opts.TargetProtocol, opts.RandSource, scope != nil})
+	if opts.Provenance != nil {
+		opts.audit("provenance", opts.Provenance)
+	}
+	if opts.AdaptiveDecimation {
+		opts.audit("adaptive_decimation", struct {
+			ActiveCycles uint32
+			Samples      int
+			Factor       uint16
+		}{activeCycles, numSamples, adc.DownsampleFactor()})
+	}
+
+	type retry struct {
+		Trace  int
+		Reason string
+	}
+
+	batchSize := 1
+	var batcher BatchTarget
+	if opts.BatchSize > 1 {
+		var ok bool
+		if batcher, ok = target.(BatchTarget); !ok {
+			return nil, fmt.Errorf("Target protocol %q does not support batching", opts.TargetProtocol)
+		}
+		if err := adc.Capabilities().Require(FeatureSegmentedCapture); err != nil {
+			return nil, fmt.Errorf("Batching needs segmented capture: %w", err)
+		}
+		batchSize = opts.BatchSize
+	}
 
 	var capture Capture
+	var baselines []baselineAt
+	recordBaseline := func() {
+		samples := adc.CaptureOnce(0)
+		if len(samples) == 0 {
+			glog.Warningf("No measurements for baseline before trace %d. Skipping", len(capture))
+			return
+		}
+		baselines = append(baselines, baselineAt{len(capture),
+			Trace{PowerMeasurements: samples, Baseline: true}})
+	}
+	// Plaintexts of the traces being captured. Retries reuse them, so the
+	// plaintext of each trace doesn't depend on the number of retries, and
+	// seeded campaigns can be regenerated.
+	var pending [][]byte
+	if pilotPt != nil {
+		pending = [][]byte{pilotPt}
+	}
+	// Consecutive trigger timeouts, see PowerCycleAfterTimeouts.
+	timeouts := 0
+	// Consecutive retryable target errors, see maxTargetErrorRetries.
+	targetErrors := 0
+	// Consecutive discarded traces, see MaxValidationDiscards.
+	discards := 0
+	// Start of the traces not yet covered by a clock check.
+	unchecked := 0
+	checkStart := time.Now()
+	// ADC settings restored after reconnecting.
+	restoreCfg := scopeConfigOf(adc)
+	// Reconnects after the device dropped off the bus, see
+	// CaptureOptions.Reconnect. Returns err if the device is still connected
+	// or reconnecting failed, and nil to retry the trace.
+	resume := func(err error) error {
+		if opts.Reconnect == nil || ctx.Err() != nil || cw.dev.Connected() {
+			return err
+		}
+		glog.Warningf("Device disconnected (%v). Reconnecting", err)
+		event := struct {
+			Trace int
+			Error string
+		}{len(capture), err.Error()}
+		if rerr := cw.reconnect(target, restoreCfg, key, *opts.Reconnect); rerr != nil {
+			event.Error = rerr.Error()
+			opts.audit("reconnect_failed", event)
+			return fmt.Errorf("%v. Reconnecting failed: %v", err, rerr)
+		}
+		opts.audit("reconnect", event)
+		opts.audit("retry", retry{len(capture), "reconnected"})
+		return nil
+	}
 	for len(capture) < numTraces {
-		if err = adc.Error(); err != nil {
+		if err = ctx.Err(); err != nil {
 			return nil, err
 		}
+		if err = adc.Error(); err != nil {
+			if err = resume(err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// Traces captured with this arm.
+		n := batchSize
+		if remaining := numTraces - len(capture); remaining < n {
+			n = remaining
+		}
+		if opts.BaselineInterval > 0 {
+			if len(baselines) == 0 || len(capture)-baselines[len(baselines)-1].pos >= opts.BaselineInterval {
+				recordBaseline()
+			}
+		}
+		if batcher != nil {
+			adc.SetSegments(n)
+		}
 
 		glog.Infof("Starting trace [%d/%d]\n", len(capture)+1, numTraces)
-		trace := Trace{}
-		trace.Key = key
+		traces := make([]Trace, n)
+		for i := range traces {
+			traces[i].Key = key
 
-		// Generate plaintext for this trace.
-		if trace.Pt, err = ptGen(); err != nil {
-			return nil, err
+			// Generate plaintext for this trace.
+			if i == len(pending) {
+				var pt []byte
+				if pt, err = ptGen(); err != nil {
+					return nil, err
+				}
+				pending = append(pending, pt)
+			}
+			// Copied, as BeforeTrace may modify it.
+			traces[i].Pt = append([]byte(nil), pending[i]...)
+
+			if opts.BeforeTrace != nil {
+				if err = opts.BeforeTrace(session, len(capture)+i, &traces[i]); err != nil {
+					return nil, fmt.Errorf("BeforeTrace hook failed on trace %d: %v", len(capture)+i, err)
+				}
+			}
 		}
 
-		adc.SetArmOn()
+		if scope != nil {
+			if err = scope.Arm(); err != nil {
+				return nil, err
+			}
+		} else {
+			adc.SetArmOn()
+		}
 
-		if err = ser.WritePlaintext(trace.Pt); err != nil {
-			return nil, err
+		if n == 1 {
+			err = target.Send(traces[0].Pt)
+		} else {
+			inputs := make([][]byte, n)
+			for i := range traces {
+				inputs[i] = traces[i].Pt
+			}
+			err = batcher.SendBatch(inputs)
+		}
+		if err != nil {
+			if err = resume(err); err != nil {
+				return nil, err
+			}
+			continue
 		}
 
-		timedOut := adc.WaitForTigger()
+		var timedOut bool
+		if scope != nil {
+			if timedOut, err = scope.WaitForTrigger(); err != nil {
+				return nil, err
+			}
+		} else {
+			timedOut = adc.WaitForTriggerContext(ctx)
+			if err = ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
 		if timedOut {
 			glog.Warning("Timed out during capture. Re-trying")
+			opts.audit("retry", retry{len(capture), "trigger timeout"})
+			timeouts++
+			if opts.PowerCycleAfterTimeouts > 0 && timeouts >= opts.PowerCycleAfterTimeouts {
+				glog.Warningf("%d consecutive trigger timeouts. Power-cycling the target", timeouts)
+				opts.audit("power_cycle", struct{ Trace int }{len(capture)})
+				if err = restartTarget(adc, session.Usart, target, key); err != nil {
+					return nil, err
+				}
+				timeouts = 0
+			}
 			continue
 		}
+		timeouts = 0
 
-		if trace.Ct, err = ser.Response(); err != nil {
-			return nil, err
+		if n == 1 {
+			traces[0].Ct, err = target.Response()
+		} else {
+			var outputs [][]byte
+			outputs, err = batcher.ResponseBatch(n)
+			for i := range outputs {
+				traces[i].Ct = outputs[i]
+			}
 		}
+		if IsRetryableTargetError(err) {
+			targetErrors++
+			if targetErrors > maxTargetErrorRetries {
+				return nil, fmt.Errorf("%d consecutive target errors: %w", targetErrors, err)
+			}
+			glog.Warningf("Target error: %v. Re-trying", err)
+			opts.audit("retry", retry{len(capture), "target error"})
+			// Drops what is left of the failed exchange, e.g. the responses
+			// to the rest of a batch, before sending the plaintexts again.
+			if err = session.Usart.Flush(); err != nil {
+				return nil, fmt.Errorf("Flush failed: %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			if err = resume(err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		targetErrors = 0
 
-		trace.PowerMeasurements = adc.TraceData()
-		if len(trace.PowerMeasurements) == 0 {
+		var segments [][]Sample
+		if scope != nil {
+			var samples []Sample
+			if samples, err = scope.ReadSamples(); err != nil {
+				return nil, err
+			}
+			if len(samples) > 0 {
+				segments = [][]Sample{samples}
+			}
+		} else {
+			segments = adc.SegmentDataContext(ctx)
+			if err = ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		if len(segments) == 0 {
 			glog.Warning("TraceData did not return measurements. Re-trying")
+			opts.audit("retry", retry{len(capture), "no measurements"})
+			continue
+		}
+		// The ADC read checks don't apply to external scopes.
+		var read TraceRead
+		if scope == nil {
+			read = adc.LastTraceRead()
+		}
+		if read.Decoded < read.Samples {
+			glog.Warningf("TraceData decoded %d of %d samples. Re-trying", read.Decoded, read.Samples)
+			opts.audit("retry", retry{len(capture), "short trace data"})
 			continue
 		}
+		if read.Overflow {
+			glog.Warning("ADC FIFO overflowed. Re-trying")
+			opts.audit("retry", retry{len(capture), "fifo overflow"})
+			continue
+		}
+		if read.Clipped > 0 {
+			gain := adc.Gain()
+			if opts.AutoGain && gain > 0 {
+				// Lowered by about 12%, at least one step.
+				lowered := gain - (gain+7)/8
+				glog.Warningf("%d samples clipped. Lowering gain from %d to %d and re-trying",
+					read.Clipped, gain, lowered)
+				adc.SetGain(lowered)
+				opts.audit("gain", struct{ Trace, Clipped, From, To int }{
+					len(capture), read.Clipped, int(gain), int(lowered)})
+				opts.audit("retry", retry{len(capture), "clipped"})
+				continue
+			}
+			opts.audit("clipped", struct{ Trace, Clipped, Gain int }{len(capture), read.Clipped, int(gain)})
+		}
+		logic := adc.LogicData()
+
+		if len(segments) < n {
+			glog.Warningf("TraceData returned %d of %d segments. Re-trying", len(segments), n)
+			opts.audit("retry", retry{len(capture), "missing segments"})
+			continue
+		}
+		gainDb := adc.GainDb()
+		if opts.TargetAmplitude > 0 {
+			var peak float64
+			for _, samples := range segments[:n] {
+				peak = math.Max(peak, PeakAmplitude(samples))
+			}
+			if math.Abs(peak-opts.TargetAmplitude) > autoRangeTolerance*opts.TargetAmplitude {
+				if db := AutoRangeDb(gainDb, peak, opts.TargetAmplitude); math.Abs(db-gainDb) >= gainDbPerStep {
+					glog.V(1).Infof("Peak amplitude %.2f. Changing gain from %.1fdB to %.1fdB", peak, gainDb, db)
+					adc.SetGainDb(db)
+					opts.audit("gain_db", struct {
+						Trace          int
+						Peak, From, To float64
+					}{len(capture), peak, gainDb, adc.GainDb()})
+				}
+			}
+		}
+		// Logic samples are stored back to back too.
+		segment := len(segments[0])
+		for i := range traces {
+			traces[i].PowerMeasurements = segments[i]
+			traces[i].GainDb = gainDb
+			if len(logic) >= (i+1)*segment {
+				traces[i].Logic = logic[i*segment : (i+1)*segment]
+			}
+
+			if opts.AfterTrace != nil {
+				if err = opts.AfterTrace(session, len(capture)+i, &traces[i]); err != nil {
+					return nil, fmt.Errorf("AfterTrace hook failed on trace %d: %v", len(capture)+i, err)
+				}
+			}
+		}
+
+		// Discarded traces are captured again with the same plaintexts.
+		var valid []Trace
+		var invalid [][]byte
+		for i := range traces {
+			if opts.Validator != nil {
+				if verr := opts.Validator(&traces[i]); verr != nil {
+					opts.audit("invalid_output", struct {
+						Trace     int
+						Error     string
+						Discarded bool
+					}{len(capture) + i, verr.Error(), opts.ValidationPolicy == ValidationDiscard})
+					if opts.ValidationPolicy == ValidationDiscard {
+						if discards++; discards >= MaxValidationDiscards {
+							return nil, fmt.Errorf("%d consecutive invalid outputs: %w", discards, verr)
+						}
+						glog.Warningf("Invalid output for trace %d: %v. Re-trying", len(capture)+i, verr)
+						invalid = append(invalid, pending[i])
+						continue
+					}
+					glog.Warningf("Invalid output for trace %d: %v", len(capture)+i, verr)
+					traces[i].InvalidOutput = true
+				}
+			}
+			discards = 0
+			valid = append(valid, traces[i])
+		}
+		capture = append(capture, valid...)
+		pending = invalid
+		if len(capture)-unchecked < opts.ClockCheckInterval && len(capture) < numTraces {
+			continue
+		}
+
+		status := adc.ClockStatus()
+		if err = adc.Error(); err != nil {
+			return nil, err
+		}
+		if opts.Reconnect != nil {
+			restoreCfg = scopeConfigOf(adc)
+		}
+		checkEvent := struct {
+			First, Last int
+			Seconds     float64
+			Clock       ClockStatus
+			ClockError  string `json:",omitempty"`
+		}{First: unchecked, Last: len(capture) - 1, Seconds: time.Since(checkStart).Seconds(), Clock: status}
+		checkStart = time.Now()
+		if err = status.Check(refClock.AdcFreq); err != nil {
+			checkEvent.ClockError = err.Error()
+		}
+		opts.audit("batch", checkEvent)
+		if err != nil {
+			if cw != nil {
+				cw.adc.diag.ClockUnlocks++
+			}
+			if opts.ClockPolicy == ClockPolicyAbort {
+				return nil, fmt.Errorf("Clock check failed after trace %d: %v", len(capture), err)
+			}
+			glog.Warningf("Clock check failed: %v. Tagging traces [%d, %d]",
+				err, unchecked+1, len(capture))
+			for i := unchecked; i < len(capture); i++ {
+				capture[i].ClockUnlocked = true
+			}
+			if cw != nil {
+				cw.adc.recover()
+			}
+		}
+		if opts.Stream != nil {
+			for i := unchecked; i < len(capture); i++ {
+				if err = opts.Stream.Encode(&capture[i]); err != nil {
+					return nil, fmt.Errorf("Failed streaming trace %d: %v", i, err)
+				}
+			}
+		}
+		unchecked = len(capture)
+	}
 
-		capture = append(capture, trace)
+	if opts.BaselineInterval > 0 {
+		recordBaseline()
+		if err = adc.Error(); err != nil {
+			return nil, err
+		}
+		capture = interleaveBaselines(capture, baselines)
 	}
 
+	if diag := adc.Diagnostics(); diag != (AdcDiagnostics{}) {
+		glog.Infof("ADC diagnostics: %+v", diag)
+		opts.audit("diagnostics", diag)
+	}
+	// Settings produced valid traces, so reuse them on the next run.
+	if cw != nil {
+		if err = cw.adc.SaveProfile(); err != nil {
+			glog.V(1).Infof("Not saving device profile: %v", err)
+		}
+	}
 	return capture, nil
 }
 
@@ -187,12 +825,31 @@ func (c Capture) Save(filename string) error {
 // |_         _|
 //
 func (c Capture) SamplesMatrix() mat.Matrix {
+	return c.samplesMatrix(new(SampleMask).Indices(len(c[0].PowerMeasurements)))
+}
+
+// Same as SamplesMatrix, but only includes the samples selected by mask.
+// Column j of the result holds sample mask.Indices(n)[j] of each trace.
+// Fails if the capture or the selection is empty.
+func (c Capture) MaskedSamplesMatrix(mask *SampleMask) (mat.Matrix, error) {
+	if len(c) == 0 {
+		return nil, fmt.Errorf("Empty capture")
+	}
+	numSamples := len(c[0].PowerMeasurements)
+	idx := mask.Indices(numSamples)
+	if len(idx) == 0 {
+		return nil, fmt.Errorf("Mask selects none of the %d samples", numSamples)
+	}
+	return c.samplesMatrix(idx), nil
+}
+
+func (c Capture) samplesMatrix(idx []int) mat.Matrix {
 	rows := len(c)
-	cols := len(c[0].PowerMeasurements)
+	cols := len(idx)
 	data := make([]float64, rows*cols)
 	for i := 0; i < rows; i++ {
-		for j := 0; j < cols; j++ {
-			data[i*cols+j] = c[i].PowerMeasurements[j]
+		for j, k := range idx {
+			data[i*cols+j] = float64(c[i].PowerMeasurements[k])
 		}
 	}
 	return mat.NewDense(rows, cols, data)
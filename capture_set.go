@@ -0,0 +1,229 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Multiple capture files read as a single capture.
+// Campaigns span many files (one per run, or per batch), so a set is opened
+// from a glob and indexed globally, in file name order. Files are only loaded
+// when needed, and all traces must have the same key, plaintext, ciphertext
+// and sample lengths.
+package gocw
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+)
+
+type CaptureSet struct {
+	files []string
+
+	mu sync.Mutex
+	// Traces per file. -1 until the file is loaded.
+	counts []int
+	// Shape of the first trace, all others must match.
+	shape *traceShape
+	// Last loaded file, for Trace.
+	cachedFile int
+	cached     Capture
+}
+
+type traceShape struct {
+	Key, Pt, Ct, Samples int
+}
+
+func shapeOf(t *Trace) traceShape {
+	return traceShape{len(t.Key), len(t.Pt), len(t.Ct), len(t.PowerMeasurements)}
+}
+
+// Opens the capture files matching a glob pattern, e.g. captures/run_*.json.gz.
+// A plain file name opens a single file set.
+func OpenCaptureSet(pattern string) (*CaptureSet, error) {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid capture pattern %s: %v", pattern, err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("No capture files match %s", pattern)
+	}
+	s := &CaptureSet{files: files, counts: make([]int, len(files)), cachedFile: -1}
+	for i := range s.counts {
+		s.counts[i] = -1
+	}
+	return s, nil
+}
+
+// Loads all the traces matching a glob pattern as a single capture.
+func LoadCaptureSet(pattern string) (Capture, error) {
+	s, err := OpenCaptureSet(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return s.Load()
+}
+
+// Same as LoadCaptureSet, without the baseline traces, which have no inputs
+// to attack.
+func LoadAttackCapture(pattern string) (Capture, error) {
+	c, err := LoadCaptureSet(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return c.WithoutBaselines(), nil
+}
+
+func (s *CaptureSet) Files() []string {
+	return s.files
+}
+
+// Loads and validates file i. Must be called with s.mu held.
+func (s *CaptureSet) load(i int) (Capture, error) {
+	if i == s.cachedFile {
+		return s.cached, nil
+	}
+	c, err := LoadCapture(s.files[i])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", s.files[i], err)
+	}
+	for j := range c {
+		shape := shapeOf(&c[j])
+		if c[j].Baseline {
+			// Baselines have no inputs, only their samples must match.
+			if s.shape != nil && shape.Samples != s.shape.Samples {
+				return nil, fmt.Errorf("%s: baseline trace %d has %d samples, expected %d",
+					s.files[i], j, shape.Samples, s.shape.Samples)
+			}
+			continue
+		}
+		if s.shape == nil {
+			s.shape = &shape
+		}
+		if shape != *s.shape {
+			return nil, fmt.Errorf("%s: trace %d shape %+v doesn't match the set shape %+v",
+				s.files[i], j, shape, *s.shape)
+		}
+	}
+	s.counts[i] = len(c)
+	s.cachedFile, s.cached = i, c
+	return c, nil
+}
+
+// Calls fn with the traces of each file, in order. offset is the global index
+// of the first trace of c. Only one file is held in memory at a time.
+func (s *CaptureSet) Each(fn func(offset int, c Capture) error) error {
+	offset := 0
+	for i := range s.files {
+		s.mu.Lock()
+		c, err := s.load(i)
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if err = fn(offset, c); err != nil {
+			return err
+		}
+		offset += len(c)
+	}
+	return nil
+}
+
+// Loads all the traces as a single capture.
+func (s *CaptureSet) Load() (Capture, error) {
+	var all Capture
+	err := s.Each(func(_ int, c Capture) error {
+		all = append(all, c...)
+		return nil
+	})
+	return all, err
+}
+
+// Loads every file not loaded yet, to count its traces.
+func (s *CaptureSet) scan() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, n := range s.counts {
+		if n < 0 {
+			if _, err := s.load(i); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the total number of traces.
+func (s *CaptureSet) Len() (int, error) {
+	if err := s.scan(); err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, n := range s.counts {
+		total += n
+	}
+	return total, nil
+}
+
+// Returns the number of samples per trace, zero if the set is empty. Only
+// loads files up to the first non-empty one.
+func (s *CaptureSet) NumSamples() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; s.shape == nil && i < len(s.files); i++ {
+		if _, err := s.load(i); err != nil {
+			return 0, err
+		}
+	}
+	if s.shape == nil {
+		return 0, nil
+	}
+	return s.shape.Samples, nil
+}
+
+// Maps a global trace index to its file and index within the file. Only loads
+// files up to the one holding the trace.
+func (s *CaptureSet) Locate(i int) (TraceRef, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for f := range s.files {
+		if s.counts[f] < 0 {
+			if _, err := s.load(f); err != nil {
+				return TraceRef{}, err
+			}
+		}
+		if i >= 0 && i < s.counts[f] {
+			return TraceRef{Capture: f, Index: i}, nil
+		}
+		i -= s.counts[f]
+	}
+	return TraceRef{}, fmt.Errorf("Trace index out of range")
+}
+
+// Returns the trace at global index i. Traces of the same file are served
+// from a cache, so sequential access loads each file once.
+func (s *CaptureSet) Trace(i int) (*Trace, error) {
+	ref, err := s.Locate(i)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, err := s.load(ref.Capture)
+	if err != nil {
+		return nil, err
+	}
+	// The file may have been rewritten since it was counted.
+	if ref.Index >= len(c) {
+		return nil, fmt.Errorf("%s: trace %d out of range", s.files[ref.Capture], ref.Index)
+	}
+	return &c[ref.Index], nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/google/gocw"
+)
+
+func setTrace(pt byte, numSamples int) gocw.Trace {
+	return gocw.Trace{Key: []byte{1}, Pt: []byte{pt}, Ct: []byte{3},
+		PowerMeasurements: make([]gocw.Sample, numSamples)}
+}
+
+func saveCaptures(t *testing.T, dir string, captures map[string]gocw.Capture) {
+	for name, c := range captures {
+		if err := c.Save(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCaptureSet(t *testing.T) {
+	dir := t.TempDir()
+	saveCaptures(t, dir, map[string]gocw.Capture{
+		"run_1.json.gz": {setTrace(0, 2), setTrace(1, 2)},
+		"run_2.json.gz": {setTrace(2, 2), setTrace(3, 2), setTrace(4, 2)},
+		"other.json.gz": {setTrace(9, 2)},
+	})
+	s, err := gocw.OpenCaptureSet(filepath.Join(dir, "run_*.json.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.Len(); err != nil || n != 5 {
+		t.Errorf("Len() = %d, %v, expected 5", n, err)
+	}
+	if n, err := s.NumSamples(); err != nil || n != 2 {
+		t.Errorf("NumSamples() = %d, %v, expected 2", n, err)
+	}
+	for i := 0; i < 5; i++ {
+		tr, err := s.Trace(i)
+		if err != nil {
+			t.Fatalf("Trace(%d) failed: %v", i, err)
+		}
+		if tr.Pt[0] != byte(i) {
+			t.Errorf("Trace(%d) has plaintext %v", i, tr.Pt)
+		}
+	}
+	if ref, err := s.Locate(3); err != nil || ref != (gocw.TraceRef{Capture: 1, Index: 1}) {
+		t.Errorf("Locate(3) = %+v, %v, expected {1 1}", ref, err)
+	}
+	if _, err := s.Trace(5); err == nil {
+		t.Errorf("Trace(5) succeeded, expected out of range")
+	}
+
+	var offsets []int
+	s.Each(func(offset int, c gocw.Capture) error {
+		offsets = append(offsets, offset)
+		return nil
+	})
+	if len(offsets) != 2 || offsets[0] != 0 || offsets[1] != 2 {
+		t.Errorf("Each() offsets = %v, expected [0 2]", offsets)
+	}
+
+	all, err := gocw.LoadCaptureSet(filepath.Join(dir, "run_*.json.gz"))
+	if err != nil || len(all) != 5 || all[4].Pt[0] != 4 {
+		t.Errorf("LoadCaptureSet() = %d traces, %v, expected 5", len(all), err)
+	}
+}
+
+func TestCaptureSetShapeMismatch(t *testing.T) {
+	dir := t.TempDir()
+	saveCaptures(t, dir, map[string]gocw.Capture{
+		"a.json.gz": {setTrace(0, 2)},
+		"b.json.gz": {setTrace(1, 3)},
+	})
+	if _, err := gocw.LoadCaptureSet(filepath.Join(dir, "*.json.gz")); err == nil {
+		t.Errorf("LoadCaptureSet() of mismatched sample lengths succeeded")
+	}
+}
+
+func TestCaptureSetNoMatch(t *testing.T) {
+	if _, err := gocw.OpenCaptureSet(filepath.Join(t.TempDir(), "*.json.gz")); err == nil {
+		t.Errorf("OpenCaptureSet() with no matching files succeeded")
+	}
+}
@@ -16,12 +16,16 @@ package gocw_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/google/gocw"
+	"github.com/google/gocw/sim"
 )
 
 func TestSaveLoad(t *testing.T) {
@@ -30,7 +34,7 @@ func TestSaveLoad(t *testing.T) {
 	c1 = gocw.Capture{gocw.Trace{Key: []byte{1},
 		Pt:                []byte{2},
 		Ct:                []byte{3},
-		PowerMeasurements: []float64{4.5, 6.7}}}
+		PowerMeasurements: []gocw.Sample{4.5, 6.7}}}
 
 	buf := bytes.Buffer{}
 	if err := c1.SaveIo(&buf); err != nil {
@@ -45,3 +49,102 @@ func TestSaveLoad(t *testing.T) {
 		t.Errorf("Loaded capture (%v) did not match original (%v)", c2, c1)
 	}
 }
+
+// Answers the first plaintexts with a bad CRC ack before the target output,
+// which stays unread.
+type flakyUsart struct {
+	gocw.UsartInterface
+	failures int
+	pending  []byte
+}
+
+func (u *flakyUsart) Write(p []byte) (int, error) {
+	if len(p) > 0 && p[0] == 'p' && u.failures > 0 {
+		u.failures--
+		u.pending = append(u.pending, "z02\n"...)
+	}
+	return u.UsartInterface.Write(p)
+}
+
+func (u *flakyUsart) Read(p []byte) (int, error) {
+	if len(u.pending) > 0 {
+		n := copy(p, u.pending)
+		u.pending = u.pending[n:]
+		return n, nil
+	}
+	return u.UsartInterface.Read(p)
+}
+
+func (u *flakyUsart) Flush() error {
+	u.pending = nil
+	return u.UsartInterface.Flush()
+}
+
+func TestCaptureRetriesTargetErrors(t *testing.T) {
+	key := make([]byte, 16)
+	capture := func(failures int) (gocw.Capture, error) {
+		s := sim.New(sim.DefaultLeakModel())
+		opts := gocw.DefaultCaptureOptions()
+		opts.Device = s.CaptureDevice()
+		opts.Device.Usart = &flakyUsart{UsartInterface: s.Usart, failures: failures}
+		opts.Validator = gocw.AesValidator
+		opts.ValidationPolicy = gocw.ValidationTag
+		return gocw.NewCaptureContext(context.Background(), key, gocw.SeededRandGen(1, len(key)), 100, 5, 0, opts)
+	}
+
+	// The unread outputs are flushed, so retried traces get their own.
+	c, err := capture(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range c {
+		if c[i].InvalidOutput {
+			t.Errorf("Trace %d has the output of another plaintext", i)
+		}
+	}
+
+	if _, err = capture(100); !errors.Is(err, gocw.Ss2BadCrc) || !strings.Contains(err.Error(), "consecutive") {
+		t.Errorf("Capture with a failing target returned %v", err)
+	}
+}
+
+func TestCaptureStopsDiscarding(t *testing.T) {
+	opts := gocw.DefaultCaptureOptions()
+	opts.Device = sim.New(sim.DefaultLeakModel()).CaptureDevice()
+	wrongKey := errors.New("wrong key")
+	validated := 0
+	opts.Validator = func(*gocw.Trace) error {
+		validated++
+		return wrongKey
+	}
+	opts.ValidationPolicy = gocw.ValidationDiscard
+	key := make([]byte, 16)
+	_, err := gocw.NewCaptureContext(context.Background(), key, gocw.SeededRandGen(1, len(key)), 100, 5, 0, opts)
+	if !errors.Is(err, wrongKey) {
+		t.Errorf("Capture with invalid outputs returned %v, want %v", err, wrongKey)
+	}
+	if validated != gocw.MaxValidationDiscards {
+		t.Errorf("Validated %d traces, want %d", validated, gocw.MaxValidationDiscards)
+	}
+}
+
+func TestCaptureStreamsTraces(t *testing.T) {
+	opts := gocw.DefaultCaptureOptions()
+	opts.Device = sim.New(sim.DefaultLeakModel()).CaptureDevice()
+	opts.ClockCheckInterval = 2
+	opts.BaselineInterval = 2
+	var buf bytes.Buffer
+	opts.Stream = gocw.NewTraceEncoder(&buf)
+	key := make([]byte, 16)
+	c, err := gocw.NewCaptureContext(context.Background(), key, gocw.SeededRandGen(1, len(key)), 100, 5, 0, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamed, _, err := gocw.LoadCaptureProtoIo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := c.WithoutBaselines(); !reflect.DeepEqual(streamed, want) {
+		t.Errorf("Streamed %d traces, want the %d captured ones without baselines", len(streamed), len(want))
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/google/gocw"
+)
+
+func TestCalcClkGenMulDiv(t *testing.T) {
+	limits := gocw.ClkGenLimitsFor(gocw.HwChipWhispererLite)
+
+	s, err := gocw.CalcClkGenMulDiv(7370000, 96000000, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Div > limits.MaxDiv || s.Mul < limits.MinMul {
+		t.Errorf("Setting %+v violates limits %+v", s, limits)
+	}
+	if expected := 96e6*float64(s.Mul)/float64(s.Div) - 7370000; math.Abs(s.ErrorHz-expected) > 1e-6 {
+		t.Errorf("ErrorHz is %v, expected %v", s.ErrorHz, expected)
+	}
+	if math.Abs(s.ErrorHz) > 0.005*7370000 {
+		t.Errorf("Setting %+v is too far from requested frequency", s)
+	}
+
+	// 48MHz from 96MHz is exact with 2/4, 3/6, ...; the lowest setting wins.
+	if s, _ = gocw.CalcClkGenMulDiv(48000000, 96000000, limits); s.Mul != 2 || s.Div != 4 || s.ErrorHz != 0 {
+		t.Errorf("Expected 2/4 for 48MHz, got %+v", s)
+	}
+
+	if _, err = gocw.CalcClkGenMulDiv(1000000, 96000000, limits); err == nil {
+		t.Errorf("Expected error for output below the CLKFX range")
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Checks the ADC clock while capturing.
+// A DCM can lose lock without any error being reported, after which traces
+// are sampled at the wrong rate. The clocks are checked after every batch of
+// traces, and the batch is either rejected or tagged.
+package gocw
+
+import (
+	"fmt"
+	"math"
+)
+
+// Relative ADC frequency drift tolerated before the clock is considered bad.
+const clockFreqTolerance = 0.01
+
+//go:generate stringer -type ClockPolicy
+type ClockPolicy int
+
+const (
+	// Fails the capture on the first bad clock check.
+	ClockPolicyAbort ClockPolicy = iota
+	// Tags the batch with Trace.ClockUnlocked, re-locks the clocks and
+	// continues.
+	ClockPolicyTag ClockPolicy = iota
+)
+
+// Snapshot of the ADC clock state.
+type ClockStatus struct {
+	DcmLocked       bool
+	ClkGenDcmLocked bool
+	// Measured ADC clock frequency.
+	AdcFreq uint32
+	// Frequency counter reading, on the configured FreqCounterSource.
+	FreqCounter uint32
+}
+
+func (c *Adc) ClockStatus() ClockStatus {
+	return ClockStatus{
+		DcmLocked:       c.DcmLocked(),
+		ClkGenDcmLocked: c.ClkGenDcmLocked(),
+		AdcFreq:         c.AdcFreq(),
+		FreqCounter:     c.FreqCounter(),
+	}
+}
+
+// Returns nil if both DCMs are locked, and the ADC frequency is within
+// tolerance of ref (the frequency at the start of the capture).
+func (s ClockStatus) Check(ref uint32) error {
+	if !s.DcmLocked {
+		return fmt.Errorf("ADC DCM unlocked")
+	}
+	if !s.ClkGenDcmLocked {
+		return fmt.Errorf("CLKGEN DCM unlocked")
+	}
+	if ref > 0 && math.Abs(float64(s.AdcFreq)-float64(ref)) > clockFreqTolerance*float64(ref) {
+		return fmt.Errorf("ADC frequency drifted from %dHz to %dHz", ref, s.AdcFreq)
+	}
+	return nil
+}
+
+// Returns the traces captured with locked clocks.
+func (c Capture) ClockLocked() Capture {
+	var locked Capture
+	for _, t := range c {
+		if !t.ClockUnlocked {
+			locked = append(locked, t)
+		}
+	}
+	return locked
+}
@@ -0,0 +1,53 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"testing"
+
+	"github.com/google/gocw"
+)
+
+func TestClockStatusCheck(t *testing.T) {
+	locked := gocw.ClockStatus{DcmLocked: true, ClkGenDcmLocked: true, AdcFreq: 29480000}
+	for _, tc := range []struct {
+		name   string
+		status gocw.ClockStatus
+		ref    uint32
+		ok     bool
+	}{
+		{"locked", locked, 29500000, true},
+		{"no reference", locked, 0, true},
+		{"adc unlocked", gocw.ClockStatus{ClkGenDcmLocked: true, AdcFreq: 29480000}, 29500000, false},
+		{"clkgen unlocked", gocw.ClockStatus{DcmLocked: true, AdcFreq: 29480000}, 29500000, false},
+		{"drifted", locked, 7370000, false},
+	} {
+		if err := tc.status.Check(tc.ref); (err == nil) != tc.ok {
+			t.Errorf("%s: Check(%d) = %v", tc.name, tc.ref, err)
+		}
+	}
+}
+
+func TestCaptureClockLocked(t *testing.T) {
+	c := gocw.Capture{
+		{Pt: []byte{1}},
+		{Pt: []byte{2}, ClockUnlocked: true},
+		{Pt: []byte{3}},
+	}
+	locked := c.ClockLocked()
+	if len(locked) != 2 || locked[0].Pt[0] != 1 || locked[1].Pt[0] != 3 {
+		t.Errorf("ClockLocked() = %v", locked)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Recovers an AES-128 key from a hardware AES core (e.g. the CW305 FPGA target).
+// Unlike software AES, a hardware core updates the whole state register each
+// round, so power follows the hamming distance between consecutive states
+// rather than the hamming weight of a single intermediate value. The attack
+// correlates with the last round update, recovers the last round key, and
+// runs the key schedule backwards to get the AES key.
+// Only the ciphertexts are used.
+
+// $ go run cmd/attack_aes_last_round_cpa.go -logtostderr -input captures/cw305_aes.json.gz
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+
+	"github.com/google/gocw"
+	"github.com/google/gocw/analysis"
+
+	"github.com/golang/glog"
+)
+
+var (
+	inputFlag = flag.String("input", "", "Capture .json.gz input file, or glob of files read as one capture")
+	maskFlag  = flag.String("mask", "", "Optional sample mask JSON file (see gocw.SampleMask)")
+)
+
+func init() {
+	flag.Parse()
+}
+
+func main() {
+	defer glog.Flush()
+
+	set, err := gocw.OpenCaptureSet(*inputFlag)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	numSamples, err := set.NumSamples()
+	if err != nil {
+		glog.Fatal(err)
+	}
+	var mask *gocw.SampleMask
+	if len(*maskFlag) > 0 {
+		if mask, err = gocw.LoadSampleMask(*maskFlag); err != nil {
+			glog.Fatal(err)
+		}
+	}
+	if len(mask.Indices(numSamples)) == 0 {
+		glog.Fatalf("Mask selects none of the %d samples", numSamples)
+	}
+
+	// Files are added one at a time, so campaigns larger than memory can be
+	// attacked.
+	cpa := analysis.NewMaskedCPA(analysis.LastRoundHammingDistance, analysis.CiphertextInput, 16, numSamples, mask)
+	var captureKey []byte
+	err = set.Each(func(_ int, capture gocw.Capture) error {
+		capture = capture.WithoutBaselines()
+		for i := range capture {
+			if len(capture[i].Ct) != 16 {
+				return fmt.Errorf("Capture must hold traces with 16 byte ciphertexts")
+			}
+		}
+		if captureKey == nil && len(capture) > 0 {
+			captureKey = capture[0].Key
+		}
+		return cpa.Add(capture...)
+	})
+	if err != nil {
+		glog.Fatal(err)
+	}
+	glog.Infof("Loaded %d files with %d traces / %d samples per trace",
+		len(set.Files()), cpa.NumTraces(), numSamples)
+
+	timeBase := gocw.LoadTimeBase(*inputFlag)
+	var roundKey [16]byte
+	for i, g := range cpa.BestGuesses() {
+		glog.V(1).Infof("Best guess for last round key index %d: %v at %s",
+			i, g, timeBase.Format(g.Location))
+		roundKey[i] = g.Key
+	}
+	key := analysis.InvertKeySchedule(roundKey, 10)
+	glog.Infof("Last round key: %v", hex.EncodeToString(roundKey[:]))
+	glog.Infof("Fully recovered key: %v", hex.EncodeToString(key[:]))
+	if len(captureKey) == 16 {
+		if hex.EncodeToString(captureKey) == hex.EncodeToString(key[:]) {
+			glog.Info("Recovered key matches the capture key")
+		} else {
+			glog.Warningf("Recovered key does not match the capture key %v",
+				hex.EncodeToString(captureKey))
+		}
+	}
+}
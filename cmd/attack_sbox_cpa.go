@@ -40,12 +40,12 @@ package main
 import (
 	"encoding/hex"
 	"flag"
-	"fmt"
 	"math"
 	"math/bits"
 	"sync"
 
 	"github.com/google/gocw"
+	"github.com/google/gocw/attack"
 
 	"github.com/golang/glog"
 	"gonum.org/v1/gonum/mat"
@@ -53,7 +53,10 @@ import (
 )
 
 var (
-	inputFlag = flag.String("input", "captures/stm_aes_t50_s5000.json.gz", "Capture input file")
+	inputFlag  = flag.String("input", "captures/stm_aes_t50_s5000.json.gz", "Capture input file, or glob of files read as one capture")
+	maskFlag   = flag.String("mask", "", "Optional JSON sample mask file. Masked out samples are ignored")
+	topKFlag   = flag.Int("top_k", 5, "Number of guesses per key byte reported and saved")
+	outputFlag = flag.String("output", "", "Optional JSON attack result output file, see attack.AttackResult")
 
 	// Copied from third_party/tiny-AES-c/aes.c
 	sbox = [256]byte{
@@ -103,16 +106,6 @@ func leakModel(key byte, keyIdx int, capture gocw.Capture) []float64 {
 	return hw
 }
 
-type keyGuess struct {
-	key         byte
-	maxCorr     float64
-	maxLocation int
-}
-
-func (g keyGuess) String() string {
-	return fmt.Sprintf("<Key:0x%02x, Corr:%f, Loc: %d>", g.key, g.maxCorr, g.maxLocation)
-}
-
 func init() {
 	flag.Parse()
 }
@@ -120,7 +113,7 @@ func init() {
 func main() {
 	defer glog.Flush()
 
-	capture, err := gocw.LoadCapture(*inputFlag)
+	capture, err := gocw.LoadAttackCapture(*inputFlag)
 	if err != nil {
 		glog.Fatal(err)
 	}
@@ -128,6 +121,16 @@ func main() {
 	glog.Infof("Loaded capture with %d traces / %d samples per trace",
 		len(capture), len(capture[0].PowerMeasurements))
 
+	var mask *gocw.SampleMask
+	if len(*maskFlag) > 0 {
+		if mask, err = gocw.LoadSampleMask(*maskFlag); err != nil {
+			glog.Fatal(err)
+		}
+	}
+	// Maps matrix columns back to sample locations in the trace.
+	locations := mask.Indices(len(capture[0].PowerMeasurements))
+	timeBase := gocw.LoadTimeBase(*inputFlag)
+
 	// Transpose the samples matrix such that samples are stored in the rows:
 	//  _            _
 	// |  | |      |  |
@@ -136,16 +139,27 @@ func main() {
 	//
 	// This lets us use RawRowView which is more efficient than copying a column
 	// each time.
-	T := mat.DenseCopyOf(capture.SamplesMatrix().T())
+	M, err := capture.MaskedSamplesMatrix(mask)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	T := mat.DenseCopyOf(M.T())
 	numSamples, _ := T.Dims()
 
-	fullKey := make([]byte, 16)
+	result := &attack.AttackResult{
+		Attack:    attack.AttackSboxCpa,
+		Input:     *inputFlag,
+		NumTraces: len(capture),
+		Bytes:     make([]attack.ByteResult, 16),
+	}
 	var wg sync.WaitGroup
 	wg.Add(16)
 	for k := 0; k < 16; k++ {
 		go func(keyIdx int) {
 			defer wg.Done()
-			bestGuess := keyGuess{byte(0), 0, 0}
+			// Highest correlation of each key guess, and its location.
+			var scores [256]float64
+			var locs [256]int
 			for key := 0; key < 256; key++ {
 				X := leakModel(byte(key), keyIdx, capture)
 
@@ -164,16 +178,28 @@ func main() {
 					// Best guess is the key with the highest correlation between all possible keys,
 					// across all possible time-slices.
 					pcc = math.Abs(pcc)
-					if pcc > bestGuess.maxCorr {
-						bestGuess = keyGuess{byte(key), pcc, i}
+					if pcc > scores[key] {
+						scores[key] = pcc
+						locs[key] = locations[i]
 					}
 				}
 			}
-			glog.V(1).Infof("Best guess for index %d: %v", keyIdx, bestGuess)
-			fullKey[keyIdx] = bestGuess.key
+			result.Bytes[keyIdx] = attack.RankGuesses(keyIdx, scores, locs, *topKFlag)
+			best := result.Bytes[keyIdx].Best()
+			glog.V(1).Infof("Best guess for index %d: <Key:0x%02x, Corr:%f> at %s",
+				keyIdx, best.Key, best.Score, timeBase.Format(best.Location))
 		}(k)
 	}
 
 	wg.Wait()
-	glog.Infof("Fully recovered key: %v", hex.EncodeToString(fullKey))
+	for _, b := range result.Bytes {
+		glog.Infof("Byte %2d: %v", b.Index, b)
+	}
+	glog.Infof("Fully recovered key: %v", hex.EncodeToString(result.Key()))
+	if len(*outputFlag) > 0 {
+		if err = result.Save(*outputFlag); err != nil {
+			glog.Fatal(err)
+		}
+		glog.Infof("Saved %s", *outputFlag)
+	}
 }
@@ -41,20 +41,24 @@ package main
 import (
 	"encoding/hex"
 	"flag"
-	"fmt"
 	"math"
 	"sync"
 
 	"github.com/google/gocw"
+	"github.com/google/gocw/attack"
 
 	"github.com/golang/glog"
 	"gonum.org/v1/gonum/mat"
 )
 
 var (
-	inputFlag    = flag.String("input", "captures/stm_aes_t500_s5000.json.gz", "Capture input file")
+	inputFlag    = flag.String("input", "captures/stm_aes_t500_s5000.json.gz", "Capture input file, or glob of files read as one capture")
 	winStartFlag = flag.Int("t1", 0, "Window start")
 	winEndFlag   = flag.Int("t2", 0, "Window end")
+	maskFlag     = flag.String("mask", "",
+		"Optional JSON sample mask file. The window is applied to the masked samples")
+	topKFlag   = flag.Int("top_k", 5, "Number of guesses per key byte reported and saved")
+	outputFlag = flag.String("output", "", "Optional JSON attack result output file, see attack.AttackResult")
 
 	// Copied from third_party/tiny-AES-c/aes.c
 	sbox = [256]byte{
@@ -99,16 +103,6 @@ func leakModel(key byte, keyIdx int, capture gocw.Capture) (mat.Vector, mat.Vect
 	return split0, split1
 }
 
-type keyGuess struct {
-	key         byte
-	maxDiff     float64
-	maxLocation int
-}
-
-func (g keyGuess) String() string {
-	return fmt.Sprintf("<Key:0x%02x, Diff:%f, Loc: %d>", g.key, g.maxDiff, g.maxLocation)
-}
-
 func init() {
 	flag.Parse()
 }
@@ -116,7 +110,7 @@ func init() {
 func main() {
 	defer glog.Flush()
 
-	capture, err := gocw.LoadCapture(*inputFlag)
+	capture, err := gocw.LoadAttackCapture(*inputFlag)
 	if err != nil {
 		glog.Fatal(err)
 	}
@@ -124,21 +118,41 @@ func main() {
 	glog.Infof("Loaded capture with %d traces / %d samples per trace",
 		len(capture), len(capture[0].PowerMeasurements))
 
-	M := capture.SamplesMatrix()
+	var mask *gocw.SampleMask
+	if len(*maskFlag) > 0 {
+		if mask, err = gocw.LoadSampleMask(*maskFlag); err != nil {
+			glog.Fatal(err)
+		}
+	}
+	// Maps matrix columns back to sample locations in the trace.
+	locations := mask.Indices(len(capture[0].PowerMeasurements))
+	timeBase := gocw.LoadTimeBase(*inputFlag)
+
+	M, err := capture.MaskedSamplesMatrix(mask)
+	if err != nil {
+		glog.Fatal(err)
+	}
 	if *winEndFlag == 0 {
-		*winEndFlag = len(capture[0].PowerMeasurements)
+		*winEndFlag = len(locations)
 	}
 	T := M.(*mat.Dense).Slice(0, len(capture), *winStartFlag, *winEndFlag)
 	r, c := T.Dims()
 	glog.Infof("T is %d x %d matrix", r, c)
 
-	fullKey := make([]byte, 16)
+	result := &attack.AttackResult{
+		Attack:    attack.AttackSboxDpa,
+		Input:     *inputFlag,
+		NumTraces: len(capture),
+		Bytes:     make([]attack.ByteResult, 16),
+	}
 	var wg sync.WaitGroup
 	wg.Add(16)
 	for k := 0; k < 16; k++ {
 		go func(keyIdx int) {
 			defer wg.Done()
-			bestGuess := keyGuess{byte(0), 0, 0}
+			// Highest difference of means of each key guess, and its location.
+			var scores [256]float64
+			var locs [256]int
 			for key := 0; key < 256; key++ {
 				S0, S1 := leakModel(byte(key), keyIdx, capture)
 
@@ -158,16 +172,28 @@ func main() {
 				// across all possible time-slices.
 				for i, v := range diff.RawRowView(0) {
 					v = math.Abs(v)
-					if v > bestGuess.maxDiff {
-						bestGuess = keyGuess{byte(key), v, *winStartFlag + i}
+					if v > scores[key] {
+						scores[key] = v
+						locs[key] = locations[*winStartFlag+i]
 					}
 				}
 			}
-			glog.V(1).Infof("Best guess for index %d: %v", keyIdx, bestGuess)
-			fullKey[keyIdx] = bestGuess.key
+			result.Bytes[keyIdx] = attack.RankGuesses(keyIdx, scores, locs, *topKFlag)
+			best := result.Bytes[keyIdx].Best()
+			glog.V(1).Infof("Best guess for index %d: <Key:0x%02x, Diff:%f> at %s",
+				keyIdx, best.Key, best.Score, timeBase.Format(best.Location))
 		}(k)
 	}
 
 	wg.Wait()
-	glog.Infof("Fully recovered key: %v", hex.EncodeToString(fullKey))
+	for _, b := range result.Bytes {
+		glog.Infof("Byte %2d: %v", b.Index, b)
+	}
+	glog.Infof("Fully recovered key: %v", hex.EncodeToString(result.Key()))
+	if len(*outputFlag) > 0 {
+		if err = result.Save(*outputFlag); err != nil {
+			glog.Fatal(err)
+		}
+		glog.Infof("Saved %s", *outputFlag)
+	}
 }
@@ -0,0 +1,67 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Measures the capture rate, and dumps latency histograms of the USB control
+// and bulk transfers and of the serial round trips to the target, to find
+// whether USB, the capture firmware or the target dominates per-trace time.
+
+// $ go run cmd/benchmark_capture.go -traces 200 -samples 5000
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/gocw"
+
+	"github.com/golang/glog"
+)
+
+var (
+	samplesFlag        = flag.Int("samples", 1500, "Number of samples per trace")
+	tracesFlag         = flag.Int("traces", 100, "Number of traces to capture")
+	batchFlag          = flag.Int("batch", 1, "Traces per arm, see cmd/capture.go")
+	targetProtocolFlag = flag.String("target_protocol", gocw.DefaultTargetProtocol,
+		"Target firmware protocol, one of the protocols registered with gocw.RegisterTargetProtocol")
+)
+
+func init() {
+	flag.Parse()
+}
+
+func main() {
+	defer glog.Flush()
+
+	key := make([]byte, 16)
+	opts := gocw.DefaultCaptureOptions()
+	opts.TargetProtocol = *targetProtocolFlag
+	opts.BatchSize = *batchFlag
+	opts.LatencyStats = gocw.NewLatencyStats()
+
+	start := time.Now()
+	capture, err := gocw.NewCaptureWithOptions(
+		key, gocw.RandGen(len(key)), *samplesFlag, *tracesFlag, 0, opts)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	fmt.Printf("%d traces of %d samples in %v: %.1f traces/s, %v per trace\n\n",
+		len(capture), *samplesFlag, elapsed.Round(time.Millisecond),
+		float64(len(capture))/elapsed.Seconds(), elapsed/time.Duration(len(capture)))
+	if err = opts.LatencyStats.Dump(os.Stdout); err != nil {
+		glog.Fatal(err)
+	}
+}
@@ -16,10 +16,18 @@
 package main
 
 import (
+	"context"
 	"encoding/hex"
 	"flag"
+	"os"
+	"os/signal"
+	"time"
 
 	"github.com/google/gocw"
+	// Registers the cw305 target protocol.
+	_ "github.com/google/gocw/cw305"
+	"github.com/google/gocw/scpi"
+	"github.com/google/gocw/sim"
 
 	"github.com/golang/glog"
 )
@@ -31,6 +39,52 @@ var (
 	outputFlag  = flag.String("output", "", "Capture .json.gz output file")
 	keyHexFlag  = flag.String("key", "2b7e151628aed2a6abf7158809cf4f3c",
 		"16byte key in hex")
+	tagUnlockedFlag = flag.Bool("tag_unlocked", false,
+		"Tag traces captured while the ADC clock was unlocked, instead of aborting")
+	auditFlag = flag.Bool("audit", true,
+		"Append session events to an audit log next to the output file")
+	firmwareFlag = flag.String("firmware", "",
+		"Optional target firmware file, recorded by hash in the audit log")
+	batchFlag = flag.Int("batch", 1,
+		"Traces per arm. Above 1, plaintexts are sent in one burst and captured with segmented capture")
+	targetProtocolFlag = flag.String("target_protocol", gocw.DefaultTargetProtocol,
+		"Target firmware protocol, one of the protocols registered with gocw.RegisterTargetProtocol")
+	baselineIntervalFlag = flag.Int("baseline_interval", 0,
+		"Record an idle target baseline trace every N traces, for drift correction. Zero disables")
+	seedFlag = flag.Int64("seed", -1,
+		"Seed of the plaintext generator, recorded in the audit log, for reproducible campaigns. Negative uses crypto/rand")
+	randSourceFlag = flag.String("rand_source", "",
+		"File to read plaintext random bytes from (e.g. /dev/hwrng) instead of crypto/rand")
+	validateFlag = flag.String("validate", "",
+		"Check each ciphertext against AES with the key. 'discard' re-captures traces with wrong outputs, 'tag' keeps them tagged. Empty disables")
+	autoGainFlag = flag.Bool("auto_gain", false,
+		"Lower the ADC gain and re-capture traces that clip the ADC")
+	targetAmplitudeFlag = flag.Float64("target_amplitude", 0,
+		"Adjust the gain to keep the trace peak at this fraction of the ADC range, e.g. 0.7. 0 disables")
+	scopeFlag = flag.String("scope", "",
+		"Capture with an external SCPI scope at tcp:host[:port] or usbtmc:/dev/usbtmcN instead of the ChipWhisperer ADC")
+	scopeDialectFlag = flag.String("scope_dialect", "keysight", "External scope family, one of keysight, rigol")
+	scopeChannelFlag = flag.Int("scope_channel", 1, "External scope channel")
+	powerCycleFlag   = flag.Int("power_cycle_after_timeouts", 0,
+		"Power-cycle the target after N consecutive trigger timeouts, e.g. when it crashed. Zero disables")
+	reconnectFlag = flag.Int("reconnect_attempts", 0,
+		"Reconnect up to N times when the device drops off the bus, and resume the capture. Zero disables")
+	adaptiveDecimationFlag = flag.Bool("adaptive_decimation", false,
+		"Measure the target operation on a pilot trace, and downsample to capture all of it. -samples only applies to the pilot")
+	baudFlag = flag.Uint("baud", uint(gocw.BaudRateLow),
+		"Baud rate of the target serial port, any rate the SAM3U can divide its clock to")
+	streamFlag = flag.String("stream", "",
+		"Trace stream (.pb) written as the traces are captured, e.g. captures/run.pb next to "+
+			"-output captures/run.json.gz, followed by the viewer's live attacks")
+	simFlag = flag.Bool("sim", false,
+		"Capture from the software simulator of an AES target instead of hardware")
+	operatorFlag = flag.String("operator", "", "Who records the capture, saved in its provenance file")
+	targetIdFlag = flag.String("target_id", "",
+		"Identifier of the target device, e.g. its serial number, saved in the provenance file")
+	projectFlag = flag.String("project", "", "Project of the capture, saved in the provenance file")
+	licenseFlag = flag.String("license", "",
+		"License the capture may be shared under, e.g. CC-BY-4.0, saved in the provenance file")
+	consentFlag = flag.Bool("consent", false, "The owner of the target agreed to publishing the capture")
 )
 
 func init() {
@@ -46,16 +100,123 @@ func main() {
 		glog.Fatal(err)
 	}
 
-	var capture gocw.Capture
-	if capture, err = gocw.NewCapture(
-		key, gocw.RandGen(len(key)), *samplesFlag, *tracesFlag, *offsetFlag); err != nil {
+	opts := gocw.DefaultCaptureOptions()
+	opts.TargetProtocol = *targetProtocolFlag
+	opts.BatchSize = *batchFlag
+	opts.BaselineInterval = *baselineIntervalFlag
+	opts.AutoGain = *autoGainFlag
+	opts.TargetAmplitude = *targetAmplitudeFlag
+	opts.PowerCycleAfterTimeouts = *powerCycleFlag
+	opts.AdaptiveDecimation = *adaptiveDecimationFlag
+	if usart := gocw.DefaultUsartConfig().WithBaudRate(gocw.BaudRate(*baudFlag)); usart != gocw.DefaultUsartConfig() {
+		if err := usart.Validate(); err != nil {
+			glog.Fatal(err)
+		}
+		opts.Usart = &usart
+	}
+	if len(*streamFlag) > 0 {
+		f, err := os.Create(*streamFlag)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		defer f.Close()
+		opts.Stream = gocw.NewTraceEncoder(f)
+	}
+	if *reconnectFlag > 0 {
+		policy := gocw.DefaultReconnectPolicy()
+		policy.Attempts = *reconnectFlag
+		opts.Reconnect = &policy
+	}
+	if len(*scopeFlag) > 0 {
+		scope, err := scpi.OpenScope(*scopeDialectFlag, *scopeFlag, *scopeChannelFlag)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		if id, err := scope.Identify(); err == nil {
+			glog.Infof("Capturing with %s", id)
+		}
+		opts.Scope = scope
+	}
+	if *tagUnlockedFlag {
+		opts.ClockPolicy = gocw.ClockPolicyTag
+	}
+	switch *validateFlag {
+	case "":
+	case "discard":
+		opts.Validator = gocw.AesValidator
+	case "tag":
+		opts.Validator = gocw.AesValidator
+		opts.ValidationPolicy = gocw.ValidationTag
+	default:
+		glog.Fatal("Unknown -validate flag. Valid values ['', 'discard', 'tag']")
+	}
+	if *auditFlag && len(*outputFlag) > 0 {
+		if opts.AuditLog, err = gocw.OpenAuditLog(gocw.AuditLogFilename(*outputFlag)); err != nil {
+			glog.Fatal(err)
+		}
+		defer opts.AuditLog.Close()
+		if len(*firmwareFlag) > 0 {
+			digest, err := gocw.FileDigest(*firmwareFlag)
+			if err != nil {
+				glog.Fatal(err)
+			}
+			opts.AuditLog.Log("target_firmware", map[string]string{
+				"file": *firmwareFlag, "sha256": digest})
+		}
+	}
+
+	if len(*operatorFlag) > 0 || len(*targetIdFlag) > 0 || len(*projectFlag) > 0 || len(*licenseFlag) > 0 || *consentFlag {
+		opts.Provenance = &gocw.Provenance{
+			Operator: *operatorFlag,
+			TargetId: *targetIdFlag,
+			Project:  *projectFlag,
+			License:  *licenseFlag,
+			Consent:  *consentFlag,
+			Created:  time.Now(),
+		}
+	}
+
+	ptGen := gocw.RandGen(len(key))
+	switch {
+	case *seedFlag >= 0 && len(*randSourceFlag) > 0:
+		glog.Fatal("-seed and -rand_source are exclusive")
+	case *seedFlag >= 0:
+		src := gocw.NewSeededRand(uint64(*seedFlag))
+		opts.RandSource = src.String()
+		ptGen = gocw.RandGenFrom(src, len(key))
+	case len(*randSourceFlag) > 0:
+		f, err := os.Open(*randSourceFlag)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		defer f.Close()
+		opts.RandSource = *randSourceFlag
+		ptGen = gocw.RandGenFrom(f, len(key))
+	}
+
+	if *simFlag {
+		opts.Device = sim.New(sim.DefaultLeakModel()).CaptureDevice()
+	}
+	// Ctrl-C stops the capture with the ADC disarmed.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	capture, err := gocw.NewCaptureContext(
+		ctx, key, ptGen, *samplesFlag, *tracesFlag, *offsetFlag, opts)
+	if err != nil {
 		glog.Fatal(err)
 	}
 
 	if len(*outputFlag) > 0 {
 		if err = capture.Save(*outputFlag); err != nil {
+			opts.AuditLog.Log("error", err.Error())
 			glog.Fatal(err)
 		}
+		opts.AuditLog.Log("saved", *outputFlag)
+		if opts.Provenance != nil {
+			if err = opts.Provenance.Save(*outputFlag); err != nil {
+				glog.Fatal(err)
+			}
+		}
 	} else {
 		glog.Infof("Capture: %v", capture)
 	}
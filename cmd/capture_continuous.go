@@ -0,0 +1,136 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Captures continuously into a ring buffer, and saves the windows selected by
+// a threshold on the power, or by a match against a template trace, with the
+// windows around them. Catches rare events the hardware trigger can't
+// isolate. Stops on Ctrl-C, or at the -events or -max_windows limits.
+
+// $ go run cmd/capture_continuous.go -logtostderr -samples 5000 -pre 2 -post 1 -threshold 0.3 -output /tmp/events.json.gz
+// $ go run cmd/capture_continuous.go -logtostderr -template captures/stm_aes_t500_s5000.json.gz -template_offset 1000 -template_length 200 -max_sad 0.01 -output /tmp/events.json.gz
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+
+	"github.com/google/gocw"
+
+	"github.com/golang/glog"
+)
+
+var (
+	samplesFlag        = flag.Int("samples", 5000, "Number of samples per window")
+	preFlag            = flag.Int("pre", 1, "Number of windows saved before each selected window")
+	postFlag           = flag.Int("post", 1, "Number of windows saved after each selected window")
+	eventsFlag         = flag.Int("events", 10, "Stop after this many events. 0 for no limit")
+	maxWindowsFlag     = flag.Int("max_windows", 0, "Stop after this many windows. 0 for no limit")
+	gainFlag           = flag.Int("gain", -1, "ADC gain (0-78). Negative keeps the device default")
+	thresholdFlag      = flag.Float64("threshold", 0, "Select windows with a sample magnitude of at least this")
+	templateFlag       = flag.String("template", "", "Capture .json.gz file, whose first trace holds the template")
+	templateOffsetFlag = flag.Int("template_offset", 0, "First sample of the template in the template trace")
+	templateLengthFlag = flag.Int("template_length", 100, "Number of samples of the template")
+	maxSadFlag         = flag.Float64("max_sad", 0.01, "Select windows matching the template with at most this mean absolute difference")
+	outputFlag         = flag.String("output", "", "Capture .json.gz output file, one trace per event")
+)
+
+func init() {
+	flag.Parse()
+}
+
+func analyzer() gocw.WindowAnalyzer {
+	if len(*templateFlag) == 0 {
+		if *thresholdFlag <= 0 {
+			glog.Fatal("Set -threshold or -template")
+		}
+		return gocw.ThresholdAnalyzer(*thresholdFlag)
+	}
+	c, err := gocw.LoadCapture(*templateFlag)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	if len(c) == 0 {
+		glog.Fatalf("%s has no traces", *templateFlag)
+	}
+	start, end := *templateOffsetFlag, *templateOffsetFlag+*templateLengthFlag
+	if start < 0 || *templateLengthFlag <= 0 || end > len(c[0].PowerMeasurements) {
+		glog.Fatalf("Template [%d, %d) outside the %d samples of %s", start, end, len(c[0].PowerMeasurements), *templateFlag)
+	}
+	if *templateLengthFlag > *samplesFlag {
+		glog.Fatalf("Template of %d samples longer than the %d samples windows", *templateLengthFlag, *samplesFlag)
+	}
+	return gocw.SadAnalyzer(c[0].PowerMeasurements[start:end], *maxSadFlag)
+}
+
+func main() {
+	defer glog.Flush()
+
+	if len(*outputFlag) == 0 {
+		glog.Fatal("Missing -output")
+	}
+	opts := gocw.ContinuousOptions{
+		WindowSamples: *samplesFlag,
+		PreWindows:    *preFlag,
+		PostWindows:   *postFlag,
+		MaxEvents:     *eventsFlag,
+		MaxWindows:    *maxWindowsFlag,
+		Analyzer:      analyzer(),
+	}
+
+	dev, err := gocw.OpenUsbDevice()
+	if err != nil {
+		glog.Fatal(err)
+	}
+	defer dev.Close()
+	fpga, err := gocw.NewFpga(dev)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	adc, err := gocw.NewAdc(fpga)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	defer adc.Close()
+	if *gainFlag >= 0 {
+		adc.SetGain(uint8(*gainFlag))
+	}
+
+	var capture gocw.Capture
+	opts.OnEvent = func(e gocw.ContinuousEvent) error {
+		glog.Infof("Event at window %d, %v", e.Window, e.Time.Format("15:04:05.000"))
+		capture = append(capture, e.Trace())
+		return nil
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	stop := make(chan struct{})
+	go func() {
+		<-interrupt
+		glog.Info("Stopping")
+		close(stop)
+	}()
+	if err = gocw.CaptureContinuous(adc, opts, stop); err != nil {
+		glog.Error(err)
+	}
+
+	if len(capture) == 0 {
+		glog.Info("No events")
+		return
+	}
+	if err = capture.Save(*outputFlag); err != nil {
+		glog.Fatal(err)
+	}
+	glog.Infof("Saved %d events to %s", len(capture), *outputFlag)
+}
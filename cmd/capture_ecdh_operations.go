@@ -38,6 +38,11 @@ var (
 	offsetFlag  = flag.Int("offset", 0, "Offset of capture after trigger")
 	pointFlag   = flag.String("point", "rand", "Input point type ['rand', 'zero']")
 	outputFlag  = flag.String("output", "", "Capture .json.gz output file")
+
+	validateFlag = flag.String("validate", "",
+		"Check each output point against a P256 multiplication. ['', 'discard', 'tag']")
+	adaptiveDecimationFlag = flag.Bool("adaptive_decimation", false,
+		"Measure the multiplication on a pilot trace, and downsample to capture all of it. -samples only applies to the pilot")
 )
 
 // Pre-computed points with sage:
@@ -140,9 +145,22 @@ func main() {
 		glog.Fatal("Unknown --point flag. Valid values ['rand', 'zero']")
 	}
 
+	opts := gocw.DefaultCaptureOptions()
+	opts.AdaptiveDecimation = *adaptiveDecimationFlag
+	switch *validateFlag {
+	case "":
+	case "discard":
+		opts.Validator = gocw.P256Validator
+	case "tag":
+		opts.Validator = gocw.P256Validator
+		opts.ValidationPolicy = gocw.ValidationTag
+	default:
+		glog.Fatal("Unknown --validate flag. Valid values ['', 'discard', 'tag']")
+	}
+
 	var capture gocw.Capture
-	if capture, err = gocw.NewCapture(
-		util.EncodeP256Int(K), pointGen, *samplesFlag, *tracesFlag, *offsetFlag); err != nil {
+	if capture, err = gocw.NewCaptureWithOptions(
+		util.EncodeP256Int(K), pointGen, *samplesFlag, *tracesFlag, *offsetFlag, opts); err != nil {
 		glog.Fatal(err)
 	}
 
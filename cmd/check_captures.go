@@ -0,0 +1,78 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Checks capture files for duplicate plaintexts and repeated traces, and
+// optionally merges them into a single capture.
+
+// $ go run cmd/check_captures.go -logtostderr -output merged.json.gz -dedup a.json.gz b.json.gz
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+
+	"github.com/google/gocw"
+
+	"github.com/golang/glog"
+)
+
+var (
+	outputFlag = flag.String("output", "", "Optional .json.gz file to write the merged capture to")
+	dedupFlag  = flag.Bool("dedup", false, "Drop traces with a repeated key and plaintext when merging")
+)
+
+func init() {
+	flag.Parse()
+}
+
+func main() {
+	defer glog.Flush()
+
+	inputs := flag.Args()
+	if len(inputs) == 0 {
+		glog.Fatal("No capture files given")
+	}
+
+	captures := make([]gocw.Capture, len(inputs))
+	for i, filename := range inputs {
+		var err error
+		if captures[i], err = gocw.LoadCapture(filename); err != nil {
+			glog.Fatal(err)
+		}
+		glog.Infof("Loaded %s with %d traces", filename, len(captures[i]))
+	}
+
+	report := gocw.FindDuplicates(captures...)
+	for _, group := range report.Plaintexts {
+		first := captures[group[0].Capture][group[0].Index]
+		glog.Warningf("Plaintext %s repeated %d times:", hex.EncodeToString(first.Pt), len(group))
+		for _, ref := range group {
+			glog.Warningf("  %s trace %d", inputs[ref.Capture], ref.Index)
+		}
+	}
+	for _, group := range report.Traces {
+		glog.Warningf("Identical trace repeated %d times (first: %s trace %d)",
+			len(group), inputs[group[0].Capture], group[0].Index)
+	}
+	glog.Infof("Found %d repeated plaintexts and %d repeated traces",
+		len(report.Plaintexts), len(report.Traces))
+
+	if len(*outputFlag) > 0 {
+		merged := gocw.MergeCaptures(*dedupFlag, captures...)
+		if err := merged.Save(*outputFlag); err != nil {
+			glog.Fatal(err)
+		}
+		glog.Infof("Wrote %d traces to %s", len(merged), *outputFlag)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Converts captures between the .json.gz format and protocol buffer trace
+// streams (.pb, see proto/gocw.proto), for consumers in other languages.
+
+// $ go run cmd/convert_capture.go -logtostderr -input captures/stm_aes_t500_s5000.json.gz -output /tmp/stm_aes_t500_s5000.pb
+package main
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/google/gocw"
+
+	"github.com/golang/glog"
+)
+
+const protoExt = ".pb"
+
+var (
+	inputFlag  = flag.String("input", "", "Capture .json.gz or .pb input file. A glob of .json.gz files is read as one capture")
+	outputFlag = flag.String("output", "", "Capture .json.gz or .pb output file")
+)
+
+func init() {
+	flag.Parse()
+}
+
+func main() {
+	defer glog.Flush()
+
+	if len(*inputFlag) == 0 || len(*outputFlag) == 0 {
+		glog.Fatal("Missing -input or -output")
+	}
+	var capture gocw.Capture
+	var cfg *gocw.ScopeConfig
+	var err error
+	if strings.HasSuffix(*inputFlag, protoExt) {
+		capture, cfg, err = gocw.LoadCaptureProto(*inputFlag)
+	} else {
+		capture, err = gocw.LoadCaptureSet(*inputFlag)
+	}
+	if err != nil {
+		glog.Fatal(err)
+	}
+
+	if strings.HasSuffix(*outputFlag, protoExt) {
+		err = capture.SaveProto(*outputFlag, cfg)
+	} else {
+		err = capture.Save(*outputFlag)
+	}
+	if err != nil {
+		glog.Fatal(err)
+	}
+	glog.Infof("Converted %d traces to %s", len(capture), *outputFlag)
+}
@@ -0,0 +1,70 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Programs the CW305 target board and sets its clock, before captures with
+// -target_protocol cw305. The scope then captures as usual: the design
+// drives the trigger, and cmd/capture.go talks to it over USB.
+
+// $ go run cmd/cw305.go -bitstream cw305_top.bit -clock_hz 10e6
+package main
+
+import (
+	"flag"
+
+	"github.com/google/gocw/cw305"
+
+	"github.com/golang/glog"
+)
+
+var (
+	bitstreamFlag = flag.String("bitstream", "", "FPGA bitstream (.bit). Empty keeps the current design")
+	pllFlag       = flag.Int("pll", 1, "PLL clocking the design")
+	clockHzFlag   = flag.Float64("clock_hz", 0, "Design clock frequency. Zero keeps the current setting")
+)
+
+func init() {
+	flag.Parse()
+}
+
+func main() {
+	defer glog.Flush()
+
+	board, err := cw305.Open()
+	if err != nil {
+		glog.Fatal(err)
+	}
+	defer board.Close()
+
+	if len(*bitstreamFlag) > 0 {
+		glog.Infof("Programming %s", *bitstreamFlag)
+		if err = board.ProgramFile(*bitstreamFlag); err != nil {
+			glog.Fatal(err)
+		}
+	}
+	if *clockHzFlag > 0 {
+		hz, err := board.SetPllFrequency(*pllFlag, *clockHzFlag)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		if err = board.SetPllOutputEnabled(*pllFlag, true); err != nil {
+			glog.Fatal(err)
+		}
+		glog.Infof("PLL %d at %.0fHz", *pllFlag, hz)
+	}
+	pll, err := board.Pll(*pllFlag)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	glog.Infof("PLL %d: %+v, %.0fHz", *pllFlag, pll, pll.OutputHz())
+}
@@ -45,6 +45,7 @@ import (
 	"sort"
 
 	"github.com/google/gocw"
+	"github.com/google/gocw/analysis"
 
 	"github.com/golang/glog"
 	"gonum.org/v1/gonum/mat"
@@ -57,6 +58,10 @@ var (
 		"Capture with ECDH operations that resulted with a zero x-coordinate point")
 	randCaptureFlag = flag.String("rand_capture", "captures/stm_ecdh_rand_t120_s5000.json.gz",
 		"Capture with ECDH operations with random EC point")
+	robustFlag = flag.Bool("robust", false,
+		"Use median/MAD statistics, and reject outlier traces before building templates")
+	outlierThresholdFlag = flag.Float64("outlier_threshold", 4,
+		"Outlier rejection threshold, in MADs. Only used with --robust")
 )
 
 const (
@@ -114,27 +119,37 @@ func findPointsOfInterest(zeroAvg, randAvg mat.Vector) []int {
 	return nil
 }
 
-func averageTraces(M mat.Matrix) mat.Vector {
-	numTraces, _ := M.Dims()
-	data := make([]float64, numTraces)
-	for i := range data {
-		data[i] = 1.0 / float64(numTraces)
+func estimator() analysis.Estimator {
+	if *robustFlag {
+		return analysis.EstimatorMedian
 	}
-	S := mat.NewVecDense(numTraces, data)
+	return analysis.EstimatorMean
+}
+
+func averageTraces(M mat.Matrix) mat.Vector {
+	avg := analysis.AverageTrace(M, estimator())
+	return mat.NewVecDense(len(avg), avg)
+}
 
-	var avg mat.Dense
-	avg.Product(mat.TransposeVec{S}, M)
-	return avg.RowView(0)
+// Drops outlier traces from the training set when --robust is set.
+func rejectOutliers(M mat.Matrix) mat.Matrix {
+	if !*robustFlag {
+		return M
+	}
+	numTraces, _ := M.Dims()
+	keep := analysis.RejectOutliers(M, *outlierThresholdFlag)
+	glog.Infof("Rejected %d/%d outlier traces", numTraces-len(keep), numTraces)
+	return analysis.SelectRows(M, keep)
 }
 
-func loadCapture(filename string) mat.Matrix {
+func loadCapture(filename string) *analysis.Dataset {
 	capture, err := gocw.LoadCapture(filename)
 	if err != nil {
 		glog.Fatalf("Failed to load capture: %v", err)
 		return nil
 	}
 
-	return capture.SamplesMatrix()
+	return analysis.NewDataset(capture)
 }
 
 // Builds template based classifier.
@@ -147,7 +162,11 @@ func buildTemplate(M mat.Matrix, poi []int) *distmv.Normal {
 	sigma := mat.NewSymDense(n, nil)
 	for i := 0; i < n; i++ {
 		X := T.RawRowView(poi[i])
-		mu[i] = stat.Mean(X, nil)
+		if *robustFlag {
+			mu[i] = analysis.Median(X)
+		} else {
+			mu[i] = stat.Mean(X, nil)
+		}
 		for j := 0; j < n; j++ {
 			Y := T.RawRowView(poi[j])
 			sigma.SetSym(i, j, stat.Covariance(X, Y, nil))
@@ -184,10 +203,9 @@ func testValidationSet(validation mat.Matrix, poi []int,
 }
 
 // Split traces: 80% for training, 20% for validation.
-func splitTraces(M mat.Matrix) (mat.Matrix, mat.Matrix) {
-	r, c := M.Dims()
-	return M.(*mat.Dense).Slice(0, (r*80)/100, 0, c),
-		M.(*mat.Dense).Slice((r*80)/100, r, 0, c)
+func splitTraces(d *analysis.Dataset) (mat.Matrix, mat.Matrix) {
+	training, validation := d.Split(0.8, nil)
+	return training.X, validation.X
 }
 
 func main() {
@@ -196,10 +214,12 @@ func main() {
 	glog.Info("Loading zero-point capture")
 	zeroTraces := loadCapture(*zeroCaptureFlag)
 	zeroTraining, zeroValidation := splitTraces(zeroTraces)
+	zeroTraining = rejectOutliers(zeroTraining)
 
 	glog.Info("Loading rand-point capture")
 	randTraces := loadCapture(*randCaptureFlag)
 	randTraining, randValidation := splitTraces(randTraces)
+	randTraining = rejectOutliers(randTraining)
 
 	zeroAvg := averageTraces(zeroTraining)
 	randAvg := averageTraces(randTraining)
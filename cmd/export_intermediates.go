@@ -0,0 +1,62 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Precomputes the leak model of every trace, key byte and key guess of a
+// capture (see analysis.IntermediateTable), so repeated attack runs and
+// model training can load them instead of recomputing them from Pt/Ct.
+
+// $ go run cmd/export_intermediates.go -logtostderr -input captures/stm_aes_t500_s5000.json.gz -model sbox_hw -output /tmp/stm_aes_sbox_hw.json.gz
+package main
+
+import (
+	"flag"
+
+	"github.com/google/gocw"
+	"github.com/google/gocw/analysis"
+
+	"github.com/golang/glog"
+)
+
+var (
+	inputFlag  = flag.String("input", "", "Capture .json.gz input file, or glob of files read as one capture")
+	modelFlag  = flag.String("model", "sbox_hw", "Leak model, one of sbox, sbox_hw, last_round_hd")
+	bytesFlag  = flag.Int("bytes", 16, "Number of key bytes")
+	outputFlag = flag.String("output", "", "Intermediate table .json.gz output file")
+)
+
+func init() {
+	flag.Parse()
+}
+
+func main() {
+	defer glog.Flush()
+
+	if len(*outputFlag) == 0 {
+		glog.Fatal("Missing -output")
+	}
+	capture, err := gocw.LoadAttackCapture(*inputFlag)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	glog.Infof("Loaded capture with %d traces", len(capture))
+
+	table, err := analysis.NewIntermediateTable(capture, *modelFlag, *bytesFlag)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	if err = table.Save(*outputFlag); err != nil {
+		glog.Fatal(err)
+	}
+	glog.Infof("Saved %s table of %d key bytes to %s", table.Model, table.NumBytes(), *outputFlag)
+}
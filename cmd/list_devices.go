@@ -0,0 +1,72 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Lists the connected ChipWhisperers and CW305 boards. Select one by serial
+// number with GOCW_TRANSPORT=gousb:<serial>. With -firmware, opens each
+// device to read its firmware version and build date.
+
+// $ go run cmd/list_devices.go [-firmware]
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/google/gocw"
+
+	"github.com/golang/glog"
+)
+
+var (
+	firmwareFlag = flag.Bool("firmware", false, "Open each device to read its firmware version and build date")
+)
+
+func init() {
+	flag.Parse()
+}
+
+func main() {
+	defer glog.Flush()
+
+	devices, err := gocw.ListDevices()
+	if err != nil {
+		glog.Fatal(err)
+	}
+	if len(devices) == 0 {
+		fmt.Println("No devices found")
+		return
+	}
+	for _, d := range devices {
+		fmt.Printf("%-16s %-24s %-28q bus %d address %d\n", d.Model, d.Serial, d.Description, d.Bus, d.Address)
+		if *firmwareFlag {
+			printFirmware(d)
+		}
+	}
+}
+
+func printFirmware(d gocw.DeviceInfo) {
+	dev, err := gocw.OpenModelUsbDevice(gocw.DefaultTransport+":"+d.Serial, d.Model)
+	if err != nil {
+		fmt.Printf("    firmware: %v\n", err)
+		return
+	}
+	defer dev.Close()
+	info, err := dev.Info()
+	if err != nil {
+		fmt.Printf("    firmware: %v\n", err)
+		return
+	}
+	fmt.Printf("    firmware %d.%d.%d, built %q, %s\n", info.Fw.Major, info.Fw.Minor, info.Fw.Debug,
+		info.FwBuildDate, info.Manufacturer)
+}
@@ -0,0 +1,89 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Free-running captures without a target, using forced triggers. Plots each
+// capture in the terminal, e.g. to check probe placement, gain or the noise
+// floor.
+
+// $ go run cmd/probe.go -samples 2000 -count 5 -delay 100ms
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/google/gocw"
+	"github.com/google/gocw/util"
+
+	"github.com/golang/glog"
+	"gonum.org/v1/gonum/stat"
+)
+
+var (
+	samplesFlag = flag.Int("samples", 1500, "Number of samples per capture")
+	countFlag   = flag.Int("count", 1, "Number of captures")
+	delayFlag   = flag.Duration("delay", 0, "Delay between arming and forcing the trigger")
+	gainFlag    = flag.Int("gain", -1, "ADC gain (0-78). Negative keeps the device default")
+	widthFlag   = flag.Int("width", 72, "Plot width in characters")
+	heightFlag  = flag.Int("height", 6, "Plot height in characters")
+)
+
+func init() {
+	flag.Parse()
+}
+
+func main() {
+	defer glog.Flush()
+
+	dev, err := gocw.OpenUsbDevice()
+	if err != nil {
+		glog.Fatal(err)
+	}
+	defer dev.Close()
+	fpga, err := gocw.NewFpga(dev)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	adc, err := gocw.NewAdc(fpga)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	defer adc.Close()
+
+	adc.SetTotalSamples(uint32(*samplesFlag))
+	if *gainFlag >= 0 {
+		adc.SetGain(uint8(*gainFlag))
+	}
+	for i := 0; i < *countFlag; i++ {
+		start := time.Now()
+		samples := adc.CaptureOnce(*delayFlag)
+		if err = adc.Error(); err != nil {
+			glog.Fatal(err)
+		}
+		y := gocw.Float64s(samples)
+		if len(y) == 0 {
+			glog.Warningf("Capture %d returned no samples", i)
+			continue
+		}
+		lo, hi := util.MinMax(y)
+		mean, std := stat.MeanStdDev(y, nil)
+		fmt.Printf("Capture %d (%v): min %+.4f  max %+.4f  mean %+.4f  std %.4f\n",
+			i, time.Since(start).Round(time.Millisecond), lo, hi, mean, std)
+		for _, line := range util.BraillePlot(y, *widthFlag, *heightFlag, lo, hi) {
+			fmt.Println(line)
+		}
+		fmt.Println()
+	}
+}
@@ -18,22 +18,72 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"os"
+	"os/signal"
 	"path"
+	"strings"
+	"time"
 
+	"github.com/google/gocw"
 	"github.com/google/gocw/util"
 
 	"github.com/golang/glog"
 )
 
 var (
-	firmwareFile = flag.String("firmware", "", ".hex firmware file name")
+	firmwareFile       = flag.String("firmware", "", ".hex firmware file name")
+	dryRunFlag         = flag.Bool("dry_run", false, "Log the erase and flash writes instead of performing them")
+	confirmChipErase   = flag.Bool("confirm_chip_erase", false, "Allow erasing the whole XMEGA, boot section and EEPROM included")
+	confirmOptionBytes = flag.Bool("confirm_option_bytes", false, "Allow writing STM32 option bytes present in the firmware")
+	progressFlag       = flag.Bool("progress", true, "Show a progress bar on stderr")
+	verifyEraseFlag    = flag.Bool("verify_erase", true, "Check that a sample of the flash reads erased before writing")
+	runFlag            = flag.Bool("run", false, "Start the firmware from the bootloader instead of resetting the chip")
 )
 
+const progressBarWidth = 40
+
 func init() {
 	flag.Parse()
 }
 
+// Returns a progress callback drawing a bar with the rate and remaining time
+// of each stage. A stage is drawn complete when the next one starts.
+func progressBar() func(util.ProgramProgress) {
+	var last util.ProgramProgress
+	var start time.Time
+	draw := func(p util.ProgramProgress) {
+		if p.Total == 0 {
+			return
+		}
+		filled := progressBarWidth * p.Done / p.Total
+		line := fmt.Sprintf("\r%-6s [%s%s] %3d%% %d/%dKB", p.Stage, strings.Repeat("=", filled),
+			strings.Repeat(" ", progressBarWidth-filled), 100*p.Done/p.Total, p.Done/1024, p.Total/1024)
+		if elapsed := time.Since(start); p.Done > 0 && elapsed > 0 {
+			rate := float64(p.Done) / elapsed.Seconds()
+			eta := time.Duration(float64(p.Total-p.Done) / rate * float64(time.Second))
+			line += fmt.Sprintf(" %.1fKB/s ETA %v", rate/1024, eta.Round(time.Second))
+		}
+		fmt.Fprint(os.Stderr, line+"\x1b[K")
+	}
+	return func(p util.ProgramProgress) {
+		if p.Stage != last.Stage {
+			if last.Stage != "" {
+				last.Done = last.Total
+				draw(last)
+				fmt.Fprintln(os.Stderr)
+			}
+			start = time.Now()
+		}
+		last = p
+		if p.Stage != "done" {
+			draw(p)
+		}
+	}
+}
+
 func main() {
 	var err error
 	defer glog.Flush()
@@ -44,9 +94,42 @@ func main() {
 	if path.Ext(*firmwareFile) != ".hex" {
 		glog.Fatal("Expected Intel-Hex firmware file")
 	}
-	if err = util.ProgramFlashFile(*firmwareFile); err != nil {
-		glog.Fatal("Failed programming device: %v", err)
+	if *dryRunFlag {
+		gocw.SetDryRun(true)
+	}
+	if *confirmChipErase {
+		gocw.Confirm(gocw.OpChipErase)
+	}
+	if *confirmOptionBytes {
+		gocw.Confirm(gocw.OpOptionBytes)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	var progress func(util.ProgramProgress)
+	if *progressFlag {
+		progress = progressBar()
+	}
+	firmware, err := util.LoadIntelHexFile(*firmwareFile)
+	if err != nil {
+		glog.Fatalf("Failed loading hex file: %v", err)
+	}
+	prog, _, err := util.OpenProgrammer("")
+	if err != nil {
+		glog.Fatal(err)
+	}
+	if err = util.ProgramDeviceOptions(ctx, prog, firmware, util.ProgramOptions{
+		Progress:    progress,
+		VerifyErase: *verifyEraseFlag,
+	}); err != nil {
+		prog.Close()
+		glog.Fatalf("Failed programming device: %v", err)
+	}
+	if *runFlag {
+		if err = util.RunFirmware(prog); err != nil {
+			glog.Warningf("%v, resetting the chip instead", err)
+		}
 	}
+	prog.Close()
 
 	glog.Info("Successfully programmed device")
 }
@@ -0,0 +1,81 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Queries, sets or clears the readout protection (RDP) of a STM32 target,
+// through its bootloader. Clearing it mass erases the flash.
+
+// $ go run cmd/readout_protection.go -logtostderr [-set | -clear] [-confirm_option_bytes] [-dry_run]
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/google/gocw"
+	"github.com/google/gocw/programmer/stm32f"
+
+	"github.com/golang/glog"
+)
+
+var (
+	setFlag            = flag.Bool("set", false, "Enable readout protection level 1")
+	clearFlag          = flag.Bool("clear", false, "Disable readout protection, mass erasing the flash")
+	confirmOptionBytes = flag.Bool("confirm_option_bytes", false, "Allow -set and -clear to write the option bytes")
+	dryRunFlag         = flag.Bool("dry_run", false, "Log the bootloader commands changing the protection instead of sending them")
+)
+
+func init() {
+	flag.Parse()
+}
+
+func main() {
+	defer glog.Flush()
+
+	if *setFlag && *clearFlag {
+		glog.Fatal("-set and -clear are exclusive")
+	}
+	if *dryRunFlag {
+		gocw.SetDryRun(true)
+	}
+	if (*setFlag || *clearFlag) && !*confirmOptionBytes {
+		glog.Fatal("-set and -clear write the option bytes, which requires -confirm_option_bytes")
+	}
+	if *confirmOptionBytes {
+		gocw.Confirm(gocw.OpOptionBytes)
+	}
+	prog, err := stm32f.NewProgrammer()
+	if err != nil {
+		glog.Fatal(err)
+	}
+	defer prog.Close()
+
+	switch {
+	case *setFlag:
+		err = prog.SetReadoutProtection()
+	case *clearFlag:
+		err = prog.ClearReadoutProtection()
+	}
+	if err != nil {
+		glog.Fatal(err)
+	}
+	if gocw.DryRun() {
+		// The programmer didn't sync with the bootloader.
+		return
+	}
+	protected, err := prog.ReadoutProtected()
+	if err != nil {
+		glog.Fatal(err)
+	}
+	fmt.Printf("%s readout protection: %v\n", prog.ChipName(), protected)
+}
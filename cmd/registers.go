@@ -0,0 +1,114 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Dumps, reads or writes the FPGA registers by name, without resetting the
+// device, e.g. to debug a custom bitstream. -map loads a JSON register map of
+// the bitstream (see internal/regmap/maps), instead of the map of the
+// hardware.
+
+// $ go run cmd/registers.go
+// $ go run cmd/registers.go -map custom.json -read ctrl
+// $ go run cmd/registers.go -map custom.json -write ctrl=21
+// $ go run cmd/registers.go -record_usb registers.usb.jsonl
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/google/gocw"
+
+	"github.com/golang/glog"
+)
+
+var (
+	mapFlag    = flag.String("map", "", "JSON register map file. Empty for the map of the hardware")
+	readFlag   = flag.String("read", "", "Register to read. Empty dumps all registers")
+	writeFlag  = flag.String("write", "", "Register to write, as name=hex")
+	recordFlag = flag.String("record_usb", "", "Records the USB transfers to this transcript file, see gocw.UsbReplay")
+)
+
+func init() {
+	flag.Parse()
+}
+
+func registerMap(fpga *gocw.Fpga) *gocw.RegisterMap {
+	if len(*mapFlag) == 0 {
+		adc, err := gocw.AttachAdc(fpga)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		return adc.RegisterMap()
+	}
+	f, err := os.Open(*mapFlag)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	defer f.Close()
+	m, err := gocw.ParseRegisterMap(f)
+	if err != nil {
+		glog.Fatalf("%s: %v", *mapFlag, err)
+	}
+	return m
+}
+
+func main() {
+	defer glog.Flush()
+
+	dev, err := gocw.OpenUsbDevice()
+	if err != nil {
+		glog.Fatal(err)
+	}
+	var usb gocw.UsbDeviceInterface = dev
+	if len(*recordFlag) > 0 {
+		if usb, err = gocw.RecordUsbTranscript(dev, *recordFlag); err != nil {
+			glog.Fatal(err)
+		}
+	}
+	defer usb.Close()
+	fpga, err := gocw.AttachFpga(usb)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	m := registerMap(fpga)
+
+	switch {
+	case len(*writeFlag) > 0:
+		parts := strings.SplitN(*writeFlag, "=", 2)
+		if len(parts) != 2 {
+			glog.Fatalf("Invalid -write %q, expected name=hex", *writeFlag)
+		}
+		data, err := hex.DecodeString(parts[1])
+		if err != nil {
+			glog.Fatalf("Invalid -write value %q: %v", parts[1], err)
+		}
+		if err = fpga.WriteRegister(m, parts[0], data); err != nil {
+			glog.Fatal(err)
+		}
+	case len(*readFlag) > 0:
+		data, err := fpga.ReadRegister(m, *readFlag)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		fmt.Printf("%x\n", data)
+	default:
+		fmt.Printf("Register map %s\n", m.Name)
+		if err = fpga.DumpRegisters(m, os.Stdout); err != nil {
+			glog.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Runs a campaign template end to end: programs the target, captures, and
+// checks that the attack recovers the key. See campaign/templates.
+// $ go run cmd/run.go -logtostderr aes-cpa-quickstart
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/google/gocw/campaign"
+
+	"github.com/golang/glog"
+)
+
+var (
+	listFlag        = flag.Bool("list", false, "List the templates and exit")
+	outputFlag      = flag.String("output", "", "Capture output file. Defaults to captures/<template>.json.gz")
+	skipProgramFlag = flag.Bool("skip_program", false, "Keep the firmware on the target")
+)
+
+func init() {
+	flag.Parse()
+}
+
+func main() {
+	defer glog.Flush()
+
+	if *listFlag {
+		names, err := campaign.Names()
+		if err != nil {
+			glog.Fatal(err)
+		}
+		templates, _ := campaign.Templates()
+		for _, name := range names {
+			fmt.Printf("%-28s %s\n", name, templates[name].Description)
+		}
+		return
+	}
+	if flag.NArg() != 1 {
+		glog.Fatal("Expected a template name, see -list")
+	}
+	t, err := campaign.Lookup(flag.Arg(0))
+	if err != nil {
+		glog.Fatal(err)
+	}
+	if *skipProgramFlag {
+		t.Firmware = ""
+	}
+	output := *outputFlag
+	if len(output) == 0 {
+		output = fmt.Sprintf("captures/%s.json.gz", t.Name)
+	}
+	report, err := campaign.Run(t, output)
+	if report != nil {
+		fmt.Println(report)
+	}
+	if err != nil {
+		glog.Fatalf("%s failed: %v", t.Name, err)
+	}
+	fmt.Printf("%s passed\n", t.Name)
+}
@@ -0,0 +1,78 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Removes the keys, plaintexts and ciphertexts of a capture before sharing it
+// publicly, keeping the measurements. The provenance file of the capture, if
+// any, is copied and marked scrubbed.
+
+// $ go run cmd/scrub_capture.go -logtostderr -input captures/stm_aes_t500_s5000.json.gz -output /tmp/stm_aes_t500_s5000.json.gz
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/google/gocw"
+
+	"github.com/golang/glog"
+)
+
+var (
+	inputFlag           = flag.String("input", "", "Capture .json.gz input file")
+	outputFlag          = flag.String("output", "", "Scrubbed capture .json.gz output file")
+	keepPlaintextsFlag  = flag.Bool("keep_plaintexts", false, "Keep the plaintexts, which allow recovering the key")
+	keepCiphertextsFlag = flag.Bool("keep_ciphertexts", false, "Keep the ciphertexts, which allow recovering the key")
+)
+
+func init() {
+	flag.Parse()
+}
+
+func main() {
+	defer glog.Flush()
+
+	if len(*inputFlag) == 0 || len(*outputFlag) == 0 {
+		glog.Fatal("Missing -input or -output")
+	}
+	if *inputFlag == *outputFlag {
+		glog.Fatal("-output must differ from -input")
+	}
+	capture, err := gocw.LoadCapture(*inputFlag)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	prov, err := gocw.LoadProvenance(*inputFlag)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	if prov == nil {
+		prov = &gocw.Provenance{Created: time.Now()}
+	}
+	if !prov.Consent {
+		glog.Warningf("%s has no recorded consent to publish it", *inputFlag)
+	}
+
+	capture = capture.Scrub(gocw.ScrubOptions{
+		KeepPlaintexts:  *keepPlaintextsFlag,
+		KeepCiphertexts: *keepCiphertextsFlag,
+	})
+	if err = capture.Save(*outputFlag); err != nil {
+		glog.Fatal(err)
+	}
+	prov.Scrubbed = true
+	if err = prov.Save(*outputFlag); err != nil {
+		glog.Fatal(err)
+	}
+	glog.Infof("Scrubbed %d traces to %s", len(capture), *outputFlag)
+}
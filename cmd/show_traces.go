@@ -0,0 +1,127 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Prints summary stats and terminal plots of a capture, for sanity checks on
+// headless capture rigs without the web viewer.
+
+// $ go run cmd/show_traces.go -input capture.json.gz -traces 0,1,2
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/gocw"
+	"github.com/google/gocw/analysis"
+	"github.com/google/gocw/util"
+
+	"github.com/golang/glog"
+	"gonum.org/v1/gonum/stat"
+)
+
+var (
+	inputFlag  = flag.String("input", "", "Capture .json.gz input file")
+	tracesFlag = flag.String("traces", "0", "Comma separated indices of the traces to plot")
+	widthFlag  = flag.Int("width", 72, "Plot width in characters")
+	heightFlag = flag.Int("height", 6, "Braille plot height in characters")
+	plotFlag   = flag.String("plot", "braille", "Plot type. Valid values ['braille', 'sparkline']")
+)
+
+func init() {
+	flag.Parse()
+}
+
+func parseIndices(s string, numTraces int) ([]int, error) {
+	var idx []int
+	for _, f := range strings.Split(s, ",") {
+		if len(f) == 0 {
+			continue
+		}
+		i, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trace index %q", f)
+		}
+		if i < 0 || i >= numTraces {
+			return nil, fmt.Errorf("Trace index %d outside [0, %d)", i, numTraces)
+		}
+		idx = append(idx, i)
+	}
+	return idx, nil
+}
+
+func summary(y []float64) string {
+	lo, hi := util.MinMax(y)
+	mean, std := stat.MeanStdDev(y, nil)
+	return fmt.Sprintf("min %+.4f  max %+.4f  mean %+.4f  std %.4f", lo, hi, mean, std)
+}
+
+// Plots all traces on the same scale, so amplitudes can be compared.
+func plot(name string, y []float64, lo, hi float64) {
+	fmt.Printf("%s: %s\n", name, summary(y))
+	switch *plotFlag {
+	case "sparkline":
+		fmt.Println(util.Sparkline(y, *widthFlag, lo, hi))
+	case "braille":
+		for _, line := range util.BraillePlot(y, *widthFlag, *heightFlag, lo, hi) {
+			fmt.Println(line)
+		}
+	default:
+		glog.Fatal("Unknown --plot flag. Valid values ['braille', 'sparkline']")
+	}
+	fmt.Println()
+}
+
+func main() {
+	defer glog.Flush()
+
+	capture, err := gocw.LoadCapture(*inputFlag)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	if len(capture) == 0 {
+		glog.Fatal("Capture has no traces")
+	}
+	idx, err := parseIndices(*tracesFlag, len(capture))
+	if err != nil {
+		glog.Fatal(err)
+	}
+
+	M := capture.SamplesMatrix()
+	numTraces, numSamples := M.Dims()
+	mean := analysis.AverageTrace(M, analysis.EstimatorMean)
+	unlocked := len(capture) - len(capture.ClockLocked())
+	fmt.Printf("%s: %d traces, %d samples per trace, %d tagged clock unlocked\n",
+		*inputFlag, numTraces, numSamples, unlocked)
+
+	traces := make([][]float64, len(idx))
+	lo, hi := util.MinMax(mean)
+	for i, t := range idx {
+		traces[i] = gocw.Float64s(capture[t].PowerMeasurements)
+		tlo, thi := util.MinMax(traces[i])
+		if tlo < lo {
+			lo = tlo
+		}
+		if thi > hi {
+			hi = thi
+		}
+	}
+	fmt.Printf("Scale: [%+.4f, %+.4f]\n\n", lo, hi)
+
+	plot("Mean", mean, lo, hi)
+	for i, t := range idx {
+		plot(fmt.Sprintf("Trace %d", t), traces[i], lo, hi)
+	}
+}
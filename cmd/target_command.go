@@ -0,0 +1,94 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Sends a simple-serial command to the target and prints its responses, e.g.
+// to exercise firmware commands gocw doesn't wrap, such as a mask seed.
+
+// $ go run cmd/target_command.go -command s -payload 0011223344556677 -responses 1
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+
+	"github.com/google/gocw"
+
+	"github.com/golang/glog"
+)
+
+var (
+	protocolFlag = flag.String("target_protocol", gocw.TargetProtocolSimpleSerialAuto,
+		"Target firmware protocol, one of simpleserial, simpleserial2, simpleserial_auto")
+	commandFlag   = flag.String("command", "", "Command letter, e.g. s")
+	payloadFlag   = flag.String("payload", "", "Command payload, in hex")
+	responsesFlag = flag.Int("responses", 1, "Number of responses to read, e.g. the output and the ack")
+	baudFlag      = flag.Uint("baud", uint(gocw.BaudRateLow), "Baud rate of the target serial port")
+)
+
+func init() {
+	flag.Parse()
+}
+
+func main() {
+	defer glog.Flush()
+
+	if len(*commandFlag) != 1 {
+		glog.Fatal("-command must be a single letter")
+	}
+	payload, err := hex.DecodeString(*payloadFlag)
+	if err != nil {
+		glog.Fatalf("Invalid -payload: %v", err)
+	}
+
+	dev, err := gocw.OpenUsbDevice()
+	if err != nil {
+		glog.Fatal(err)
+	}
+	defer dev.Close()
+	fpga, err := gocw.NewFpga(dev)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	// Clocks the target.
+	adc, err := gocw.NewAdc(fpga)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	defer adc.Close()
+	conf := gocw.DefaultUsartConfig().WithBaudRate(gocw.BaudRate(*baudFlag))
+	usart, err := gocw.NewUsart(dev, &conf)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	target, err := gocw.OpenTarget(*protocolFlag, usart)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	ct, ok := target.(gocw.CommandTarget)
+	if !ok {
+		glog.Fatalf("Protocol %s does not support arbitrary commands", *protocolFlag)
+	}
+
+	if err := ct.Command((*commandFlag)[0], payload); err != nil {
+		glog.Fatal(err)
+	}
+	for i := 0; i < *responsesFlag; i++ {
+		cmd, data, err := ct.ReadResponse()
+		if err != nil {
+			glog.Fatal(err)
+		}
+		fmt.Printf("%c %x\n", cmd, data)
+	}
+}
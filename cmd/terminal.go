@@ -0,0 +1,223 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Interactive serial terminal to the target, e.g. to bring up new target
+// firmware. Lines typed on stdin are sent to the target, and what the target
+// prints is written to stdout. Ends on EOF (Ctrl-D) or interrupt.
+
+// $ go run cmd/terminal.go -baud 115200 -timestamps
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/google/gocw"
+
+	"github.com/golang/glog"
+)
+
+var (
+	baudFlag     = flag.Uint("baud", uint(gocw.BaudRateLow), "Baud rate of the target serial port")
+	parityFlag   = flag.String("parity", "none", "Parity, one of none, odd, even, mark, space")
+	stopBitsFlag = flag.Int("stop_bits", 1, "Stop bits, 1 or 2")
+	dataBitsFlag = flag.Int("data_bits", 8, "Data bits, 5 to 9")
+	flowFlag     = flag.Bool("flow_control", false, "Enable RTS/CTS flow control")
+	hexFlag      = flag.Bool("hex", false,
+		"Print the target output in hex, and send the input lines decoded from hex instead of as text")
+	timestampsFlag = flag.Bool("timestamps", false,
+		"Prefix the target output lines (chunks in -hex mode) with the time since the start")
+)
+
+// Read timeout of the USART. Timeouts only mean the target was idle.
+const pollTimeout = 20 * time.Millisecond
+
+func init() {
+	flag.Parse()
+}
+
+func usartConfig() (gocw.UsartConfig, error) {
+	conf := gocw.DefaultUsartConfig().
+		WithBaudRate(gocw.BaudRate(*baudFlag)).
+		WithDataBits(gocw.DataBits(*dataBitsFlag))
+	switch *parityFlag {
+	case "none":
+	case "odd":
+		conf = conf.WithParity(gocw.ParityOdd)
+	case "even":
+		conf = conf.WithParity(gocw.ParityEven)
+	case "mark":
+		conf = conf.WithParity(gocw.ParityMark)
+	case "space":
+		conf = conf.WithParity(gocw.ParitySpace)
+	default:
+		return conf, fmt.Errorf("Unknown -parity %s", *parityFlag)
+	}
+	switch *stopBitsFlag {
+	case 1:
+	case 2:
+		conf = conf.WithStopBits(gocw.StopBitsTwo)
+	default:
+		return conf, fmt.Errorf("Unsupported -stop_bits %d", *stopBitsFlag)
+	}
+	return conf, conf.Validate()
+}
+
+// Writes the target output to w, with timestamps if -timestamps.
+type outputWriter struct {
+	w         io.Writer
+	start     time.Time
+	lineStart bool
+}
+
+func (o *outputWriter) timestamp() {
+	if *timestampsFlag {
+		fmt.Fprintf(o.w, "[%10.6f] ", time.Since(o.start).Seconds())
+	}
+}
+
+func (o *outputWriter) write(data []byte) {
+	if *hexFlag {
+		o.timestamp()
+		fmt.Fprintf(o.w, "% x\n", data)
+		return
+	}
+	for len(data) > 0 {
+		if o.lineStart {
+			o.timestamp()
+		}
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line = data[:i+1]
+		}
+		o.w.Write(line)
+		o.lineStart = line[len(line)-1] == '\n'
+		data = data[len(line):]
+	}
+}
+
+// Returns the bytes to send for an input line.
+func encodeInput(line string) ([]byte, error) {
+	if !*hexFlag {
+		return []byte(line), nil
+	}
+	return hex.DecodeString(strings.Join(strings.Fields(line), ""))
+}
+
+func main() {
+	defer glog.Flush()
+
+	conf, err := usartConfig()
+	if err != nil {
+		glog.Fatal(err)
+	}
+
+	dev, err := gocw.OpenUsbDevice()
+	if err != nil {
+		glog.Fatal(err)
+	}
+	defer dev.Close()
+	fpga, err := gocw.NewFpga(dev)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	// Clocks the target.
+	adc, err := gocw.NewAdc(fpga)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	defer adc.Close()
+	usart, err := gocw.NewUsart(dev, &conf)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	if *flowFlag {
+		if err := usart.SetFlowControl(gocw.FlowControlRtsCts); err != nil {
+			glog.Fatal(err)
+		}
+	}
+	usart.SetTimeout(pollTimeout)
+	glog.Infof("Connected to the target at %v", conf)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	readErr := make(chan error, 1)
+	go func() {
+		out := &outputWriter{w: os.Stdout, start: time.Now(), lineStart: true}
+		buf := make([]byte, 256)
+		for {
+			n, err := usart.ReadContext(ctx, buf)
+			if n > 0 {
+				out.write(buf[:n])
+			}
+			if ctx.Err() != nil {
+				readErr <- nil
+				return
+			}
+			if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		in := bufio.NewReader(os.Stdin)
+		for {
+			line, err := in.ReadString('\n')
+			if len(line) > 0 {
+				lines <- line
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-readErr:
+			glog.Fatal(err)
+		case line, ok := <-lines:
+			if !ok {
+				// Prints the output of the last line before exiting.
+				time.Sleep(2 * pollTimeout)
+				return
+			}
+			data, err := encodeInput(line)
+			if err != nil {
+				glog.Errorf("Invalid hex input: %v", err)
+				continue
+			}
+			if _, err := usart.Write(data); err != nil {
+				glog.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Shares a locally attached ChipWhisperer over TCP.
+// Clients select the tunnel with the GOCW_TRANSPORT environment variable.
+// The server is unauthenticated, and only listens on localhost unless -listen
+// selects other interfaces, e.g. on a trusted lab network:
+//
+// $ go run cmd/usb_server.go -logtostderr -listen 0.0.0.0 -port 7007
+// (remote) $ GOCW_TRANSPORT=tcp:<server>:7007 go run cmd/capture.go -logtostderr
+package main
+
+import (
+	"flag"
+	"net"
+	"strconv"
+
+	"github.com/google/gocw"
+
+	"github.com/golang/glog"
+)
+
+var (
+	listenFlag = flag.String("listen", "localhost",
+		"Address to listen on. Anyone reaching it can use the device: bind other interfaces only on trusted networks")
+	portFlag      = flag.Int("port", 7007, "TCP port to listen on")
+	transportFlag = flag.String("transport", gocw.DefaultTransport, "Local USB transport")
+)
+
+func init() {
+	flag.Parse()
+}
+
+func main() {
+	defer glog.Flush()
+
+	l, err := net.Listen("tcp", net.JoinHostPort(*listenFlag, strconv.Itoa(*portFlag)))
+	if err != nil {
+		glog.Fatal(err)
+	}
+	glog.Infof("Listening on %v", l.Addr())
+
+	// Serve one client at a time, since the device can only be opened once.
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			glog.Fatal(err)
+		}
+		glog.Infof("Client connected from %v", conn.RemoteAddr())
+
+		t, model, err := gocw.OpenUsbTransport(*transportFlag)
+		if err != nil {
+			glog.Errorf("Failed opening device: %v", err)
+			conn.Close()
+			continue
+		}
+		glog.Infof("Serving %v", model)
+		if err = gocw.ServeTransport(conn, t); err != nil {
+			glog.Errorf("Client error: %v", err)
+		}
+		t.Close()
+		conn.Close()
+		glog.Infof("Client disconnected")
+	}
+}
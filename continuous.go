@@ -0,0 +1,198 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Continuous acquisition with trigger-on-analysis, to capture rare events
+// that the hardware trigger alone can't isolate.
+// The ADC records back-to-back windows with forced triggers into a ring
+// buffer, and an analysis callback picks the windows to keep, along with
+// the windows recorded around them. Nothing is recorded while a window is
+// read out, so the windows are not gapless.
+package gocw
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Decides whether a window holds an event to keep. index counts the windows
+// since the start of the acquisition.
+type WindowAnalyzer func(index int, window []Sample) bool
+
+type ContinuousOptions struct {
+	// Samples per window.
+	WindowSamples int
+	// Windows kept around each event: recorded before the selected window,
+	// and after it.
+	PreWindows  int
+	PostWindows int
+	// Stops after this many events, or windows. Zero for no limit.
+	MaxEvents  int
+	MaxWindows int
+	Analyzer   WindowAnalyzer
+	// Called with each event. An error stops the acquisition.
+	OnEvent func(e ContinuousEvent) error
+}
+
+type ContinuousEvent struct {
+	// Index of the window selected by the analyzer.
+	Window int
+	// When the selected window was recorded.
+	Time time.Time
+	// The windows before the selected one, the selected one, and the windows
+	// after it, in order. Fewer than PreWindows before it at the start.
+	Windows [][]Sample
+	// Index of the selected window in Windows.
+	Selected int
+}
+
+// Returns the windows of the event as a single trace, e.g. to save events as
+// a capture.
+func (e ContinuousEvent) Trace() Trace {
+	var t Trace
+	for _, w := range e.Windows {
+		t.PowerMeasurements = append(t.PowerMeasurements, w...)
+	}
+	return t
+}
+
+// Fixed size ring buffer of the last windows.
+type windowRing struct {
+	windows [][]Sample
+	next    int
+	full    bool
+}
+
+func newWindowRing(size int) *windowRing {
+	return &windowRing{windows: make([][]Sample, size)}
+}
+
+func (r *windowRing) push(w []Sample) {
+	if len(r.windows) == 0 {
+		return
+	}
+	r.windows[r.next] = w
+	r.next = (r.next + 1) % len(r.windows)
+	r.full = r.full || r.next == 0
+}
+
+// Returns the buffered windows, oldest first.
+func (r *windowRing) ordered() [][]Sample {
+	if !r.full {
+		return append([][]Sample{}, r.windows[:r.next]...)
+	}
+	return append(append([][]Sample{}, r.windows[r.next:]...), r.windows[:r.next]...)
+}
+
+// Records windows until stop is closed or a limit of opts is reached, and
+// calls opts.OnEvent with the windows opts.Analyzer selects. Windows
+// recorded while collecting the PostWindows of an event are not analyzed.
+func CaptureContinuous(adc AdcInterface, opts ContinuousOptions, stop <-chan struct{}) error {
+	if opts.WindowSamples <= 0 || opts.Analyzer == nil || opts.OnEvent == nil {
+		return fmt.Errorf("Continuous acquisition needs WindowSamples, an Analyzer and OnEvent")
+	}
+	if opts.PreWindows < 0 || opts.PostWindows < 0 {
+		return fmt.Errorf("Invalid pre (%d) or post (%d) windows", opts.PreWindows, opts.PostWindows)
+	}
+	adc.SetTotalSamples(uint32(opts.WindowSamples))
+	if err := adc.Error(); err != nil {
+		return err
+	}
+
+	ring := newWindowRing(opts.PreWindows)
+	var event *ContinuousEvent
+	events := 0
+	for i := 0; opts.MaxWindows == 0 || i < opts.MaxWindows; i++ {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		start := time.Now()
+		w := adc.CaptureOnce(0)
+		if err := adc.Error(); err != nil {
+			return err
+		}
+		if len(w) == 0 {
+			return fmt.Errorf("Window %d has no samples", i)
+		}
+
+		if event == nil && opts.Analyzer(i, w) {
+			event = &ContinuousEvent{Window: i, Time: start, Windows: ring.ordered()}
+			event.Selected = len(event.Windows)
+			event.Windows = append(event.Windows, w)
+		} else if event != nil {
+			event.Windows = append(event.Windows, w)
+		} else {
+			ring.push(w)
+			continue
+		}
+		if len(event.Windows)-event.Selected <= opts.PostWindows {
+			continue
+		}
+		if err := opts.OnEvent(*event); err != nil {
+			return err
+		}
+		event = nil
+		ring = newWindowRing(opts.PreWindows)
+		if events++; opts.MaxEvents > 0 && events >= opts.MaxEvents {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Selects windows with a sample magnitude of at least level.
+func ThresholdAnalyzer(level float64) WindowAnalyzer {
+	return func(_ int, w []Sample) bool {
+		for _, s := range w {
+			if math.Abs(float64(s)) >= level {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Returns the offset in window where template matches best, and the mean
+// absolute difference of the samples there (sum of absolute differences
+// over the template length). Returns -1 if the window is shorter than the
+// template.
+func MinSad(window, template []Sample) (offset int, sad float64) {
+	offset, sad = -1, math.Inf(1)
+	if len(template) == 0 {
+		return
+	}
+	for o := 0; o+len(template) <= len(window); o++ {
+		var sum float64
+		for i, t := range template {
+			if sum += math.Abs(float64(window[o+i] - t)); sum >= sad*float64(len(template)) {
+				break
+			}
+		}
+		if s := sum / float64(len(template)); s < sad {
+			offset, sad = o, s
+		}
+	}
+	return
+}
+
+// Selects windows containing template, with a mean absolute difference (see
+// MinSad) of at most maxSad, like the SAD trigger of the CW-Pro.
+func SadAnalyzer(template []Sample, maxSad float64) WindowAnalyzer {
+	return func(_ int, w []Sample) bool {
+		_, sad := MinSad(w, template)
+		return sad <= maxSad
+	}
+}
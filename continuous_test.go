@@ -0,0 +1,81 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/gocw"
+	"github.com/google/gocw/sim"
+)
+
+func TestCaptureContinuous(t *testing.T) {
+	s := sim.New(sim.DefaultLeakModel())
+	var events []gocw.ContinuousEvent
+	opts := gocw.ContinuousOptions{
+		WindowSamples: 50,
+		PreWindows:    2,
+		PostWindows:   1,
+		MaxWindows:    20,
+		Analyzer: func(i int, w []gocw.Sample) bool {
+			return i == 1 || i == 5 || i == 6
+		},
+		OnEvent: func(e gocw.ContinuousEvent) error {
+			events = append(events, e)
+			return nil
+		},
+	}
+	if err := gocw.CaptureContinuous(s.Adc, opts, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Window 6 is a post window of the event at window 5.
+	if len(events) != 2 {
+		t.Fatalf("Got %d events, want 2", len(events))
+	}
+	for i, want := range []struct{ window, windows, selected int }{{1, 3, 1}, {5, 4, 2}} {
+		e := events[i]
+		if e.Window != want.window || len(e.Windows) != want.windows || e.Selected != want.selected {
+			t.Errorf("Event %d at window %d has %d windows, selected %d, want %d, %d, %d",
+				i, e.Window, len(e.Windows), e.Selected, want.window, want.windows, want.selected)
+		}
+		if n := len(e.Trace().PowerMeasurements); n != 50*len(e.Windows) {
+			t.Errorf("Event %d trace has %d samples, want %d", i, n, 50*len(e.Windows))
+		}
+	}
+
+	opts.MaxEvents = 1
+	opts.OnEvent = func(e gocw.ContinuousEvent) error { return fmt.Errorf("stop") }
+	if err := gocw.CaptureContinuous(s.Adc, opts, nil); err == nil {
+		t.Error("CaptureContinuous ignored the OnEvent error")
+	}
+}
+
+func TestWindowAnalyzers(t *testing.T) {
+	w := []gocw.Sample{0, 0.01, -0.01, 0.2, 0.4, 0.2, 0, 0}
+	if !gocw.ThresholdAnalyzer(0.3)(0, w) || gocw.ThresholdAnalyzer(0.5)(0, w) {
+		t.Error("ThresholdAnalyzer selects the wrong windows")
+	}
+	template := []gocw.Sample{0.2, 0.4, 0.2}
+	if offset, sad := gocw.MinSad(w, template); offset != 3 || sad != 0 {
+		t.Errorf("MinSad returned offset %d, SAD %v, want 3, 0", offset, sad)
+	}
+	if offset, _ := gocw.MinSad(w[:2], template); offset != -1 {
+		t.Errorf("MinSad matched a window shorter than the template at %d", offset)
+	}
+	if !gocw.SadAnalyzer(template, 0.01)(0, w) || gocw.SadAnalyzer(template, 0.01)(0, w[:5]) {
+		t.Error("SadAnalyzer selects the wrong windows")
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Voltage (crowbar) glitches.
+// Two MOSFETs across the target VCC shunt the supply while the glitch module
+// output is high. Enabling a crowbar ties its gate to the glitch output, so
+// the glitch module settings (trigger, offset, width, repeat) shape the
+// voltage glitch as well.
+// Based on chipwhisperer/software/chipwhisperer/capture/scopes/cwhardware/ChipWhispererExtra.py.
+package gocw
+
+import (
+	"fmt"
+
+	"github.com/google/gocw/internal/regmap"
+)
+
+//go:generate stringer -type Crowbar
+type Crowbar int
+
+const (
+	// Strong shunt, for targets with decoupling capacitors.
+	CrowbarHighPower Crowbar = iota
+	// Weaker shunt, for more gentle glitches.
+	CrowbarLowPower Crowbar = iota
+)
+
+var crowbarFields = map[Crowbar]string{
+	CrowbarHighPower: "glitch_hp",
+	CrowbarLowPower:  "glitch_lp",
+}
+
+// Returns the io_route register and the enable field of a crowbar.
+func (c *Adc) crowbarField(m Crowbar) (reg regmap.Register, field regmap.Field) {
+	if c.err != nil {
+		return
+	}
+	if c.err = c.caps.Require(FeatureGlitch); c.err != nil {
+		return
+	}
+	name, ok := crowbarFields[m]
+	if !ok {
+		c.err = fmt.Errorf("Unknown crowbar %v", m)
+		return
+	}
+	if c.regMap == nil {
+		c.err = fmt.Errorf("No register map")
+		return
+	}
+	if reg, c.err = c.regMap.Register("io_route"); c.err != nil {
+		return
+	}
+	field, c.err = reg.Field(name)
+	return
+}
+
+// Returns whether the glitch output drives a crowbar.
+func (c *Adc) Crowbar(m Crowbar) bool {
+	reg, field := c.crowbarField(m)
+	if c.err != nil {
+		return false
+	}
+	buf := make([]byte, reg.Width)
+	if c.err = c.fpga.Mem.Read(Address(reg.Address), buf); c.err != nil {
+		return false
+	}
+	return field.Get(buf) != 0
+}
+
+// Ties a crowbar to the glitch output, or disconnects it.
+func (c *Adc) SetCrowbar(m Crowbar, enabled bool) {
+	reg, field := c.crowbarField(m)
+	if c.err != nil {
+		return
+	}
+	buf := make([]byte, reg.Width)
+	if c.err = c.fpga.Mem.Read(Address(reg.Address), buf); c.err != nil {
+		return
+	}
+	var v uint8
+	if enabled {
+		v = 1
+	}
+	field.Set(buf, v)
+	if SkipWrite("crowbar %v enabled %v", m, enabled) {
+		return
+	}
+	c.err = c.fpga.Mem.Write(Address(reg.Address), buf, true, nil)
+}
+
+// Configures the glitch module for voltage glitches and enables crowbars:
+// the glitch pulse alone drives the crowbars, and the target clock is left
+// untouched (g.Output and g.Hs2 are ignored). Crowbars not listed are
+// disabled.
+func (c *Adc) SetVoltageGlitch(g Glitch, crowbars ...Crowbar) {
+	g.Output = GlitchOutputGlitchOnly
+	g.Hs2 = false
+	c.SetGlitch(g)
+	for _, m := range []Crowbar{CrowbarHighPower, CrowbarLowPower} {
+		enabled := false
+		for _, want := range crowbars {
+			enabled = enabled || want == m
+		}
+		c.SetCrowbar(m, enabled)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The reference AES-128 design as a capture target.
+// Select it with -target_protocol cw305 after programming the board, see
+// cmd/cw305.go. The scope triggers on the design's trigger output, as with
+// simple-serial targets.
+package cw305
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/gocw"
+)
+
+// Target protocol name of AesTarget.
+const Protocol = "cw305"
+
+const (
+	aesBlockSize = 16
+	// Time allowed for an encryption, polled every aesPollInterval.
+	aesTimeout      = 100 * time.Millisecond
+	aesPollInterval = time.Millisecond
+)
+
+// Implements gocw.Target over the board registers.
+type AesTarget struct {
+	board *Board
+}
+
+func init() {
+	gocw.RegisterTargetProtocol(Protocol, func(gocw.UsartInterface) (gocw.Target, error) {
+		board, err := Open()
+		if err != nil {
+			return nil, err
+		}
+		t, err := NewAesTarget(board)
+		if err != nil {
+			board.Close()
+			return nil, err
+		}
+		return t, nil
+	})
+}
+
+// Returns a target over a programmed board. The target owns the board, see
+// Close.
+func NewAesTarget(board *Board) (*AesTarget, error) {
+	programmed, err := board.IsProgrammed()
+	if err != nil {
+		return nil, err
+	}
+	if !programmed {
+		return nil, fmt.Errorf("CW305 FPGA is not programmed, run cmd/cw305.go -bitstream first")
+	}
+	return &AesTarget{board}, nil
+}
+
+func (t *AesTarget) SetKey(key []byte) error {
+	if len(key) != aesBlockSize {
+		return fmt.Errorf("Invalid AES key length %d", len(key))
+	}
+	return t.board.WriteBlock(RegCryptKey, key)
+}
+
+// Loads the plaintext and starts the encryption.
+func (t *AesTarget) Send(input []byte) error {
+	if len(input) != aesBlockSize {
+		return fmt.Errorf("Invalid AES block length %d", len(input))
+	}
+	if err := t.board.WriteBlock(RegCryptTextIn, input); err != nil {
+		return err
+	}
+	return t.board.Write(RegCryptGo, []byte{1})
+}
+
+// Waits for the encryption to finish, and returns the ciphertext.
+func (t *AesTarget) Response() ([]byte, error) {
+	deadline := time.Now().Add(aesTimeout)
+	busy := []byte{0}
+	for {
+		if err := t.board.Read(RegCryptGo, busy); err != nil {
+			return nil, err
+		}
+		if busy[0] == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("Timeout waiting for the CW305 encryption")
+		}
+		time.Sleep(aesPollInterval)
+	}
+	return t.board.ReadBlock(RegCryptCipherOut, aesBlockSize)
+}
+
+func (t *AesTarget) Close() error {
+	return t.board.Close()
+}
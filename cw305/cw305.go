@@ -0,0 +1,151 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// CW305 Artix FPGA target board.
+// The board is a separate NAEUSB device: its microcontroller programs the
+// FPGA, drives the CDCE906 PLL which clocks it, and bridges register
+// accesses to the FPGA design. Registers are those of the NewAE reference
+// AES design (cw305_defines.v).
+// From start to end: program the board with cmd/cw305.go, capture with
+// cmd/capture.go -target_protocol cw305 (see AesTarget), and attack with
+// cmd/attack_aes_last_round_cpa.go. See "Hardware AES on the CW305" in
+// README.md.
+// Based on chipwhisperer/software/chipwhisperer/capture/targets/CW305.py.
+package cw305
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/gocw"
+)
+
+// Register address, shifted left by byteCountBits on the bus.
+type Register uint32
+
+const (
+	RegClkSettings    Register = 0x00
+	RegUserLed        Register = 0x01
+	RegCryptType      Register = 0x02
+	RegCryptRev       Register = 0x03
+	RegIdentify       Register = 0x04
+	RegCryptGo        Register = 0x05
+	RegCryptTextIn    Register = 0x06
+	RegCryptCipherIn  Register = 0x07
+	RegCryptTextOut   Register = 0x08
+	RegCryptCipherOut Register = 0x09
+	RegCryptKey       Register = 0x0a
+	RegBuildTime      Register = 0x0b
+)
+
+// Low address bits select the byte within a register.
+const byteCountBits = 7
+
+type Board struct {
+	dev  *gocw.UsbDevice
+	fpga *gocw.Fpga
+}
+
+// Opens the board using the transport selected by the GOCW_TRANSPORT
+// environment variable (gousb by default).
+func Open() (*Board, error) {
+	spec := os.Getenv(gocw.TransportEnv)
+	if len(spec) == 0 {
+		spec = gocw.DefaultTransport
+	}
+	return OpenTransport(spec)
+}
+
+// Opens the board using the given transport spec, see gocw.OpenTransport.
+func OpenTransport(spec string) (*Board, error) {
+	dev, err := gocw.OpenModelUsbDevice(spec, gocw.DeviceModelCw305)
+	if err != nil {
+		return nil, err
+	}
+	// The board bitstream is the user design, so NewFpga doesn't program it.
+	fpga, err := gocw.NewFpga(dev)
+	if err != nil {
+		dev.Close()
+		return nil, err
+	}
+	return &Board{dev, fpga}, nil
+}
+
+func (b *Board) Close() error {
+	return b.dev.Close()
+}
+
+func (b *Board) IsProgrammed() (bool, error) {
+	return b.fpga.IsProgrammed()
+}
+
+// Programs the FPGA with a bitstream (.bit).
+func (b *Board) Program(bitstream io.Reader) error {
+	return b.fpga.Program(bitstream)
+}
+
+// Programs the FPGA with a bitstream file.
+func (b *Board) ProgramFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return b.Program(f)
+}
+
+func (b *Board) address(reg Register) gocw.Address {
+	return gocw.Address(reg << byteCountBits)
+}
+
+// Reads len(data) bytes of a register, least significant byte first.
+func (b *Board) Read(reg Register, data []byte) error {
+	if _, err := b.fpga.Mem.ReadBytes(b.address(reg), data); err != nil {
+		return fmt.Errorf("Failed reading register %#x: %v", reg, err)
+	}
+	return nil
+}
+
+// Writes data to a register, least significant byte first.
+func (b *Board) Write(reg Register, data []byte) error {
+	if err := b.fpga.Mem.Write(b.address(reg), data, false, nil); err != nil {
+		return fmt.Errorf("Failed writing register %#x: %v", reg, err)
+	}
+	return nil
+}
+
+// Reads a big-endian value, e.g. an AES block, from a register.
+func (b *Board) ReadBlock(reg Register, n int) ([]byte, error) {
+	data := make([]byte, n)
+	if err := b.Read(reg, data); err != nil {
+		return nil, err
+	}
+	return Reverse(data), nil
+}
+
+// Writes a big-endian value, e.g. an AES block, to a register.
+func (b *Board) WriteBlock(reg Register, data []byte) error {
+	return b.Write(reg, Reverse(data))
+}
+
+// Returns a copy of data in reverse byte order. The design registers hold
+// blocks least significant byte first.
+func Reverse(data []byte) []byte {
+	r := make([]byte, len(data))
+	for i, v := range data {
+		r[len(data)-1-i] = v
+	}
+	return r
+}
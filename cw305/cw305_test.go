@@ -0,0 +1,54 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cw305_test
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/google/gocw/cw305"
+)
+
+func TestReverse(t *testing.T) {
+	in := []byte{1, 2, 3, 4}
+	if got := cw305.Reverse(in); !bytes.Equal(got, []byte{4, 3, 2, 1}) {
+		t.Errorf("Reverse(%v) = %v", in, got)
+	}
+	if !bytes.Equal(in, []byte{1, 2, 3, 4}) {
+		t.Errorf("Reverse modified its input: %v", in)
+	}
+}
+
+func TestPllSettingsFor(t *testing.T) {
+	for _, hz := range []float64{7.37e6, 10e6, 20e6, 50e6, 100e6} {
+		s, err := cw305.PllSettingsFor(hz)
+		if err != nil {
+			t.Errorf("PllSettingsFor(%.0f): %v", hz, err)
+			continue
+		}
+		if s.VcoHz() < 80e6 || s.VcoHz() > 300e6 {
+			t.Errorf("PllSettingsFor(%.0f) = %+v, VCO at %.0fHz", hz, s, s.VcoHz())
+		}
+		if e := math.Abs(s.OutputHz()-hz) / hz; e > 1e-4 {
+			t.Errorf("PllSettingsFor(%.0f) = %+v, output %.0fHz", hz, s, s.OutputHz())
+		}
+	}
+	for _, hz := range []float64{0, -1, 400e6} {
+		if s, err := cw305.PllSettingsFor(hz); err == nil {
+			t.Errorf("PllSettingsFor(%.0f) = %+v, want error", hz, s)
+		}
+	}
+}
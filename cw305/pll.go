@@ -0,0 +1,199 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// CDCE906 PLL of the CW305.
+// The board microcontroller bridges the PLL I2C registers. Each of the three
+// PLLs multiplies the 12MHz reference by N/M into a VCO, and output divider P
+// of the same index divides it down. Output 1 clocks the FPGA design.
+// Based on CW305.py:CDCE906.
+package cw305
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/google/gocw"
+)
+
+const (
+	pllRefHz    = 12e6
+	pllVcoMinHz = 80e6
+	pllVcoMaxHz = 300e6
+	pllMaxM     = 511
+	pllMaxN     = 4095
+	pllMaxP     = 127
+	// The I2C bridge acknowledges reads with this status.
+	cdce906ReadOk = 2
+	// Number of PLLs and outputs.
+	pllCount = 3
+)
+
+// Multiplier N, and dividers M and P of a PLL output: ref * N / M / P.
+type PllSettings struct {
+	M, N, P int
+}
+
+func (s PllSettings) VcoHz() float64 {
+	return pllRefHz * float64(s.N) / float64(s.M)
+}
+
+func (s PllSettings) OutputHz() float64 {
+	return s.VcoHz() / float64(s.P)
+}
+
+// Returns the settings closest to an output frequency, keeping the VCO in
+// its operating range.
+func PllSettingsFor(hz float64) (PllSettings, error) {
+	if hz <= 0 || hz > pllVcoMaxHz {
+		return PllSettings{}, fmt.Errorf("PLL output %.0fHz out of range", hz)
+	}
+	best := PllSettings{}
+	bestErr := math.Inf(1)
+	for p := 1; p <= pllMaxP; p++ {
+		vco := hz * float64(p)
+		if vco < pllVcoMinHz || vco > pllVcoMaxHz {
+			continue
+		}
+		for m := 1; m <= pllMaxM; m++ {
+			n := int(math.Round(vco * float64(m) / pllRefHz))
+			if n < 1 || n > pllMaxN {
+				continue
+			}
+			s := PllSettings{m, n, p}
+			if s.VcoHz() < pllVcoMinHz || s.VcoHz() > pllVcoMaxHz {
+				continue
+			}
+			if e := math.Abs(s.OutputHz() - hz); e < bestErr {
+				best, bestErr = s, e
+			}
+		}
+	}
+	if best.M == 0 {
+		return best, fmt.Errorf("No PLL settings for %.0fHz", hz)
+	}
+	return best, nil
+}
+
+func (b *Board) cdce906Write(addr, v uint8) error {
+	if err := b.dev.ControlOut(gocw.ReqCdce906, 0, []byte{1, addr, v}); err != nil {
+		return fmt.Errorf("CDCE906 write of %#x failed: %v", addr, err)
+	}
+	return nil
+}
+
+func (b *Board) cdce906Read(addr uint8) (uint8, error) {
+	if err := b.dev.ControlOut(gocw.ReqCdce906, 0, []byte{0, addr, 0}); err != nil {
+		return 0, fmt.Errorf("CDCE906 read of %#x failed: %v", addr, err)
+	}
+	resp := make([]byte, 2)
+	if err := b.dev.ControlIn(gocw.ReqCdce906, 0, resp); err != nil {
+		return 0, fmt.Errorf("CDCE906 read of %#x failed: %v", addr, err)
+	}
+	if resp[0] != cdce906ReadOk {
+		return 0, fmt.Errorf("CDCE906 read of %#x failed with status %d", addr, resp[0])
+	}
+	return resp[1], nil
+}
+
+func checkPll(pll int) error {
+	if pll < 0 || pll >= pllCount {
+		return fmt.Errorf("Invalid PLL %d", pll)
+	}
+	return nil
+}
+
+// Programs a PLL and its output divider.
+func (b *Board) SetPll(pll int, s PllSettings) error {
+	if err := checkPll(pll); err != nil {
+		return err
+	}
+	if s.M < 1 || s.M > pllMaxM || s.N < 1 || s.N > pllMaxN || s.P < 1 || s.P > pllMaxP {
+		return fmt.Errorf("Invalid PLL settings %+v", s)
+	}
+	base := uint8(1 + 3*pll)
+	if err := b.cdce906Write(base, uint8(s.M)); err != nil {
+		return err
+	}
+	if err := b.cdce906Write(base+1, uint8(s.N)); err != nil {
+		return err
+	}
+	// M[8] and N[11:8], keeping the other bits.
+	high, err := b.cdce906Read(base + 2)
+	if err != nil {
+		return err
+	}
+	high = high&0xe0 | uint8(s.M>>8)&1 | uint8(s.N>>8)<<1&0x1e
+	if err = b.cdce906Write(base+2, high); err != nil {
+		return err
+	}
+	div, err := b.cdce906Read(uint8(13 + pll))
+	if err != nil {
+		return err
+	}
+	return b.cdce906Write(uint8(13+pll), div&0x80|uint8(s.P))
+}
+
+// Returns the settings of a PLL and its output divider.
+func (b *Board) Pll(pll int) (PllSettings, error) {
+	if err := checkPll(pll); err != nil {
+		return PllSettings{}, err
+	}
+	var regs [3]uint8
+	for i := range regs {
+		var err error
+		if regs[i], err = b.cdce906Read(uint8(1 + 3*pll + i)); err != nil {
+			return PllSettings{}, err
+		}
+	}
+	div, err := b.cdce906Read(uint8(13 + pll))
+	if err != nil {
+		return PllSettings{}, err
+	}
+	return PllSettings{
+		M: int(regs[0]) | int(regs[2]&1)<<8,
+		N: int(regs[1]) | int(regs[2]&0x1e)<<7,
+		P: int(div & 0x7f),
+	}, nil
+}
+
+// Sets a PLL output to the frequency closest to hz. Returns the actual
+// frequency.
+func (b *Board) SetPllFrequency(pll int, hz float64) (float64, error) {
+	s, err := PllSettingsFor(hz)
+	if err != nil {
+		return 0, err
+	}
+	if err = b.SetPll(pll, s); err != nil {
+		return 0, err
+	}
+	return s.OutputHz(), nil
+}
+
+// Enables or disables a PLL output.
+func (b *Board) SetPllOutputEnabled(pll int, enabled bool) error {
+	if err := checkPll(pll); err != nil {
+		return err
+	}
+	addr := uint8(19 + pll)
+	v, err := b.cdce906Read(addr)
+	if err != nil {
+		return err
+	}
+	if enabled {
+		v |= 1 << 3
+	} else {
+		v &^= 1 << 3
+	}
+	return b.cdce906Write(addr, v)
+}
@@ -0,0 +1,107 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Decimation fitting whole target operations in the ADC FIFO.
+// Long operations, e.g. ECDH, outlast the FIFO at full rate, and the end of
+// each trace is lost. The length of the operation is measured with the
+// trigger (see Adc.ActiveCount), and the downsample factor chosen to cover
+// all of it, see CaptureOptions.AdaptiveDecimation.
+package gocw
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/golang/glog"
+)
+
+// Number of pilot traces tried before giving up on measuring the operation.
+const pilotRetries = 3
+
+// Returns the smallest downsample factor covering an operation of
+// activeCycles ADC cycles, from offset cycles after the trigger, within
+// maxSamples, and the number of samples covering it at that factor.
+func DecimationFor(activeCycles, offset, maxSamples uint32) (uint16, uint32, error) {
+	if activeCycles <= offset {
+		return 0, 0, fmt.Errorf("Operation of %d cycles ends before the trigger offset (%d)", activeCycles, offset)
+	}
+	if maxSamples == 0 {
+		return 0, 0, fmt.Errorf("No samples available")
+	}
+	cycles := activeCycles - offset
+	factor := (cycles + maxSamples - 1) / maxSamples
+	if factor > math.MaxUint16 {
+		return 0, 0, fmt.Errorf("Operation of %d cycles needs a downsample factor of %d, above %d",
+			activeCycles, factor, math.MaxUint16)
+	}
+	return uint16(factor), (cycles + factor - 1) / factor, nil
+}
+
+// Sets the downsample factor and total samples covering an operation of
+// activeCycles ADC cycles, e.g. the ActiveCount of a pilot trace, from the
+// trigger offset. Pre-trigger samples are disabled by downsampling.
+func (c *Adc) FitOperation(activeCycles uint32) {
+	if c.err != nil {
+		return
+	}
+	offset := c.TriggerOffset()
+	if c.err != nil {
+		return
+	}
+	var factor uint16
+	var samples uint32
+	if factor, samples, c.err = DecimationFor(activeCycles, offset, c.MaxSamples()); c.err != nil {
+		return
+	}
+	if factor > 1 && c.presamples > 0 {
+		glog.Warningf("Downsampling by %d disables the %d pre-trigger samples", factor, c.presamples)
+	}
+	c.SetDownsampleFactor(factor)
+	c.SetTotalSamples(samples)
+}
+
+// Captures a pilot trace with plaintext pt and fits the ADC settings to the
+// length of the target operation, see FitOperation. Returns the active
+// cycles measured. The trace data isn't read.
+func fitPilotTrace(ctx context.Context, adc AdcInterface, target Target, pt []byte) (uint32, error) {
+	fitter, ok := adc.(interface{ FitOperation(activeCycles uint32) })
+	if !ok {
+		return 0, fmt.Errorf("The ADC can't fit its settings to the target operation")
+	}
+	for i := 0; i < pilotRetries; i++ {
+		adc.SetArmOn()
+		if err := target.Send(pt); err != nil {
+			return 0, err
+		}
+		timedOut := adc.WaitForTriggerContext(ctx)
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		if timedOut {
+			glog.Warning("Timed out during pilot trace. Re-trying")
+			continue
+		}
+		if _, err := target.Response(); err != nil {
+			return 0, err
+		}
+		cycles := adc.ActiveCount()
+		if cycles == 0 && adc.Error() == nil {
+			return 0, fmt.Errorf("The trigger was not active during the pilot trace")
+		}
+		fitter.FitOperation(cycles)
+		return cycles, adc.Error()
+	}
+	return 0, fmt.Errorf("Timed out on %d pilot traces", pilotRetries)
+}
@@ -0,0 +1,59 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"testing"
+
+	"github.com/google/gocw"
+)
+
+func TestDecimationFor(t *testing.T) {
+	for _, tc := range []struct {
+		active, offset, max uint32
+		factor              uint16
+		samples             uint32
+	}{
+		// Fits at full rate.
+		{5000, 0, 24000, 1, 5000},
+		{24000, 0, 24000, 1, 24000},
+		{24001, 0, 24000, 2, 12001},
+		// ECDH on the CW-Lite.
+		{3000000, 0, 24528, 123, 24391},
+		// The offset skips the start.
+		{30000, 6000, 24000, 1, 24000},
+	} {
+		factor, samples, err := gocw.DecimationFor(tc.active, tc.offset, tc.max)
+		if err != nil {
+			t.Errorf("DecimationFor(%d, %d, %d) failed: %v", tc.active, tc.offset, tc.max, err)
+			continue
+		}
+		if factor != tc.factor || samples != tc.samples {
+			t.Errorf("DecimationFor(%d, %d, %d) = %d, %d, want %d, %d",
+				tc.active, tc.offset, tc.max, factor, samples, tc.factor, tc.samples)
+		}
+		if uint32(factor)*samples < tc.active-tc.offset || samples > tc.max {
+			t.Errorf("DecimationFor(%d, %d, %d): %d samples by %d don't cover the operation",
+				tc.active, tc.offset, tc.max, samples, factor)
+		}
+	}
+
+	if _, _, err := gocw.DecimationFor(100, 100, 24000); err == nil {
+		t.Error("Operation ending at the trigger offset didn't fail")
+	}
+	if _, _, err := gocw.DecimationFor(1<<31, 0, 10); err == nil {
+		t.Error("Downsample factor above 65535 didn't fail")
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Serial data pattern trigger.
+// The decode IO module decodes the UART traffic on TIO1 or TIO2, and
+// triggers when the last received bytes match a pattern, e.g. the command
+// byte the target waits for. The trigger module selects which module drives
+// the capture trigger.
+// Only 8N1 framing is supported.
+// Based on chipwhisperer/software/chipwhisperer/capture/scopes/cwhardware/ChipWhispererDecodeTrigger.py.
+package gocw
+
+import (
+	"fmt"
+
+	"github.com/google/gocw/internal/regmap"
+)
+
+//go:generate stringer -type TriggerModule
+type TriggerModule int
+
+const (
+	// Edge or level of the TIO trigger pins, see SetTriggerMode.
+	TriggerModuleBasic      TriggerModule = iota
+	TriggerModuleAdvPattern TriggerModule = iota
+	// Sum-of-absolute-differences trigger.
+	TriggerModuleSad TriggerModule = iota
+	// Serial data pattern, see SetDecodeTrigger.
+	TriggerModuleDecodeIo TriggerModule = iota
+)
+
+// Maximal length of a decode trigger pattern.
+const MaxDecodePatternLen = 8
+
+// Decode type values of the decode_cfg register.
+const decodeTypeUsart uint8 = 1
+
+// Serial line values of the decode_cfg register.
+var decodePins = map[TriggerTargetIoPin]uint8{
+	TriggerTargetIoPin1: 1,
+	TriggerTargetIoPin2: 2,
+}
+
+type DecodeTrigger struct {
+	// Serial line to decode, TriggerTargetIoPin1 or TriggerTargetIoPin2.
+	Pin  TriggerTargetIoPin
+	Baud BaudRate
+	// Bytes to match, in order of reception [1, MaxDecodePatternLen].
+	Pattern []byte
+}
+
+// Decode trigger registers, looked up in the register map.
+type decodeRegisters struct {
+	cfg, data regmap.Register
+	// Fields of the decode_cfg register.
+	decodeType, pin, baudLo, baudHi, patternLen regmap.Field
+}
+
+func (c *Adc) decodeRegisters() (r decodeRegisters) {
+	if c.err != nil {
+		return
+	}
+	if c.err = c.caps.Require(FeatureDecodeTrigger); c.err != nil {
+		return
+	}
+	if c.regMap == nil {
+		c.err = fmt.Errorf("No register map")
+		return
+	}
+	if r.cfg, c.err = c.regMap.Register("decode_cfg"); c.err != nil {
+		return
+	}
+	if r.data, c.err = c.regMap.Register("decode_data"); c.err != nil {
+		return
+	}
+	for _, f := range []struct {
+		name  string
+		field *regmap.Field
+	}{
+		{"type", &r.decodeType},
+		{"pin", &r.pin},
+		{"baud_lo", &r.baudLo},
+		{"baud_hi", &r.baudHi},
+		{"pattern_len", &r.patternLen},
+	} {
+		if *f.field, c.err = r.cfg.Field(f.name); c.err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (c *Adc) trigModuleField() (reg regmap.Register, field regmap.Field) {
+	if c.err != nil {
+		return
+	}
+	if c.regMap == nil {
+		c.err = fmt.Errorf("No register map")
+		return
+	}
+	if reg, c.err = c.regMap.Register("trig_module"); c.err != nil {
+		return
+	}
+	field, c.err = reg.Field("module")
+	return
+}
+
+// Returns the module driving the capture trigger.
+func (c *Adc) TriggerModule() TriggerModule {
+	reg, field := c.trigModuleField()
+	if c.err != nil {
+		return TriggerModuleBasic
+	}
+	buf := make([]byte, reg.Width)
+	if c.err = c.fpga.Mem.Read(Address(reg.Address), buf); c.err != nil {
+		return TriggerModuleBasic
+	}
+	return TriggerModule(field.Get(buf))
+}
+
+// Selects the module driving the capture trigger. Modules other than
+// TriggerModuleBasic require the trigger mode to be TriggerModeRisingEdge.
+func (c *Adc) SetTriggerModule(m TriggerModule) {
+	if c.err != nil {
+		return
+	}
+	switch m {
+	case TriggerModuleBasic:
+	case TriggerModuleSad:
+		c.err = c.caps.Require(FeatureSadTrigger)
+	case TriggerModuleDecodeIo:
+		c.err = c.caps.Require(FeatureDecodeTrigger)
+	default:
+		c.err = fmt.Errorf("Unsupported trigger module %v", m)
+	}
+	reg, field := c.trigModuleField()
+	if c.err != nil {
+		return
+	}
+	buf := make([]byte, reg.Width)
+	if c.err = c.fpga.Mem.Read(Address(reg.Address), buf); c.err != nil {
+		return
+	}
+	field.Set(buf, uint8(m))
+	c.err = c.fpga.Mem.Write(Address(reg.Address), buf, true, nil)
+}
+
+// Configures the decode IO module, and routes it to the capture trigger. See
+// DecodeTrigger.
+func (c *Adc) SetDecodeTrigger(t DecodeTrigger) {
+	if c.err != nil {
+		return
+	}
+	if len(t.Pattern) < 1 || len(t.Pattern) > MaxDecodePatternLen {
+		c.err = fmt.Errorf("Decode pattern length %d outside [1, %d]",
+			len(t.Pattern), MaxDecodePatternLen)
+		return
+	}
+	pin, ok := decodePins[t.Pin]
+	if !ok {
+		c.err = fmt.Errorf("Decode trigger pin %v is not a serial line", t.Pin)
+		return
+	}
+	regs := c.decodeRegisters()
+	sysFreq := c.SysFreq()
+	if c.err != nil {
+		return
+	}
+	if t.Baud == 0 {
+		c.err = fmt.Errorf("Invalid baud rate 0")
+		return
+	}
+	// Bit period in system clock cycles.
+	period := sysFreq / uint32(t.Baud)
+	if period < 1 || period > 0xffff {
+		c.err = fmt.Errorf("Baud rate %d out of range for system clock %dHz", t.Baud, sysFreq)
+		return
+	}
+
+	cfg := make([]byte, regs.cfg.Width)
+	if c.err = c.fpga.Mem.Read(Address(regs.cfg.Address), cfg); c.err != nil {
+		return
+	}
+	regs.decodeType.Set(cfg, decodeTypeUsart)
+	regs.pin.Set(cfg, pin)
+	regs.baudLo.Set(cfg, uint8(period))
+	regs.baudHi.Set(cfg, uint8(period>>8))
+	regs.patternLen.Set(cfg, uint8(len(t.Pattern)-1))
+	if c.err = c.fpga.Mem.Write(Address(regs.cfg.Address), cfg, true, nil); c.err != nil {
+		return
+	}
+	// The last received byte is compared with byte 0.
+	data := make([]byte, regs.data.Width)
+	for i, b := range t.Pattern {
+		data[len(t.Pattern)-1-i] = b
+	}
+	if c.err = c.fpga.Mem.Write(Address(regs.data.Address), data, true, nil); c.err != nil {
+		return
+	}
+
+	c.SetTriggerMode(TriggerModeRisingEdge)
+	c.SetTriggerModule(TriggerModuleDecodeIo)
+}
+
+// Returns the decode IO module configuration.
+func (c *Adc) DecodeTrigger() DecodeTrigger {
+	var t DecodeTrigger
+	regs := c.decodeRegisters()
+	sysFreq := c.SysFreq()
+	if c.err != nil {
+		return t
+	}
+	cfg := make([]byte, regs.cfg.Width)
+	if c.err = c.fpga.Mem.Read(Address(regs.cfg.Address), cfg); c.err != nil {
+		return t
+	}
+	data := make([]byte, regs.data.Width)
+	if c.err = c.fpga.Mem.Read(Address(regs.data.Address), data); c.err != nil {
+		return t
+	}
+	pin := regs.pin.Get(cfg)
+	for p, v := range decodePins {
+		if v == pin {
+			t.Pin = p
+		}
+	}
+	if period := uint32(regs.baudLo.Get(cfg)) | uint32(regs.baudHi.Get(cfg))<<8; period > 0 {
+		t.Baud = BaudRate(sysFreq / period)
+	}
+	n := int(regs.patternLen.Get(cfg)) + 1
+	if n > len(data) {
+		n = len(data)
+	}
+	for i := n - 1; i >= 0; i-- {
+		t.Pattern = append(t.Pattern, data[i])
+	}
+	return t
+}
@@ -0,0 +1,130 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Detects repeated inputs and traces in captures.
+// Repeated inputs bias correlation estimates, so they should be dropped
+// before running an attack.
+package gocw
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// Identifies a trace within a list of captures.
+type TraceRef struct {
+	Capture int
+	Index   int
+}
+
+// Groups of traces (two or more each) sharing the same input or data.
+type DuplicateReport struct {
+	// Traces with the same key and plaintext.
+	Plaintexts [][]TraceRef
+	// Traces with the same key, plaintext, ciphertext and power measurements.
+	Traces [][]TraceRef
+}
+
+type traceDigest [sha256.Size]byte
+
+func writeField(h io.Writer, b []byte) {
+	var n [8]byte
+	binary.LittleEndian.PutUint64(n[:], uint64(len(b)))
+	h.Write(n[:])
+	h.Write(b)
+}
+
+// Hashes the key and plaintext of a trace. Returns false for traces without
+// inputs, e.g. idle baselines, which aren't duplicates of each other.
+func inputDigest(t *Trace) (traceDigest, bool) {
+	var d traceDigest
+	if t.Baseline || (len(t.Key) == 0 && len(t.Pt) == 0) {
+		return d, false
+	}
+	h := sha256.New()
+	writeField(h, t.Key)
+	writeField(h, t.Pt)
+	copy(d[:], h.Sum(nil))
+	return d, true
+}
+
+// Hashes all the fields of a trace.
+func fullDigest(t *Trace) (traceDigest, bool) {
+	h := sha256.New()
+	writeField(h, t.Key)
+	writeField(h, t.Pt)
+	writeField(h, t.Ct)
+	buf := make([]byte, 8*len(t.PowerMeasurements))
+	for i, s := range t.PowerMeasurements {
+		binary.LittleEndian.PutUint64(buf[8*i:], math.Float64bits(float64(s)))
+	}
+	writeField(h, buf)
+	var d traceDigest
+	copy(d[:], h.Sum(nil))
+	return d, true
+}
+
+func groupDuplicates(captures []Capture, digest func(*Trace) (traceDigest, bool)) [][]TraceRef {
+	groups := map[traceDigest][]TraceRef{}
+	var order []traceDigest
+	for i, c := range captures {
+		for j := range c {
+			d, ok := digest(&c[j])
+			if !ok {
+				continue
+			}
+			if _, ok := groups[d]; !ok {
+				order = append(order, d)
+			}
+			groups[d] = append(groups[d], TraceRef{i, j})
+		}
+	}
+	var res [][]TraceRef
+	for _, d := range order {
+		if len(groups[d]) > 1 {
+			res = append(res, groups[d])
+		}
+	}
+	return res
+}
+
+// Finds duplicate plaintexts and repeated traces within and across captures.
+func FindDuplicates(captures ...Capture) DuplicateReport {
+	return DuplicateReport{
+		Plaintexts: groupDuplicates(captures, inputDigest),
+		Traces:     groupDuplicates(captures, fullDigest),
+	}
+}
+
+// Concatenates captures.
+// If dedup is set, only the first trace of each key and plaintext is kept.
+// Traces without inputs, e.g. idle baselines, are all kept.
+func MergeCaptures(dedup bool, captures ...Capture) Capture {
+	var res Capture
+	seen := map[traceDigest]bool{}
+	for _, c := range captures {
+		for i := range c {
+			if d, ok := inputDigest(&c[i]); dedup && ok {
+				if seen[d] {
+					continue
+				}
+				seen[d] = true
+			}
+			res = append(res, c[i])
+		}
+	}
+	return res
+}
@@ -0,0 +1,64 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/gocw"
+)
+
+func TestFindDuplicatesAndMerge(t *testing.T) {
+	c1 := gocw.Capture{
+		gocw.Trace{Pt: []byte{1}, PowerMeasurements: []gocw.Sample{1, 2}},
+		gocw.Trace{Pt: []byte{2}, PowerMeasurements: []gocw.Sample{3, 4}},
+	}
+	c2 := gocw.Capture{
+		gocw.Trace{Pt: []byte{1}, PowerMeasurements: []gocw.Sample{5, 6}},
+		gocw.Trace{Pt: []byte{2}, PowerMeasurements: []gocw.Sample{3, 4}},
+	}
+
+	expected := gocw.DuplicateReport{
+		Plaintexts: [][]gocw.TraceRef{{{0, 0}, {1, 0}}, {{0, 1}, {1, 1}}},
+		Traces:     [][]gocw.TraceRef{{{0, 1}, {1, 1}}},
+	}
+	if actual := gocw.FindDuplicates(c1, c2); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Duplicates (%v) did not match expected (%v)", actual, expected)
+	}
+
+	if merged := gocw.MergeCaptures(false, c1, c2); len(merged) != 4 {
+		t.Errorf("Merge without dedup returned %d traces", len(merged))
+	}
+	if merged := gocw.MergeCaptures(true, c1, c2); !reflect.DeepEqual(merged, c1) {
+		t.Errorf("Deduplicated merge (%v) did not match expected (%v)", merged, c1)
+	}
+}
+
+func TestDuplicatesSkipBaselines(t *testing.T) {
+	baseline := gocw.Trace{PowerMeasurements: []gocw.Sample{0, 1}, Baseline: true}
+	c := gocw.Capture{
+		baseline,
+		gocw.Trace{Pt: []byte{1}, PowerMeasurements: []gocw.Sample{1, 2}},
+		gocw.Trace{PowerMeasurements: []gocw.Sample{0, 2}, Baseline: true},
+	}
+	if got := gocw.FindDuplicates(c, c); len(got.Plaintexts) != 1 || len(got.Plaintexts[0]) != 2 {
+		t.Errorf("Duplicate plaintexts %v, want only trace 1", got.Plaintexts)
+	}
+	merged := gocw.MergeCaptures(true, c, gocw.Capture{baseline})
+	if want := append(c, baseline); !reflect.DeepEqual(merged, want) {
+		t.Errorf("Deduplicated merge %v, want %v", merged, want)
+	}
+}
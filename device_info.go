@@ -0,0 +1,123 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Identification of devices: USB descriptor strings, firmware version and
+// build date.
+package gocw
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// Size of the buffer ReqFwBuildDate is read into. The firmware returns a
+// shorter string, e.g. "Mar 16 2020 14:57:32".
+const fwBuildDateSize = 100
+
+// A device, see ListDevices and UsbDevice.Info.
+type DeviceInfo struct {
+	Model  DeviceModel
+	Serial string
+	// USB product string, e.g. "ChipWhisperer Lite".
+	Description string
+	// USB manufacturer string, e.g. "NewAE Technology Inc.".
+	Manufacturer string
+	// Capture firmware version and build date. Only read from open devices,
+	// see UsbDevice.Info.
+	Fw          FwVersion
+	FwBuildDate string
+	// Location on the USB bus. Only known to ListDevices.
+	Bus, Address int
+}
+
+func (i DeviceInfo) String() string {
+	s := fmt.Sprintf("%v %s", i.Model, i.Serial)
+	if len(i.Description) > 0 {
+		s += fmt.Sprintf(" (%s)", i.Description)
+	}
+	if i.Fw != (FwVersion{}) {
+		s += fmt.Sprintf(" firmware %d.%d.%d", i.Fw.Major, i.Fw.Minor, i.Fw.Debug)
+	}
+	if len(i.FwBuildDate) > 0 {
+		s += fmt.Sprintf(" built %s", i.FwBuildDate)
+	}
+	return s
+}
+
+// Implemented by transports that can report the USB product and manufacturer
+// strings.
+type usbStringer interface {
+	Product() (string, error)
+	Manufacturer() (string, error)
+}
+
+// Returns the USB product string of the device.
+func (d *UsbDevice) Product() (string, error) {
+	if t, ok := d.transport().(usbStringer); ok {
+		return t.Product()
+	}
+	return "", fmt.Errorf("Transport does not report product strings")
+}
+
+// Returns the USB manufacturer string of the device.
+func (d *UsbDevice) Manufacturer() (string, error) {
+	if t, ok := d.transport().(usbStringer); ok {
+		return t.Manufacturer()
+	}
+	return "", fmt.Errorf("Transport does not report manufacturer strings")
+}
+
+// Reads the capture firmware build date, e.g. "Mar 16 2020 14:57:32".
+func (d *UsbDevice) ReadFwBuildDate() (string, error) {
+	buf := make([]byte, fwBuildDateSize)
+	// The date is shorter than the buffer, so this isn't a ControlIn.
+	n, err := d.transfer(context.Background(), "control IN", ReqFwBuildDate, true, d.cfg.ControlTimeout, func(ctx context.Context) (int, error) {
+		return d.control(ctx, rTypeControlIn, ReqFwBuildDate, 0, buf)
+	})
+	if err != nil {
+		return "", err
+	}
+	if i := bytes.IndexByte(buf[:n], 0); i >= 0 {
+		n = i
+	}
+	return strings.TrimSpace(string(buf[:n])), nil
+}
+
+// Identifies the device. Fails if the firmware version can't be read. The
+// descriptor strings and build date are left empty if the transport or the
+// firmware don't report them.
+func (d *UsbDevice) Info() (DeviceInfo, error) {
+	info := DeviceInfo{Model: d.model}
+	if err := d.ReadFwVersion(&info.Fw); err != nil {
+		return info, fmt.Errorf("Failed reading FW version: %v", err)
+	}
+	var err error
+	if info.Serial, err = d.SerialNumber(); err != nil {
+		glog.V(1).Infof("Failed reading serial number: %v", err)
+	}
+	if info.Description, err = d.Product(); err != nil {
+		glog.V(1).Infof("Failed reading product: %v", err)
+	}
+	if info.Manufacturer, err = d.Manufacturer(); err != nil {
+		glog.V(1).Infof("Failed reading manufacturer: %v", err)
+	}
+	if info.FwBuildDate, err = d.ReadFwBuildDate(); err != nil {
+		glog.V(1).Infof("Failed reading FW build date: %v", err)
+	}
+	return info, nil
+}
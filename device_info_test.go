@@ -0,0 +1,83 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"testing"
+
+	"github.com/google/gocw"
+)
+
+// Reports descriptor strings, and a build date shorter than the transfer.
+type describedTransport struct {
+	loopbackTransport
+}
+
+func (t *describedTransport) Control(rType, request uint8, val, idx uint16, data []byte) (int, error) {
+	if request == uint8(gocw.ReqFwBuildDate) {
+		return copy(data, "Mar 16 2020 14:57:32\x00"), nil
+	}
+	return t.loopbackTransport.Control(rType, request, val, idx, data)
+}
+
+func (t *describedTransport) SerialNumber() (string, error) { return "5020312032413650", nil }
+func (t *describedTransport) Product() (string, error)      { return "ChipWhisperer Lite", nil }
+func (t *describedTransport) Manufacturer() (string, error) { return "NewAE Technology Inc.", nil }
+
+func TestUsbDeviceInfo(t *testing.T) {
+	gocw.RegisterTransport("test_described", func(address string, vid, pid uint16, inEp, outEp int) (gocw.UsbTransport, error) {
+		return &describedTransport{}, nil
+	})
+	dev, err := gocw.OpenModelUsbDevice("test_described", gocw.DeviceModelCw305)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	info, err := dev.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := gocw.DeviceInfo{
+		Model:        gocw.DeviceModelCw305,
+		Serial:       "5020312032413650",
+		Description:  "ChipWhisperer Lite",
+		Manufacturer: "NewAE Technology Inc.",
+		// The loopback fills control IN transfers with the request number.
+		Fw:          gocw.FwVersion{Major: 0x17, Minor: 0x17, Debug: 0x17},
+		FwBuildDate: "Mar 16 2020 14:57:32",
+	}
+	if info != want {
+		t.Errorf("Info() = %+v, want %+v", info, want)
+	}
+	if s := info.String(); s != "DeviceModelCw305 5020312032413650 (ChipWhisperer Lite) firmware 23.23.23 built Mar 16 2020 14:57:32" {
+		t.Errorf("String() = %q", s)
+	}
+
+	// Transports without descriptor strings still identify the device.
+	gocw.RegisterTransport("test_undescribed", func(address string, vid, pid uint16, inEp, outEp int) (gocw.UsbTransport, error) {
+		return &loopbackTransport{}, nil
+	})
+	dev, err = gocw.OpenModelUsbDevice("test_undescribed", gocw.DeviceModelCw305)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	if info, err = dev.Info(); err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Description) > 0 || len(info.Manufacturer) > 0 || len(info.Serial) > 0 {
+		t.Errorf("Info() = %+v, want no descriptor strings", info)
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Persists tuned ADC settings per device.
+// A profile is saved after gain and clocks were tuned and verified, and is
+// applied by NewAdc on the next run instead of the default setup.
+package gocw
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// Environment variable that overrides the profiles directory.
+const ProfileDirEnv = "GOCW_PROFILE_DIR"
+
+type DeviceProfile struct {
+	Serial         string      `json:"serial"`
+	GainMode       GainMode    `json:"gain_mode"`
+	Gain           uint8       `json:"gain"`
+	AdcClockSource AdcSrcTuple `json:"adc_clock_source"`
+	// CLKGEN settings that were verified to lock the DCMs.
+	ClkGenInput ClkGenInputSrc `json:"clkgen_input"`
+	ClkGenMul   uint32         `json:"clkgen_mul"`
+	ClkGenDiv   uint32         `json:"clkgen_div"`
+}
+
+// Implemented by devices that can report their USB serial number.
+type serialNumberer interface {
+	SerialNumber() (string, error)
+}
+
+// Returns the directory holding device profiles.
+func ProfileDir() (string, error) {
+	if dir := os.Getenv(ProfileDirEnv); len(dir) > 0 {
+		return dir, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("Failed finding config directory: %v", err)
+	}
+	return filepath.Join(dir, "gocw", "profiles"), nil
+}
+
+var unsafeSerialChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+func profilePath(serial string) (string, error) {
+	dir, err := ProfileDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, unsafeSerialChars.ReplaceAllString(serial, "_")+".json"), nil
+}
+
+// Loads the profile of the device with the given serial number.
+// Returns nil if there is no saved profile.
+func LoadDeviceProfile(serial string) (*DeviceProfile, error) {
+	filename, err := profilePath(serial)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error opening profile file: %v", err)
+	}
+	defer f.Close()
+	p := &DeviceProfile{}
+	if err = json.NewDecoder(f).Decode(p); err != nil {
+		return nil, fmt.Errorf("JSON decoder failed %v", err)
+	}
+	return p, nil
+}
+
+// Saves the profile, replacing any previous profile of the device.
+func (p *DeviceProfile) Save() error {
+	filename, err := profilePath(p.Serial)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return fmt.Errorf("Error creating profile directory: %v", err)
+	}
+	buf, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("JSON encoder failed %v", err)
+	}
+	tmp := filename + ".tmp"
+	if err = os.WriteFile(tmp, buf, 0644); err != nil {
+		return fmt.Errorf("Error writing profile file: %v", err)
+	}
+	return os.Rename(tmp, filename)
+}
+
+// Returns the current settings as a profile of the device.
+// Fails if the DCMs are not locked, since the clock settings are then not
+// worth saving.
+func (c *Adc) Profile() (*DeviceProfile, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	if len(c.serial) == 0 {
+		return nil, fmt.Errorf("Device serial number is unknown")
+	}
+	if !c.DcmLocked() || !c.ClkGenDcmLocked() {
+		return nil, fmt.Errorf("DCMs are not locked")
+	}
+	p := &DeviceProfile{
+		Serial:         c.serial,
+		GainMode:       c.GainMode(),
+		Gain:           c.Gain(),
+		AdcClockSource: c.AdcClockSource(),
+		ClkGenInput:    c.ClkGenInputSource(),
+		ClkGenMul:      c.clkGenMul(),
+		ClkGenDiv:      c.clkGenDiv(),
+	}
+	return p, c.err
+}
+
+// Saves the current settings, to be applied by NewAdc on the next run.
+func (c *Adc) SaveProfile() error {
+	p, err := c.Profile()
+	if err != nil {
+		return err
+	}
+	return p.Save()
+}
+
+// Applies a saved profile. Returns false if the DCMs did not lock with the
+// saved clock settings.
+func (c *Adc) applyProfile(p *DeviceProfile) bool {
+	c.SetGainMode(p.GainMode)
+	c.SetGain(p.Gain)
+	c.SetClkGenInputSource(p.ClkGenInput)
+	c.setClkGenMul(p.ClkGenMul)
+	c.setClkGenDiv(p.ClkGenDiv)
+	c.resetClkGen()
+	c.SetAdcClockSource(p.AdcClockSource)
+	return c.err == nil && c.DcmLocked() && c.ClkGenDcmLocked()
+}
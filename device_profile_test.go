@@ -0,0 +1,50 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/gocw"
+)
+
+func TestDeviceProfileSaveLoad(t *testing.T) {
+	t.Setenv(gocw.ProfileDirEnv, t.TempDir())
+
+	if p, err := gocw.LoadDeviceProfile("missing"); p != nil || err != nil {
+		t.Errorf("Expected no profile, got %v, %v", p, err)
+	}
+
+	p := &gocw.DeviceProfile{
+		Serial:         "50203120/3a3c2d",
+		GainMode:       gocw.GainModeHigh,
+		Gain:           45,
+		AdcClockSource: gocw.AdcSrcClkGenX4ViaDcm,
+		ClkGenInput:    gocw.ClkGenInputSystem,
+		ClkGenMul:      21,
+		ClkGenDiv:      26,
+	}
+	if err := p.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	loaded, err := gocw.LoadDeviceProfile(p.Serial)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, p) {
+		t.Errorf("Loaded profile (%v) did not match original (%v)", loaded, p)
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Registry of the supported USB devices.
+// Each DeviceModel has a DeviceSpec: its USB ids and endpoints, supported
+// firmware versions, bitstream and hardware type. Clones with other USB ids,
+// and new boards speaking the NAEUSB protocol, are added with
+// RegisterDeviceModel, e.g. from an init function.
+package gocw
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const (
+	cwliteVid   = 0x2b3e
+	cwlitePid   = 0xace2
+	cwliteInEp  = 1
+	cwliteOutEp = 2
+
+	cwliteMjVersion = 0
+	cwliteMnVersion = 11
+
+	cw1200Pid = 0xace3
+
+	cw1200MjVersion = 1
+	cw1200MnVersion = 11
+
+	cw305Pid = 0xc305
+)
+
+type DeviceSpec struct {
+	// Returned by DeviceModel.String.
+	Name     string
+	Vid, Pid uint16
+	// Bulk endpoints.
+	InEp, OutEp int
+	// Supported firmware versions, inclusive. Only major and minor versions
+	// are compared, and zero versions don't bound the range.
+	MinFw, MaxFw FwVersion
+	// Target boards (e.g. the CW305) are not capture devices, and are never
+	// discovered by OpenUsbDevice.
+	Target bool
+	// Bitstream in the hardware resources, see Fpga. Empty for target
+	// boards, which run user bitstreams.
+	Bitstream string
+	// Hardware type reported by the bitstream, which selects the features of
+	// the device, see Capabilities.
+	HwType HwType
+}
+
+func (s DeviceSpec) supportsFw(ver FwVersion) bool {
+	var zero FwVersion
+	return (s.MinFw == zero || fwAtLeast(ver, s.MinFw)) && (s.MaxFw == zero || fwAtLeast(s.MaxFw, ver))
+}
+
+var (
+	deviceModelsMu sync.Mutex
+	deviceModels   = map[DeviceModel]DeviceSpec{
+		DeviceModelCwLite: {
+			Name: "DeviceModelCwLite",
+			Vid:  cwliteVid, Pid: cwlitePid, InEp: cwliteInEp, OutEp: cwliteOutEp,
+			MinFw:     FwVersion{Major: cwliteMjVersion, Minor: cwliteMnVersion},
+			MaxFw:     FwVersion{Major: cwliteMjVersion, Minor: cwliteMnVersion},
+			Bitstream: "/cwlite_interface.bit",
+			HwType:    HwChipWhispererLite,
+		},
+		DeviceModelCw1200: {
+			Name: "DeviceModelCw1200",
+			Vid:  cwliteVid, Pid: cw1200Pid, InEp: cwliteInEp, OutEp: cwliteOutEp,
+			MinFw:     FwVersion{Major: cw1200MjVersion, Minor: cw1200MnVersion},
+			MaxFw:     FwVersion{Major: cw1200MjVersion, Minor: cw1200MnVersion},
+			Bitstream: "/cw1200_interface.bit",
+			HwType:    HwChipWhispererCw1200,
+		},
+		DeviceModelCw305: {
+			Name: "DeviceModelCw305",
+			Vid:  cwliteVid, Pid: cw305Pid, InEp: cwliteInEp, OutEp: cwliteOutEp,
+			Target: true,
+			HwType: HwUnknown,
+		},
+	}
+	// Models tried by OpenUsbDevice, in order.
+	discoveryOrder = []DeviceModel{DeviceModelCwLite, DeviceModelCw1200}
+	// Next model returned by RegisterDeviceModel. Models aren't reused once
+	// unregistered.
+	nextDeviceModel = DeviceModel(len(deviceModels))
+)
+
+// Adds a device model, and returns it. Capture devices are discovered by
+// OpenUsbDevice after the models registered before them.
+func RegisterDeviceModel(spec DeviceSpec) (DeviceModel, error) {
+	if len(spec.Name) == 0 {
+		return 0, fmt.Errorf("Device model without a name")
+	}
+	if spec.InEp <= 0 || spec.OutEp <= 0 {
+		return 0, fmt.Errorf("Device model %s: invalid endpoints %d, %d", spec.Name, spec.InEp, spec.OutEp)
+	}
+	deviceModelsMu.Lock()
+	defer deviceModelsMu.Unlock()
+	for _, s := range deviceModels {
+		if s.Name == spec.Name {
+			return 0, fmt.Errorf("Device model %s already registered", spec.Name)
+		}
+		if s.Vid == spec.Vid && s.Pid == spec.Pid {
+			return 0, fmt.Errorf("Device model %s: USB ids %04x:%04x already used by %s",
+				spec.Name, spec.Vid, spec.Pid, s.Name)
+		}
+	}
+	model := nextDeviceModel
+	nextDeviceModel++
+	deviceModels[model] = spec
+	if !spec.Target {
+		discoveryOrder = append(discoveryOrder, model)
+	}
+	return model, nil
+}
+
+// Removes a device model added by RegisterDeviceModel, e.g. at the end of a
+// test. Built-in models can't be removed.
+func UnregisterDeviceModel(model DeviceModel) error {
+	if model <= DeviceModelCw305 {
+		return fmt.Errorf("Device model %v is built in", model)
+	}
+	deviceModelsMu.Lock()
+	defer deviceModelsMu.Unlock()
+	if _, ok := deviceModels[model]; !ok {
+		return fmt.Errorf("Device model %d not registered", int(model))
+	}
+	delete(deviceModels, model)
+	for i, m := range discoveryOrder {
+		if m == model {
+			discoveryOrder = append(discoveryOrder[:i:i], discoveryOrder[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// Returns the spec of a device model.
+func LookupDeviceModel(model DeviceModel) (DeviceSpec, bool) {
+	deviceModelsMu.Lock()
+	defer deviceModelsMu.Unlock()
+	spec, ok := deviceModels[model]
+	return spec, ok
+}
+
+// Returns the registered device models, in registration order.
+func DeviceModels() []DeviceModel {
+	deviceModelsMu.Lock()
+	defer deviceModelsMu.Unlock()
+	models := make([]DeviceModel, 0, len(deviceModels))
+	for m := range deviceModels {
+		models = append(models, m)
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i] < models[j] })
+	return models
+}
+
+// Returns the spec of a device model, zero if unknown.
+func deviceSpec(model DeviceModel) DeviceSpec {
+	spec, _ := LookupDeviceModel(model)
+	return spec
+}
+
+// Returns the models tried by OpenUsbDevice, in order.
+func discoveryModels() []DeviceModel {
+	deviceModelsMu.Lock()
+	defer deviceModelsMu.Unlock()
+	return append([]DeviceModel(nil), discoveryOrder...)
+}
+
+func (m DeviceModel) String() string {
+	if spec, ok := LookupDeviceModel(m); ok {
+		return spec.Name
+	}
+	return fmt.Sprintf("DeviceModel(%d)", int(m))
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"testing"
+
+	"github.com/google/gocw"
+)
+
+func TestRegisterDeviceModel(t *testing.T) {
+	var vid, pid uint16
+	var inEp, outEp int
+	gocw.RegisterTransport("test_registry", func(address string, v, p uint16, in, out int) (gocw.UsbTransport, error) {
+		vid, pid, inEp, outEp = v, p, in, out
+		// Reports firmware version 23.23, see loopbackTransport.
+		return &loopbackTransport{}, nil
+	})
+
+	spec := gocw.DeviceSpec{
+		Name: "TestClone",
+		Vid:  0x1234, Pid: 0x5678, InEp: 3, OutEp: 4,
+		MinFw:  gocw.FwVersion{Major: 23, Minor: 20},
+		Target: true,
+	}
+	model := registerDeviceModel(t, spec)
+	if model.String() != "TestClone" {
+		t.Errorf("Model name %q, want TestClone", model)
+	}
+	if got, ok := gocw.LookupDeviceModel(model); !ok || got.Pid != 0x5678 {
+		t.Errorf("Looked up %+v, %v", got, ok)
+	}
+	dev, err := gocw.OpenModelUsbDevice("test_registry", model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev.Close()
+	if vid != 0x1234 || pid != 0x5678 || inEp != 3 || outEp != 4 {
+		t.Errorf("Opened %04x:%04x endpoints %d, %d", vid, pid, inEp, outEp)
+	}
+
+	// Firmware outside the supported range.
+	spec.Name, spec.Pid, spec.MaxFw = "TestOldClone", 0x5679, gocw.FwVersion{Major: 23, Minor: 22}
+	model = registerDeviceModel(t, spec)
+	if _, err = gocw.OpenModelUsbDevice("test_registry", model); err == nil {
+		t.Error("Opened a device with unsupported firmware")
+	}
+
+	// Built-in models stay.
+	if err = gocw.UnregisterDeviceModel(gocw.DeviceModelCwLite); err == nil {
+		t.Error("Unregistered a built-in model")
+	}
+
+	for _, bad := range []gocw.DeviceSpec{
+		{Vid: 0x1234, Pid: 0x1, InEp: 1, OutEp: 2},
+		{Name: "TestNoEndpoints", Vid: 0x1234, Pid: 0x2},
+		{Name: "TestClone", Vid: 0x1234, Pid: 0x3, InEp: 1, OutEp: 2},
+		{Name: "TestSameIds", Vid: 0x2b3e, Pid: 0xace2, InEp: 1, OutEp: 2},
+	} {
+		if _, err = gocw.RegisterDeviceModel(bad); err == nil {
+			t.Errorf("Registered %+v", bad)
+		}
+	}
+}
+
+// Registers a device model for the duration of the test.
+func registerDeviceModel(t *testing.T, spec gocw.DeviceSpec) gocw.DeviceModel {
+	t.Helper()
+	model, err := gocw.RegisterDeviceModel(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := gocw.UnregisterDeviceModel(model); err != nil {
+			t.Error(err)
+		}
+		if _, ok := gocw.LookupDeviceModel(model); ok {
+			t.Errorf("Model %v still registered", model)
+		}
+	})
+	return model
+}
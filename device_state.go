@@ -0,0 +1,51 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Live device state, for monitoring, e.g. the viewer device panel.
+package gocw
+
+import "fmt"
+
+type DeviceState struct {
+	Model  string
+	Config ScopeConfig
+	Clock  ClockStatus
+	// Target clock generated by CLKGEN.
+	ClkGenOutputFreq uint32
+	Diagnostics      AdcDiagnostics
+	// Health problems, e.g. unlocked clocks. Empty if healthy.
+	Problems []string
+}
+
+// Reads the current settings, clocks and health of the device.
+func (c *Adc) DeviceState() DeviceState {
+	s := DeviceState{
+		Model:            fmt.Sprint(modelOf(c.fpga.dev)),
+		Config:           c.scopeConfig(),
+		Clock:            c.ClockStatus(),
+		ClkGenOutputFreq: c.ClkGenOutputFreq(),
+		Diagnostics:      c.Diagnostics(),
+	}
+	if c.err != nil {
+		s.Problems = append(s.Problems, c.err.Error())
+		return s
+	}
+	if err := s.Clock.Check(0); err != nil {
+		s.Problems = append(s.Problems, err.Error())
+	}
+	if s.Config.Hw.HwType != deviceSpec(modelOf(c.fpga.dev)).HwType {
+		s.Problems = append(s.Problems, fmt.Sprintf("Bitstream reports hardware type %v", s.Config.Hw.HwType))
+	}
+	return s
+}
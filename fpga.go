@@ -48,6 +48,8 @@ func (f *Fpga) ctrlProgram(val uint16) error {
 func (f *Fpga) Program(bitstream io.Reader) error {
 	var err error
 	glog.V(1).Info("Programming FPGA")
+	unlock := lockDevice(f.dev)
+	defer unlock()
 	// Erase the FPGA by toggling PROGRAM pin, setup
 	// NAEUSB chip for FPGA programming
 	if err = f.ctrlProgram(0xA0); err != nil {
@@ -89,9 +91,21 @@ func (f *Fpga) Program(bitstream io.Reader) error {
 }
 
 func (f *Fpga) ProgramCwlite() error {
+	return f.ProgramModel(DeviceModelCwLite)
+}
+
+// Programs the bitstream of a device model.
+func (f *Fpga) ProgramModel(model DeviceModel) error {
+	info, ok := LookupDeviceModel(model)
+	if !ok {
+		return fmt.Errorf("Unknown device model %v", model)
+	}
+	if len(info.Bitstream) == 0 {
+		return fmt.Errorf("No bitstream for %v", model)
+	}
 	var err error
 	var bs http.File
-	if bs, err = hardware.FS.Open("/cwlite_interface.bit"); err != nil {
+	if bs, err = hardware.FS.Open(info.Bitstream); err != nil {
 		return fmt.Errorf("Failed opening bitstream file %v", err)
 	}
 	defer bs.Close()
@@ -99,19 +113,41 @@ func (f *Fpga) ProgramCwlite() error {
 }
 
 func NewFpga(dev UsbDeviceInterface) (*Fpga, error) {
-	var err error
-	var programmed bool
 	f := &Fpga{dev, NewMemory(dev)}
+	if _, err := f.programIfNeeded(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
 
-	if programmed, err = f.IsProgrammed(); err != nil {
-		return nil, fmt.Errorf("IsProgrammed failed %v", err)
+// Programs the bitstream of the device model, unless the FPGA is already
+// programmed. Returns true if it was programmed.
+func (f *Fpga) programIfNeeded() (bool, error) {
+	programmed, err := f.IsProgrammed()
+	if err != nil {
+		return false, fmt.Errorf("IsProgrammed failed %v", err)
 	}
 
-	if !programmed {
-		if err = f.ProgramCwlite(); err != nil {
-			return nil, fmt.Errorf("ProgramCwlite failed %v", err)
-		}
+	// Target boards run user bitstreams, see Program.
+	if programmed || len(deviceSpec(modelOf(f.dev)).Bitstream) == 0 {
+		return false, nil
+	}
+	if err = f.ProgramModel(modelOf(f.dev)); err != nil {
+		return false, fmt.Errorf("ProgramModel failed %v", err)
 	}
+	return true, nil
+}
 
+// Returns the FPGA without programming it. Fails if it isn't programmed, see
+// AttachAdc.
+func AttachFpga(dev UsbDeviceInterface) (*Fpga, error) {
+	f := &Fpga{dev, NewMemory(dev)}
+	programmed, err := f.IsProgrammed()
+	if err != nil {
+		return nil, fmt.Errorf("IsProgrammed failed %v", err)
+	}
+	if !programmed {
+		return nil, fmt.Errorf("FPGA is not programmed")
+	}
 	return f, nil
 }
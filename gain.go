@@ -0,0 +1,110 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// AD8331 gain in dB, and auto-ranging.
+// The gain register drives the VGAIN voltage of the amplifier, VGAIN =
+// gain / 256 * 3.3V, and the gain is 50dB/V * VGAIN - 6.5dB in
+// GainModeLow, or + 5.5dB in GainModeHigh: about -6.5dB to 56dB.
+// Based on OpenADCInterface.py:OpenADCInterface_Gain.
+package gocw
+
+import (
+	"fmt"
+	"math"
+)
+
+// Largest value of the gain register.
+const GainMax = 78
+
+const (
+	gainDbOffsetLow  = -6.5
+	gainDbOffsetHigh = 5.5
+	// dB per step of the gain register.
+	gainDbPerStep = 50 * 3.3 / 256
+)
+
+// Range of the gain in dB, over both gain modes.
+const (
+	GainDbMin = gainDbOffsetLow
+	GainDbMax = gainDbOffsetHigh + GainMax*gainDbPerStep
+)
+
+// Returns the amplifier gain in dB for a gain mode and register value.
+func GainDb(mode GainMode, gain uint8) float64 {
+	offset := gainDbOffsetLow
+	if mode == GainModeHigh {
+		offset = gainDbOffsetHigh
+	}
+	return offset + float64(gain)*gainDbPerStep
+}
+
+// Returns the gain mode and register value closest to a gain in dB.
+// GainModeHigh is preferred where both modes reach it, as it has less noise.
+func GainSetting(db float64) (GainMode, uint8, error) {
+	if db < GainDbMin || db > GainDbMax {
+		return GainModeLow, 0, fmt.Errorf("Gain %.1fdB outside [%.1f, %.1f]dB", db, GainDbMin, GainDbMax)
+	}
+	mode, offset := GainModeHigh, gainDbOffsetHigh
+	if db < gainDbOffsetHigh {
+		mode, offset = GainModeLow, gainDbOffsetLow
+	}
+	gain := math.Round((db - offset) / gainDbPerStep)
+	if gain > GainMax {
+		gain = GainMax
+	}
+	return mode, uint8(gain), nil
+}
+
+// Returns the amplifier gain in dB.
+func (c *Adc) GainDb() float64 {
+	mode := c.GainMode()
+	gain := c.Gain()
+	return GainDb(mode, gain)
+}
+
+// Sets the gain mode and gain closest to a gain in dB.
+func (c *Adc) SetGainDb(db float64) {
+	if c.err != nil {
+		return
+	}
+	var mode GainMode
+	var gain uint8
+	if mode, gain, c.err = GainSetting(db); c.err != nil {
+		return
+	}
+	c.SetGainMode(mode)
+	c.SetGain(gain)
+}
+
+// Returns the largest sample magnitude, as a fraction of the ADC range
+// around zero: 1 at SampleMin.
+func PeakAmplitude(samples []Sample) float64 {
+	var peak float64
+	for _, s := range samples {
+		if a := math.Abs(float64(s)); a > peak {
+			peak = a
+		}
+	}
+	return peak / float64(-SampleMin)
+}
+
+// Returns the gain in dB bringing a peak amplitude (see PeakAmplitude)
+// measured at gain db to the target amplitude, within the gain range.
+func AutoRangeDb(db, peak, target float64) float64 {
+	if peak <= 0 {
+		return GainDbMax
+	}
+	db += 20 * math.Log10(target/peak)
+	return math.Max(GainDbMin, math.Min(GainDbMax, db))
+}
@@ -0,0 +1,82 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/google/gocw"
+)
+
+// AD8331 datasheet: 50dB/V gain slope. The CW-Lite drives VGAIN from a
+// 3.3V 8-bit DAC.
+const (
+	dbPerVolt = 50.0
+	vGainStep = 3.3 / 256
+)
+
+func TestGainDb(t *testing.T) {
+	for _, tc := range []struct {
+		mode gocw.GainMode
+		gain uint8
+		db   float64
+	}{
+		{gocw.GainModeLow, 0, -6.5},
+		{gocw.GainModeHigh, 0, 5.5},
+		{gocw.GainModeHigh, 45, 5.5 + 45*vGainStep*dbPerVolt},
+	} {
+		if db := gocw.GainDb(tc.mode, tc.gain); math.Abs(db-tc.db) > 1e-9 {
+			t.Errorf("GainDb(%v, %d) = %v, want %v", tc.mode, tc.gain, db, tc.db)
+		}
+		// Round trip.
+		mode, gain, err := gocw.GainSetting(tc.db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if db := gocw.GainDb(mode, gain); math.Abs(db-tc.db) > 1e-9 {
+			t.Errorf("GainSetting(%v) = %v, %d (%vdB)", tc.db, mode, gain, db)
+		}
+	}
+	// The CW-Lite gain range is about 56dB.
+	if math.Abs(gocw.GainDbMax-(5.5+gocw.GainMax*vGainStep*dbPerVolt)) > 1e-9 || gocw.GainDbMax < 55 || gocw.GainDbMax > 57 {
+		t.Errorf("GainDbMax = %v, want about 56dB", gocw.GainDbMax)
+	}
+	// Below the high gain mode range.
+	if mode, _, err := gocw.GainSetting(0); err != nil || mode != gocw.GainModeLow {
+		t.Errorf("GainSetting(0) = %v, %v, want GainModeLow", mode, err)
+	}
+	for _, db := range []float64{gocw.GainDbMin - 1, gocw.GainDbMax + 1} {
+		if _, _, err := gocw.GainSetting(db); err == nil {
+			t.Errorf("GainSetting(%v) succeeded", db)
+		}
+	}
+}
+
+func TestAutoRangeDb(t *testing.T) {
+	if p := gocw.PeakAmplitude([]gocw.Sample{0.1, -0.25, 0.2}); p != 0.5 {
+		t.Errorf("PeakAmplitude = %v, want 0.5", p)
+	}
+	// Half the target amplitude needs 6dB more.
+	if db := gocw.AutoRangeDb(10, 0.35, 0.7); math.Abs(db-16.02) > 0.01 {
+		t.Errorf("AutoRangeDb(10, 0.35, 0.7) = %v, want 16.02", db)
+	}
+	if db := gocw.AutoRangeDb(10, 0, 0.7); db != gocw.GainDbMax {
+		t.Errorf("AutoRangeDb without signal = %v, want %v", db, gocw.GainDbMax)
+	}
+	if db := gocw.AutoRangeDb(0, 1, 0.01); db != gocw.GainDbMin {
+		t.Errorf("AutoRangeDb = %v, want %v", db, gocw.GainDbMin)
+	}
+}
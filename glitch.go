@@ -0,0 +1,268 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Clock glitch module.
+// The glitch module derives a glitch from a clock through two phase shifted
+// DCMs (width and offset), and combines it with the clock on the glitch
+// output. Campaigns sweep the settings between traces, e.g. from a
+// CaptureOptions.BeforeTrace hook.
+// Only the fine phase adjustments of the DCMs are supported. The coarse
+// width and offset settings require partial reconfiguration data for the
+// bitstream, which is not part of gocw. Voltage glitches through the crowbar
+// outputs are in crowbar.go.
+// Based on chipwhisperer/software/chipwhisperer/capture/scopes/cwhardware/ChipWhispererGlitch.py.
+package gocw
+
+import (
+	"fmt"
+
+	"github.com/google/gocw/internal/regmap"
+)
+
+//go:generate stringer -type GlitchTrigger
+type GlitchTrigger int
+
+const (
+	// Glitches on ManualGlitch only.
+	GlitchTriggerManual GlitchTrigger = iota
+	// Glitches on every trigger.
+	GlitchTriggerExtContinuous GlitchTrigger = iota
+	// Glitches continuously.
+	GlitchTriggerContinuous GlitchTrigger = iota
+	// Glitches on the first trigger after arming.
+	GlitchTriggerExtSingleShot GlitchTrigger = iota
+)
+
+//go:generate stringer -type GlitchOutput
+type GlitchOutput int
+
+const (
+	GlitchOutputClockXor   GlitchOutput = iota
+	GlitchOutputClockOr    GlitchOutput = iota
+	GlitchOutputGlitchOnly GlitchOutput = iota
+	GlitchOutputClockOnly  GlitchOutput = iota
+	// Output is high while the glitch is enabled, see TriggerPulse.
+	GlitchOutputEnableOnly GlitchOutput = iota
+)
+
+//go:generate stringer -type GlitchClockSource
+type GlitchClockSource int
+
+const (
+	GlitchClockTarget GlitchClockSource = iota
+	GlitchClockClkGen GlitchClockSource = iota
+)
+
+// Range of the fine phase adjustments.
+const (
+	GlitchFineMin = -255
+	GlitchFineMax = 255
+)
+
+type Glitch struct {
+	ClockSource GlitchClockSource
+	Output      GlitchOutput
+	Trigger     GlitchTrigger
+	// Delay from the trigger to the glitch, in clock cycles.
+	ExtOffset uint32
+	// Number of consecutive glitched cycles [1, 256].
+	Repeat int
+	// Fine phase adjustments of the width and offset DCMs
+	// [GlitchFineMin, GlitchFineMax].
+	WidthFine  int
+	OffsetFine int
+	// Routes the glitch output to HS2, which clocks the target.
+	Hs2 bool
+}
+
+// Glitch module registers, looked up in the register map.
+type glitchRegisters struct {
+	glitch, extOffset regmap.Register
+	// Fields of the glitch register.
+	trigSrc, outType, repeat, clkSrc, manual regmap.Field
+	// 9 bit two's complement fine adjustments, and the strobe applying them.
+	widthFineLo, widthFineHi, widthFineLoad    regmap.Field
+	offsetFineLo, offsetFineHi, offsetFineLoad regmap.Field
+}
+
+func (c *Adc) glitchRegisters() (r glitchRegisters) {
+	if c.err != nil {
+		return
+	}
+	if c.regMap == nil {
+		c.err = fmt.Errorf("No register map")
+		return
+	}
+	if r.glitch, c.err = c.regMap.Register("glitch"); c.err != nil {
+		return
+	}
+	if r.extOffset, c.err = c.regMap.Register("glitch_ext_offset"); c.err != nil {
+		return
+	}
+	for _, f := range []struct {
+		name  string
+		field *regmap.Field
+	}{
+		{"trig_src", &r.trigSrc},
+		{"out_type", &r.outType},
+		{"repeat", &r.repeat},
+		{"clk_src", &r.clkSrc},
+		{"manual", &r.manual},
+		{"width_fine_lo", &r.widthFineLo},
+		{"width_fine_hi", &r.widthFineHi},
+		{"width_fine_load", &r.widthFineLoad},
+		{"offset_fine_lo", &r.offsetFineLo},
+		{"offset_fine_hi", &r.offsetFineHi},
+		{"offset_fine_load", &r.offsetFineLoad},
+	} {
+		if *f.field, c.err = r.glitch.Field(f.name); c.err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (c *Adc) glitchSettings(r glitchRegisters) []byte {
+	if c.err != nil {
+		return nil
+	}
+	buf := make([]byte, r.glitch.Width)
+	c.err = c.fpga.Mem.Read(Address(r.glitch.Address), buf)
+	return buf
+}
+
+func (c *Adc) writeGlitchSettings(r glitchRegisters, settings []byte) {
+	if c.err != nil || SkipWrite("glitch settings %x", settings) {
+		return
+	}
+	c.err = c.fpga.Mem.Write(Address(r.glitch.Address), settings, false, nil)
+}
+
+func setFine(settings []byte, lo, hi regmap.Field, v int) {
+	lo.Set(settings, uint8(v))
+	hi.Set(settings, uint8(v>>8))
+}
+
+func getFine(settings []byte, lo, hi regmap.Field) int {
+	v := int(lo.Get(settings)) | int(hi.Get(settings))<<8
+	if v&0x100 != 0 {
+		v -= 0x200
+	}
+	return v
+}
+
+// Configures the glitch module, see Glitch.
+func (c *Adc) SetGlitch(g Glitch) {
+	if c.err != nil {
+		return
+	}
+	if c.err = c.caps.Require(FeatureGlitch); c.err != nil {
+		return
+	}
+	if g.Repeat < 1 || g.Repeat > 256 {
+		c.err = fmt.Errorf("Glitch repeat %d outside [1, 256]", g.Repeat)
+		return
+	}
+	for _, fine := range []int{g.WidthFine, g.OffsetFine} {
+		if fine < GlitchFineMin || fine > GlitchFineMax {
+			c.err = fmt.Errorf("Glitch fine adjustment %d outside [%d, %d]",
+				fine, GlitchFineMin, GlitchFineMax)
+			return
+		}
+	}
+
+	regs := c.glitchRegisters()
+	if c.err != nil {
+		return
+	}
+	offset := g.ExtOffset
+	if !SkipWrite("glitch offset %d", offset) {
+		if c.err = c.fpga.Mem.Write(Address(regs.extOffset.Address), &offset, true, nil); c.err != nil {
+			return
+		}
+	}
+
+	settings := c.glitchSettings(regs)
+	if c.err != nil {
+		return
+	}
+	regs.clkSrc.Set(settings, uint8(g.ClockSource))
+	regs.outType.Set(settings, uint8(g.Output))
+	regs.trigSrc.Set(settings, uint8(g.Trigger))
+	regs.repeat.Set(settings, uint8(g.Repeat-1))
+	setFine(settings, regs.widthFineLo, regs.widthFineHi, g.WidthFine)
+	setFine(settings, regs.offsetFineLo, regs.offsetFineHi, g.OffsetFine)
+	// Strobe the DCM phase shift loads.
+	regs.widthFineLoad.Set(settings, 1)
+	regs.offsetFineLoad.Set(settings, 1)
+	c.writeGlitchSettings(regs, settings)
+	regs.widthFineLoad.Set(settings, 0)
+	regs.offsetFineLoad.Set(settings, 0)
+	c.writeGlitchSettings(regs, settings)
+
+	if g.Hs2 {
+		c.SetHs2(Hs2ModeGlitch)
+	}
+}
+
+// Returns the glitch module configuration.
+func (c *Adc) Glitch() Glitch {
+	var g Glitch
+	regs := c.glitchRegisters()
+	settings := c.glitchSettings(regs)
+	if c.err != nil {
+		return g
+	}
+	if c.err = c.fpga.Mem.Read(Address(regs.extOffset.Address), &g.ExtOffset); c.err != nil {
+		return g
+	}
+	g.ClockSource = GlitchClockSource(regs.clkSrc.Get(settings))
+	g.Output = GlitchOutput(regs.outType.Get(settings))
+	g.Trigger = GlitchTrigger(regs.trigSrc.Get(settings))
+	g.Repeat = int(regs.repeat.Get(settings)) + 1
+	g.WidthFine = getFine(settings, regs.widthFineLo, regs.widthFineHi)
+	g.OffsetFine = getFine(settings, regs.offsetFineLo, regs.offsetFineHi)
+	g.Hs2 = c.Hs2() == Hs2ModeGlitch
+	return g
+}
+
+// Fires a glitch now. Requires GlitchTriggerManual.
+func (c *Adc) ManualGlitch() {
+	regs := c.glitchRegisters()
+	settings := c.glitchSettings(regs)
+	if c.err != nil {
+		return
+	}
+	regs.manual.Set(settings, 1)
+	c.writeGlitchSettings(regs, settings)
+	regs.manual.Set(settings, 0)
+	c.writeGlitchSettings(regs, settings)
+}
+
+// Stops glitching, disconnects the crowbars, and restores the CLKGEN output on
+// HS2 if it was routed to the glitch output.
+func (c *Adc) DisableGlitch() {
+	regs := c.glitchRegisters()
+	settings := c.glitchSettings(regs)
+	if c.err != nil {
+		return
+	}
+	regs.trigSrc.Set(settings, uint8(GlitchTriggerManual))
+	c.writeGlitchSettings(regs, settings)
+	c.SetCrowbar(CrowbarHighPower, false)
+	c.SetCrowbar(CrowbarLowPower, false)
+	if c.Hs2() == Hs2ModeGlitch {
+		c.SetHs2(Hs2ModeClkGen)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Safety interlock for operations that can brick or damage a target.
+// In dry-run mode the programmers, the glitch module and the target GPIOs log
+// the hardware writes they would make instead of making them, e.g. to check
+// a glitch campaign or a firmware image before running it on a device.
+// Destructive operations additionally need an explicit Confirm: erasing a
+// whole XMEGA (bootloader and EEPROM included), writing STM32 option
+// bytes, which can permanently lock the chip, and writing XMEGA fuses and
+// lock bits, which can leave the chip unable to run or program.
+package gocw
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// Environment variable enabling dry-run mode when set to 1.
+const DryRunEnv = "GOCW_DRY_RUN"
+
+//go:generate stringer -type DestructiveOp
+type DestructiveOp int
+
+const (
+	OpChipErase   DestructiveOp = iota
+	OpOptionBytes DestructiveOp = iota
+	OpFuses       DestructiveOp = iota
+)
+
+var (
+	interlockMu sync.Mutex
+	dryRun      = os.Getenv(DryRunEnv) == "1"
+	confirmed   = make(map[DestructiveOp]bool)
+)
+
+// Enables or disables dry-run mode, overriding GOCW_DRY_RUN.
+func SetDryRun(enabled bool) {
+	interlockMu.Lock()
+	defer interlockMu.Unlock()
+	dryRun = enabled
+}
+
+func DryRun() bool {
+	interlockMu.Lock()
+	defer interlockMu.Unlock()
+	return dryRun
+}
+
+// Logs a hardware write in dry-run mode, and returns true if the caller must
+// skip it.
+func SkipWrite(format string, args ...interface{}) bool {
+	if !DryRun() {
+		return false
+	}
+	glog.Infof("Dry run, skipping: "+format, args...)
+	return true
+}
+
+// Allows destructive operations for the rest of the process.
+func Confirm(ops ...DestructiveOp) {
+	interlockMu.Lock()
+	defer interlockMu.Unlock()
+	for _, op := range ops {
+		confirmed[op] = true
+	}
+}
+
+// Withdraws a confirmation.
+func Unconfirm(op DestructiveOp) {
+	interlockMu.Lock()
+	defer interlockMu.Unlock()
+	delete(confirmed, op)
+}
+
+// Returns an error unless the operation was confirmed.
+func RequireConfirmed(op DestructiveOp) error {
+	interlockMu.Lock()
+	defer interlockMu.Unlock()
+	if !confirmed[op] {
+		return fmt.Errorf("%v requires confirmation, see gocw.Confirm", op)
+	}
+	return nil
+}
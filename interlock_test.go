@@ -0,0 +1,47 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"testing"
+
+	"github.com/google/gocw"
+)
+
+func TestRequireConfirmed(t *testing.T) {
+	defer gocw.Unconfirm(gocw.OpChipErase)
+	if err := gocw.RequireConfirmed(gocw.OpChipErase); err == nil {
+		t.Fatal("Unconfirmed chip erase allowed")
+	}
+	gocw.Confirm(gocw.OpChipErase)
+	if err := gocw.RequireConfirmed(gocw.OpChipErase); err != nil {
+		t.Fatal(err)
+	}
+	if err := gocw.RequireConfirmed(gocw.OpOptionBytes); err == nil {
+		t.Fatal("Confirming chip erase allowed option-byte writes")
+	}
+}
+
+func TestSkipWrite(t *testing.T) {
+	defer gocw.SetDryRun(gocw.DryRun())
+	gocw.SetDryRun(false)
+	if gocw.SkipWrite("test") {
+		t.Error("SkipWrite skipped outside dry-run mode")
+	}
+	gocw.SetDryRun(true)
+	if !gocw.SkipWrite("test %d", 1) {
+		t.Error("SkipWrite didn't skip in dry-run mode")
+	}
+}
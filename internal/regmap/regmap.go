@@ -0,0 +1,182 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// FPGA register maps.
+// Each map in maps/ describes the registers of a family of bitstreams:
+// address, width in bytes and named bit fields. The map is selected by the
+// hardware type and register version reported by the FPGA, so supporting a
+// new bitstream revision means adding a map file.
+// Register-level plumbing of gocw. It changes with the bitstreams, and isn't
+// part of the stable API.
+package regmap
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/golang/glog"
+)
+
+//go:embed maps/*.json
+var mapFiles embed.FS
+
+// Map used when no map matches the hardware.
+const defaultMap = "openadc"
+
+type Field struct {
+	Name string `json:"name"`
+	// Byte of the register holding the field.
+	Byte  int  `json:"byte"`
+	Shift uint `json:"shift"`
+	Bits  uint `json:"bits"`
+}
+
+// Returns the field mask, within its byte.
+func (f Field) Mask() uint8 {
+	return uint8((1<<f.Bits - 1) << f.Shift)
+}
+
+// Extracts the field value from the register contents.
+func (f Field) Get(buf []byte) uint8 {
+	return (buf[f.Byte] & f.Mask()) >> f.Shift
+}
+
+// Sets the field value in the register contents.
+func (f Field) Set(buf []byte, v uint8) {
+	buf[f.Byte] = buf[f.Byte]&^f.Mask() | (v<<f.Shift)&f.Mask()
+}
+
+type Register struct {
+	Name    string `json:"name"`
+	Address uint32 `json:"address"`
+	// Width in bytes. Zero for streamed registers.
+	Width  int     `json:"width"`
+	Fields []Field `json:"fields"`
+}
+
+// Returns the named field.
+func (r Register) Field(name string) (Field, error) {
+	for _, f := range r.Fields {
+		if f.Name == name {
+			return f, nil
+		}
+	}
+	return Field{}, fmt.Errorf("Register %s has no field %s", r.Name, name)
+}
+
+type Map struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Hardware types (gocw.HwType) the map applies to.
+	HwTypes []int `json:"hw_types"`
+	// Lowest register version (see gocw.HwVersion) the map applies to.
+	MinRegVersion uint8      `json:"min_reg_version"`
+	Registers     []Register `json:"registers"`
+
+	byName map[string]Register
+}
+
+// Parses a JSON register map.
+func Parse(r io.Reader) (*Map, error) {
+	m := &Map{}
+	if err := json.NewDecoder(r).Decode(m); err != nil {
+		return nil, fmt.Errorf("JSON decoder failed %v", err)
+	}
+	m.byName = make(map[string]Register)
+	for _, reg := range m.Registers {
+		if _, ok := m.byName[reg.Name]; ok {
+			return nil, fmt.Errorf("Register %s defined twice in map %s", reg.Name, m.Name)
+		}
+		for _, f := range reg.Fields {
+			if f.Bits == 0 || f.Shift+f.Bits > 8 || f.Byte < 0 || (reg.Width > 0 && f.Byte >= reg.Width) {
+				return nil, fmt.Errorf("Invalid field %s.%s in map %s", reg.Name, f.Name, m.Name)
+			}
+		}
+		m.byName[reg.Name] = reg
+	}
+	return m, nil
+}
+
+func (m *Map) matches(hwType int, regVersion uint8) bool {
+	if regVersion < m.MinRegVersion {
+		return false
+	}
+	for _, t := range m.HwTypes {
+		if t == hwType {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the named register.
+func (m *Map) Register(name string) (Register, error) {
+	reg, ok := m.byName[name]
+	if !ok {
+		return Register{}, fmt.Errorf("Register %s not in map %s", name, m.Name)
+	}
+	return reg, nil
+}
+
+// Returns all embedded register maps.
+func All() ([]*Map, error) {
+	entries, err := mapFiles.ReadDir("maps")
+	if err != nil {
+		return nil, err
+	}
+	var maps []*Map
+	for _, e := range entries {
+		f, err := mapFiles.Open(path.Join("maps", e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		m, err := Parse(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", e.Name(), err)
+		}
+		maps = append(maps, m)
+	}
+	return maps, nil
+}
+
+// Returns the register map of the given hardware type and register version.
+// Among matching maps, the one with the highest MinRegVersion wins.
+func Load(hwType int, regVersion uint8) (*Map, error) {
+	maps, err := All()
+	if err != nil {
+		return nil, err
+	}
+	var best, fallback *Map
+	for _, m := range maps {
+		if m.Name == defaultMap {
+			fallback = m
+		}
+		if m.matches(hwType, regVersion) && (best == nil || m.MinRegVersion > best.MinRegVersion) {
+			best = m
+		}
+	}
+	if best != nil {
+		return best, nil
+	}
+	if fallback == nil {
+		return nil, fmt.Errorf("No register map for hardware type %d, register version %d", hwType, regVersion)
+	}
+	glog.Warningf("No register map for hardware type %d, register version %d. Using %s",
+		hwType, regVersion, fallback.Name)
+	return fallback, nil
+}
@@ -0,0 +1,164 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package regmap_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/gocw"
+	"github.com/google/gocw/internal/regmap"
+)
+
+func TestAllParse(t *testing.T) {
+	maps, err := regmap.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(maps) == 0 {
+		t.Error("No embedded register maps")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	for _, hw := range []gocw.HwVersion{
+		{RegVersion: 0, HwType: gocw.HwChipWhispererLite},
+		{RegVersion: 0, HwType: gocw.HwUnknown},
+	} {
+		m, err := regmap.Load(int(hw.HwType), hw.RegVersion)
+		if err != nil {
+			t.Fatalf("Load(%+v) failed: %v", hw, err)
+		}
+		reg, err := m.Register("samples")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reg.Address != 16 || reg.Width != 4 {
+			t.Errorf("samples register = %+v", reg)
+		}
+	}
+}
+
+func TestRegisterField(t *testing.T) {
+	f := regmap.Field{Name: "out_type", Byte: 1, Shift: 4, Bits: 3}
+	buf := []byte{0xff, 0x8f}
+	f.Set(buf, 5)
+	if buf[0] != 0xff || buf[1] != 0xdf {
+		t.Errorf("Set(5) = %x", buf)
+	}
+	if v := f.Get(buf); v != 5 {
+		t.Errorf("Get() = %d, want 5", v)
+	}
+	// Out of range values are truncated to the field.
+	f.Set(buf, 0xf)
+	if buf[1] != 0xff {
+		t.Errorf("Set(0xf) = %x", buf)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, src := range []string{
+		`{"name": "dup", "registers": [{"name": "a", "address": 0}, {"name": "a", "address": 1}]}`,
+		`{"name": "wide", "registers": [{"name": "a", "width": 1, "fields": [{"name": "f", "shift": 6, "bits": 3}]}]}`,
+		`{"name": "outside", "registers": [{"name": "a", "width": 1, "fields": [{"name": "f", "byte": 1, "bits": 1}]}]}`,
+	} {
+		if _, err := regmap.Parse(strings.NewReader(src)); err == nil {
+			t.Errorf("Parse(%s) succeeded", src)
+		}
+	}
+}
+
+func TestGlitchRegisterFields(t *testing.T) {
+	m, err := regmap.Load(int(gocw.HwChipWhispererLite), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg, err := m.Register("glitch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Fields must not overlap.
+	used := make([]uint8, reg.Width)
+	for _, f := range reg.Fields {
+		if used[f.Byte]&f.Mask() != 0 {
+			t.Errorf("Field %s overlaps another field", f.Name)
+		}
+		used[f.Byte] |= f.Mask()
+	}
+	for _, name := range []string{"trig_src", "out_type", "repeat", "clk_src", "manual",
+		"width_fine_lo", "width_fine_hi", "width_fine_load",
+		"offset_fine_lo", "offset_fine_hi", "offset_fine_load"} {
+		if _, err := reg.Field(name); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestCrowbarRegisterFields(t *testing.T) {
+	m, err := regmap.Load(int(gocw.HwChipWhispererLite), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg, err := m.Register("io_route")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hp, err := reg.Field("glitch_hp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lp, err := reg.Field("glitch_lp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, reg.Width)
+	hp.Set(buf, 1)
+	lp.Set(buf, 1)
+	if want := []byte{0, 0, 0, 0, 0x06, 0, 0, 0}; !bytes.Equal(buf, want) {
+		t.Errorf("Crowbar bits = %x, want %x", buf, want)
+	}
+}
+
+func TestDecodeTriggerRegisterFields(t *testing.T) {
+	m, err := regmap.Load(int(gocw.HwChipWhispererCw1200), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg, err := m.Register("decode_cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	used := make([]uint8, reg.Width)
+	for _, f := range reg.Fields {
+		if used[f.Byte]&f.Mask() != 0 {
+			t.Errorf("Field %s overlaps another field", f.Name)
+		}
+		used[f.Byte] |= f.Mask()
+	}
+	for _, name := range []string{"type", "pin", "baud_lo", "baud_hi", "pattern_len"} {
+		if _, err := reg.Field(name); err != nil {
+			t.Error(err)
+		}
+	}
+	if data, err := m.Register("decode_data"); err != nil {
+		t.Error(err)
+	} else if data.Width != gocw.MaxDecodePatternLen {
+		t.Errorf("decode_data width %d, want %d", data.Width, gocw.MaxDecodePatternLen)
+	}
+	if _, err := m.Register("trig_module"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Transfer latency histograms.
+// Per-trace time splits between USB transfers, the capture firmware and the
+// target. Memory and Usart record the latency of each transfer in a
+// LatencyStats when one is set (see CaptureOptions.LatencyStats), to tell
+// which of them dominates. Nothing is recorded by default.
+package gocw
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:generate stringer -type LatencyKind
+type LatencyKind int
+
+const (
+	// USB control transfers: address blocks, short register reads and
+	// writes, serial data and status.
+	LatencyControl LatencyKind = iota
+	// USB bulk endpoint reads, e.g. trace data.
+	LatencyBulkRead LatencyKind = iota
+	// USB bulk endpoint writes.
+	LatencyBulkWrite LatencyKind = iota
+	// From the end of a serial write to the first read returning data, i.e.
+	// the target processing time plus the polling delay.
+	LatencySerialRoundTrip LatencyKind = iota
+)
+
+var latencyKinds = []LatencyKind{
+	LatencyControl, LatencyBulkRead, LatencyBulkWrite, LatencySerialRoundTrip}
+
+// Number of histogram buckets. Bucket i counts latencies in
+// [2^i, 2^(i+1)) microseconds, the first one starts at zero and the last one
+// is unbounded.
+const LatencyBuckets = 24
+
+type LatencyHistogram struct {
+	Count           uint64
+	Total, Min, Max time.Duration
+	Buckets         [LatencyBuckets]uint64
+}
+
+// Returns the lower bound of histogram bucket i.
+func LatencyBucketStart(i int) time.Duration {
+	if i == 0 {
+		return 0
+	}
+	return time.Duration(1<<uint(i)) * time.Microsecond
+}
+
+func latencyBucket(d time.Duration) int {
+	i := bits.Len64(uint64(d/time.Microsecond)) - 1
+	if i < 0 {
+		return 0
+	}
+	if i >= LatencyBuckets {
+		return LatencyBuckets - 1
+	}
+	return i
+}
+
+func (h *LatencyHistogram) record(d time.Duration) {
+	if h.Count == 0 || d < h.Min {
+		h.Min = d
+	}
+	if d > h.Max {
+		h.Max = d
+	}
+	h.Count++
+	h.Total += d
+	h.Buckets[latencyBucket(d)]++
+}
+
+func (h LatencyHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Total / time.Duration(h.Count)
+}
+
+// Returns an upper bound of quantile q in [0, 1]: the end of the bucket
+// holding it, capped at Max.
+func (h LatencyHistogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(h.Count))
+	if rank >= h.Count {
+		rank = h.Count - 1
+	}
+	var seen uint64
+	for i, n := range h.Buckets {
+		seen += n
+		if seen > rank && i < LatencyBuckets-1 {
+			if end := LatencyBucketStart(i + 1); end < h.Max {
+				return end
+			}
+			break
+		}
+	}
+	return h.Max
+}
+
+// Latency histograms of each LatencyKind. Safe for concurrent use. Methods of
+// a nil *LatencyStats do nothing, so recording can be left unconditional.
+type LatencyStats struct {
+	mu    sync.Mutex
+	hists map[LatencyKind]*LatencyHistogram
+}
+
+func NewLatencyStats() *LatencyStats {
+	return &LatencyStats{hists: make(map[LatencyKind]*LatencyHistogram)}
+}
+
+func (s *LatencyStats) Record(kind LatencyKind, d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.hists[kind]
+	if !ok {
+		h = &LatencyHistogram{}
+		s.hists[kind] = h
+	}
+	h.record(d)
+}
+
+// Records the time elapsed since start.
+func (s *LatencyStats) Since(kind LatencyKind, start time.Time) {
+	if s == nil {
+		return
+	}
+	s.Record(kind, time.Since(start))
+}
+
+// Returns a copy of the histogram of a kind.
+func (s *LatencyStats) Histogram(kind LatencyKind) LatencyHistogram {
+	if s == nil {
+		return LatencyHistogram{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h, ok := s.hists[kind]; ok {
+		return *h
+	}
+	return LatencyHistogram{}
+}
+
+func (s *LatencyStats) Reset() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.hists = make(map[LatencyKind]*LatencyHistogram)
+	s.mu.Unlock()
+}
+
+// Writes a summary and the non-empty buckets of each histogram.
+func (s *LatencyStats) Dump(w io.Writer) error {
+	for _, kind := range latencyKinds {
+		h := s.Histogram(kind)
+		if h.Count == 0 {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%v: n=%d total=%v mean=%v min=%v p50<=%v p90<=%v p99<=%v max=%v\n",
+			kind, h.Count, h.Total, h.Mean(), h.Min,
+			h.Quantile(0.5), h.Quantile(0.9), h.Quantile(0.99), h.Max); err != nil {
+			return err
+		}
+		var peak uint64
+		for _, n := range h.Buckets {
+			if n > peak {
+				peak = n
+			}
+		}
+		for i, n := range h.Buckets {
+			if n == 0 {
+				continue
+			}
+			end := "inf"
+			if i < LatencyBuckets-1 {
+				end = LatencyBucketStart(i + 1).String()
+			}
+			bar := strings.Repeat("#", int((40*n+peak-1)/peak))
+			if _, err := fmt.Fprintf(w, "  [%8v, %8v) %-40s %d\n",
+				LatencyBucketStart(i), end, bar, n); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
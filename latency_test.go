@@ -0,0 +1,89 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gocw"
+	"github.com/google/gocw/mocks"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	s := gocw.NewLatencyStats()
+	for _, d := range []time.Duration{
+		500 * time.Nanosecond, 3 * time.Microsecond, 3 * time.Microsecond, 100 * time.Microsecond} {
+		s.Record(gocw.LatencyControl, d)
+	}
+	h := s.Histogram(gocw.LatencyControl)
+	if h.Count != 4 || h.Min != 500*time.Nanosecond || h.Max != 100*time.Microsecond {
+		t.Errorf("Histogram count %d, min %v, max %v", h.Count, h.Min, h.Max)
+	}
+	// [0, 2us): 1, [2us, 4us): 2, [64us, 128us): 1.
+	if h.Buckets[0] != 1 || h.Buckets[1] != 2 || h.Buckets[6] != 1 {
+		t.Errorf("Unexpected buckets %v", h.Buckets)
+	}
+	if q := h.Quantile(0.5); q != 4*time.Microsecond {
+		t.Errorf("Median bound %v, want 4us", q)
+	}
+	if q := h.Quantile(1); q != h.Max {
+		t.Errorf("Max quantile %v, want %v", q, h.Max)
+	}
+	if s.Histogram(gocw.LatencyBulkRead).Count != 0 {
+		t.Errorf("Unexpected bulk read latencies")
+	}
+
+	var out bytes.Buffer
+	if err := s.Dump(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "LatencyControl: n=4") {
+		t.Errorf("Unexpected dump:\n%s", out.String())
+	}
+}
+
+func TestNilLatencyStats(t *testing.T) {
+	var s *gocw.LatencyStats
+	s.Record(gocw.LatencyControl, time.Second)
+	if s.Histogram(gocw.LatencyControl).Count != 0 {
+		t.Errorf("nil LatencyStats recorded a latency")
+	}
+}
+
+func TestMemoryRecordsLatency(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	dev := mocks.NewMockUsbDeviceInterface(mockCtrl)
+	dev.EXPECT().ControlOut(gocw.ReqMemReadBulk, uint16(0), gomock.Any()).Return(nil)
+	dev.EXPECT().Read(gomock.Any()).Return(200, nil)
+	m := gocw.NewMemory(dev)
+	s := gocw.NewLatencyStats()
+	m.SetLatencyStats(s)
+	if _, err := m.ReadBytes(0, make([]byte, 200)); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Histogram(gocw.LatencyControl).Count; n != 1 {
+		t.Errorf("Recorded %d control transfers, want 1", n)
+	}
+	if n := s.Histogram(gocw.LatencyBulkRead).Count; n != 1 {
+		t.Errorf("Recorded %d bulk reads, want 1", n)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Logic capture of the target IO pins, sampled on the ADC clock.
+// Bitstreams with a logic analyzer store one byte per ADC sample, holding the
+// state of the enabled TIO pins, so protocol events (e.g. UART bytes, a GPIO
+// raised by the firmware) can be aligned with power features.
+// The registers are looked up in the register map ("logic_capture" and
+// "logic_data"), and the feature is gated by FeatureLogicCapture.
+package gocw
+
+import (
+	"fmt"
+
+	"github.com/google/gocw/internal/regmap"
+)
+
+// Bit mask of target IO pins. Bit i is TIO(i+1).
+type LogicChannels uint8
+
+const (
+	LogicTio1 LogicChannels = 1 << iota
+	LogicTio2
+	LogicTio3
+	LogicTio4
+)
+
+// Enables logic capture of the given pins. Zero disables it.
+func (c *Adc) SetLogicCapture(ch LogicChannels) {
+	if c.err != nil {
+		return
+	}
+	if c.err = c.caps.Require(FeatureLogicCapture); c.err != nil {
+		return
+	}
+	var reg regmap.Register
+	if reg, c.err = c.regMap.Register("logic_capture"); c.err != nil {
+		return
+	}
+	mask := uint8(ch)
+	if c.err = c.fpga.Mem.Write(Address(reg.Address), &mask, true, nil); c.err != nil {
+		return
+	}
+	c.logicChannels = ch
+}
+
+func (c *Adc) LogicCapture() LogicChannels {
+	return c.logicChannels
+}
+
+// Reads the pin states of the last capture, one byte per sample. Only bits of
+// the enabled channels are meaningful.
+func (c *Adc) LogicData() []uint8 {
+	if c.err != nil || c.logicChannels == 0 {
+		return nil
+	}
+	var reg regmap.Register
+	if reg, c.err = c.regMap.Register("logic_data"); c.err != nil {
+		return nil
+	}
+	data := make([]uint8, int(c.TotalSamples())*c.Segments())
+	if c.err = c.fpga.Mem.Read(Address(reg.Address), data); c.err != nil {
+		c.err = fmt.Errorf("Failed reading logic data: %v", c.err)
+		return nil
+	}
+	return data
+}
+
+// Returns the state of a single channel of the trace's logic capture.
+func (t *Trace) LogicLevels(ch LogicChannels) []bool {
+	levels := make([]bool, len(t.Logic))
+	for i, v := range t.Logic {
+		levels[i] = LogicChannels(v)&ch != 0
+	}
+	return levels
+}
+
+// Returns the sample indices where a channel of the trace's logic capture
+// changes state, e.g. to align traces on a GPIO raised by the firmware.
+func (t *Trace) LogicEdges(ch LogicChannels) []int {
+	var edges []int
+	for i := 1; i < len(t.Logic); i++ {
+		if (t.Logic[i]^t.Logic[i-1])&uint8(ch) != 0 {
+			edges = append(edges, i)
+		}
+	}
+	return edges
+}
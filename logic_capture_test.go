@@ -0,0 +1,37 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/gocw"
+)
+
+func TestLogicEdges(t *testing.T) {
+	// TIO1 toggles at samples 2 and 4, TIO4 rises at sample 3.
+	trace := gocw.Trace{Logic: []uint8{0x0, 0x0, 0x1, 0x9, 0x8, 0x8}}
+	if actual, expected := trace.LogicEdges(gocw.LogicTio1), []int{2, 4}; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("TIO1 edges (%v) did not match expected (%v)", actual, expected)
+	}
+	if actual, expected := trace.LogicEdges(gocw.LogicTio4), []int{3}; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("TIO4 edges (%v) did not match expected (%v)", actual, expected)
+	}
+	expected := []bool{false, false, true, true, false, false}
+	if actual := trace.LogicLevels(gocw.LogicTio1); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("TIO1 levels (%v) did not match expected (%v)", actual, expected)
+	}
+}
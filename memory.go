@@ -17,16 +17,139 @@ package gocw
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
+	"time"
 
 	"github.com/golang/glog"
 )
 
 type Address uint32
 
+const (
+	// Transfers shorter than this are sent over the control endpoint. The
+	// firmware control buffer can't hold much more.
+	DefaultCtrlThreshold = 48
+	// Large enough to read a full ADC FIFO in a single request.
+	DefaultMaxBulkRead = 256 * 1024
+	// Retries of the remaining bytes of short bulk reads.
+	DefaultShortReadRetries = 2
+	// Bulk transfers of ReadBytesStream: two in flight, one being consumed.
+	DefaultStreamChunk   = 16 * 1024
+	DefaultStreamBuffers = 2
+)
+
+// Tunable transfer parameters.
+type TransferConfig struct {
+	// Transfers shorter than this use control transfers, longer ones use the
+	// bulk endpoints.
+	CtrlThreshold int
+	// Maximum number of bytes per bulk read request. Larger reads are split
+	// into multiple requests to the same address. Rounded down to a multiple
+	// of the endpoint max packet size, if known.
+	MaxBulkRead int
+	// Number of times the remaining bytes of a short bulk read are requested
+	// again before failing with a ShortReadError.
+	ShortReadRetries int
+	// Optional. Called after each bulk read request with the number of bytes
+	// read so far.
+	Progress func(done, total int)
+	// Bytes per bulk transfer of ReadBytesStream, rounded down to a multiple
+	// of the endpoint max packet size if known, and number of transfers read
+	// ahead of the consumer.
+	StreamChunk   int
+	StreamBuffers int
+}
+
+// Returned when a bulk read stays short after all retries.
+type ShortReadError struct {
+	Read, Expected int
+}
+
+func (e *ShortReadError) Error() string {
+	return fmt.Sprintf("Short bulk read: %d of %d bytes", e.Read, e.Expected)
+}
+
+func DefaultTransferConfig() TransferConfig {
+	return TransferConfig{
+		CtrlThreshold:    DefaultCtrlThreshold,
+		MaxBulkRead:      DefaultMaxBulkRead,
+		ShortReadRetries: DefaultShortReadRetries,
+		StreamChunk:      DefaultStreamChunk,
+		StreamBuffers:    DefaultStreamBuffers,
+	}
+}
+
+// Implemented by devices that know their bulk endpoint max packet size.
+type maxPacketSizer interface {
+	MaxPacketSize() int
+}
+
+// Each operation is atomic with respect to the other users of the device,
+// see UsbDevice.Lock. The byte order and transfer configuration must be set
+// before concurrent use.
 type Memory struct {
 	dev UsbDeviceInterface
+	cfg TransferConfig
+	// Byte order of multi-byte values in Read/Write.
+	order binary.ByteOrder
+	// Optional transfer latency histograms.
+	latency *LatencyStats
+}
+
+// Sets the byte order of multi-byte register values. The OpenADC registers are
+// little-endian, which is the default. Address blocks sent to the firmware are
+// always little-endian.
+func (m *Memory) SetByteOrder(order binary.ByteOrder) {
+	m.order = order
+}
+
+func (m *Memory) ByteOrder() binary.ByteOrder {
+	return m.order
+}
+
+// Sets the transfer parameters, see TransferConfig.
+func (m *Memory) SetTransferConfig(cfg TransferConfig) {
+	if cfg.CtrlThreshold <= 0 {
+		cfg.CtrlThreshold = DefaultCtrlThreshold
+	}
+	if cfg.MaxBulkRead <= 0 {
+		cfg.MaxBulkRead = DefaultMaxBulkRead
+	}
+	if cfg.ShortReadRetries < 0 {
+		cfg.ShortReadRetries = 0
+	}
+	if cfg.StreamChunk <= 0 {
+		cfg.StreamChunk = DefaultStreamChunk
+	}
+	if cfg.StreamBuffers <= 0 {
+		cfg.StreamBuffers = DefaultStreamBuffers
+	}
+	if d, ok := m.dev.(maxPacketSizer); ok {
+		if p := d.MaxPacketSize(); p > 0 && cfg.MaxBulkRead > p {
+			cfg.MaxBulkRead -= cfg.MaxBulkRead % p
+		}
+		if p := d.MaxPacketSize(); p > 0 && cfg.StreamChunk > p {
+			cfg.StreamChunk -= cfg.StreamChunk % p
+		}
+	}
+	glog.V(1).Infof("Transfer config: ctrl threshold = %d, max bulk read = %d, short read retries = %d",
+		cfg.CtrlThreshold, cfg.MaxBulkRead, cfg.ShortReadRetries)
+	m.cfg = cfg
+}
+
+func (m *Memory) TransferConfig() TransferConfig {
+	return m.cfg
+}
+
+// Records the latency of each transfer in s. nil stops recording.
+func (m *Memory) SetLatencyStats(s *LatencyStats) {
+	m.latency = s
+}
+
+func (m *Memory) LatencyStats() *LatencyStats {
+	return m.latency
 }
 
 type AddressBlock struct {
@@ -36,59 +159,122 @@ type AddressBlock struct {
 
 // Reads len(data) bytes from memory address addr.
 // Automatically decides to use control-transfer or build-endpoint transfer
-// based on data length.
-func (m *Memory) doRead(addr Address, data []byte) error {
-	var err error
+// based on data length. Returns the number of bytes read, which is short of
+// len(data) only with a ShortReadError. Bulk reads return early when ctx is
+// done.
+func (m *Memory) doRead(ctx context.Context, addr Address, data []byte) (int, error) {
 	glog.V(1).Infof("[ext-mem-read]: addr = %v, dlen = %v", addr, len(data))
 
-	cmd := ReqMemReadBulk
-	if len(data) < 48 {
-		cmd = ReqMemReadCtrl
-	}
-
-	info := AddressBlock{}
-	info.Dlen = uint32(len(data))
-	info.Addr = uint32(addr)
-
-	if err = m.dev.ControlOut(cmd, 0, &info); err != nil {
-		return fmt.Errorf("ControlOut AddressBlock failed: %v", err)
+	if len(data) < m.cfg.CtrlThreshold {
+		if err := m.sendAddressBlock(ReqMemReadCtrl, addr, len(data)); err != nil {
+			return 0, err
+		}
+		start := time.Now()
+		err := m.dev.ControlIn(ReqMemReadCtrl, 0, data)
+		m.latency.Since(LatencyControl, start)
+		if err != nil {
+			return 0, fmt.Errorf("ReqMemReadCtrl data failed: %v", err)
+		}
+		return len(data), nil
 	}
 
-	switch cmd {
-	case ReqMemReadBulk:
-		var n int
-		if n, err = m.dev.Read(data); err != nil {
-			return fmt.Errorf("ReqMemReadBulk data failed: %v", err)
+	// Addresses are FPGA registers, and long reads stream the register
+	// contents (e.g. the ADC FIFO). Chunks are therefore read from the same
+	// address, and so are the remaining bytes of short reads.
+	retries := m.cfg.ShortReadRetries
+	for done := 0; done < len(data); {
+		if err := ctx.Err(); err != nil {
+			return done, err
 		}
-		if n != len(data) {
-			return fmt.Errorf("Failed to read entire buffer over bulk interface")
+		end := done + m.cfg.MaxBulkRead
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := data[done:end]
+		if err := m.sendAddressBlock(ReqMemReadBulk, addr, len(chunk)); err != nil {
+			return done, err
+		}
+		start := time.Now()
+		n, err := readContext(ctx, m.dev, chunk)
+		m.latency.Since(LatencyBulkRead, start)
+		if err != nil {
+			return done, fmt.Errorf("ReqMemReadBulk data failed: %v", err)
 		}
-	case ReqMemReadCtrl:
-		if err = m.dev.ControlIn(ReqMemReadCtrl, 0, data); err != nil {
-			return fmt.Errorf("ReqMemReadCtrl data failed: %v", err)
+		done += n
+		if m.cfg.Progress != nil {
+			m.cfg.Progress(done, len(data))
+		}
+		if n != len(chunk) {
+			if retries == 0 {
+				return done, &ShortReadError{done, len(data)}
+			}
+			retries--
+			glog.V(1).Infof("Short bulk read (%d of %d bytes). Reading the remaining bytes", n, len(chunk))
 		}
 	}
+	return len(data), nil
+}
+
+func (m *Memory) sendAddressBlock(cmd Request, addr Address, dlen int) error {
+	info := AddressBlock{}
+	info.Dlen = uint32(dlen)
+	info.Addr = uint32(addr)
 
+	start := time.Now()
+	err := m.dev.ControlOut(cmd, 0, &info)
+	m.latency.Since(LatencyControl, start)
+	if err != nil {
+		return fmt.Errorf("ControlOut AddressBlock failed: %v", err)
+	}
 	return nil
 }
 
+// Reads a binary structure from memory address addr, in the memory byte order.
 func (m *Memory) Read(addr Address, data interface{}) error {
+	return m.ReadOrder(addr, data, m.order)
+}
+
+// Reads a binary structure from memory address addr, in the given byte order.
+func (m *Memory) ReadOrder(addr Address, data interface{}, order binary.ByteOrder) error {
 	var err error
 	if binary.Size(data) == -1 {
 		return fmt.Errorf("Failed to get data size")
 	}
-	// TODO: read directly to data if it's already a slice of bytes.
+	unlock := lockDevice(m.dev)
+	defer unlock()
+	// Byte slices need no decoding, and are read in place.
+	if b, ok := data.([]byte); ok {
+		if _, err = m.doRead(context.Background(), addr, b); err != nil {
+			return fmt.Errorf("m.doRead failed %v", err)
+		}
+		return nil
+	}
 	buf := make([]byte, binary.Size(data))
-	if err = m.doRead(addr, buf); err != nil {
+	if _, err = m.doRead(context.Background(), addr, buf); err != nil {
 		return fmt.Errorf("m.doRead failed %v", err)
 	}
 	r := bytes.NewReader(buf)
-	if err := binary.Read(r, binary.LittleEndian, data); err != nil {
+	if err := binary.Read(r, order, data); err != nil {
 		return fmt.Errorf("binary.Read failed: %v", err)
 	}
 	return nil
 }
 
+// Reads len(data) raw bytes from memory address addr. Returns the number of
+// bytes read, which is short of len(data) only with a *ShortReadError, so
+// callers can use the partial data.
+func (m *Memory) ReadBytes(addr Address, data []byte) (int, error) {
+	return m.ReadBytesContext(context.Background(), addr, data)
+}
+
+// Same as ReadBytes, returning early with the context error when ctx is done,
+// e.g. to cancel a long read of the ADC FIFO.
+func (m *Memory) ReadBytesContext(ctx context.Context, addr Address, data []byte) (int, error) {
+	unlock := lockDevice(m.dev)
+	defer unlock()
+	return m.doRead(ctx, addr, data)
+}
+
 // Writes data to memory address addr.
 // Automatically decides to use control-transfer of build-endpoint trasfer
 // based on data length.
@@ -98,7 +284,7 @@ func (m *Memory) doWrite(addr Address, data []byte, validate bool, mask []byte)
 	glog.V(1).Infof("[ext-mem-write]: addr = %v, dlen = %v", addr, len(data))
 
 	cmd := ReqMemWriteBulk
-	if len(data) < 48 {
+	if len(data) < m.cfg.CtrlThreshold {
 		cmd = ReqMemWriteCtrl
 	}
 
@@ -121,12 +307,18 @@ func (m *Memory) doWrite(addr Address, data []byte, validate bool, mask []byte)
 		}
 	}
 
-	if err = m.dev.ControlOut(cmd, 0, infoBuf.Bytes()); err != nil {
+	start := time.Now()
+	err = m.dev.ControlOut(cmd, 0, infoBuf.Bytes())
+	m.latency.Since(LatencyControl, start)
+	if err != nil {
 		return fmt.Errorf("ControlOut AddressBlock failed: %v", err)
 	}
 
 	if cmd == ReqMemWriteBulk {
-		if written, err = m.dev.Write(data); err != nil {
+		start = time.Now()
+		written, err = m.dev.Write(data)
+		m.latency.Since(LatencyBulkWrite, start)
+		if err != nil {
 			return fmt.Errorf("ReqMemWriteBulk data failed: %v", err)
 		}
 		if written != len(data) {
@@ -136,7 +328,7 @@ func (m *Memory) doWrite(addr Address, data []byte, validate bool, mask []byte)
 
 	if validate {
 		actual := make([]byte, len(data))
-		if err = m.Read(addr, actual); err != nil {
+		if _, err = m.doRead(context.Background(), addr, actual); err != nil {
 			return fmt.Errorf("Read for verify failed %v", err)
 		}
 		expected := make([]byte, len(data))
@@ -157,27 +349,147 @@ func (m *Memory) doWrite(addr Address, data []byte, validate bool, mask []byte)
 	return nil
 }
 
+// Writes a binary structure to memory address addr, in the memory byte order.
 func (m *Memory) Write(addr Address, data interface{}, validate bool, mask interface{}) error {
+	return m.WriteOrder(addr, data, m.order, validate, mask)
+}
+
+// Writes a binary structure to memory address addr, in the given byte order.
+func (m *Memory) WriteOrder(addr Address, data interface{}, order binary.ByteOrder, validate bool, mask interface{}) error {
 	var err error
-	buf := new(bytes.Buffer)
-	if err = binary.Write(buf, binary.LittleEndian, data); err != nil {
-		return fmt.Errorf("binary.Write failed: %v", err)
+	// Byte slices need no encoding, and are written as is.
+	buf, ok := data.([]byte)
+	if !ok {
+		w := new(bytes.Buffer)
+		if err = binary.Write(w, order, data); err != nil {
+			return fmt.Errorf("binary.Write failed: %v", err)
+		}
+		buf = w.Bytes()
 	}
-	// TODO: write directly from data if it's already a slice of bytes.
 	var maskBytes []byte
 	if mask != nil {
-		var ok bool
 		maskBytes, ok = mask.([]byte)
 		if !ok {
 			return fmt.Errorf("Invalid readMask type")
 		}
 	}
-	if err = m.doWrite(addr, buf.Bytes(), validate, maskBytes); err != nil {
+	unlock := lockDevice(m.dev)
+	defer unlock()
+	if err = m.doWrite(addr, buf, validate, maskBytes); err != nil {
 		return fmt.Errorf("m.doWrite failed %v", err)
 	}
 	return nil
 }
 
 func NewMemory(dev UsbDeviceInterface) *Memory {
-	return &Memory{dev}
+	m := &Memory{dev: dev, order: binary.LittleEndian}
+	m.SetTransferConfig(DefaultTransferConfig())
+	return m
+}
+
+func (m *Memory) ReadU8(addr Address) (uint8, error) {
+	var v uint8
+	err := m.Read(addr, &v)
+	return v, err
+}
+
+func (m *Memory) ReadU16(addr Address) (uint16, error) {
+	var v uint16
+	err := m.Read(addr, &v)
+	return v, err
+}
+
+func (m *Memory) ReadU32(addr Address) (uint32, error) {
+	var v uint32
+	err := m.Read(addr, &v)
+	return v, err
+}
+
+func (m *Memory) WriteU8(addr Address, v uint8, validate bool) error {
+	return m.Write(addr, v, validate, nil)
+}
+
+func (m *Memory) WriteU16(addr Address, v uint16, validate bool) error {
+	return m.Write(addr, v, validate, nil)
+}
+
+func (m *Memory) WriteU32(addr Address, v uint32, validate bool) error {
+	return m.Write(addr, v, validate, nil)
+}
+
+// Bit range of a register of up to 4 bytes. Bits are numbered in the register
+// value decoded in the memory byte order, so fields may cross byte boundaries.
+type BitRange struct {
+	// Register width in bytes.
+	Width int
+	Shift uint
+	Bits  uint
+}
+
+func (b BitRange) validate() error {
+	if b.Width < 1 || b.Width > 4 || b.Bits == 0 || b.Shift+b.Bits > uint(8*b.Width) {
+		return fmt.Errorf("Invalid bit range %+v", b)
+	}
+	return nil
+}
+
+func (b BitRange) mask() uint32 {
+	return uint32((uint64(1)<<b.Bits - 1) << b.Shift)
+}
+
+// Decodes a register value of up to 4 bytes.
+func (m *Memory) decode(buf []byte) uint32 {
+	var padded [4]byte
+	if m.order == binary.BigEndian {
+		copy(padded[4-len(buf):], buf)
+		return binary.BigEndian.Uint32(padded[:])
+	}
+	copy(padded[:], buf)
+	return m.order.Uint32(padded[:])
+}
+
+// Encodes a register value of len(buf) bytes.
+func (m *Memory) encode(buf []byte, v uint32) {
+	var padded [4]byte
+	if m.order == binary.BigEndian {
+		binary.BigEndian.PutUint32(padded[:], v)
+		copy(buf, padded[4-len(buf):])
+		return
+	}
+	m.order.PutUint32(padded[:], v)
+	copy(buf, padded[:])
+}
+
+// Reads a bit range of the register at addr.
+func (m *Memory) ReadBits(addr Address, b BitRange) (uint32, error) {
+	if err := b.validate(); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, b.Width)
+	if err := m.Read(addr, buf); err != nil {
+		return 0, err
+	}
+	return (m.decode(buf) & b.mask()) >> b.Shift, nil
+}
+
+// Sets a bit range of the register at addr, keeping the other bits. If
+// validate is set, only the range is verified. The device stays locked from
+// the read to the write, see UsbDevice.Lock.
+func (m *Memory) WriteBits(addr Address, b BitRange, v uint32, validate bool) error {
+	if err := b.validate(); err != nil {
+		return err
+	}
+	unlock := lockDevice(m.dev)
+	defer unlock()
+	buf := make([]byte, b.Width)
+	if _, err := m.doRead(context.Background(), addr, buf); err != nil {
+		return fmt.Errorf("m.doRead failed %v", err)
+	}
+	m.encode(buf, m.decode(buf)&^b.mask()|(v<<b.Shift)&b.mask())
+	mask := make([]byte, b.Width)
+	m.encode(mask, b.mask())
+	if err := m.doWrite(addr, buf, validate, mask); err != nil {
+		return fmt.Errorf("m.doWrite failed %v", err)
+	}
+	return nil
 }
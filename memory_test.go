@@ -16,6 +16,8 @@ package gocw_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"testing"
 
 	"github.com/google/gocw"
@@ -179,3 +181,268 @@ func TestMemoryWriteReadMaskPasses(t *testing.T) {
 		t.Errorf("Memory Write failed: %v", err)
 	}
 }
+
+func TestMemoryBulkReadIsChunked(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	const addr = 0x11223344
+	dev := mocks.NewMockUsbDeviceInterface(mockCtrl)
+	var calls []*gomock.Call
+	for i, dlen := range []int{64, 64, 22} {
+		fill := byte(i + 1)
+		calls = append(calls,
+			dev.EXPECT().ControlOut(
+				gocw.ReqMemReadBulk, uint16(0), &gocw.AddressBlock{uint32(dlen), addr}).
+				Return(nil),
+			dev.EXPECT().Read(gomock.Len(dlen)).
+				DoAndReturn(func(p []byte) (int, error) {
+					for j := range p {
+						p[j] = fill
+					}
+					return len(p), nil
+				}))
+	}
+	gomock.InOrder(calls...)
+
+	m := gocw.NewMemory(dev)
+	var progress []int
+	m.SetTransferConfig(gocw.TransferConfig{
+		CtrlThreshold: 48,
+		MaxBulkRead:   64,
+		Progress:      func(done, total int) { progress = append(progress, done) },
+	})
+	out := make([]byte, 150)
+	if err := m.Read(addr, out); err != nil {
+		t.Errorf("Memory Read failed: %v", err)
+	}
+	if out[0] != 1 || out[64] != 2 || out[149] != 3 {
+		t.Errorf("Unexpected data returned (%v)", out)
+	}
+	if len(progress) != 3 || progress[2] != 150 {
+		t.Errorf("Unexpected progress reports (%v)", progress)
+	}
+}
+
+func TestMemoryWriteU16ByteOrder(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	const addr = 0x11223344
+	dev := mocks.NewMockUsbDeviceInterface(mockCtrl)
+	gomock.InOrder(
+		dev.EXPECT().ControlOut(gocw.ReqMemWriteCtrl, uint16(0),
+			[]byte{2, 0, 0, 0, 0x44, 0x33, 0x22, 0x11, 0x34, 0x12}).
+			Return(nil),
+		// Address block stays little-endian.
+		dev.EXPECT().ControlOut(gocw.ReqMemWriteCtrl, uint16(0),
+			[]byte{2, 0, 0, 0, 0x44, 0x33, 0x22, 0x11, 0x12, 0x34}).
+			Return(nil),
+	)
+	m := gocw.NewMemory(dev)
+	if err := m.WriteU16(addr, 0x1234, false); err != nil {
+		t.Errorf("WriteU16 failed: %v", err)
+	}
+	m.SetByteOrder(binary.BigEndian)
+	if err := m.WriteU16(addr, 0x1234, false); err != nil {
+		t.Errorf("WriteU16 failed: %v", err)
+	}
+}
+
+func expectMemoryRead(dev *mocks.MockUsbDeviceInterface, addr uint32, data []byte) *gomock.Call {
+	dev.EXPECT().ControlOut(
+		gocw.ReqMemReadCtrl, uint16(0), &gocw.AddressBlock{uint32(len(data)), addr}).
+		Return(nil)
+	return dev.EXPECT().ControlIn(gocw.ReqMemReadCtrl, uint16(0), gomock.Any()).
+		SetArg(2, data).
+		Return(nil)
+}
+
+func TestMemoryReadBits(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	dev := mocks.NewMockUsbDeviceInterface(mockCtrl)
+	m := gocw.NewMemory(dev)
+	// 12 bits crossing the byte boundary.
+	bits := gocw.BitRange{Width: 2, Shift: 4, Bits: 12}
+	for _, tc := range []struct {
+		order binary.ByteOrder
+		want  uint32
+	}{
+		{binary.LittleEndian, 0xabc},
+		{binary.BigEndian, 0xc0a},
+	} {
+		expectMemoryRead(dev, 0x10, []byte{0xc0, 0xab})
+		m.SetByteOrder(tc.order)
+		got, err := m.ReadBits(0x10, bits)
+		if err != nil {
+			t.Fatalf("ReadBits failed: %v", err)
+		}
+		if got != tc.want {
+			t.Errorf("ReadBits(%v) = %#x, expected %#x", tc.order, got, tc.want)
+		}
+	}
+	if _, err := m.ReadBits(0x10, gocw.BitRange{Width: 1, Shift: 4, Bits: 5}); err == nil {
+		t.Errorf("ReadBits of an out of range field succeeded")
+	}
+}
+
+func TestMemoryWriteBits(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	dev := mocks.NewMockUsbDeviceInterface(mockCtrl)
+	gomock.InOrder(
+		expectMemoryRead(dev, 0x10, []byte{0x0f, 0xf0}),
+		dev.EXPECT().ControlOut(gocw.ReqMemWriteCtrl, uint16(0),
+			[]byte{2, 0, 0, 0, 0x10, 0, 0, 0, 0x5f, 0xf5}).
+			Return(nil),
+	)
+	m := gocw.NewMemory(dev)
+	if err := m.WriteBits(0x10, gocw.BitRange{Width: 2, Shift: 4, Bits: 8}, 0x55, false); err != nil {
+		t.Errorf("WriteBits failed: %v", err)
+	}
+}
+
+func TestMemoryBulkReadRetriesShortRead(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	const addr = 0x3
+	dev := mocks.NewMockUsbDeviceInterface(mockCtrl)
+	fill := func(n int, v byte) func(p []byte) (int, error) {
+		return func(p []byte) (int, error) {
+			for j := 0; j < n; j++ {
+				p[j] = v
+			}
+			return n, nil
+		}
+	}
+	gomock.InOrder(
+		dev.EXPECT().ControlOut(gocw.ReqMemReadBulk, uint16(0), &gocw.AddressBlock{100, addr}).Return(nil),
+		dev.EXPECT().Read(gomock.Len(100)).DoAndReturn(fill(60, 1)),
+		// Only the remaining bytes are requested again.
+		dev.EXPECT().ControlOut(gocw.ReqMemReadBulk, uint16(0), &gocw.AddressBlock{40, addr}).Return(nil),
+		dev.EXPECT().Read(gomock.Len(40)).DoAndReturn(fill(40, 2)),
+	)
+	m := gocw.NewMemory(dev)
+	out := make([]byte, 100)
+	n, err := m.ReadBytes(addr, out)
+	if err != nil || n != 100 {
+		t.Fatalf("ReadBytes() = %d, %v, expected 100 bytes", n, err)
+	}
+	if out[59] != 1 || out[60] != 2 || out[99] != 2 {
+		t.Errorf("Unexpected data returned (%v)", out)
+	}
+}
+
+func TestMemoryBulkReadShortReadError(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	const addr = 0x3
+	dev := mocks.NewMockUsbDeviceInterface(mockCtrl)
+	gomock.InOrder(
+		dev.EXPECT().ControlOut(gocw.ReqMemReadBulk, uint16(0), &gocw.AddressBlock{100, addr}).Return(nil),
+		dev.EXPECT().Read(gomock.Len(100)).Return(60, nil),
+	)
+	m := gocw.NewMemory(dev)
+	cfg := m.TransferConfig()
+	cfg.ShortReadRetries = 0
+	m.SetTransferConfig(cfg)
+	n, err := m.ReadBytes(addr, make([]byte, 100))
+	if serr, ok := err.(*gocw.ShortReadError); !ok || serr.Read != 60 || serr.Expected != 100 {
+		t.Errorf("ReadBytes() error = %v, expected a short read of 60/100 bytes", err)
+	}
+	if n != 60 {
+		t.Errorf("ReadBytes() = %d bytes, expected 60", n)
+	}
+}
+
+func TestMemoryBulkReadContextCancelled(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	const addr = 0x3
+	dev := mocks.NewMockUsbDeviceInterface(mockCtrl)
+	gomock.InOrder(
+		dev.EXPECT().ControlOut(gocw.ReqMemReadBulk, uint16(0), &gocw.AddressBlock{64, addr}).Return(nil),
+		dev.EXPECT().Read(gomock.Len(64)).Return(64, nil),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := gocw.NewMemory(dev)
+	m.SetTransferConfig(gocw.TransferConfig{
+		MaxBulkRead: 64,
+		// Cancelled after the first chunk.
+		Progress: func(done, total int) { cancel() },
+	})
+	n, err := m.ReadBytesContext(ctx, addr, make([]byte, 150))
+	if err != context.Canceled || n != 64 {
+		t.Errorf("ReadBytesContext() = %d, %v, expected 64, %v", n, err, context.Canceled)
+	}
+}
+
+func TestMemoryReadBytesStream(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	const addr = 0x3
+	dev := mocks.NewMockUsbDeviceInterface(mockCtrl)
+	// A single request, read in chunks.
+	next := byte(0)
+	fill := func(p []byte) (int, error) {
+		for j := range p {
+			p[j] = next
+			next++
+		}
+		return len(p), nil
+	}
+	gomock.InOrder(
+		dev.EXPECT().ControlOut(gocw.ReqMemReadBulk, uint16(0), &gocw.AddressBlock{100, addr}).Return(nil),
+		dev.EXPECT().Read(gomock.Len(32)).DoAndReturn(fill).Times(3),
+		dev.EXPECT().Read(gomock.Len(4)).DoAndReturn(fill),
+	)
+	m := gocw.NewMemory(dev)
+	cfg := m.TransferConfig()
+	cfg.StreamChunk = 32
+	m.SetTransferConfig(cfg)
+	var out []byte
+	n, err := m.ReadBytesStream(context.Background(), addr, 100, func(chunk []byte) error {
+		out = append(out, chunk...)
+		return nil
+	})
+	if err != nil || n != 100 {
+		t.Fatalf("ReadBytesStream() = %d, %v, expected 100 bytes", n, err)
+	}
+	for i, b := range out {
+		if b != byte(i) {
+			t.Fatalf("Byte %d is %d, chunks out of order", i, b)
+		}
+	}
+}
+
+func TestMemoryReadBytesStreamShortRead(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	const addr = 0x3
+	dev := mocks.NewMockUsbDeviceInterface(mockCtrl)
+	gomock.InOrder(
+		dev.EXPECT().ControlOut(gocw.ReqMemReadBulk, uint16(0), &gocw.AddressBlock{100, addr}).Return(nil),
+		dev.EXPECT().Read(gomock.Len(64)).Return(64, nil),
+		dev.EXPECT().Read(gomock.Len(36)).Return(0, nil),
+	)
+	m := gocw.NewMemory(dev)
+	cfg := m.TransferConfig()
+	cfg.StreamChunk = 64
+	m.SetTransferConfig(cfg)
+	n, err := m.ReadBytesStream(context.Background(), addr, 100, func(chunk []byte) error { return nil })
+	if serr, ok := err.(*gocw.ShortReadError); !ok || serr.Read != 64 || serr.Expected != 100 {
+		t.Errorf("ReadBytesStream() error = %v, expected a short read of 64/100 bytes", err)
+	}
+	if n != 64 {
+		t.Errorf("ReadBytesStream() = %d bytes, expected 64", n)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Composable preprocessing of captures before running an attack.
+package preprocess
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/google/gocw"
+
+	"github.com/golang/glog"
+)
+
+// A single capture transformation.
+// Steps are identified by their type name and JSON encoding, so every field
+// that affects the output must be exported.
+type Step interface {
+	Apply(c gocw.Capture) (gocw.Capture, error)
+}
+
+// Chains steps, and caches the transformed captures on disk.
+type Pipeline struct {
+	Steps []Step
+	// Directory holding transformed captures. Caching is disabled if empty.
+	CacheDir string
+}
+
+func NewPipeline(cacheDir string, steps ...Step) *Pipeline {
+	return &Pipeline{steps, cacheDir}
+}
+
+// Returns a hex digest of the pipeline configuration.
+func (p *Pipeline) Hash() (string, error) {
+	h := sha256.New()
+	for _, s := range p.Steps {
+		conf, err := json.Marshal(s)
+		if err != nil {
+			return "", fmt.Errorf("Failed encoding step %T: %v", s, err)
+		}
+		fmt.Fprintf(h, "%T:%s\n", s, conf)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Applies all steps in order.
+func (p *Pipeline) Apply(c gocw.Capture) (gocw.Capture, error) {
+	var err error
+	for _, s := range p.Steps {
+		glog.V(1).Infof("Applying preprocessing step %T", s)
+		if c, err = s.Apply(c); err != nil {
+			return nil, fmt.Errorf("Step %T failed: %v", s, err)
+		}
+	}
+	return c, nil
+}
+
+// Returns the hex SHA-256 digest of the file contents.
+func fileDigest(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Returns the cache file for the given input capture.
+// Cache entries are keyed by (input digest, pipeline hash).
+func (p *Pipeline) cacheFile(filename string) (string, error) {
+	digest, err := fileDigest(filename)
+	if err != nil {
+		return "", fmt.Errorf("Failed hashing input capture: %v", err)
+	}
+	hash, err := p.Hash()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(p.CacheDir, fmt.Sprintf("%s-%s.json.gz", digest[:16], hash[:16])), nil
+}
+
+// Loads capture from file, and applies the pipeline.
+// Returns the cached result if the same capture was already transformed by an
+// identical pipeline.
+func (p *Pipeline) LoadCapture(filename string) (gocw.Capture, error) {
+	if len(p.CacheDir) == 0 {
+		c, err := gocw.LoadCapture(filename)
+		if err != nil {
+			return nil, err
+		}
+		return p.Apply(c)
+	}
+
+	cached, err := p.cacheFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = os.Stat(cached); err == nil {
+		glog.V(1).Infof("Loading preprocessed capture from cache: %v", cached)
+		return gocw.LoadCapture(cached)
+	}
+
+	c, err := gocw.LoadCapture(filename)
+	if err != nil {
+		return nil, err
+	}
+	if c, err = p.Apply(c); err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(p.CacheDir, 0755); err != nil {
+		return nil, fmt.Errorf("Failed creating cache directory: %v", err)
+	}
+	// Write to a temporary file first, so an interrupted run doesn't leave a
+	// truncated cache entry behind.
+	tmp := cached + ".tmp"
+	if err = c.Save(tmp); err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("Failed writing cache file: %v", err)
+	}
+	if err = os.Rename(tmp, cached); err != nil {
+		return nil, fmt.Errorf("Failed renaming cache file: %v", err)
+	}
+	return c, nil
+}
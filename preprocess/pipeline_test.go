@@ -0,0 +1,130 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package preprocess_test
+
+import (
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/google/gocw"
+	"github.com/google/gocw/preprocess"
+)
+
+func TestPipelineHashDependsOnConfig(t *testing.T) {
+	h1, err := preprocess.NewPipeline("", preprocess.Window{0, 2}).Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := preprocess.NewPipeline("", preprocess.Window{0, 2}).Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h3, err := preprocess.NewPipeline("", preprocess.Window{1, 2}).Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h1 != h2 {
+		t.Errorf("Identical pipelines have different hashes (%v vs %v)", h1, h2)
+	}
+	if h1 == h3 {
+		t.Errorf("Different pipelines have the same hash (%v)", h1)
+	}
+}
+
+func TestPipelineLoadCaptureUsesCache(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.json.gz")
+	c := gocw.Capture{gocw.Trace{Pt: []byte{1}, PowerMeasurements: []gocw.Sample{1, 2, 3, 4}}}
+	if err := c.Save(input); err != nil {
+		t.Fatal(err)
+	}
+
+	p := preprocess.NewPipeline(filepath.Join(dir, "cache"), preprocess.Window{1, 3})
+	expected := gocw.Capture{gocw.Trace{Pt: []byte{1}, PowerMeasurements: []gocw.Sample{2, 3}}}
+	for i := 0; i < 2; i++ {
+		actual, err := p.LoadCapture(input)
+		if err != nil {
+			t.Fatalf("LoadCapture failed: %v", err)
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Preprocessed capture (%v) did not match expected (%v)", actual, expected)
+		}
+	}
+
+	cached, err := filepath.Glob(filepath.Join(dir, "cache", "*.json.gz"))
+	if err != nil || len(cached) != 1 {
+		t.Errorf("Expected a single cache entry, found %v", cached)
+	}
+}
+
+func TestSubtractBaseline(t *testing.T) {
+	trace := func(v gocw.Sample, baseline bool) gocw.Trace {
+		return gocw.Trace{PowerMeasurements: []gocw.Sample{v, v + 2}, Baseline: baseline}
+	}
+	// Baseline means 1 and 5, two traces in between.
+	c := gocw.Capture{trace(0, true), trace(10, false), trace(10, false), trace(4, true), trace(10, false)}
+	res, err := preprocess.SubtractBaseline{}.Apply(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]float64{{10 - 7.0/3, 12 - 7.0/3}, {10 - 11.0/3, 12 - 11.0/3}, {5, 7}}
+	if len(res) != len(expected) {
+		t.Fatalf("SubtractBaseline returned %d traces, expected %d", len(res), len(expected))
+	}
+	for i := range res {
+		for j, v := range gocw.Float64s(res[i].PowerMeasurements) {
+			if math.Abs(v-expected[i][j]) > 1e-5 {
+				t.Errorf("SubtractBaseline trace %d = %v, expected %v", i, res[i].PowerMeasurements, expected[i])
+				break
+			}
+		}
+	}
+
+	res, err = preprocess.SubtractBaseline{PerSample: true}.Apply(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := res[2].PowerMeasurements; last[0] != 6 || last[1] != 6 {
+		t.Errorf("Per sample SubtractBaseline of the last trace = %v, expected [6 6]", last)
+	}
+}
+
+func TestAlign(t *testing.T) {
+	pulse := []gocw.Sample{0, 0, 0, 1, 5, 2, 0, 0, 0, 0}
+	delayed := []gocw.Sample{0, 0, 0, 0, 0, 1, 5, 2, 0, 0}
+	c := gocw.Capture{{PowerMeasurements: pulse}, {PowerMeasurements: delayed}}
+	align := preprocess.Align{Start: 3, End: 7, MaxShift: 3}
+	shifts, err := align.Shifts(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(shifts, []int{0, 2}) {
+		t.Errorf("Shifts %v, expected [0 2]", shifts)
+	}
+	res, err := align.Apply(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []gocw.Sample{0, 0, 0, 1, 5, 2, 0, 0, 0, 0}
+	if !reflect.DeepEqual(res[1].PowerMeasurements, expected) {
+		t.Errorf("Aligned trace %v, expected %v", res[1].PowerMeasurements, expected)
+	}
+
+	if _, err := (preprocess.Align{Start: 1, End: 7, MaxShift: 3}).Shifts(c); err == nil {
+		t.Error("Alignment window outside the traces accepted")
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Preprocessing steps.
+package preprocess
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/google/gocw"
+	"github.com/google/gocw/analysis"
+
+	"github.com/golang/glog"
+)
+
+// Keeps only samples in the [Start, End) range of each trace.
+type Window struct {
+	Start int
+	End   int
+}
+
+func (w Window) Apply(c gocw.Capture) (gocw.Capture, error) {
+	res := make(gocw.Capture, len(c))
+	for i, t := range c {
+		if w.Start < 0 || w.End > len(t.PowerMeasurements) || w.Start >= w.End {
+			return nil, fmt.Errorf("Window [%d, %d) outside trace %d with %d samples",
+				w.Start, w.End, i, len(t.PowerMeasurements))
+		}
+		res[i] = t
+		res[i].PowerMeasurements = t.PowerMeasurements[w.Start:w.End]
+		// Keep the logic capture aligned with the samples.
+		if len(t.Logic) >= w.End {
+			res[i].Logic = t.Logic[w.Start:w.End]
+		}
+	}
+	return res, nil
+}
+
+// Keeps only the samples selected by the mask.
+type Mask struct {
+	Mask gocw.SampleMask
+}
+
+func (m Mask) Apply(c gocw.Capture) (gocw.Capture, error) {
+	res := make(gocw.Capture, len(c))
+	for i, t := range c {
+		res[i] = t
+		res[i].PowerMeasurements = m.Mask.Apply(t.PowerMeasurements)
+		if len(t.Logic) > 0 {
+			idx := m.Mask.Indices(len(t.Logic))
+			res[i].Logic = make([]uint8, len(idx))
+			for k, j := range idx {
+				res[i].Logic[k] = t.Logic[j]
+			}
+		}
+	}
+	return res, nil
+}
+
+// Drops outlier traces, see analysis.RejectOutliers.
+type RejectOutliers struct {
+	Threshold float64
+}
+
+func (r RejectOutliers) Apply(c gocw.Capture) (gocw.Capture, error) {
+	if len(c) == 0 {
+		return c, nil
+	}
+	keep := analysis.RejectOutliers(c.SamplesMatrix(), r.Threshold)
+	glog.V(1).Infof("Rejected %d/%d outlier traces", len(c)-len(keep), len(c))
+	res := make(gocw.Capture, len(keep))
+	for i, j := range keep {
+		res[i] = c[j]
+	}
+	return res, nil
+}
+
+// Subtracts the baseline drift measured by idle baseline traces (see
+// gocw.Trace.Baseline), and drops the baselines. The baseline of each trace is
+// interpolated linearly between the surrounding baselines, or taken from the
+// nearest one before the first or after the last baseline. Captures without
+// baselines are returned unchanged.
+type SubtractBaseline struct {
+	// Subtract the baselines sample by sample, e.g. to also remove periodic
+	// idle noise. By default only the mean level of each baseline is
+	// subtracted, which doesn't add the baseline noise to the traces.
+	PerSample bool
+}
+
+func (b SubtractBaseline) Apply(c gocw.Capture) (gocw.Capture, error) {
+	idx := c.Baselines()
+	if len(idx) == 0 {
+		return c, nil
+	}
+	levels := make([][]float64, len(idx))
+	for k, i := range idx {
+		samples := gocw.Float64s(c[i].PowerMeasurements)
+		if b.PerSample {
+			levels[k] = samples
+			continue
+		}
+		mean := 0.0
+		for _, v := range samples {
+			mean += v
+		}
+		if len(samples) > 0 {
+			mean /= float64(len(samples))
+		}
+		levels[k] = []float64{mean}
+	}
+
+	res := make(gocw.Capture, 0, len(c)-len(idx))
+	// Index in idx of the last baseline before trace i.
+	prev := -1
+	for i, t := range c {
+		if t.Baseline {
+			prev++
+			continue
+		}
+		lo, hi, w := prev, prev+1, 0.0
+		switch {
+		case prev < 0:
+			lo, hi = 0, 0
+		case prev == len(idx)-1:
+			hi = lo
+		default:
+			w = float64(i-idx[lo]) / float64(idx[hi]-idx[lo])
+		}
+		if b.PerSample && (len(levels[lo]) != len(t.PowerMeasurements) || len(levels[hi]) != len(t.PowerMeasurements)) {
+			return nil, fmt.Errorf("Trace %d has %d samples, baselines have %d",
+				i, len(t.PowerMeasurements), len(levels[lo]))
+		}
+		pm := make([]gocw.Sample, len(t.PowerMeasurements))
+		for j, v := range t.PowerMeasurements {
+			k := 0
+			if b.PerSample {
+				k = j
+			}
+			pm[j] = v - gocw.Sample((1-w)*levels[lo][k]+w*levels[hi][k])
+		}
+		t.PowerMeasurements = pm
+		res = append(res, t)
+	}
+	glog.V(1).Infof("Subtracted %d baselines", len(idx))
+	return res, nil
+}
+
+// Undoes trigger jitter by shifting each trace to best match the samples
+// [Start, End) of the first trace, with the highest Pearson correlation.
+// Samples shifted in from outside a trace repeat its edge samples, so sample
+// indices are unchanged.
+type Align struct {
+	Start int
+	End   int
+	// Largest shift searched, in samples, in both directions.
+	MaxShift int
+	// Traces matching the reference with a lower correlation are not
+	// shifted, e.g. pure noise.
+	MinCorrelation float64
+}
+
+// Returns the shift of each trace: sample j of the aligned trace is sample
+// j+shift of the original one.
+func (a Align) Shifts(c gocw.Capture) ([]int, error) {
+	if len(c) == 0 {
+		return nil, nil
+	}
+	n := len(c[0].PowerMeasurements)
+	if a.Start-a.MaxShift < 0 || a.End+a.MaxShift > n || a.Start >= a.End || a.MaxShift < 0 {
+		return nil, fmt.Errorf("Alignment window [%d, %d) shifted by up to %d outside traces with %d samples",
+			a.Start, a.End, a.MaxShift, n)
+	}
+	ref := gocw.Float64s(c[0].PowerMeasurements[a.Start:a.End])
+	shifts := make([]int, len(c))
+	for i, t := range c {
+		if len(t.PowerMeasurements) != n {
+			return nil, fmt.Errorf("Trace %d has %d samples, expected %d", i, len(t.PowerMeasurements), n)
+		}
+		best, bestShift := math.Inf(-1), 0
+		for s := -a.MaxShift; s <= a.MaxShift; s++ {
+			corr := pearson(ref, t.PowerMeasurements[a.Start+s:a.End+s])
+			// Ties keep the smallest shift.
+			if corr > best || (corr == best && abs(s) < abs(bestShift)) {
+				best, bestShift = corr, s
+			}
+		}
+		if best >= a.MinCorrelation {
+			shifts[i] = bestShift
+		}
+	}
+	return shifts, nil
+}
+
+func (a Align) Apply(c gocw.Capture) (gocw.Capture, error) {
+	shifts, err := a.Shifts(c)
+	if err != nil {
+		return nil, err
+	}
+	res := make(gocw.Capture, len(c))
+	for i, t := range c {
+		n := len(t.PowerMeasurements)
+		res[i] = t
+		res[i].PowerMeasurements = make([]gocw.Sample, n)
+		for j := range res[i].PowerMeasurements {
+			res[i].PowerMeasurements[j] = t.PowerMeasurements[shiftIndex(j, shifts[i], n)]
+		}
+		// Keep the logic capture aligned with the samples.
+		if len(t.Logic) == n {
+			res[i].Logic = make([]uint8, n)
+			for j := range res[i].Logic {
+				res[i].Logic[j] = t.Logic[shiftIndex(j, shifts[i], n)]
+			}
+		}
+	}
+	glog.V(1).Infof("Aligned %d traces", len(c))
+	return res, nil
+}
+
+// Index of sample j shifted by s, clamped to [0, n).
+func shiftIndex(j, s, n int) int {
+	k := j + s
+	if k < 0 {
+		return 0
+	}
+	if k >= n {
+		return n - 1
+	}
+	return k
+}
+
+func pearson(x []float64, y []gocw.Sample) float64 {
+	var sx, sy, sxx, syy, sxy float64
+	for j := range x {
+		v := float64(y[j])
+		sx += x[j]
+		sy += v
+		sxx += x[j] * x[j]
+		syy += v * v
+		sxy += x[j] * v
+	}
+	n := float64(len(x))
+	den := math.Sqrt((n*sxx - sx*sx) * (n*syy - sy*sy))
+	if den == 0 {
+		return 0
+	}
+	return (n*sxy - sx*sy) / den
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
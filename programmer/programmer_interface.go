@@ -15,6 +15,10 @@
 package programmer
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 )
 
@@ -25,3 +29,91 @@ type ProgrammerInterface interface {
 	NewMemoryReader(addr uint32) io.Reader
 	NewMemoryWriter(addr uint32) io.Writer
 }
+
+// Implemented by programmers whose operations stop when ctx is done, e.g. on
+// a wedged bootloader, releasing the chip: the programmer must then be
+// closed.
+type ContextProgrammer interface {
+	EraseContext(ctx context.Context) error
+	NewMemoryReaderContext(ctx context.Context, addr uint32) io.Reader
+	NewMemoryWriterContext(ctx context.Context, addr uint32) io.Writer
+}
+
+// Implemented by programmers erasing only part of the flash, e.g. the pages
+// a firmware image covers.
+type RangeEraser interface {
+	EraseRange(addr, n uint32) error
+}
+
+// Same as RangeEraser, stopping when ctx is done, see ContextProgrammer.
+type ContextRangeEraser interface {
+	EraseRangeContext(ctx context.Context, addr, n uint32) error
+}
+
+// Implemented by programmers verifying memory contents with a checksum
+// computed on the chip, in one round-trip instead of reading them back.
+type Verifier interface {
+	// Returns whether the memory at addr matches data. Fails with
+	// ErrVerifyUnsupported when the chip can't check that memory.
+	Verify(ctx context.Context, addr uint32, data []byte) (bool, error)
+}
+
+var ErrVerifyUnsupported = errors.New("Checksum verification not supported")
+
+// Implemented by programmers starting the firmware directly, e.g. with a
+// bootloader jump, instead of resetting the chip on Close.
+type Runner interface {
+	Run() error
+}
+
+// Implemented by programmers checking that the flash reads erased (0xff)
+// after an erase, e.g. to catch failing flash or protected sectors before
+// writing.
+type EraseVerifier interface {
+	// Checks BlankCheckSamples blocks of the n bytes from addr, see
+	// CheckErased.
+	VerifyErase(ctx context.Context, addr, n uint32) error
+}
+
+const (
+	// Size of the blocks CheckErased reads.
+	blankCheckBlock = 64
+	// Blocks read by VerifyErase.
+	BlankCheckSamples = 16
+)
+
+// Checks that the n bytes from addr read erased, reading blocks at count
+// evenly spaced addresses, the first and last blocks included. read reads
+// len(p) bytes at addr. Stops between blocks when ctx is done.
+func CheckErased(ctx context.Context, read func(addr uint32, p []byte) error, addr, n uint32, count int) error {
+	if n == 0 {
+		return nil
+	}
+	blank := bytes.Repeat([]byte{0xff}, blankCheckBlock)
+	blocks := (n + blankCheckBlock - 1) / blankCheckBlock
+	if uint32(count) > blocks {
+		count = int(blocks)
+	}
+	buf := make([]byte, blankCheckBlock)
+	for i := 0; i < count; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		block := uint32(0)
+		if count > 1 {
+			block = uint32(i) * (blocks - 1) / uint32(count-1)
+		}
+		start := addr + block*blankCheckBlock
+		size := addr + n - start
+		if size > blankCheckBlock {
+			size = blankCheckBlock
+		}
+		if err := read(start, buf[:size]); err != nil {
+			return fmt.Errorf("Blank check read at %#x failed: %v", start, err)
+		}
+		if !bytes.Equal(buf[:size], blank[:size]) {
+			return fmt.Errorf("Flash at %#x not erased: %x", start, buf[:size])
+		}
+	}
+	return nil
+}
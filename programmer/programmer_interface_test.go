@@ -0,0 +1,53 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package programmer_test
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/gocw/programmer"
+)
+
+func TestCheckErased(t *testing.T) {
+	flash := make([]byte, 4096)
+	for i := range flash {
+		flash[i] = 0xff
+	}
+	var reads []uint32
+	read := func(addr uint32, p []byte) error {
+		reads = append(reads, addr)
+		copy(p, flash[addr-0x1000:])
+		return nil
+	}
+	if err := programmer.CheckErased(context.Background(), read, 0x1000, 4000, 4); err != nil {
+		t.Errorf("CheckErased() of blank flash failed: %v", err)
+	}
+	// 63 blocks, the last one partial.
+	if want := []uint32{0x1000, 0x1500, 0x1a40, 0x1f80}; !reflect.DeepEqual(reads, want) {
+		t.Errorf("CheckErased() read %#x, want %#x", reads, want)
+	}
+	flash[3999] = 0
+	if err := programmer.CheckErased(context.Background(), read, 0x1000, 4000, 4); err == nil || !strings.Contains(err.Error(), "0x1f80") {
+		t.Errorf("CheckErased() of written flash = %v, want an error at 0x1f80", err)
+	}
+	flash[3999] = 0xff
+	flash[64] = 0
+	if err := programmer.CheckErased(context.Background(), read, 0x1000, 4000, 4); err != nil {
+		t.Errorf("CheckErased() of a block not sampled failed: %v", err)
+	}
+}
@@ -0,0 +1,335 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Programs a SAM4S device through the SAM-BA bootloader of its ROM, over the
+// target serial port, e.g. on the CW308T-SAM4S target board.
+// The chip runs the bootloader when its flash is erased, or its GPNVM1 bit is
+// clear: erase a programmed chip with its ERASE pin first. Only the first
+// flash bank of the dual-bank SAM4SD parts is programmed.
+package sam
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/gocw"
+	"github.com/google/gocw/programmer"
+
+	"github.com/golang/glog"
+)
+
+// Implements programmer.ProgrammerInterface
+type Programmer struct {
+	dev       gocw.UsbDeviceInterface
+	adc       gocw.AdcInterface
+	ser       gocw.UsartInterface
+	name      string
+	flashSize uint32
+	// Set once the flash was written, to boot from it on Close.
+	written bool
+}
+
+const (
+	flashBase = 0x00400000
+	pageSize  = 512
+
+	// Chip identification register.
+	chipIdAddr = 0x400e0740
+
+	// Enhanced embedded flash controller registers.
+	eefcFcr   = 0x400e0a04
+	eefcFsr   = 0x400e0a08
+	fcrKey    = 0x5a << 24
+	fsrFrdy   = 1 << 0
+	fsrErrors = 0xe
+
+	// EEFC commands.
+	cmdWritePage = 0x01
+	cmdEraseAll  = 0x05
+	cmdSetGpnvm  = 0x0b
+
+	// GPNVM bit booting from flash instead of the ROM.
+	gpnvmBootFlash = 1
+
+	// Baud rate of the bootloader.
+	BaudRate = 115200
+	// Longest EEFC command, erase all.
+	eefcTimeout = 15 * time.Second
+)
+
+// Flash sizes in KB of the NVPSIZ field of the chip ID.
+var nvpSizes = map[uint32]uint32{1: 8, 2: 16, 3: 32, 5: 64, 7: 128, 9: 256, 10: 512, 12: 1024, 14: 2048}
+
+func (p *Programmer) reset() {
+	p.adc.SetNRST(gocw.GpioLow)
+	time.Sleep(10 * time.Millisecond)
+	p.adc.SetNRST(gocw.GpioHigh)
+	time.Sleep(100 * time.Millisecond)
+}
+
+// Sends a SAM-BA command, terminated by '#'.
+func (p *Programmer) command(format string, args ...interface{}) error {
+	cmd := fmt.Sprintf(format, args...) + "#"
+	glog.V(2).Infof("SAM-BA command %s", cmd)
+	if _, err := p.ser.Write([]byte(cmd)); err != nil {
+		return fmt.Errorf("Failed to write %s: %v", cmd, err)
+	}
+	return nil
+}
+
+func (p *Programmer) writeWord(addr, value uint32) error {
+	return p.command("W%08X,%08X", addr, value)
+}
+
+func (p *Programmer) readWord(addr uint32) (uint32, error) {
+	if err := p.command("w%08X,4", addr); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(p.ser, buf); err != nil {
+		return 0, fmt.Errorf("Failed to read word at %#x: %v", addr, err)
+	}
+	return binary.LittleEndian.Uint32(buf), nil
+}
+
+// Switches the bootloader to binary mode, which answers "\n\r".
+func (p *Programmer) sync() error {
+	for fails := 0; fails < 3; fails++ {
+		p.reset()
+		p.ser.Flush()
+		if err := p.command("N"); err != nil {
+			return err
+		}
+		res := make([]byte, 2)
+		_, err := io.ReadFull(p.ser, res)
+		if err == nil && string(res) == "\n\r" {
+			return nil
+		}
+		glog.Warningf("SAM-BA sync failed: %q, %v", res, err)
+	}
+	return fmt.Errorf("SAM-BA bootloader not responding, erase the chip with its ERASE pin")
+}
+
+// Reads the chip ID, and the flash size from it.
+func (p *Programmer) identify() error {
+	cidr, err := p.readWord(chipIdAddr)
+	if err != nil {
+		return err
+	}
+	if arch := (cidr >> 20) & 0xff; arch < 0x88 || arch > 0x8a {
+		return fmt.Errorf("Unsupported chip. CHIPID: %#x", cidr)
+	}
+	size, ok := nvpSizes[(cidr>>8)&0xf]
+	if !ok {
+		return fmt.Errorf("Unknown flash size in CHIPID %#x", cidr)
+	}
+	p.flashSize = size * 1024
+	p.name = fmt.Sprintf("SAM4S (%dKB flash, CHIPID %#x)", size, cidr)
+	return nil
+}
+
+// Runs an EEFC command and waits for it to complete.
+func (p *Programmer) eefc(cmd, arg uint32) error {
+	if err := p.writeWord(eefcFcr, fcrKey|arg<<8|cmd); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(eefcTimeout)
+	for {
+		fsr, err := p.readWord(eefcFsr)
+		if err != nil {
+			return err
+		}
+		if fsr&fsrErrors != 0 {
+			return fmt.Errorf("EEFC command %#x failed, FSR %#x", cmd, fsr)
+		}
+		if fsr&fsrFrdy != 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("EEFC command %#x timed out", cmd)
+		}
+	}
+}
+
+// Writes to the flash. Each write programs the pages it covers, so partial
+// pages are padded with 0xff, which leaves the bits written before unchanged.
+type memWriter struct {
+	prog *Programmer
+	addr uint32
+}
+
+func (w *memWriter) Write(p []byte) (n int, err error) {
+	for n < len(p) {
+		toWrite := len(p) - n
+		if pageEnd := (w.addr/pageSize + 1) * pageSize; w.addr+uint32(toWrite) > pageEnd {
+			toWrite = int(pageEnd - w.addr)
+		}
+		end := w.addr + uint32(toWrite)
+		if w.addr < flashBase || end > flashBase+w.prog.flashSize {
+			return n, fmt.Errorf("%d bytes at %#x are outside the %dKB flash", toWrite, w.addr, w.prog.flashSize/1024)
+		}
+		if gocw.SkipWrite("SAM4S write of %d bytes at %#x", toWrite, w.addr) {
+			n += toWrite
+			w.addr = end
+			continue
+		}
+		// Whole words, padded.
+		start := w.addr &^ 3
+		words := make([]byte, (end-start+3)&^3)
+		for i := range words {
+			words[i] = 0xff
+		}
+		copy(words[w.addr-start:], p[n:n+toWrite])
+		for i := 0; i < len(words); i += 4 {
+			if err = w.prog.writeWord(start+uint32(i), binary.LittleEndian.Uint32(words[i:])); err != nil {
+				return n, err
+			}
+		}
+		if err = w.prog.eefc(cmdWritePage, (w.addr-flashBase)/pageSize); err != nil {
+			return n, fmt.Errorf("Writing page at %#x failed: %v", w.addr, err)
+		}
+		w.prog.written = true
+		n += toWrite
+		w.addr = end
+	}
+	return n, nil
+}
+
+func (p *Programmer) NewMemoryWriter(addr uint32) io.Writer {
+	return &memWriter{p, addr}
+}
+
+// Reads memory a word at a time.
+type memReader struct {
+	prog *Programmer
+	addr uint32
+}
+
+func (r *memReader) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		word, err := r.prog.readWord(r.addr &^ 3)
+		if err != nil {
+			return n, err
+		}
+		var buf [4]byte
+		binary.LittleEndian.PutUint32(buf[:], word)
+		k := copy(p[n:], buf[r.addr&3:])
+		n += k
+		r.addr += uint32(k)
+	}
+	return n, nil
+}
+
+// Implements programmer.EraseVerifier.
+func (p *Programmer) VerifyErase(ctx context.Context, addr, n uint32) error {
+	return programmer.CheckErased(ctx, func(addr uint32, data []byte) error {
+		_, err := (&memReader{p, addr}).Read(data)
+		return err
+	}, addr, n, programmer.BlankCheckSamples)
+}
+
+func (p *Programmer) NewMemoryReader(addr uint32) io.Reader {
+	return &memReader{p, addr}
+}
+
+// Erases the whole flash. The bootloader is in ROM, so this doesn't require
+// confirmation.
+func (p *Programmer) Erase() error {
+	if gocw.SkipWrite("SAM4S erase") {
+		return nil
+	}
+	glog.Infof("Erasing flash, this can take a few seconds...")
+	if err := p.eefc(cmdEraseAll, 0); err != nil {
+		return fmt.Errorf("Erase failed: %v", err)
+	}
+	return nil
+}
+
+// Returns the name of the detected chip.
+func (p *Programmer) ChipName() string {
+	return p.name
+}
+
+// Takes ownership of dev, adc: programmer closes dev, adc on Close(). ser
+// runs at BaudRate.
+func NewProgrammerDeps(dev gocw.UsbDeviceInterface, adc gocw.AdcInterface,
+	ser gocw.UsartInterface) (*Programmer, error) {
+	p := &Programmer{dev: dev, adc: adc, ser: ser}
+	// The bootloader is entered with a reset, which dry-run mode skips.
+	if gocw.DryRun() {
+		glog.Info("Dry run, skipping SAM4S chip detection")
+		return p, nil
+	}
+	if err := p.sync(); err != nil {
+		p.Close()
+		return nil, err
+	}
+	if err := p.identify(); err != nil {
+		p.Close()
+		return nil, err
+	}
+	glog.V(1).Infof("Found supported chip %v", p.name)
+	return p, nil
+}
+
+func NewProgrammer() (*Programmer, error) {
+	var err error
+	var dev gocw.UsbDeviceInterface
+	if dev, err = gocw.OpenUsbDevice(); err != nil {
+		return nil, err
+	}
+	var fpga *gocw.Fpga
+	if fpga, err = gocw.NewFpga(dev); err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("NewFpga failed: %v", err)
+	}
+
+	var adc *gocw.Adc
+	if adc, err = gocw.NewAdc(fpga); err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("NewAdc failed: %v", err)
+	}
+
+	var ser *gocw.Usart
+	conf := gocw.DefaultUsartConfig().WithBaudRate(BaudRate)
+	if ser, err = gocw.NewUsart(dev, &conf); err != nil {
+		adc.Close()
+		dev.Close()
+		return nil, fmt.Errorf("NewUsart failed: %v", err)
+	}
+
+	return NewProgrammerDeps(dev, adc, ser)
+}
+
+// Boots the chip from flash if it was written.
+func (p *Programmer) Close() error {
+	var err error
+	if p.written {
+		if err = p.eefc(cmdSetGpnvm, gpnvmBootFlash); err != nil {
+			err = fmt.Errorf("Failed to set boot from flash: %v", err)
+		} else {
+			p.reset()
+		}
+	}
+	if p.adc != nil {
+		p.adc.Close()
+	}
+	if p.dev != nil {
+		p.dev.Close()
+	}
+	return err
+}
@@ -0,0 +1,181 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sam_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/google/gocw/mocks"
+	"github.com/google/gocw/programmer/sam"
+)
+
+// Simulates the SAM-BA bootloader of a SAM4S with 256KB of flash.
+type fakeSamBa struct {
+	cmd   []byte
+	out   bytes.Buffer
+	latch map[uint32]uint32
+	flash []byte
+	gpnvm uint32
+}
+
+func newFakeSamBa() *fakeSamBa {
+	f := &fakeSamBa{latch: map[uint32]uint32{}, flash: make([]byte, 256*1024)}
+	for i := range f.flash {
+		f.flash[i] = 0xff
+	}
+	return f
+}
+
+func (f *fakeSamBa) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if b != '#' {
+			f.cmd = append(f.cmd, b)
+			continue
+		}
+		f.exec(string(f.cmd))
+		f.cmd = nil
+	}
+	return len(p), nil
+}
+
+func (f *fakeSamBa) exec(cmd string) {
+	var addr, value uint32
+	switch {
+	case cmd == "N":
+		f.out.WriteString("\n\r")
+	case len(cmd) > 0 && cmd[0] == 'W':
+		fmt.Sscanf(cmd, "W%08X,%08X", &addr, &value)
+		if addr == 0x400e0a04 {
+			f.eefc(value)
+		} else {
+			f.latch[addr] = value
+		}
+	case len(cmd) > 0 && cmd[0] == 'w':
+		fmt.Sscanf(cmd, "w%08X,4", &addr)
+		switch {
+		case addr == 0x400e0740:
+			value = 0x89<<20 | 9<<8
+		case addr == 0x400e0a08:
+			value = 1
+		case addr >= 0x400000 && addr < 0x440000:
+			value = binary.LittleEndian.Uint32(f.flash[addr-0x400000:])
+		}
+		binary.Write(&f.out, binary.LittleEndian, value)
+	}
+}
+
+func (f *fakeSamBa) eefc(fcr uint32) {
+	arg := (fcr >> 8) & 0xffff
+	switch fcr & 0xff {
+	case 0x01:
+		for addr, value := range f.latch {
+			if (addr-0x400000)/512 == arg {
+				binary.LittleEndian.PutUint32(f.flash[addr-0x400000:], value)
+			}
+		}
+		f.latch = map[uint32]uint32{}
+	case 0x05:
+		for i := range f.flash {
+			f.flash[i] = 0xff
+		}
+	case 0x0b:
+		f.gpnvm |= 1 << arg
+	}
+}
+
+func (f *fakeSamBa) Read(p []byte) (int, error) {
+	if f.out.Len() == 0 {
+		return 0, fmt.Errorf("Read timed out")
+	}
+	return f.out.Read(p)
+}
+
+func (f *fakeSamBa) ReadContext(ctx context.Context, p []byte) (int, error) {
+	return f.Read(p)
+}
+
+func (f *fakeSamBa) Flush() error {
+	f.out.Reset()
+	return nil
+}
+
+func (f *fakeSamBa) Timeout() time.Duration           { return time.Second }
+func (f *fakeSamBa) SetTimeout(timeout time.Duration) {}
+
+func TestProgrammer(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	dev := mocks.NewMockUsbDeviceInterface(mockCtrl)
+	adc := mocks.NewMockAdcInterface(mockCtrl)
+	adc.EXPECT().SetNRST(gomock.Any()).AnyTimes()
+	adc.EXPECT().Close().Return(nil)
+	dev.EXPECT().Close().Return(nil)
+	ser := newFakeSamBa()
+
+	p, err := sam.NewProgrammerDeps(dev, adc, ser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := p.ChipName(); name != "SAM4S (256KB flash, CHIPID 0x8900900)" {
+		t.Errorf("ChipName() = %q", name)
+	}
+	ser.flash[0] = 0
+	if err := p.Erase(); err != nil {
+		t.Fatal(err)
+	}
+	if ser.flash[0] != 0xff {
+		t.Errorf("Erase() left flash unchanged")
+	}
+	if err := p.VerifyErase(context.Background(), 0x400000, 256*1024); err != nil {
+		t.Errorf("VerifyErase() after Erase() failed: %v", err)
+	}
+
+	// Unaligned, across a page boundary.
+	data := make([]byte, 700)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if _, err := p.NewMemoryWriter(0x400003).Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if ser.flash[2] != 0xff || ser.flash[703] != 0xff || !bytes.Equal(ser.flash[3:703], data) {
+		t.Errorf("Write() programmed the wrong flash bytes")
+	}
+	if err := p.VerifyErase(context.Background(), 0x400000, 1024); err == nil {
+		t.Errorf("VerifyErase() of written flash succeeded")
+	}
+	read, err := ioutil.ReadAll(io.LimitReader(p.NewMemoryReader(0x400003), int64(len(data))))
+	if err != nil || !bytes.Equal(read, data) {
+		t.Errorf("Read() = %v, want the bytes written", err)
+	}
+	if _, err := p.NewMemoryWriter(0x43ffff).Write([]byte{1, 2}); err == nil {
+		t.Errorf("Write() past the end of the flash succeeded")
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if ser.gpnvm != 1<<1 {
+		t.Errorf("Close() set GPNVM %#b, want boot from flash", ser.gpnvm)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// STM32 chip database.
+// Product IDs returned by the bootloader Get ID command, from AN2606, and the
+// flash layouts from the reference manuals: uniform pages on the F0, F1, F3
+// and L4, sectors of growing sizes on the F2 and F4.
+package stm32f
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Base address of the main flash.
+const flashBase = 0x08000000
+
+// Count erase units (pages or sectors) of Size bytes.
+type FlashBlock struct {
+	Size  uint32
+	Count int
+}
+
+type ChipProperties struct {
+	Name      string
+	Signature [2]byte
+	// Erase units of the main flash, in address order.
+	Flash []FlashBlock
+	// Address and size of the option bytes.
+	OptionBytes, OptionBytesSize uint32
+	// Offset of the readout protection byte in the option bytes, and its
+	// values for levels 0 and 2. Other values are level 1. RdpLevel2 is
+	// zero on chips without level 2, e.g. the F1.
+	RdpOffset            uint32
+	RdpLevel0, RdpLevel2 byte
+}
+
+// Size of the main flash.
+func (c *ChipProperties) FlashSize() uint32 {
+	var size uint32
+	for _, b := range c.Flash {
+		size += b.Size * uint32(b.Count)
+	}
+	return size
+}
+
+// Number of erase units of the main flash.
+func (c *ChipProperties) Pages() int {
+	n := 0
+	for _, b := range c.Flash {
+		n += b.Count
+	}
+	return n
+}
+
+// Returns the numbers of the first and last erase units covering n > 0 bytes
+// from addr, failing if they extend past the main flash.
+func (c *ChipProperties) PageRange(addr, n uint32) (int, int, error) {
+	if addr < flashBase || addr-flashBase+n > c.FlashSize() || n == 0 {
+		return 0, 0, fmt.Errorf("%d bytes at %#x are outside the %dKB flash of %s", n, addr, c.FlashSize()/1024, c.Name)
+	}
+	first, last := -1, -1
+	start, page := uint32(flashBase), 0
+	for _, b := range c.Flash {
+		for i := 0; i < b.Count; i, page = i+1, page+1 {
+			end := start + b.Size
+			if first < 0 && addr < end {
+				first = page
+			}
+			if last < 0 && addr+n <= end {
+				last = page
+			}
+			start = end
+		}
+	}
+	return first, last, nil
+}
+
+func (c *ChipProperties) pageSize(page int) uint32 {
+	for _, b := range c.Flash {
+		if page < b.Count {
+			return b.Size
+		}
+		page -= b.Count
+	}
+	return 0
+}
+
+func pid(id uint16) [2]byte {
+	return [2]byte{byte(id >> 8), byte(id)}
+}
+
+// Uniform pages of page KB.
+func pages(sizeKB, pageKB uint32) []FlashBlock {
+	return []FlashBlock{{pageKB * 1024, int(sizeKB / pageKB)}}
+}
+
+// Sectors of the F2 and F4 banks: four of 16KB, one of 64KB, then 128KB ones.
+func sectors(sizeKB uint32) []FlashBlock {
+	return []FlashBlock{{16 * 1024, 4}, {64 * 1024, 1}, {128 * 1024, int(sizeKB-128) / 128}}
+}
+
+func chip(name string, id uint16, flash []FlashBlock) ChipProperties {
+	c := ChipProperties{Name: name, Signature: pid(id), Flash: flash, RdpLevel0: 0xaa, RdpLevel2: 0xcc}
+	switch {
+	case strings.HasPrefix(name, "STM32F2"), strings.HasPrefix(name, "STM32F4"):
+		// The RDP byte follows the user byte.
+		c.OptionBytes, c.OptionBytesSize = 0x1fffc000, 16
+		c.RdpOffset = 1
+	case strings.HasPrefix(name, "STM32L4"):
+		c.OptionBytes, c.OptionBytesSize = 0x1fff7800, 40
+	default:
+		c.OptionBytes, c.OptionBytesSize = 0x1ffff800, 16
+	}
+	if strings.HasPrefix(name, "STM32F10") {
+		c.RdpLevel0, c.RdpLevel2 = 0xa5, 0
+	}
+	return c
+}
+
+var SupportedChips = map[string]ChipProperties{
+	"STM32F03x4/6":   chip("STM32F03x4/6", 0x444, pages(32, 1)),
+	"STM32F04x":      chip("STM32F04x", 0x445, pages(32, 1)),
+	"STM32F05x":      chip("STM32F05x", 0x440, pages(64, 1)),
+	"STM32F07x":      chip("STM32F07x", 0x448, pages(128, 2)),
+	"STM32F09x":      chip("STM32F09x", 0x442, pages(256, 2)),
+	"STM32F10x-LD":   chip("STM32F10x-LD", 0x412, pages(32, 1)),
+	"STM32F10x-MD":   chip("STM32F10x-MD", 0x410, pages(128, 1)),
+	"STM32F10x-HD":   chip("STM32F10x-HD", 0x414, pages(512, 2)),
+	"STM32F10x-XL":   chip("STM32F10x-XL", 0x430, pages(1024, 2)),
+	"STM32F10x-CL":   chip("STM32F10x-CL", 0x418, pages(256, 2)),
+	"STM32F100-LDMD": chip("STM32F100-LDMD", 0x420, pages(128, 1)),
+	"STM32F2xx":      chip("STM32F2xx", 0x411, sectors(1024)),
+	"STM32F303cBC":   chip("STM32F303cBC", 0x422, pages(256, 2)),
+	"STM32F303x6/8":  chip("STM32F303x6/8", 0x438, pages(64, 2)),
+	"STM32F303xD/E":  chip("STM32F303xD/E", 0x446, pages(512, 2)),
+	"STM32F373":      chip("STM32F373", 0x432, pages(256, 2)),
+	"STM32F40x/41x":  chip("STM32F40x/41x", 0x413, sectors(1024)),
+	"STM32F42x/43x":  chip("STM32F42x/43x", 0x419, append(sectors(1024), sectors(1024)...)),
+	"STM32F401xB/C":  chip("STM32F401xB/C", 0x423, sectors(256)),
+	"STM32F401xD/E":  chip("STM32F401xD/E", 0x433, sectors(512)),
+	"STM32F411":      chip("STM32F411", 0x431, sectors(512)),
+	"STM32L43x/44x":  chip("STM32L43x/44x", 0x435, pages(256, 2)),
+	"STM32L45x/46x":  chip("STM32L45x/46x", 0x462, pages(512, 2)),
+	"STM32L47x/48x":  chip("STM32L47x/48x", 0x415, pages(1024, 2)),
+}
+
+// Returns the chip with the product ID id.
+func LookupChip(id []byte) (*ChipProperties, error) {
+	for _, chip := range SupportedChips {
+		if string(chip.Signature[:]) == string(id) {
+			return &chip, nil
+		}
+	}
+	return nil, fmt.Errorf("Unsupported chip. Signature: %x", id)
+}
@@ -0,0 +1,56 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stm32f_test
+
+import (
+	"testing"
+
+	"github.com/google/gocw/programmer/stm32f"
+)
+
+func TestChipPageRange(t *testing.T) {
+	chip, err := stm32f.LookupChip([]byte{0x04, 0x13})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chip.FlashSize() != 1024*1024 || chip.Pages() != 12 {
+		t.Errorf("%s has %d bytes in %d sectors, want 1MB in 12", chip.Name, chip.FlashSize(), chip.Pages())
+	}
+	for _, test := range []struct {
+		addr, n     uint32
+		first, last int
+	}{
+		{0x08000000, 1, 0, 0},
+		{0x08000000, 0x10000, 0, 3},
+		{0x08004000, 0x10001, 1, 4},
+		{0x080e0000, 0x20000, 11, 11},
+	} {
+		first, last, err := chip.PageRange(test.addr, test.n)
+		if err != nil || first != test.first || last != test.last {
+			t.Errorf("PageRange(%#x, %#x) = %d, %d, %v, want %d, %d", test.addr, test.n, first, last, err, test.first, test.last)
+		}
+	}
+	if _, _, err := chip.PageRange(0x080e0000, 0x20001); err == nil {
+		t.Errorf("PageRange() past the end of the flash succeeded")
+	}
+
+	chip, err = stm32f.LookupChip([]byte{0x04, 0x22})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first, last, err := chip.PageRange(0x08000800, 0x1000); err != nil || first != 1 || last != 2 {
+		t.Errorf("PageRange(0x8000800, 0x1000) = %d, %d, %v, want pages 1 to 2", first, last, err)
+	}
+}
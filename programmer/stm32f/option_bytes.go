@@ -0,0 +1,213 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// STM32 option bytes and readout protection.
+// The F0, F1 and F3 store each option byte followed by its complement, see
+// OptionBytes. The F2, F4 and L4 layouts are read and written raw.
+// Readout protection level 1 blocks the bootloader memory commands and debug
+// accesses to the flash. The bootloader sets it, and clears it with a mass
+// erase.
+package stm32f
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/gocw"
+
+	"github.com/golang/glog"
+)
+
+// Option bytes of the F0, F1 and F3, with Get and Set on their indices.
+type OptionBytes []byte
+
+// Indices of the F0, F1 and F3 option bytes.
+const (
+	OptRdp   = 0
+	OptUser  = 1
+	OptData0 = 2
+	OptData1 = 3
+	OptWrp0  = 4
+)
+
+// OptUser bits.
+const (
+	UserWdgSw     = 1 << 0 // Software watchdog, else started on reset.
+	UserNRstStop  = 1 << 1
+	UserNRstStdby = 1 << 2
+	UserNBoot1    = 1 << 4
+)
+
+// Returns option byte i, failing if its complement doesn't match.
+func (o OptionBytes) Get(i int) (byte, error) {
+	if 2*i+1 >= len(o) {
+		return 0, fmt.Errorf("No option byte %d", i)
+	}
+	if o[2*i]^o[2*i+1] != 0xff {
+		return 0, fmt.Errorf("Option byte %d %#x doesn't match its complement %#x", i, o[2*i], o[2*i+1])
+	}
+	return o[2*i], nil
+}
+
+// Sets option byte i and its complement.
+func (o OptionBytes) Set(i int, v byte) {
+	o[2*i] = v
+	o[2*i+1] = ^v
+}
+
+// Returns an error if data can't be written to the option bytes of the chip:
+// its size differs, or it sets readout protection level 2, which permanently
+// disables debug and the bootloader.
+func (c *ChipProperties) CheckOptionBytes(data OptionBytes) error {
+	if uint32(len(data)) != c.OptionBytesSize {
+		return fmt.Errorf("Got %d option bytes, want %d for %s", len(data), c.OptionBytesSize, c.Name)
+	}
+	if c.RdpLevel2 != 0 && data[c.RdpOffset] == c.RdpLevel2 {
+		return fmt.Errorf("Readout protection level 2 is permanent, refusing to write it")
+	}
+	return nil
+}
+
+// Address and size of the option bytes of the chip.
+func (p *Programmer) optionBytes() (uint32, uint32) {
+	if p.chip == nil || p.chip.OptionBytesSize == 0 {
+		return optionBytesAddr, optionBytesSize
+	}
+	return p.chip.OptionBytes, p.chip.OptionBytesSize
+}
+
+// Reads the option bytes. Fails while readout protection is active.
+func (p *Programmer) ReadOptionBytes() (OptionBytes, error) {
+	ctx := context.Background()
+	addr, size := p.optionBytes()
+	data := make([]byte, size)
+	if err := p.cmdReadMemory(ctx, addr, data); err != nil {
+		return nil, fmt.Errorf("Reading option bytes failed: %v", err)
+	}
+	return data, nil
+}
+
+// Writes the option bytes, e.g. modified from ReadOptionBytes. Requires
+// gocw.OpOptionBytes confirmation, and refuses readout protection level 2,
+// which can't be undone. The bootloader resets the chip once the option
+// bytes are written, and the programmer resynchronizes with it.
+func (p *Programmer) WriteOptionBytes(data OptionBytes) error {
+	ctx := context.Background()
+	// The readout protection levels depend on the chip.
+	if p.chip == nil {
+		return fmt.Errorf("Unknown chip, refusing to write option bytes")
+	}
+	if err := p.chip.CheckOptionBytes(data); err != nil {
+		return err
+	}
+	addr := p.chip.OptionBytes
+	if err := gocw.RequireConfirmed(gocw.OpOptionBytes); err != nil {
+		return err
+	}
+	if gocw.SkipWrite("STM32 option bytes write %x", []byte(data)) {
+		return nil
+	}
+	if err := p.cmdWriteMemory(ctx, addr, data); err != nil {
+		return fmt.Errorf("Writing option bytes failed: %v", err)
+	}
+	if err := p.initChip(ctx); err != nil {
+		return fmt.Errorf("Chip not responding after the option bytes write: %v", err)
+	}
+	return nil
+}
+
+// Returns an error unless data, written at addr over some of the option
+// bytes, may be written: as WriteOptionBytes, it requires gocw.OpOptionBytes
+// confirmation and refuses readout protection level 2, checked on the current
+// option bytes merged with data.
+func (p *Programmer) checkOptionBytesWrite(ctx context.Context, addr uint32, data []byte) error {
+	if p.chip == nil {
+		return fmt.Errorf("Unknown chip, refusing to write option bytes")
+	}
+	if err := gocw.RequireConfirmed(gocw.OpOptionBytes); err != nil {
+		return err
+	}
+	ob := make(OptionBytes, p.chip.OptionBytesSize)
+	if err := p.cmdReadMemory(ctx, p.chip.OptionBytes, ob); err != nil {
+		return fmt.Errorf("Reading option bytes failed: %v", err)
+	}
+	for i, b := range data {
+		if a := addr + uint32(i); a >= p.chip.OptionBytes && a-p.chip.OptionBytes < p.chip.OptionBytesSize {
+			ob[a-p.chip.OptionBytes] = b
+		}
+	}
+	return p.chip.CheckOptionBytes(ob)
+}
+
+// Returns whether readout protection is active: the bootloader then refuses
+// memory reads.
+func (p *Programmer) ReadoutProtected() (bool, error) {
+	ctx := context.Background()
+	err := p.cmdReadMemory(ctx, flashBase, make([]byte, 4))
+	if errors.Is(err, errNack) {
+		return true, nil
+	}
+	return false, err
+}
+
+// Enables readout protection level 1. Requires gocw.OpOptionBytes
+// confirmation. The bootloader resets the chip, and the programmer
+// resynchronizes with it.
+func (p *Programmer) SetReadoutProtection() error {
+	ctx := context.Background()
+	if err := gocw.RequireConfirmed(gocw.OpOptionBytes); err != nil {
+		return err
+	}
+	if gocw.SkipWrite("STM32 readout protect") {
+		return nil
+	}
+	if err := p.cmdGeneric(ctx, CmdReadoutProtect); err != nil {
+		return fmt.Errorf("CmdReadoutProtect failed: %v", err)
+	}
+	if err := p.waitForAck(ctx); err != nil {
+		return fmt.Errorf("Readout protect failed: %v", err)
+	}
+	if err := p.initChip(ctx); err != nil {
+		return fmt.Errorf("Chip not responding after readout protect: %v", err)
+	}
+	return nil
+}
+
+// Disables readout protection, which mass erases the flash, and resets the
+// option bytes on some chips. Requires gocw.OpOptionBytes confirmation. The
+// bootloader resets the chip, and the programmer resynchronizes with it.
+func (p *Programmer) ClearReadoutProtection() error {
+	ctx := context.Background()
+	if err := gocw.RequireConfirmed(gocw.OpOptionBytes); err != nil {
+		return err
+	}
+	if gocw.SkipWrite("STM32 readout unprotect and mass erase") {
+		return nil
+	}
+	if err := p.cmdGeneric(ctx, CmdReadoutUnprotect); err != nil {
+		return fmt.Errorf("CmdReadoutUnprotect failed: %v", err)
+	}
+	t := p.ser.Timeout()
+	defer p.ser.SetTimeout(t)
+	glog.Infof("Readout unprotect, mass erasing the flash...")
+	p.ser.SetTimeout(p.massEraseTimeout())
+	if err := p.waitForAck(ctx); err != nil {
+		return fmt.Errorf("Readout unprotect failed: %v", err)
+	}
+	if err := p.initChip(ctx); err != nil {
+		return fmt.Errorf("Chip not responding after readout unprotect: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stm32f_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/google/gocw"
+	"github.com/google/gocw/mocks"
+	"github.com/google/gocw/programmer/stm32f"
+)
+
+func TestOptionBytes(t *testing.T) {
+	ob := stm32f.OptionBytes{0xaa, 0x55, 0xff, 0x00, 0xff, 0xff}
+	if v, err := ob.Get(stm32f.OptRdp); err != nil || v != 0xaa {
+		t.Errorf("Get(OptRdp) = %#x, %v, want level 0", v, err)
+	}
+	ob.Set(stm32f.OptUser, 0xff&^stm32f.UserWdgSw)
+	if v, err := ob.Get(stm32f.OptUser); err != nil || v != 0xfe || ob[3] != 0x01 {
+		t.Errorf("Get(OptUser) = %#x, %v after Set(0xfe), bytes %x", v, err, ob)
+	}
+	if _, err := ob.Get(stm32f.OptData0); err == nil {
+		t.Errorf("Get() of a byte not matching its complement succeeded")
+	}
+	if _, err := ob.Get(3); err == nil {
+		t.Errorf("Get() past the option bytes succeeded")
+	}
+}
+
+func TestWriteOptionBytesRefused(t *testing.T) {
+	p := &stm32f.Programmer{}
+	if err := p.WriteOptionBytes(make(stm32f.OptionBytes, 16)); err == nil {
+		t.Errorf("WriteOptionBytes() succeeded without a known chip")
+	}
+}
+
+func TestCheckOptionBytes(t *testing.T) {
+	f0 := stm32f.SupportedChips["STM32F05x"]
+	ob := make(stm32f.OptionBytes, 16)
+	ob.Set(stm32f.OptRdp, f0.RdpLevel0)
+	if err := f0.CheckOptionBytes(ob); err != nil {
+		t.Errorf("CheckOptionBytes() of level 0 on %s: %v", f0.Name, err)
+	}
+	ob.Set(stm32f.OptRdp, f0.RdpLevel2)
+	if err := f0.CheckOptionBytes(ob); err == nil {
+		t.Errorf("CheckOptionBytes() of readout protection level 2 succeeded on %s", f0.Name)
+	}
+	if err := f0.CheckOptionBytes(ob[:8]); err == nil {
+		t.Errorf("CheckOptionBytes() of 8 bytes succeeded")
+	}
+
+	// The F1 has no level 2: 0xa5 is level 0, any other value level 1.
+	f1 := stm32f.SupportedChips["STM32F10x-MD"]
+	if f1.RdpLevel0 != 0xa5 || f1.RdpLevel2 != 0 {
+		t.Errorf("%s RDP levels 0 %#x and 2 %#x, want 0xa5 and none", f1.Name, f1.RdpLevel0, f1.RdpLevel2)
+	}
+	ob.Set(stm32f.OptRdp, 0xcc)
+	if err := f1.CheckOptionBytes(ob); err != nil {
+		t.Errorf("CheckOptionBytes() of level 1 on %s: %v", f1.Name, err)
+	}
+
+	// The F4 RDP byte follows the user byte.
+	f4 := stm32f.SupportedChips["STM32F40x/41x"]
+	raw := make(stm32f.OptionBytes, 16)
+	raw[0], raw[1] = f4.RdpLevel2, f4.RdpLevel0
+	if err := f4.CheckOptionBytes(raw); err != nil {
+		t.Errorf("CheckOptionBytes() of level 0 on %s: %v", f4.Name, err)
+	}
+	raw[1] = f4.RdpLevel2
+	if err := f4.CheckOptionBytes(raw); err == nil {
+		t.Errorf("CheckOptionBytes() of readout protection level 2 succeeded on %s", f4.Name)
+	}
+}
+
+func TestMemoryWriterRefusesReadoutProtectionLevel2(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	dev := mocks.NewMockUsbDeviceInterface(mockCtrl)
+	adc := mocks.NewMockAdcInterface(mockCtrl)
+	ser := mocks.NewMockUsartInterface(mockCtrl)
+
+	adc.EXPECT().SetPDIC(gomock.Any()).AnyTimes()
+	adc.EXPECT().SetNRST(gomock.Any()).AnyTimes()
+	ser.EXPECT().Flush().AnyTimes()
+	var sent []byte
+	ser.EXPECT().Write(gomock.Any()).DoAndReturn(func(b []byte) (int, error) {
+		sent = append(sent, b...)
+		return len(b), nil
+	}).AnyTimes()
+	var replies []byte
+	ser.EXPECT().ReadContext(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, b []byte) (int, error) {
+		n := copy(b, replies)
+		replies = replies[n:]
+		return n, nil
+	}).AnyTimes()
+
+	// Sync, the Get command listing Read Memory, and the STM32F05x id.
+	replies = []byte{0x79, 0x79, 1, 0x31, 0x11, 0x79, 0x79, 1, 0x04, 0x40, 0x79}
+	p, err := stm32f.NewProgrammerDeps(dev, adc, ser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f0 := stm32f.SupportedChips["STM32F05x"]
+	if p.ChipName() != f0.Name {
+		t.Fatalf("Detected %q, want %s", p.ChipName(), f0.Name)
+	}
+
+	gocw.Confirm(gocw.OpOptionBytes)
+	defer gocw.Unconfirm(gocw.OpOptionBytes)
+	// The current option bytes are read, at level 0, and the image sets the
+	// RDP byte to level 2.
+	current := make(stm32f.OptionBytes, 16)
+	current.Set(stm32f.OptRdp, f0.RdpLevel0)
+	replies = append([]byte{0x79, 0x79, 0x79}, current...)
+	record := []byte{f0.RdpLevel2, ^f0.RdpLevel2}
+	sent = nil
+	if _, err := p.NewMemoryWriter(f0.OptionBytes).Write(record); err == nil {
+		t.Errorf("Writing RDP %#x to the option bytes succeeded", f0.RdpLevel2)
+	}
+	// Read Memory of the 16 option bytes at 0x1ffff800, and no write.
+	if want := []byte{0x11, 0xee, 0x1f, 0xff, 0xf8, 0x00, 0x18, 0x0f, 0xf0}; !bytes.Equal(sent, want) {
+		t.Errorf("Sent %x, want only the option bytes read %x", sent, want)
+	}
+
+	adc.EXPECT().Close()
+	dev.EXPECT().Close()
+	p.Close()
+}
+
+func TestReadoutProtected(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	dev := mocks.NewMockUsbDeviceInterface(mockCtrl)
+	adc := mocks.NewMockAdcInterface(mockCtrl)
+	ser := mocks.NewMockUsartInterface(mockCtrl)
+
+	// Skips the chip detection.
+	gocw.SetDryRun(true)
+	p, err := stm32f.NewProgrammerDeps(dev, adc, ser)
+	gocw.SetDryRun(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replies []byte
+	ser.EXPECT().Write(gomock.Any()).DoAndReturn(func(b []byte) (int, error) { return len(b), nil }).AnyTimes()
+	ser.EXPECT().ReadContext(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, b []byte) (int, error) {
+		n := copy(b, replies)
+		replies = replies[n:]
+		return n, nil
+	}).AnyTimes()
+
+	// Read memory command NACKed.
+	replies = []byte{0x1f}
+	if protected, err := p.ReadoutProtected(); err != nil || !protected {
+		t.Errorf("ReadoutProtected() = %v, %v after NACK, want true", protected, err)
+	}
+	// Command, address and length ACKed, then the data.
+	replies = []byte{0x79, 0x79, 0x79, 1, 2, 3, 4}
+	if protected, err := p.ReadoutProtected(); err != nil || protected {
+		t.Errorf("ReadoutProtected() = %v, %v after a read, want false", protected, err)
+	}
+
+	adc.EXPECT().Close()
+	dev.EXPECT().Close()
+	p.Close()
+}
@@ -18,12 +18,15 @@ package stm32f
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"time"
 
 	"github.com/google/gocw"
+	"github.com/google/gocw/programmer"
 
 	"github.com/golang/glog"
 )
@@ -35,18 +38,8 @@ type Programmer struct {
 	ser      gocw.UsartInterface
 	commands map[byte]bool // supported commands.
 	chip     *ChipProperties
-}
-
-type ChipProperties struct {
-	Name      string
-	Signature [2]byte
-}
-
-var SupportedChips = map[string]ChipProperties{
-	"STM32F303cBC": ChipProperties{
-		"STM32F303cBC",      // name
-		[2]byte{0x04, 0x22}, // signature
-	},
+	// Set once Run started the firmware.
+	running bool
 }
 
 //go:generate stringer -type Command
@@ -56,9 +49,21 @@ const (
 	CmdGetAvailableCommands Command = 0x00
 	CmdGetId                Command = 0x02
 	CmdReadMemory           Command = 0x11
+	CmdGo                   Command = 0x21
 	CmdWriteMemory          Command = 0x31
 	CmdEraseMemory          Command = 0x43
 	CmdExtendedEraseMemory  Command = 0x44
+	CmdReadoutProtect       Command = 0x82
+	CmdReadoutUnprotect     Command = 0x92
+	CmdGetChecksum          Command = 0xA1
+)
+
+// Option bytes of the STM32F3, when the chip is unknown. Writing them can
+// enable permanent readout protection, so it requires gocw.OpOptionBytes
+// confirmation.
+const (
+	optionBytesAddr = 0x1FFFF800
+	optionBytesSize = 16
 )
 
 func (p *Programmer) setBoot(enterBootLoader bool) {
@@ -76,11 +81,13 @@ func (p *Programmer) reset() {
 	time.Sleep(25 * time.Millisecond)
 }
 
-func (p *Programmer) waitForAck() error {
+var errNack = errors.New("Target returned NACK")
+
+func (p *Programmer) waitForAck(ctx context.Context) error {
 	res := make([]byte, 1)
-	n, err := p.ser.Read(res)
+	n, err := p.ser.ReadContext(ctx, res)
 	if err != nil {
-		return fmt.Errorf("Read failed with %v", err)
+		return fmt.Errorf("Read failed with %w", err)
 	}
 	if n == 0 {
 		return fmt.Errorf("Read ack timed out")
@@ -90,14 +97,13 @@ func (p *Programmer) waitForAck() error {
 		// ACK
 		return nil
 	case 0x1F:
-		// NACK
-		return fmt.Errorf("Target returned NACK")
+		return errNack
 	default:
 		return fmt.Errorf("Unknown response %02x", res[0])
 	}
 }
 
-func (p *Programmer) initChip() error {
+func (p *Programmer) initChip(ctx context.Context) error {
 	glog.V(1).Info("Initializing chip")
 	p.setBoot(true)
 	for fails := 0; fails < 5; fails++ {
@@ -108,7 +114,7 @@ func (p *Programmer) initChip() error {
 
 		p.ser.Flush()
 		p.ser.Write([]byte{'\x7F'})
-		err := p.waitForAck()
+		err := p.waitForAck(ctx)
 		if err == nil {
 			return nil
 		}
@@ -124,32 +130,57 @@ func (p *Programmer) releaseChip() {
 	p.reset()
 }
 
-func (p *Programmer) cmdGeneric(cmd Command) error {
+// Reads the serial port until ctx is done.
+type contextReader struct {
+	ctx context.Context
+	ser gocw.UsartInterface
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	return r.ser.ReadContext(r.ctx, p)
+}
+
+func (p *Programmer) reader(ctx context.Context) io.Reader {
+	return contextReader{ctx, p.ser}
+}
+
+// Releases the chip when an operation failed because ctx is done, as the
+// bootloader may be left in the middle of a command.
+func (p *Programmer) abort(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+	glog.Warningf("Operation stopped, releasing the chip: %v", err)
+	p.releaseChip()
+	return err
+}
+
+func (p *Programmer) cmdGeneric(ctx context.Context, cmd Command) error {
 	glog.V(2).Infof("Executing command %v", cmd)
 	p.ser.Write([]byte{byte(cmd)})
 	p.ser.Write([]byte{byte(cmd) ^ 0xFF}) // control byte
-	return p.waitForAck()
+	return p.waitForAck(ctx)
 }
 
-func (p *Programmer) cmdGetAvailableCommands() error {
+func (p *Programmer) cmdGetAvailableCommands(ctx context.Context) error {
 	var err error
-	if err = p.cmdGeneric(CmdGetAvailableCommands); err != nil {
+	if err = p.cmdGeneric(ctx, CmdGetAvailableCommands); err != nil {
 		return fmt.Errorf("CmdGetAvailableCommands failed: %v", err)
 	}
 	glog.V(1).Infof("*** Get command")
 	l := make([]byte, 1)
-	if _, err = p.ser.Read(l); err != nil {
+	if _, err = p.reader(ctx).Read(l); err != nil {
 		return fmt.Errorf("Failed reading len %v", err)
 	}
 	ver := make([]byte, 1)
-	if _, err = p.ser.Read(ver); err != nil {
+	if _, err = p.reader(ctx).Read(ver); err != nil {
 		return fmt.Errorf("Failed reading version %v", err)
 	}
 	commands := make([]byte, l[0])
-	if _, err = p.ser.Read(commands); err != nil {
+	if _, err = io.ReadFull(p.reader(ctx), commands); err != nil {
 		return fmt.Errorf("Failed reading commands %v", err)
 	}
-	if err = p.waitForAck(); err != nil {
+	if err = p.waitForAck(ctx); err != nil {
 		return fmt.Errorf("Ack failed %v", err)
 	}
 	for _, c := range commands {
@@ -160,29 +191,29 @@ func (p *Programmer) cmdGetAvailableCommands() error {
 	return nil
 }
 
-func (p *Programmer) cmdGetId() ([]byte, error) {
+func (p *Programmer) cmdGetId(ctx context.Context) ([]byte, error) {
 	var err error
-	if err = p.cmdGeneric(CmdGetId); err != nil {
+	if err = p.cmdGeneric(ctx, CmdGetId); err != nil {
 		return nil, fmt.Errorf("CmdGetId failed: %v", err)
 	}
 	glog.V(1).Infof("*** GetID command")
 	l := make([]byte, 1)
-	if _, err = p.ser.Read(l); err != nil {
+	if _, err = p.reader(ctx).Read(l); err != nil {
 		return nil, fmt.Errorf("Failed reading len %v", err)
 	}
 	id := make([]byte, l[0]+1)
-	if _, err = p.ser.Read(id); err != nil {
+	if _, err = io.ReadFull(p.reader(ctx), id); err != nil {
 		return nil, fmt.Errorf("Failed reading id %v", err)
 	}
-	if err = p.waitForAck(); err != nil {
+	if err = p.waitForAck(ctx); err != nil {
 		return nil, fmt.Errorf("Ack failed %v", err)
 	}
 	return id, nil
 }
 
-func (p *Programmer) cmdExtendedEraseMemory() error {
+func (p *Programmer) cmdExtendedEraseMemory(ctx context.Context) error {
 	var err error
-	if err = p.cmdGeneric(CmdExtendedEraseMemory); err != nil {
+	if err = p.cmdGeneric(ctx, CmdExtendedEraseMemory); err != nil {
 		return fmt.Errorf("CmdExtendedEraseMemory failed: %v", err)
 	}
 	glog.V(1).Infof("*** Extended erase memory command")
@@ -195,22 +226,85 @@ func (p *Programmer) cmdExtendedEraseMemory() error {
 	defer p.ser.SetTimeout(t)
 
 	glog.Infof("Extended erase, this can take a few seconds...")
-	p.ser.SetTimeout(30 * time.Second)
-	return p.waitForAck()
+	p.ser.SetTimeout(p.massEraseTimeout())
+	return p.waitForAck(ctx)
+}
+
+// Mass erase takes up to 32s per MB of flash on the F4, at 3.3V.
+func (p *Programmer) massEraseTimeout() time.Duration {
+	timeout := 30 * time.Second
+	if p.chip != nil {
+		if t := time.Duration(p.chip.FlashSize()>>20) * 32 * time.Second; t > timeout {
+			timeout = t
+		}
+	}
+	return timeout
+}
+
+// Erases pages first to last, with the 2-byte page numbers of the extended
+// erase command if supported.
+func (p *Programmer) cmdErasePages(ctx context.Context, first, last int) error {
+	_, extended := p.commands[byte(CmdExtendedEraseMemory)]
+	t := p.ser.Timeout()
+	defer p.ser.SetTimeout(t)
+	// Pages per command.
+	const maxPages = 255
+	for ; first <= last; first += maxPages {
+		n := last - first + 1
+		if n > maxPages {
+			n = maxPages
+		}
+		var buf []byte
+		cmd := CmdEraseMemory
+		if extended {
+			cmd = CmdExtendedEraseMemory
+			buf = append(buf, byte((n-1)>>8), byte(n-1))
+			for i := first; i < first+n; i++ {
+				buf = append(buf, byte(i>>8), byte(i))
+			}
+		} else {
+			if first+n > 256 {
+				return fmt.Errorf("Page %d can't be erased without the extended erase command", first+n-1)
+			}
+			buf = append(buf, byte(n-1))
+			for i := first; i < first+n; i++ {
+				buf = append(buf, byte(i))
+			}
+		}
+		var crc byte
+		for _, b := range buf {
+			crc ^= b
+		}
+		if err := p.cmdGeneric(ctx, cmd); err != nil {
+			return fmt.Errorf("%v failed: %v", cmd, err)
+		}
+		glog.V(1).Infof("*** Erasing pages %d to %d", first, first+n-1)
+		var size uint32
+		for i := first; i < first+n; i++ {
+			size += p.chip.pageSize(i)
+		}
+		// Up to 32s per MB, as the mass erase, with a second of margin.
+		p.ser.SetTimeout(time.Second + time.Duration(size)*32*time.Second>>20)
+		p.ser.Write(append(buf, crc))
+		if err := p.waitForAck(ctx); err != nil {
+			return fmt.Errorf("Erasing pages %d to %d failed: %v", first, first+n-1, err)
+		}
+	}
+	return nil
 }
 
-func (p *Programmer) cmdEraseMemory() error {
+func (p *Programmer) cmdEraseMemory(ctx context.Context) error {
 	if _, ok := p.commands[0x44]; ok {
-		return p.cmdExtendedEraseMemory()
+		return p.cmdExtendedEraseMemory(ctx)
 	}
 	var err error
-	if err = p.cmdGeneric(CmdEraseMemory); err != nil {
+	if err = p.cmdGeneric(ctx, CmdEraseMemory); err != nil {
 		return fmt.Errorf("CmdEraseMemory failed: %v", err)
 	}
 	glog.V(1).Infof("*** Extended memory command")
 	// Global erase
 	p.ser.Write([]byte{0xff, 0x00})
-	return p.waitForAck()
+	return p.waitForAck(ctx)
 }
 
 func encodeAddr(addr uint32) []byte {
@@ -226,7 +320,7 @@ func encodeAddr(addr uint32) []byte {
 	return buf.Bytes()
 }
 
-func (p *Programmer) cmdWriteMemory(addr uint32, data []byte) error {
+func (p *Programmer) cmdWriteMemory(ctx context.Context, addr uint32, data []byte) error {
 	var toWrite []byte
 	if len(data)%4 > 0 {
 		// Copy of data, with padding bytes.
@@ -239,12 +333,12 @@ func (p *Programmer) cmdWriteMemory(addr uint32, data []byte) error {
 		toWrite = data
 	}
 	var err error
-	if err = p.cmdGeneric(CmdWriteMemory); err != nil {
+	if err = p.cmdGeneric(ctx, CmdWriteMemory); err != nil {
 		return fmt.Errorf("CmdWriteMemory failed: %v", err)
 	}
 	glog.V(2).Infof("*** Write memory command")
 	p.ser.Write(encodeAddr(addr))
-	if err = p.waitForAck(); err != nil {
+	if err = p.waitForAck(ctx); err != nil {
 		return fmt.Errorf("Write addr failed: %v", err)
 	}
 	n := byte(len(toWrite) - 1)
@@ -256,36 +350,111 @@ func (p *Programmer) cmdWriteMemory(addr uint32, data []byte) error {
 		crc ^= c
 	}
 	p.ser.Write([]byte{crc})
-	if err = p.waitForAck(); err != nil {
+	if err = p.waitForAck(ctx); err != nil {
 		return fmt.Errorf("Write failed: %v", err)
 	}
 	return nil
 }
 
-func (p *Programmer) cmdReadMemory(addr uint32, data []byte) error {
+func (p *Programmer) cmdReadMemory(ctx context.Context, addr uint32, data []byte) error {
 	var err error
-	if err = p.cmdGeneric(CmdReadMemory); err != nil {
-		return fmt.Errorf("CmdReadMemory failed: %v", err)
+	if err = p.cmdGeneric(ctx, CmdReadMemory); err != nil {
+		// NACK with readout protection, see ReadoutProtected.
+		return fmt.Errorf("CmdReadMemory failed: %w", err)
 	}
 	glog.V(2).Infof("*** Read memory command")
 	p.ser.Write(encodeAddr(addr))
-	if err = p.waitForAck(); err != nil {
+	if err = p.waitForAck(ctx); err != nil {
 		return fmt.Errorf("Read addr failed: %v", err)
 	}
 	n := byte(len(data) - 1)
 	crc := n ^ 0xff
 	p.ser.Write([]byte{n, crc})
-	if err = p.waitForAck(); err != nil {
+	if err = p.waitForAck(ctx); err != nil {
 		return fmt.Errorf("Read len failed: %v", err)
 	}
-	if _, err = p.ser.Read(data); err != nil {
+	if _, err = io.ReadFull(p.reader(ctx), data); err != nil {
 		return fmt.Errorf("Read data failed: %v", err)
 	}
 	return nil
 }
 
+// Returns the CRC of the n bytes at addr, both multiples of 4, computed by
+// the bootloader (AN3155 Get Checksum, bootloader v3.3 and later).
+func (p *Programmer) cmdGetChecksum(ctx context.Context, addr, n uint32) (uint32, error) {
+	var err error
+	if err = p.cmdGeneric(ctx, CmdGetChecksum); err != nil {
+		return 0, fmt.Errorf("CmdGetChecksum failed: %v", err)
+	}
+	glog.V(2).Infof("*** Get checksum command")
+	p.ser.Write(encodeAddr(addr))
+	if err = p.waitForAck(ctx); err != nil {
+		return 0, fmt.Errorf("Checksum addr failed: %v", err)
+	}
+	p.ser.Write(encodeAddr(n))
+	if err = p.waitForAck(ctx); err != nil {
+		return 0, fmt.Errorf("Checksum len failed: %v", err)
+	}
+	// Ack once the CRC is computed.
+	if err = p.waitForAck(ctx); err != nil {
+		return 0, fmt.Errorf("Checksum failed: %v", err)
+	}
+	res := make([]byte, 5)
+	if _, err = io.ReadFull(p.reader(ctx), res); err != nil {
+		return 0, fmt.Errorf("Read checksum failed: %v", err)
+	}
+	// The CRC and its XOR checksum, like an address.
+	if !bytes.Equal(encodeAddr(binary.BigEndian.Uint32(res)), res) {
+		return 0, fmt.Errorf("Bad checksum response %x", res)
+	}
+	return binary.BigEndian.Uint32(res), nil
+}
+
+// CRC of the STM32 CRC unit: CRC-32 polynomial, MSB first, on little endian
+// words, without final XOR.
+func crc32Stm32(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for i := 0; i < len(data); i += 4 {
+		crc ^= binary.LittleEndian.Uint32(data[i:])
+		for bit := 0; bit < 32; bit++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// Implements programmer.Verifier, with the bootloader CRC of the memory.
+// Writes pad partial words with 0xff, so data is padded alike.
+func (p *Programmer) Verify(ctx context.Context, addr uint32, data []byte) (bool, error) {
+	if !p.commands[byte(CmdGetChecksum)] || addr%4 != 0 {
+		return false, programmer.ErrVerifyUnsupported
+	}
+	padded := append([]byte{}, data...)
+	for len(padded)%4 > 0 {
+		padded = append(padded, 0xff)
+	}
+	crc, err := p.cmdGetChecksum(ctx, addr, uint32(len(padded)))
+	if err != nil {
+		return false, err
+	}
+	glog.V(1).Infof("Flash CRC %#x, expected %#x", crc, crc32Stm32(padded))
+	return crc == crc32Stm32(padded), nil
+}
+
+// Implements programmer.EraseVerifier.
+func (p *Programmer) VerifyErase(ctx context.Context, addr, n uint32) error {
+	return programmer.CheckErased(ctx, func(addr uint32, data []byte) error {
+		return p.cmdReadMemory(ctx, addr, data)
+	}, addr, n, programmer.BlankCheckSamples)
+}
+
 // Writes to FLASH/EEPROM memory.
 type memWriter struct {
+	ctx       context.Context
 	prog      *Programmer
 	addr      uint32
 	blockSize int
@@ -294,13 +463,32 @@ type memWriter struct {
 func (w *memWriter) Write(p []byte) (n int, err error) {
 	// Write memory in small chunks.
 	for n < len(p) {
+		if err = w.ctx.Err(); err != nil {
+			return n, w.prog.abort(w.ctx, err)
+		}
 		toWrite := len(p) - n
 		if toWrite > w.blockSize {
 			toWrite = w.blockSize
 		}
 
-		if err = w.prog.cmdWriteMemory(w.addr, p[n:n+toWrite]); err != nil {
-			return n, fmt.Errorf("cmdWriteMemory failed: %v", err)
+		end := w.addr + uint32(toWrite)
+		if chip := w.prog.chip; chip != nil && w.addr>>24 == flashBase>>24 {
+			if _, _, err = chip.PageRange(w.addr, uint32(toWrite)); err != nil {
+				return n, err
+			}
+		}
+		if addr, size := w.prog.optionBytes(); w.addr < addr+size && end > addr {
+			if err = w.prog.checkOptionBytesWrite(w.ctx, w.addr, p[n:n+toWrite]); err != nil {
+				return n, err
+			}
+		}
+		if gocw.SkipWrite("STM32 write of %d bytes at %#x", toWrite, w.addr) {
+			n += toWrite
+			w.addr = end
+			continue
+		}
+		if err = w.prog.cmdWriteMemory(w.ctx, w.addr, p[n:n+toWrite]); err != nil {
+			return n, w.prog.abort(w.ctx, fmt.Errorf("cmdWriteMemory failed: %w", err))
 		}
 
 		n += toWrite
@@ -310,11 +498,18 @@ func (w *memWriter) Write(p []byte) (n int, err error) {
 }
 
 func (p *Programmer) NewMemoryWriter(addr uint32) io.Writer {
-	return &memWriter{p, addr, 64}
+	return p.NewMemoryWriterContext(context.Background(), addr)
+}
+
+// Same as NewMemoryWriter, failing writes and releasing the chip when ctx is
+// done.
+func (p *Programmer) NewMemoryWriterContext(ctx context.Context, addr uint32) io.Writer {
+	return &memWriter{ctx, p, addr, 64}
 }
 
 // Reads from FLASH/EEPROM memory.
 type memReader struct {
+	ctx       context.Context
 	prog      *Programmer
 	addr      uint32
 	blockSize int
@@ -323,13 +518,16 @@ type memReader struct {
 func (r *memReader) Read(p []byte) (n int, err error) {
 	// Read memory in small chunks.
 	for n < len(p) {
+		if err = r.ctx.Err(); err != nil {
+			return n, r.prog.abort(r.ctx, err)
+		}
 		toRead := len(p) - n
 		if toRead > r.blockSize {
 			toRead = r.blockSize
 		}
 
-		if err = r.prog.cmdReadMemory(r.addr, p[n:n+toRead]); err != nil {
-			return n, fmt.Errorf("cmdReadMemory failed: %v", err)
+		if err = r.prog.cmdReadMemory(r.ctx, r.addr, p[n:n+toRead]); err != nil {
+			return n, r.prog.abort(r.ctx, fmt.Errorf("cmdReadMemory failed: %w", err))
 		}
 
 		n += toRead
@@ -339,40 +537,51 @@ func (r *memReader) Read(p []byte) (n int, err error) {
 }
 
 func (p *Programmer) NewMemoryReader(addr uint32) io.Reader {
-	return &memReader{p, addr, 64}
+	return p.NewMemoryReaderContext(context.Background(), addr)
+}
+
+// Same as NewMemoryReader, failing reads and releasing the chip when ctx is
+// done.
+func (p *Programmer) NewMemoryReaderContext(ctx context.Context, addr uint32) io.Reader {
+	return &memReader{ctx, p, addr, 64}
 }
 
 func (p *Programmer) findChip() (*ChipProperties, error) {
 	var err error
-	if err = p.initChip(); err != nil {
+	ctx := context.Background()
+	if err = p.initChip(ctx); err != nil {
 		p.releaseChip()
 		return nil, fmt.Errorf("initChip failed: %v", err)
 	}
-	if err = p.cmdGetAvailableCommands(); err != nil {
+	if err = p.cmdGetAvailableCommands(ctx); err != nil {
 		p.releaseChip()
 		return nil, fmt.Errorf("cmdGet failed: %v", err)
 	}
 	var id []byte
-	if id, err = p.cmdGetId(); err != nil {
+	if id, err = p.cmdGetId(ctx); err != nil {
 		p.releaseChip()
 		return nil, fmt.Errorf("cmdGetId failed: %v", err)
 	}
 
-	for _, chip := range SupportedChips {
-		if bytes.Equal(chip.Signature[:], id) {
-			return &chip, nil
-		}
+	chip, err := LookupChip(id)
+	if err != nil {
+		p.releaseChip()
+		return nil, err
 	}
-
-	p.releaseChip()
-	return nil, fmt.Errorf("Unsupported chip. Signature: %v", id)
+	return chip, nil
 }
 
 // Takes ownership of dev, adc: programmer closes dev, adc on Close().
 func NewProgrammerDeps(dev gocw.UsbDeviceInterface, adc gocw.AdcInterface,
 	ser gocw.UsartInterface) (*Programmer, error) {
 	var err error
-	p := &Programmer{dev, adc, ser, make(map[byte]bool), nil}
+	p := &Programmer{dev, adc, ser, make(map[byte]bool), nil, false}
+	// The bootloader entry sequence drives nRST and BOOT0, which dry-run
+	// mode skips.
+	if gocw.DryRun() {
+		glog.Info("Dry run, skipping STM32 chip detection")
+		return p, nil
+	}
 
 	if p.chip, err = p.findChip(); err != nil {
 		return nil, fmt.Errorf("findChip failed: %v", err)
@@ -382,10 +591,18 @@ func NewProgrammerDeps(dev gocw.UsbDeviceInterface, adc gocw.AdcInterface,
 	return p, nil
 }
 
+// Returns the name of the detected chip.
+func (p *Programmer) ChipName() string {
+	if p.chip == nil {
+		return ""
+	}
+	return p.chip.Name
+}
+
 func NewProgrammer() (*Programmer, error) {
 	var err error
 	var dev gocw.UsbDeviceInterface
-	if dev, err = gocw.OpenCwLiteUsbDevice(); err != nil {
+	if dev, err = gocw.OpenUsbDevice(); err != nil {
 		return nil, err
 	}
 	var fpga *gocw.Fpga
@@ -401,9 +618,8 @@ func NewProgrammer() (*Programmer, error) {
 	}
 
 	var ser *gocw.Usart
-	if ser, err = gocw.NewUsart(dev,
-		&gocw.UsartConfig{
-			gocw.BaudRateLow, gocw.StopBitsOne, gocw.ParityEven, gocw.DataBitsOneByte}); err != nil {
+	conf := gocw.DefaultUsartConfig().WithParity(gocw.ParityEven)
+	if ser, err = gocw.NewUsart(dev, &conf); err != nil {
 		adc.Close()
 		dev.Close()
 		return nil, fmt.Errorf("NewUsart failed: %v", err)
@@ -412,8 +628,29 @@ func NewProgrammer() (*Programmer, error) {
 	return NewProgrammerDeps(dev, adc, ser)
 }
 
+// Implements programmer.Runner. Jumps to the firmware at the start of the
+// flash with the bootloader Go command, without resetting the chip, which
+// then stays out of the bootloader.
+func (p *Programmer) Run() error {
+	if gocw.SkipWrite("STM32 go to %#x", flashBase) {
+		return nil
+	}
+	// Later resets boot the flash too.
+	p.setBoot(false)
+	ctx := context.Background()
+	if err := p.cmdGeneric(ctx, CmdGo); err != nil {
+		return fmt.Errorf("CmdGo failed: %v", err)
+	}
+	p.ser.Write(encodeAddr(flashBase))
+	if err := p.waitForAck(ctx); err != nil {
+		return fmt.Errorf("Go address failed: %v", err)
+	}
+	p.running = true
+	return nil
+}
+
 func (p *Programmer) Close() error {
-	if p.chip != nil {
+	if p.chip != nil && !p.running {
 		p.releaseChip()
 	}
 	if p.adc != nil {
@@ -425,6 +662,42 @@ func (p *Programmer) Close() error {
 	return nil
 }
 
+// Mass erases the flash. The bootloader is in system memory, and the option
+// bytes are kept, so this doesn't require confirmation.
 func (p *Programmer) Erase() error {
-	return p.cmdEraseMemory()
+	return p.EraseContext(context.Background())
+}
+
+// Same as Erase, failing and releasing the chip when ctx is done.
+func (p *Programmer) EraseContext(ctx context.Context) error {
+	if gocw.SkipWrite("STM32 mass erase") {
+		return nil
+	}
+	return p.abort(ctx, p.cmdEraseMemory(ctx))
+}
+
+// Implements programmer.RangeEraser. Erases the pages or sectors covering n
+// bytes from addr, which is faster than a mass erase for small images on the
+// large sectors of the F2 and F4, and keeps the rest of the flash. Mass
+// erases if the chip is unknown.
+func (p *Programmer) EraseRange(addr, n uint32) error {
+	return p.EraseRangeContext(context.Background(), addr, n)
+}
+
+// Same as EraseRange, failing and releasing the chip when ctx is done.
+func (p *Programmer) EraseRangeContext(ctx context.Context, addr, n uint32) error {
+	if p.chip == nil {
+		return p.EraseContext(ctx)
+	}
+	first, last, err := p.chip.PageRange(addr, n)
+	if err != nil {
+		return err
+	}
+	if first == 0 && last == p.chip.Pages()-1 {
+		return p.EraseContext(ctx)
+	}
+	if gocw.SkipWrite("STM32 erase of pages %d to %d", first, last) {
+		return nil
+	}
+	return p.abort(ctx, p.cmdErasePages(ctx, first, last))
 }
@@ -0,0 +1,100 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stm32f_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/google/gocw"
+	"github.com/google/gocw/mocks"
+	"github.com/google/gocw/programmer"
+	"github.com/google/gocw/programmer/stm32f"
+)
+
+var _ programmer.ContextProgrammer = &stm32f.Programmer{}
+var _ programmer.ContextRangeEraser = &stm32f.Programmer{}
+var _ programmer.Runner = &stm32f.Programmer{}
+
+func TestContextReleasesChip(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	dev := mocks.NewMockUsbDeviceInterface(mockCtrl)
+	adc := mocks.NewMockAdcInterface(mockCtrl)
+	ser := mocks.NewMockUsartInterface(mockCtrl)
+
+	// Skips the chip detection.
+	gocw.SetDryRun(true)
+	p, err := stm32f.NewProgrammerDeps(dev, adc, ser)
+	gocw.SetDryRun(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ser.EXPECT().Write(gomock.Any()).DoAndReturn(func(b []byte) (int, error) { return len(b), nil }).AnyTimes()
+	// The bootloader stops answering, until the read is cancelled.
+	ser.EXPECT().ReadContext(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, b []byte) (int, error) {
+		cancel()
+		return 0, ctx.Err()
+	})
+	gomock.InOrder(
+		adc.EXPECT().SetPDIC(gocw.GpioLow),
+		adc.EXPECT().SetNRST(gocw.GpioLow),
+		adc.EXPECT().SetNRST(gocw.GpioHigh),
+	)
+	if _, err := p.NewMemoryReaderContext(ctx, 0x08000000).Read(make([]byte, 4)); !errors.Is(err, context.Canceled) {
+		t.Errorf("Read() = %v, want context.Canceled", err)
+	}
+
+	adc.EXPECT().Close()
+	dev.EXPECT().Close()
+	p.Close()
+}
+
+func TestRun(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	dev := mocks.NewMockUsbDeviceInterface(mockCtrl)
+	adc := mocks.NewMockAdcInterface(mockCtrl)
+	ser := mocks.NewMockUsartInterface(mockCtrl)
+
+	// Skips the chip detection.
+	gocw.SetDryRun(true)
+	p, err := stm32f.NewProgrammerDeps(dev, adc, ser)
+	gocw.SetDryRun(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent bytes.Buffer
+	ser.EXPECT().Write(gomock.Any()).DoAndReturn(sent.Write).AnyTimes()
+	ser.EXPECT().ReadContext(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, b []byte) (int, error) {
+		b[0] = 0x79
+		return 1, nil
+	}).Times(2)
+	adc.EXPECT().SetPDIC(gocw.GpioLow)
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0x21, 0xde, 0x08, 0, 0, 0, 0x08}; !bytes.Equal(sent.Bytes(), want) {
+		t.Errorf("Run() sent %x, want %x", sent.Bytes(), want)
+	}
+
+	adc.EXPECT().Close()
+	dev.EXPECT().Close()
+	p.Close()
+}
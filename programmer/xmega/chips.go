@@ -0,0 +1,102 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// XMEGA chip database.
+// Signatures and memory maps from the XMEGA A and D series datasheets. The
+// U variants share the signatures of the parts they replace.
+package xmega
+
+import (
+	"fmt"
+)
+
+type MemRegion struct {
+	MemType MemoryType
+	Offset  uint32
+	Size    uint32
+	// Bytes written per page.
+	PageSize uint32
+}
+
+type ChipProperties struct {
+	Name      string
+	Signature [3]byte
+	// Application and boot sections.
+	Flash  MemRegion
+	Eeprom MemRegion
+	// Size of the application section, at the start of Flash.
+	AppSize uint32
+	// Memory map guessed from the signature, see LookupChip.
+	Unknown bool
+}
+
+const (
+	flashOffset  = 0x0800000
+	eepromOffset = 0x08c0000
+)
+
+// Flash of size KB plus a boot section, and EEPROM of eeprom KB.
+func xmega(name string, sig [3]byte, size, boot, page, eeprom uint32) ChipProperties {
+	return ChipProperties{
+		Name:      name,
+		Signature: sig,
+		Flash:     MemRegion{MemTypeApp, flashOffset, (size + boot) * 1024, page},
+		Eeprom:    MemRegion{MemTypeEeprom, eepromOffset, eeprom * 1024, 32},
+		AppSize:   size * 1024,
+	}
+}
+
+var SupportedChips = map[string]ChipProperties{
+	"XMEGA16A4U":   xmega("XMEGA16A4U", [3]byte{0x1e, 0x94, 0x41}, 16, 4, 256, 1),
+	"XMEGA16D4":    xmega("XMEGA16D4", [3]byte{0x1e, 0x94, 0x42}, 16, 4, 256, 1),
+	"XMEGA32A4U":   xmega("XMEGA32A4U", [3]byte{0x1e, 0x95, 0x41}, 32, 4, 256, 1),
+	"XMEGA32D4":    xmega("XMEGA32D4", [3]byte{0x1e, 0x95, 0x42}, 32, 4, 256, 1),
+	"XMEGA64A4U":   xmega("XMEGA64A4U", [3]byte{0x1e, 0x96, 0x46}, 64, 4, 256, 2),
+	"XMEGA64D4":    xmega("XMEGA64D4", [3]byte{0x1e, 0x96, 0x47}, 64, 4, 256, 2),
+	"XMEGA128A4U":  xmega("XMEGA128A4U", [3]byte{0x1e, 0x97, 0x46}, 128, 8, 256, 2),
+	"XMEGA128D4":   xmega("XMEGA128D4", [3]byte{0x1e, 0x97, 0x47}, 128, 8, 256, 2),
+	"XMEGA64A3U":   xmega("XMEGA64A3U", [3]byte{0x1e, 0x96, 0x42}, 64, 4, 256, 2),
+	"XMEGA64D3":    xmega("XMEGA64D3", [3]byte{0x1e, 0x96, 0x4a}, 64, 4, 256, 2),
+	"XMEGA128A3U":  xmega("XMEGA128A3U", [3]byte{0x1e, 0x97, 0x42}, 128, 8, 512, 2),
+	"XMEGA128D3":   xmega("XMEGA128D3", [3]byte{0x1e, 0x97, 0x48}, 128, 8, 512, 2),
+	"XMEGA192A3U":  xmega("XMEGA192A3U", [3]byte{0x1e, 0x97, 0x44}, 192, 8, 512, 2),
+	"XMEGA192D3":   xmega("XMEGA192D3", [3]byte{0x1e, 0x97, 0x49}, 192, 8, 512, 2),
+	"XMEGA256A3U":  xmega("XMEGA256A3U", [3]byte{0x1e, 0x98, 0x42}, 256, 8, 512, 4),
+	"XMEGA256A3BU": xmega("XMEGA256A3BU", [3]byte{0x1e, 0x98, 0x43}, 256, 8, 512, 4),
+	"XMEGA256D3":   xmega("XMEGA256D3", [3]byte{0x1e, 0x98, 0x44}, 256, 8, 512, 4),
+	"XMEGA64A1U":   xmega("XMEGA64A1U", [3]byte{0x1e, 0x96, 0x4e}, 64, 4, 256, 2),
+	"XMEGA128A1U":  xmega("XMEGA128A1U", [3]byte{0x1e, 0x97, 0x4c}, 128, 8, 512, 2),
+}
+
+// Returns the chip with signature sig. Unknown Atmel chips get a memory map
+// guessed from the signature, whose second byte is 0x90 plus log2 of the
+// flash size in KB, with the smallest pages and EEPROM of the series.
+func LookupChip(sig [3]byte) (*ChipProperties, error) {
+	for _, chip := range SupportedChips {
+		if chip.Signature == sig {
+			return &chip, nil
+		}
+	}
+	if sig[0] != 0x1e || sig[1] < 0x94 || sig[1] > 0x98 {
+		return nil, fmt.Errorf("Unsupported chip. Signature: %x", sig)
+	}
+	size := uint32(1) << (sig[1] - 0x90)
+	boot := uint32(4)
+	if size >= 128 {
+		boot = 8
+	}
+	chip := xmega(fmt.Sprintf("XMEGA%d (unknown, signature %x)", size, sig), sig, size, boot, 256, 1)
+	chip.Unknown = true
+	return &chip, nil
+}
@@ -0,0 +1,44 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xmega_test
+
+import (
+	"testing"
+
+	"github.com/google/gocw/programmer/xmega"
+)
+
+func TestLookupChip(t *testing.T) {
+	chip, err := xmega.LookupChip([3]byte{0x1e, 0x98, 0x42})
+	if err != nil || chip.Name != "XMEGA256A3U" || chip.Unknown || chip.Flash.Size != 264*1024 || chip.Flash.PageSize != 512 {
+		t.Errorf("LookupChip(1e9842) = %+v, %v, want XMEGA256A3U", chip, err)
+	}
+	// Signatures are unique.
+	seen := map[[3]byte]string{}
+	for name, chip := range xmega.SupportedChips {
+		if other, ok := seen[chip.Signature]; ok {
+			t.Errorf("%s and %s share signature %x", name, other, chip.Signature)
+		}
+		seen[chip.Signature] = name
+	}
+
+	chip, err = xmega.LookupChip([3]byte{0x1e, 0x97, 0x7f})
+	if err != nil || !chip.Unknown || chip.Flash.Size != 136*1024 {
+		t.Errorf("LookupChip(1e977f) = %+v, %v, want an unknown 128KB chip", chip, err)
+	}
+	if _, err := xmega.LookupChip([3]byte{0xff, 0xff, 0xff}); err == nil {
+		t.Errorf("LookupChip(ffffff) succeeded")
+	}
+}
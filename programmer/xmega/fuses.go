@@ -0,0 +1,132 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// XMEGA fuses and lock bits.
+// Bit fields from the XMEGA AU manual. Fuse bits are programmed at 0, so
+// unprogrammed fuses read 0xff.
+package xmega
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/gocw"
+)
+
+const (
+	fuseAddr     = 0x008f0020
+	lockBitsAddr = 0x008f0027
+)
+
+// Fuse bytes, FUSEBYTE3 doesn't exist.
+const (
+	FuseWatchdog = 1 // WDWPER[7:4], WDPER[3:0].
+	FuseBoot     = 2 // BOOTRST, BODPD[1:0].
+	FuseStartup  = 4 // RSTDISBL, STARTUPTIME[1:0], WDLOCK.
+	FuseBod      = 5 // BODACT[1:0], EESAVE, BODLEVEL[2:0].
+)
+
+// Fuse bits and fields.
+const (
+	FuseBootRst   = 1 << 6 // Boots the application section when set.
+	FuseBodPd     = 3 << 0 // BOD mode in power-down.
+	FuseRstDisbl  = 1 << 4 // Disables the reset pin when cleared.
+	FuseWdLock    = 1 << 1 // Locks the watchdog when cleared.
+	FuseBodAct    = 3 << 4 // BOD mode when active.
+	FuseEeSave    = 1 << 3 // Keeps the EEPROM on chip erase when cleared.
+	FuseBodLevel  = 7 << 0 // 0 is 3.0V to 7 is 1.6V.
+	BodDisabled   = 3      // BODPD and BODACT value.
+	BodContinuous = 2      // BODPD and BODACT value.
+)
+
+// Lock bits. Cleared fields restrict accesses, and only a chip erase resets
+// them to LockBitsUnlocked.
+const (
+	LockBitsUnlocked = 0xff
+	LockLb           = 3 << 0 // External programming and debug accesses.
+	LockBlbat        = 3 << 2 // Application table section.
+	LockBlba         = 3 << 4 // Application section.
+	LockBlbb         = 3 << 6 // Boot section.
+)
+
+func (p *Programmer) readByte(addr uint32) (byte, error) {
+	var b [1]byte
+	if _, err := (&memReader{context.Background(), p, addr, 1}).Read(b[:]); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (p *Programmer) writeByte(memType MemoryType, addr uint32, v byte) error {
+	w := &memWriter{context.Background(), p, memType, addr, addr + 1, 1}
+	_, err := w.Write([]byte{v})
+	return err
+}
+
+// Reads fuse byte n.
+func (p *Programmer) ReadFuse(n int) (byte, error) {
+	if n < 0 || n > 5 || n == 3 {
+		return 0, fmt.Errorf("No fuse byte %d", n)
+	}
+	v, err := p.readByte(fuseAddr + uint32(n))
+	if err != nil {
+		return 0, fmt.Errorf("Reading fuse byte %d failed: %v", n, err)
+	}
+	return v, nil
+}
+
+// Writes fuse byte n, e.g. modified from ReadFuse. Requires gocw.OpFuses
+// confirmation.
+func (p *Programmer) WriteFuse(n int, v byte) error {
+	if n < 0 || n > 5 || n == 3 {
+		return fmt.Errorf("No fuse byte %d", n)
+	}
+	if err := gocw.RequireConfirmed(gocw.OpFuses); err != nil {
+		return err
+	}
+	if err := p.writeByte(MemTypeFuse, fuseAddr+uint32(n), v); err != nil {
+		return fmt.Errorf("Writing fuse byte %d failed: %v", n, err)
+	}
+	return nil
+}
+
+func (p *Programmer) ReadLockBits() (byte, error) {
+	v, err := p.readByte(lockBitsAddr)
+	if err != nil {
+		return 0, fmt.Errorf("Reading lock bits failed: %v", err)
+	}
+	return v, nil
+}
+
+// Writes the lock bits. Requires gocw.OpFuses confirmation. Bits can only be
+// cleared: EraseChip sets them back.
+func (p *Programmer) WriteLockBits(v byte) error {
+	if err := gocw.RequireConfirmed(gocw.OpFuses); err != nil {
+		return err
+	}
+	if err := p.writeByte(MemTypeLockbits, lockBitsAddr, v); err != nil {
+		return fmt.Errorf("Writing lock bits failed: %v", err)
+	}
+	return nil
+}
+
+// Returns whether lock bits restrict accesses, and ProgramDevice needs a chip
+// erase (see gocw.OpChipErase) to program the application section.
+func (p *Programmer) Locked() (bool, error) {
+	v, err := p.ReadLockBits()
+	if err != nil {
+		return false, err
+	}
+	return v != LockBitsUnlocked, nil
+}
@@ -0,0 +1,41 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xmega_test
+
+import (
+	"testing"
+
+	"github.com/google/gocw"
+	"github.com/google/gocw/programmer"
+	"github.com/google/gocw/programmer/xmega"
+)
+
+var _ programmer.ContextProgrammer = &xmega.Programmer{}
+var _ programmer.Runner = &xmega.Programmer{}
+
+func TestWriteFuseRefused(t *testing.T) {
+	p := &xmega.Programmer{}
+	if err := p.WriteFuse(xmega.FuseBod, 0xff); err == nil {
+		t.Errorf("WriteFuse() succeeded without confirmation")
+	}
+	if err := p.WriteLockBits(0xfc); err == nil {
+		t.Errorf("WriteLockBits() succeeded without confirmation")
+	}
+	gocw.Confirm(gocw.OpFuses)
+	defer gocw.Unconfirm(gocw.OpFuses)
+	if err := p.WriteFuse(3, 0xff); err == nil {
+		t.Errorf("WriteFuse(3) succeeded")
+	}
+}
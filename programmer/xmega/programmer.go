@@ -17,12 +17,14 @@
 package xmega
 
 import (
-	"bytes"
+	"context"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"time"
 
 	"github.com/google/gocw"
+	"github.com/google/gocw/programmer"
 
 	"github.com/golang/glog"
 )
@@ -31,6 +33,8 @@ import (
 type Programmer struct {
 	dev  gocw.UsbDeviceInterface
 	chip *ChipProperties
+	// Set once Run left programming mode.
+	running bool
 }
 
 const (
@@ -46,6 +50,9 @@ const (
 
 	signatureAddr = 0x01000090
 	signatureSize = 3
+
+	// CRC types.
+	crcApp = 1
 )
 
 type MemoryType uint8
@@ -61,36 +68,6 @@ const (
 	MemTypeFactoryCalibration MemoryType = 7
 )
 
-type MemRegion struct {
-	MemType MemoryType
-	Offset  uint32
-	Size    uint32
-}
-
-type ChipProperties struct {
-	Name      string
-	Signature [3]byte
-	Flash     MemRegion
-	Eeprom    MemRegion
-}
-
-var SupportedChips = map[string]ChipProperties{
-	"XMEGA128D4": ChipProperties{
-		"XMEGA128D4",              // name
-		[3]byte{0x1e, 0x97, 0x47}, // signature
-		MemRegion{ // flash
-			MemTypeApp,
-			0x0800000,
-			0x00022000,
-		},
-		MemRegion{ // eeprom
-			MemTypeEeprom,
-			0x08c0000,
-			0x0800,
-		},
-	},
-}
-
 //go:generate stringer -type Command
 type Command uint16
 
@@ -188,6 +165,7 @@ func (p *Programmer) disablePDI() error {
 // Reads from FLASH/EEPROM memory.
 // Implements io.Reader.
 type memReader struct {
+	ctx       context.Context
 	prog      *Programmer
 	addr      uint32
 	chunkSize int
@@ -202,6 +180,9 @@ func (r *memReader) Read(p []byte) (n int, err error) {
 
 	// Read memory in small chunks.
 	for n < len(p) {
+		if err = r.ctx.Err(); err != nil {
+			return n, r.prog.abort(err)
+		}
 		toRead := len(p) - n
 		if toRead > r.chunkSize {
 			toRead = r.chunkSize
@@ -227,16 +208,32 @@ func (r *memReader) Read(p []byte) (n int, err error) {
 	return n, nil
 }
 
+// Implements programmer.EraseVerifier. Like NewMemoryWriter, checks from the
+// start of the flash, whatever addr.
+func (p *Programmer) VerifyErase(ctx context.Context, addr, n uint32) error {
+	return programmer.CheckErased(ctx, func(addr uint32, data []byte) error {
+		_, err := (&memReader{ctx, p, addr, 64}).Read(data)
+		return err
+	}, p.chip.Flash.Offset, n, programmer.BlankCheckSamples)
+}
+
 func (p *Programmer) NewMemoryReader(addr uint32) io.Reader {
+	return p.NewMemoryReaderContext(context.Background(), addr)
+}
+
+// Same as NewMemoryReader, failing reads and releasing the chip when ctx is
+// done.
+func (p *Programmer) NewMemoryReaderContext(ctx context.Context, addr uint32) io.Reader {
 	if p.chip != nil {
 		addr = p.chip.Flash.Offset
 	}
-	return &memReader{p, addr, 64}
+	return &memReader{ctx, p, addr, 64}
 }
 
 // Writes to FLASH/EEPROM memory.
 // Implements io.Writer.
 type memWriter struct {
+	ctx       context.Context
 	prog      *Programmer
 	memType   MemoryType
 	addr      uint32
@@ -254,6 +251,9 @@ func (w *memWriter) Write(p []byte) (n int, err error) {
 
 	// Write memory in small chunks.
 	for n < len(p) {
+		if err = w.ctx.Err(); err != nil {
+			return n, w.prog.abort(err)
+		}
 		toWrite := len(p) - n
 		if toWrite > w.chunkSize {
 			toWrite = w.chunkSize
@@ -262,6 +262,11 @@ func (w *memWriter) Write(p []byte) (n int, err error) {
 		if w.addr+uint32(toWrite) > w.maxAddr {
 			return n, io.ErrShortWrite
 		}
+		if gocw.SkipWrite("XMEGA write of %d bytes at %#x", toWrite, w.addr) {
+			n += toWrite
+			w.addr += uint32(toWrite)
+			continue
+		}
 
 		info := infoBlock{}
 		info.typ = uint8(w.memType)
@@ -284,30 +289,42 @@ func (w *memWriter) Write(p []byte) (n int, err error) {
 }
 
 func (p *Programmer) NewMemoryWriter(addr uint32) io.Writer {
-	region := p.chip.Flash
-	return &memWriter{p, region.MemType, region.Offset, region.Offset + region.Size, 64}
+	return p.NewMemoryWriterContext(context.Background(), addr)
+}
+
+// Same as NewMemoryWriter, failing writes and releasing the chip when ctx is
+// done.
+func (p *Programmer) NewMemoryWriterContext(ctx context.Context, addr uint32) io.Writer {
+	return p.newRegionWriter(ctx, p.chip.Flash)
+}
+
+// Writes the EEPROM of the chip from its start.
+func (p *Programmer) NewEepromWriter() io.Writer {
+	return p.newRegionWriter(context.Background(), p.chip.Eeprom)
+}
+
+// Writes in chunks of at most a page, so that no chunk crosses a page.
+func (p *Programmer) newRegionWriter(ctx context.Context, region MemRegion) io.Writer {
+	chunkSize := 64
+	if region.PageSize > 0 && int(region.PageSize) < chunkSize {
+		chunkSize = int(region.PageSize)
+	}
+	return &memWriter{ctx, p, region.MemType, region.Offset, region.Offset + region.Size, chunkSize}
 }
 
 func (p *Programmer) findChip() (*ChipProperties, error) {
 	r := p.NewMemoryReader(signatureAddr)
-	sig := make([]byte, signatureSize)
-	if _, err := r.Read(sig); err != nil {
+	var sig [signatureSize]byte
+	if _, err := r.Read(sig[:]); err != nil {
 		return nil, fmt.Errorf("Failed to read signature: %v", err)
 	}
-
-	for _, chip := range SupportedChips {
-		if bytes.Equal(chip.Signature[:], sig) {
-			return &chip, nil
-		}
-	}
-
-	return nil, fmt.Errorf("Unsupported chip. Signature: %v", sig)
+	return LookupChip(sig)
 }
 
 // Takes ownership of dev: programmer closes dev on Close().
 func NewProgrammerDeps(dev gocw.UsbDeviceInterface) (*Programmer, error) {
 	var err error
-	p := &Programmer{dev, nil}
+	p := &Programmer{dev, nil, false}
 	if err = p.setTimeout(400 * time.Millisecond); err != nil {
 		return nil, fmt.Errorf("setTimeout failed: %v", err)
 	}
@@ -321,47 +338,156 @@ func NewProgrammerDeps(dev gocw.UsbDeviceInterface) (*Programmer, error) {
 		return nil, fmt.Errorf("Failed to find chip: %v", err)
 	}
 
-	glog.V(1).Infof("Found supported chip %v", p.chip.Name)
+	if p.chip.Unknown {
+		glog.Warningf("Unknown chip, programming it as %v", p.chip.Name)
+	} else {
+		glog.V(1).Infof("Found supported chip %v", p.chip.Name)
+	}
 	return p, nil
 }
 
 func NewProgrammer() (*Programmer, error) {
 	var err error
 	var dev gocw.UsbDeviceInterface
-	if dev, err = gocw.OpenCwLiteUsbDevice(); err != nil {
+	if dev, err = gocw.OpenUsbDevice(); err != nil {
 		return nil, err
 	}
 	return NewProgrammerDeps(dev)
 }
 
+// Returns the name of the detected chip.
+func (p *Programmer) ChipName() string {
+	if p.chip == nil {
+		return ""
+	}
+	return p.chip.Name
+}
+
+// Returns the properties of the detected chip.
+func (p *Programmer) Chip() *ChipProperties {
+	return p.chip
+}
+
+// Leaves programming mode when an operation stopped because its context is
+// done. The programmer must then be closed.
+func (p *Programmer) abort(err error) error {
+	glog.Warningf("Operation stopped, releasing the chip: %v", err)
+	p.disablePDI()
+	return err
+}
+
+// Implements programmer.Runner. Leaves programming mode, which releases the
+// chip reset and starts the application.
+func (p *Programmer) Run() error {
+	if err := p.disablePDI(); err != nil {
+		return err
+	}
+	p.running = true
+	return nil
+}
+
 func (p *Programmer) Close() error {
 	var err error
 	if p.dev != nil {
-		err = p.disablePDI()
+		if !p.running {
+			err = p.disablePDI()
+		}
 		p.dev.Close()
 		p.dev = nil
 	}
 	return err
 }
 
+// Returns the CRC of the application section computed by the chip, 24 bits
+// of it as the PDI programmer firmware reports it.
+func (p *Programmer) appCrc() (uint32, error) {
+	if err := p.doWrite(CmdCrc, []byte{crcApp}, true); err != nil {
+		return 0, fmt.Errorf("CmdCrc failed: %v", err)
+	}
+	var crc [3]byte
+	if err := p.doRead(CmdGetRamBuf, crc[:]); err != nil {
+		return 0, fmt.Errorf("CmdGetRamBuf failed: %v", err)
+	}
+	return uint32(crc[0]) | uint32(crc[1])<<8 | uint32(crc[2])<<16, nil
+}
+
+// Implements programmer.Verifier with the CRC-32 the XMEGA AU NVM controller
+// computes over the whole application section, whose bytes past data are
+// expected erased. Writes always start at the flash (see NewMemoryWriter), so
+// addr is ignored.
+func (p *Programmer) Verify(ctx context.Context, addr uint32, data []byte) (bool, error) {
+	if p.chip == nil || uint32(len(data)) > p.chip.AppSize {
+		return false, programmer.ErrVerifyUnsupported
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	app := make([]byte, p.chip.AppSize)
+	copy(app, data)
+	for i := len(data); i < len(app); i++ {
+		app[i] = 0xff
+	}
+	crc, err := p.appCrc()
+	if err != nil {
+		return false, err
+	}
+	want := crc32.ChecksumIEEE(app) & 0xffffff
+	glog.V(1).Infof("Application CRC %#x, expected %#x", crc, want)
+	return crc == want, nil
+}
+
+// Erases the whole chip, including the boot section and EEPROM. Requires
+// gocw.OpChipErase confirmation.
 func (p *Programmer) EraseChip() error {
+	if err := gocw.RequireConfirmed(gocw.OpChipErase); err != nil {
+		return err
+	}
+	if gocw.SkipWrite("XMEGA chip erase") {
+		return nil
+	}
 	if err := p.doWrite(CmdErase, []byte{eraseChip, 0, 0, 0, 0}, true); err != nil {
 		return fmt.Errorf("EraseChip failed: %v", err)
 	}
 	return nil
 }
 
+// Erases the application section.
 func (p *Programmer) EraseApp() error {
+	if gocw.SkipWrite("XMEGA application erase") {
+		return nil
+	}
 	if err := p.doWrite(CmdErase, []byte{eraseApp, 0, 0, 0, 0}, true); err != nil {
 		return fmt.Errorf("EraseApp failed: %v", err)
 	}
 	return nil
 }
 
+// Erases the whole chip if gocw.OpChipErase was confirmed, falling back to the
+// application section, e.g. on locked chips. Erases only the application
+// section otherwise.
 func (p *Programmer) Erase() error {
+	return p.EraseContext(context.Background())
+}
+
+// Same as Erase, failing and releasing the chip when ctx is done. The erase
+// commands themselves are bounded by the programmer timeout.
+func (p *Programmer) EraseContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return p.abort(err)
+	}
 	var err error
+	if gocw.RequireConfirmed(gocw.OpChipErase) != nil {
+		glog.Info("Erasing app")
+		if err = p.EraseApp(); err != nil {
+			return fmt.Errorf("Failed to erase app before program (locked chip? confirm a chip erase): %v", err)
+		}
+		return nil
+	}
 	glog.Info("Erasing chip")
 	if err = p.EraseChip(); err != nil {
+		if ctx.Err() != nil {
+			return p.abort(ctx.Err())
+		}
 		p.disablePDI()
 		p.enablePDI()
 		glog.Info("Erasing app")
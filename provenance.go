@@ -0,0 +1,103 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Provenance and licensing metadata of captures, and removal of the secrets
+// of a capture before sharing it publicly.
+// The metadata is kept in a JSON file alongside the capture file, like the
+// audit log, so the capture format is unchanged.
+package gocw
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+type Provenance struct {
+	// Who recorded the capture.
+	Operator string `json:"operator,omitempty"`
+	// Identifier of the target device, e.g. the serial number of the board.
+	TargetId string `json:"target_id,omitempty"`
+	Project  string `json:"project,omitempty"`
+	// License the capture may be shared under, e.g. CC-BY-4.0.
+	License string `json:"license,omitempty"`
+	// Set if the owner of the target agreed to publishing the capture.
+	Consent bool      `json:"consent,omitempty"`
+	Notes   string    `json:"notes,omitempty"`
+	Created time.Time `json:"created"`
+	// Set once keys and plaintexts were removed, see Capture.Scrub.
+	Scrubbed bool `json:"scrubbed,omitempty"`
+}
+
+// Returns the provenance filename of a capture file,
+// e.g. aes.json.gz -> aes.meta.json.
+func ProvenanceFilename(captureFile string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(captureFile, ".gz"), ".json") + ".meta.json"
+}
+
+// Loads the provenance of a capture file. Returns nil if it has none.
+func LoadProvenance(captureFile string) (*Provenance, error) {
+	f, err := os.Open(ProvenanceFilename(captureFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error opening provenance file: %v", err)
+	}
+	defer f.Close()
+	p := &Provenance{}
+	if err = json.NewDecoder(f).Decode(p); err != nil {
+		return nil, fmt.Errorf("JSON decoder failed %v", err)
+	}
+	return p, nil
+}
+
+// Saves the provenance of a capture file, replacing any previous one.
+func (p *Provenance) Save(captureFile string) error {
+	buf, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("JSON encoder failed %v", err)
+	}
+	if err = os.WriteFile(ProvenanceFilename(captureFile), append(buf, '\n'), 0644); err != nil {
+		return fmt.Errorf("Error writing provenance file: %v", err)
+	}
+	return nil
+}
+
+// What Capture.Scrub keeps besides the measurements. Either the plaintexts or
+// the ciphertexts are enough to recover the key from the measurements with
+// a CPA attack.
+type ScrubOptions struct {
+	KeepPlaintexts  bool
+	KeepCiphertexts bool
+}
+
+// Returns a copy of the capture without keys, and unless kept, plaintexts and
+// ciphertexts. Measurements and the other trace fields are unchanged.
+func (c Capture) Scrub(opts ScrubOptions) Capture {
+	scrubbed := make(Capture, len(c))
+	for i, t := range c {
+		t.Key = nil
+		if !opts.KeepPlaintexts {
+			t.Pt = nil
+		}
+		if !opts.KeepCiphertexts {
+			t.Ct = nil
+		}
+		scrubbed[i] = t
+	}
+	return scrubbed
+}
@@ -0,0 +1,71 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gocw"
+)
+
+func TestProvenanceSaveLoad(t *testing.T) {
+	capture := filepath.Join(t.TempDir(), "aes.json.gz")
+	if p, err := gocw.LoadProvenance(capture); p != nil || err != nil {
+		t.Errorf("Expected no provenance, got %v, %v", p, err)
+	}
+
+	p := &gocw.Provenance{
+		Operator: "lab-1",
+		TargetId: "cw308-stm32f3-0042",
+		Project:  "aes-baseline",
+		License:  "CC-BY-4.0",
+		Consent:  true,
+		Created:  time.Date(2019, 8, 1, 12, 0, 0, 0, time.UTC),
+	}
+	if err := p.Save(capture); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if got := filepath.Base(gocw.ProvenanceFilename(capture)); got != "aes.meta.json" {
+		t.Errorf("ProvenanceFilename is %s, want aes.meta.json", got)
+	}
+	loaded, err := gocw.LoadProvenance(capture)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, p) {
+		t.Errorf("Loaded provenance (%v) did not match original (%v)", loaded, p)
+	}
+}
+
+func TestScrub(t *testing.T) {
+	c := gocw.Capture{
+		{Key: []byte{1}, Pt: []byte{2}, Ct: []byte{3}, PowerMeasurements: []gocw.Sample{0.1, 0.2}},
+		{Baseline: true, PowerMeasurements: []gocw.Sample{0.3}},
+	}
+	s := c.Scrub(gocw.ScrubOptions{KeepCiphertexts: true})
+	if s[0].Key != nil || s[0].Pt != nil || len(s[0].Ct) != 1 {
+		t.Errorf("Scrubbed trace has key %v, pt %v, ct %v", s[0].Key, s[0].Pt, s[0].Ct)
+	}
+	if !reflect.DeepEqual(s[0].PowerMeasurements, c[0].PowerMeasurements) || !s[1].Baseline {
+		t.Errorf("Scrub changed the measurements: %v", s)
+	}
+	// The original is unchanged.
+	if c[0].Key == nil || c[0].Pt == nil {
+		t.Errorf("Scrub modified the original capture: %v", c[0])
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Plaintext random sources.
+// RandGen draws from crypto/rand, so a campaign can't be regenerated. Any
+// io.Reader can stand in for it (e.g. a hardware RNG device), and SeededRand
+// produces the same plaintexts for the same seed, so a published campaign
+// can be regenerated and verified.
+// SeededRand is AES-128 in counter mode with a zero IV, keyed with the first
+// 16 bytes of SHA-256("gocw-seed" || seed as 8 big-endian bytes), so other
+// tools can reproduce the stream.
+package gocw
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Generates plaintext for each trace, read from a random source.
+func RandGenFrom(src io.Reader, numBytes int) PtGen {
+	return func() ([]byte, error) {
+		buf := make([]byte, numBytes)
+		if _, err := io.ReadFull(src, buf); err != nil {
+			return nil, fmt.Errorf("Failed reading random source: %v", err)
+		}
+		return buf, nil
+	}
+}
+
+// Deterministic random stream, see the package comment.
+type SeededRand struct {
+	seed   uint64
+	stream cipher.Stream
+}
+
+func NewSeededRand(seed uint64) *SeededRand {
+	h := sha256.New()
+	h.Write([]byte("gocw-seed"))
+	binary.Write(h, binary.BigEndian, seed)
+	block, err := aes.NewCipher(h.Sum(nil)[:16])
+	if err != nil {
+		// Can't happen with a 16 byte key.
+		panic(err)
+	}
+	return &SeededRand{seed, cipher.NewCTR(block, make([]byte, aes.BlockSize))}
+}
+
+func (r *SeededRand) Seed() uint64 {
+	return r.seed
+}
+
+func (r *SeededRand) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	r.stream.XORKeyStream(p, p)
+	return len(p), nil
+}
+
+// Describes the source, e.g. for CaptureOptions.RandSource.
+func (r *SeededRand) String() string {
+	return fmt.Sprintf("seeded-aes-ctr:%d", r.seed)
+}
+
+// Generates reproducible plaintexts from a seed.
+func SeededRandGen(seed uint64, numBytes int) PtGen {
+	return RandGenFrom(NewSeededRand(seed), numBytes)
+}
@@ -0,0 +1,63 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/google/gocw"
+)
+
+func TestSeededRandKnownAnswer(t *testing.T) {
+	// head -c 20 /dev/zero | openssl enc -aes-128-ctr -iv 0 \
+	//   -K $(first 16 bytes of sha256("gocw-seed" || 1234 big-endian))
+	want, _ := hex.DecodeString("ea70430ca7123ad778c7ad14516c8fa5f545a179")
+	gen := gocw.SeededRandGen(1234, 10)
+	var got []byte
+	for i := 0; i < 2; i++ {
+		pt, err := gen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, pt...)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Seeded stream %x, want %x", got, want)
+	}
+}
+
+func TestSeededRandDiffersBySeed(t *testing.T) {
+	a, _ := gocw.SeededRandGen(1, 16)()
+	b, _ := gocw.SeededRandGen(2, 16)()
+	if bytes.Equal(a, b) {
+		t.Errorf("Seeds 1 and 2 generated the same plaintext %x", a)
+	}
+	if s := gocw.NewSeededRand(7).String(); s != "seeded-aes-ctr:7" {
+		t.Errorf("Unexpected description %s", s)
+	}
+}
+
+func TestRandGenFromShortSource(t *testing.T) {
+	gen := gocw.RandGenFrom(strings.NewReader("abc"), 2)
+	if pt, err := gen(); err != nil || string(pt) != "ab" {
+		t.Errorf("First plaintext %q, %v", pt, err)
+	}
+	if _, err := gen(); err == nil {
+		t.Error("Reading past the end of the source succeeded")
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Reconnection after the device briefly drops off the bus.
+// Long campaigns shouldn't die on a flaky cable or hub. The device is
+// re-opened by serial number, its firmware checked again, the FPGA
+// reprogrammed if it lost its bitstream, and the ADC and USART settings
+// restored, see CaptureOptions.Reconnect.
+package gocw
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+type ReconnectPolicy struct {
+	// Attempts to re-open the device before giving up.
+	Attempts int
+	// Delay before the first attempt, doubled after each failed attempt up
+	// to MaxDelay.
+	Delay    time.Duration
+	MaxDelay time.Duration
+}
+
+// Retries for about half a minute.
+func DefaultReconnectPolicy() ReconnectPolicy {
+	return ReconnectPolicy{
+		Attempts: 10,
+		Delay:    500 * time.Millisecond,
+		MaxDelay: 5 * time.Second,
+	}
+}
+
+// Transport of a device that dropped off the bus, until it reconnects.
+type disconnectedTransport struct{}
+
+var errDisconnected = fmt.Errorf("Device disconnected")
+
+func (disconnectedTransport) Control(rType, request uint8, val, idx uint16, data []byte) (int, error) {
+	return 0, errDisconnected
+}
+
+func (disconnectedTransport) ReadBulk(p []byte) (int, error) {
+	return 0, errDisconnected
+}
+
+func (disconnectedTransport) WriteBulk(p []byte) (int, error) {
+	return 0, errDisconnected
+}
+
+func (disconnectedTransport) Close() error {
+	return nil
+}
+
+// Returns true if the device answers requests.
+func (d *UsbDevice) Connected() bool {
+	var ver FwVersion
+	return d.transport() != nil && d.ReadFwVersion(&ver) == nil
+}
+
+// Returns the spec re-opening the same device: by serial number with the
+// default transport, as the bus address changes when it reconnects.
+func (d *UsbDevice) reopenSpec() string {
+	if len(d.serial) > 0 && (d.spec == DefaultTransport || len(d.spec) == 0) {
+		return DefaultTransport + ":" + d.serial
+	}
+	return d.spec
+}
+
+// Closes the device and opens it again, e.g. after it dropped off the bus,
+// and checks its firmware. The FPGA and ADC are not set up again, see
+// CaptureOptions.Reconnect. Requests fail until it succeeds.
+func (d *UsbDevice) Reconnect(p ReconnectPolicy) error {
+	if t := d.setTransport(disconnectedTransport{}); t != nil {
+		t.Close()
+	}
+	spec := d.reopenSpec()
+	delay := p.Delay
+	var err error
+	for i := 0; i < p.Attempts; i++ {
+		time.Sleep(delay)
+		if delay *= 2; p.MaxDelay > 0 && delay > p.MaxDelay {
+			delay = p.MaxDelay
+		}
+		var t UsbTransport
+		if t, err = OpenModelTransport(spec, d.model); err != nil {
+			glog.Warningf("Reconnect attempt %d of %d failed: %v", i+1, p.Attempts, err)
+			continue
+		}
+		d.setTransport(t)
+		if err = d.checkFwVersion(); err != nil {
+			glog.Warningf("Reconnect attempt %d of %d failed: %v", i+1, p.Attempts, err)
+			d.setTransport(disconnectedTransport{})
+			t.Close()
+			continue
+		}
+		glog.Infof("Reconnected %v (%s)", d.model, spec)
+		return nil
+	}
+	return fmt.Errorf("Failed reconnecting %v after %d attempts: %v", d.model, p.Attempts, err)
+}
+
+// Resets the ADC and applies the settings of cfg, e.g. after the device
+// reconnected and the FPGA was reprogrammed. Clears the error left by the
+// disconnection. Pins and glitch settings are left at their defaults if cfg
+// doesn't have them. Segments and logic capture are kept as set.
+func (c *Adc) Restore(cfg ScopeConfig) error {
+	c.err = nil
+	c.stuckCount = 0
+	segments, logic := c.Segments(), c.logicChannels
+
+	c.setResetOn()
+	c.setResetOff()
+	c.defaultSetup(true)
+	c.SetGainMode(cfg.GainMode)
+	c.SetGain(cfg.Gain)
+	if cfg.ClkGenMul > 0 && cfg.ClkGenDiv > 0 {
+		c.setClkGenMul(cfg.ClkGenMul)
+		c.setClkGenDiv(cfg.ClkGenDiv)
+		c.resetClkGen()
+	}
+	c.SetAdcClockSource(cfg.AdcClockSource)
+	c.SetTriggerMode(cfg.TriggerMode)
+	c.SetTotalSamples(cfg.TotalSamples)
+	c.SetTriggerOffset(cfg.TriggerOffset)
+	c.SetPreTriggerSamples(cfg.PreSamples)
+	c.SetDownsampleFactor(cfg.Decimate)
+	if io := cfg.Io; io != nil {
+		if len(io.TriggerPins) > 0 {
+			c.SetTriggerTargetIoPins(io.TriggerPins, io.TriggerPinLogic)
+		}
+		c.SetTargetIo1(io.TargetIo[0])
+		c.SetTargetIo2(io.TargetIo[1])
+		c.SetTargetIo3(io.TargetIo[2])
+		c.SetTargetIo4(io.TargetIo[3])
+		c.SetHs2(io.Hs2)
+	}
+	if cfg.Glitch != nil {
+		c.SetGlitch(*cfg.Glitch)
+	}
+	c.segments = 0
+	c.SetSegments(segments)
+	if logic != 0 {
+		c.SetLogicCapture(logic)
+	}
+	if c.err == nil && (!c.DcmLocked() || !c.ClkGenDcmLocked()) {
+		c.err = fmt.Errorf("DCMs did not lock after restoring the ADC settings")
+	}
+	return c.err
+}
+
+// Reconnects the ChipWhisperer of a capture: re-opens it, reprograms the
+// FPGA if it lost its bitstream, restores the ADC settings of cfg and the
+// USART, and sets the key again, as the target may have reset.
+func (cw *chipWhisperer) reconnect(target Target, cfg ScopeConfig, key []byte, p ReconnectPolicy) error {
+	if err := cw.dev.Reconnect(p); err != nil {
+		return err
+	}
+	reprogrammed, err := cw.fpga.programIfNeeded()
+	if err != nil {
+		return err
+	}
+	if reprogrammed {
+		glog.Warning("FPGA lost its bitstream, and was reprogrammed")
+	}
+	if err = cw.adc.Restore(cfg); err != nil {
+		return err
+	}
+	if err = cw.usart.Reinit(); err != nil {
+		return err
+	}
+	if err = cw.usart.Flush(); err != nil {
+		return fmt.Errorf("Flush failed: %v", err)
+	}
+	if err = target.SetKey(key); err != nil {
+		return fmt.Errorf("Failed setting the key after reconnecting: %v", err)
+	}
+	return nil
+}
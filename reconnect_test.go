@@ -0,0 +1,149 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/google/gocw"
+)
+
+// A programmed FPGA whose registers hold the last value written. The ADC
+// clocks report locked and loaded, and the samples register the buffer size
+// until written.
+type registerDevice struct {
+	hwType gocw.HwType
+	regs   map[uint32][]byte
+	addr   uint32
+}
+
+func newRegisterDevice(hwType gocw.HwType) *registerDevice {
+	d := &registerDevice{hwType: hwType}
+	d.powerCycle()
+	return d
+}
+
+// Resets all the registers.
+func (d *registerDevice) powerCycle() {
+	d.regs = map[uint32][]byte{
+		// sys_freq: 96 MHz.
+		7: {0x00, 0xd8, 0xb8, 0x05},
+		// samples
+		16: {0x50, 0x5f, 0, 0},
+	}
+}
+
+func (d *registerDevice) Read(p []byte) (int, error)  { return 0, nil }
+func (d *registerDevice) Write(p []byte) (int, error) { return len(p), nil }
+func (d *registerDevice) Close() error                { return nil }
+
+func (d *registerDevice) ControlIn(request gocw.Request, val uint16, data interface{}) error {
+	switch v := data.(type) {
+	case *uint32:
+		*v = 1
+	case *gocw.FwVersion:
+		*v = gocw.FwVersion{Major: 0, Minor: 11}
+	case []byte:
+		n := copy(v, d.regs[d.addr])
+		for i := n; i < len(v); i++ {
+			v[i] = 0
+		}
+		switch {
+		case d.addr == 10 && len(v) > 1:
+			v[1] = byte(d.hwType) << 3
+		case d.addr == 6 && len(v) > 3:
+			// adv_clk: DCMs locked, clock generator loaded.
+			v[0] |= 0x60
+			v[3] |= 0x02
+		}
+	}
+	return nil
+}
+
+func (d *registerDevice) ControlOut(request gocw.Request, val uint16, data interface{}) error {
+	switch request {
+	case gocw.ReqMemReadCtrl:
+		d.addr = data.(*gocw.AddressBlock).Addr
+	case gocw.ReqMemWriteCtrl:
+		buf := data.([]byte)
+		var block gocw.AddressBlock
+		if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &block); err != nil {
+			return err
+		}
+		d.regs[block.Addr] = append([]byte(nil), buf[8:]...)
+	}
+	return nil
+}
+
+func TestAdcRestore(t *testing.T) {
+	dev := newRegisterDevice(gocw.HwChipWhispererLite)
+	fpga, err := gocw.AttachFpga(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adc, err := gocw.NewAdc(fpga)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pins := []gocw.TriggerTargetIoPin{gocw.TriggerTargetIoPin1, gocw.TriggerTargetIoPinNrst}
+	adc.SetTriggerTargetIoPins(pins, gocw.TriggerPinAnd)
+	adc.SetTargetIo1(gocw.TargetIoModeSerialTx)
+	adc.SetTargetIo2(gocw.TargetIoModeSerialRx)
+	adc.SetTargetIo3(gocw.TargetIoModeGpioHigh)
+	adc.SetTargetIo4(gocw.TargetIoModeHighZ)
+	glitch := gocw.Glitch{
+		ClockSource: gocw.GlitchClockClkGen,
+		Output:      gocw.GlitchOutputGlitchOnly,
+		Trigger:     gocw.GlitchTriggerExtSingleShot,
+		ExtOffset:   100,
+		Repeat:      3,
+		WidthFine:   -20,
+		OffsetFine:  10,
+		Hs2:         true,
+	}
+	adc.SetGlitch(glitch)
+	cfg := adc.DeviceState().Config
+	if err = adc.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The FPGA was reprogrammed after reconnecting.
+	dev.powerCycle()
+	if err = adc.Restore(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := adc.TriggerTargetIoPins(); !reflect.DeepEqual(got, pins) {
+		t.Errorf("Trigger pins %v, want %v", got, pins)
+	}
+	if got := adc.TriggerPinLogic(); got != gocw.TriggerPinAnd {
+		t.Errorf("Trigger pin logic %v, want %v", got, gocw.TriggerPinAnd)
+	}
+	got := [4]gocw.TargetIoMode{adc.TargetIo1(), adc.TargetIo2(), adc.TargetIo3(), adc.TargetIo4()}
+	if want := cfg.Io.TargetIo; got != want || want[2] != gocw.TargetIoModeGpioHigh {
+		t.Errorf("Target IO %v, want %v", got, want)
+	}
+	if got := adc.Hs2(); got != gocw.Hs2ModeGlitch {
+		t.Errorf("HS2 %v, want %v", got, gocw.Hs2ModeGlitch)
+	}
+	if got := adc.Glitch(); got != glitch {
+		t.Errorf("Glitch %+v, want %+v", got, glitch)
+	}
+	if err = adc.Error(); err != nil {
+		t.Fatal(err)
+	}
+}
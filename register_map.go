@@ -0,0 +1,200 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Named access to the FPGA registers, for custom bitstreams.
+// The register map of the hardware names the registers Adc uses, with their
+// address, width and bit fields. Bitstreams with extra registers can describe
+// them in a JSON map of the same format (see internal/regmap/maps) loaded
+// with ParseRegisterMap, and access them with Fpga.RawRead and Fpga.RawWrite
+// without changes to Adc.
+package gocw
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/gocw/internal/regmap"
+)
+
+// Bit field of a register.
+type RegisterField struct {
+	Name string
+	// Byte of the register holding the field.
+	Byte  int
+	Shift uint
+	Bits  uint
+}
+
+// Extracts the field value from the register contents.
+func (f RegisterField) Get(buf []byte) uint8 {
+	return regmap.Field(f).Get(buf)
+}
+
+// Sets the field value in the register contents.
+func (f RegisterField) Set(buf []byte, v uint8) {
+	regmap.Field(f).Set(buf, v)
+}
+
+type RegisterInfo struct {
+	Name    string
+	Address Address
+	// Width in bytes. Zero for streamed registers, e.g. the ADC FIFO.
+	Width  int
+	Fields []RegisterField
+}
+
+// Returns the named field.
+func (r RegisterInfo) Field(name string) (RegisterField, error) {
+	for _, f := range r.Fields {
+		if f.Name == name {
+			return f, nil
+		}
+	}
+	return RegisterField{}, fmt.Errorf("Register %s has no field %s", r.Name, name)
+}
+
+type RegisterMap struct {
+	Name        string
+	Description string
+	// In map order.
+	Registers []RegisterInfo
+}
+
+func newRegisterMap(m *regmap.Map) *RegisterMap {
+	rm := &RegisterMap{Name: m.Name, Description: m.Description}
+	for _, reg := range m.Registers {
+		info := RegisterInfo{Name: reg.Name, Address: Address(reg.Address), Width: reg.Width}
+		for _, f := range reg.Fields {
+			info.Fields = append(info.Fields, RegisterField(f))
+		}
+		rm.Registers = append(rm.Registers, info)
+	}
+	return rm
+}
+
+// Returns the register map used for a hardware type and register version,
+// see HwVersion.
+func LoadRegisterMap(hwType HwType, regVersion uint8) (*RegisterMap, error) {
+	m, err := regmap.Load(int(hwType), regVersion)
+	if err != nil {
+		return nil, err
+	}
+	return newRegisterMap(m), nil
+}
+
+// Parses a JSON register map, e.g. describing the registers of a custom
+// bitstream.
+func ParseRegisterMap(r io.Reader) (*RegisterMap, error) {
+	m, err := regmap.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+	return newRegisterMap(m), nil
+}
+
+// Returns the named register.
+func (m *RegisterMap) Lookup(name string) (RegisterInfo, error) {
+	for _, reg := range m.Registers {
+		if reg.Name == name {
+			return reg, nil
+		}
+	}
+	return RegisterInfo{}, fmt.Errorf("Register %s not in map %s", name, m.Name)
+}
+
+// Returns the register addresses, by name.
+func (m *RegisterMap) Addresses() map[string]Address {
+	addrs := make(map[string]Address)
+	for _, reg := range m.Registers {
+		addrs[reg.Name] = reg.Address
+	}
+	return addrs
+}
+
+// Returns the register map of the hardware.
+func (c *Adc) RegisterMap() *RegisterMap {
+	if c.regMap == nil {
+		return nil
+	}
+	return newRegisterMap(c.regMap)
+}
+
+// Reads n bytes from a register, without any of the checks of Adc.
+func (f *Fpga) RawRead(addr Address, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := f.Mem.ReadBytes(addr, buf); err != nil {
+		return nil, fmt.Errorf("Failed reading register 0x%x: %v", addr, err)
+	}
+	return buf, nil
+}
+
+// Writes data to a register, without any of the checks of Adc. The write is
+// not read back. Skipped in dry runs.
+func (f *Fpga) RawWrite(addr Address, data []byte) error {
+	if SkipWrite("register 0x%x = %x", addr, data) {
+		return nil
+	}
+	if err := f.Mem.Write(addr, data, false, nil); err != nil {
+		return fmt.Errorf("Failed writing register 0x%x: %v", addr, err)
+	}
+	return nil
+}
+
+// Reads the named register of m.
+func (f *Fpga) ReadRegister(m *RegisterMap, name string) ([]byte, error) {
+	reg, err := m.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if reg.Width == 0 {
+		return nil, fmt.Errorf("Register %s is streamed", name)
+	}
+	return f.RawRead(reg.Address, reg.Width)
+}
+
+// Writes the named register of m. data must hold the register width.
+func (f *Fpga) WriteRegister(m *RegisterMap, name string, data []byte) error {
+	reg, err := m.Lookup(name)
+	if err != nil {
+		return err
+	}
+	if len(data) != reg.Width {
+		return fmt.Errorf("Register %s is %d bytes wide, got %d", name, reg.Width, len(data))
+	}
+	return f.RawWrite(reg.Address, data)
+}
+
+// Writes the contents and field values of the registers of m to w, one
+// register per line, for debugging. Streamed registers are skipped, as
+// reading them consumes data.
+func (f *Fpga) DumpRegisters(m *RegisterMap, w io.Writer) error {
+	for _, reg := range m.Registers {
+		if reg.Width == 0 {
+			continue
+		}
+		buf, err := f.RawRead(reg.Address, reg.Width)
+		if err != nil {
+			return fmt.Errorf("%s: %v", reg.Name, err)
+		}
+		var fields []string
+		for _, field := range reg.Fields {
+			fields = append(fields, fmt.Sprintf("%s=%d", field.Name, field.Get(buf)))
+		}
+		if _, err = fmt.Fprintf(w, "%-20s 0x%02x %x %s\n", reg.Name, reg.Address, buf, strings.Join(fields, " ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
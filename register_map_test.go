@@ -0,0 +1,103 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/gocw"
+	"github.com/google/gocw/mocks"
+
+	"github.com/golang/mock/gomock"
+)
+
+const customMap = `{
+  "name": "custom",
+  "registers": [
+    {"name": "ctrl", "address": 60, "width": 1, "fields": [
+      {"name": "enable", "shift": 0, "bits": 1},
+      {"name": "mode", "shift": 4, "bits": 2}
+    ]},
+    {"name": "fifo", "address": 61, "width": 0}
+  ]
+}`
+
+func TestLoadRegisterMap(t *testing.T) {
+	m, err := gocw.LoadRegisterMap(gocw.HwChipWhispererLite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg, err := m.Lookup("io_route")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = reg.Field("target_pwr"); err != nil {
+		t.Error(err)
+	}
+	if m.Addresses()["gain"] != 0 {
+		t.Errorf("gain at 0x%x, want 0", m.Addresses()["gain"])
+	}
+	if _, err = m.Lookup("missing"); err == nil {
+		t.Error("Lookup found a missing register")
+	}
+}
+
+func TestCustomRegisters(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	m, err := gocw.ParseRegisterMap(strings.NewReader(customMap))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg, _ := m.Lookup("ctrl")
+	mode, err := reg.Field("mode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := []byte{0x01}
+	mode.Set(buf, 2)
+	if buf[0] != 0x21 || mode.Get(buf) != 2 {
+		t.Errorf("Setting mode 2 gave 0x%02x", buf[0])
+	}
+
+	dev := mocks.NewMockUsbDeviceInterface(mockCtrl)
+	gomock.InOrder(
+		dev.EXPECT().ControlOut(gocw.ReqMemWriteCtrl, uint16(0),
+			[]byte{1, 0, 0, 0, 60, 0, 0, 0, 0x21}).
+			Return(nil),
+		dev.EXPECT().ControlOut(gocw.ReqMemReadCtrl, uint16(0), &gocw.AddressBlock{1, 60}).
+			Return(nil),
+		dev.EXPECT().ControlIn(gocw.ReqMemReadCtrl, uint16(0), gomock.Any()).
+			SetArg(2, []byte{0x21}).
+			Return(nil),
+	)
+	fpga := &gocw.Fpga{Mem: gocw.NewMemory(dev)}
+	if err = fpga.WriteRegister(m, "ctrl", buf); err != nil {
+		t.Fatal(err)
+	}
+	if err = fpga.WriteRegister(m, "ctrl", []byte{1, 2}); err == nil {
+		t.Error("WriteRegister accepted data wider than the register")
+	}
+	var dump bytes.Buffer
+	if err = fpga.DumpRegisters(m, &dump); err != nil {
+		t.Fatal(err)
+	}
+	if want := "ctrl                 0x3c 21 enable=1 mode=2\n"; dump.String() != want {
+		t.Errorf("DumpRegisters wrote %q, want %q", dump.String(), want)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Registers used by Adc.
+// Addresses are resolved from the register map of the hardware, see
+// internal/regmap.
+package gocw
+
+import (
+	"github.com/google/gocw/internal/regmap"
+)
+
+// Addresses of the registers used by Adc, resolved from the register map.
+type adcRegisters struct {
+	gain, settings, status, adcData, freq, advClk, sysFreq, adcFreq Address
+	offset, decimate, samples, presamples, bytesToRx, triggerDur    Address
+	trigSrc, extClk, ioRoute, ioRead, phase                         Address
+}
+
+func newAdcRegisters(m *regmap.Map) (adcRegisters, error) {
+	var regs adcRegisters
+	for name, addr := range map[string]*Address{
+		"gain":        &regs.gain,
+		"settings":    &regs.settings,
+		"status":      &regs.status,
+		"adc_data":    &regs.adcData,
+		"freq":        &regs.freq,
+		"adv_clk":     &regs.advClk,
+		"sys_freq":    &regs.sysFreq,
+		"adc_freq":    &regs.adcFreq,
+		"offset":      &regs.offset,
+		"decimate":    &regs.decimate,
+		"samples":     &regs.samples,
+		"presamples":  &regs.presamples,
+		"bytes_to_rx": &regs.bytesToRx,
+		"trigger_dur": &regs.triggerDur,
+		"trig_src":    &regs.trigSrc,
+		"ext_clk":     &regs.extClk,
+		"io_route":    &regs.ioRoute,
+		"io_read":     &regs.ioRead,
+		"phase":       &regs.phase,
+	} {
+		reg, err := m.Register(name)
+		if err != nil {
+			return regs, err
+		}
+		*addr = Address(reg.Address)
+	}
+	return regs, nil
+}
@@ -0,0 +1,39 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Power measurement sample type.
+//
+// Samples are stored as float32 by default: the ADC has a 10-bit resolution,
+// so float64 would double the memory used by large captures with no accuracy
+// gain. Build with the gocw_float64 tag to store samples as float64.
+// Analysis code converts samples to float64 when building gonum matrices.
+package gocw
+
+// Converts samples to float64.
+func Float64s(samples []Sample) []float64 {
+	res := make([]float64, len(samples))
+	for i, s := range samples {
+		res[i] = float64(s)
+	}
+	return res
+}
+
+// Converts float64 values to samples.
+func Samples(values []float64) []Sample {
+	res := make([]Sample, len(values))
+	for i, v := range values {
+		res[i] = Sample(v)
+	}
+	return res
+}
@@ -0,0 +1,138 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Per-sample selection (region-of-interest) of power traces.
+package gocw
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Half-open range of sample indices [Start, End).
+type SampleRange struct {
+	// Optional region name, e.g. "serial-io" or "sbox".
+	Name  string `json:"name,omitempty"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
+// Selects a subset of samples from each trace.
+// Samples are selected if they fall in any of the Include ranges (or all
+// samples if there are none), and in none of the Exclude ranges. Stride is
+// then applied to the remaining samples.
+type SampleMask struct {
+	Include []SampleRange `json:"include,omitempty"`
+	Exclude []SampleRange `json:"exclude,omitempty"`
+	// Keeps every Stride-th selected sample. Zero keeps all samples.
+	Stride int `json:"stride,omitempty"`
+}
+
+// Loads a JSON encoded mask from file.
+func LoadSampleMask(filename string) (*SampleMask, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening mask file: %v", err)
+	}
+	defer f.Close()
+	mask := &SampleMask{}
+	if err = json.NewDecoder(f).Decode(mask); err != nil {
+		return nil, fmt.Errorf("JSON decoder failed %v", err)
+	}
+	if err = mask.validate(); err != nil {
+		return nil, fmt.Errorf("Invalid mask %s: %v", filename, err)
+	}
+	return mask, nil
+}
+
+// Rejects malformed ranges, and Include ranges that are entirely excluded.
+func (m *SampleMask) validate() error {
+	if m.Stride < 0 {
+		return fmt.Errorf("Negative stride %d", m.Stride)
+	}
+	for _, ranges := range [][]SampleRange{m.Include, m.Exclude} {
+		for _, r := range ranges {
+			if r.Start < 0 || r.End <= r.Start {
+				return fmt.Errorf("Empty or negative range %q [%d, %d)", r.Name, r.Start, r.End)
+			}
+		}
+	}
+	end := 0
+	for _, r := range m.Include {
+		if r.End > end {
+			end = r.End
+		}
+	}
+	if len(m.Include) > 0 && len(m.Indices(end)) == 0 {
+		return fmt.Errorf("Mask selects no samples")
+	}
+	return nil
+}
+
+// Returns the named region, or nil if there is no such region.
+func (m *SampleMask) Region(name string) *SampleRange {
+	for _, ranges := range [][]SampleRange{m.Include, m.Exclude} {
+		for i := range ranges {
+			if ranges[i].Name == name {
+				return &ranges[i]
+			}
+		}
+	}
+	return nil
+}
+
+func inRanges(i int, ranges []SampleRange) bool {
+	for _, r := range ranges {
+		if r.Start <= i && i < r.End {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the selected sample indices of a trace with numSamples samples.
+// A nil mask selects all samples.
+func (m *SampleMask) Indices(numSamples int) []int {
+	var res []int
+	for i := 0; i < numSamples; i++ {
+		if m != nil {
+			if len(m.Include) > 0 && !inRanges(i, m.Include) {
+				continue
+			}
+			if inRanges(i, m.Exclude) {
+				continue
+			}
+		}
+		res = append(res, i)
+	}
+	if m == nil || m.Stride <= 1 {
+		return res
+	}
+	strided := make([]int, 0, (len(res)+m.Stride-1)/m.Stride)
+	for i := 0; i < len(res); i += m.Stride {
+		strided = append(strided, res[i])
+	}
+	return strided
+}
+
+// Returns the selected samples.
+func (m *SampleMask) Apply(samples []Sample) []Sample {
+	idx := m.Indices(len(samples))
+	res := make([]Sample, len(idx))
+	for i, j := range idx {
+		res[i] = samples[j]
+	}
+	return res
+}
@@ -0,0 +1,79 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/google/gocw"
+	"gonum.org/v1/gonum/mat"
+)
+
+func TestSampleMaskIndices(t *testing.T) {
+	mask := &gocw.SampleMask{
+		Include: []gocw.SampleRange{{Start: 0, End: 4}, {Start: 6, End: 10}},
+		Exclude: []gocw.SampleRange{{Name: "serial-io", Start: 2, End: 3}},
+		Stride:  2,
+	}
+	// Selected before stride: [0 1 3 6 7 8 9]
+	expected := []int{0, 3, 7, 9}
+	if actual := mask.Indices(12); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Indices (%v) did not match expected (%v)", actual, expected)
+	}
+	if r := mask.Region("serial-io"); r == nil || r.Start != 2 {
+		t.Errorf("Region lookup failed: %v", r)
+	}
+}
+
+func TestMaskedSamplesMatrix(t *testing.T) {
+	c := gocw.Capture{
+		gocw.Trace{PowerMeasurements: []gocw.Sample{1, 2, 3}},
+		gocw.Trace{PowerMeasurements: []gocw.Sample{4, 5, 6}},
+	}
+	mask := &gocw.SampleMask{Exclude: []gocw.SampleRange{{Start: 1, End: 2}}}
+	expected := mat.NewDense(2, 2, []float64{1, 3, 4, 6})
+	if actual, err := c.MaskedSamplesMatrix(mask); err != nil || !mat.Equal(actual, expected) {
+		t.Errorf("Masked matrix (%v, %v) did not match expected (%v)", actual, err, expected)
+	}
+	if actual, err := c.MaskedSamplesMatrix(nil); err != nil || !mat.Equal(actual, c.SamplesMatrix()) {
+		t.Errorf("Nil mask should select all samples")
+	}
+	all := &gocw.SampleMask{Exclude: []gocw.SampleRange{{Start: 0, End: 3}}}
+	if _, err := c.MaskedSamplesMatrix(all); err == nil {
+		t.Errorf("Expected an error for an empty selection")
+	}
+	if _, err := (gocw.Capture{}).MaskedSamplesMatrix(nil); err == nil {
+		t.Errorf("Expected an error for an empty capture")
+	}
+}
+
+func TestLoadSampleMaskRejectsEmptySelection(t *testing.T) {
+	for _, mask := range []string{
+		`{"include": [{"start": 4, "end": 4}]}`,
+		`{"include": [{"start": 0, "end": 4}], "exclude": [{"start": 0, "end": 8}]}`,
+		`{"stride": -1}`,
+	} {
+		filename := filepath.Join(t.TempDir(), "mask.json")
+		if err := os.WriteFile(filename, []byte(mask), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := gocw.LoadSampleMask(filename); err == nil {
+			t.Errorf("LoadSampleMask(%s) should fail", mask)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// External acquisition hardware.
+// Captures normally read the ChipWhisperer ADC. With CaptureOptions.Scope
+// set, the traces are acquired by another instrument instead, e.g. a bench
+// oscilloscope (see the scpi package), while the ChipWhisperer still clocks
+// and talks to the target. Traces keep the Trace/Capture format, with
+// samples in the unit of the instrument (volts for scpi).
+package gocw
+
+import (
+	"fmt"
+	"io"
+)
+
+type ScopeInterface interface {
+	io.Closer
+	// Sets the number of samples per trace, and the number of samples
+	// between the trigger and the first recorded sample.
+	Configure(numSamples, offset int) error
+	// Arms a single acquisition.
+	Arm() error
+	// Waits for the trigger and the end of the acquisition. Returns true if
+	// the acquisition timed out.
+	WaitForTrigger() (bool, error)
+	// Reads the samples of the last acquisition.
+	ReadSamples() ([]Sample, error)
+}
+
+// Returns an error if the options need the ChipWhisperer ADC.
+func (o CaptureOptions) checkScope() error {
+	if o.Scope == nil {
+		return nil
+	}
+	switch {
+	case o.BatchSize > 1:
+		return fmt.Errorf("Batched captures are not supported with an external scope")
+	case o.LogicChannels != 0:
+		return fmt.Errorf("Logic capture is not supported with an external scope")
+	case o.AutoGain || o.TargetAmplitude > 0:
+		return fmt.Errorf("Gain control is not supported with an external scope")
+	case o.BaselineInterval > 0:
+		return fmt.Errorf("Baseline traces are not supported with an external scope")
+	case o.AdaptiveDecimation:
+		return fmt.Errorf("Adaptive decimation is not supported with an external scope")
+	}
+	return nil
+}
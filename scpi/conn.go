@@ -0,0 +1,158 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Bench instruments over SCPI.
+// Instruments are reached through a raw SCPI socket (LXI instruments listen
+// on port 5025), or through a USB-TMC device file of the Linux usbtmc driver.
+// Scope implements gocw.ScopeInterface on top of a Conn.
+package scpi
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default port of raw SCPI sockets.
+const DefaultPort = 5025
+
+// Time allowed for a single query.
+const DefaultTimeout = 5 * time.Second
+
+// Sends commands and reads responses.
+type Conn struct {
+	rw io.ReadWriteCloser
+	r  *bufio.Reader
+	// Set for sockets, which support deadlines.
+	conn    net.Conn
+	Timeout time.Duration
+}
+
+// Wraps an open transport.
+func NewConn(rw io.ReadWriteCloser) *Conn {
+	c := &Conn{rw: rw, r: bufio.NewReader(rw), Timeout: DefaultTimeout}
+	c.conn, _ = rw.(net.Conn)
+	return c
+}
+
+// Opens an instrument given a "tcp:host[:port]" or "usbtmc:/dev/usbtmcN"
+// address.
+func Dial(address string) (*Conn, error) {
+	i := strings.Index(address, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("Invalid SCPI address %q, expected tcp:host[:port] or usbtmc:device", address)
+	}
+	kind, addr := address[:i], address[i+1:]
+	switch kind {
+	case "tcp":
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, strconv.Itoa(DefaultPort))
+		}
+		conn, err := net.DialTimeout("tcp", addr, DefaultTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("Failed connecting to %s: %v", addr, err)
+		}
+		return NewConn(conn), nil
+	case "usbtmc":
+		f, err := os.OpenFile(addr, os.O_RDWR, 0)
+		if err != nil {
+			return nil, err
+		}
+		return NewConn(f), nil
+	}
+	return nil, fmt.Errorf("Unknown SCPI transport %q", kind)
+}
+
+func (c *Conn) Close() error {
+	return c.rw.Close()
+}
+
+func (c *Conn) deadline() {
+	if c.conn != nil {
+		c.conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+}
+
+// Sends a command.
+func (c *Conn) Command(format string, args ...interface{}) error {
+	c.deadline()
+	cmd := fmt.Sprintf(format, args...)
+	if _, err := io.WriteString(c.rw, cmd+"\n"); err != nil {
+		return fmt.Errorf("Failed sending %q: %v", cmd, err)
+	}
+	return nil
+}
+
+// Sends a query, and returns the response line.
+func (c *Conn) Query(format string, args ...interface{}) (string, error) {
+	if err := c.Command(format, args...); err != nil {
+		return "", err
+	}
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return "", fmt.Errorf("Failed reading response to %q: %v", fmt.Sprintf(format, args...), err)
+		}
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			return line, nil
+		}
+	}
+}
+
+// Sends a query, and returns its IEEE 488.2 definite length block response,
+// "#<digits><length><data>".
+func (c *Conn) QueryBlock(format string, args ...interface{}) ([]byte, error) {
+	if err := c.Command(format, args...); err != nil {
+		return nil, err
+	}
+	data, err := readBlock(c.r)
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading response to %q: %v", fmt.Sprintf(format, args...), err)
+	}
+	return data, nil
+}
+
+func readBlock(r *bufio.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != '#' || header[1] < '1' || header[1] > '9' {
+		return nil, fmt.Errorf("Invalid block header %q", header)
+	}
+	digits := make([]byte, header[1]-'0')
+	if _, err := io.ReadFull(r, digits); err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(string(digits))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid block length %q", digits)
+	}
+	data := make([]byte, n)
+	if _, err = io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	// Terminating newline, if already received. Query skips it otherwise.
+	if r.Buffered() > 0 {
+		if b, _ := r.Peek(1); b[0] == '\n' {
+			r.ReadByte()
+		}
+	}
+	return data, nil
+}
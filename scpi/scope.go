@@ -0,0 +1,226 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Oscilloscope acquisition over SCPI.
+// Waveform commands differ between vendors, so each supported family has a
+// Dialect. The scope is set up by the user (vertical scale, sample rate,
+// trigger on the target trigger output, trigger point at the left of the
+// record), and Scope only arms single acquisitions and reads the raw byte
+// waveform of one channel, converted to volts.
+package scpi
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gocw"
+)
+
+// Commands of a scope family.
+type Dialect struct {
+	// Sent by Configure, with %[1]d the channel and %[2]d the record length.
+	// The other commands are sent verbatim.
+	Setup []string
+	// Starts a single acquisition.
+	Arm string
+	// Polled after Arm until it returns Done.
+	Status, Done string
+	// Returns the 10 value waveform preamble: format, type, points, count,
+	// xincrement, xorigin, xreference, yincrement, yorigin, yreference.
+	Preamble string
+	// Returns the waveform as a block of bytes.
+	Data string
+	// The preamble yorigin is in codes rather than volts.
+	YOriginInCodes bool
+}
+
+// Supported scope families, by name.
+var Dialects = map[string]Dialect{
+	// Keysight/Agilent InfiniiVision.
+	"keysight": {
+		Setup: []string{
+			":WAVeform:SOURce CHANnel%[1]d",
+			":WAVeform:FORMat BYTE",
+			":WAVeform:UNSigned ON",
+			":WAVeform:POINts:MODE RAW",
+			":WAVeform:POINts %[2]d",
+		},
+		Arm:      ":SINGle",
+		Status:   ":TER?",
+		Done:     "+1",
+		Preamble: ":WAVeform:PREamble?",
+		Data:     ":WAVeform:DATA?",
+	},
+	// Rigol DS1000Z/MSO5000.
+	"rigol": {
+		Setup: []string{
+			":WAVeform:SOURce CHANnel%[1]d",
+			":WAVeform:MODE RAW",
+			":WAVeform:FORMat BYTE",
+			":WAVeform:STARt 1",
+			":WAVeform:STOP %[2]d",
+		},
+		Arm:            ":SINGle",
+		Status:         ":TRIGger:STATus?",
+		Done:           "STOP",
+		Preamble:       ":WAVeform:PREamble?",
+		Data:           ":WAVeform:DATA?",
+		YOriginInCodes: true,
+	},
+}
+
+// Returns the names of Dialects, sorted.
+func DialectNames() []string {
+	var names []string
+	for name := range Dialects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Time allowed for an acquisition, and the status polling interval.
+const (
+	DefaultAcquisitionTimeout = time.Second
+	statusPollInterval        = 5 * time.Millisecond
+)
+
+// Conversion of waveform codes to volts.
+type Preamble struct {
+	Points                          int
+	YIncrement, YOrigin, YReference float64
+}
+
+// Parses a waveform preamble response, see Dialect.Preamble.
+func ParsePreamble(s string) (Preamble, error) {
+	fields := strings.Split(s, ",")
+	if len(fields) != 10 {
+		return Preamble{}, fmt.Errorf("Invalid preamble %q", s)
+	}
+	var v [10]float64
+	for i, f := range fields {
+		var err error
+		if v[i], err = strconv.ParseFloat(strings.TrimSpace(f), 64); err != nil {
+			return Preamble{}, fmt.Errorf("Invalid preamble %q: %v", s, err)
+		}
+	}
+	return Preamble{Points: int(v[2]), YIncrement: v[7], YOrigin: v[8], YReference: v[9]}, nil
+}
+
+// Converts a waveform code to volts.
+func (p Preamble) Volts(code byte, yOriginInCodes bool) float64 {
+	if yOriginInCodes {
+		return (float64(code) - p.YOrigin - p.YReference) * p.YIncrement
+	}
+	return (float64(code)-p.YReference)*p.YIncrement + p.YOrigin
+}
+
+// Implements gocw.ScopeInterface.
+type Scope struct {
+	conn    *Conn
+	dialect Dialect
+	channel int
+	// Samples recorded and skipped, see Configure.
+	samples, offset int
+	Timeout         time.Duration
+}
+
+// Opens a scope given a dialect name, a Dial address and the channel to
+// record.
+func OpenScope(dialect, address string, channel int) (*Scope, error) {
+	d, ok := Dialects[dialect]
+	if !ok {
+		return nil, fmt.Errorf("Unknown scope dialect %q, one of %v", dialect, DialectNames())
+	}
+	conn, err := Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	return NewScope(conn, d, channel), nil
+}
+
+func NewScope(conn *Conn, d Dialect, channel int) *Scope {
+	return &Scope{conn: conn, dialect: d, channel: channel, Timeout: DefaultAcquisitionTimeout}
+}
+
+// Returns the instrument identification.
+func (s *Scope) Identify() (string, error) {
+	return s.conn.Query("*IDN?")
+}
+
+func (s *Scope) Close() error {
+	return s.conn.Close()
+}
+
+// The scope can't delay its record by a sample count, so the record includes
+// the offset, and ReadSamples drops it.
+func (s *Scope) Configure(numSamples, offset int) error {
+	if numSamples <= 0 || offset < 0 {
+		return fmt.Errorf("Invalid samples %d or offset %d", numSamples, offset)
+	}
+	s.samples, s.offset = numSamples, offset
+	for _, cmd := range s.dialect.Setup {
+		if err := s.conn.Command(cmd, s.channel, offset+numSamples); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Scope) Arm() error {
+	return s.conn.Command("%s", s.dialect.Arm)
+}
+
+func (s *Scope) WaitForTrigger() (bool, error) {
+	deadline := time.Now().Add(s.Timeout)
+	for {
+		status, err := s.conn.Query("%s", s.dialect.Status)
+		if err != nil {
+			return false, err
+		}
+		if status == s.dialect.Done {
+			return false, nil
+		}
+		if time.Now().After(deadline) {
+			return true, nil
+		}
+		time.Sleep(statusPollInterval)
+	}
+}
+
+func (s *Scope) ReadSamples() ([]gocw.Sample, error) {
+	resp, err := s.conn.Query("%s", s.dialect.Preamble)
+	if err != nil {
+		return nil, err
+	}
+	p, err := ParsePreamble(resp)
+	if err != nil {
+		return nil, err
+	}
+	data, err := s.conn.QueryBlock("%s", s.dialect.Data)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < s.offset+s.samples {
+		return nil, fmt.Errorf("Scope returned %d samples, expected %d", len(data), s.offset+s.samples)
+	}
+	samples := make([]gocw.Sample, s.samples)
+	for i, code := range data[s.offset : s.offset+s.samples] {
+		samples[i] = gocw.Sample(p.Volts(code, s.dialect.YOriginInCodes))
+	}
+	return samples, nil
+}
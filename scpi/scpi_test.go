@@ -0,0 +1,119 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scpi_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/gocw/scpi"
+)
+
+// Answers queries from a table, and records commands.
+type fakeScope struct {
+	responses map[string]string
+	commands  []string
+	out       bytes.Buffer
+}
+
+func (f *fakeScope) Write(p []byte) (int, error) {
+	cmd := strings.TrimSpace(string(p))
+	f.commands = append(f.commands, cmd)
+	if resp, ok := f.responses[cmd]; ok {
+		f.out.WriteString(resp)
+	}
+	return len(p), nil
+}
+
+func (f *fakeScope) Read(p []byte) (int, error) { return f.out.Read(p) }
+func (f *fakeScope) Close() error               { return nil }
+
+func TestParsePreamble(t *testing.T) {
+	p, err := scpi.ParsePreamble("0,0,1000,1,1.0e-9,-5.0e-7,0,4.0e-3,0.1,128")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := scpi.Preamble{Points: 1000, YIncrement: 4e-3, YOrigin: 0.1, YReference: 128}
+	if p != want {
+		t.Errorf("ParsePreamble = %+v, want %+v", p, want)
+	}
+	if v := p.Volts(138, false); v < 0.1399 || v > 0.1401 {
+		t.Errorf("Volts(138) = %v, want 0.14", v)
+	}
+	if _, err = scpi.ParsePreamble("0,0,1000"); err == nil {
+		t.Error("Short preamble accepted")
+	}
+}
+
+func TestScope(t *testing.T) {
+	f := &fakeScope{responses: map[string]string{
+		":TER?":               "+1\n",
+		":WAVeform:PREamble?": "0,0,4,1,1e-9,0,0,0.5,0,100\n",
+		":WAVeform:DATA?":     "#14\x64\x66\x62\x64\n",
+		"*IDN?":               "KEYSIGHT,DSOX3024T,MY0,07.50\n",
+	}}
+	s := scpi.NewScope(scpi.NewConn(f), scpi.Dialects["keysight"], 2)
+	if id, err := s.Identify(); err != nil || !strings.HasPrefix(id, "KEYSIGHT") {
+		t.Fatalf("Identify returned %q, %v", id, err)
+	}
+	if err := s.Configure(3, 1); err != nil {
+		t.Fatal(err)
+	}
+	if !contains(f.commands, ":WAVeform:SOURce CHANnel2") || !contains(f.commands, ":WAVeform:POINts 4") {
+		t.Errorf("Setup commands %v", f.commands)
+	}
+	if err := s.Arm(); err != nil {
+		t.Fatal(err)
+	}
+	if timedOut, err := s.WaitForTrigger(); err != nil || timedOut {
+		t.Fatalf("WaitForTrigger returned %v, %v", timedOut, err)
+	}
+	samples, err := s.ReadSamples()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Codes 0x66, 0x62, 0x64 around the reference code 100.
+	want := []float64{1, -1, 0}
+	if len(samples) != len(want) {
+		t.Fatalf("ReadSamples returned %v, want %v", samples, want)
+	}
+	for i := range want {
+		if float64(samples[i]) != want[i] {
+			t.Errorf("ReadSamples returned %v, want %v", samples, want)
+		}
+	}
+}
+
+func TestScopeSendsCommandsVerbatim(t *testing.T) {
+	f := &fakeScope{}
+	d := scpi.Dialects["keysight"]
+	d.Arm = ":SYSTem:TEXT \"100%\""
+	if err := scpi.NewScope(scpi.NewConn(f), d, 1).Arm(); err != nil {
+		t.Fatal(err)
+	}
+	if !contains(f.commands, d.Arm) {
+		t.Errorf("Arm sent %v, want %q", f.commands, d.Arm)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Segmented capture.
+// With N segments, a single arm records TotalSamples samples after each of N
+// triggers, and the FIFO holds the segments back to back. Combined with a
+// target that queues operations (see BatchTarget), this amortizes the serial
+// and USB latency across N traces.
+// SegmentData splits the FIFO contents into one trace per trigger.
+// The segment count register is looked up in the register map ("segments").
+// None of the embedded maps describes it yet, so SetSegments above 1 fails
+// with ErrNotSupported until the bitstream's map does.
+package gocw
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/gocw/internal/regmap"
+)
+
+// Sets the number of triggers recorded per arm. 1 disables segmenting.
+func (c *Adc) SetSegments(n int) {
+	if c.err != nil {
+		return
+	}
+	if n < 1 || n > 0xffff {
+		c.err = fmt.Errorf("Segment count %d outside [1, 65535]", n)
+		return
+	}
+	if n > 1 {
+		if c.err = c.caps.Require(FeatureSegmentedCapture); c.err != nil {
+			return
+		}
+	}
+	if n == c.Segments() {
+		return
+	}
+	var reg regmap.Register
+	if reg, c.err = c.regMap.Register("segments"); c.err != nil {
+		return
+	}
+	count := uint16(n)
+	if c.err = c.fpga.Mem.Write(Address(reg.Address), &count, true, nil); c.err != nil {
+		return
+	}
+	c.segments = n
+}
+
+func (c *Adc) Segments() int {
+	if c.segments < 1 {
+		return 1
+	}
+	return c.segments
+}
+
+// Reads the samples of the last capture, split into one trace per segment.
+// Only complete segments are returned, so a short read returns fewer traces
+// than Segments(), see LastTraceRead.
+func (c *Adc) SegmentData() [][]Sample {
+	return c.SegmentDataContext(context.Background())
+}
+
+// Same as SegmentData, returning early when ctx is done.
+func (c *Adc) SegmentDataContext(ctx context.Context) [][]Sample {
+	samples := c.TraceDataContext(ctx)
+	segmentLen := int(c.numSamples())
+	if c.err != nil {
+		return nil
+	}
+	return SplitSegments(samples, segmentLen)
+}
+
+// Splits samples stored back to back into segments of segmentLen samples.
+// Trailing samples not filling a segment are dropped.
+func SplitSegments(samples []Sample, segmentLen int) [][]Sample {
+	if segmentLen <= 0 {
+		return nil
+	}
+	var segments [][]Sample
+	for start := 0; start+segmentLen <= len(samples); start += segmentLen {
+		segments = append(segments, samples[start:start+segmentLen:start+segmentLen])
+	}
+	return segments
+}
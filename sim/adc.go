@@ -0,0 +1,735 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sim
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/google/gocw"
+)
+
+// Hardware reported by the simulated ADC.
+const (
+	sysFreq    = 96000000
+	maxSamples = 24400
+	// Samples per chunk of TraceDataStream.
+	simStreamChunk = 4096
+)
+
+// Simulated ADC of a ChipWhisperer-Lite. Implements gocw.AdcInterface.
+// Settings are kept as set, and shape the simulated samples where they
+// matter: gain, total, offset and pre-trigger samples, downsampling and
+// segments. Clocks always lock, and the target clock is exact.
+type Adc struct {
+	target *target
+	err    error
+
+	gainMode         gocw.GainMode
+	gain             uint8
+	triggerMode      gocw.TriggerMode
+	offset           uint32
+	preSamples       uint32
+	totalSamples     uint32
+	downsample       uint16
+	adcSrc           gocw.AdcSrcTuple
+	adcPhase         int
+	freqCounterSrc   gocw.FreqCounterSrc
+	clkGenInputSrc   gocw.ClkGenInputSrc
+	extClockFreq     uint32
+	clkGenFreq       uint32
+	triggerPins      []gocw.TriggerTargetIoPin
+	triggerLogic     gocw.TriggerPinLogic
+	triggerModule    gocw.TriggerModule
+	decodeTrigger    gocw.DecodeTrigger
+	targetIo1        gocw.TargetIoMode
+	targetIo2        gocw.TargetIoMode
+	targetIo3        gocw.TargetIoMode
+	targetIo4        gocw.TargetIoMode
+	nrst, pdic, pdid gocw.GpioMode
+	hs2              gocw.Hs2Mode
+	triggerPulse     gocw.TriggerPulse
+	glitch           gocw.Glitch
+	crowbars         map[gocw.Crowbar]bool
+	readPadding      int
+	logic            gocw.LogicChannels
+	segments         int
+
+	// Set by ForceTrigger, or a timed out WaitForTigger.
+	forced      bool
+	lastRead    gocw.TraceRead
+	diagnostics gocw.AdcDiagnostics
+}
+
+// Same defaults as gocw.NewAdc on a ChipWhisperer-Lite.
+func newAdc(t *target) *Adc {
+	return &Adc{
+		target:       t,
+		gainMode:     gocw.GainModeHigh,
+		gain:         45,
+		totalSamples: 3000,
+		downsample:   1,
+		adcSrc:       gocw.AdcSrcClkGenX4ViaDcm,
+		extClockFreq: 10e6,
+		clkGenFreq:   7370000,
+		triggerPins:  []gocw.TriggerTargetIoPin{gocw.TriggerTargetIoPin4},
+		targetIo1:    gocw.TargetIoModeSerialRx,
+		targetIo2:    gocw.TargetIoModeSerialTx,
+		targetIo3:    gocw.TargetIoModeHighZ,
+		targetIo4:    gocw.TargetIoModeHighZ,
+		nrst:         gocw.GpioDisabled,
+		pdic:         gocw.GpioDisabled,
+		pdid:         gocw.GpioDisabled,
+		hs2:          gocw.Hs2ModeClkGen,
+		crowbars:     make(map[gocw.Crowbar]bool),
+		readPadding:  gocw.DefaultTraceReadPadding,
+		segments:     1,
+	}
+}
+
+func (c *Adc) Close() error {
+	return nil
+}
+
+func (c *Adc) Error() error {
+	return c.err
+}
+
+//
+// Hardware information.
+//
+
+func (c *Adc) Version() gocw.HwVersion {
+	return gocw.HwVersion{RegVersion: 1, HwType: gocw.HwChipWhispererLite}
+}
+
+func (c *Adc) Capabilities() gocw.Capabilities {
+	return gocw.Capabilities{Hw: c.Version()}
+}
+
+func (c *Adc) SysFreq() uint32 {
+	return sysFreq
+}
+
+func (c *Adc) MaxSamples() uint32 {
+	return maxSamples
+}
+
+//
+// Gain settings.
+//
+
+func (c *Adc) GainMode() gocw.GainMode {
+	return c.gainMode
+}
+
+func (c *Adc) SetGainMode(mode gocw.GainMode) {
+	c.gainMode = mode
+}
+
+func (c *Adc) Gain() uint8 {
+	return c.gain
+}
+
+func (c *Adc) SetGain(gain uint8) {
+	if c.err != nil {
+		return
+	}
+	if gain > gocw.GainMax {
+		c.err = fmt.Errorf("Invalid Gain, range 0-%d only", gocw.GainMax)
+		return
+	}
+	c.gain = gain
+}
+
+func (c *Adc) GainDb() float64 {
+	return gocw.GainDb(c.gainMode, c.gain)
+}
+
+func (c *Adc) SetGainDb(db float64) {
+	if c.err != nil {
+		return
+	}
+	mode, gain, err := gocw.GainSetting(db)
+	if err != nil {
+		c.err = err
+		return
+	}
+	c.gainMode, c.gain = mode, gain
+}
+
+func (c *Adc) TriggerPinState() bool {
+	return false
+}
+
+func (c *Adc) TriggerMode() gocw.TriggerMode {
+	return c.triggerMode
+}
+
+func (c *Adc) SetTriggerMode(mode gocw.TriggerMode) {
+	c.triggerMode = mode
+}
+
+func (c *Adc) TriggerOffset() uint32 {
+	return c.offset
+}
+
+func (c *Adc) SetTriggerOffset(offset uint32) {
+	c.offset = offset
+}
+
+func (c *Adc) PreTriggerSamples() uint32 {
+	return c.preSamples
+}
+
+func (c *Adc) SetPreTriggerSamples(samples uint32) {
+	c.preSamples = samples
+}
+
+func (c *Adc) TotalSamples() uint32 {
+	return c.totalSamples
+}
+
+func (c *Adc) SetTotalSamples(samples uint32) {
+	if c.err != nil {
+		return
+	}
+	if samples > maxSamples {
+		c.err = fmt.Errorf("Total samples %d above maximum %d", samples, maxSamples)
+		return
+	}
+	c.totalSamples = samples
+}
+
+func (c *Adc) DownsampleFactor() uint16 {
+	return c.downsample
+}
+
+func (c *Adc) SetDownsampleFactor(factor uint16) {
+	if factor == 0 {
+		factor = 1
+	}
+	c.downsample = factor
+}
+
+func (c *Adc) ActiveCount() uint32 {
+	return 0
+}
+
+//
+// Clocks.
+//
+
+func (c *Adc) AdcClockSource() gocw.AdcSrcTuple {
+	return c.adcSrc
+}
+
+func (c *Adc) SetAdcClockSource(src gocw.AdcSrcTuple) {
+	c.adcSrc = src
+}
+
+func (c *Adc) AdcFreq() uint32 {
+	in := c.clkGenFreq
+	if c.adcSrc.DcmInput == gocw.DcmInputExtClk {
+		in = c.extClockFreq
+	}
+	if c.adcSrc.AdcSrc == gocw.AdcSrcExtClk {
+		return in
+	}
+	return in * uint32(c.adcSrc.DcmOut)
+}
+
+func (c *Adc) AdcSampleRate() uint32 {
+	return c.AdcFreq() / uint32(c.downsample)
+}
+
+func (c *Adc) DcmLocked() bool {
+	return true
+}
+
+func (c *Adc) AdcPhase() int {
+	return c.adcPhase
+}
+
+func (c *Adc) SetAdcPhase(phase int) {
+	if c.err != nil {
+		return
+	}
+	if phase < gocw.AdcPhaseMin || phase > gocw.AdcPhaseMax {
+		c.err = fmt.Errorf("ADC phase %d outside [%d, %d]", phase, gocw.AdcPhaseMin, gocw.AdcPhaseMax)
+		return
+	}
+	c.adcPhase = phase
+}
+
+func (c *Adc) FreqCounter() uint32 {
+	if c.freqCounterSrc == gocw.FreqCounterClkGenOutput {
+		return c.clkGenFreq
+	}
+	return c.extClockFreq
+}
+
+func (c *Adc) FreqCounterSource() gocw.FreqCounterSrc {
+	return c.freqCounterSrc
+}
+
+func (c *Adc) SetFreqCounterSource(src gocw.FreqCounterSrc) {
+	c.freqCounterSrc = src
+}
+
+func (c *Adc) ClkGenInputSource() gocw.ClkGenInputSrc {
+	return c.clkGenInputSrc
+}
+
+func (c *Adc) SetClkGenInputSource(src gocw.ClkGenInputSrc) {
+	c.clkGenInputSrc = src
+}
+
+func (c *Adc) ExtClockFreq() uint32 {
+	return c.extClockFreq
+}
+
+func (c *Adc) SetExtClockFreq(freq uint32) {
+	c.extClockFreq = freq
+}
+
+func (c *Adc) ClkGenOutputFreq() uint32 {
+	return c.clkGenFreq
+}
+
+func (c *Adc) SetClkGenOutputFreq(freq uint32) {
+	c.clkGenFreq = freq
+}
+
+func (c *Adc) ClkGenDcmLocked() bool {
+	return true
+}
+
+func (c *Adc) SetTargetClock(freq uint32, tolerance float64) (gocw.TargetClock, error) {
+	if c.err != nil {
+		return gocw.TargetClock{Requested: freq}, c.err
+	}
+	c.clkGenFreq = freq
+	c.hs2 = gocw.Hs2ModeClkGen
+	return gocw.TargetClock{
+		Requested:  freq,
+		Achieved:   freq,
+		Iterations: 1,
+		MeasuredOn: gocw.FreqCounterClkGenOutput,
+	}, nil
+}
+
+//
+// Trigger settings.
+//
+
+func (c *Adc) TriggerTargetIoPins() []gocw.TriggerTargetIoPin {
+	return c.triggerPins
+}
+
+func (c *Adc) TriggerPinLogic() gocw.TriggerPinLogic {
+	return c.triggerLogic
+}
+
+func (c *Adc) SetTriggerTargetIoPin(pin gocw.TriggerTargetIoPin) {
+	c.SetTriggerTargetIoPins([]gocw.TriggerTargetIoPin{pin}, gocw.TriggerPinOr)
+}
+
+func (c *Adc) SetTriggerTargetIoPins(pins []gocw.TriggerTargetIoPin, logic gocw.TriggerPinLogic) {
+	c.triggerPins = append([]gocw.TriggerTargetIoPin{}, pins...)
+	c.triggerLogic = logic
+}
+
+func (c *Adc) TriggerModule() gocw.TriggerModule {
+	return c.triggerModule
+}
+
+func (c *Adc) SetTriggerModule(m gocw.TriggerModule) {
+	c.triggerModule = m
+}
+
+func (c *Adc) DecodeTrigger() gocw.DecodeTrigger {
+	return c.decodeTrigger
+}
+
+func (c *Adc) SetDecodeTrigger(t gocw.DecodeTrigger) {
+	if c.err != nil {
+		return
+	}
+	if len(t.Pattern) == 0 || len(t.Pattern) > gocw.MaxDecodePatternLen {
+		c.err = fmt.Errorf("Decode trigger pattern of %d bytes, expected 1 to %d",
+			len(t.Pattern), gocw.MaxDecodePatternLen)
+		return
+	}
+	c.decodeTrigger = t
+}
+
+//
+// GPIO settings.
+//
+
+func (c *Adc) TargetIo1() gocw.TargetIoMode {
+	return c.targetIo1
+}
+
+func (c *Adc) SetTargetIo1(mode gocw.TargetIoMode) {
+	c.targetIo1 = mode
+}
+
+func (c *Adc) TargetIo2() gocw.TargetIoMode {
+	return c.targetIo2
+}
+
+func (c *Adc) SetTargetIo2(mode gocw.TargetIoMode) {
+	c.targetIo2 = mode
+}
+
+func (c *Adc) TargetIo3() gocw.TargetIoMode {
+	return c.targetIo3
+}
+
+func (c *Adc) SetTargetIo3(mode gocw.TargetIoMode) {
+	c.targetIo3 = mode
+}
+
+func (c *Adc) TargetIo4() gocw.TargetIoMode {
+	return c.targetIo4
+}
+
+func (c *Adc) SetTargetIo4(mode gocw.TargetIoMode) {
+	c.targetIo4 = mode
+}
+
+func (c *Adc) NRST() gocw.GpioMode {
+	return c.nrst
+}
+
+func (c *Adc) SetNRST(mode gocw.GpioMode) {
+	c.nrst = mode
+}
+
+func (c *Adc) PDIC() gocw.GpioMode {
+	return c.pdic
+}
+
+func (c *Adc) SetPDIC(mode gocw.GpioMode) {
+	c.pdic = mode
+}
+
+func (c *Adc) PDID() gocw.GpioMode {
+	return c.pdid
+}
+
+func (c *Adc) SetPDID(mode gocw.GpioMode) {
+	c.pdid = mode
+}
+
+func (c *Adc) Hs2() gocw.Hs2Mode {
+	return c.hs2
+}
+
+func (c *Adc) SetHs2(mode gocw.Hs2Mode) {
+	c.hs2 = mode
+}
+
+// Pulses and glitches are recorded, and have no effect on the target.
+
+func (c *Adc) TriggerPulse() gocw.TriggerPulse {
+	return c.triggerPulse
+}
+
+func (c *Adc) SetTriggerPulse(p gocw.TriggerPulse) {
+	c.triggerPulse = p
+}
+
+func (c *Adc) DisableTriggerPulse() {
+	c.triggerPulse = gocw.TriggerPulse{}
+}
+
+func (c *Adc) Glitch() gocw.Glitch {
+	return c.glitch
+}
+
+func (c *Adc) SetGlitch(g gocw.Glitch) {
+	c.glitch = g
+}
+
+func (c *Adc) ManualGlitch() {
+}
+
+func (c *Adc) DisableGlitch() {
+	c.glitch = gocw.Glitch{}
+}
+
+func (c *Adc) Crowbar(m gocw.Crowbar) bool {
+	return c.crowbars[m]
+}
+
+func (c *Adc) SetCrowbar(m gocw.Crowbar, enabled bool) {
+	c.crowbars[m] = enabled
+}
+
+func (c *Adc) SetVoltageGlitch(g gocw.Glitch, crowbars ...gocw.Crowbar) {
+	c.SetGlitch(g)
+	for _, m := range crowbars {
+		c.SetCrowbar(m, true)
+	}
+}
+
+func (c *Adc) TargetPowered() bool {
+	return c.target.powered()
+}
+
+func (c *Adc) PowerOn() {
+	c.target.setPower(true)
+}
+
+func (c *Adc) PowerOff() {
+	c.target.setPower(false)
+}
+
+func (c *Adc) PowerCycle(off time.Duration) {
+	c.PowerOff()
+	time.Sleep(off)
+	c.PowerOn()
+}
+
+//
+// Capture settings.
+//
+
+func (c *Adc) SetArmOn() {
+	c.target.mu.Lock()
+	defer c.target.mu.Unlock()
+	c.target.armed = true
+	c.target.ops = nil
+	c.forced = false
+}
+
+func (c *Adc) SetArmOff() {
+	c.target.mu.Lock()
+	defer c.target.mu.Unlock()
+	c.target.armed = false
+}
+
+func (c *Adc) Disarm() {
+	c.SetArmOff()
+}
+
+func (c *Adc) ForceTrigger() {
+	c.forced = true
+}
+
+func (c *Adc) CaptureOnce(delay time.Duration) []gocw.Sample {
+	c.SetArmOn()
+	time.Sleep(delay)
+	c.ForceTrigger()
+	samples := c.TraceData()
+	c.SetArmOff()
+	return samples
+}
+
+// The trigger fires on the first encryption after arming.
+func (c *Adc) WaitForTigger() bool {
+	c.target.mu.Lock()
+	triggered := len(c.target.ops) > 0
+	c.target.mu.Unlock()
+	if triggered || c.forced {
+		return false
+	}
+	c.diagnostics.TriggerTimeouts++
+	c.ForceTrigger()
+	return true
+}
+
+func (c *Adc) WaitForTriggerContext(ctx context.Context) bool {
+	if c.err == nil {
+		c.err = ctx.Err()
+	}
+	if c.err != nil {
+		c.SetArmOff()
+		return false
+	}
+	return c.WaitForTigger()
+}
+
+// Returns the samples of the encryptions since the last arm, one segment
+// each, or of the idle target if the trigger was forced.
+func (c *Adc) TraceData() []gocw.Sample {
+	var samples []gocw.Sample
+	for _, s := range c.SegmentData() {
+		samples = append(samples, s...)
+	}
+	return samples
+}
+
+func (c *Adc) TraceDataContext(ctx context.Context) []gocw.Sample {
+	if c.err == nil {
+		c.err = ctx.Err()
+	}
+	return c.TraceData()
+}
+
+// Delivers the samples of TraceDataContext in chunks of simStreamChunk
+// samples.
+func (c *Adc) TraceDataStream(ctx context.Context) <-chan []gocw.Sample {
+	samples := c.TraceDataContext(ctx)
+	out := make(chan []gocw.Sample, (len(samples)+simStreamChunk-1)/simStreamChunk)
+	for len(samples) > 0 {
+		n := simStreamChunk
+		if n > len(samples) {
+			n = len(samples)
+		}
+		out <- samples[:n]
+		samples = samples[n:]
+	}
+	close(out)
+	return out
+}
+
+func (c *Adc) SetTraceReadPadding(bytes int) {
+	c.readPadding = bytes
+}
+
+func (c *Adc) TraceReadPadding() int {
+	return c.readPadding
+}
+
+func (c *Adc) LastTraceRead() gocw.TraceRead {
+	return c.lastRead
+}
+
+func (c *Adc) SetLogicCapture(ch gocw.LogicChannels) {
+	if c.err != nil {
+		return
+	}
+	if ch != 0 {
+		c.err = fmt.Errorf("Logic capture is not simulated")
+		return
+	}
+	c.logic = ch
+}
+
+func (c *Adc) LogicCapture() gocw.LogicChannels {
+	return c.logic
+}
+
+func (c *Adc) LogicData() []uint8 {
+	return nil
+}
+
+func (c *Adc) SetSegments(n int) {
+	if c.err != nil {
+		return
+	}
+	if n < 1 {
+		c.err = fmt.Errorf("Invalid number of segments %d", n)
+		return
+	}
+	c.segments = n
+}
+
+func (c *Adc) Segments() int {
+	return c.segments
+}
+
+func (c *Adc) SegmentDataContext(ctx context.Context) [][]gocw.Sample {
+	if c.err == nil {
+		c.err = ctx.Err()
+	}
+	return c.SegmentData()
+}
+
+func (c *Adc) SegmentData() [][]gocw.Sample {
+	if c.err != nil {
+		return nil
+	}
+	c.target.mu.Lock()
+	ops := c.target.ops
+	c.target.mu.Unlock()
+	if len(ops) > c.segments {
+		ops = ops[:c.segments]
+	}
+	if len(ops) == 0 && c.forced {
+		ops = [][]byte{nil}
+	}
+
+	// Pre-trigger samples are only recorded without downsampling.
+	first := int(c.offset)
+	if c.downsample == 1 {
+		first -= int(c.preSamples)
+	}
+	// The model is in cycles of the default 4x ADC clock.
+	mul := c.adcSrc.DcmOut
+	if mul < 1 {
+		mul = 1
+	}
+	step := int(c.downsample) * 4 / mul
+	gain := math.Pow(10, c.GainDb()/20)
+	read := gocw.TraceRead{Samples: int(c.totalSamples) * len(ops)}
+	var segments [][]gocw.Sample
+	for _, pt := range ops {
+		s := c.target.samples(pt, first, step, int(c.totalSamples), gain)
+		for _, v := range s {
+			if v <= gocw.SampleMin || v >= gocw.SampleMax {
+				read.Clipped++
+			}
+		}
+		segments = append(segments, s)
+	}
+	read.Decoded = read.Samples
+	c.lastRead = read
+	return segments
+}
+
+func (c *Adc) Diagnostics() gocw.AdcDiagnostics {
+	return c.diagnostics
+}
+
+func (c *Adc) ClockStatus() gocw.ClockStatus {
+	return gocw.ClockStatus{
+		DcmLocked:       true,
+		ClkGenDcmLocked: true,
+		AdcFreq:         c.AdcFreq(),
+		FreqCounter:     c.FreqCounter(),
+	}
+}
+
+func (c *Adc) DeviceState() gocw.DeviceState {
+	s := gocw.DeviceState{
+		Model: "Simulator",
+		Config: gocw.ScopeConfig{
+			Hw:             c.Version(),
+			GainMode:       c.gainMode,
+			Gain:           c.gain,
+			TriggerMode:    c.triggerMode,
+			TotalSamples:   c.totalSamples,
+			TriggerOffset:  c.offset,
+			PreSamples:     c.preSamples,
+			Decimate:       c.downsample,
+			AdcClockSource: c.adcSrc,
+			AdcFreq:        c.AdcFreq(),
+		},
+		Clock:            c.ClockStatus(),
+		ClkGenOutputFreq: c.clkGenFreq,
+		Diagnostics:      c.diagnostics,
+	}
+	if c.err != nil {
+		s.Problems = append(s.Problems, c.err.Error())
+	}
+	return s
+}
@@ -0,0 +1,161 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sim_test
+
+// End-to-end tests of the capture and attack pipeline on the simulator:
+// program, capture with gocw.NewCaptureContext, save, load, and recover the
+// key with CPA. Seeded, so they run deterministically without hardware, e.g. in
+// CI. Run them with and without the gocw_float64 tag: the saved capture must
+// load back identical under both sample types.
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/gocw"
+	"github.com/google/gocw/attack"
+	"github.com/google/gocw/sim"
+	"github.com/google/gocw/util"
+)
+
+// Firmware image of the simulated target. Its contents don't matter, as long
+// as the flash isn't empty.
+const simFirmware = `:10000000000102030405060708090A0B0C0D0E0F78
+:10001000101112131415161718191A1B1C1D1E1F68
+:00000001FF
+`
+
+var e2eKey = []byte{0x10, 0xa5, 0x88, 0x69, 0xd7, 0x4b, 0xe5, 0xa3, 0x74, 0xcf, 0x86, 0x7c, 0xfb, 0x47, 0x38, 0x59}
+
+// Programs a new simulator, and captures seeded traces with
+// gocw.NewCaptureContext, validating the ciphertexts and logging the session
+// to the audit log in dir.
+func programAndCapture(t *testing.T, dir string) gocw.Capture {
+	model := sim.DefaultLeakModel()
+	model.Seed = 7
+	s := sim.New(model)
+
+	firmware, err := util.LoadIntelHexIo(strings.NewReader(simFirmware))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Programmer.Erase(); err != nil {
+		t.Fatal(err)
+	}
+	opts := gocw.DefaultCaptureOptions()
+	opts.Device = s.CaptureDevice()
+	ctx := context.Background()
+	if _, err = gocw.NewCaptureContext(ctx, e2eKey, gocw.SeededRandGen(42, len(e2eKey)), 500, 1, 0, opts); err == nil {
+		t.Fatal("Captured from an erased target")
+	}
+	if err = util.ProgramDevice(s.Programmer, firmware); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Programmer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	auditFile := filepath.Join(dir, "aes.audit.jsonl")
+	if opts.AuditLog, err = gocw.OpenAuditLog(auditFile); err != nil {
+		t.Fatal(err)
+	}
+	opts.Validator = gocw.AesValidator
+	opts.ValidationPolicy = gocw.ValidationDiscard
+	hooked := 0
+	opts.AfterTrace = func(s *gocw.CaptureSession, index int, trace *gocw.Trace) error {
+		hooked++
+		return nil
+	}
+	c, err := gocw.NewCaptureContext(ctx, e2eKey, gocw.SeededRandGen(42, len(e2eKey)), 500, 200, 0, opts)
+	opts.AuditLog.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c) != 200 || hooked != 200 {
+		t.Fatalf("Captured %d traces and ran AfterTrace %d times, expected 200", len(c), hooked)
+	}
+
+	f, err := os.Open(auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	events, err := gocw.ReadAuditLog(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int{}
+	for _, e := range events {
+		counts[e.Event]++
+	}
+	if counts["session_start"] != 1 || counts["session_end"] != 1 || counts["batch"] == 0 {
+		t.Errorf("Audit log events %v, expected a session with clock checks", counts)
+	}
+	if counts["retry"] != 0 || counts["invalid_output"] != 0 {
+		t.Errorf("Audit log events %v, expected no retries", counts)
+	}
+	return c
+}
+
+func TestEndToEndAesCpa(t *testing.T) {
+	dir := t.TempDir()
+	c := programAndCapture(t, dir)
+	if again := programAndCapture(t, t.TempDir()); !reflect.DeepEqual(c, again) {
+		t.Fatal("Seeded captures differ")
+	}
+
+	for _, format := range []struct {
+		name string
+		save func(c gocw.Capture, filename string) error
+		load func(filename string) (gocw.Capture, error)
+	}{
+		{"aes.json.gz", gocw.Capture.Save, gocw.LoadCapture},
+		{"aes.pb", func(c gocw.Capture, filename string) error {
+			return c.SaveProto(filename, nil)
+		}, func(filename string) (gocw.Capture, error) {
+			c, _, err := gocw.LoadCaptureProto(filename)
+			return c, err
+		}},
+	} {
+		filename := filepath.Join(dir, format.name)
+		if err := format.save(c, filename); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := format.load(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(loaded, c) {
+			t.Errorf("%s: loaded capture differs from the saved one", format.name)
+		}
+		for i := range loaded {
+			if err = gocw.AesValidator(&loaded[i]); err != nil {
+				t.Fatalf("%s: trace %d: %v", format.name, i, err)
+			}
+		}
+		report, err := attack.RunAesCpa(loaded, attack.DefaultAesCpaOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(report.Key[:], e2eKey) {
+			t.Errorf("%s: recovered key %x, expected %x", format.name, report.Key, e2eKey)
+		}
+	}
+}
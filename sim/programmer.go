@@ -0,0 +1,95 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sim
+
+import (
+	"io"
+	"sync"
+)
+
+// Flash programmer of the simulated target. Implements
+// programmer.ProgrammerInterface, e.g. for util.ProgramDevice. Erasing stops
+// the firmware, and the target boots again once the programmer is closed
+// with a non-empty flash.
+type Programmer struct {
+	target *target
+	mu     sync.Mutex
+	// Written bytes, by address. Erased bytes are absent.
+	flash map[uint32]byte
+}
+
+func newProgrammer(t *target) *Programmer {
+	return &Programmer{target: t, flash: make(map[uint32]byte)}
+}
+
+func (p *Programmer) Erase() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.flash = make(map[uint32]byte)
+	p.target.setErased(true)
+	return nil
+}
+
+// Boots the programmed firmware.
+func (p *Programmer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.target.setErased(len(p.flash) == 0)
+	return nil
+}
+
+// Returns the bytes written at addr, 0xff where erased, as on real flash.
+func (p *Programmer) Flash(addr uint32, n int) []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	buf := make([]byte, n)
+	for i := range buf {
+		b, ok := p.flash[addr+uint32(i)]
+		if !ok {
+			b = 0xff
+		}
+		buf[i] = b
+	}
+	return buf
+}
+
+type flashIo struct {
+	p    *Programmer
+	addr uint32
+}
+
+func (f *flashIo) Read(buf []byte) (int, error) {
+	copy(buf, f.p.Flash(f.addr, len(buf)))
+	f.addr += uint32(len(buf))
+	return len(buf), nil
+}
+
+func (f *flashIo) Write(buf []byte) (int, error) {
+	f.p.mu.Lock()
+	defer f.p.mu.Unlock()
+	for i, b := range buf {
+		f.p.flash[f.addr+uint32(i)] = b
+	}
+	f.addr += uint32(len(buf))
+	return len(buf), nil
+}
+
+func (p *Programmer) NewMemoryReader(addr uint32) io.Reader {
+	return &flashIo{p, addr}
+}
+
+func (p *Programmer) NewMemoryWriter(addr uint32) io.Writer {
+	return &flashIo{p, addr}
+}
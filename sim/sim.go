@@ -0,0 +1,206 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Software simulator of a ChipWhisperer and an AES target, to develop and
+// test attacks, capture loops and the viewer without hardware.
+// The target runs simple-serial AES-128 over Usart. Each encryption while
+// the Adc is armed fires the trigger, and leaks the Hamming weight of the
+// first round sbox outputs into the samples, plus gaussian noise. See
+// LeakModel.
+package sim
+
+import (
+	"context"
+	"crypto/aes"
+	"fmt"
+	"math"
+	"math/bits"
+	"math/rand"
+	"sync"
+
+	"github.com/google/gocw"
+	"github.com/google/gocw/analysis"
+)
+
+// Where and how strongly the target leaks. Sample indexes are ADC cycles from
+// the trigger, at the default 4x ADC clock.
+type LeakModel struct {
+	// Sample leaking the sbox output of key byte 0. Key byte i leaks at
+	// Start + i*Spacing.
+	Start   int
+	Spacing int
+	// Sample amplitude per bit of Hamming weight, at 0dB gain.
+	Amplitude float64
+	// Standard deviation of the noise, at 0dB gain.
+	Noise float64
+	// Seed of the noise, for reproducible captures.
+	Seed int64
+}
+
+func DefaultLeakModel() LeakModel {
+	return LeakModel{
+		Start:     100,
+		Spacing:   20,
+		Amplitude: 0.002,
+		Noise:     0.002,
+		Seed:      1,
+	}
+}
+
+// The simulated target, shared by the Adc and the Usart.
+type target struct {
+	model LeakModel
+	mu    sync.Mutex
+	rng   *rand.Rand
+	key   []byte
+	// An unpowered target ignores commands, and so does an erased one until
+	// it is programmed.
+	unpowered bool
+	erased    bool
+	// Set when armed. Receives the plaintexts encrypted since.
+	armed bool
+	ops   [][]byte
+}
+
+// Records an encryption, which fires the trigger when armed.
+func (t *target) encrypt(pt []byte) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	block, err := aes.NewCipher(t.key)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid key: %v", err)
+	}
+	if len(pt) != aes.BlockSize {
+		return nil, fmt.Errorf("Plaintext of %d bytes, expected %d", len(pt), aes.BlockSize)
+	}
+	ct := make([]byte, aes.BlockSize)
+	block.Encrypt(ct, pt)
+	if t.armed {
+		t.ops = append(t.ops, append([]byte{}, pt...))
+	}
+	return ct, nil
+}
+
+func (t *target) powered() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.unpowered
+}
+
+// Returns true if the target handles commands.
+func (t *target) running() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.unpowered && !t.erased
+}
+
+// Booting new firmware clears the key.
+func (t *target) setErased(erased bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !erased && t.erased {
+		t.key = make([]byte, aes.BlockSize)
+	}
+	t.erased = erased
+}
+
+// Powering the target up reboots it, and clears the key.
+func (t *target) setPower(on bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if on && t.unpowered {
+		t.key = make([]byte, aes.BlockSize)
+	}
+	t.unpowered = !on
+}
+
+func (t *target) setKey(key []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.key = append([]byte{}, key...)
+}
+
+// Returns the samples of an encryption of pt, or of the idle target if pt
+// is nil. Sample i is taken first+i*step ADC cycles after the trigger, and
+// scaled by gain.
+func (t *target) samples(pt []byte, first, step, n int, gain float64) []gocw.Sample {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := make([]gocw.Sample, n)
+	for i := range s {
+		v := t.rng.NormFloat64() * t.model.Noise
+		if k := first + i*step - t.model.Start; pt != nil && k >= 0 &&
+			t.model.Spacing > 0 && k%t.model.Spacing == 0 && k/t.model.Spacing < len(pt) {
+			b := k / t.model.Spacing
+			v += t.model.Amplitude * float64(bits.OnesCount8(analysis.Sbox[pt[b]^t.key[b]]))
+		}
+		v *= gain
+		s[i] = gocw.Sample(math.Max(float64(gocw.SampleMin), math.Min(float64(gocw.SampleMax), v)))
+	}
+	return s
+}
+
+// A simulated ChipWhisperer and AES target.
+type Simulator struct {
+	Dev        *Device
+	Adc        *Adc
+	Usart      *Usart
+	Programmer *Programmer
+}
+
+func New(model LeakModel) *Simulator {
+	t := &target{model: model, rng: rand.New(rand.NewSource(model.Seed)), key: make([]byte, aes.BlockSize)}
+	return &Simulator{
+		Dev:        &Device{},
+		Adc:        newAdc(t),
+		Usart:      newUsart(t),
+		Programmer: newProgrammer(t),
+	}
+}
+
+// Handles to capture from the simulator with gocw.NewCaptureContext, see
+// gocw.CaptureOptions.Device.
+func (s *Simulator) CaptureDevice() *gocw.CaptureDevice {
+	return &gocw.CaptureDevice{Dev: s.Dev, Adc: s.Adc, Usart: s.Usart}
+}
+
+// Captures a set of traces, like gocw.NewCapture, from the simulator.
+func (s *Simulator) Capture(key []byte, ptGen gocw.PtGen, numSamples, numTraces, offset int) (gocw.Capture, error) {
+	opts := gocw.DefaultCaptureOptions()
+	opts.Device = s.CaptureDevice()
+	return gocw.NewCaptureContext(context.Background(), key, ptGen, numSamples, numTraces, offset, opts)
+}
+
+// Accepts and discards all USB transfers. Implements gocw.UsbDeviceInterface.
+type Device struct{}
+
+func (d *Device) Read(p []byte) (int, error) {
+	return 0, nil
+}
+
+func (d *Device) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (d *Device) Close() error {
+	return nil
+}
+
+func (d *Device) ControlIn(request gocw.Request, val uint16, data interface{}) error {
+	return nil
+}
+
+func (d *Device) ControlOut(request gocw.Request, val uint16, data interface{}) error {
+	return nil
+}
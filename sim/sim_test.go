@@ -0,0 +1,112 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sim_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/gocw"
+	"github.com/google/gocw/attack"
+	"github.com/google/gocw/sim"
+)
+
+var _ gocw.UsbDeviceInterface = &sim.Device{}
+var _ gocw.AdcInterface = &sim.Adc{}
+var _ gocw.UsartInterface = &sim.Usart{}
+
+func TestCaptureRecoversKey(t *testing.T) {
+	key := []byte{0x2b, 0x7e, 0x15, 0x16, 0x28, 0xae, 0xd2, 0xa6, 0xab, 0xf7, 0x15, 0x88, 0x09, 0xcf, 0x4f, 0x3c}
+	s := sim.New(sim.DefaultLeakModel())
+	c, err := s.Capture(key, gocw.SeededRandGen(1, len(key)), 500, 200, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c) != 200 || len(c[0].PowerMeasurements) != 500 {
+		t.Fatalf("Captured %d traces of %d samples, want 200 of 500", len(c), len(c[0].PowerMeasurements))
+	}
+	for i := range c {
+		if err = gocw.AesValidator(&c[i]); err != nil {
+			t.Fatalf("Trace %d: %v", i, err)
+		}
+	}
+	report, err := attack.RunAesCpa(c, attack.DefaultAesCpaOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(report.Key[:], key) {
+		t.Errorf("Recovered key %x, expected %x", report.Key, key)
+	}
+}
+
+func TestWaitForTriggerTimesOut(t *testing.T) {
+	s := sim.New(sim.DefaultLeakModel())
+	s.Adc.SetTotalSamples(100)
+	s.Adc.SetArmOn()
+	if !s.Adc.WaitForTigger() {
+		t.Error("WaitForTigger did not time out without an encryption")
+	}
+	if n := len(s.Adc.TraceData()); n != 100 {
+		t.Errorf("Forced trace has %d samples, want 100", n)
+	}
+	if d := s.Adc.Diagnostics(); d.TriggerTimeouts != 1 {
+		t.Errorf("TriggerTimeouts is %d, want 1", d.TriggerTimeouts)
+	}
+}
+
+func TestUsartRejectsUnknownCommands(t *testing.T) {
+	s := sim.New(sim.DefaultLeakModel())
+	s.Usart.Write([]byte("q00\n"))
+	buf := make([]byte, 8)
+	n, err := s.Usart.Read(buf)
+	if err != nil || string(buf[:n]) != "z01\n" {
+		t.Errorf("Read %q, %v, want z01", buf[:n], err)
+	}
+	if _, err = s.Usart.Read(buf); err == nil {
+		t.Error("Read with no pending response did not time out")
+	}
+}
+
+func TestPowerCycleClearsKey(t *testing.T) {
+	s := sim.New(sim.DefaultLeakModel())
+	ss, err := gocw.NewSimpleSerial(s.Usart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ss.SetKey(bytes.Repeat([]byte{1}, 16)); err != nil {
+		t.Fatal(err)
+	}
+	s.Adc.PowerOff()
+	if s.Adc.TargetPowered() {
+		t.Error("TargetPowered after PowerOff")
+	}
+	if err = ss.Send(make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ss.Response(); err == nil {
+		t.Error("Unpowered target responded")
+	}
+	s.Adc.PowerOn()
+	if err = ss.Send(make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	trace := gocw.Trace{Key: make([]byte, 16), Pt: make([]byte, 16)}
+	if trace.Ct, err = ss.Response(); err != nil {
+		t.Fatal(err)
+	}
+	if err = gocw.AesValidator(&trace); err != nil {
+		t.Errorf("Key was not cleared by the power cycle: %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sim
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Serial link to the simulated simple-serial AES firmware. Implements
+// gocw.UsartInterface. Commands are handled as soon as their line is
+// written:
+//
+//	v              version, answers z00
+//	k<key hex>     sets the key, answers z00
+//	p<pt hex>      encrypts, answers r<ct hex>
+//	x              clears the partial command line
+//
+// Commands are ignored while the target is powered off (see Adc.PowerOff),
+// or erased (see Programmer).
+type Usart struct {
+	target  *target
+	mu      sync.Mutex
+	line    []byte
+	out     bytes.Buffer
+	timeout time.Duration
+}
+
+func newUsart(t *target) *Usart {
+	return &Usart{target: t, timeout: time.Second}
+}
+
+func (u *Usart) Write(p []byte) (int, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, b := range p {
+		switch b {
+		case 'x':
+			u.line = u.line[:0]
+		case '\n':
+			u.handle(string(u.line))
+			u.line = u.line[:0]
+		default:
+			u.line = append(u.line, b)
+		}
+	}
+	return len(p), nil
+}
+
+func (u *Usart) handle(cmd string) {
+	if len(cmd) == 0 || !u.target.running() {
+		return
+	}
+	arg, err := hex.DecodeString(cmd[1:])
+	switch {
+	case cmd[0] == 'v':
+		u.out.WriteString("z00\n")
+	case err != nil:
+		u.out.WriteString("z01\n")
+	case cmd[0] == 'k':
+		u.target.setKey(arg)
+		u.out.WriteString("z00\n")
+	case cmd[0] == 'p':
+		ct, err := u.target.encrypt(arg)
+		if err != nil {
+			u.out.WriteString("z01\n")
+			return
+		}
+		fmt.Fprintf(&u.out, "r%s\n", hex.EncodeToString(ct))
+	default:
+		u.out.WriteString("z01\n")
+	}
+}
+
+// Reads the pending responses. The firmware answers immediately, so there
+// is nothing to wait for.
+func (u *Usart) ReadContext(ctx context.Context, p []byte) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return u.Read(p)
+}
+
+func (u *Usart) Read(p []byte) (int, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.out.Len() == 0 {
+		return 0, fmt.Errorf("Read timed out after %v: %w", u.timeout, os.ErrDeadlineExceeded)
+	}
+	return u.out.Read(p)
+}
+
+func (u *Usart) Flush() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.out.Reset()
+	return nil
+}
+
+func (u *Usart) Timeout() time.Duration {
+	return u.timeout
+}
+
+func (u *Usart) SetTimeout(timeout time.Duration) {
+	u.timeout = timeout
+}
@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"strings"
 	"time"
 
@@ -28,29 +29,92 @@ import (
 
 type SimpleSerial struct {
 	usart UsartInterface
+	// Reads responses from usart. Shared by all reads, since a read may
+	// buffer the start of the next response line.
+	rd *bufio.Reader
 }
 
 func (s *SimpleSerial) WriteKey(k []byte) error {
-	var err error
-	cmd := bytes.NewBufferString(fmt.Sprintf("k%s\n", hex.EncodeToString(k)))
-	if _, err = s.usart.Write(cmd.Bytes()); err != nil {
-		return fmt.Errorf("Failed to write key command: %v", err)
-	}
-	if err = s.waitForAck(); err != nil {
+	if err := s.Command('k', k); err != nil {
 		return err
 	}
-	return nil
+	return s.waitForAck()
 }
 
 func (s *SimpleSerial) WritePlaintext(p []byte) error {
-	var err error
-	cmd := bytes.NewBufferString(fmt.Sprintf("p%s\n", hex.EncodeToString(p)))
-	if _, err = s.usart.Write(cmd.Bytes()); err != nil {
-		return fmt.Errorf("Failed to write p command: %v", err)
+	return s.Command('p', p)
+}
+
+// Formats a command: its letter, the payload in hex and a newline.
+func encodeCommand(cmd byte, payload []byte) []byte {
+	return []byte(fmt.Sprintf("%c%s\n", cmd, hex.EncodeToString(payload)))
+}
+
+// Implements CommandTarget, e.g. Command('s', seed) for firmware taking a
+// mask seed with an 's' command. Read any response with ReadResponse.
+func (s *SimpleSerial) Command(cmd byte, payload []byte) error {
+	if _, err := s.usart.Write(encodeCommand(cmd, payload)); err != nil {
+		return fmt.Errorf("Failed to write %c command: %v", cmd, err)
 	}
 	return nil
 }
 
+// Implements CommandTarget. Reads a response line, and returns its letter,
+// e.g. 'r' for output or 'z' for an ack, and its payload.
+func (s *SimpleSerial) ReadResponse() (byte, []byte, error) {
+	line, err := s.ResponseLine()
+	if err != nil {
+		return 0, nil, err
+	}
+	line = strings.TrimSuffix(line, "\n")
+	if len(line) == 0 {
+		return 0, nil, fmt.Errorf("Empty response")
+	}
+	payload, err := hex.DecodeString(line[1:])
+	if err != nil {
+		return 0, nil, fmt.Errorf("Invalid %c response payload: %v", line[0], err)
+	}
+	return line[0], payload, nil
+}
+
+// Implements Target.
+func (s *SimpleSerial) SetKey(k []byte) error {
+	return s.WriteKey(k)
+}
+
+// Implements Target.
+func (s *SimpleSerial) Send(p []byte) error {
+	return s.WritePlaintext(p)
+}
+
+// Implements BatchTarget. The firmware processes the queued commands in order,
+// as long as they fit its receive buffer.
+func (s *SimpleSerial) SendBatch(inputs [][]byte) error {
+	cmd := &bytes.Buffer{}
+	for _, p := range inputs {
+		cmd.Write(encodeCommand('p', p))
+	}
+	if _, err := s.usart.Write(cmd.Bytes()); err != nil {
+		return fmt.Errorf("Failed to write batched p commands: %v", err)
+	}
+	return nil
+}
+
+// Implements BatchTarget.
+func (s *SimpleSerial) ResponseBatch(n int) ([][]byte, error) {
+	res := make([][]byte, n)
+	for i := range res {
+		line, err := s.rd.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("Failed reading response %d/%d: %v", i+1, n, err)
+		}
+		if res[i], err = parseResponse(line); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
 func (s *SimpleSerial) waitForAck() error {
 	var err error
 	var res string
@@ -60,13 +124,29 @@ func (s *SimpleSerial) waitForAck() error {
 	if res[0] != 'z' {
 		return fmt.Errorf("ACK error %v", res)
 	}
+	return ackStatus(res)
+}
+
+// Returns the status of a 'z' ack line as an error, nil for Ss2Ok. Acks of
+// simple-serial v1.0 firmware carry no status.
+func ackStatus(res string) error {
+	res = strings.TrimSpace(res[1:])
+	if len(res) == 0 {
+		return nil
+	}
+	status, err := hex.DecodeString(res)
+	if err != nil || len(status) != 1 {
+		return fmt.Errorf("Invalid ACK status %q", res)
+	}
+	if Ss2Status(status[0]) != Ss2Ok {
+		return Ss2Status(status[0])
+	}
 	return nil
 }
 
 // Reads response line.
 func (s *SimpleSerial) ResponseLine() (string, error) {
-	rd := bufio.NewReader(s.usart)
-	return rd.ReadString('\n')
+	return s.rd.ReadString('\n')
 }
 
 // Reads response.
@@ -76,6 +156,17 @@ func (s *SimpleSerial) Response() ([]byte, error) {
 	if res, err = s.ResponseLine(); err != nil {
 		return nil, err
 	}
+	return parseResponse(res)
+}
+
+// A 'z' ack instead of the response returns its status, e.g. Ss2InvalidLength
+// for a plaintext of the wrong size.
+func parseResponse(res string) ([]byte, error) {
+	if res[0] == 'z' {
+		if err := ackStatus(res); err != nil {
+			return nil, fmt.Errorf("Command failed: %w", err)
+		}
+	}
 	if res[0] != 'r' {
 		return nil, fmt.Errorf("Res error %v", res)
 	}
@@ -88,11 +179,12 @@ func (s *SimpleSerial) checkVersion() error {
 	if err = s.usart.Flush(); err != nil {
 		return fmt.Errorf("Flush failed: %v", err)
 	}
+	s.rd.Reset(s.usart)
 	if _, err = s.usart.Write([]byte{'v', '\n'}); err != nil {
 		return fmt.Errorf("Failed to write ver command: %v", err)
 	}
 	res := make([]byte, 4)
-	if _, err = s.usart.Read(res); err != nil {
+	if _, err = io.ReadFull(s.rd, res); err != nil {
 		return fmt.Errorf("Failed to read ver response: %v", err)
 	}
 	if res[0] != 'z' {
@@ -112,13 +204,14 @@ func (s *SimpleSerial) flush() error {
 	if err = s.usart.Flush(); err != nil {
 		return fmt.Errorf("Failed to flush read buffer: %v", err)
 	}
+	s.rd.Reset(s.usart)
 	return nil
 }
 
 func NewSimpleSerial(usart UsartInterface) (*SimpleSerial, error) {
 	var err error
 	glog.V(1).Infof("Opening SimpleSerial")
-	s := &SimpleSerial{usart}
+	s := &SimpleSerial{usart: usart, rd: bufio.NewReader(usart)}
 	if err = s.flush(); err != nil {
 		return nil, err
 	}
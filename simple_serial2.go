@@ -0,0 +1,348 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// simple-serial v2 protocol.
+// Commands are binary frames: command, sub-command, data length, data and a
+// CRC-8. Zero bytes are stuffed (COBS), so a zero byte ends each frame. The
+// target answers with frames of a command, length, data and CRC-8: the output
+// of the command if any, then an error frame ('e') with a status code.
+// Based on simpleserial.py:SimpleSerial2.
+package gocw
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	TargetProtocolSimpleSerial2 = "simpleserial2"
+	// Speaks simple-serial v2 if the firmware does, and v1 otherwise.
+	TargetProtocolSimpleSerialAuto = "simpleserial_auto"
+)
+
+const (
+	// Longest data of a frame, so stuffing offsets fit a byte.
+	ss2MaxData = 249
+	ss2CrcPoly = 0x4d
+	// Zero bytes sent to end any partial frame the target holds.
+	ss2ResetLen = 10
+)
+
+// Status code of the error frame acknowledging a simple-serial v2 command,
+// also sent in the 'z' acks of simple-serial v1.1. Codes from 0x10 are
+// command specific. Returned as the error of failed commands, see
+// IsRetryableTargetError.
+type Ss2Status uint8
+
+const (
+	Ss2Ok                  Ss2Status = 0x00
+	Ss2InvalidCommand      Ss2Status = 0x01
+	Ss2BadCrc              Ss2Status = 0x02
+	Ss2Timeout             Ss2Status = 0x03
+	Ss2InvalidLength       Ss2Status = 0x04
+	Ss2UnexpectedFrameByte Ss2Status = 0x05
+)
+
+func (s Ss2Status) Error() string {
+	switch s {
+	case Ss2Ok:
+		return "ok"
+	case Ss2InvalidCommand:
+		return "invalid command"
+	case Ss2BadCrc:
+		return "bad CRC"
+	case Ss2Timeout:
+		return "timeout"
+	case Ss2InvalidLength:
+		return "invalid length"
+	case Ss2UnexpectedFrameByte:
+		return "unexpected frame byte"
+	}
+	return fmt.Sprintf("command error %#x", uint8(s))
+}
+
+// Returns true if the command may succeed when sent again: the frame was
+// corrupted or cut short on the serial line. Invalid commands or lengths, and
+// command specific errors, fail again.
+func (s Ss2Status) Retryable() bool {
+	switch s {
+	case Ss2BadCrc, Ss2Timeout, Ss2UnexpectedFrameByte:
+		return true
+	}
+	return false
+}
+
+// Returns true if err is, or wraps, a retryable target status, see
+// Ss2Status.Retryable.
+func IsRetryableTargetError(err error) bool {
+	var status Ss2Status
+	return errors.As(err, &status) && status.Retryable()
+}
+
+// CRC-8 of the frames, polynomial 0x4d.
+func ss2Crc(data []byte) byte {
+	var crc byte
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ ss2CrcPoly
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// Stuffs the zero bytes of frame: a leading byte and each zero byte hold the
+// offset of the next zero byte, up to the zero byte ending the frame.
+func ss2Stuff(frame []byte) []byte {
+	buf := make([]byte, len(frame)+2)
+	copy(buf[1:], frame)
+	last := 0
+	for i := 1; i < len(buf); i++ {
+		if buf[i] == 0 {
+			buf[last] = byte(i - last)
+			last = i
+		}
+	}
+	return buf
+}
+
+// Reverses ss2Stuff, given the frame without the ending zero byte.
+func ss2Unstuff(buf []byte) ([]byte, error) {
+	frame := append([]byte(nil), buf...)
+	i := 0
+	for i < len(frame) {
+		next := int(frame[i])
+		if next == 0 {
+			return nil, fmt.Errorf("Unexpected zero byte at %d", i)
+		}
+		frame[i] = 0
+		i += next
+	}
+	if i != len(frame) {
+		return nil, fmt.Errorf("Stuffing overruns the frame")
+	}
+	return frame[1:], nil
+}
+
+type SimpleSerial2 struct {
+	usart UsartInterface
+}
+
+// Opens the protocol, and checks the firmware answers the version command.
+func NewSimpleSerial2(usart UsartInterface) (*SimpleSerial2, error) {
+	glog.V(1).Infof("Opening SimpleSerial v2")
+	s := &SimpleSerial2{usart}
+	if err := s.reset(); err != nil {
+		return nil, err
+	}
+	if err := s.checkVersion(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Opens simple-serial v2 if the firmware speaks it, and v1 otherwise.
+func OpenSimpleSerial(usart UsartInterface) (Target, error) {
+	s, err := NewSimpleSerial2(usart)
+	if err == nil {
+		return s, nil
+	}
+	glog.V(1).Infof("Falling back to SimpleSerial v1: %v", err)
+	return NewSimpleSerial(usart)
+}
+
+func (s *SimpleSerial2) reset() error {
+	if _, err := s.usart.Write(make([]byte, ss2ResetLen)); err != nil {
+		return fmt.Errorf("Failed to write reset: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := s.usart.Flush(); err != nil {
+		return fmt.Errorf("Failed to flush read buffer: %v", err)
+	}
+	return nil
+}
+
+// Any valid frame answering the version command tells the firmware speaks
+// v2. Firmware versions differ in the frame: 2.0 answers with an 'e' frame,
+// while 2.1 answers with an 'r' frame followed by the 'e' acknowledgement.
+func (s *SimpleSerial2) checkVersion() error {
+	if err := s.Command('v', nil); err != nil {
+		return err
+	}
+	cmd, data, err := s.ReadFrame()
+	if err != nil {
+		return fmt.Errorf("No SimpleSerial v2 version response: %v", err)
+	}
+	glog.V(1).Infof("SimpleSerial v2 version response %c %x", cmd, data)
+	if cmd == 'r' {
+		if err := s.Ack(); err != nil {
+			return fmt.Errorf("SimpleSerial v2 version not acknowledged: %v", err)
+		}
+	}
+	return nil
+}
+
+// Implements CommandTarget, with sub-command 0.
+func (s *SimpleSerial2) Command(cmd byte, payload []byte) error {
+	return s.SubCommand(cmd, 0, payload)
+}
+
+// Sends command cmd with sub-command scmd and data.
+func (s *SimpleSerial2) SubCommand(cmd, scmd byte, data []byte) error {
+	if len(data) > ss2MaxData {
+		return fmt.Errorf("Command %c data too long: %d > %d bytes", cmd, len(data), ss2MaxData)
+	}
+	if _, err := s.usart.Write(s.frame(cmd, scmd, data)); err != nil {
+		return fmt.Errorf("Failed to write %c command: %v", cmd, err)
+	}
+	return nil
+}
+
+func (s *SimpleSerial2) frame(cmd, scmd byte, data []byte) []byte {
+	frame := append([]byte{cmd, scmd, byte(len(data))}, data...)
+	return ss2Stuff(append(frame, ss2Crc(frame)))
+}
+
+// Reads len(p) bytes, failing if the USART read times out first.
+func (s *SimpleSerial2) read(p []byte) error {
+	if n, err := io.ReadFull(s.usart, p); err != nil {
+		return fmt.Errorf("Read failed after %d of %d bytes: %v", n, len(p), err)
+	}
+	return nil
+}
+
+// Implements CommandTarget, see ReadFrame.
+func (s *SimpleSerial2) ReadResponse() (byte, []byte, error) {
+	return s.ReadFrame()
+}
+
+// Reads a frame from the target, and returns its command, e.g. 'r' for output
+// or 'e' for the status, and data.
+func (s *SimpleSerial2) ReadFrame() (byte, []byte, error) {
+	// The stuffing byte, command and length tell the frame size.
+	buf := make([]byte, 3)
+	if err := s.read(buf); err != nil {
+		return 0, nil, fmt.Errorf("Failed reading frame header: %v", err)
+	}
+	// A stuffing offset pointing at the length means it is zero.
+	dlen := int(buf[2])
+	for i := 0; i < len(buf); i += int(buf[i]) {
+		if buf[i] == 0 {
+			return 0, nil, fmt.Errorf("Unexpected zero byte in frame header %x", buf)
+		}
+		if i == 2 {
+			dlen = 0
+		}
+	}
+	// Data, CRC and the ending zero byte.
+	buf = append(buf, make([]byte, dlen+2)...)
+	if err := s.read(buf[3:]); err != nil {
+		return 0, nil, fmt.Errorf("Failed reading frame: %v", err)
+	}
+	if buf[len(buf)-1] != 0 {
+		return 0, nil, fmt.Errorf("Frame %x not terminated", buf)
+	}
+	frame, err := ss2Unstuff(buf[:len(buf)-1])
+	if err != nil {
+		return 0, nil, fmt.Errorf("Invalid frame %x: %v", buf, err)
+	}
+	if crc := ss2Crc(frame[:len(frame)-1]); crc != frame[len(frame)-1] {
+		return 0, nil, fmt.Errorf("Frame %x CRC mismatch, expected %#x", frame, crc)
+	}
+	return frame[0], frame[2 : len(frame)-1], nil
+}
+
+// Reads the error frame acknowledging a command. Returns its status if not
+// Ss2Ok.
+func (s *SimpleSerial2) Ack() error {
+	cmd, data, err := s.ReadFrame()
+	if err != nil {
+		return err
+	}
+	if cmd != 'e' || len(data) != 1 {
+		return fmt.Errorf("ACK error %c %x", cmd, data)
+	}
+	if status := Ss2Status(data[0]); status != Ss2Ok {
+		return status
+	}
+	return nil
+}
+
+// Implements Target.
+func (s *SimpleSerial2) SetKey(k []byte) error {
+	if err := s.Command('k', k); err != nil {
+		return err
+	}
+	return s.Ack()
+}
+
+// Implements Target.
+func (s *SimpleSerial2) Send(p []byte) error {
+	return s.Command('p', p)
+}
+
+// Implements Target.
+func (s *SimpleSerial2) Response() ([]byte, error) {
+	cmd, data, err := s.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	if cmd == 'e' && len(data) == 1 {
+		return nil, fmt.Errorf("Command failed: %w", Ss2Status(data[0]))
+	}
+	if cmd != 'r' {
+		return nil, fmt.Errorf("Res error %c %x", cmd, data)
+	}
+	if err := s.Ack(); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Implements BatchTarget. The firmware processes the queued frames in order,
+// as long as they fit its receive buffer.
+func (s *SimpleSerial2) SendBatch(inputs [][]byte) error {
+	var buf bytes.Buffer
+	for _, p := range inputs {
+		if len(p) > ss2MaxData {
+			return fmt.Errorf("Command p data too long: %d > %d bytes", len(p), ss2MaxData)
+		}
+		buf.Write(s.frame('p', 0, p))
+	}
+	if _, err := s.usart.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("Failed to write batched p commands: %v", err)
+	}
+	return nil
+}
+
+// Implements BatchTarget.
+func (s *SimpleSerial2) ResponseBatch(n int) ([][]byte, error) {
+	res := make([][]byte, n)
+	for i := range res {
+		var err error
+		if res[i], err = s.Response(); err != nil {
+			return nil, fmt.Errorf("Failed reading response %d/%d: %v", i+1, n, err)
+		}
+	}
+	return res, nil
+}
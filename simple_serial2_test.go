@@ -0,0 +1,179 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gocw"
+)
+
+// Simple-serial v2 firmware echoing the plaintext XORed with the key. Frames
+// are written and read whole, as the USART delivers them.
+type ss2Target struct {
+	key []byte
+	out bytes.Buffer
+	// Answers commands with this status, if not zero.
+	status gocw.Ss2Status
+}
+
+func ss2Crc(data []byte) byte {
+	var crc byte
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x4d
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// Stuffs zero bytes as the firmware does, see simpleserial.c.
+func ss2Frame(cmd byte, data []byte) []byte {
+	frame := append([]byte{0, cmd, byte(len(data))}, data...)
+	frame = append(frame, ss2Crc(frame[1:]), 0)
+	last := 0
+	for i := 1; i < len(frame); i++ {
+		if frame[i] == 0 {
+			frame[last] = byte(i - last)
+			last = i
+		}
+	}
+	return frame
+}
+
+func (t *ss2Target) Write(p []byte) (int, error) {
+	for _, raw := range bytes.SplitAfter(p, []byte{0}) {
+		if len(raw) < 2 {
+			// Reset zero bytes.
+			continue
+		}
+		frame := append([]byte(nil), raw[:len(raw)-1]...)
+		for i := 0; i < len(frame); {
+			next := int(frame[i])
+			frame[i] = 0
+			i += next
+		}
+		frame = frame[1:]
+		if ss2Crc(frame[:len(frame)-1]) != frame[len(frame)-1] {
+			t.out.Write(ss2Frame('e', []byte{byte(gocw.Ss2BadCrc)}))
+			continue
+		}
+		if t.status != gocw.Ss2Ok {
+			t.out.Write(ss2Frame('e', []byte{byte(t.status)}))
+			continue
+		}
+		data := frame[3 : len(frame)-1]
+		switch frame[0] {
+		case 'v':
+			// SimpleSerial 2.1 answers with the version, then acknowledges.
+			t.out.Write(ss2Frame('r', []byte{3}))
+			t.out.Write(ss2Frame('e', []byte{0}))
+		case 'k':
+			t.key = append([]byte(nil), data...)
+			t.out.Write(ss2Frame('e', []byte{0}))
+		case 'p':
+			res := make([]byte, len(data))
+			for i := range res {
+				res[i] = data[i] ^ t.key[i%len(t.key)]
+			}
+			t.out.Write(ss2Frame('r', res))
+			t.out.Write(ss2Frame('e', []byte{0}))
+		default:
+			t.out.Write(ss2Frame('e', []byte{byte(gocw.Ss2InvalidCommand)}))
+		}
+	}
+	return len(p), nil
+}
+
+func (t *ss2Target) Read(p []byte) (int, error) {
+	return t.out.Read(p)
+}
+
+func (t *ss2Target) ReadContext(ctx context.Context, p []byte) (int, error) {
+	return t.out.Read(p)
+}
+
+func (t *ss2Target) Flush() error {
+	t.out.Reset()
+	return nil
+}
+
+func (t *ss2Target) Timeout() time.Duration           { return time.Second }
+func (t *ss2Target) SetTimeout(timeout time.Duration) {}
+
+func TestSimpleSerial2(t *testing.T) {
+	usart := &ss2Target{}
+	target, err := gocw.OpenTarget(gocw.TargetProtocolSimpleSerialAuto, usart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, ok := target.(*gocw.SimpleSerial2)
+	if !ok {
+		t.Fatalf("Opened %T, want *gocw.SimpleSerial2", target)
+	}
+	// Zero bytes in the data are stuffed.
+	if err := ss.SetKey([]byte{0, 0xff, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.Send([]byte{1, 0, 0xff, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := ss.Response(); err != nil || !bytes.Equal(res, []byte{1, 0xff, 0xff, 0}) {
+		t.Errorf("Response() = %x, %v", res, err)
+	}
+	if err := ss.SendBatch([][]byte{{1}, {2}, {}}); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := ss.ResponseBatch(3); err != nil || !reflect.DeepEqual(res, [][]byte{{1}, {2}, {}}) {
+		t.Errorf("ResponseBatch(3) = %x, %v", res, err)
+	}
+
+	// Commands the library doesn't know.
+	if err := ss.Command('c', []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if cmd, data, err := ss.ReadResponse(); err != nil || cmd != 'e' || !bytes.Equal(data, []byte{byte(gocw.Ss2InvalidCommand)}) {
+		t.Errorf("ReadResponse() = %c, %x, %v, want an invalid command status", cmd, data, err)
+	}
+
+	usart.status = gocw.Ss2InvalidLength
+	if err := ss.SetKey([]byte{1}); err != gocw.Ss2InvalidLength {
+		t.Errorf("SetKey() = %v, want %v", err, gocw.Ss2InvalidLength)
+	}
+	usart.status = gocw.Ss2Ok
+	if err := ss.Command('p', make([]byte, 250)); err == nil {
+		t.Errorf("Command with 250 bytes succeeded")
+	}
+}
+
+func TestSimpleSerial2Timeout(t *testing.T) {
+	// Firmware answering nothing, e.g. simple-serial v1 ignoring the frames.
+	if _, err := gocw.NewSimpleSerial2(&silentUsart{}); err == nil {
+		t.Errorf("NewSimpleSerial2 succeeded without a target")
+	}
+}
+
+type silentUsart struct{ ss2Target }
+
+func (u *silentUsart) Write(p []byte) (int, error) { return len(p), nil }
@@ -16,6 +16,7 @@ package gocw_test
 
 import (
 	"bytes"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -48,3 +49,154 @@ func TestNewSimpleSerialFailsOnBadVersion(t *testing.T) {
 		t.Errorf("NewSimpleSerial expected to fail with bad version")
 	}
 }
+
+func TestSimpleSerialBatch(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	usart := mocks.NewMockUsartInterface(mockCtrl)
+	clear := bytes.NewBufferString("xxxxxxxxxxxxxxxxxxx\n")
+	responses := []byte("r0a0b\nr0c0d\n")
+	gomock.InOrder(
+		usart.EXPECT().Write(clear.Bytes()).Return(clear.Len(), nil),
+		usart.EXPECT().Flush().Return(nil),
+		usart.EXPECT().Flush().Return(nil),
+		usart.EXPECT().Write([]byte{'v', '\n'}).Return(2, nil),
+		usart.EXPECT().Read(gomock.Any()).
+			SetArg(0, []byte{'z', '0', '0', '\n'}).
+			Return(4, nil),
+		// All commands in a single write.
+		usart.EXPECT().Write([]byte("p0102\np0304\n")).Return(12, nil),
+		// Both responses arrive in a single read.
+		usart.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (int, error) {
+			return copy(p, responses), nil
+		}),
+	)
+
+	ser, err := gocw.NewSimpleSerial(usart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ser.SendBatch([][]byte{{1, 2}, {3, 4}}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := ser.ResponseBatch(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, [][]byte{{0x0a, 0x0b}, {0x0c, 0x0d}}) {
+		t.Errorf("ResponseBatch returned %x", res)
+	}
+}
+
+func TestSimpleSerialResponsesInOneRead(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	usart := mocks.NewMockUsartInterface(mockCtrl)
+	clear := bytes.NewBufferString("xxxxxxxxxxxxxxxxxxx\n")
+	gomock.InOrder(
+		usart.EXPECT().Write(clear.Bytes()).Return(clear.Len(), nil),
+		usart.EXPECT().Flush().Return(nil),
+		usart.EXPECT().Flush().Return(nil),
+		usart.EXPECT().Write([]byte{'v', '\n'}).Return(2, nil),
+		usart.EXPECT().Read(gomock.Any()).
+			SetArg(0, []byte{'z', '0', '0', '\n'}).
+			Return(4, nil),
+		usart.EXPECT().Write([]byte("k01\n")).Return(4, nil),
+		// The ack and the response of the next command arrive together.
+		usart.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (int, error) {
+			return copy(p, "z00\nr0a\n"), nil
+		}),
+		usart.EXPECT().Write([]byte("p01\n")).Return(4, nil),
+	)
+
+	ser, err := gocw.NewSimpleSerial(usart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ser.SetKey([]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err = ser.Send([]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := ser.Response(); err != nil || !bytes.Equal(res, []byte{0x0a}) {
+		t.Errorf("Response() = %x, %v, want 0a", res, err)
+	}
+}
+
+func TestSimpleSerialCommand(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	usart := mocks.NewMockUsartInterface(mockCtrl)
+	clear := bytes.NewBufferString("xxxxxxxxxxxxxxxxxxx\n")
+	gomock.InOrder(
+		usart.EXPECT().Write(clear.Bytes()).Return(clear.Len(), nil),
+		usart.EXPECT().Flush().Return(nil),
+		usart.EXPECT().Flush().Return(nil),
+		usart.EXPECT().Write([]byte{'v', '\n'}).Return(2, nil),
+		usart.EXPECT().Read(gomock.Any()).
+			SetArg(0, []byte{'z', '0', '0', '\n'}).
+			Return(4, nil),
+		// A custom mask seed command, answered with the seed count.
+		usart.EXPECT().Write([]byte("s0011\n")).Return(6, nil),
+		usart.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (int, error) {
+			return copy(p, "c02\n"), nil
+		}),
+	)
+
+	ser, err := gocw.NewSimpleSerial(usart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var target gocw.CommandTarget = ser
+	if err = target.Command('s', []byte{0x00, 0x11}); err != nil {
+		t.Fatal(err)
+	}
+	cmd, payload, err := target.ReadResponse()
+	if err != nil || cmd != 'c' || !bytes.Equal(payload, []byte{2}) {
+		t.Errorf("ReadResponse() = %c, %x, %v, want c, 02", cmd, payload, err)
+	}
+}
+
+func TestSimpleSerialAckErrors(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	usart := mocks.NewMockUsartInterface(mockCtrl)
+	clear := bytes.NewBufferString("xxxxxxxxxxxxxxxxxxx\n")
+	gomock.InOrder(
+		usart.EXPECT().Write(clear.Bytes()).Return(clear.Len(), nil),
+		usart.EXPECT().Flush().Return(nil),
+		usart.EXPECT().Flush().Return(nil),
+		usart.EXPECT().Write([]byte{'v', '\n'}).Return(2, nil),
+		usart.EXPECT().Read(gomock.Any()).
+			SetArg(0, []byte{'z', '0', '0', '\n'}).
+			Return(4, nil),
+		usart.EXPECT().Write([]byte("k01\n")).Return(4, nil),
+		usart.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (int, error) {
+			return copy(p, "z04\n"), nil
+		}),
+		usart.EXPECT().Write([]byte("p01\n")).Return(4, nil),
+		usart.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (int, error) {
+			return copy(p, "z02\n"), nil
+		}),
+	)
+
+	ser, err := gocw.NewSimpleSerial(usart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ser.SetKey([]byte{1})
+	if err != gocw.Ss2InvalidLength || gocw.IsRetryableTargetError(err) {
+		t.Errorf("SetKey() = %v, want fatal %v", err, gocw.Ss2InvalidLength)
+	}
+	if err = ser.Send([]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ser.Response(); !gocw.IsRetryableTargetError(err) {
+		t.Errorf("Response() = %v, want retryable %v", err, gocw.Ss2BadCrc)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Pluggable target protocols.
+// Captures drive the target firmware through a Target. The default protocol
+// is simple-serial v1, v2 and detection of either are built in, and others
+// can be registered for arbitrary firmware, e.g.
+// a bootloader password check or a proprietary command set:
+//
+//	func init() {
+//		gocw.RegisterTargetProtocol("bootloader", openBootloader)
+//	}
+//
+// Commands select the protocol by name (see cmd/capture.go -target_protocol).
+package gocw
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const DefaultTargetProtocol = "simpleserial"
+
+// Target firmware protocol. A capture performs one operation per trace.
+type Target interface {
+	// Sets the key, or any other secret fixed for the whole capture.
+	SetKey(key []byte) error
+	// Sends the input of an operation. The trigger is expected to fire while
+	// the target processes it.
+	Send(input []byte) error
+	// Reads the output of the last operation.
+	Response() ([]byte, error)
+}
+
+// Implemented by targets that can queue operations, for batched captures
+// (see CaptureOptions.BatchSize).
+type BatchTarget interface {
+	Target
+	// Sends the inputs of len(inputs) operations in a single burst.
+	SendBatch(inputs [][]byte) error
+	// Reads the outputs of the last n operations.
+	ResponseBatch(n int) ([][]byte, error)
+}
+
+// Implemented by the simple-serial targets, for firmware commands gocw
+// doesn't wrap, e.g. setting a mask seed or reading a trigger count.
+type CommandTarget interface {
+	Target
+	// Sends command cmd with payload.
+	Command(cmd byte, payload []byte) error
+	// Reads a response of the target, and returns its command and payload.
+	ReadResponse() (byte, []byte, error)
+}
+
+// Opens a target protocol over the target serial port.
+type TargetOpener func(usart UsartInterface) (Target, error)
+
+var (
+	targetProtocolsMu sync.Mutex
+	targetProtocols   = map[string]TargetOpener{
+		DefaultTargetProtocol: func(usart UsartInterface) (Target, error) {
+			return NewSimpleSerial(usart)
+		},
+		TargetProtocolSimpleSerial2: func(usart UsartInterface) (Target, error) {
+			return NewSimpleSerial2(usart)
+		},
+		TargetProtocolSimpleSerialAuto: OpenSimpleSerial,
+	}
+)
+
+// Makes a target protocol available by name.
+func RegisterTargetProtocol(name string, open TargetOpener) {
+	targetProtocolsMu.Lock()
+	defer targetProtocolsMu.Unlock()
+	targetProtocols[name] = open
+}
+
+// Returns the names of the registered target protocols, sorted.
+func TargetProtocols() []string {
+	targetProtocolsMu.Lock()
+	defer targetProtocolsMu.Unlock()
+	var names []string
+	for name := range targetProtocols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Opens the named target protocol. An empty name selects the default.
+func OpenTarget(name string, usart UsartInterface) (Target, error) {
+	if len(name) == 0 {
+		name = DefaultTargetProtocol
+	}
+	targetProtocolsMu.Lock()
+	open, ok := targetProtocols[name]
+	targetProtocolsMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown target protocol %q. Registered protocols: %v",
+			name, TargetProtocols())
+	}
+	return open(usart)
+}
@@ -0,0 +1,125 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Closed-loop tuning of the target clock.
+// XMEGA targets run from the CLKGEN clock driven on HS2. The nominal CLKGEN
+// frequency is only as accurate as the mul/div search, so the actual clock is
+// measured with the frequency counter and CLKGEN is adjusted until it is
+// within tolerance.
+package gocw
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	targetClockMaxIterations = 5
+	// The frequency counter updates every 2^23 system clock cycles (~84ms at
+	// 100MHz), so wait a bit longer before each measurement.
+	freqCounterSettleTime = 150 * time.Millisecond
+)
+
+// Result of SetTargetClock.
+type TargetClock struct {
+	Requested uint32
+	// Frequency measured by the frequency counter.
+	Achieved uint32
+	Mul      uint32
+	Div      uint32
+	// Number of measure / adjust iterations.
+	Iterations int
+	// Source the frequency was measured on. EXTCLK if the target clock is
+	// looped back, CLKGEN output otherwise.
+	MeasuredOn FreqCounterSrc
+}
+
+func (t TargetClock) String() string {
+	return fmt.Sprintf("<Requested: %dHz, Achieved: %dHz (%+.3f%%), Mul: %d, Div: %d>",
+		t.Requested, t.Achieved, 100*t.RelativeError(), t.Mul, t.Div)
+}
+
+// Returns (achieved - requested) / requested.
+func (t TargetClock) RelativeError() float64 {
+	return (float64(t.Achieved) - float64(t.Requested)) / float64(t.Requested)
+}
+
+func (c *Adc) measureClock() uint32 {
+	time.Sleep(freqCounterSettleTime)
+	return c.FreqCounter()
+}
+
+// Drives the target clock from CLKGEN on HS2, and tunes CLKGEN until the
+// measured frequency is within tolerance (relative, e.g. 0.001) of freq.
+func (c *Adc) SetTargetClock(freq uint32, tolerance float64) (TargetClock, error) {
+	res := TargetClock{Requested: freq, MeasuredOn: FreqCounterExtClkInput}
+	if c.err != nil {
+		return res, c.err
+	}
+
+	c.SetClkGenInputSource(ClkGenInputSystem)
+	c.SetClkGenOutputFreq(freq)
+	c.SetHs2(Hs2ModeClkGen)
+	c.SetFreqCounterSource(FreqCounterExtClkInput)
+	if c.err != nil {
+		return res, c.err
+	}
+
+	if c.measureClock() == 0 {
+		glog.Warning("No clock on EXTCLK. Measuring CLKGEN output instead")
+		res.MeasuredOn = FreqCounterClkGenOutput
+		c.SetFreqCounterSource(FreqCounterClkGenOutput)
+	}
+
+	res.Mul, res.Div = c.clkGenMul(), c.clkGenDiv()
+	for res.Iterations = 1; ; res.Iterations++ {
+		res.Achieved = c.measureClock()
+		if c.err != nil {
+			return res, c.err
+		}
+		glog.V(1).Infof("Target clock iteration %d: %v", res.Iterations, res)
+		if math.Abs(res.RelativeError()) <= tolerance {
+			return res, nil
+		}
+		if res.Achieved == 0 {
+			return res, fmt.Errorf("Target clock not running")
+		}
+		if res.Iterations >= targetClockMaxIterations {
+			break
+		}
+
+		// Estimate the actual CLKGEN input frequency from the measurement,
+		// and search for better settings based on it.
+		inpFreq := float64(res.Achieved) * float64(res.Div) / float64(res.Mul)
+		setting, err := CalcClkGenMulDiv(freq, uint32(inpFreq), ClkGenLimitsFor(c.caps.Hw.HwType))
+		if err != nil {
+			return res, err
+		}
+		if uint32(setting.Mul) == res.Mul && uint32(setting.Div) == res.Div {
+			break
+		}
+		res.Mul, res.Div = uint32(setting.Mul), uint32(setting.Div)
+		c.setClkGenMul(res.Mul)
+		c.setClkGenDiv(res.Div)
+		c.resetClkGen()
+		c.resetAdc()
+		if !c.ClkGenDcmLocked() {
+			glog.Warning("CLKGEN DCM did not lock")
+		}
+	}
+	return res, fmt.Errorf("Target clock %v not within %.3f%% of requested", res, 100*tolerance)
+}
@@ -0,0 +1,91 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Target debug output.
+// Target firmware often prints debug logs on a second UART. With TIO3 routed
+// to the serial RX path, the logs are read through the CW instead of an
+// external adapter.
+// The FPGA has a single serial RX path, into the USART. Routing TIO3 to it
+// while another pin receives the target protocol would mix both streams, so
+// debug output needs the other target IO pins off the RX path.
+package gocw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Read timeout of the debug USART. Timeouts only mean the target was idle.
+const debugOutputPoll = 50 * time.Millisecond
+
+// Routes TIO3 (the target TX) to the USART, configured with conf
+// (DefaultUsartConfig if nil), and copies what the target prints to w until
+// the returned function is called. It returns the first read or write error.
+// Fails if another target IO pin uses the serial RX path, e.g. the target
+// protocol on TIO1, as it does after the default setup. The USART is the one
+// of the target protocol, so this is for targets driven over SPI or I2C.
+func StartDebugOutput(adc AdcInterface, dev UsbDeviceInterface, conf *UsartConfig, w io.Writer) (func() error, error) {
+	pins := []struct {
+		num  int
+		mode TargetIoMode
+	}{{1, adc.TargetIo1()}, {2, adc.TargetIo2()}, {4, adc.TargetIo4()}}
+	for _, pin := range pins {
+		if pin.mode == TargetIoModeSerialRx {
+			return nil, fmt.Errorf("TIO%d uses the serial RX path, which TIO3 would share. "+
+				"Read the debug output through an external adapter", pin.num)
+		}
+	}
+	if err := adc.Error(); err != nil {
+		return nil, err
+	}
+	adc.SetTargetIo3(TargetIoModeSerialRx)
+	if err := adc.Error(); err != nil {
+		return nil, fmt.Errorf("Failed routing TIO3: %v", err)
+	}
+	u, err := NewUsart(dev, conf)
+	if err != nil {
+		return nil, err
+	}
+	u.SetTimeout(debugOutputPoll)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			n, err := u.ReadContext(ctx, buf)
+			if n > 0 {
+				if _, err := w.Write(buf[:n]); err != nil {
+					done <- err
+					return
+				}
+			}
+			if ctx.Err() != nil {
+				done <- nil
+				return
+			}
+			if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+				done <- err
+				return
+			}
+		}
+	}()
+	return func() error {
+		cancel()
+		return <-done
+	}, nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gocw"
+	"github.com/google/gocw/sim"
+)
+
+// Serves pending bytes to reads of the USART on the serial RX path.
+type debugUartDevice struct {
+	sim.Device
+	mu      sync.Mutex
+	pending []byte
+	// USART numbers data was read from.
+	usarts map[uint16]bool
+}
+
+func (d *debugUartDevice) ControlIn(request gocw.Request, val uint16, data interface{}) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch {
+	case request == gocw.ReqUsart0Config && val&0xff == 0x14:
+		*data.(*uint32) = uint32(len(d.pending))
+	case request == gocw.ReqUsart0Data:
+		buf := data.([]byte)
+		n := copy(buf, d.pending)
+		d.pending = d.pending[n:]
+		d.usarts[val>>8] = true
+	}
+	return nil
+}
+
+func TestDebugOutput(t *testing.T) {
+	adc := sim.New(sim.DefaultLeakModel()).Adc
+	dev := &debugUartDevice{pending: []byte("boot ok\n"), usarts: map[uint16]bool{}}
+	var out bytes.Buffer
+
+	// The target protocol receives on TIO1.
+	if _, err := gocw.StartDebugOutput(adc, dev, nil, &out); err == nil || !strings.Contains(err.Error(), "TIO1") {
+		t.Errorf("StartDebugOutput with TIO1 on the serial RX path returned %v", err)
+	}
+	if adc.TargetIo3() == gocw.TargetIoModeSerialRx {
+		t.Error("TIO3 was routed to the serial RX path shared with TIO1")
+	}
+
+	adc.SetTargetIo1(gocw.TargetIoModeHighZ)
+	stop, err := gocw.StartDebugOutput(adc, dev, nil, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		dev.mu.Lock()
+		drained := len(dev.pending) == 0
+		dev.mu.Unlock()
+		if drained || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err = stop(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "boot ok\n" {
+		t.Errorf("Debug output %q, want \"boot ok\\n\"", out.String())
+	}
+	if adc.TargetIo3() != gocw.TargetIoModeSerialRx {
+		t.Errorf("TIO3 is %v, want serial RX", adc.TargetIo3())
+	}
+	if !dev.usarts[0] || len(dev.usarts) != 1 {
+		t.Errorf("Read USARTs %v, want the one on the serial RX path (0)", dev.usarts)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Switching of the 3.3V target supply, to power-cycle the target after a
+// crash, or before a cold-boot attack.
+// Based on chipwhisperer/software/chipwhisperer/capture/scopes/cwhardware/ChipWhispererExtra.py.
+package gocw
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/gocw/internal/regmap"
+)
+
+// Time the target stays off in PowerCycle by default, enough for the
+// decoupling capacitors of the usual targets to discharge.
+const DefaultPowerOffTime = 500 * time.Millisecond
+
+// Returns the io_route register and its target power field.
+func (c *Adc) targetPowerField() (reg regmap.Register, field regmap.Field) {
+	if c.err != nil {
+		return
+	}
+	if c.regMap == nil {
+		c.err = fmt.Errorf("No register map")
+		return
+	}
+	if reg, c.err = c.regMap.Register("io_route"); c.err != nil {
+		return
+	}
+	field, c.err = reg.Field("target_pwr")
+	return
+}
+
+// Returns whether the target is powered.
+func (c *Adc) TargetPowered() bool {
+	reg, field := c.targetPowerField()
+	if c.err != nil {
+		return false
+	}
+	buf := make([]byte, reg.Width)
+	if c.err = c.fpga.Mem.Read(Address(reg.Address), buf); c.err != nil {
+		return false
+	}
+	return field.Get(buf) != 0
+}
+
+func (c *Adc) setTargetPower(on bool) {
+	reg, field := c.targetPowerField()
+	if c.err != nil {
+		return
+	}
+	buf := make([]byte, reg.Width)
+	if c.err = c.fpga.Mem.Read(Address(reg.Address), buf); c.err != nil {
+		return
+	}
+	var v uint8
+	if on {
+		v = 1
+	}
+	field.Set(buf, v)
+	if SkipWrite("target power %v", on) {
+		return
+	}
+	c.err = c.fpga.Mem.Write(Address(reg.Address), buf, true, nil)
+}
+
+// Switches the target supply on.
+func (c *Adc) PowerOn() {
+	c.setTargetPower(true)
+}
+
+// Switches the target supply off. The target loses its state, including
+// any key set over the target protocol.
+func (c *Adc) PowerOff() {
+	c.setTargetPower(false)
+}
+
+// Switches the target supply off for the given time, e.g.
+// DefaultPowerOffTime, and on again.
+func (c *Adc) PowerCycle(off time.Duration) {
+	c.PowerOff()
+	if c.err != nil {
+		return
+	}
+	time.Sleep(off)
+	c.PowerOn()
+}
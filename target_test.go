@@ -0,0 +1,61 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/gocw"
+)
+
+var _ gocw.Target = &gocw.SimpleSerial{}
+var _ gocw.BatchTarget = &gocw.SimpleSerial2{}
+
+// Echoes its input, e.g. a password check returning the comparison result.
+type echoTarget struct {
+	last []byte
+}
+
+func (t *echoTarget) SetKey(key []byte) error   { return nil }
+func (t *echoTarget) Send(input []byte) error   { t.last = input; return nil }
+func (t *echoTarget) Response() ([]byte, error) { return t.last, nil }
+
+func TestRegisterTargetProtocol(t *testing.T) {
+	gocw.RegisterTargetProtocol("echo", func(usart gocw.UsartInterface) (gocw.Target, error) {
+		return &echoTarget{}, nil
+	})
+
+	protocols := gocw.TargetProtocols()
+	if !reflect.DeepEqual(protocols, []string{"echo", gocw.DefaultTargetProtocol,
+		gocw.TargetProtocolSimpleSerial2, gocw.TargetProtocolSimpleSerialAuto}) {
+		t.Errorf("TargetProtocols() = %v", protocols)
+	}
+
+	target, err := gocw.OpenTarget("echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = target.Send([]byte{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := target.Response(); err != nil || !reflect.DeepEqual(res, []byte{1, 2}) {
+		t.Errorf("Response() = %v, %v", res, err)
+	}
+
+	if _, err = gocw.OpenTarget("missing", nil); err == nil {
+		t.Error("Opening an unregistered protocol succeeded")
+	}
+}
@@ -0,0 +1,333 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Target transports.
+// Targets without a UART are driven over SPI or I2C, bit-banged on the target
+// IO pins through TargetGpio. The FPGA USI routing of the pins is a
+// half-duplex smartcard line, so it doesn't carry either bus. Every pin change
+// is a register write over USB, so the buses run at a few hundred bits per
+// second: enough to load a key or read a result, not for bulk data.
+package gocw
+
+import (
+	"fmt"
+	"io"
+)
+
+// Byte stream to the target firmware. Usart (the UART), SpiTransport and
+// I2cTransport implement it.
+type TargetTransport interface {
+	io.Reader
+	io.Writer
+}
+
+// Target IO pin: TIO1 to TIO4, or the nRST, PDIC and PDID pins, which are
+// outputs only.
+type TargetIoPin int
+
+const (
+	TargetIoPin1    TargetIoPin = 0
+	TargetIoPin2    TargetIoPin = 1
+	TargetIoPin3    TargetIoPin = 2
+	TargetIoPin4    TargetIoPin = 3
+	TargetIoPinNrst TargetIoPin = TargetIoPin(nrstPinNum)
+	TargetIoPinPdid TargetIoPin = TargetIoPin(pdidPinNum)
+	TargetIoPinPdic TargetIoPin = TargetIoPin(pdicPinNum)
+)
+
+func (p TargetIoPin) String() string {
+	switch p {
+	case TargetIoPinNrst:
+		return "nRST"
+	case TargetIoPinPdid:
+		return "PDID"
+	case TargetIoPinPdic:
+		return "PDIC"
+	}
+	return fmt.Sprintf("TIO%d", int(p)+1)
+}
+
+func (p TargetIoPin) special() bool {
+	return p >= TargetIoPinNrst
+}
+
+func (p TargetIoPin) valid() bool {
+	return (p >= TargetIoPin1 && p <= TargetIoPin4) || (p >= TargetIoPinNrst && p <= TargetIoPinPdic)
+}
+
+// GPIO access to the target IO pins, implemented by Adc. Errors are sticky,
+// as those of Adc.
+type TargetGpio interface {
+	// Drives pin high or low.
+	SetTargetPin(pin TargetIoPin, high bool)
+	// Stops driving pin, e.g. to read it or to let a pull-up raise it.
+	ReleaseTargetPin(pin TargetIoPin)
+	// Reads the level of a TIO pin.
+	TargetPinLevel(pin TargetIoPin) bool
+	Error() error
+}
+
+// Checks that pins are distinct and valid, and that inputs can be read.
+func checkPins(pins, inputs []TargetIoPin) error {
+	seen := map[TargetIoPin]bool{}
+	for _, p := range pins {
+		if !p.valid() {
+			return fmt.Errorf("Invalid target IO pin %d", int(p))
+		}
+		if seen[p] {
+			return fmt.Errorf("%v is assigned twice", p)
+		}
+		seen[p] = true
+	}
+	for _, p := range inputs {
+		if p.special() {
+			return fmt.Errorf("%v is an output, it can't be read", p)
+		}
+	}
+	return nil
+}
+
+// Pins of an SPI bus.
+type SpiPins struct {
+	Sck, Mosi, Miso, Cs TargetIoPin
+}
+
+// SCK on TIO3, MOSI on TIO2 (the target RX), MISO on TIO1 (the target TX)
+// and CS on PDIC, leaving TIO4 to the trigger.
+func DefaultSpiPins() SpiPins {
+	return SpiPins{Sck: TargetIoPin3, Mosi: TargetIoPin2, Miso: TargetIoPin1, Cs: TargetIoPinPdic}
+}
+
+// SPI host in mode 0 (clock idle low, sampled on the rising edge), most
+// significant bit first. Each Read, Write or Transfer is one transaction,
+// with CS held low.
+type SpiTransport struct {
+	gpio TargetGpio
+	pins SpiPins
+	// Last level driven on MOSI, to skip redundant writes.
+	mosi bool
+}
+
+// Drives CS high and SCK low.
+func NewSpiTransport(gpio TargetGpio, pins SpiPins) (*SpiTransport, error) {
+	if err := checkPins([]TargetIoPin{pins.Sck, pins.Mosi, pins.Miso, pins.Cs}, []TargetIoPin{pins.Miso}); err != nil {
+		return nil, err
+	}
+	s := &SpiTransport{gpio: gpio, pins: pins}
+	gpio.SetTargetPin(pins.Cs, true)
+	gpio.SetTargetPin(pins.Sck, false)
+	gpio.SetTargetPin(pins.Mosi, false)
+	gpio.ReleaseTargetPin(pins.Miso)
+	if err := gpio.Error(); err != nil {
+		return nil, fmt.Errorf("Failed setting up SPI pins: %v", err)
+	}
+	return s, nil
+}
+
+// Sends out while reading in. The shorter one is padded: zero bytes are
+// sent, and the bytes read are dropped.
+func (s *SpiTransport) Transfer(out, in []byte) error {
+	n := len(out)
+	if len(in) > n {
+		n = len(in)
+	}
+	s.gpio.SetTargetPin(s.pins.Cs, false)
+	for i := 0; i < n; i++ {
+		var o, r byte
+		if i < len(out) {
+			o = out[i]
+		}
+		for bit := 7; bit >= 0; bit-- {
+			if mosi := o&(1<<uint(bit)) != 0; mosi != s.mosi {
+				s.gpio.SetTargetPin(s.pins.Mosi, mosi)
+				s.mosi = mosi
+			}
+			s.gpio.SetTargetPin(s.pins.Sck, true)
+			if s.gpio.TargetPinLevel(s.pins.Miso) {
+				r |= 1 << uint(bit)
+			}
+			s.gpio.SetTargetPin(s.pins.Sck, false)
+		}
+		if i < len(in) {
+			in[i] = r
+		}
+		if err := s.gpio.Error(); err != nil {
+			break
+		}
+	}
+	s.gpio.SetTargetPin(s.pins.Cs, true)
+	if err := s.gpio.Error(); err != nil {
+		return fmt.Errorf("SPI transfer failed: %v", err)
+	}
+	return nil
+}
+
+// Implements TargetTransport, sending zero bytes.
+func (s *SpiTransport) Read(p []byte) (int, error) {
+	if err := s.Transfer(nil, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Implements TargetTransport, dropping the bytes read.
+func (s *SpiTransport) Write(p []byte) (int, error) {
+	if err := s.Transfer(p, nil); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Pins of an I2C bus. SDA is open-drain: released high, it needs a pull-up
+// on the target board. SCL is driven, so clock stretching isn't supported.
+type I2cPins struct {
+	Scl, Sda TargetIoPin
+}
+
+// SCL on TIO3 and SDA on TIO1, leaving TIO4 to the trigger.
+func DefaultI2cPins() I2cPins {
+	return I2cPins{Scl: TargetIoPin3, Sda: TargetIoPin1}
+}
+
+// I2C host talking to the device at a 7-bit address. Each Read, Write or
+// Transfer is one transaction, from the start to the stop condition.
+type I2cTransport struct {
+	gpio TargetGpio
+	pins I2cPins
+	addr uint8
+}
+
+// Releases the bus, SCL and SDA high.
+func NewI2cTransport(gpio TargetGpio, pins I2cPins, addr uint8) (*I2cTransport, error) {
+	if addr >= 0x80 {
+		return nil, fmt.Errorf("Invalid 7-bit I2C address %#x", addr)
+	}
+	if err := checkPins([]TargetIoPin{pins.Scl, pins.Sda}, []TargetIoPin{pins.Sda}); err != nil {
+		return nil, err
+	}
+	t := &I2cTransport{gpio: gpio, pins: pins, addr: addr}
+	gpio.SetTargetPin(pins.Scl, true)
+	gpio.ReleaseTargetPin(pins.Sda)
+	if err := gpio.Error(); err != nil {
+		return nil, fmt.Errorf("Failed setting up I2C pins: %v", err)
+	}
+	return t, nil
+}
+
+func (t *I2cTransport) sda(high bool) {
+	if high {
+		t.gpio.ReleaseTargetPin(t.pins.Sda)
+	} else {
+		t.gpio.SetTargetPin(t.pins.Sda, false)
+	}
+}
+
+func (t *I2cTransport) scl(high bool) {
+	t.gpio.SetTargetPin(t.pins.Scl, high)
+}
+
+// SDA falls while SCL is high. Also a repeated start, with SCL low.
+func (t *I2cTransport) start() {
+	t.sda(true)
+	t.scl(true)
+	t.sda(false)
+	t.scl(false)
+}
+
+// SDA rises while SCL is high.
+func (t *I2cTransport) stop() {
+	t.sda(false)
+	t.scl(true)
+	t.sda(true)
+}
+
+// Returns true if the device acknowledged b.
+func (t *I2cTransport) writeByte(b byte) bool {
+	for bit := 7; bit >= 0; bit-- {
+		t.sda(b&(1<<uint(bit)) != 0)
+		t.scl(true)
+		t.scl(false)
+	}
+	t.sda(true)
+	t.scl(true)
+	ack := !t.gpio.TargetPinLevel(t.pins.Sda)
+	t.scl(false)
+	return ack
+}
+
+// Acknowledges the byte if more are read.
+func (t *I2cTransport) readByte(ack bool) byte {
+	var b byte
+	t.sda(true)
+	for bit := 7; bit >= 0; bit-- {
+		t.scl(true)
+		if t.gpio.TargetPinLevel(t.pins.Sda) {
+			b |= 1 << uint(bit)
+		}
+		t.scl(false)
+	}
+	t.sda(!ack)
+	t.scl(true)
+	t.scl(false)
+	t.sda(true)
+	return b
+}
+
+// Writes out to the device, then reads in after a repeated start. Either may
+// be empty.
+func (t *I2cTransport) Transfer(out, in []byte) (err error) {
+	defer func() {
+		t.stop()
+		if gerr := t.gpio.Error(); gerr != nil {
+			err = fmt.Errorf("I2C transfer failed: %v", gerr)
+		}
+	}()
+	if len(out) > 0 || len(in) == 0 {
+		t.start()
+		if !t.writeByte(t.addr << 1) {
+			return fmt.Errorf("I2C device %#x did not acknowledge its address", t.addr)
+		}
+		for i, b := range out {
+			if !t.writeByte(b) {
+				return fmt.Errorf("I2C device %#x did not acknowledge byte %d", t.addr, i)
+			}
+		}
+	}
+	if len(in) > 0 {
+		t.start()
+		if !t.writeByte(t.addr<<1 | 1) {
+			return fmt.Errorf("I2C device %#x did not acknowledge its address", t.addr)
+		}
+		for i := range in {
+			in[i] = t.readByte(i < len(in)-1)
+		}
+	}
+	return nil
+}
+
+// Implements TargetTransport.
+func (t *I2cTransport) Read(p []byte) (int, error) {
+	if err := t.Transfer(nil, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Implements TargetTransport.
+func (t *I2cTransport) Write(p []byte) (int, error) {
+	if err := t.Transfer(p, nil); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
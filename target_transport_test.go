@@ -0,0 +1,204 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/gocw"
+)
+
+var _ gocw.TargetTransport = &gocw.Usart{}
+var _ gocw.TargetTransport = &gocw.SpiTransport{}
+var _ gocw.TargetTransport = &gocw.I2cTransport{}
+var _ gocw.TargetGpio = &gocw.Adc{}
+
+// Pins driven by the host. Released pins read high, unless pulled low by the
+// device.
+type fakeGpio struct {
+	driven   map[gocw.TargetIoPin]bool
+	pulled   func(pin gocw.TargetIoPin) bool
+	onChange func(pin gocw.TargetIoPin)
+}
+
+func (g *fakeGpio) level(pin gocw.TargetIoPin) bool {
+	if high, ok := g.driven[pin]; ok {
+		return high
+	}
+	return g.pulled == nil || !g.pulled(pin)
+}
+
+func (g *fakeGpio) SetTargetPin(pin gocw.TargetIoPin, high bool) {
+	g.driven[pin] = high
+	if g.onChange != nil {
+		g.onChange(pin)
+	}
+}
+
+func (g *fakeGpio) ReleaseTargetPin(pin gocw.TargetIoPin) {
+	delete(g.driven, pin)
+	if g.onChange != nil {
+		g.onChange(pin)
+	}
+}
+
+func (g *fakeGpio) TargetPinLevel(pin gocw.TargetIoPin) bool { return g.level(pin) }
+func (g *fakeGpio) Error() error                             { return nil }
+
+func TestSpiTransport(t *testing.T) {
+	pins := gocw.DefaultSpiPins()
+	gpio := &fakeGpio{driven: map[gocw.TargetIoPin]bool{}}
+	// The device answers each bit with the next bit of response, and
+	// records MOSI on the rising edge of SCK.
+	response := []byte{0xa5, 0x3c}
+	var received []byte
+	bits := 0
+	gpio.pulled = func(pin gocw.TargetIoPin) bool {
+		return pin == pins.Miso && bits/8 < len(response) && response[bits/8]&(0x80>>uint(bits%8)) == 0
+	}
+	gpio.onChange = func(pin gocw.TargetIoPin) {
+		if gpio.level(pins.Cs) {
+			bits = 0
+			return
+		}
+		if pin != pins.Sck {
+			return
+		}
+		if gpio.level(pins.Sck) {
+			if bits%8 == 0 {
+				received = append(received, 0)
+			}
+			if gpio.level(pins.Mosi) {
+				received[bits/8] |= 0x80 >> uint(bits%8)
+			}
+		} else {
+			bits++
+		}
+	}
+
+	spi, err := gocw.NewSpiTransport(gpio, pins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := make([]byte, 2)
+	if err := spi.Transfer([]byte{0x12, 0xef}, in); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, []byte{0x12, 0xef}) || !bytes.Equal(in, response) {
+		t.Errorf("Transfer() sent %x and read %x, want 12ef and %x", received, in, response)
+	}
+	if !gpio.level(pins.Cs) {
+		t.Errorf("CS still low after the transfer")
+	}
+
+	pins.Miso = gocw.TargetIoPinNrst
+	if _, err := gocw.NewSpiTransport(gpio, pins); err == nil {
+		t.Errorf("NewSpiTransport() succeeded with MISO on nRST")
+	}
+}
+
+// I2C device acknowledging its address and the bytes written, and answering
+// reads with response.
+type i2cDevice struct {
+	gpio     *fakeGpio
+	pins     gocw.I2cPins
+	addr     uint8
+	response []byte
+	written  []byte
+
+	sda, started, read, ack bool
+	bit                     int
+	shift                   byte
+}
+
+func (d *i2cDevice) pulled(pin gocw.TargetIoPin) bool {
+	if pin != d.pins.Sda || !d.started {
+		return false
+	}
+	if d.bit == 8 {
+		return d.ack
+	}
+	return d.read && len(d.response) > 0 && d.response[0]&(0x80>>uint(d.bit)) == 0
+}
+
+func (d *i2cDevice) onChange(pin gocw.TargetIoPin) {
+	scl, sda := d.gpio.level(d.pins.Scl), d.gpio.level(d.pins.Sda)
+	defer func() { d.sda = d.gpio.level(d.pins.Sda) }()
+	if pin == d.pins.Sda && scl && sda != d.sda {
+		// Start or stop condition. The first bit starts when SCL falls.
+		d.started, d.read, d.ack, d.bit, d.shift = !sda, false, false, -1, 0
+		d.addr &^= 0x80
+		return
+	}
+	if pin != d.pins.Scl || !d.started {
+		return
+	}
+	if scl {
+		if d.bit < 8 {
+			d.shift = d.shift<<1 | map[bool]byte{false: 0, true: 1}[sda]
+		}
+		return
+	}
+	d.bit++
+	switch {
+	case d.bit == 8 && d.read:
+		d.response = d.response[1:]
+	case d.bit == 8 && d.addr&0x80 == 0:
+		// Address byte, marked as matched with the top bit.
+		if d.shift>>1 == d.addr {
+			d.ack, d.read = true, d.shift&1 == 1
+			d.addr |= 0x80
+		}
+	case d.bit == 8:
+		d.written = append(d.written, d.shift)
+		d.ack = true
+	case d.bit == 9:
+		d.bit, d.shift, d.ack = 0, 0, false
+	}
+}
+
+func TestI2cTransport(t *testing.T) {
+	pins := gocw.DefaultI2cPins()
+	gpio := &fakeGpio{driven: map[gocw.TargetIoPin]bool{}}
+	dev := &i2cDevice{gpio: gpio, pins: pins, addr: 0x42, response: []byte{0x5a, 0x01}, sda: true}
+	gpio.pulled, gpio.onChange = dev.pulled, dev.onChange
+
+	i2c, err := gocw.NewI2cTransport(gpio, pins, 0x42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := make([]byte, 2)
+	if err := i2c.Transfer([]byte{0x10, 0x20}, in); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dev.written, []byte{0x10, 0x20}) || !bytes.Equal(in, []byte{0x5a, 0x01}) {
+		t.Errorf("Transfer() wrote %x and read %x, want 1020 and 5a01", dev.written, in)
+	}
+	if !gpio.level(pins.Sda) || !gpio.level(pins.Scl) {
+		t.Errorf("Bus not released after the transfer")
+	}
+
+	other, err := gocw.NewI2cTransport(gpio, pins, 0x43)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Write([]byte{1}); err == nil {
+		t.Errorf("Write() to a missing device succeeded")
+	}
+	if _, err := gocw.NewI2cTransport(gpio, pins, 0x80); err == nil {
+		t.Errorf("NewI2cTransport() succeeded with an 8-bit address")
+	}
+}
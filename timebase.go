@@ -0,0 +1,188 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Sample index to time conversions.
+// The scope configuration recorded with a capture (see ScopeConfig) gives the
+// ADC sample rate, the trigger offset and pre-trigger samples, and how the
+// ADC clock derives from the target clock, so sample indices can be reported
+// as time since the trigger or as target clock cycles.
+package gocw
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// Maps the sample indices of a capture to time. The zero value is unknown,
+// see Known.
+type TimeBase struct {
+	// ADC sample rate after decimation, in Hz.
+	SampleRate float64
+	// Target clock in Hz, zero if unknown.
+	TargetClock float64
+	// Time of sample 0 since the trigger, in seconds. Negative with
+	// pre-trigger samples.
+	Start float64
+}
+
+// Returns the time base of the captures recorded with a scope configuration.
+// The target clock is known when the ADC clock is derived from it through the
+// DCM, or is the target clock itself.
+func (cfg ScopeConfig) TimeBase() TimeBase {
+	if cfg.AdcFreq == 0 {
+		return TimeBase{}
+	}
+	adcFreq := float64(cfg.AdcFreq)
+	decimate := float64(cfg.Decimate)
+	if decimate < 1 {
+		decimate = 1
+	}
+	tb := TimeBase{
+		SampleRate: adcFreq / decimate,
+		// Trigger offset and pre-trigger samples count ADC clock cycles.
+		Start: (float64(cfg.TriggerOffset) - float64(cfg.PreSamples)) / adcFreq,
+	}
+	switch {
+	case cfg.AdcClockSource.AdcSrc == AdcSrcExtClk:
+		tb.TargetClock = adcFreq
+	case cfg.AdcClockSource.DcmOut > 0:
+		tb.TargetClock = adcFreq / float64(cfg.AdcClockSource.DcmOut)
+	}
+	return tb
+}
+
+func (tb TimeBase) Known() bool {
+	return tb.SampleRate > 0
+}
+
+// Returns the time of a sample since the trigger, in seconds. NaN if unknown.
+func (tb TimeBase) Seconds(sample int) float64 {
+	if !tb.Known() {
+		return math.NaN()
+	}
+	return tb.Start + float64(sample)/tb.SampleRate
+}
+
+func (tb TimeBase) Nanoseconds(sample int) float64 {
+	return tb.Seconds(sample) * 1e9
+}
+
+// Returns the number of target clock cycles from the trigger to a sample. NaN
+// if unknown.
+func (tb TimeBase) Cycles(sample int) float64 {
+	if tb.TargetClock == 0 {
+		return math.NaN()
+	}
+	return tb.Seconds(sample) * tb.TargetClock
+}
+
+// Returns the index of the sample closest to a time since the trigger.
+func (tb TimeBase) Sample(seconds float64) int {
+	if !tb.Known() {
+		return 0
+	}
+	return int(math.Round((seconds - tb.Start) * tb.SampleRate))
+}
+
+// Formats a sample as time since the trigger and target clock cycles when
+// known, e.g. "1.234µs (9.1 cycles)", or as a raw sample index.
+func (tb TimeBase) Format(sample int) string {
+	if !tb.Known() {
+		return fmt.Sprintf("sample %d", sample)
+	}
+	s := tb.Seconds(sample)
+	var res string
+	switch a := math.Abs(s); {
+	case a < 1e-6:
+		res = fmt.Sprintf("%.1fns", s*1e9)
+	case a < 1e-3:
+		res = fmt.Sprintf("%.3fµs", s*1e6)
+	default:
+		res = fmt.Sprintf("%.3fms", s*1e3)
+	}
+	if tb.TargetClock > 0 {
+		res += fmt.Sprintf(" (%.1f cycles)", tb.Cycles(sample))
+	}
+	return res
+}
+
+// Returns the scope configuration a capture file was recorded with: the
+// config record of a .pb trace stream, or the last session_start event of the
+// audit log next to a .json.gz capture. Globs use their first file.
+func LoadScopeConfig(captureFile string) (*ScopeConfig, error) {
+	if files, err := filepath.Glob(captureFile); err == nil && len(files) > 0 {
+		captureFile = files[0]
+	}
+
+	if strings.HasSuffix(captureFile, ".pb") {
+		f, err := os.Open(captureFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error opening capture file: %v", err)
+		}
+		defer f.Close()
+		d := NewTraceDecoder(f)
+		var t Trace
+		if err = d.Decode(&t); err != nil && err != io.EOF {
+			return nil, err
+		}
+		if d.Config() == nil {
+			return nil, fmt.Errorf("No scope config in %s", captureFile)
+		}
+		return d.Config(), nil
+	}
+
+	f, err := os.Open(AuditLogFilename(captureFile))
+	if err != nil {
+		return nil, fmt.Errorf("Error opening audit log: %v", err)
+	}
+	defer f.Close()
+	events, err := ReadAuditLog(f)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].Event != "session_start" {
+			continue
+		}
+		// Data was decoded as generic JSON.
+		buf, err := json.Marshal(events[i].Data)
+		if err != nil {
+			return nil, err
+		}
+		var start struct{ Scope ScopeConfig }
+		if err = json.Unmarshal(buf, &start); err != nil {
+			return nil, fmt.Errorf("Invalid session_start event: %v", err)
+		}
+		return &start.Scope, nil
+	}
+	return nil, fmt.Errorf("No session_start event in the audit log of %s", captureFile)
+}
+
+// Same as LoadScopeConfig, returning the zero (unknown) time base if the
+// capture has no recorded configuration.
+func LoadTimeBase(captureFile string) TimeBase {
+	cfg, err := LoadScopeConfig(captureFile)
+	if err != nil {
+		glog.V(1).Infof("No time base for %s: %v", captureFile, err)
+		return TimeBase{}
+	}
+	return cfg.TimeBase()
+}
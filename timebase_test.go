@@ -0,0 +1,98 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/google/gocw"
+)
+
+// 4x DCM from a 7.37MHz CLKGEN, decimated by 2, 30 pre-trigger samples.
+var timeBaseConfig = gocw.ScopeConfig{
+	AdcFreq:        29480000,
+	Decimate:       2,
+	PreSamples:     30,
+	AdcClockSource: gocw.AdcSrcClkGenX4ViaDcm,
+}
+
+func TestTimeBase(t *testing.T) {
+	tb := timeBaseConfig.TimeBase()
+	if tb.SampleRate != 14740000 || tb.TargetClock != 7370000 {
+		t.Errorf("Unexpected time base %+v", tb)
+	}
+	// Sample 15 is at the trigger, each sample is half a target cycle.
+	if s := tb.Seconds(15); math.Abs(s) > 1e-15 {
+		t.Errorf("Sample 15 at %gs, expected the trigger", s)
+	}
+	if c := tb.Cycles(115); math.Abs(c-50) > 1e-9 {
+		t.Errorf("Sample 115 at %g cycles, expected 50", c)
+	}
+	if s := tb.Sample(tb.Seconds(1234)); s != 1234 {
+		t.Errorf("Round trip of sample 1234 gave %d", s)
+	}
+	if f := tb.Format(115); f != "6.784µs (50.0 cycles)" {
+		t.Errorf("Unexpected format %q", f)
+	}
+
+	direct := gocw.ScopeConfig{AdcFreq: 7370000, AdcClockSource: gocw.AdcSrcExtClkDirect}.TimeBase()
+	if direct.TargetClock != 7370000 || direct.Cycles(10) != 10 {
+		t.Errorf("Unexpected direct clock time base %+v", direct)
+	}
+
+	var unknown gocw.TimeBase
+	if unknown.Known() || !math.IsNaN(unknown.Nanoseconds(1)) || unknown.Format(7) != "sample 7" {
+		t.Errorf("Zero time base is not unknown")
+	}
+}
+
+func TestLoadScopeConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	// From the audit log of a JSON capture.
+	jsonFile := filepath.Join(dir, "c.json.gz")
+	l, err := gocw.OpenAuditLog(gocw.AuditLogFilename(jsonFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Log("session_start", struct{ Scope gocw.ScopeConfig }{timeBaseConfig})
+	l.Close()
+	cfg, err := gocw.LoadScopeConfig(jsonFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*cfg, timeBaseConfig) {
+		t.Errorf("Loaded config %+v, expected %+v", *cfg, timeBaseConfig)
+	}
+
+	// From a trace stream.
+	pbFile := filepath.Join(dir, "c.pb")
+	if err = (gocw.Capture{{Pt: []byte{1}}}).SaveProto(pbFile, &timeBaseConfig); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err = gocw.LoadScopeConfig(pbFile); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TimeBase() != timeBaseConfig.TimeBase() {
+		t.Errorf("Loaded time base %+v, expected %+v", cfg.TimeBase(), timeBaseConfig.TimeBase())
+	}
+
+	if tb := gocw.LoadTimeBase(filepath.Join(dir, "missing.json.gz")); tb.Known() {
+		t.Errorf("Time base %+v of a capture without config", tb)
+	}
+}
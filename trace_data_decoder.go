@@ -0,0 +1,201 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Decoding of the ADC FIFO data.
+// The FIFO holds a sync byte, followed by 32 bit words packing 3 consecutive
+// 10 bit samples, first sample in the low bits. The top 2 bits of the words
+// before the trigger are 3, and the trigger word holds the index of the
+// first sample at or after the trigger.
+package gocw
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/golang/glog"
+)
+
+const (
+	DefaultSyncByte = 0xac
+	// Subtracted from the samples scaled to [0, 1), centering them on zero.
+	DefaultSampleOffset = 0.5
+)
+
+type TraceDataDecoderConfig struct {
+	// Subtracted from the samples scaled to [0, 1).
+	Offset float64
+	// First byte of the data.
+	SyncByte byte
+	// Samples kept before the trigger, see SetPreTriggerSamples. Fewer are
+	// returned if fewer were recorded.
+	PreTriggerSamples int
+	// Byte order of the packed words.
+	ByteOrder binary.ByteOrder
+}
+
+// Returns the configuration of the OpenADC bitstreams, without pre-trigger
+// samples.
+func DefaultTraceDataDecoderConfig() TraceDataDecoderConfig {
+	return TraceDataDecoderConfig{
+		Offset:    DefaultSampleOffset,
+		SyncByte:  DefaultSyncByte,
+		ByteOrder: binary.BigEndian,
+	}
+}
+
+// Streaming decoder of the ADC FIFO data. The data can be fed in chunks of
+// any size, e.g. as read in stream mode, and words split across chunks are
+// decoded once complete.
+type TraceDataDecoder struct {
+	cfg TraceDataDecoderConfig
+	// Set once the sync byte was checked.
+	synced bool
+	// Bytes of an incomplete word.
+	partial []byte
+	// Samples before the trigger, the last PreTriggerSamples of them are
+	// kept.
+	pre       []Sample
+	triggered bool
+}
+
+func NewTraceDataDecoder(cfg TraceDataDecoderConfig) *TraceDataDecoder {
+	if cfg.ByteOrder == nil {
+		cfg.ByteOrder = binary.BigEndian
+	}
+	if cfg.PreTriggerSamples < 0 {
+		cfg.PreTriggerSamples = 0
+	}
+	return &TraceDataDecoder{cfg: cfg}
+}
+
+// Returns the decoder configuration.
+func (d *TraceDataDecoder) Config() TraceDataDecoderConfig {
+	return d.cfg
+}
+
+// Prepares the decoder for the data of a new trace.
+func (d *TraceDataDecoder) Reset() {
+	d.synced = false
+	d.partial = d.partial[:0]
+	d.pre = d.pre[:0]
+	d.triggered = false
+}
+
+// Returns true once the trigger word was decoded.
+func (d *TraceDataDecoder) Triggered() bool {
+	return d.triggered
+}
+
+func (d *TraceDataDecoder) unpack(word uint32) [3]Sample {
+	var samples [3]Sample
+	for i := range samples {
+		w := (word >> (10 * uint(i))) & 0x3ff
+		samples[i] = Sample(float64(w)/1024.0 - d.cfg.Offset)
+	}
+	return samples
+}
+
+// Decodes a word before the trigger, and returns the samples from
+// PreTriggerSamples before the trigger if it's the trigger word.
+func (d *TraceDataDecoder) decodePreTrigger(word uint32) []Sample {
+	n := d.cfg.PreTriggerSamples
+	samples := d.unpack(word)
+	pos := int(word >> 30)
+	if pos == 3 {
+		if n > 0 {
+			d.pre = append(d.pre, samples[:]...)
+			// Trims lazily, to copy once per n samples.
+			if len(d.pre) >= 2*n+3 {
+				d.pre = append(d.pre[:0], d.pre[len(d.pre)-n:]...)
+			}
+		} else {
+			glog.V(2).Infof("Skipping word %x before trigger", word)
+		}
+		return nil
+	}
+	d.triggered = true
+	if len(d.pre) > n {
+		d.pre = d.pre[len(d.pre)-n:]
+	}
+	start := len(d.pre) + pos - n
+	if start < 0 {
+		glog.Warningf("Only %d of %d pre-trigger samples were recorded", len(d.pre)+pos, n)
+		start = 0
+	}
+	res := append(append([]Sample{}, d.pre...), samples[:]...)[start:]
+	d.pre = d.pre[:0]
+	return res
+}
+
+// Decodes a chunk of data, and returns the samples it completes from
+// PreTriggerSamples before the trigger. Returns no samples until the trigger
+// word is decoded.
+func (d *TraceDataDecoder) Decode(chunk []byte) ([]Sample, error) {
+	if len(chunk) == 0 {
+		return nil, nil
+	}
+	if !d.synced {
+		if chunk[0] != d.cfg.SyncByte {
+			return nil, fmt.Errorf("Unexpected sync byte %x", chunk[0])
+		}
+		d.synced = true
+		chunk = chunk[1:]
+	}
+	var samples []Sample
+	if len(d.partial) > 0 {
+		n := 4 - len(d.partial)
+		if n > len(chunk) {
+			n = len(chunk)
+		}
+		d.partial = append(d.partial, chunk[:n]...)
+		chunk = chunk[n:]
+		if len(d.partial) < 4 {
+			return nil, nil
+		}
+		samples = d.appendWord(samples, d.cfg.ByteOrder.Uint32(d.partial))
+		d.partial = d.partial[:0]
+	}
+	for ; len(chunk) >= 4; chunk = chunk[4:] {
+		samples = d.appendWord(samples, d.cfg.ByteOrder.Uint32(chunk[:4]))
+	}
+	d.partial = append(d.partial, chunk...)
+	return samples, nil
+}
+
+func (d *TraceDataDecoder) appendWord(samples []Sample, word uint32) []Sample {
+	if !d.triggered {
+		return append(samples, d.decodePreTrigger(word)...)
+	}
+	s := d.unpack(word)
+	return append(samples, s[:]...)
+}
+
+// Decodes the FIFO data of a trace at once, with the default configuration
+// and presamples pre-trigger samples, see TraceDataDecoder. The data is read in
+// 4 byte multiples, so the last 3 bytes are ignored. Returns nil if there's
+// no trigger.
+func DecodeTraceData(data []byte, presamples int) ([]Sample, error) {
+	glog.V(1).Infof("Processing %d bytes of trace data", len(data))
+	if len(data) < 4 || len(data)%4 != 0 {
+		return nil, fmt.Errorf("Unexpected data length (%v)", len(data))
+	}
+	cfg := DefaultTraceDataDecoderConfig()
+	cfg.PreTriggerSamples = presamples
+	d := NewTraceDataDecoder(cfg)
+	samples, err := d.Decode(data)
+	if err != nil || !d.Triggered() {
+		return nil, err
+	}
+	return samples, nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/google/gocw"
+)
+
+// Packs words of 3 samples valued by their index, with the trigger word at
+// index trigger and the first sample after the trigger at pos in it.
+func packedTrace(order binary.ByteOrder, words, trigger, pos int) []byte {
+	data := []byte{gocw.DefaultSyncByte}
+	for w := 0; w < words; w++ {
+		p := uint32(0)
+		if w < trigger {
+			p = 3
+		} else if w == trigger {
+			p = uint32(pos)
+		}
+		word := make([]byte, 4)
+		order.PutUint32(word, p<<30|uint32(3*w+2)<<20|uint32(3*w+1)<<10|uint32(3*w))
+		data = append(data, word...)
+	}
+	return data
+}
+
+func indexSamples(first, last int) []gocw.Sample {
+	var res []gocw.Sample
+	for i := first; i <= last; i++ {
+		res = append(res, gocw.Sample(float64(i)/1024.0-0.5))
+	}
+	return res
+}
+
+func TestTraceDataDecoderChunks(t *testing.T) {
+	data := packedTrace(binary.BigEndian, 10, 4, 2)
+	cfg := gocw.DefaultTraceDataDecoderConfig()
+	cfg.PreTriggerSamples = 5
+	d := gocw.NewTraceDataDecoder(cfg)
+	for _, size := range []int{1, 2, 3, 5, 7, len(data)} {
+		d.Reset()
+		var samples []gocw.Sample
+		for i := 0; i < len(data); i += size {
+			end := i + size
+			if end > len(data) {
+				end = len(data)
+			}
+			s, err := d.Decode(data[i:end])
+			if err != nil {
+				t.Fatal(err)
+			}
+			samples = append(samples, s...)
+		}
+		if !d.Triggered() {
+			t.Errorf("Chunks of %d bytes: no trigger", size)
+		}
+		// The trigger is at sample 14.
+		if expected := indexSamples(9, 29); !reflect.DeepEqual(samples, expected) {
+			t.Errorf("Chunks of %d bytes: decoded %v, want %v", size, samples, expected)
+		}
+	}
+}
+
+func TestTraceDataDecoderConfig(t *testing.T) {
+	cfg := gocw.DefaultTraceDataDecoderConfig()
+	cfg.ByteOrder = binary.LittleEndian
+	cfg.Offset = 0
+	cfg.SyncByte = 0x55
+	data := packedTrace(binary.LittleEndian, 3, 1, 0)
+	data[0] = 0x55
+	samples, err := gocw.NewTraceDataDecoder(cfg).Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []gocw.Sample{3.0 / 1024, 4.0 / 1024, 5.0 / 1024, 6.0 / 1024, 7.0 / 1024, 8.0 / 1024}; !reflect.DeepEqual(samples, expected) {
+		t.Errorf("Decoded %v, want %v", samples, expected)
+	}
+
+	if _, err = gocw.NewTraceDataDecoder(gocw.DefaultTraceDataDecoderConfig()).Decode(data); err == nil {
+		t.Error("Decode accepted a wrong sync byte")
+	}
+}
@@ -0,0 +1,676 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Protocol buffer trace streams, see proto/gocw.proto.
+// A stream is a sequence of length delimited Record messages, each holding a
+// trace or the scope config of the traces that follow. Consumers in other
+// languages read it with the code generated from the schema. The Go side is
+// encoded by hand with protowire, to avoid generated code in the tree.
+// Samples are stored as 32 bit floats, or as 64 bit ones by gocw_float64
+// builds. Decoders accept either.
+package gocw
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers of proto/gocw.proto.
+const (
+	recordConfig protowire.Number = 1
+	recordTrace  protowire.Number = 2
+
+	traceKey                 protowire.Number = 1
+	tracePt                  protowire.Number = 2
+	traceCt                  protowire.Number = 3
+	tracePowerMeasurements   protowire.Number = 4
+	traceClockUnlocked       protowire.Number = 5
+	traceLogic               protowire.Number = 6
+	traceBaseline            protowire.Number = 7
+	traceInvalidOutput       protowire.Number = 8
+	traceGainDbFloat         protowire.Number = 9
+	traceGainDb              protowire.Number = 10
+	tracePowerMeasurements64 protowire.Number = 11
+)
+
+// Maximum size of a stream record, to fail fast on corrupt streams.
+const maxProtoRecordSize = 1 << 28
+
+func appendVarintField(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendIntField(b []byte, num protowire.Number, v int) []byte {
+	return appendVarintField(b, num, uint64(int64(v)))
+}
+
+func appendBoolField(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	return appendVarintField(b, num, 1)
+}
+
+func appendBytesField(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+// Appends a packed repeated int field.
+func appendPackedIntsField(b []byte, num protowire.Number, v []int) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	var packed []byte
+	for _, x := range v {
+		packed = protowire.AppendVarint(packed, uint64(int64(x)))
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, packed)
+}
+
+// Appends a nested message built by fn.
+func appendMessageField(b []byte, num protowire.Number, fn func([]byte) []byte) []byte {
+	msg := fn(nil)
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+// Calls fn with each field of a message, and the encoded value. fn returns
+// the length of the value it consumed, or 0 to skip unknown fields.
+func protoFields(b []byte, fn func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		m, err := fn(num, typ, b)
+		if err != nil {
+			return fmt.Errorf("Field %d: %v", num, err)
+		}
+		if m == 0 {
+			m = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if m < 0 {
+			return fmt.Errorf("Field %d: %v", num, protowire.ParseError(m))
+		}
+		b = b[m:]
+	}
+	return nil
+}
+
+// Consumes a varint value, or returns 0 if the field has another type.
+func consumeVarint(typ protowire.Type, b []byte, v *uint64) int {
+	if typ != protowire.VarintType {
+		return 0
+	}
+	x, n := protowire.ConsumeVarint(b)
+	if n > 0 {
+		*v = x
+	}
+	return n
+}
+
+// Consumes the values of a repeated int field, packed or not, calling add
+// with each. Returns 0 if the field has another type.
+func consumeInts(typ protowire.Type, b []byte, add func(v int)) int {
+	var v uint64
+	if n := consumeVarint(typ, b, &v); n > 0 {
+		add(int(int32(v)))
+		return n
+	}
+	if typ != protowire.BytesType {
+		return 0
+	}
+	packed, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return n
+	}
+	for len(packed) > 0 {
+		x, m := protowire.ConsumeVarint(packed)
+		if m < 0 {
+			return m
+		}
+		add(int(int32(x)))
+		packed = packed[m:]
+	}
+	return n
+}
+
+// Consumes a bytes value (copied), or returns 0 if the field has another type.
+func consumeBytes(typ protowire.Type, b []byte, v *[]byte) int {
+	if typ != protowire.BytesType {
+		return 0
+	}
+	x, n := protowire.ConsumeBytes(b)
+	if n > 0 {
+		*v = append([]byte(nil), x...)
+	}
+	return n
+}
+
+// Consumes the values of a repeated float (size 4) or double (size 8) field,
+// packed or not, calling add with the bits of each. Returns 0 if the field has
+// another type.
+func consumeFloats(typ protowire.Type, b []byte, size int, add func(bits uint64)) (int, error) {
+	switch {
+	case typ == protowire.Fixed32Type && size == 4:
+		x, n := protowire.ConsumeFixed32(b)
+		if n > 0 {
+			add(uint64(x))
+		}
+		return n, nil
+	case typ == protowire.Fixed64Type && size == 8:
+		x, n := protowire.ConsumeFixed64(b)
+		if n > 0 {
+			add(x)
+		}
+		return n, nil
+	case typ != protowire.BytesType:
+		return 0, nil
+	}
+	packed, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return n, nil
+	}
+	if len(packed)%size != 0 {
+		return 0, fmt.Errorf("Packed length %d is not a multiple of %d", len(packed), size)
+	}
+	for ; len(packed) > 0; packed = packed[size:] {
+		if size == 4 {
+			add(uint64(binary.LittleEndian.Uint32(packed)))
+		} else {
+			add(binary.LittleEndian.Uint64(packed))
+		}
+	}
+	return n, nil
+}
+
+func appendTrace(b []byte, t *Trace) []byte {
+	b = appendBytesField(b, traceKey, t.Key)
+	b = appendBytesField(b, tracePt, t.Pt)
+	b = appendBytesField(b, traceCt, t.Ct)
+	switch {
+	case len(t.PowerMeasurements) == 0:
+	case sampleBits == 32:
+		b = protowire.AppendTag(b, tracePowerMeasurements, protowire.BytesType)
+		b = protowire.AppendVarint(b, uint64(4*len(t.PowerMeasurements)))
+		for _, s := range t.PowerMeasurements {
+			b = protowire.AppendFixed32(b, math.Float32bits(float32(s)))
+		}
+	default:
+		b = protowire.AppendTag(b, tracePowerMeasurements64, protowire.BytesType)
+		b = protowire.AppendVarint(b, uint64(8*len(t.PowerMeasurements)))
+		for _, s := range t.PowerMeasurements {
+			b = protowire.AppendFixed64(b, math.Float64bits(float64(s)))
+		}
+	}
+	b = appendBoolField(b, traceClockUnlocked, t.ClockUnlocked)
+	b = appendBytesField(b, traceLogic, t.Logic)
+	b = appendBoolField(b, traceBaseline, t.Baseline)
+	b = appendBoolField(b, traceInvalidOutput, t.InvalidOutput)
+	if t.GainDb != 0 {
+		b = protowire.AppendTag(b, traceGainDb, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(t.GainDb))
+	}
+	return b
+}
+
+func parseTrace(b []byte, t *Trace) error {
+	*t = Trace{}
+	return protoFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		var v uint64
+		switch num {
+		case traceKey:
+			return consumeBytes(typ, b, &t.Key), nil
+		case tracePt:
+			return consumeBytes(typ, b, &t.Pt), nil
+		case traceCt:
+			return consumeBytes(typ, b, &t.Ct), nil
+		case tracePowerMeasurements:
+			return consumeFloats(typ, b, 4, func(bits uint64) {
+				t.PowerMeasurements = append(t.PowerMeasurements, Sample(math.Float32frombits(uint32(bits))))
+			})
+		case tracePowerMeasurements64:
+			return consumeFloats(typ, b, 8, func(bits uint64) {
+				t.PowerMeasurements = append(t.PowerMeasurements, Sample(math.Float64frombits(bits)))
+			})
+		case traceClockUnlocked:
+			n := consumeVarint(typ, b, &v)
+			t.ClockUnlocked = v != 0
+			return n, nil
+		case traceLogic:
+			return consumeBytes(typ, b, &t.Logic), nil
+		case traceBaseline:
+			n := consumeVarint(typ, b, &v)
+			t.Baseline = v != 0
+			return n, nil
+		case traceInvalidOutput:
+			n := consumeVarint(typ, b, &v)
+			t.InvalidOutput = v != 0
+			return n, nil
+		case traceGainDb:
+			return consumeFloats(typ, b, 8, func(bits uint64) {
+				t.GainDb = math.Float64frombits(bits)
+			})
+		case traceGainDbFloat:
+			// Written by older encoders.
+			return consumeFloats(typ, b, 4, func(bits uint64) {
+				t.GainDb = float64(math.Float32frombits(uint32(bits)))
+			})
+		}
+		return 0, nil
+	})
+}
+
+func appendScopeConfig(b []byte, c *ScopeConfig) []byte {
+	b = appendBytesField(b, 1, []byte(c.Serial))
+	b = appendMessageField(b, 2, func(b []byte) []byte {
+		b = appendVarintField(b, 1, uint64(c.Hw.RegVersion))
+		b = appendIntField(b, 2, int(c.Hw.HwType))
+		return appendVarintField(b, 3, uint64(c.Hw.HwVersion))
+	})
+	b = appendMessageField(b, 3, func(b []byte) []byte {
+		b = appendVarintField(b, 1, uint64(c.Fw.Major))
+		b = appendVarintField(b, 2, uint64(c.Fw.Minor))
+		return appendVarintField(b, 3, uint64(c.Fw.Debug))
+	})
+	b = appendBytesField(b, 4, []byte(c.RegisterMap))
+	b = appendIntField(b, 5, int(c.GainMode))
+	b = appendVarintField(b, 6, uint64(c.Gain))
+	b = appendIntField(b, 7, int(c.TriggerMode))
+	b = appendVarintField(b, 8, uint64(c.TotalSamples))
+	b = appendVarintField(b, 9, uint64(c.TriggerOffset))
+	b = appendVarintField(b, 10, uint64(c.PreSamples))
+	b = appendVarintField(b, 11, uint64(c.Decimate))
+	b = appendMessageField(b, 12, func(b []byte) []byte {
+		b = appendIntField(b, 1, int(c.AdcClockSource.AdcSrc))
+		b = appendIntField(b, 2, c.AdcClockSource.DcmOut)
+		return appendIntField(b, 3, int(c.AdcClockSource.DcmInput))
+	})
+	b = appendVarintField(b, 13, uint64(c.AdcFreq))
+	b = appendVarintField(b, 14, uint64(c.ClkGenMul))
+	b = appendVarintField(b, 15, uint64(c.ClkGenDiv))
+	if io := c.Io; io != nil {
+		b = appendMessageField(b, 16, func(b []byte) []byte {
+			pins := make([]int, len(io.TriggerPins))
+			for i, p := range io.TriggerPins {
+				pins[i] = int(p)
+			}
+			b = appendPackedIntsField(b, 1, pins)
+			b = appendIntField(b, 2, int(io.TriggerPinLogic))
+			modes := make([]int, len(io.TargetIo))
+			for i, m := range io.TargetIo {
+				modes[i] = int(m)
+			}
+			b = appendPackedIntsField(b, 3, modes)
+			return appendIntField(b, 4, int(io.Hs2))
+		})
+	}
+	if g := c.Glitch; g != nil {
+		b = appendMessageField(b, 17, func(b []byte) []byte {
+			b = appendIntField(b, 1, int(g.ClockSource))
+			b = appendIntField(b, 2, int(g.Output))
+			b = appendIntField(b, 3, int(g.Trigger))
+			b = appendVarintField(b, 4, uint64(g.ExtOffset))
+			b = appendIntField(b, 5, g.Repeat)
+			b = appendIntField(b, 6, g.WidthFine)
+			b = appendIntField(b, 7, g.OffsetFine)
+			return appendBoolField(b, 8, g.Hs2)
+		})
+	}
+	return b
+}
+
+func parseScopeIo(b []byte, io *ScopeIo) error {
+	target := 0
+	return protoFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		var v uint64
+		switch num {
+		case 1:
+			return consumeInts(typ, b, func(v int) {
+				io.TriggerPins = append(io.TriggerPins, TriggerTargetIoPin(v))
+			}), nil
+		case 2:
+			n := consumeVarint(typ, b, &v)
+			io.TriggerPinLogic = TriggerPinLogic(int32(v))
+			return n, nil
+		case 3:
+			return consumeInts(typ, b, func(v int) {
+				if target < len(io.TargetIo) {
+					io.TargetIo[target] = TargetIoMode(v)
+					target++
+				}
+			}), nil
+		case 4:
+			n := consumeVarint(typ, b, &v)
+			io.Hs2 = Hs2Mode(int32(v))
+			return n, nil
+		}
+		return 0, nil
+	})
+}
+
+func parseGlitch(b []byte, g *Glitch) error {
+	return parseVarints(b, func(num protowire.Number, v uint64) {
+		switch num {
+		case 1:
+			g.ClockSource = GlitchClockSource(int32(v))
+		case 2:
+			g.Output = GlitchOutput(int32(v))
+		case 3:
+			g.Trigger = GlitchTrigger(int32(v))
+		case 4:
+			g.ExtOffset = uint32(v)
+		case 5:
+			g.Repeat = int(int32(v))
+		case 6:
+			g.WidthFine = int(int32(v))
+		case 7:
+			g.OffsetFine = int(int32(v))
+		case 8:
+			g.Hs2 = v != 0
+		}
+	})
+}
+
+// Parses a message of varint fields, calling set with each value.
+func parseVarints(b []byte, set func(num protowire.Number, v uint64)) error {
+	return protoFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		var v uint64
+		n := consumeVarint(typ, b, &v)
+		if n > 0 {
+			set(num, v)
+		}
+		return n, nil
+	})
+}
+
+// Consumes a nested varint message, or returns 0 if the field has another type.
+func consumeVarints(typ protowire.Type, b []byte, set func(num protowire.Number, v uint64)) (int, error) {
+	var msg []byte
+	n := consumeBytes(typ, b, &msg)
+	if n <= 0 {
+		return n, nil
+	}
+	return n, parseVarints(msg, set)
+}
+
+func parseScopeConfig(b []byte, c *ScopeConfig) error {
+	*c = ScopeConfig{}
+	return protoFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		var v uint64
+		var s []byte
+		switch num {
+		case 1:
+			n := consumeBytes(typ, b, &s)
+			c.Serial = string(s)
+			return n, nil
+		case 2:
+			return consumeVarints(typ, b, func(num protowire.Number, v uint64) {
+				switch num {
+				case 1:
+					c.Hw.RegVersion = uint8(v)
+				case 2:
+					c.Hw.HwType = HwType(int32(v))
+				case 3:
+					c.Hw.HwVersion = uint8(v)
+				}
+			})
+		case 3:
+			return consumeVarints(typ, b, func(num protowire.Number, v uint64) {
+				switch num {
+				case 1:
+					c.Fw.Major = uint8(v)
+				case 2:
+					c.Fw.Minor = uint8(v)
+				case 3:
+					c.Fw.Debug = uint8(v)
+				}
+			})
+		case 4:
+			n := consumeBytes(typ, b, &s)
+			c.RegisterMap = string(s)
+			return n, nil
+		case 12:
+			return consumeVarints(typ, b, func(num protowire.Number, v uint64) {
+				switch num {
+				case 1:
+					c.AdcClockSource.AdcSrc = AdcSrc(int32(v))
+				case 2:
+					c.AdcClockSource.DcmOut = int(int32(v))
+				case 3:
+					c.AdcClockSource.DcmInput = DcmInput(int32(v))
+				}
+			})
+		case 16, 17:
+			var msg []byte
+			n := consumeBytes(typ, b, &msg)
+			if n <= 0 {
+				return n, nil
+			}
+			if num == 16 {
+				c.Io = &ScopeIo{}
+				return n, parseScopeIo(msg, c.Io)
+			}
+			c.Glitch = &Glitch{}
+			return n, parseGlitch(msg, c.Glitch)
+		}
+		n := consumeVarint(typ, b, &v)
+		if n <= 0 {
+			return n, nil
+		}
+		switch num {
+		case 5:
+			c.GainMode = GainMode(int32(v))
+		case 6:
+			c.Gain = uint8(v)
+		case 7:
+			c.TriggerMode = TriggerMode(int32(v))
+		case 8:
+			c.TotalSamples = uint32(v)
+		case 9:
+			c.TriggerOffset = uint32(v)
+		case 10:
+			c.PreSamples = uint32(v)
+		case 11:
+			c.Decimate = uint16(v)
+		case 13:
+			c.AdcFreq = uint32(v)
+		case 14:
+			c.ClkGenMul = uint32(v)
+		case 15:
+			c.ClkGenDiv = uint32(v)
+		}
+		return n, nil
+	})
+}
+
+// Writes a trace stream.
+type TraceEncoder struct {
+	w          io.Writer
+	msg, frame []byte
+}
+
+func NewTraceEncoder(w io.Writer) *TraceEncoder {
+	return &TraceEncoder{w: w}
+}
+
+func (e *TraceEncoder) writeRecord(num protowire.Number) error {
+	size := protowire.SizeTag(num) + protowire.SizeBytes(len(e.msg))
+	e.frame = protowire.AppendVarint(e.frame[:0], uint64(size))
+	e.frame = protowire.AppendTag(e.frame, num, protowire.BytesType)
+	e.frame = protowire.AppendBytes(e.frame, e.msg)
+	_, err := e.w.Write(e.frame)
+	return err
+}
+
+// Writes the scope config of the traces that follow.
+func (e *TraceEncoder) EncodeConfig(cfg *ScopeConfig) error {
+	e.msg = appendScopeConfig(e.msg[:0], cfg)
+	return e.writeRecord(recordConfig)
+}
+
+func (e *TraceEncoder) Encode(t *Trace) error {
+	e.msg = appendTrace(e.msg[:0], t)
+	return e.writeRecord(recordTrace)
+}
+
+// Reads a trace stream.
+type TraceDecoder struct {
+	r      *bufio.Reader
+	buf    []byte
+	config *ScopeConfig
+	// Size of the records read.
+	offset int64
+}
+
+func NewTraceDecoder(r io.Reader) *TraceDecoder {
+	return &TraceDecoder{r: bufio.NewReader(r)}
+}
+
+// Returns the last scope config read from the stream, nil if none yet.
+func (d *TraceDecoder) Config() *ScopeConfig {
+	return d.config
+}
+
+// Returns the number of bytes of the records read so far. A stream still
+// being written can be read again from there once it has grown.
+func (d *TraceDecoder) Offset() int64 {
+	return d.offset
+}
+
+// Reads the next trace, and any config records before it. Returns io.EOF at
+// the end of the stream, and an error wrapping io.ErrUnexpectedEOF if it ends
+// within a record, e.g. while it's being written.
+func (d *TraceDecoder) Decode(t *Trace) error {
+	for {
+		size, err := binary.ReadUvarint(d.r)
+		if err == io.EOF {
+			return io.EOF
+		}
+		if err != nil {
+			return fmt.Errorf("Failed reading record size: %w", err)
+		}
+		if size > maxProtoRecordSize {
+			return fmt.Errorf("Record size %d exceeds %d", size, maxProtoRecordSize)
+		}
+		if uint64(cap(d.buf)) < size {
+			d.buf = make([]byte, size)
+		}
+		d.buf = d.buf[:size]
+		if _, err = io.ReadFull(d.r, d.buf); err == io.EOF {
+			return fmt.Errorf("Truncated record: %w", io.ErrUnexpectedEOF)
+		} else if err != nil {
+			return fmt.Errorf("Truncated record: %w", err)
+		}
+		d.offset += int64(protowire.SizeVarint(size)) + int64(size)
+
+		found := false
+		err = protoFields(d.buf, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+			if typ != protowire.BytesType || (num != recordConfig && num != recordTrace) {
+				return 0, nil
+			}
+			msg, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			if num == recordTrace {
+				found = true
+				return n, parseTrace(msg, t)
+			}
+			cfg := &ScopeConfig{}
+			if err := parseScopeConfig(msg, cfg); err != nil {
+				return n, err
+			}
+			d.config = cfg
+			return n, nil
+		})
+		if err != nil {
+			return fmt.Errorf("Invalid record: %v", err)
+		}
+		if found {
+			return nil
+		}
+	}
+}
+
+// Writes the capture as a trace stream, preceded by the scope config if not
+// nil.
+func (c Capture) SaveProtoIo(dst io.Writer, cfg *ScopeConfig) error {
+	w := bufio.NewWriter(dst)
+	e := NewTraceEncoder(w)
+	if cfg != nil {
+		if err := e.EncodeConfig(cfg); err != nil {
+			return err
+		}
+	}
+	for i := range c {
+		if err := e.Encode(&c[i]); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func (c Capture) SaveProto(filename string, cfg *ScopeConfig) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("Error creating capture file: %v", err)
+	}
+	if err = c.SaveProtoIo(f, cfg); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Reads a whole trace stream. Returns the last scope config in the stream,
+// nil if there is none.
+func LoadCaptureProtoIo(src io.Reader) (Capture, *ScopeConfig, error) {
+	var c Capture
+	d := NewTraceDecoder(src)
+	for {
+		var t Trace
+		if err := d.Decode(&t); err == io.EOF {
+			return c, d.Config(), nil
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("Trace %d: %w", len(c), err)
+		}
+		c = append(c, t)
+	}
+}
+
+func LoadCaptureProto(filename string) (Capture, *ScopeConfig, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error opening capture file: %v", err)
+	}
+	defer f.Close()
+	return LoadCaptureProtoIo(f)
+}
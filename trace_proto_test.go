@@ -0,0 +1,186 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+	"unsafe"
+
+	"github.com/google/gocw"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestTraceProtoWireFormat(t *testing.T) {
+	var buf bytes.Buffer
+	e := gocw.NewTraceEncoder(&buf)
+	if err := e.Encode(&gocw.Trace{Key: []byte{1}, PowerMeasurements: []gocw.Sample{0.5}}); err != nil {
+		t.Fatal(err)
+	}
+	// Record{trace: Trace{key: [1], power_measurements: [0.5]}}, length delimited.
+	want := []byte{0x0b, 0x12, 0x09, 0x0a, 0x01, 0x01, 0x22, 0x04, 0x00, 0x00, 0x00, 0x3f}
+	if unsafe.Sizeof(gocw.Sample(0)) == 8 {
+		// Record{trace: Trace{key: [1], power_measurements_double: [0.5]}}.
+		want = []byte{0x0f, 0x12, 0x0d, 0x0a, 0x01, 0x01, 0x5a, 0x08,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xe0, 0x3f}
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("Encoded % x, want % x", buf.Bytes(), want)
+	}
+}
+
+func TestTraceProtoRoundTrip(t *testing.T) {
+	cfg := &gocw.ScopeConfig{
+		Serial:         "50203220",
+		Hw:             gocw.HwVersion{RegVersion: 1, HwType: gocw.HwChipWhispererLite, HwVersion: 2},
+		Fw:             gocw.FwVersion{Major: 0, Minor: 11},
+		RegisterMap:    "openadc",
+		GainMode:       gocw.GainModeLow,
+		Gain:           45,
+		TriggerMode:    gocw.TriggerModeFallingEdge,
+		TotalSamples:   5000,
+		TriggerOffset:  100,
+		Decimate:       2,
+		AdcClockSource: gocw.AdcSrcExtClkDirect,
+		AdcFreq:        29538459,
+		ClkGenMul:      2,
+		ClkGenDiv:      26,
+		Io: &gocw.ScopeIo{
+			TriggerPins:     []gocw.TriggerTargetIoPin{gocw.TriggerTargetIoPin4, gocw.TriggerTargetIoPinNrst},
+			TriggerPinLogic: gocw.TriggerPinAnd,
+			TargetIo: [4]gocw.TargetIoMode{gocw.TargetIoModeSerialRx, gocw.TargetIoModeSerialTx,
+				gocw.TargetIoModeHighZ, gocw.TargetIoModeGpioHigh},
+			Hs2: gocw.Hs2ModeGlitch,
+		},
+		Glitch: &gocw.Glitch{
+			ClockSource: gocw.GlitchClockClkGen,
+			Output:      gocw.GlitchOutputEnableOnly,
+			Trigger:     gocw.GlitchTriggerExtSingleShot,
+			ExtOffset:   1000,
+			Repeat:      3,
+			WidthFine:   -20,
+			OffsetFine:  255,
+			Hs2:         true,
+		},
+	}
+	capture := gocw.Capture{
+		{Key: []byte{1, 2}, Pt: []byte{3, 4}, Ct: []byte{5, 6},
+			PowerMeasurements: []gocw.Sample{-0.25, 0, 0.1}, ClockUnlocked: true},
+		{PowerMeasurements: []gocw.Sample{0.5, 0.5, 0.5}, Baseline: true, GainDb: 22.1},
+		{Key: []byte{7}, PowerMeasurements: []gocw.Sample{1, 2, 3}, Logic: []byte{0, 1, 3},
+			InvalidOutput: true},
+	}
+	var buf bytes.Buffer
+	if err := capture.SaveProtoIo(&buf, cfg); err != nil {
+		t.Fatal(err)
+	}
+	got, gotCfg, err := gocw.LoadCaptureProtoIo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, capture) {
+		t.Errorf("Decoded capture %+v, want %+v", got, capture)
+	}
+	if !reflect.DeepEqual(gotCfg, cfg) {
+		t.Errorf("Decoded config %+v, want %+v", gotCfg, cfg)
+	}
+}
+
+func TestTraceProtoDecodesUnpackedAndUnknownFields(t *testing.T) {
+	var trace []byte
+	// Unknown fields are skipped.
+	trace = protowire.AppendTag(trace, 99, protowire.VarintType)
+	trace = protowire.AppendVarint(trace, 7)
+	for _, s := range []float32{1.5, -2} {
+		trace = protowire.AppendTag(trace, 4, protowire.Fixed32Type)
+		trace = protowire.AppendFixed32(trace, math.Float32bits(s))
+	}
+	trace = protowire.AppendTag(trace, 11, protowire.Fixed64Type)
+	trace = protowire.AppendFixed64(trace, math.Float64bits(0.25))
+	// Single precision gain of older streams.
+	trace = protowire.AppendTag(trace, 9, protowire.Fixed32Type)
+	trace = protowire.AppendFixed32(trace, math.Float32bits(22.5))
+	var rec []byte
+	rec = protowire.AppendTag(rec, 2, protowire.BytesType)
+	rec = protowire.AppendBytes(rec, trace)
+	stream := protowire.AppendBytes(nil, rec)
+
+	d := gocw.NewTraceDecoder(bytes.NewReader(stream))
+	var got gocw.Trace
+	if err := d.Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if want := []gocw.Sample{1.5, -2, 0.25}; !reflect.DeepEqual(got.PowerMeasurements, want) {
+		t.Errorf("Samples %v, want %v", got.PowerMeasurements, want)
+	}
+	if got.GainDb != 22.5 {
+		t.Errorf("GainDb %v, want 22.5", got.GainDb)
+	}
+	if d.Config() != nil {
+		t.Errorf("Unexpected config %+v", d.Config())
+	}
+	if err := d.Decode(&got); err != io.EOF {
+		t.Errorf("Decode at end of stream returned %v, want io.EOF", err)
+	}
+}
+
+func TestTraceProtoTruncatedStream(t *testing.T) {
+	var buf bytes.Buffer
+	capture := gocw.Capture{{Key: []byte{1}, PowerMeasurements: []gocw.Sample{1, 2}}}
+	if err := capture.SaveProtoIo(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	truncated := buf.Bytes()[:buf.Len()-1]
+	if _, _, err := gocw.LoadCaptureProtoIo(bytes.NewReader(truncated)); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Loading a truncated stream returned %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestTraceProtoResumesGrowingStream(t *testing.T) {
+	var buf bytes.Buffer
+	capture := gocw.Capture{
+		{Key: []byte{1}, PowerMeasurements: []gocw.Sample{1, 2}},
+		{Key: []byte{2}, PowerMeasurements: []gocw.Sample{3, 4}},
+	}
+	if err := capture.SaveProtoIo(&buf, &gocw.ScopeConfig{Serial: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	stream := buf.Bytes()
+
+	// The second trace is still being written.
+	d := gocw.NewTraceDecoder(bytes.NewReader(stream[:len(stream)-2]))
+	var got gocw.Trace
+	if err := d.Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Decode(&got); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Decoding a partial record returned %v, want io.ErrUnexpectedEOF", err)
+	}
+	d = gocw.NewTraceDecoder(bytes.NewReader(stream[d.Offset():]))
+	if err := d.Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, capture[1]) {
+		t.Errorf("Resumed at %+v, want %+v", got, capture[1])
+	}
+	if err := d.Decode(&got); err != io.EOF {
+		t.Errorf("Decode at end of stream returned %v, want io.EOF", err)
+	}
+}
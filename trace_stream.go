@@ -0,0 +1,219 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Streaming reads of the ADC FIFO.
+// Large FIFO drains are read in chunks by a goroutine, with several bulk
+// transfers in flight where the transport supports it (the gousb stream
+// API), while the chunks already read are decoded. USB transfers and
+// decoding overlap, instead of decoding once the whole FIFO was read.
+package gocw
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Bulk input stream with several transfers in flight.
+type BulkReadStream interface {
+	io.ReadCloser
+	ReadContext(ctx context.Context, p []byte) (int, error)
+}
+
+// Implemented by transports whose bulk input endpoint supports streams, and
+// by devices opening them, see UsbDevice.NewReadStream.
+type readStreamer interface {
+	NewReadStream(size, count int) (BulkReadStream, error)
+}
+
+// Opens a stream reading the bulk input endpoint with count transfers of size
+// bytes in flight. Transfers are queued until the stream is closed, which
+// cancels them. Fails if the transport doesn't support streams.
+func (d *UsbDevice) NewReadStream(size, count int) (BulkReadStream, error) {
+	if t, ok := d.transport().(readStreamer); ok {
+		return t.NewReadStream(size, count)
+	}
+	return nil, fmt.Errorf("Transport does not support read streams")
+}
+
+// Reads n bytes from memory address addr, in chunks of up to StreamChunk
+// bytes read by a goroutine up to StreamBuffers chunks ahead of consume.
+// consume is called in order with each chunk, from the calling goroutine,
+// and must not keep it. Returns the number of bytes read, short of n with a
+// *ShortReadError, or with the error of consume, which stops the read.
+// Devices without streams (see UsbDevice.NewReadStream) read one chunk at a
+// time, still ahead of consume. The device stays locked until the read ends,
+// see UsbDevice.Lock, so consume must not use the memory.
+func (m *Memory) ReadBytesStream(ctx context.Context, addr Address, n int, consume func([]byte) error) (int, error) {
+	glog.V(1).Infof("[ext-mem-stream]: addr = %v, dlen = %v", addr, n)
+	if n <= 0 {
+		return 0, nil
+	}
+	unlock := lockDevice(m.dev)
+	defer unlock()
+	if err := m.sendAddressBlock(ReqMemReadBulk, addr, n); err != nil {
+		return 0, err
+	}
+	read := func(p []byte) (int, error) {
+		return readContext(ctx, m.dev, p)
+	}
+	if d, ok := m.dev.(readStreamer); ok {
+		if stream, err := d.NewReadStream(m.cfg.StreamChunk, m.cfg.StreamBuffers); err == nil {
+			defer stream.Close()
+			read = func(p []byte) (int, error) {
+				return stream.ReadContext(ctx, p)
+			}
+		}
+	}
+
+	// Buffers cycle from free to the reader, to full and to consume. One more
+	// than StreamBuffers, so the reader fills them while one is consumed.
+	free := make(chan []byte, m.cfg.StreamBuffers+1)
+	for i := 0; i < cap(free); i++ {
+		free <- make([]byte, m.cfg.StreamChunk)
+	}
+	full := make(chan []byte, m.cfg.StreamBuffers)
+	done := make(chan struct{})
+	var readErr error
+	go func() {
+		defer close(full)
+		for total := 0; total < n; {
+			var buf []byte
+			select {
+			case buf = <-free:
+			case <-done:
+				return
+			}
+			if len(buf) > n-total {
+				buf = buf[:n-total]
+			}
+			start := time.Now()
+			k, err := read(buf)
+			m.latency.Since(LatencyBulkRead, start)
+			if k > 0 {
+				total += k
+				full <- buf[:k]
+			}
+			if err == nil && k == 0 {
+				err = &ShortReadError{total, n}
+			}
+			if err != nil {
+				readErr = err
+				return
+			}
+			if m.cfg.Progress != nil {
+				m.cfg.Progress(total, n)
+			}
+		}
+	}()
+
+	consumed := 0
+	var err error
+	for buf := range full {
+		if err == nil {
+			if err = consume(buf); err == nil {
+				consumed += len(buf)
+			}
+		}
+		if err != nil {
+			// Drains the reader.
+			select {
+			case <-done:
+			default:
+				close(done)
+			}
+			continue
+		}
+		free <- buf[:cap(buf)]
+	}
+	if err != nil {
+		return consumed, err
+	}
+	if readErr != nil {
+		if _, ok := readErr.(*ShortReadError); ok {
+			return consumed, readErr
+		}
+		if ctx.Err() != nil {
+			return consumed, ctx.Err()
+		}
+		return consumed, fmt.Errorf("ReqMemReadBulk data failed: %v", readErr)
+	}
+	return consumed, nil
+}
+
+// Same as TraceDataContext, delivering the samples over the returned channel
+// as the FIFO is read and decoded, see Memory.ReadBytesStream. The channel is
+// closed at the end of the samples, or on error. The Adc must not be used
+// until then, and Error and LastTraceRead then report the read.
+func (c *Adc) TraceDataStream(ctx context.Context) <-chan []Sample {
+	out := make(chan []Sample, c.fpga.Mem.cfg.StreamBuffers)
+	samples, toRead := c.traceReadSize()
+	if toRead == 0 {
+		close(out)
+		return out
+	}
+	decoder := NewTraceDataDecoder(c.TraceDataDecoderConfig())
+	if c.err != nil {
+		close(out)
+		return out
+	}
+	glog.V(1).Infof("Streaming trace data. samples: %v, toRead: %v", samples, toRead)
+	go func() {
+		defer close(out)
+		n, err := c.fpga.Mem.ReadBytesStream(ctx, c.regs.adcData, toRead, func(chunk []byte) error {
+			measurements, err := decoder.Decode(chunk)
+			if err != nil {
+				return err
+			}
+			if c.lastRead.Decoded+len(measurements) > samples {
+				measurements = measurements[:samples-c.lastRead.Decoded]
+			}
+			if len(measurements) == 0 {
+				return nil
+			}
+			c.lastRead.Decoded += len(measurements)
+			c.lastRead.Clipped += ClippedSamples(measurements)
+			select {
+			case out <- measurements:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		c.lastRead.BytesRead = n
+		if ctx.Err() != nil {
+			c.err = ctx.Err()
+			return
+		}
+		if err != nil {
+			if _, ok := err.(*ShortReadError); !ok {
+				c.err = fmt.Errorf("Failed reading trace data: %v", err)
+				return
+			}
+			c.diag.ShortReads++
+			glog.Warningf("Failed reading trace data: %v", err)
+		}
+		if c.lastRead.Decoded < samples {
+			glog.Warningf("Decoded %d of %d samples", c.lastRead.Decoded, samples)
+		}
+		if c.lastRead.Clipped > 0 {
+			c.diag.ClippedReads++
+			glog.Warningf("%d samples clipped, the gain may be too high", c.lastRead.Clipped)
+		}
+	}()
+	return out
+}
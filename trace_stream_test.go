@@ -0,0 +1,89 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"context"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/google/gocw"
+)
+
+// A registerDevice whose bulk reads drain a FIFO, through read streams.
+type fifoDevice struct {
+	*registerDevice
+	fifo    []byte
+	streams int
+}
+
+func (d *fifoDevice) Read(p []byte) (int, error) {
+	n := copy(p, d.fifo)
+	d.fifo = d.fifo[n:]
+	return n, nil
+}
+
+func (d *fifoDevice) NewReadStream(size, count int) (gocw.BulkReadStream, error) {
+	d.streams++
+	return fifoStream{d}, nil
+}
+
+type fifoStream struct{ d *fifoDevice }
+
+func (s fifoStream) Read(p []byte) (int, error) { return s.d.Read(p) }
+func (s fifoStream) Close() error               { return nil }
+
+func (s fifoStream) ReadContext(ctx context.Context, p []byte) (int, error) {
+	return s.d.Read(p)
+}
+
+func TestAdcTraceDataStream(t *testing.T) {
+	dev := &fifoDevice{registerDevice: newRegisterDevice(gocw.HwChipWhispererLite)}
+	fpga, err := gocw.AttachFpga(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adc, err := gocw.NewAdc(fpga)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := fpga.Mem.TransferConfig()
+	cfg.StreamChunk = 8
+	fpga.Mem.SetTransferConfig(cfg)
+	adc.SetTotalSamples(30)
+	dev.fifo = packedTrace(binary.BigEndian, 11, 0, 0)
+	// bytes_to_rx
+	dev.regs[18] = []byte{byte(len(dev.fifo)), 0, 0, 0}
+
+	var samples []gocw.Sample
+	chunks := 0
+	for s := range adc.TraceDataStream(context.Background()) {
+		samples = append(samples, s...)
+		chunks++
+	}
+	if err = adc.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if want := indexSamples(0, 29); !reflect.DeepEqual(samples, want) {
+		t.Errorf("Streamed %v, want %v", samples, want)
+	}
+	if chunks < 2 || dev.streams != 1 {
+		t.Errorf("Streamed %d chunks over %d streams, want several over 1", chunks, dev.streams)
+	}
+	if read := adc.LastTraceRead(); read.Decoded != 30 || read.BytesRead != 44 {
+		t.Errorf("Last read %+v, want 30 samples from 44 bytes", read)
+	}
+}
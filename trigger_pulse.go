@@ -0,0 +1,119 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Pulse output on trigger, for driving external fault injection equipment
+// (EMFI probes, lasers) with TTL trigger inputs.
+// Uses the glitch module in "enable only" mode, so HS2 outputs a clean pulse
+// instead of a glitched clock. The crowbar MOSFETs are not used.
+// Based on chipwhisperer/software/chipwhisperer/capture/scopes/cwhardware/ChipWhispererGlitch.py.
+package gocw
+
+import (
+	"fmt"
+)
+
+//go:generate stringer -type PulsePin
+type PulsePin int
+
+const (
+	// High speed output 2. The only glitch output routable to a header on
+	// the CW-Lite besides the crowbars.
+	PulsePinHs2 PulsePin = iota
+)
+
+type TriggerPulse struct {
+	Pin PulsePin
+	// Delay from the trigger to the pulse, in CLKGEN cycles.
+	Offset uint32
+	// Pulse width in CLKGEN cycles [1, 256].
+	Width int
+	// Fires once per arm, ignoring triggers until the ADC is re-armed. This
+	// acts as an unbounded dead-time, protecting probes that must not fire
+	// twice in quick succession.
+	SingleShot bool
+}
+
+// Configures a pulse on the trigger, see TriggerPulse.
+func (c *Adc) SetTriggerPulse(p TriggerPulse) {
+	if c.err != nil {
+		return
+	}
+	if c.err = c.caps.Require(FeatureTriggerPulse); c.err != nil {
+		return
+	}
+	if p.Width < 1 || p.Width > 256 {
+		c.err = fmt.Errorf("Pulse width %d outside [1, 256]", p.Width)
+		return
+	}
+	if p.Pin != PulsePinHs2 {
+		c.err = fmt.Errorf("Unsupported pulse pin %v", p.Pin)
+		return
+	}
+
+	regs := c.glitchRegisters()
+	if c.err != nil {
+		return
+	}
+	offset := p.Offset
+	if c.err = c.fpga.Mem.Write(Address(regs.extOffset.Address), &offset, true, nil); c.err != nil {
+		return
+	}
+
+	settings := c.glitchSettings(regs)
+	if c.err != nil {
+		return
+	}
+	src := GlitchTriggerExtContinuous
+	if p.SingleShot {
+		src = GlitchTriggerExtSingleShot
+	}
+	regs.trigSrc.Set(settings, uint8(src))
+	regs.outType.Set(settings, uint8(GlitchOutputEnableOnly))
+	// Number of cycles the output is enabled for, minus one.
+	regs.repeat.Set(settings, uint8(p.Width-1))
+	if c.err = c.fpga.Mem.Write(Address(regs.glitch.Address), settings, false, nil); c.err != nil {
+		return
+	}
+	c.SetHs2(Hs2ModeGlitch)
+}
+
+// Returns the pulse configuration.
+func (c *Adc) TriggerPulse() TriggerPulse {
+	var p TriggerPulse
+	regs := c.glitchRegisters()
+	settings := c.glitchSettings(regs)
+	if c.err != nil {
+		return p
+	}
+	if c.err = c.fpga.Mem.Read(Address(regs.extOffset.Address), &p.Offset); c.err != nil {
+		return p
+	}
+	p.Width = int(regs.repeat.Get(settings)) + 1
+	p.SingleShot = GlitchTrigger(regs.trigSrc.Get(settings)) == GlitchTriggerExtSingleShot
+	return p
+}
+
+// Stops pulsing on trigger, and restores the CLKGEN output on HS2.
+func (c *Adc) DisableTriggerPulse() {
+	regs := c.glitchRegisters()
+	settings := c.glitchSettings(regs)
+	if c.err != nil {
+		return
+	}
+	regs.trigSrc.Set(settings, uint8(GlitchTriggerManual))
+	if c.err = c.fpga.Mem.Write(Address(regs.glitch.Address), settings, false, nil); c.err != nil {
+		return
+	}
+	c.SetHs2(Hs2ModeClkGen)
+}
@@ -0,0 +1,316 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Lower case, without separators, so that "rising_edge", "Rising Edge" and
+// "RisingEdge" all match.
+func normalize(s string) string {
+	return strings.ToLower(strings.NewReplacer("_", "", "-", "", " ", "").Replace(s))
+}
+
+// Returns the value of an enum named s: the name of the constant, with or
+// without its prefix, in any case and with or without separators. E.g.
+// "TriggerModeRisingEdge", "rising_edge" or "RisingEdge" for
+// TriggerModeRisingEdge. Values run from zero up to the first one name
+// doesn't know, which stringer names typeName(value).
+func parse(typeName, prefix, s string, name func(v int) string) (int, error) {
+	want := normalize(s)
+	var names []string
+	for v := 0; ; v++ {
+		n := name(v)
+		if strings.HasPrefix(n, typeName+"(") {
+			break
+		}
+		if want == normalize(n) || want == normalize(strings.TrimPrefix(n, prefix)) {
+			return v, nil
+		}
+		names = append(names, strings.TrimPrefix(n, prefix))
+	}
+	return 0, fmt.Errorf("Unknown %s %q, expected one of %s", typeName, s, strings.Join(names, ", "))
+}
+
+// Unmarshals a JSON enum from its name, or from its number as written by
+// versions before text marshaling, e.g. in device profiles and audit logs.
+func unmarshalJSON(data []byte, v *int, parse func(s string) (int, error)) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return json.Unmarshal(data, v)
+	}
+	n, err := parse(s)
+	if err != nil {
+		return err
+	}
+	*v = n
+	return nil
+}
+
+func ParseHwType(s string) (HwType, error) {
+	v, err := parse("HwType", "Hw", s, func(v int) string { return fmt.Sprint(HwType(v)) })
+	return HwType(v), err
+}
+
+func (t HwType) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprint(t)), nil
+}
+
+func (t *HwType) UnmarshalText(text []byte) (err error) {
+	*t, err = ParseHwType(string(text))
+	return
+}
+
+func (t *HwType) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, (*int)(t), func(s string) (int, error) {
+		v, err := ParseHwType(s)
+		return int(v), err
+	})
+}
+
+func ParseGainMode(s string) (GainMode, error) {
+	v, err := parse("GainMode", "GainMode", s, func(v int) string { return fmt.Sprint(GainMode(v)) })
+	return GainMode(v), err
+}
+
+func (m GainMode) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprint(m)), nil
+}
+
+func (m *GainMode) UnmarshalText(text []byte) (err error) {
+	*m, err = ParseGainMode(string(text))
+	return
+}
+
+func (m *GainMode) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, (*int)(m), func(s string) (int, error) {
+		v, err := ParseGainMode(s)
+		return int(v), err
+	})
+}
+
+func ParseTriggerMode(s string) (TriggerMode, error) {
+	v, err := parse("TriggerMode", "TriggerMode", s, func(v int) string { return fmt.Sprint(TriggerMode(v)) })
+	return TriggerMode(v), err
+}
+
+func (m TriggerMode) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprint(m)), nil
+}
+
+func (m *TriggerMode) UnmarshalText(text []byte) (err error) {
+	*m, err = ParseTriggerMode(string(text))
+	return
+}
+
+func (m *TriggerMode) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, (*int)(m), func(s string) (int, error) {
+		v, err := ParseTriggerMode(s)
+		return int(v), err
+	})
+}
+
+func ParseAdcSrc(s string) (AdcSrc, error) {
+	v, err := parse("AdcSrc", "AdcSrc", s, func(v int) string { return fmt.Sprint(AdcSrc(v)) })
+	return AdcSrc(v), err
+}
+
+func (src AdcSrc) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprint(src)), nil
+}
+
+func (src *AdcSrc) UnmarshalText(text []byte) (err error) {
+	*src, err = ParseAdcSrc(string(text))
+	return
+}
+
+func (src *AdcSrc) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, (*int)(src), func(s string) (int, error) {
+		v, err := ParseAdcSrc(s)
+		return int(v), err
+	})
+}
+
+func ParseDcmInput(s string) (DcmInput, error) {
+	v, err := parse("DcmInput", "DcmInput", s, func(v int) string { return fmt.Sprint(DcmInput(v)) })
+	return DcmInput(v), err
+}
+
+func (in DcmInput) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprint(in)), nil
+}
+
+func (in *DcmInput) UnmarshalText(text []byte) (err error) {
+	*in, err = ParseDcmInput(string(text))
+	return
+}
+
+func (in *DcmInput) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, (*int)(in), func(s string) (int, error) {
+		v, err := ParseDcmInput(s)
+		return int(v), err
+	})
+}
+
+func ParseFreqCounterSrc(s string) (FreqCounterSrc, error) {
+	v, err := parse("FreqCounterSrc", "FreqCounter", s, func(v int) string { return fmt.Sprint(FreqCounterSrc(v)) })
+	return FreqCounterSrc(v), err
+}
+
+func (src FreqCounterSrc) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprint(src)), nil
+}
+
+func (src *FreqCounterSrc) UnmarshalText(text []byte) (err error) {
+	*src, err = ParseFreqCounterSrc(string(text))
+	return
+}
+
+func (src *FreqCounterSrc) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, (*int)(src), func(s string) (int, error) {
+		v, err := ParseFreqCounterSrc(s)
+		return int(v), err
+	})
+}
+
+func ParseClkGenInputSrc(s string) (ClkGenInputSrc, error) {
+	v, err := parse("ClkGenInputSrc", "ClkGenInput", s, func(v int) string { return fmt.Sprint(ClkGenInputSrc(v)) })
+	return ClkGenInputSrc(v), err
+}
+
+func (src ClkGenInputSrc) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprint(src)), nil
+}
+
+func (src *ClkGenInputSrc) UnmarshalText(text []byte) (err error) {
+	*src, err = ParseClkGenInputSrc(string(text))
+	return
+}
+
+func (src *ClkGenInputSrc) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, (*int)(src), func(s string) (int, error) {
+		v, err := ParseClkGenInputSrc(s)
+		return int(v), err
+	})
+}
+
+func ParseTriggerTargetIoPin(s string) (TriggerTargetIoPin, error) {
+	v, err := parse("TriggerTargetIoPin", "TriggerTargetIoPin", s,
+		func(v int) string { return fmt.Sprint(TriggerTargetIoPin(v)) })
+	return TriggerTargetIoPin(v), err
+}
+
+func (pin TriggerTargetIoPin) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprint(pin)), nil
+}
+
+func (pin *TriggerTargetIoPin) UnmarshalText(text []byte) (err error) {
+	*pin, err = ParseTriggerTargetIoPin(string(text))
+	return
+}
+
+func (pin *TriggerTargetIoPin) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, (*int)(pin), func(s string) (int, error) {
+		v, err := ParseTriggerTargetIoPin(s)
+		return int(v), err
+	})
+}
+
+func ParseTriggerPinLogic(s string) (TriggerPinLogic, error) {
+	v, err := parse("TriggerPinLogic", "TriggerPin", s, func(v int) string { return fmt.Sprint(TriggerPinLogic(v)) })
+	return TriggerPinLogic(v), err
+}
+
+func (l TriggerPinLogic) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprint(l)), nil
+}
+
+func (l *TriggerPinLogic) UnmarshalText(text []byte) (err error) {
+	*l, err = ParseTriggerPinLogic(string(text))
+	return
+}
+
+func (l *TriggerPinLogic) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, (*int)(l), func(s string) (int, error) {
+		v, err := ParseTriggerPinLogic(s)
+		return int(v), err
+	})
+}
+
+func ParseTargetIoMode(s string) (TargetIoMode, error) {
+	v, err := parse("TargetIoMode", "TargetIoMode", s, func(v int) string { return fmt.Sprint(TargetIoMode(v)) })
+	return TargetIoMode(v), err
+}
+
+func (m TargetIoMode) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprint(m)), nil
+}
+
+func (m *TargetIoMode) UnmarshalText(text []byte) (err error) {
+	*m, err = ParseTargetIoMode(string(text))
+	return
+}
+
+func (m *TargetIoMode) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, (*int)(m), func(s string) (int, error) {
+		v, err := ParseTargetIoMode(s)
+		return int(v), err
+	})
+}
+
+func ParseHs2Mode(s string) (Hs2Mode, error) {
+	v, err := parse("Hs2Mode", "Hs2Mode", s, func(v int) string { return fmt.Sprint(Hs2Mode(v)) })
+	return Hs2Mode(v), err
+}
+
+func (m Hs2Mode) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprint(m)), nil
+}
+
+func (m *Hs2Mode) UnmarshalText(text []byte) (err error) {
+	*m, err = ParseHs2Mode(string(text))
+	return
+}
+
+func (m *Hs2Mode) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, (*int)(m), func(s string) (int, error) {
+		v, err := ParseHs2Mode(s)
+		return int(v), err
+	})
+}
+
+func ParseGpioMode(s string) (GpioMode, error) {
+	v, err := parse("GpioMode", "Gpio", s, func(v int) string { return fmt.Sprint(GpioMode(v)) })
+	return GpioMode(v), err
+}
+
+func (m GpioMode) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprint(m)), nil
+}
+
+func (m *GpioMode) UnmarshalText(text []byte) (err error) {
+	*m, err = ParseGpioMode(string(text))
+	return
+}
+
+func (m *GpioMode) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, (*int)(m), func(s string) (int, error) {
+		v, err := ParseGpioMode(s)
+		return int(v), err
+	})
+}
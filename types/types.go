@@ -0,0 +1,161 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Enums of the ADC settings, shared by the gocw API, the CLI and config
+// files. Each enum has a Parse function, and marshals to its name in JSON,
+// YAML and any other encoding using encoding.TextMarshaler, so human-readable
+// configs round-trip to hardware settings. See Parse.
+// The gocw package re-exports all of them, e.g. gocw.TriggerMode.
+package types
+
+// FPGA board, as reported by the bitstream.
+//
+//go:generate stringer -type HwType
+type HwType int
+
+const (
+	HwUnknown               HwType = iota
+	HwLx9MicroBoard         HwType = iota
+	HwSaseboW               HwType = iota
+	HwChipWhispererRev2Lx25 HwType = iota
+	HwReserved              HwType = iota
+	HwZedBoard              HwType = iota
+	HwPapilioPro            HwType = iota
+	HwSakuraG               HwType = iota
+	HwChipWhispererLite     HwType = iota
+	HwChipWhispererCw1200   HwType = iota
+)
+
+// Gain range of the AD8331 amplifier, see gocw.GainDb.
+//
+//go:generate stringer -type GainMode
+type GainMode int
+
+const (
+	GainModeHigh GainMode = iota
+	GainModeLow  GainMode = iota
+)
+
+// Edge or level of the trigger signal starting a capture.
+//
+//go:generate stringer -type TriggerMode
+type TriggerMode int
+
+const (
+	TriggerModeRisingEdge  TriggerMode = iota
+	TriggerModeFallingEdge TriggerMode = iota
+	TriggerModeLow         TriggerMode = iota
+	TriggerModeHigh        TriggerMode = iota
+)
+
+// Source of the ADC sample clock: a DCM, or the EXTCLK pin directly.
+//
+//go:generate stringer -type AdcSrc
+type AdcSrc int
+
+const (
+	AdcSrcDcm    AdcSrc = iota
+	AdcSrcExtClk AdcSrc = iota
+)
+
+// Input of the ADC clock DCM.
+//
+//go:generate stringer -type DcmInput
+type DcmInput int
+
+const (
+	DcmInputClkGen DcmInput = iota
+	DcmInputExtClk DcmInput = iota
+)
+
+// Clock measured by the frequency counter.
+//
+//go:generate stringer -type FreqCounterSrc
+type FreqCounterSrc int
+
+const (
+	FreqCounterExtClkInput  FreqCounterSrc = iota
+	FreqCounterClkGenOutput FreqCounterSrc = iota
+)
+
+// Input of the CLKGEN clock generator.
+//
+//go:generate stringer -type ClkGenInputSrc
+type ClkGenInputSrc int
+
+const (
+	ClkGenInputSystem ClkGenInputSrc = iota
+	ClkGenInputExtClk ClkGenInputSrc = iota
+)
+
+// Pin feeding the trigger module.
+//
+//go:generate stringer -type TriggerTargetIoPin
+type TriggerTargetIoPin int
+
+const (
+	TriggerTargetIoPin1 TriggerTargetIoPin = iota
+	TriggerTargetIoPin2 TriggerTargetIoPin = iota
+	TriggerTargetIoPin3 TriggerTargetIoPin = iota
+	TriggerTargetIoPin4 TriggerTargetIoPin = iota
+	// Target nRST.
+	TriggerTargetIoPinNrst TriggerTargetIoPin = iota
+)
+
+// Combination of several trigger pins.
+//
+//go:generate stringer -type TriggerPinLogic
+type TriggerPinLogic int
+
+const (
+	TriggerPinOr   TriggerPinLogic = iota
+	TriggerPinAnd  TriggerPinLogic = iota
+	TriggerPinNand TriggerPinLogic = iota
+)
+
+// Function of the TIO1 and TIO2 pins.
+//
+//go:generate stringer -type TargetIoMode
+type TargetIoMode int
+
+const (
+	TargetIoModeSerialRx     TargetIoMode = iota
+	TargetIoModeSerialTx     TargetIoMode = iota
+	TargetIoModeHighZ        TargetIoMode = iota
+	TargetIoModeGpioLow      TargetIoMode = iota
+	TargetIoModeGpioHigh     TargetIoMode = iota
+	TargetIoModeGpioDisabled TargetIoMode = iota
+)
+
+// Clock driven on the HS2 pin, which usually clocks the target.
+//
+//go:generate stringer -type Hs2Mode
+type Hs2Mode int
+
+const (
+	Hs2ModeDisabled Hs2Mode = iota
+	Hs2ModeClkGen   Hs2Mode = iota
+	Hs2ModeGlitch   Hs2Mode = iota
+)
+
+// State of the special GPIOs: nRST, PDIC and PDID.
+//
+//go:generate stringer -type GpioMode
+type GpioMode int
+
+const (
+	GpioLow      GpioMode = iota
+	GpioHigh     GpioMode = iota
+	GpioDisabled GpioMode = iota
+)
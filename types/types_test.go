@@ -0,0 +1,80 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/google/gocw/types"
+)
+
+func TestParse(t *testing.T) {
+	for _, s := range []string{"TriggerModeFallingEdge", "FallingEdge", "falling_edge", "falling-edge"} {
+		if m, err := types.ParseTriggerMode(s); err != nil || m != types.TriggerModeFallingEdge {
+			t.Errorf("ParseTriggerMode(%q) = %v, %v", s, m, err)
+		}
+	}
+	// Prefixes shorter than the type name.
+	if l, err := types.ParseTriggerPinLogic("nand"); err != nil || l != types.TriggerPinNand {
+		t.Errorf("ParseTriggerPinLogic(nand) = %v, %v", l, err)
+	}
+	if m, err := types.ParseGpioMode("disabled"); err != nil || m != types.GpioDisabled {
+		t.Errorf("ParseGpioMode(disabled) = %v, %v", m, err)
+	}
+	if p, err := types.ParseTriggerTargetIoPin("4"); err != nil || p != types.TriggerTargetIoPin4 {
+		t.Errorf("ParseTriggerTargetIoPin(4) = %v, %v", p, err)
+	}
+	_, err := types.ParseHs2Mode("fast")
+	if err == nil || !strings.Contains(err.Error(), "ClkGen") {
+		t.Errorf("ParseHs2Mode(fast) = %v, expected an error listing the modes", err)
+	}
+}
+
+type config struct {
+	Trigger types.TriggerMode
+	Io1     types.TargetIoMode
+	Gain    types.GainMode
+}
+
+func TestJsonRoundTrip(t *testing.T) {
+	c := config{types.TriggerModeLow, types.TargetIoModeGpioHigh, types.GainModeLow}
+	buf, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"Trigger":"TriggerModeLow","Io1":"TargetIoModeGpioHigh","Gain":"GainModeLow"}`; string(buf) != want {
+		t.Errorf("Marshaled %s, want %s", buf, want)
+	}
+	var got config
+	if err = json.Unmarshal(buf, &got); err != nil || got != c {
+		t.Errorf("Unmarshaled %+v, %v, want %+v", got, err, c)
+	}
+}
+
+// Files written before text marshaling store numbers.
+func TestJsonNumbers(t *testing.T) {
+	var c config
+	if err := json.Unmarshal([]byte(`{"Trigger":2,"Io1":4,"Gain":1}`), &c); err != nil {
+		t.Fatal(err)
+	}
+	if want := (config{types.TriggerModeLow, types.TargetIoModeGpioHigh, types.GainModeLow}); c != want {
+		t.Errorf("Unmarshaled %+v, want %+v", c, want)
+	}
+	if err := json.Unmarshal([]byte(`{"Trigger":"sideways"}`), &c); err == nil {
+		t.Error("Unmarshaled an unknown trigger mode")
+	}
+}
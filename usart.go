@@ -16,9 +16,12 @@
 package gocw
 
 import (
+	"context"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"math"
+	"os"
 	"sync"
 	"time"
 
@@ -27,8 +30,12 @@ import (
 
 //go:generate mockgen -destination=mocks/usart.go -package=mocks github.com/google/gocw UsartInterface
 type UsartInterface interface {
+	// Reads return as soon as bytes are available, and fail if none arrive
+	// within the timeout. Use io.ReadFull to read a fixed length.
 	io.Reader
 	io.Writer
+	// Same as Read, returning early when ctx is done.
+	ReadContext(ctx context.Context, p []byte) (int, error)
 	// Clears any pending data from the read buffer.
 	Flush() (err error)
 	// Gets/Sets Read timeout.
@@ -43,8 +50,31 @@ const (
 	cmdEnable  command = 0x11
 	cmdDisable command = 0x12
 	cmdNumWait command = 0x14
+	// Set US_MR_USART_MODE_HW_HANDSHAKING, and the US_CR_STTBRK and
+	// US_CR_STPBRK control bits.
+	cmdFlowControl command = 0x15
+	cmdStartBreak  command = 0x16
+	cmdStopBreak   command = 0x17
 )
 
+// NAEUSB number of the auxiliary USART.
+const usartAux = 1
+
+// Flow control of the target serial port.
+type FlowControl uint8
+
+const (
+	FlowControlNone FlowControl = 0
+	// RTS/CTS hardware handshaking. The USART stops sending while CTS is
+	// high, and raises RTS when its receive buffer is full.
+	FlowControlRtsCts FlowControl = 1
+)
+
+// Longest USART frame: start bit, 9 data bits and 2 stop bits.
+const maxFrameBits = 12
+
+// Any rate the SAM3U divides from its master clock within maxBaudRateError,
+// about 92 to 12M baud, see BaudRate.Validate.
 type BaudRate uint32
 
 const (
@@ -52,6 +82,47 @@ const (
 	BaudRateHigh BaudRate = 115200
 )
 
+const (
+	// Master clock of the SAM3U, divided down to the baud rate.
+	sam3uMasterClock = 96000000
+	// Relative error of the divided baud rate. Receivers tolerate about 2%,
+	// shared by both ends.
+	maxBaudRateError = 0.01
+	// Fractional bits of the SAM3U baud rate divider.
+	baudRateFracBits = 3
+	maxBaudRateDiv   = 1<<16 - 1
+)
+
+// Returns the baud rate the SAM3U runs at when set to b. As the firmware
+// (ASF usart_set_async_baudrate), oversamples 16 times, or 8 times at rates
+// too high for it, and rounds the fractional divider.
+func (b BaudRate) Actual() (BaudRate, error) {
+	if b == 0 {
+		return 0, fmt.Errorf("Baud rate 0 is invalid")
+	}
+	over := uint64(16)
+	if uint64(b)*over > sam3uMasterClock {
+		over = 8
+	}
+	div := (sam3uMasterClock<<baudRateFracBits + over*uint64(b)/2) / (over * uint64(b))
+	if div>>baudRateFracBits < 1 || div>>baudRateFracBits > maxBaudRateDiv {
+		return 0, fmt.Errorf("Baud rate %d out of the SAM3U range", b)
+	}
+	return BaudRate(sam3uMasterClock << baudRateFracBits / (over * div)), nil
+}
+
+// Checks that the SAM3U runs close enough to baud rate b, see Actual.
+func (b BaudRate) Validate() error {
+	actual, err := b.Actual()
+	if err != nil {
+		return err
+	}
+	if e := math.Abs(float64(actual)-float64(b)) / float64(b); e > maxBaudRateError {
+		return fmt.Errorf("Baud rate %d is off by %.1f%% (%d)", b, e*100, actual)
+	}
+	return nil
+}
+
 type Parity uint8
 
 const (
@@ -73,10 +144,19 @@ const (
 type DataBits uint8
 
 const (
+	DataBitsFive    DataBits = 5
+	DataBitsSix     DataBits = 6
+	DataBitsSeven   DataBits = 7
 	DataBitsOneByte DataBits = 8
+	DataBitsNine    DataBits = 9
 )
 
-// Struct layout matches what cmdInit expects, so don't change this.
+// Struct layout matches what cmdInit expects, so don't change this. Build
+// one from DefaultUsartConfig, e.g.
+//
+//	gocw.DefaultUsartConfig().WithBaudRate(9600).WithParity(gocw.ParityEven)
+//
+// rather than a struct literal, whose zero baud rate and data bits are invalid.
 type UsartConfig struct {
 	BaudRate BaudRate
 	StopBits StopBits
@@ -91,22 +171,115 @@ var defaultProperties = UsartConfig{
 	DataBitsOneByte,
 }
 
+// Returns the configuration of the ChipWhisperer firmware: 38400 baud, 8 data
+// bits, no parity and 1 stop bit.
+func DefaultUsartConfig() UsartConfig {
+	return defaultProperties
+}
+
+func (c UsartConfig) WithBaudRate(b BaudRate) UsartConfig {
+	c.BaudRate = b
+	return c
+}
+
+func (c UsartConfig) WithParity(p Parity) UsartConfig {
+	c.Parity = p
+	return c
+}
+
+func (c UsartConfig) WithStopBits(s StopBits) UsartConfig {
+	c.StopBits = s
+	return c
+}
+
+func (c UsartConfig) WithDataBits(d DataBits) UsartConfig {
+	c.DataBits = d
+	return c
+}
+
+// Checks the configuration is supported by the SAM3U USART.
+func (c UsartConfig) Validate() error {
+	if err := c.BaudRate.Validate(); err != nil {
+		return err
+	}
+	if c.StopBits > StopBitsTwo {
+		return fmt.Errorf("Invalid stop bits %d", c.StopBits)
+	}
+	if c.Parity > ParitySpace {
+		return fmt.Errorf("Invalid parity %d", c.Parity)
+	}
+	if c.DataBits < DataBitsFive || c.DataBits > DataBitsNine {
+		return fmt.Errorf("Invalid data bits %d", c.DataBits)
+	}
+	return nil
+}
+
+// Formats the configuration as e.g. "115200 8N1".
+func (c UsartConfig) String() string {
+	parity := "?"
+	if int(c.Parity) < len("NOEMS") {
+		parity = "NOEMS"[c.Parity : c.Parity+1]
+	}
+	stop := "?"
+	switch c.StopBits {
+	case StopBitsOne:
+		stop = "1"
+	case StopBitsOneAndHalf:
+		stop = "1.5"
+	case StopBitsTwo:
+		stop = "2"
+	}
+	return fmt.Sprintf("%d %d%s%s", c.BaudRate, c.DataBits, parity, stop)
+}
+
 var defaultTimeout = 750 * time.Millisecond
 
+// Safe for concurrent use, e.g. reading the target output in one goroutine
+// while writing to it in another, and alongside the Adc. Reads and writes are
+// each serialized, and don't wait for each other.
 type Usart struct {
-	dev     UsbDeviceInterface
-	conf    UsartConfig
-	timeout time.Duration
+	dev UsbDeviceInterface
+	// NAEUSB USART number, see usartAux.
+	num  uint8
+	conf UsartConfig
+	flow FlowControl
+	// Serialize reads and flushes, and writes and configuration.
+	rmu, wmu sync.Mutex
+	// Guards the timeouts, deadlines, readFull, latency and lastWrite.
+	mu sync.Mutex
+	// Timeout of each read without a read deadline.
+	timeout                     time.Duration
+	readDeadline, writeDeadline time.Time
+	readFull                    bool
+	// Optional transfer latency histograms.
+	latency *LatencyStats
+	// End of the last write, until a read returns data. Zero otherwise.
+	lastWrite time.Time
 }
 
+func (u *Usart) controlIn(request Request, val uint16, data interface{}) error {
+	start := time.Now()
+	err := u.dev.ControlIn(request, val, data)
+	u.LatencyStats().Since(LatencyControl, start)
+	return err
+}
+
+func (u *Usart) controlOut(request Request, val uint16, data interface{}) error {
+	start := time.Now()
+	err := u.dev.ControlOut(request, val, data)
+	u.LatencyStats().Since(LatencyControl, start)
+	return err
+}
+
+// The USART number selects the USART in the high byte of the request value.
 func (u *Usart) configRead(cmd command, data interface{}) error {
-	glog.V(1).Infof("[usart-config-read]: cmd = %v", cmd)
-	return u.dev.ControlIn(ReqUsart0Config, uint16(cmd), data)
+	glog.V(1).Infof("[usart%d-config-read]: cmd = %v", u.num, cmd)
+	return u.controlIn(ReqUsart0Config, uint16(u.num)<<8|uint16(cmd), data)
 }
 
 func (u *Usart) configWrite(cmd command, data interface{}) error {
-	glog.V(1).Infof("[usart-config-write]: cmd = %v", cmd)
-	return u.dev.ControlOut(ReqUsart0Config, uint16(cmd), data)
+	glog.V(1).Infof("[usart%d-config-write]: cmd = %v", u.num, cmd)
+	return u.controlOut(ReqUsart0Config, uint16(u.num)<<8|uint16(cmd), data)
 }
 
 // Returns the number of bytes waiting to be read.
@@ -120,78 +293,204 @@ func (u *Usart) inWaiting() (int, error) {
 }
 
 func (u *Usart) dataRead(data []byte) error {
-	glog.V(1).Infof("[usart-data-read]: len = %v", len(data))
-	return u.dev.ControlIn(ReqUsart0Data, 0, data)
+	glog.V(1).Infof("[usart%d-data-read]: len = %v", u.num, len(data))
+	return u.controlIn(ReqUsart0Data, uint16(u.num)<<8, data)
 }
 
 func (u *Usart) dataWrite(data []byte) error {
-	glog.V(1).Infof("[usart-data-write]: data =\n%s", hex.Dump(data))
-	return u.dev.ControlOut(ReqUsart0Data, 0, data)
+	glog.V(1).Infof("[usart%d-data-write]: data =\n%s", u.num, hex.Dump(data))
+	return u.controlOut(ReqUsart0Data, uint16(u.num)<<8, data)
 }
 
+// Configures and enables the USART. A nil conf uses DefaultUsartConfig.
 func NewUsart(dev UsbDeviceInterface, conf *UsartConfig) (*Usart, error) {
+	return newUsart(dev, 0, conf)
+}
+
+// Configures and enables the auxiliary USART of the NAEUSB firmware. The
+// target IO pins don't reach it, see StartDebugOutput. A nil conf uses
+// DefaultUsartConfig.
+func NewAuxUsart(dev UsbDeviceInterface, conf *UsartConfig) (*Usart, error) {
+	return newUsart(dev, usartAux, conf)
+}
+
+func newUsart(dev UsbDeviceInterface, num uint8, conf *UsartConfig) (*Usart, error) {
 	var err error
-	u := &Usart{dev, defaultProperties, defaultTimeout}
+	u := &Usart{dev: dev, num: num, conf: defaultProperties, timeout: defaultTimeout}
 	if conf != nil {
 		u.conf = *conf
 	}
-	glog.Infof("USART configution: %v", u.conf)
-	if err = u.configWrite(cmdInit, u.conf); err != nil {
-		return nil, fmt.Errorf("cmdInit failed: %v", err)
+	if err = u.conf.Validate(); err != nil {
+		return nil, err
 	}
-	if err = u.configWrite(cmdEnable, []byte{}); err != nil {
-		return nil, fmt.Errorf("cmdEnable failed: %v", err)
+	glog.Infof("USART%d configution: %v", u.num, u.conf)
+	if err = u.Reinit(); err != nil {
+		return nil, err
 	}
-	glog.V(1).Infof("USART initialized successfully")
 	return u, nil
 }
 
+// Returns the USART configuration.
+func (u *Usart) Config() UsartConfig {
+	u.wmu.Lock()
+	defer u.wmu.Unlock()
+	return u.conf
+}
+
+// Validates and applies a new configuration, e.g. once a bootloader switched
+// the target to a higher baud rate. Pending data may be garbled.
+func (u *Usart) SetConfig(conf UsartConfig) error {
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+	u.wmu.Lock()
+	defer u.wmu.Unlock()
+	glog.Infof("USART configution: %v", conf)
+	u.conf = conf
+	return u.configure()
+}
+
+// Configures and enables the USART again, e.g. after the device reconnected.
+func (u *Usart) Reinit() error {
+	u.wmu.Lock()
+	defer u.wmu.Unlock()
+	return u.configure()
+}
+
+// Configures and enables the USART. Called with wmu held.
+func (u *Usart) configure() error {
+	if err := u.configWrite(cmdInit, u.conf); err != nil {
+		return fmt.Errorf("cmdInit failed: %v", err)
+	}
+	// Firmware without flow control works as before with it disabled.
+	if u.flow != FlowControlNone {
+		if err := u.configWrite(cmdFlowControl, uint8(u.flow)); err != nil {
+			return fmt.Errorf("cmdFlowControl failed: %v", err)
+		}
+	}
+	if err := u.configWrite(cmdEnable, []byte{}); err != nil {
+		return fmt.Errorf("cmdEnable failed: %v", err)
+	}
+	glog.V(1).Infof("USART initialized successfully")
+	return nil
+}
+
+// Returns the flow control of the USART.
+func (u *Usart) FlowControl() FlowControl {
+	u.wmu.Lock()
+	defer u.wmu.Unlock()
+	return u.flow
+}
+
+// Enables or disables hardware flow control, e.g. for targets stalling
+// without it. Kept when the USART is configured again, see Reinit.
+func (u *Usart) SetFlowControl(flow FlowControl) error {
+	if flow > FlowControlRtsCts {
+		return fmt.Errorf("Invalid flow control %d", flow)
+	}
+	u.wmu.Lock()
+	defer u.wmu.Unlock()
+	if err := u.configWrite(cmdFlowControl, uint8(flow)); err != nil {
+		return fmt.Errorf("cmdFlowControl failed: %v", err)
+	}
+	u.flow = flow
+	return nil
+}
+
+// Holds the target receive line low for d, at least two frames, e.g. for
+// bootloaders entered with a break condition. Writes wait for the break to
+// end.
+func (u *Usart) SendBreak(d time.Duration) error {
+	u.wmu.Lock()
+	defer u.wmu.Unlock()
+	if min := 2 * maxFrameBits * time.Second / time.Duration(u.conf.BaudRate); d < min {
+		d = min
+	}
+	if err := u.configWrite(cmdStartBreak, []byte{}); err != nil {
+		return fmt.Errorf("cmdStartBreak failed: %v", err)
+	}
+	time.Sleep(d)
+	if err := u.configWrite(cmdStopBreak, []byte{}); err != nil {
+		return fmt.Errorf("cmdStopBreak failed: %v", err)
+	}
+	return nil
+}
+
+// Reads the bytes waiting, up to len(p), as soon as there is at least one
+// (see SetReadFull to wait for len(p) bytes). Fails with an error wrapping
+// os.ErrDeadlineExceeded if none arrives before the read deadline, see
+// SetReadDeadline.
 func (u *Usart) Read(p []byte) (n int, err error) {
-	var wg sync.WaitGroup
-	timedOut := time.NewTimer(u.timeout)
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for {
-			select {
-			case <-timedOut.C:
-				return
-			default:
-				var toRead int
-				if toRead, err = u.inWaiting(); err != nil {
-					err = fmt.Errorf("inWaiting failed: %v", err)
-					return
-				}
-
-				if n+toRead > len(p) {
-					toRead = len(p) - n
-				}
-
-				if toRead == 0 {
-					time.Sleep(time.Millisecond)
-					continue
-				}
-
-				if err = u.dataRead(p[n : n+toRead]); err != nil {
-					err = fmt.Errorf("dataRead failed: %v", err)
-					return
-				}
-
-				n += toRead
-				if n == len(p) {
-					return
-				}
+	return u.ReadContext(context.Background(), p)
+}
+
+// Same as Read, returning early with the bytes read so far and the context
+// error when ctx is done.
+func (u *Usart) ReadContext(ctx context.Context, p []byte) (n int, err error) {
+	u.rmu.Lock()
+	defer u.rmu.Unlock()
+	if len(p) == 0 {
+		return 0, nil
+	}
+	start := time.Now()
+	for {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		var toRead int
+		if toRead, err = u.inWaiting(); err != nil {
+			err = fmt.Errorf("inWaiting failed: %v", err)
+			break
+		}
+		if n+toRead > len(p) {
+			toRead = len(p) - n
+		}
+		if toRead > 0 {
+			if err = u.dataRead(p[n : n+toRead]); err != nil {
+				err = fmt.Errorf("dataRead failed: %v", err)
+				break
 			}
+			n += toRead
+		}
+		u.mu.Lock()
+		full, deadline := u.readFull, u.readDeadline
+		if deadline.IsZero() {
+			deadline = start.Add(u.timeout)
+		}
+		u.mu.Unlock()
+		if n == len(p) || (n > 0 && !full) {
+			break
 		}
-	}()
-	wg.Wait()
+		if !time.Now().Before(deadline) {
+			err = fmt.Errorf("USART read timed out after %d of %d bytes: %w", n, len(p), os.ErrDeadlineExceeded)
+			break
+		}
+		if toRead == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	u.mu.Lock()
+	if n > 0 && !u.lastWrite.IsZero() {
+		u.latency.Since(LatencySerialRoundTrip, u.lastWrite)
+		u.lastWrite = time.Time{}
+	}
+	u.mu.Unlock()
 	return n, err
 }
 
+// Writes p in chunks. Fails with an error wrapping os.ErrDeadlineExceeded if
+// the write deadline passes before the last chunk, see SetWriteDeadline.
 func (u *Usart) Write(p []byte) (n int, err error) {
+	u.wmu.Lock()
+	defer u.wmu.Unlock()
 	// Write memory in small chunks.
 	for n < len(p) {
+		u.mu.Lock()
+		deadline := u.writeDeadline
+		u.mu.Unlock()
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return n, fmt.Errorf("USART write timed out after %d of %d bytes: %w", n, len(p), os.ErrDeadlineExceeded)
+		}
 		toWrite := len(p) - n
 		if toWrite > 58 {
 			toWrite = 58
@@ -201,10 +500,15 @@ func (u *Usart) Write(p []byte) (n int, err error) {
 		}
 		n += toWrite
 	}
+	u.mu.Lock()
+	u.lastWrite = time.Now()
+	u.mu.Unlock()
 	return n, nil
 }
 
 func (u *Usart) Flush() (err error) {
+	u.rmu.Lock()
+	defer u.rmu.Unlock()
 	var toRead int
 	for true {
 		if toRead, err = u.inWaiting(); err != nil {
@@ -222,9 +526,59 @@ func (u *Usart) Flush() (err error) {
 }
 
 func (u *Usart) Timeout() time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 	return u.timeout
 }
 
 func (u *Usart) SetTimeout(timeout time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 	u.timeout = timeout
 }
+
+// Sets the deadline of the reads, including pending ones, as with
+// net.Conn.SetReadDeadline. The zero time restores the per-read timeout, see
+// SetTimeout.
+func (u *Usart) SetReadDeadline(t time.Time) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.readDeadline = t
+	return nil
+}
+
+// Sets the deadline of the writes. The zero time means no deadline.
+func (u *Usart) SetWriteDeadline(t time.Time) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.writeDeadline = t
+	return nil
+}
+
+// Sets both the read and write deadlines.
+func (u *Usart) SetDeadline(t time.Time) error {
+	u.SetReadDeadline(t)
+	return u.SetWriteDeadline(t)
+}
+
+// If full, reads wait for the whole buffer, as io.ReadFull, and a timeout
+// returns the bytes read so far with the error.
+func (u *Usart) SetReadFull(full bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.readFull = full
+}
+
+// Records the latency of each transfer and serial round trip in s. nil stops
+// recording.
+func (u *Usart) SetLatencyStats(s *LatencyStats) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.latency = s
+}
+
+func (u *Usart) LatencyStats() *LatencyStats {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.latency
+}
@@ -0,0 +1,215 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/gocw"
+	"github.com/google/gocw/mocks"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestBaudRateValidate(t *testing.T) {
+	for _, tc := range []struct {
+		baud  gocw.BaudRate
+		valid bool
+	}{
+		{9600, true},
+		{gocw.BaudRateLow, true},
+		{gocw.BaudRateHigh, true},
+		{230400, true},
+		{921600, true},
+		// Oversampled 8 times.
+		{12000000, true},
+		// Divided to 4.8M.
+		{5000000, false},
+		{13000000, false},
+		// Divider overflows.
+		{50, false},
+		{0, false},
+	} {
+		if err := tc.baud.Validate(); (err == nil) != tc.valid {
+			t.Errorf("BaudRate(%d).Validate() = %v, want valid %v", tc.baud, err, tc.valid)
+		}
+	}
+	if actual, err := gocw.BaudRate(230400).Actual(); err != nil || actual != 230769 {
+		t.Errorf("BaudRate(230400).Actual() = %d, %v, want 230769", actual, err)
+	}
+}
+
+func TestUsartConfig(t *testing.T) {
+	conf := gocw.DefaultUsartConfig().WithBaudRate(9600).WithParity(gocw.ParityEven).WithStopBits(gocw.StopBitsTwo)
+	if s := conf.String(); s != "9600 8E2" {
+		t.Errorf("String() = %q, want 9600 8E2", s)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Error(err)
+	}
+	if s := gocw.DefaultUsartConfig().String(); s != "38400 8N1" {
+		t.Errorf("DefaultUsartConfig().String() = %q, want 38400 8N1", s)
+	}
+	for _, bad := range []gocw.UsartConfig{
+		{},
+		gocw.DefaultUsartConfig().WithDataBits(4),
+		gocw.DefaultUsartConfig().WithParity(5),
+		gocw.DefaultUsartConfig().WithStopBits(3),
+	} {
+		if err := bad.Validate(); err == nil {
+			t.Errorf("Validate() of %v succeeded", bad)
+		}
+	}
+
+	// Invalid configurations are rejected before reaching the device.
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	dev := mocks.NewMockUsbDeviceInterface(mockCtrl)
+	bad := conf.WithBaudRate(5000000)
+	if _, err := gocw.NewUsart(dev, &bad); err == nil {
+		t.Errorf("NewUsart with %v succeeded", bad)
+	}
+	dev.EXPECT().ControlOut(gocw.ReqUsart0Config, gomock.Any(), gomock.Any()).Return(nil).Times(4)
+	u, err := gocw.NewUsart(dev, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.SetConfig(bad); err == nil {
+		t.Errorf("SetConfig(%v) succeeded", bad)
+	}
+	if err := u.SetConfig(conf); err != nil {
+		t.Fatal(err)
+	}
+	if u.Config() != conf {
+		t.Errorf("Config() = %v, want %v", u.Config(), conf)
+	}
+}
+
+func TestUsartFlowControlAndBreak(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	dev := mocks.NewMockUsbDeviceInterface(mockCtrl)
+	// cmdInit and cmdEnable.
+	dev.EXPECT().ControlOut(gocw.ReqUsart0Config, uint16(0x10), gomock.Any()).Return(nil).Times(2)
+	dev.EXPECT().ControlOut(gocw.ReqUsart0Config, uint16(0x11), gomock.Any()).Return(nil).Times(2)
+	u, err := gocw.NewUsart(dev, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev.EXPECT().ControlOut(gocw.ReqUsart0Config, uint16(0x15), uint8(gocw.FlowControlRtsCts)).Return(nil).Times(2)
+	if err := u.SetFlowControl(gocw.FlowControlRtsCts); err != nil {
+		t.Fatal(err)
+	}
+	if u.FlowControl() != gocw.FlowControlRtsCts {
+		t.Errorf("FlowControl() = %v, want RTS/CTS", u.FlowControl())
+	}
+	// Configuring the USART again keeps flow control.
+	if err := u.Reinit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.SetFlowControl(2); err == nil {
+		t.Errorf("SetFlowControl(2) succeeded")
+	}
+
+	start := time.Now()
+	gomock.InOrder(
+		dev.EXPECT().ControlOut(gocw.ReqUsart0Config, uint16(0x16), gomock.Any()).Return(nil),
+		dev.EXPECT().ControlOut(gocw.ReqUsart0Config, uint16(0x17), gomock.Any()).Return(nil),
+	)
+	// Extended to two frames at 38400 baud.
+	if err := u.SendBreak(0); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 2*12*time.Second/38400 {
+		t.Errorf("Break lasted %v", d)
+	}
+}
+
+func TestAuxUsart(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	dev := mocks.NewMockUsbDeviceInterface(mockCtrl)
+	// The USART number is the high byte of the request value.
+	dev.EXPECT().ControlOut(gocw.ReqUsart0Config, uint16(0x110), gomock.Any()).Return(nil)
+	dev.EXPECT().ControlOut(gocw.ReqUsart0Config, uint16(0x111), gomock.Any()).Return(nil)
+	u, err := gocw.NewAuxUsart(dev, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev.EXPECT().ControlIn(gocw.ReqUsart0Config, uint16(0x114), gomock.Any()).SetArg(2, uint32(3)).Return(nil)
+	dev.EXPECT().ControlIn(gocw.ReqUsart0Data, uint16(0x100), gomock.Any()).SetArg(2, []byte("dbg")).Return(nil)
+	buf := make([]byte, 3)
+	if n, err := u.Read(buf); err != nil || string(buf[:n]) != "dbg" {
+		t.Errorf("Read() = %q, %v, want \"dbg\"", buf[:n], err)
+	}
+}
+
+func TestUsartDeadlines(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	dev := mocks.NewMockUsbDeviceInterface(mockCtrl)
+	dev.EXPECT().ControlOut(gocw.ReqUsart0Config, gomock.Any(), gomock.Any()).Return(nil).Times(2)
+	u, err := gocw.NewUsart(dev, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.SetTimeout(10 * time.Millisecond)
+	waiting := func(n uint32) *gomock.Call {
+		return dev.EXPECT().ControlIn(gocw.ReqUsart0Config, uint16(0x14), gomock.Any()).SetArg(2, n).Return(nil)
+	}
+
+	// Returns the bytes waiting, without waiting for the whole buffer.
+	gomock.InOrder(
+		waiting(2),
+		dev.EXPECT().ControlIn(gocw.ReqUsart0Data, uint16(0), gomock.Any()).SetArg(2, []byte("ab")).Return(nil),
+	)
+	buf := make([]byte, 4)
+	if n, err := u.Read(buf); n != 2 || err != nil {
+		t.Errorf("Read() = %d, %v, want 2 bytes", n, err)
+	}
+
+	// Waits for the whole buffer, returning the partial read on timeout.
+	u.SetReadFull(true)
+	gomock.InOrder(
+		waiting(3),
+		dev.EXPECT().ControlIn(gocw.ReqUsart0Data, uint16(0), gomock.Any()).SetArg(2, []byte("abc")).Return(nil),
+		waiting(0).MinTimes(1),
+	)
+	if n, err := u.Read(buf); n != 3 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read() = %d, %v, want 3 bytes and a timeout", n, err)
+	}
+	u.SetReadFull(false)
+
+	// Times out without data.
+	if n, err := u.Read(buf); n != 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read() = %d, %v, want a timeout", n, err)
+	}
+	u.SetReadDeadline(time.Now().Add(-time.Second))
+	if _, err := u.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read() past the deadline = %v, want a timeout", err)
+	}
+	u.SetReadDeadline(time.Time{})
+
+	// Fails before writing anything past the deadline.
+	u.SetWriteDeadline(time.Now().Add(-time.Second))
+	if n, err := u.Write([]byte("k00\n")); n != 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Write() = %d, %v, want a timeout", n, err)
+	}
+}
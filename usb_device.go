@@ -14,44 +14,68 @@
 
 // Provides low-level interface for ChipWhisperer USB device.
 // Based on chipwhisperer/software/chipwhisperer/hardware/naeusb/naeusb.py.
-// Implementation is hard-coded for ChipWhisperer-Lite hardware.
+// Supports the ChipWhisperer-Lite and the ChipWhisperer-Pro (CW1200), which
+// share the NAEUSB protocol and differ by USB PID, firmware and bitstream.
+// The CW305 target board speaks NAEUSB too, see the cw305 package.
 package gocw
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/golang/glog"
 	"github.com/google/gousb"
 )
 
-const (
-	cwliteVid   = 0x2b3e
-	cwlitePid   = 0xace2
-	cwliteInEp  = 1
-	cwliteOutEp = 2
+// A supported device, see DeviceSpec.
+type DeviceModel int
 
-	cwliteMjVersion = 0
-	cwliteMnVersion = 11
+const (
+	DeviceModelCwLite DeviceModel = iota
+	// ChipWhisperer-Pro.
+	DeviceModelCw1200 DeviceModel = iota
+	// CW305 Artix FPGA target board. Not a capture device, so never
+	// discovered by OpenUsbDevice.
+	DeviceModelCw305 DeviceModel = iota
 )
 
 //go:generate stringer -type Request
 type Request uint8
 
+// NAEUSB firmware requests. Those gocw doesn't wrap can be sent with
+// VendorRequest.
 const (
 	ReqMemReadBulk  Request = 0x10
 	ReqMemWriteBulk Request = 0x11
 	ReqMemReadCtrl  Request = 0x12
 	ReqMemWriteCtrl Request = 0x13
+	// Streams memory reads over the bulk endpoint.
+	ReqMemStream    Request = 0x14
 	ReqFpgaStatus   Request = 0x15
 	ReqFpgaProgram  Request = 0x16
 	ReqFwVersion    Request = 0x17
 	ReqUsart0Data   Request = 0x1a
 	ReqUsart0Config Request = 0x1b
 	ReqXmegaProgram Request = 0x20
+	// AVR ISP programmer (ATmega targets).
+	ReqAvrProgram Request = 0x21
+	// SAM3U configuration, e.g. erasing the firmware to enter the bootloader.
+	ReqSam3uConfig Request = 0x22
+	// I2C bridge to the CDCE906 PLL of the CW305.
+	ReqCdce906 Request = 0x30
+	// Enables or disables the USB CDC serial port settings.
+	ReqCdcSettings Request = 0x31
+	// Reads the firmware build date, as a string.
+	ReqFwBuildDate Request = 0x40
+	// Sets the LED behavior.
+	ReqLedSettings Request = 0x41
 )
 
 const (
@@ -70,135 +94,416 @@ type UsbDeviceInterface interface {
 	ControlOut(request Request, val uint16, data interface{}) error
 }
 
+// Implemented by devices whose bulk transfers can be cancelled, see
+// UsbDevice.ReadContext.
+type contextReadWriter interface {
+	ReadContext(ctx context.Context, p []byte) (int, error)
+	WriteContext(ctx context.Context, p []byte) (int, error)
+}
+
+// Reads from the bulk endpoint of dev, returning early when ctx is done if
+// the device supports it.
+func readContext(ctx context.Context, dev io.Reader, p []byte) (int, error) {
+	if d, ok := dev.(contextReadWriter); ok {
+		return d.ReadContext(ctx, p)
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return dev.Read(p)
+}
+
+// Implemented by devices that know their model. Others are assumed to be
+// a ChipWhisperer-Lite.
+type modeler interface {
+	Model() DeviceModel
+}
+
+func modelOf(dev interface{}) DeviceModel {
+	if d, ok := dev.(modeler); ok {
+		return d.Model()
+	}
+	return DeviceModelCwLite
+}
+
 // Encapsulates CW USB resources.
+// A UsbDevice is safe for concurrent use: control transfers are serialized,
+// and users issuing sequences of transfers that must not interleave with
+// other goroutines, like Memory, hold the device Lock around them.
 type UsbDevice struct {
-	ctx *gousb.Context
-	// dev also implements the control endpoint.
-	dev       *gousb.Device
-	intf      *gousb.Interface
-	intf_done func()
-	// Bulk output/input data endpoints.
-	ep_out *gousb.OutEndpoint
-	ep_in  *gousb.InEndpoint
+	// Guards t, replaced by Reconnect and Close, and cfg.
+	tmu sync.RWMutex
+	t   UsbTransport
+	// Serializes control transfers, see control.
+	ctrl sync.Mutex
+	// See Lock.
+	seq   sync.Mutex
+	model DeviceModel
+	// Transport spec and serial number the device was opened with, to
+	// re-open it, see Reconnect.
+	spec   string
+	serial string
+	cfg    UsbConfig
 }
 
+// Opens the device using the transport selected by the GOCW_TRANSPORT
+// environment variable (gousb by default).
 func OpenCwLiteUsbDevice() (*UsbDevice, error) {
-	d := &UsbDevice{}
-	d.ctx = gousb.NewContext()
+	return OpenCwLiteUsbDeviceTransport(transportSpec())
+}
 
-	var err error
-	d.dev, err = d.ctx.OpenDeviceWithVIDPID(cwliteVid, cwlitePid)
-	if d.dev == nil && err == nil {
-		return nil, fmt.Errorf("CWLite device not found")
+// Opens the raw transport of the device given a spec, see OpenTransport.
+func OpenCwLiteTransport(spec string) (UsbTransport, error) {
+	return OpenModelTransport(spec, DeviceModelCwLite)
+}
+
+// Opens the device using the given transport spec, see OpenTransport.
+func OpenCwLiteUsbDeviceTransport(spec string) (*UsbDevice, error) {
+	return OpenModelUsbDevice(spec, DeviceModelCwLite)
+}
+
+// Opens the raw transport of a device model given a spec, see OpenTransport.
+func OpenModelTransport(spec string, model DeviceModel) (UsbTransport, error) {
+	info, ok := LookupDeviceModel(model)
+	if !ok {
+		return nil, fmt.Errorf("Unknown device model %v", model)
 	}
+	return OpenTransport(spec, info.Vid, info.Pid, info.InEp, info.OutEp)
+}
 
+// Opens a device model using the given transport spec, see OpenTransport.
+func OpenModelUsbDevice(spec string, model DeviceModel) (*UsbDevice, error) {
+	t, err := OpenModelTransport(spec, model)
 	if err != nil {
-		d.Close()
-		return nil, fmt.Errorf("Opening CWLITE device: %v", err)
+		return nil, err
 	}
+	return newUsbDevice(t, spec, model)
+}
+
+// Opens the first connected ChipWhisperer, trying each supported model,
+// using the transport selected by the GOCW_TRANSPORT environment variable.
+func OpenUsbDevice() (*UsbDevice, error) {
+	return OpenUsbDeviceTransport(transportSpec())
+}
 
-	// The default interface is always #0 alt #0 in the currently active
-	// config.
-	d.intf, d.intf_done, err = d.dev.DefaultInterface()
+// Opens the first connected ChipWhisperer using the given transport spec.
+func OpenUsbDeviceTransport(spec string) (*UsbDevice, error) {
+	t, model, err := OpenUsbTransport(spec)
 	if err != nil {
-		d.Close()
-		return nil, fmt.Errorf("Claming default interface: %v", err)
+		return nil, err
 	}
+	return newUsbDevice(t, spec, model)
+}
 
-	d.ep_out, err = d.intf.OutEndpoint(cwliteOutEp)
-	if err != nil {
+// Opens the raw transport of the first connected ChipWhisperer given a spec,
+// trying each supported model in order. Transports which don't select the
+// device by USB ids, e.g. tcp, open the first model, and the firmware version
+// tells the model of the device behind them.
+func OpenUsbTransport(spec string) (UsbTransport, DeviceModel, error) {
+	var errs []string
+	for _, model := range discoveryModels() {
+		t, err := OpenModelTransport(spec, model)
+		if _, ok := t.(anyModelTransport); err == nil && ok {
+			if model, err = detectModel(t); err != nil {
+				t.Close()
+				return nil, 0, err
+			}
+		}
+		if err == nil {
+			glog.V(1).Infof("Opened %v", model)
+			return t, model, nil
+		}
+		errs = append(errs, fmt.Sprintf("%v: %v", model, err))
+	}
+	return nil, 0, fmt.Errorf("No ChipWhisperer found (%s)", strings.Join(errs, "; "))
+}
+
+// Implemented by transports reaching the same device whatever USB ids they
+// are opened with, e.g. the tcp tunnel.
+type anyModelTransport interface {
+	reachesAnyModel()
+}
+
+// Returns the first discovered model supporting the firmware of the device
+// behind t.
+func detectModel(t UsbTransport) (DeviceModel, error) {
+	buf := make([]byte, 3)
+	if _, err := t.Control(rTypeControlIn, uint8(ReqFwVersion), 0, 0, buf); err != nil {
+		return 0, fmt.Errorf("Failed reading FW version: %v", err)
+	}
+	ver := FwVersion{Major: buf[0], Minor: buf[1], Debug: buf[2]}
+	for _, model := range discoveryModels() {
+		if deviceSpec(model).supportsFw(ver) {
+			glog.V(1).Infof("FW version %v is a %v", ver, model)
+			return model, nil
+		}
+	}
+	return 0, fmt.Errorf("No ChipWhisperer model supports FW version %v", ver)
+}
+
+// Lists the connected ChipWhisperers and CW305 boards through libusb, sorted
+// by serial number.
+func ListDevices() ([]DeviceInfo, error) {
+	ctx := gousb.NewContext()
+	defer ctx.Close()
+	type usbIds struct{ vid, pid uint16 }
+	models := make(map[usbIds]DeviceModel)
+	pids := make(map[uint16][]uint16)
+	for _, model := range DeviceModels() {
+		info := deviceSpec(model)
+		models[usbIds{info.Vid, info.Pid}] = model
+		pids[info.Vid] = append(pids[info.Vid], info.Pid)
+	}
+	var devs []*gousb.Device
+	for vid := range pids {
+		vidDevs, err := openGousbDevices(ctx, vid, pids[vid])
+		if err != nil {
+			return nil, fmt.Errorf("Failed listing USB devices: %v%s", err, openHint(err))
+		}
+		devs = append(devs, vidDevs...)
+	}
+	var infos []DeviceInfo
+	var err error
+	for _, d := range devs {
+		info := DeviceInfo{
+			Model:   models[usbIds{uint16(d.Desc.Vendor), uint16(d.Desc.Product)}],
+			Bus:     d.Desc.Bus,
+			Address: d.Desc.Address,
+		}
+		if info.Serial, err = d.SerialNumber(); err != nil {
+			glog.Warningf("Failed reading serial number of device %d.%d: %v", info.Bus, info.Address, err)
+		}
+		if info.Description, err = d.Product(); err != nil {
+			glog.Warningf("Failed reading product of device %d.%d: %v", info.Bus, info.Address, err)
+		}
+		if info.Manufacturer, err = d.Manufacturer(); err != nil {
+			glog.Warningf("Failed reading manufacturer of device %d.%d: %v", info.Bus, info.Address, err)
+		}
 		d.Close()
-		return nil, fmt.Errorf("Opening output interface: %v", err)
+		infos = append(infos, info)
 	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Serial < infos[j].Serial
+	})
+	return infos, nil
+}
 
-	d.ep_in, err = d.intf.InEndpoint(cwliteInEp)
-	if err != nil {
+// Opens the ChipWhisperer with the given USB serial number through libusb,
+// see ListDevices.
+func OpenBySerial(sn string) (*UsbDevice, error) {
+	return OpenUsbDeviceTransport(DefaultTransport + ":" + sn)
+}
+
+// Wraps an open transport and checks the firmware version.
+func newUsbDevice(t UsbTransport, spec string, model DeviceModel) (*UsbDevice, error) {
+	d := &UsbDevice{t: t, model: model, spec: spec, cfg: DefaultUsbConfig()}
+	if err := d.checkFwVersion(); err != nil {
 		d.Close()
-		return nil, fmt.Errorf("Opening input interface: %v", err)
+		return nil, err
+	}
+	if s, ok := t.(serialNumberer); ok {
+		d.serial, _ = s.SerialNumber()
 	}
+	return d, nil
+}
 
+// Checks the firmware is the version supported for the model.
+func (d *UsbDevice) checkFwVersion() error {
 	ver := FwVersion{}
-	if err = d.ReadFwVersion(&ver); err != nil {
-		return nil, fmt.Errorf("Failed reading FW version: %v", err)
+	if err := d.ReadFwVersion(&ver); err != nil {
+		return fmt.Errorf("Failed reading FW version: %v", err)
 	}
 
-	if ver.Major != cwliteMjVersion || ver.Minor != cwliteMnVersion {
-		return nil, fmt.Errorf("Unexpected FW version: %v", ver)
+	glog.V(1).Infof("%v FW version: %v", d.model, ver)
+	if !deviceSpec(d.model).supportsFw(ver) {
+		return fmt.Errorf("Unexpected FW version: %v", ver)
 	}
-	return d, err
+	return nil
+}
+
+func (d *UsbDevice) Model() DeviceModel {
+	return d.model
+}
+
+func (d *UsbDevice) transport() UsbTransport {
+	d.tmu.RLock()
+	defer d.tmu.RUnlock()
+	return d.t
+}
+
+// Replaces the transport, and returns the previous one.
+func (d *UsbDevice) setTransport(t UsbTransport) UsbTransport {
+	d.tmu.Lock()
+	defer d.tmu.Unlock()
+	old := d.t
+	d.t = t
+	return old
+}
+
+// Locks the device for a sequence of transfers, e.g. the address block and
+// data of a memory read, so other sequences don't interleave. Memory locks
+// the device around each of its operations, and callers only need it for
+// their own sequences of raw memory transfers. Not reentrant.
+func (d *UsbDevice) Lock() {
+	d.seq.Lock()
+}
+
+func (d *UsbDevice) Unlock() {
+	d.seq.Unlock()
+}
+
+// Locks dev for a sequence of transfers if it supports it, see
+// UsbDevice.Lock, and returns the function unlocking it.
+func lockDevice(dev interface{}) func() {
+	if l, ok := dev.(sync.Locker); ok {
+		l.Lock()
+		return l.Unlock
+	}
+	return func() {}
 }
 
 func (d *UsbDevice) Close() error {
 	glog.V(1).Infof("Closing USB device")
-	if d.intf_done != nil {
-		d.intf_done()
-		d.intf_done = nil
+	t := d.setTransport(nil)
+	if t == nil {
+		return nil
 	}
-	if d.intf != nil {
-		d.intf.Close()
-		d.intf = nil
-	}
-	if d.dev != nil {
-		d.dev.Close()
-		d.dev = nil
+	return t.Close()
+}
+
+// Returns the bulk input endpoint max packet size, or 0 if unknown.
+func (d *UsbDevice) MaxPacketSize() int {
+	if t, ok := d.transport().(maxPacketSizer); ok {
+		return t.MaxPacketSize()
 	}
-	if d.ctx != nil {
-		d.ctx.Close()
-		d.ctx = nil
+	return 0
+}
+
+// Returns the USB serial number of the device.
+func (d *UsbDevice) SerialNumber() (string, error) {
+	if t, ok := d.transport().(serialNumberer); ok {
+		return t.SerialNumber()
 	}
-	return nil
+	return "", fmt.Errorf("Transport does not report serial numbers")
 }
 
 func (d *UsbDevice) Read(p []byte) (n int, err error) {
-	n, err = d.ep_in.Read(p)
-	glog.V(2).Infof("[usb-bulk IN]: read %d bytes. data:[:32]\n%s", n, hex.Dump(p[:32]))
-	return n, err
+	return d.ReadContext(context.Background(), p)
 }
 
 func (d *UsbDevice) Write(buf []byte) (n int, err error) {
-	n, err = d.ep_out.Write(buf)
-	glog.V(2).Infof("[usb-bulk OUT]: wrote %d bytes. data[:32]:\n%s", n, hex.Dump(buf[:32]))
+	return d.WriteContext(context.Background(), buf)
+}
+
+// Same as Read, returning early when ctx is done. Transports that can't
+// cancel transfers only check ctx before reading.
+func (d *UsbDevice) ReadContext(ctx context.Context, p []byte) (n int, err error) {
+	if err = ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err = d.transfer(ctx, "bulk IN", 0, true, d.UsbConfig().BulkTimeout, func(ctx context.Context) (int, error) {
+		t := d.transport()
+		if bt, ok := t.(bulkContexter); ok {
+			return bt.ReadBulkContext(ctx, p)
+		}
+		return t.ReadBulk(p)
+	})
+	if glog.V(2) {
+		glog.Infof("[usb-bulk IN]: read %d bytes. data:[:32]\n%s", n, hex.Dump(p[:32]))
+	}
+	return n, err
+}
+
+// Same as Write, returning early when ctx is done. Transports that can't
+// cancel transfers only check ctx before writing.
+func (d *UsbDevice) WriteContext(ctx context.Context, buf []byte) (n int, err error) {
+	if err = ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err = d.transfer(ctx, "bulk OUT", 0, false, d.UsbConfig().BulkTimeout, func(ctx context.Context) (int, error) {
+		t := d.transport()
+		if bt, ok := t.(bulkContexter); ok {
+			return bt.WriteBulkContext(ctx, buf)
+		}
+		return t.WriteBulk(buf)
+	})
+	if glog.V(2) {
+		glog.Infof("[usb-bulk OUT]: wrote %d bytes. data[:32]:\n%s", n, hex.Dump(buf[:32]))
+	}
 	return n, err
 }
 
 func (d *UsbDevice) ControlIn(request Request, val uint16, data interface{}) error {
-	if binary.Size(data) == -1 {
+	return d.ControlInContext(context.Background(), request, val, data)
+}
+
+func (d *UsbDevice) ControlOut(request Request, val uint16, data interface{}) error {
+	return d.ControlOutContext(context.Background(), request, val, data)
+}
+
+// Same as ControlIn, failing when ctx is done. The deadline of ctx bounds
+// the transfer and its retries, see UsbConfig.
+func (d *UsbDevice) ControlInContext(ctx context.Context, request Request, val uint16, data interface{}) error {
+	size := binary.Size(data)
+	if size == -1 {
 		return fmt.Errorf("Failed to get data size")
 	}
-	// TODO: read directly to data if it's already a slice of bytes.
-	buf := make([]byte, binary.Size(data))
-	n, err := d.dev.Control(rTypeControlIn, uint8(request), val, 0, buf)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// Byte slices need no decoding, and are read in place.
+	buf, isBytes := data.([]byte)
+	if !isBytes {
+		buf = make([]byte, size)
+	}
+	n, err := d.transfer(ctx, "control IN", request, true, d.UsbConfig().ControlTimeout, func(ctx context.Context) (int, error) {
+		return d.control(ctx, rTypeControlIn, request, val, buf)
+	})
 	if err != nil {
-		return fmt.Errorf("dev.Control failed %v", err)
+		return err
 	}
 	if n != len(buf) {
 		return fmt.Errorf("Failed to read entire buffer %v vs %v", n, len(buf))
 	}
-	r := bytes.NewReader(buf)
-	if err := binary.Read(r, binary.LittleEndian, data); err != nil {
-		return fmt.Errorf("binary.Read failed: %v", err)
+	if !isBytes {
+		r := bytes.NewReader(buf)
+		if err := binary.Read(r, binary.LittleEndian, data); err != nil {
+			return fmt.Errorf("binary.Read failed: %v", err)
+		}
+	}
+	if glog.V(2) {
+		glog.Infof("[usb-ctrl IN]: request = %v, val = %x, data =\n%s", request, val, hex.Dump(buf))
 	}
-	glog.V(2).Infof("[usb-ctrl IN]: request = %v, val = %x, data =\n%s",
-		request, val, hex.Dump(buf))
 	return nil
 }
 
-func (d *UsbDevice) ControlOut(request Request, val uint16, data interface{}) error {
-	var err error
-	buf := new(bytes.Buffer)
-	if err = binary.Write(buf, binary.LittleEndian, data); err != nil {
-		return fmt.Errorf("binary.Write failed: %v", err)
+// Same as ControlOut, failing when ctx is done. The deadline of ctx bounds
+// the transfer and its retries, see UsbConfig.
+func (d *UsbDevice) ControlOutContext(ctx context.Context, request Request, val uint16, data interface{}) error {
+	// Byte slices need no encoding, and are sent as is.
+	buf, ok := data.([]byte)
+	if !ok {
+		w := new(bytes.Buffer)
+		if err := binary.Write(w, binary.LittleEndian, data); err != nil {
+			return fmt.Errorf("binary.Write failed: %v", err)
+		}
+		buf = w.Bytes()
 	}
-	// TODO: write directly from data if it's already a slice of bytes.
-	n, err := d.dev.Control(rTypeControlOut, uint8(request), val, 0, buf.Bytes())
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	n, err := d.transfer(ctx, "control OUT", request, idempotentRequests[request], d.UsbConfig().ControlTimeout, func(ctx context.Context) (int, error) {
+		return d.control(ctx, rTypeControlOut, request, val, buf)
+	})
 	if err != nil {
-		return fmt.Errorf("dev.Control failed %v", err)
+		return err
+	}
+	if n != len(buf) {
+		return fmt.Errorf("Failed to write entire buffer %v vs %v", n, len(buf))
 	}
-	if n != buf.Len() {
-		return fmt.Errorf("Failed to write entire buffer %v vs %v", n, buf.Len())
+	if glog.V(2) {
+		glog.Infof("[usb-ctrl OUT]: request = %v, val = %x, data =\n%s", request, val, hex.Dump(buf))
 	}
-	glog.V(2).Infof("[usb-ctrl OUT]: request = %v, val = %x, data =\n%s",
-		request, val, hex.Dump(buf.Bytes()))
 	return nil
 }
 
@@ -212,3 +517,25 @@ type FwVersion struct {
 func (d *UsbDevice) ReadFwVersion(ver *FwVersion) error {
 	return d.ControlIn(ReqFwVersion, 0, ver)
 }
+
+// Sends vendor request req with value val to dev, for firmware features gocw
+// doesn't wrap. out, if not nil, is sent first with a control OUT transfer,
+// then in, if not nil, is filled with a control IN transfer, as most NAEUSB
+// requests returning data expect. With neither, sends a control OUT transfer
+// without data, as commands like ReqSam3uConfig expect. The device stays
+// locked between both transfers, see UsbDevice.Lock.
+func VendorRequest(dev UsbDeviceInterface, req uint8, val uint16, out, in []byte) error {
+	unlock := lockDevice(dev)
+	defer unlock()
+	if out != nil || in == nil {
+		if err := dev.ControlOut(Request(req), val, out); err != nil {
+			return fmt.Errorf("Vendor request %#x OUT failed: %v", req, err)
+		}
+	}
+	if in != nil {
+		if err := dev.ControlIn(Request(req), val, in); err != nil {
+			return fmt.Errorf("Vendor request %#x IN failed: %v", req, err)
+		}
+	}
+	return nil
+}
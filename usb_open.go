@@ -0,0 +1,56 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Platform-aware handling of device open failures.
+// libusb errors are generic, so known failure modes are annotated with a hint
+// on how to fix them on the current platform (see usb_open_<os>.go).
+package gocw
+
+import (
+	"errors"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/gousb"
+)
+
+const (
+	// Number of retries when the device or interface is busy, e.g. while
+	// another process releases it or the OS driver is still probing.
+	openBusyRetries = 4
+	openBusyDelay   = 250 * time.Millisecond
+)
+
+// Retries op with exponential backoff while it fails with ErrorBusy.
+func retryBusy(what string, op func() error) error {
+	err := op()
+	for i := 0; i < openBusyRetries && errors.Is(err, gousb.ErrorBusy); i++ {
+		glog.Warningf("%s: device busy. Re-trying [%d/%d]", what, i+1, openBusyRetries)
+		time.Sleep(openBusyDelay << uint(i))
+		err = op()
+	}
+	return err
+}
+
+// Returns a platform specific suggestion for fixing err, or an empty string.
+func openHint(err error) string {
+	var usbErr gousb.Error
+	if !errors.As(err, &usbErr) {
+		return ""
+	}
+	if hint, ok := platformOpenHints[usbErr]; ok {
+		return ". " + hint
+	}
+	return ""
+}
@@ -0,0 +1,28 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw
+
+import (
+	"github.com/google/gousb"
+)
+
+// Linux lets libusb detach kernel drivers (e.g. cdc_acm) from the interface.
+const autoDetachKernelDriver = true
+
+var platformOpenHints = map[gousb.Error]string{
+	gousb.ErrorAccess: "Add a udev rule granting access to the device " +
+		`(SUBSYSTEM=="usb", ATTRS{idVendor}=="2b3e", MODE="0666"), or run as root`,
+	gousb.ErrorBusy: "The device is in use by another process, or a kernel driver could not be detached",
+}
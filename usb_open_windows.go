@@ -0,0 +1,31 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw
+
+import (
+	"github.com/google/gousb"
+)
+
+// Kernel driver detaching is not supported on Windows.
+const autoDetachKernelDriver = false
+
+const winUSBHint = "libusb requires the WinUSB driver on Windows. Install it for the device with Zadig (https://zadig.akeo.ie)"
+
+var platformOpenHints = map[gousb.Error]string{
+	gousb.ErrorNotSupported: winUSBHint,
+	gousb.ErrorNotFound:     winUSBHint,
+	gousb.ErrorAccess:       "Another process may have the device open, or " + winUSBHint,
+	gousb.ErrorBusy:         "The device is in use by another process",
+}
@@ -0,0 +1,175 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Timeouts and retries of USB transfers.
+// libusb transfers wait forever by default, and a stall or timeout on a
+// flaky cable fails the whole operation. UsbDevice bounds each transfer with
+// a timeout, and retries those failing with a transient error. Per-call
+// deadlines are given with a context, see UsbDevice.ControlInContext.
+package gocw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/gousb"
+)
+
+type UsbConfig struct {
+	// Timeout of each control and bulk transfer attempt. Zero waits forever.
+	// Bulk timeouts need a transport whose transfers can be cancelled, e.g.
+	// gousb.
+	ControlTimeout time.Duration
+	BulkTimeout    time.Duration
+	// Number of times a transfer failing with a transient error, a timeout or
+	// a stall (EPIPE), is retried. Only reads and control requests setting up
+	// a read are, as the device may have acted on a write whose status was
+	// lost. Transfers which moved some data aren't retried either.
+	Retries int
+	// Delay before the first retry, doubled after each retry.
+	RetryDelay time.Duration
+}
+
+func DefaultUsbConfig() UsbConfig {
+	return UsbConfig{
+		ControlTimeout: 2 * time.Second,
+		BulkTimeout:    5 * time.Second,
+		Retries:        2,
+		RetryDelay:     10 * time.Millisecond,
+	}
+}
+
+// Returned by UsbDevice transfers failing after all retries.
+type UsbTransferError struct {
+	// Transfer type, e.g. "control IN" or "bulk OUT".
+	Op string
+	// Request of control transfers.
+	Request  Request
+	Attempts int
+	Err      error
+}
+
+func (e *UsbTransferError) Error() string {
+	op := e.Op
+	if e.Request != 0 {
+		op = fmt.Sprintf("%s %v", op, e.Request)
+	}
+	if e.Attempts > 1 {
+		return fmt.Sprintf("USB %s failed after %d attempts: %v", op, e.Attempts, e.Err)
+	}
+	return fmt.Sprintf("USB %s failed: %v", op, e.Err)
+}
+
+func (e *UsbTransferError) Unwrap() error {
+	return e.Err
+}
+
+// Returns true if the transfer timed out.
+func (e *UsbTransferError) Timeout() bool {
+	return errors.Is(e.Err, context.DeadlineExceeded) || errors.Is(e.Err, gousb.ErrorTimeout) ||
+		errors.Is(e.Err, gousb.TransferTimedOut)
+}
+
+// Returns true if the device stalled the transfer.
+func (e *UsbTransferError) Stalled() bool {
+	return errors.Is(e.Err, gousb.ErrorPipe) || errors.Is(e.Err, gousb.TransferStall)
+}
+
+// Returns true if the transfer may succeed when retried.
+func (e *UsbTransferError) transient() bool {
+	return e.Timeout() || e.Stalled()
+}
+
+// Implemented by transports whose control transfers can time out.
+type controlTimeouter interface {
+	ControlTimeout(timeout time.Duration, rType, request uint8, val, idx uint16, data []byte) (int, error)
+}
+
+// Sets the timeouts and retries of the transfers, see DefaultUsbConfig.
+func (d *UsbDevice) SetUsbConfig(cfg UsbConfig) {
+	d.tmu.Lock()
+	defer d.tmu.Unlock()
+	d.cfg = cfg
+}
+
+func (d *UsbDevice) UsbConfig() UsbConfig {
+	d.tmu.RLock()
+	defer d.tmu.RUnlock()
+	return d.cfg
+}
+
+// Control OUT requests which can be repeated without side effects. They only
+// send the address block of the next read.
+var idempotentRequests = map[Request]bool{
+	ReqMemReadBulk: true,
+	ReqMemReadCtrl: true,
+}
+
+// Runs a transfer attempt until it succeeds, fails with a permanent error or
+// the retries run out. Non-retryable transfers get a single attempt. Each
+// attempt gets a context expiring after timeout, and within the deadline of
+// ctx. Returns ctx.Err() once ctx is done.
+func (d *UsbDevice) transfer(ctx context.Context, op string, request Request, retryable bool, timeout time.Duration,
+	attempt func(ctx context.Context) (int, error)) (int, error) {
+	cfg := d.UsbConfig()
+	delay := cfg.RetryDelay
+	for i := 1; ; i++ {
+		actx, cancel := ctx, context.CancelFunc(func() {})
+		if timeout > 0 {
+			actx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		n, err := attempt(actx)
+		expired := actx.Err() == context.DeadlineExceeded
+		cancel()
+		if err == nil {
+			return n, nil
+		}
+		if ctx.Err() != nil {
+			return n, ctx.Err()
+		}
+		if expired {
+			err = context.DeadlineExceeded
+		}
+		terr := &UsbTransferError{Op: op, Request: request, Attempts: i, Err: err}
+		if n > 0 || !retryable || i > cfg.Retries || !terr.transient() {
+			return n, terr
+		}
+		glog.Warningf("USB %s %v: %v. Re-trying [%d/%d]", op, request, err, i, cfg.Retries)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Performs a control transfer attempt, with the deadline of ctx if the
+// transport supports timeouts. Control transfers are serialized, as the
+// control endpoint handles one request at a time, and transports set the
+// timeout on the shared device handle.
+func (d *UsbDevice) control(ctx context.Context, rType uint8, request Request, val uint16, buf []byte) (int, error) {
+	d.ctrl.Lock()
+	defer d.ctrl.Unlock()
+	tr := d.transport()
+	t, ok := tr.(controlTimeouter)
+	deadline, hasDeadline := ctx.Deadline()
+	if !ok || !hasDeadline {
+		return tr.Control(rType, uint8(request), val, 0, buf)
+	}
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return 0, context.DeadlineExceeded
+	}
+	return t.ControlTimeout(timeout, rType, uint8(request), val, 0, buf)
+}
@@ -0,0 +1,420 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Record and replay of USB sessions.
+// UsbRecorder wraps a device and logs every control and bulk transfer, one
+// JSON entry per line. UsbReplay serves a transcript back in order, and fails
+// as soon as the caller diverges from it, so a session on real hardware
+// becomes a reproducible test of the Adc, Fpga, Usart or programmer code that
+// drove it.
+package gocw
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Transcript operations.
+const (
+	UsbOpControlIn  = "control_in"
+	UsbOpControlOut = "control_out"
+	UsbOpRead       = "read"
+	UsbOpWrite      = "write"
+	// Properties of the device, see modeler and maxPacketSizer, recorded the
+	// first time they are queried. Val holds the value.
+	UsbOpModel         = "model"
+	UsbOpMaxPacketSize = "max_packet_size"
+)
+
+type UsbTranscriptEntry struct {
+	Op      string  `json:"op"`
+	Request Request `json:"request,omitempty"`
+	Val     uint16  `json:"val,omitempty"`
+	// Hex data transferred, encoded like the device does for control
+	// transfers.
+	Data string `json:"data,omitempty"`
+	// Error returned by the device. Replayed as a plain error, whatever its
+	// type was.
+	Err string `json:"err,omitempty"`
+}
+
+func (e UsbTranscriptEntry) String() string {
+	switch e.Op {
+	case UsbOpControlIn, UsbOpControlOut:
+		return fmt.Sprintf("%s %v val=%x data=%s", e.Op, e.Request, e.Val, e.Data)
+	case UsbOpModel, UsbOpMaxPacketSize:
+		return fmt.Sprintf("%s %d", e.Op, e.Val)
+	}
+	return fmt.Sprintf("%s data=%s", e.Op, e.Data)
+}
+
+// Returns the little-endian encoding of control transfer data, as sent by
+// UsbDevice.
+func encodeControlData(data interface{}) ([]byte, error) {
+	if buf, ok := data.([]byte); ok {
+		return buf, nil
+	}
+	w := new(bytes.Buffer)
+	if err := binary.Write(w, binary.LittleEndian, data); err != nil {
+		return nil, fmt.Errorf("binary.Write failed: %v", err)
+	}
+	return w.Bytes(), nil
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// Records the transfers of a device. Implements UsbDeviceInterface.
+type UsbRecorder struct {
+	dev UsbDeviceInterface
+	mu  sync.Mutex
+	// Serializes transfer sequences when dev has no Lock, see Lock.
+	seq sync.Mutex
+	w   io.Writer
+	// Closed with the recorder, if set.
+	closer io.Closer
+	// Set once the properties are recorded.
+	model, maxPacketSize bool
+	err                  error
+}
+
+// Records the transfers of dev to w. Closing the recorder closes dev.
+func NewUsbRecorder(dev UsbDeviceInterface, w io.Writer) *UsbRecorder {
+	return &UsbRecorder{dev: dev, w: w}
+}
+
+// Records the transfers of dev to a new transcript file. Closing the recorder
+// closes dev and the file.
+func RecordUsbTranscript(dev UsbDeviceInterface, filename string) (*UsbRecorder, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating USB transcript: %v", err)
+	}
+	r := NewUsbRecorder(dev, f)
+	r.closer = f
+	return r, nil
+}
+
+func (r *UsbRecorder) record(e UsbTranscriptEntry) {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		err = fmt.Errorf("JSON encoder failed %v", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	if err == nil {
+		// A single write per line, so a crash leaves at most one partial line.
+		_, err = r.w.Write(append(buf, '\n'))
+	}
+	r.err = err
+}
+
+// Returns the first error writing the transcript. Transfers keep going to the
+// device after it.
+func (r *UsbRecorder) Error() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Locks the recorded device for a sequence of transfers, like
+// UsbDevice.Lock, so Memory keeps its sequences atomic through the recorder.
+func (r *UsbRecorder) Lock() {
+	if l, ok := r.dev.(sync.Locker); ok {
+		l.Lock()
+		return
+	}
+	r.seq.Lock()
+}
+
+func (r *UsbRecorder) Unlock() {
+	if l, ok := r.dev.(sync.Locker); ok {
+		l.Unlock()
+		return
+	}
+	r.seq.Unlock()
+}
+
+func (r *UsbRecorder) Read(p []byte) (int, error) {
+	n, err := r.dev.Read(p)
+	r.record(UsbTranscriptEntry{Op: UsbOpRead, Data: hex.EncodeToString(p[:n]), Err: errString(err)})
+	return n, err
+}
+
+func (r *UsbRecorder) Write(p []byte) (int, error) {
+	n, err := r.dev.Write(p)
+	r.record(UsbTranscriptEntry{Op: UsbOpWrite, Data: hex.EncodeToString(p[:n]), Err: errString(err)})
+	return n, err
+}
+
+func (r *UsbRecorder) ControlIn(request Request, val uint16, data interface{}) error {
+	err := r.dev.ControlIn(request, val, data)
+	e := UsbTranscriptEntry{Op: UsbOpControlIn, Request: request, Val: val, Err: errString(err)}
+	if err == nil {
+		buf, encErr := encodeControlData(data)
+		if encErr != nil {
+			return encErr
+		}
+		e.Data = hex.EncodeToString(buf)
+	}
+	r.record(e)
+	return err
+}
+
+func (r *UsbRecorder) ControlOut(request Request, val uint16, data interface{}) error {
+	buf, err := encodeControlData(data)
+	if err != nil {
+		return err
+	}
+	err = r.dev.ControlOut(request, val, data)
+	r.record(UsbTranscriptEntry{Op: UsbOpControlOut, Request: request, Val: val,
+		Data: hex.EncodeToString(buf), Err: errString(err)})
+	return err
+}
+
+func (r *UsbRecorder) Model() DeviceModel {
+	model := modelOf(r.dev)
+	r.mu.Lock()
+	recorded := r.model
+	r.model = true
+	r.mu.Unlock()
+	if !recorded {
+		r.record(UsbTranscriptEntry{Op: UsbOpModel, Val: uint16(model)})
+	}
+	return model
+}
+
+func (r *UsbRecorder) MaxPacketSize() int {
+	size := 0
+	if d, ok := r.dev.(maxPacketSizer); ok {
+		size = d.MaxPacketSize()
+	}
+	r.mu.Lock()
+	recorded := r.maxPacketSize
+	r.maxPacketSize = true
+	r.mu.Unlock()
+	if !recorded {
+		r.record(UsbTranscriptEntry{Op: UsbOpMaxPacketSize, Val: uint16(size)})
+	}
+	return size
+}
+
+func (r *UsbRecorder) Close() error {
+	err := r.dev.Close()
+	if r.closer != nil {
+		if cerr := r.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Serves the transfers of a transcript back, in order. Implements
+// UsbDeviceInterface. Any transfer that differs from the next one of the
+// transcript fails, see Done.
+type UsbReplay struct {
+	mu      sync.Mutex
+	entries []UsbTranscriptEntry
+	next    int
+	// Recorded device properties.
+	model         DeviceModel
+	maxPacketSize int
+	// Set on the first divergence, and returned by all later transfers.
+	err error
+}
+
+// Reads a transcript written by UsbRecorder. A truncated last line, left by a
+// crash, is ignored.
+func NewUsbReplay(r io.Reader) (*UsbReplay, error) {
+	replay := &UsbReplay{model: DeviceModelCwLite}
+	decoder := json.NewDecoder(r)
+	for {
+		var e UsbTranscriptEntry
+		err := decoder.Decode(&e)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return replay, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("JSON decoder failed %v", err)
+		}
+		switch e.Op {
+		case UsbOpModel:
+			replay.model = DeviceModel(e.Val)
+		case UsbOpMaxPacketSize:
+			replay.maxPacketSize = int(e.Val)
+		case UsbOpControlIn, UsbOpControlOut, UsbOpRead, UsbOpWrite:
+			replay.entries = append(replay.entries, e)
+		default:
+			return nil, fmt.Errorf("Unknown USB transcript operation %q", e.Op)
+		}
+	}
+}
+
+// Loads a transcript file written by UsbRecorder.
+func LoadUsbTranscript(filename string) (*UsbReplay, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening USB transcript: %v", err)
+	}
+	defer f.Close()
+	return NewUsbReplay(f)
+}
+
+// Returns the next entry, checking it matches the operation and, unless nil,
+// its control request and data.
+func (r *UsbReplay) expect(op string, request Request, val uint16, data []byte) (UsbTranscriptEntry, []byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return UsbTranscriptEntry{}, nil, r.err
+	}
+	got := UsbTranscriptEntry{Op: op, Request: request, Val: val, Data: hex.EncodeToString(data)}
+	if r.next == len(r.entries) {
+		r.err = fmt.Errorf("USB transcript ended, got %v", got)
+		return UsbTranscriptEntry{}, nil, r.err
+	}
+	e := r.entries[r.next]
+	mismatch := e.Op != op
+	if op == UsbOpControlIn || op == UsbOpControlOut {
+		mismatch = mismatch || e.Request != request || e.Val != val
+	}
+	if data != nil {
+		mismatch = mismatch || e.Data != got.Data
+	}
+	if mismatch {
+		r.err = fmt.Errorf("USB transcript entry %d is %v, got %v", r.next, e, got)
+		return UsbTranscriptEntry{}, nil, r.err
+	}
+	buf, err := hex.DecodeString(e.Data)
+	if err != nil {
+		r.err = fmt.Errorf("USB transcript entry %d: %v", r.next, err)
+		return UsbTranscriptEntry{}, nil, r.err
+	}
+	r.next++
+	return e, buf, nil
+}
+
+// Returns the recorded error of an entry.
+func (e UsbTranscriptEntry) err() error {
+	if len(e.Err) == 0 {
+		return nil
+	}
+	return errors.New(e.Err)
+}
+
+func (r *UsbReplay) Read(p []byte) (int, error) {
+	e, buf, err := r.expect(UsbOpRead, 0, 0, nil)
+	if err != nil {
+		return 0, err
+	}
+	if len(buf) > len(p) {
+		return 0, r.fail(fmt.Errorf("USB transcript read of %d bytes into a %d bytes buffer", len(buf), len(p)))
+	}
+	return copy(p, buf), e.err()
+}
+
+func (r *UsbReplay) Write(p []byte) (int, error) {
+	e, buf, err := r.expect(UsbOpWrite, 0, 0, nil)
+	if err != nil {
+		return 0, err
+	}
+	// Partial writes only match the bytes the device took.
+	if len(buf) > len(p) || !bytes.Equal(buf, p[:len(buf)]) {
+		return 0, r.fail(fmt.Errorf("USB transcript write of %x, got %x", buf, p))
+	}
+	return len(buf), e.err()
+}
+
+func (r *UsbReplay) ControlIn(request Request, val uint16, data interface{}) error {
+	e, buf, err := r.expect(UsbOpControlIn, request, val, nil)
+	if err != nil || len(e.Err) > 0 {
+		if err == nil {
+			err = e.err()
+		}
+		return err
+	}
+	if out, ok := data.([]byte); ok {
+		if len(out) != len(buf) {
+			return r.fail(fmt.Errorf("USB transcript control IN of %d bytes, got %d", len(buf), len(out)))
+		}
+		copy(out, buf)
+		return nil
+	}
+	if err = binary.Read(bytes.NewReader(buf), binary.LittleEndian, data); err != nil {
+		return r.fail(fmt.Errorf("binary.Read failed: %v", err))
+	}
+	return nil
+}
+
+func (r *UsbReplay) ControlOut(request Request, val uint16, data interface{}) error {
+	buf, err := encodeControlData(data)
+	if err != nil {
+		return err
+	}
+	e, _, err := r.expect(UsbOpControlOut, request, val, buf)
+	if err != nil {
+		return err
+	}
+	return e.err()
+}
+
+// Records a divergence found after matching an entry.
+func (r *UsbReplay) fail(err error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = err
+	}
+	return r.err
+}
+
+func (r *UsbReplay) Model() DeviceModel {
+	return r.model
+}
+
+func (r *UsbReplay) MaxPacketSize() int {
+	return r.maxPacketSize
+}
+
+func (r *UsbReplay) Close() error {
+	return nil
+}
+
+// Returns the first divergence from the transcript, or an error if transfers
+// of the transcript were not replayed.
+func (r *UsbReplay) Done() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	if r.next < len(r.entries) {
+		return fmt.Errorf("USB transcript has %d transfers left, next %v", len(r.entries)-r.next, r.entries[r.next])
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/gocw"
+)
+
+// Drives dev through a few memory and bulk transfers, and returns what was
+// read back.
+func transcriptSession(dev gocw.UsbDeviceInterface, value uint32) (uint32, []byte, error) {
+	m := gocw.NewMemory(dev)
+	if err := m.WriteU32(0x10, value, false); err != nil {
+		return 0, nil, err
+	}
+	reg, err := m.ReadU32(0x20)
+	if err != nil {
+		return 0, nil, err
+	}
+	if _, err = dev.Write([]byte("bulk data")); err != nil {
+		return 0, nil, err
+	}
+	buf := make([]byte, 16)
+	n, err := dev.Read(buf)
+	return reg, buf[:n], err
+}
+
+func TestUsbTranscriptReplay(t *testing.T) {
+	gocw.RegisterTransport("test_transcript", func(address string, vid, pid uint16, inEp, outEp int) (gocw.UsbTransport, error) {
+		return &loopbackTransport{}, nil
+	})
+	dev, err := gocw.OpenModelUsbDevice("test_transcript", gocw.DeviceModelCw305)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var transcript bytes.Buffer
+	rec := gocw.NewUsbRecorder(dev, &transcript)
+	if model := rec.Model(); model != gocw.DeviceModelCw305 {
+		t.Errorf("Recorder model %v, want %v", model, gocw.DeviceModelCw305)
+	}
+	reg, bulk, err := transcriptSession(rec, 0x12345678)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = rec.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The replay serves the same session without the device.
+	replay, err := gocw.NewUsbReplay(bytes.NewReader(transcript.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if model := replay.Model(); model != gocw.DeviceModelCw305 {
+		t.Errorf("Replayed model %v, want %v", model, gocw.DeviceModelCw305)
+	}
+	gotReg, gotBulk, err := transcriptSession(replay, 0x12345678)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotReg != reg || !bytes.Equal(gotBulk, bulk) {
+		t.Errorf("Replayed %x, %q, want %x, %q", gotReg, gotBulk, reg, bulk)
+	}
+	if err = replay.Done(); err != nil {
+		t.Error(err)
+	}
+
+	// Diverging from the transcript fails, and keeps failing.
+	replay, _ = gocw.NewUsbReplay(bytes.NewReader(transcript.Bytes()))
+	if _, _, err = transcriptSession(replay, 0x87654321); err == nil {
+		t.Fatal("Replay of a different write succeeded")
+	}
+	if _, err = replay.Read(make([]byte, 16)); err == nil {
+		t.Error("Replay continued after a divergence")
+	}
+	if err = replay.Done(); err == nil || !strings.Contains(err.Error(), "transcript entry 0") {
+		t.Errorf("Done returned %v, want the first divergence", err)
+	}
+
+	// Unreplayed transfers are reported.
+	replay, _ = gocw.NewUsbReplay(bytes.NewReader(transcript.Bytes()))
+	if err = replay.Done(); err == nil {
+		t.Error("Done ignored the transfers left")
+	}
+}
+
+// Counts the transfer sequences locked through it.
+type lockCountingDevice struct {
+	gocw.UsbDeviceInterface
+	locks, unlocks int
+}
+
+func (d *lockCountingDevice) Lock()   { d.locks++ }
+func (d *lockCountingDevice) Unlock() { d.unlocks++ }
+
+func TestUsbRecorderLocksDevice(t *testing.T) {
+	dev := &lockCountingDevice{}
+	var r sync.Locker = gocw.NewUsbRecorder(dev, &bytes.Buffer{})
+	r.Lock()
+	r.Unlock()
+	if dev.locks != 1 || dev.unlocks != 1 {
+		t.Errorf("Recorder locked the device %d times and unlocked it %d times, expected 1",
+			dev.locks, dev.unlocks)
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Pluggable USB transports.
+// UsbDevice talks to the hardware through a UsbTransport. The default
+// transport uses gousb (libusb), and others can be registered, e.g. a TCP
+// tunnel to a remote machine (see usb_transport_tcp.go).
+package gocw
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/gousb"
+)
+
+// Environment variable that selects the transport used by OpenCwLiteUsbDevice,
+// formatted as "name" or "name:address", e.g. "tcp:192.168.1.10:7007". The
+// gousb address is a USB serial number, e.g. "gousb:50203120374a4b32",
+// selecting one device of a multi-ChipWhisperer rig (see ListDevices).
+const TransportEnv = "GOCW_TRANSPORT"
+
+const DefaultTransport = "gousb"
+
+// Raw USB operations of a single device.
+type UsbTransport interface {
+	// Performs a control transfer. The direction is given by rType.
+	Control(rType, request uint8, val, idx uint16, data []byte) (int, error)
+	// Reads from the bulk input endpoint.
+	ReadBulk(p []byte) (int, error)
+	// Writes to the bulk output endpoint.
+	WriteBulk(p []byte) (int, error)
+	Close() error
+}
+
+// Implemented by transports whose bulk transfers can be cancelled.
+type bulkContexter interface {
+	ReadBulkContext(ctx context.Context, p []byte) (int, error)
+	WriteBulkContext(ctx context.Context, p []byte) (int, error)
+}
+
+// Opens a transport to the device with the given USB ids and bulk endpoints.
+// address is the part of the transport spec after the name, if any.
+type TransportOpener func(address string, vid, pid uint16, inEp, outEp int) (UsbTransport, error)
+
+var (
+	transportsMu sync.Mutex
+	transports   = map[string]TransportOpener{
+		DefaultTransport: openGousbTransport,
+	}
+)
+
+// Makes a transport available by name.
+func RegisterTransport(name string, open TransportOpener) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	transports[name] = open
+}
+
+// Opens a transport given a "name[:address]" spec.
+func OpenTransport(spec string, vid, pid uint16, inEp, outEp int) (UsbTransport, error) {
+	name, address := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		name, address = spec[:i], spec[i+1:]
+	}
+	transportsMu.Lock()
+	open, ok := transports[name]
+	transportsMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown USB transport %q", name)
+	}
+	return open(address, vid, pid, inEp, outEp)
+}
+
+// Returns the transport spec selected by the environment.
+func transportSpec() string {
+	if spec := os.Getenv(TransportEnv); len(spec) > 0 {
+		return spec
+	}
+	return DefaultTransport
+}
+
+// Encapsulates libusb resources.
+type gousbTransport struct {
+	ctx *gousb.Context
+	// dev also implements the control endpoint.
+	dev       *gousb.Device
+	intf      *gousb.Interface
+	intf_done func()
+	// Bulk output/input data endpoints.
+	ep_out *gousb.OutEndpoint
+	ep_in  *gousb.InEndpoint
+}
+
+func openGousbTransport(address string, vid, pid uint16, inEp, outEp int) (UsbTransport, error) {
+	t := &gousbTransport{}
+	t.ctx = gousb.NewContext()
+
+	var err error
+	err = retryBusy("Opening USB device", func() error {
+		var err error
+		if len(address) == 0 {
+			t.dev, err = t.ctx.OpenDeviceWithVIDPID(gousb.ID(vid), gousb.ID(pid))
+		} else {
+			t.dev, err = openGousbSerial(t.ctx, vid, pid, address)
+		}
+		return err
+	})
+	if t.dev == nil && err == nil {
+		t.Close()
+		if len(address) > 0 {
+			return nil, fmt.Errorf("USB device %04x:%04x with serial number %s not found", vid, pid, address)
+		}
+		return nil, fmt.Errorf("USB device %04x:%04x not found%s",
+			vid, pid, openHint(gousb.ErrorNotFound))
+	}
+
+	if err != nil {
+		t.Close()
+		return nil, fmt.Errorf("Opening USB device %04x:%04x: %v%s", vid, pid, err, openHint(err))
+	}
+
+	if autoDetachKernelDriver {
+		if err = t.dev.SetAutoDetach(true); err != nil {
+			glog.Warningf("Failed enabling kernel driver auto-detach: %v", err)
+		}
+	}
+
+	// The default interface is always #0 alt #0 in the currently active
+	// config.
+	err = retryBusy("Claiming default interface", func() error {
+		var err error
+		t.intf, t.intf_done, err = t.dev.DefaultInterface()
+		return err
+	})
+	if err != nil {
+		t.Close()
+		return nil, fmt.Errorf("Claming default interface: %v%s", err, openHint(err))
+	}
+
+	t.ep_out, err = t.intf.OutEndpoint(outEp)
+	if err != nil {
+		t.Close()
+		return nil, fmt.Errorf("Opening output interface: %v", err)
+	}
+
+	t.ep_in, err = t.intf.InEndpoint(inEp)
+	if err != nil {
+		t.Close()
+		return nil, fmt.Errorf("Opening input interface: %v", err)
+	}
+	return t, nil
+}
+
+// Opens the devices with the given vendor id and any of the product ids.
+// Devices that can't be opened, e.g. for lack of permissions, are skipped
+// with a warning. The caller closes the devices.
+func openGousbDevices(ctx *gousb.Context, vid uint16, pids []uint16) ([]*gousb.Device, error) {
+	devs, err := ctx.OpenDevices(func(desc *gousb.DeviceDesc) bool {
+		if desc.Vendor != gousb.ID(vid) {
+			return false
+		}
+		for _, pid := range pids {
+			if desc.Product == gousb.ID(pid) {
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		if len(devs) == 0 {
+			return nil, err
+		}
+		glog.Warningf("Skipped USB devices: %v%s", err, openHint(err))
+	}
+	return devs, nil
+}
+
+// Opens the device with the given USB ids and serial number. Returns a nil
+// device if not found, as OpenDeviceWithVIDPID.
+func openGousbSerial(ctx *gousb.Context, vid, pid uint16, serial string) (*gousb.Device, error) {
+	devs, err := openGousbDevices(ctx, vid, []uint16{pid})
+	if err != nil {
+		return nil, err
+	}
+	var found *gousb.Device
+	for _, d := range devs {
+		if sn, err := d.SerialNumber(); err == nil && sn == serial && found == nil {
+			found = d
+			continue
+		}
+		d.Close()
+	}
+	return found, nil
+}
+
+func (t *gousbTransport) Control(rType, request uint8, val, idx uint16, data []byte) (int, error) {
+	return t.dev.Control(rType, request, val, idx, data)
+}
+
+func (t *gousbTransport) ControlTimeout(timeout time.Duration, rType, request uint8, val, idx uint16, data []byte) (int, error) {
+	t.dev.ControlTimeout = timeout
+	defer func() { t.dev.ControlTimeout = 0 }()
+	return t.dev.Control(rType, request, val, idx, data)
+}
+
+func (t *gousbTransport) ReadBulk(p []byte) (int, error) {
+	return t.ep_in.Read(p)
+}
+
+func (t *gousbTransport) WriteBulk(p []byte) (int, error) {
+	return t.ep_out.Write(p)
+}
+
+func (t *gousbTransport) ReadBulkContext(ctx context.Context, p []byte) (int, error) {
+	return t.ep_in.ReadContext(ctx, p)
+}
+
+func (t *gousbTransport) WriteBulkContext(ctx context.Context, p []byte) (int, error) {
+	return t.ep_out.WriteContext(ctx, p)
+}
+
+func (t *gousbTransport) NewReadStream(size, count int) (BulkReadStream, error) {
+	return t.ep_in.NewStream(size, count)
+}
+
+func (t *gousbTransport) MaxPacketSize() int {
+	return t.ep_in.Desc.MaxPacketSize
+}
+
+func (t *gousbTransport) SerialNumber() (string, error) {
+	return t.dev.SerialNumber()
+}
+
+func (t *gousbTransport) Product() (string, error) {
+	return t.dev.Product()
+}
+
+func (t *gousbTransport) Manufacturer() (string, error) {
+	return t.dev.Manufacturer()
+}
+
+func (t *gousbTransport) Close() error {
+	if t.intf_done != nil {
+		t.intf_done()
+		t.intf_done = nil
+	}
+	if t.intf != nil {
+		t.intf.Close()
+		t.intf = nil
+	}
+	if t.dev != nil {
+		t.dev.Close()
+		t.dev = nil
+	}
+	if t.ctx != nil {
+		t.ctx.Close()
+		t.ctx = nil
+	}
+	return nil
+}
@@ -0,0 +1,430 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Tunnels USB transfers over a TCP connection.
+// The machine with the device runs ServeTransport (see cmd/usb_server.go),
+// and clients select it with GOCW_TRANSPORT=tcp:host:port.
+//
+// Each request is an op byte and the transfer timeout in milliseconds (zero
+// waits forever), followed by little-endian fields:
+//
+//	opControl: timeout u32, rType u8, request u8, val u16, idx u16, len u32, [OUT data]
+//	opRead:    timeout u32, len u32
+//	opWrite:   timeout u32, len u32, data
+//
+// Each response is: n u32, errKind u8, errCode i32, errLen u32, err string,
+// [IN data (n bytes)]. errKind lets clients tell timeouts, stalls and short
+// reads from other failures, see UsbTransferError.
+package gocw
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/gousb"
+)
+
+const (
+	opControl uint8 = 1
+	opRead    uint8 = 2
+	opWrite   uint8 = 3
+
+	// Upper bound on a single transfer, to reject corrupted requests.
+	maxTunnelTransfer = 1 << 24
+
+	// Time the server gets past the transfer timeout to report it, before the
+	// connection is dropped.
+	tunnelResponseSlack = time.Second
+)
+
+// Kinds of tunneled errors.
+const (
+	tunnelOk uint8 = iota
+	// Only the message is known.
+	tunnelErrOther
+	// A gousb.Error, with the libusb error code.
+	tunnelErrUsb
+	// A gousb.TransferStatus, with the status code.
+	tunnelErrTransfer
+	// The transfer timeout expired.
+	tunnelErrDeadline
+	// A ShortReadError, with the expected bytes.
+	tunnelErrShortRead
+)
+
+func init() {
+	RegisterTransport("tcp", openTCPTransport)
+}
+
+type tcpTransport struct {
+	address string
+	// Held from sending a request until its response is read, so concurrent
+	// transfers don't interleave on conn.
+	mu sync.Mutex
+	// Guards conn, so Close doesn't wait for a transfer in flight.
+	connMu sync.Mutex
+	// Nil after a failed exchange, which may leave a response in flight. The
+	// next transfer reconnects.
+	conn   net.Conn
+	closed bool
+}
+
+func openTCPTransport(address string, vid, pid uint16, inEp, outEp int) (UsbTransport, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("Connecting to USB server: %v", err)
+	}
+	return &tcpTransport{address: address, conn: conn}, nil
+}
+
+func writeFields(w io.Writer, fields ...interface{}) error {
+	for _, f := range fields {
+		if err := binary.Write(w, binary.LittleEndian, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A transfer error reported by the USB server. Unwraps to the gousb error of
+// the remote transfer, if any.
+type remoteTransferError struct {
+	msg string
+	err error
+}
+
+func (e *remoteTransferError) Error() string {
+	return e.msg
+}
+
+func (e *remoteTransferError) Unwrap() error {
+	return e.err
+}
+
+// Classifies a transfer error for the response.
+func encodeTransferError(err error) (uint8, int32) {
+	var usbErr gousb.Error
+	var status gousb.TransferStatus
+	var short *ShortReadError
+	switch {
+	case err == nil:
+		return tunnelOk, 0
+	case errors.As(err, &usbErr):
+		return tunnelErrUsb, int32(usbErr)
+	case errors.As(err, &status):
+		return tunnelErrTransfer, int32(status)
+	case errors.Is(err, context.DeadlineExceeded):
+		return tunnelErrDeadline, 0
+	case errors.As(err, &short):
+		return tunnelErrShortRead, int32(short.Expected)
+	}
+	return tunnelErrOther, 0
+}
+
+// Inverse of encodeTransferError. n is the number of bytes transferred.
+func decodeTransferError(kind uint8, code int32, msg string, n int) error {
+	var err error
+	switch kind {
+	case tunnelOk:
+		return nil
+	case tunnelErrUsb:
+		err = gousb.Error(code)
+	case tunnelErrTransfer:
+		err = gousb.TransferStatus(code)
+	case tunnelErrDeadline:
+		err = context.DeadlineExceeded
+	case tunnelErrShortRead:
+		err = &ShortReadError{Read: n, Expected: int(code)}
+	}
+	return &remoteTransferError{msg, err}
+}
+
+// Reads a response, copying IN data to p. Returns the remote error, if any.
+func response(conn net.Conn, p []byte) (int, error) {
+	var hdr struct {
+		N       uint32
+		ErrKind uint8
+		ErrCode int32
+		ErrLen  uint32
+	}
+	if err := binary.Read(conn, binary.LittleEndian, &hdr); err != nil {
+		return 0, err
+	}
+	if hdr.ErrLen > maxTunnelTransfer || (p != nil && int(hdr.N) > len(p)) {
+		return 0, fmt.Errorf("Malformed USB server response")
+	}
+	msg := make([]byte, hdr.ErrLen)
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return 0, err
+	}
+	if p != nil {
+		if _, err := io.ReadFull(conn, p[:hdr.N]); err != nil {
+			return 0, err
+		}
+	}
+	return int(hdr.N), decodeTransferError(hdr.ErrKind, hdr.ErrCode, string(msg), int(hdr.N))
+}
+
+// Sends a request with the remaining time of ctx as transfer timeout, and
+// reads its response into p. The connection is dropped when the server
+// doesn't respond shortly after the timeout, when ctx is cancelled or when
+// the exchange fails otherwise, as a response may still be in flight.
+func (t *tcpTransport) exchange(ctx context.Context, p []byte, op uint8, fields ...interface{}) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	conn, err := t.connect(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var timeout uint32
+	var connDeadline time.Time
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return 0, context.DeadlineExceeded
+		}
+		timeout = uint32((remaining + time.Millisecond - 1) / time.Millisecond)
+		connDeadline = deadline.Add(tunnelResponseSlack)
+	}
+	conn.SetDeadline(connDeadline)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.Canceled {
+				conn.SetDeadline(time.Now())
+			}
+		case <-done:
+		}
+	}()
+
+	n, err := roundTrip(conn, p, append([]interface{}{op, timeout}, fields...))
+	var remote *remoteTransferError
+	if err != nil && !errors.As(err, &remote) {
+		t.connMu.Lock()
+		conn.Close()
+		if t.conn == conn {
+			t.conn = nil
+		}
+		t.connMu.Unlock()
+		if ctx.Err() != nil {
+			return n, ctx.Err()
+		}
+	}
+	return n, err
+}
+
+// Returns the connection to the server, reconnecting after a failed exchange.
+func (t *tcpTransport) connect(ctx context.Context) (net.Conn, error) {
+	t.connMu.Lock()
+	defer t.connMu.Unlock()
+	if t.closed {
+		return nil, fmt.Errorf("USB transport closed")
+	}
+	if t.conn == nil {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", t.address)
+		if err != nil {
+			return nil, fmt.Errorf("Reconnecting to USB server: %v", err)
+		}
+		t.conn = conn
+	}
+	return t.conn, nil
+}
+
+func roundTrip(conn net.Conn, p []byte, fields []interface{}) (int, error) {
+	if err := writeFields(conn, fields...); err != nil {
+		return 0, err
+	}
+	return response(conn, p)
+}
+
+func (t *tcpTransport) Control(rType, request uint8, val, idx uint16, data []byte) (int, error) {
+	return t.control(context.Background(), rType, request, val, idx, data)
+}
+
+func (t *tcpTransport) ControlTimeout(timeout time.Duration, rType, request uint8, val, idx uint16, data []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return t.control(ctx, rType, request, val, idx, data)
+}
+
+func (t *tcpTransport) control(ctx context.Context, rType, request uint8, val, idx uint16, data []byte) (int, error) {
+	in := rType&gousb.ControlIn != 0
+	fields := []interface{}{rType, request, val, idx, uint32(len(data))}
+	if !in {
+		fields = append(fields, data)
+		data = nil
+	}
+	return t.exchange(ctx, data, opControl, fields...)
+}
+
+func (t *tcpTransport) ReadBulk(p []byte) (int, error) {
+	return t.ReadBulkContext(context.Background(), p)
+}
+
+func (t *tcpTransport) WriteBulk(p []byte) (int, error) {
+	return t.WriteBulkContext(context.Background(), p)
+}
+
+func (t *tcpTransport) ReadBulkContext(ctx context.Context, p []byte) (int, error) {
+	return t.exchange(ctx, p, opRead, uint32(len(p)))
+}
+
+func (t *tcpTransport) WriteBulkContext(ctx context.Context, p []byte) (int, error) {
+	return t.exchange(ctx, nil, opWrite, uint32(len(p)), p)
+}
+
+// The server opened whichever ChipWhisperer it found, see OpenUsbTransport.
+func (t *tcpTransport) reachesAnyModel() {}
+
+func (t *tcpTransport) Close() error {
+	t.connMu.Lock()
+	defer t.connMu.Unlock()
+	t.closed = true
+	if t.conn == nil {
+		return nil
+	}
+	return t.conn.Close()
+}
+
+// Performs a tunneled control transfer, with the requested timeout if t
+// supports timeouts.
+func serveControl(t UsbTransport, timeout time.Duration, rType, request uint8, val, idx uint16, data []byte) (int, error) {
+	if ct, ok := t.(controlTimeouter); ok && timeout > 0 {
+		return ct.ControlTimeout(timeout, rType, request, val, idx, data)
+	}
+	return t.Control(rType, request, val, idx, data)
+}
+
+// Performs a tunneled bulk transfer, with the requested timeout if t
+// supports cancellation.
+func serveBulk(t UsbTransport, timeout time.Duration, read bool, p []byte) (int, error) {
+	bt, ok := t.(bulkContexter)
+	if !ok || timeout == 0 {
+		if read {
+			return t.ReadBulk(p)
+		}
+		return t.WriteBulk(p)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var n int
+	var err error
+	if read {
+		n, err = bt.ReadBulkContext(ctx, p)
+	} else {
+		n, err = bt.WriteBulkContext(ctx, p)
+	}
+	// Cancelled transfers report TransferCancelled rather than a timeout.
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = context.DeadlineExceeded
+	}
+	return n, err
+}
+
+// Serves tunneled requests from conn on transport t, until conn is closed.
+func ServeTransport(conn io.ReadWriter, t UsbTransport) error {
+	for {
+		var op uint8
+		if err := binary.Read(conn, binary.LittleEndian, &op); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		var timeoutMs uint32
+		if err := binary.Read(conn, binary.LittleEndian, &timeoutMs); err != nil {
+			return err
+		}
+		timeout := time.Duration(timeoutMs) * time.Millisecond
+
+		var n int
+		var opErr error
+		var in []byte
+		switch op {
+		case opControl:
+			var hdr struct {
+				RType, Request uint8
+				Val, Idx       uint16
+				Len            uint32
+			}
+			if err := binary.Read(conn, binary.LittleEndian, &hdr); err != nil {
+				return err
+			}
+			if hdr.Len > maxTunnelTransfer {
+				return fmt.Errorf("Control transfer too large: %d", hdr.Len)
+			}
+			buf := make([]byte, hdr.Len)
+			if hdr.RType&gousb.ControlIn == 0 {
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					return err
+				}
+			}
+			n, opErr = serveControl(t, timeout, hdr.RType, hdr.Request, hdr.Val, hdr.Idx, buf)
+			if hdr.RType&gousb.ControlIn != 0 {
+				in = buf
+			}
+		case opRead, opWrite:
+			var size uint32
+			if err := binary.Read(conn, binary.LittleEndian, &size); err != nil {
+				return err
+			}
+			if size > maxTunnelTransfer {
+				return fmt.Errorf("Bulk transfer too large: %d", size)
+			}
+			buf := make([]byte, size)
+			if op == opRead {
+				n, opErr = serveBulk(t, timeout, true, buf)
+				in = buf
+			} else {
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					return err
+				}
+				n, opErr = serveBulk(t, timeout, false, buf)
+			}
+		default:
+			return fmt.Errorf("Unknown tunnel op %d", op)
+		}
+
+		if n < 0 {
+			n = 0
+		}
+		var msg []byte
+		if opErr != nil {
+			glog.V(1).Infof("Tunneled op %d failed: %v", op, opErr)
+			msg = []byte(opErr.Error())
+		}
+		kind, code := encodeTransferError(opErr)
+		fields := []interface{}{uint32(n), kind, code, uint32(len(msg)), msg}
+		if in != nil {
+			fields = append(fields, in[:n])
+		}
+		if err := writeFields(conn, fields...); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,662 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gocw"
+
+	"github.com/google/gousb"
+)
+
+// Loops bulk writes back to reads, and fills control IN transfers with the
+// request number.
+type loopbackTransport struct {
+	bulk    bytes.Buffer
+	lastOut []byte
+}
+
+func (t *loopbackTransport) Control(rType, request uint8, val, idx uint16, data []byte) (int, error) {
+	if rType&0x80 == 0 {
+		t.lastOut = append([]byte(nil), data...)
+		return len(data), nil
+	}
+	if request == 0xff {
+		return 0, fmt.Errorf("stall")
+	}
+	if request == 0xfe {
+		return 0, gousb.ErrorTimeout
+	}
+	for i := range data {
+		data[i] = request
+	}
+	return len(data), nil
+}
+
+func (t *loopbackTransport) ReadBulk(p []byte) (int, error)  { return t.bulk.Read(p) }
+func (t *loopbackTransport) WriteBulk(p []byte) (int, error) { return t.bulk.Write(p) }
+func (t *loopbackTransport) Close() error                    { return nil }
+
+func TestTCPTransport(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Cannot listen on loopback: %v", err)
+	}
+	defer l.Close()
+	remote := &loopbackTransport{}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		gocw.ServeTransport(conn, remote)
+	}()
+
+	tr, err := gocw.OpenTransport("tcp:"+l.Addr().String(), 0, 0, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	if n, err := tr.Control(0x40, 0x11, 0, 0, []byte{1, 2, 3}); err != nil || n != 3 {
+		t.Errorf("Control OUT returned %d, %v", n, err)
+	}
+	buf := make([]byte, 4)
+	if n, err := tr.Control(0xc1, 0x17, 0, 0, buf); err != nil || n != 4 || !bytes.Equal(buf, []byte{0x17, 0x17, 0x17, 0x17}) {
+		t.Errorf("Control IN returned %d, %v, %v", n, err, buf)
+	}
+	if _, err := tr.Control(0xc1, 0xff, 0, 0, buf); err == nil || err.Error() != "stall" {
+		t.Errorf("Control IN should propagate remote error, got %v", err)
+	}
+	if _, err := tr.Control(0xc1, 0xfe, 0, 0, buf); !errors.Is(err, gousb.ErrorTimeout) {
+		t.Errorf("Control IN should propagate %v, got %v", gousb.ErrorTimeout, err)
+	}
+
+	if n, err := tr.WriteBulk([]byte("hello")); err != nil || n != 5 {
+		t.Errorf("WriteBulk returned %d, %v", n, err)
+	}
+	buf = make([]byte, 16)
+	if n, err := tr.ReadBulk(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Errorf("ReadBulk returned %q, %v", buf[:n], err)
+	}
+	if !bytes.Equal(remote.lastOut, []byte{1, 2, 3}) {
+		t.Errorf("Remote received %v", remote.lastOut)
+	}
+}
+
+func TestTCPTransportConcurrentUse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Cannot listen on loopback: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		gocw.ServeTransport(conn, &loopbackTransport{})
+	}()
+
+	tr, err := gocw.OpenTransport("tcp:"+l.Addr().String(), 0, 0, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	// Each goroutine reads its own request number back, so interleaved
+	// requests and responses show up as wrong data or errors.
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for request := uint8(1); request <= 8; request++ {
+		wg.Add(1)
+		go func(request uint8) {
+			defer wg.Done()
+			buf := make([]byte, 64)
+			for i := 0; i < 100; i++ {
+				n, err := tr.Control(0xc1, request, 0, 0, buf)
+				if err == nil && (n != len(buf) || !bytes.Equal(buf, bytes.Repeat([]byte{request}, len(buf)))) {
+					err = fmt.Errorf("Request %d read %d bytes: %v", request, n, buf[:n])
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(request)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestOpenUsbTransportDiscovery(t *testing.T) {
+	var pids []uint16
+	gocw.RegisterTransport("test_cw1200", func(address string, vid, pid uint16, inEp, outEp int) (gocw.UsbTransport, error) {
+		pids = append(pids, pid)
+		if pid != 0xace3 {
+			return nil, fmt.Errorf("USB device %04x:%04x not found", vid, pid)
+		}
+		return &loopbackTransport{}, nil
+	})
+
+	tr, model, err := gocw.OpenUsbTransport("test_cw1200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	if model != gocw.DeviceModelCw1200 {
+		t.Errorf("Opened model %v, want %v", model, gocw.DeviceModelCw1200)
+	}
+	if len(pids) != 2 || pids[0] != 0xace2 || pids[1] != 0xace3 {
+		t.Errorf("Tried PIDs %x, want [ace2 ace3]", pids)
+	}
+}
+
+// Transport of a device which can drop off the bus.
+type unpluggableTransport struct {
+	loopbackTransport
+	unplugged *bool
+}
+
+func (t *unpluggableTransport) Control(rType, request uint8, val, idx uint16, data []byte) (int, error) {
+	if *t.unplugged {
+		return 0, fmt.Errorf("no device")
+	}
+	return t.loopbackTransport.Control(rType, request, val, idx, data)
+}
+
+func TestUsbDeviceReconnect(t *testing.T) {
+	unplugged := false
+	opens, failures := 0, 0
+	gocw.RegisterTransport("test_unplug", func(address string, vid, pid uint16, inEp, outEp int) (gocw.UsbTransport, error) {
+		opens++
+		if unplugged {
+			// Comes back on the bus after two attempts.
+			if failures++; failures < 3 {
+				return nil, fmt.Errorf("USB device %04x:%04x not found", vid, pid)
+			}
+			unplugged = false
+		}
+		return &unpluggableTransport{unplugged: &unplugged}, nil
+	})
+
+	dev, err := gocw.OpenModelUsbDevice("test_unplug", gocw.DeviceModelCw305)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	if !dev.Connected() {
+		t.Fatal("Device not connected after opening")
+	}
+	unplugged = true
+	if dev.Connected() {
+		t.Fatal("Device connected while unplugged")
+	}
+
+	p := gocw.ReconnectPolicy{Attempts: 2}
+	if err = dev.Reconnect(p); err == nil {
+		t.Fatal("Reconnected after 2 attempts, want failure")
+	}
+	if dev.Connected() {
+		t.Error("Device connected after failing to reconnect")
+	}
+	if err = dev.Reconnect(p); err != nil {
+		t.Fatal(err)
+	}
+	if !dev.Connected() {
+		t.Error("Device not connected after reconnecting")
+	}
+	if opens != 4 {
+		t.Errorf("Opened the transport %d times, want 4", opens)
+	}
+}
+
+// Transport failing the first transfers with the given errors.
+type flakyTransport struct {
+	loopbackTransport
+	errs     []error
+	attempts int
+}
+
+func (t *flakyTransport) fail() error {
+	t.attempts++
+	if len(t.errs) == 0 {
+		return nil
+	}
+	err := t.errs[0]
+	t.errs = t.errs[1:]
+	return err
+}
+
+func (t *flakyTransport) Control(rType, request uint8, val, idx uint16, data []byte) (int, error) {
+	if err := t.fail(); err != nil {
+		return 0, err
+	}
+	return t.loopbackTransport.Control(rType, request, val, idx, data)
+}
+
+// Blocks until ctx is done, as a bulk transfer to a hung device.
+func (t *flakyTransport) ReadBulkContext(ctx context.Context, p []byte) (int, error) {
+	t.attempts++
+	<-ctx.Done()
+	return 0, gousb.TransferCancelled
+}
+
+func (t *flakyTransport) WriteBulk(p []byte) (int, error) {
+	if err := t.fail(); err != nil {
+		return 0, err
+	}
+	return t.loopbackTransport.WriteBulk(p)
+}
+
+func (t *flakyTransport) WriteBulkContext(ctx context.Context, p []byte) (int, error) {
+	return t.WriteBulk(p)
+}
+
+func openFlakyDevice(t *testing.T, tr *flakyTransport) *gocw.UsbDevice {
+	gocw.RegisterTransport("test_flaky", func(address string, vid, pid uint16, inEp, outEp int) (gocw.UsbTransport, error) {
+		return tr, nil
+	})
+	dev, err := gocw.OpenModelUsbDevice("test_flaky", gocw.DeviceModelCw305)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := gocw.DefaultUsbConfig()
+	cfg.RetryDelay = 0
+	cfg.BulkTimeout = 10 * time.Millisecond
+	dev.SetUsbConfig(cfg)
+	tr.attempts = 0
+	return dev
+}
+
+func TestUsbDeviceRetries(t *testing.T) {
+	tr := &flakyTransport{}
+	dev := openFlakyDevice(t, tr)
+	defer dev.Close()
+
+	// Transient errors are retried.
+	tr.errs = []error{gousb.ErrorPipe, gousb.ErrorTimeout}
+	var ver gocw.FwVersion
+	if err := dev.ReadFwVersion(&ver); err != nil {
+		t.Fatal(err)
+	}
+	if tr.attempts != 3 {
+		t.Errorf("%d attempts, want 3", tr.attempts)
+	}
+
+	// Until the retries run out.
+	tr.attempts = 0
+	tr.errs = []error{gousb.ErrorPipe, gousb.ErrorPipe, gousb.ErrorPipe}
+	err := dev.ReadFwVersion(&ver)
+	var terr *gocw.UsbTransferError
+	if !errors.As(err, &terr) || !terr.Stalled() || terr.Timeout() || terr.Attempts != 3 {
+		t.Errorf("Got %v, want a stall after 3 attempts", err)
+	}
+	if terr != nil && terr.Request != gocw.ReqFwVersion {
+		t.Errorf("Failed request %v, want %v", terr.Request, gocw.ReqFwVersion)
+	}
+
+	// Other errors aren't.
+	tr.attempts = 0
+	tr.errs = []error{gousb.ErrorNoDevice}
+	if err = dev.ReadFwVersion(&ver); !errors.Is(err, gousb.ErrorNoDevice) {
+		t.Errorf("Got %v, want %v", err, gousb.ErrorNoDevice)
+	}
+	if tr.attempts != 1 {
+		t.Errorf("%d attempts, want 1", tr.attempts)
+	}
+
+	// Nor are writes, which the device may have acted on.
+	tr.attempts = 0
+	tr.errs = []error{gousb.ErrorPipe}
+	if err = dev.ControlOut(gocw.ReqMemWriteCtrl, 0, []byte{1}); !errors.Is(err, gousb.ErrorPipe) {
+		t.Errorf("Got %v, want %v", err, gousb.ErrorPipe)
+	}
+	tr.errs = []error{gousb.ErrorTimeout}
+	if _, err = dev.Write([]byte{1}); !errors.Is(err, gousb.ErrorTimeout) {
+		t.Errorf("Got %v, want %v", err, gousb.ErrorTimeout)
+	}
+	if tr.attempts != 2 {
+		t.Errorf("%d attempts, want 2", tr.attempts)
+	}
+
+	// Except address blocks setting up a read.
+	tr.attempts = 0
+	tr.errs = []error{gousb.ErrorPipe}
+	if err = dev.ControlOut(gocw.ReqMemReadCtrl, 0, make([]byte, 8)); err != nil {
+		t.Fatal(err)
+	}
+	if tr.attempts != 2 {
+		t.Errorf("%d attempts, want 2", tr.attempts)
+	}
+}
+
+func TestUsbDeviceTimeouts(t *testing.T) {
+	tr := &flakyTransport{}
+	dev := openFlakyDevice(t, tr)
+	defer dev.Close()
+
+	// Each attempt times out.
+	_, err := dev.Read(make([]byte, 64))
+	var terr *gocw.UsbTransferError
+	if !errors.As(err, &terr) || !terr.Timeout() {
+		t.Errorf("Got %v, want a timeout", err)
+	}
+	if want := dev.UsbConfig().Retries + 1; tr.attempts != want {
+		t.Errorf("%d attempts, want %d", tr.attempts, want)
+	}
+
+	// The deadline of the call ends the retries.
+	cfg := dev.UsbConfig()
+	cfg.BulkTimeout = 0
+	dev.SetUsbConfig(cfg)
+	tr.attempts = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err = dev.ReadContext(ctx, make([]byte, 64)); err != context.DeadlineExceeded {
+		t.Errorf("Got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if tr.attempts != 1 {
+		t.Errorf("%d attempts, want 1", tr.attempts)
+	}
+}
+
+// Serves tr to any number of clients, one at a time. Returns the server
+// address.
+func serveTCP(t *testing.T, tr gocw.UsbTransport) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Cannot listen on loopback: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			gocw.ServeTransport(conn, tr)
+			conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestTCPTransportTransferErrors(t *testing.T) {
+	tr := &flakyTransport{}
+	dev, err := gocw.OpenModelUsbDevice("tcp:"+serveTCP(t, tr), gocw.DeviceModelCw305)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	cfg := gocw.DefaultUsbConfig()
+	cfg.RetryDelay = 0
+	cfg.BulkTimeout = 10 * time.Millisecond
+	dev.SetUsbConfig(cfg)
+
+	// Remote stalls are retried, and reported as such.
+	tr.attempts = 0
+	tr.errs = []error{gousb.ErrorPipe, gousb.ErrorPipe, gousb.ErrorPipe}
+	var ver gocw.FwVersion
+	err = dev.ReadFwVersion(&ver)
+	var terr *gocw.UsbTransferError
+	if !errors.As(err, &terr) || !terr.Stalled() || terr.Attempts != 3 {
+		t.Errorf("Got %v, want a stall after 3 attempts", err)
+	}
+
+	// The server times out hung bulk transfers, and the connection survives.
+	tr.attempts = 0
+	_, err = dev.Read(make([]byte, 64))
+	if !errors.As(err, &terr) || !terr.Timeout() {
+		t.Errorf("Got %v, want a timeout", err)
+	}
+	if want := cfg.Retries + 1; tr.attempts != want {
+		t.Errorf("%d attempts, want %d", tr.attempts, want)
+	}
+	if err = dev.ReadFwVersion(&ver); err != nil {
+		t.Errorf("ReadFwVersion after timeouts: %v", err)
+	}
+}
+
+// Serves a transcript as a transport, without its recorded model.
+type replayTransport struct {
+	*gocw.UsbReplay
+}
+
+func (t replayTransport) Control(rType, request uint8, val, idx uint16, data []byte) (int, error) {
+	if rType&0x80 != 0 {
+		return len(data), t.ControlIn(gocw.Request(request), val, data)
+	}
+	return len(data), t.ControlOut(gocw.Request(request), val, data)
+}
+
+func (t replayTransport) ReadBulk(p []byte) (int, error)  { return t.Read(p) }
+func (t replayTransport) WriteBulk(p []byte) (int, error) { return t.Write(p) }
+
+func TestTCPTransportDetectsModel(t *testing.T) {
+	// A CW1200 (FW 1.11) read once to tell the model, and once by the device
+	// checking it.
+	replay, err := gocw.NewUsbReplay(strings.NewReader(`{"op":"model","val":1}
+{"op":"control_in","request":23,"data":"010b00"}
+{"op":"control_in","request":23,"data":"010b00"}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, err := gocw.OpenUsbDeviceTransport("tcp:" + serveTCP(t, replayTransport{replay}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	if dev.Model() != gocw.DeviceModelCw1200 {
+		t.Errorf("Opened a %v, want %v", dev.Model(), gocw.DeviceModelCw1200)
+	}
+	if err = replay.Done(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Bulk reads block until released, as a hung device without timeouts.
+type hungTransport struct {
+	loopbackTransport
+	release chan struct{}
+}
+
+func (t *hungTransport) ReadBulk(p []byte) (int, error) {
+	<-t.release
+	return 0, gousb.TransferCancelled
+}
+
+func TestTCPTransportCancel(t *testing.T) {
+	remote := &hungTransport{release: make(chan struct{})}
+	tr, err := gocw.OpenTransport("tcp:"+serveTCP(t, remote), 0, 0, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	bt := tr.(interface {
+		ReadBulkContext(ctx context.Context, p []byte) (int, error)
+	})
+	if _, err = bt.ReadBulkContext(ctx, make([]byte, 64)); err != context.Canceled {
+		t.Errorf("Got %v, want %v", err, context.Canceled)
+	}
+
+	// The next transfer reconnects once the server is done.
+	close(remote.release)
+	buf := make([]byte, 2)
+	if n, err := tr.Control(0xc1, 0x17, 0, 0, buf); err != nil || n != 2 {
+		t.Errorf("Control IN after cancel returned %d, %v", n, err)
+	}
+}
+
+func TestUsbDeviceControlBytes(t *testing.T) {
+	tr := &flakyTransport{}
+	dev := openFlakyDevice(t, tr)
+	defer dev.Close()
+
+	// Byte slices are read in place.
+	buf := make([]byte, 5)
+	if err := dev.ControlIn(gocw.ReqMemReadCtrl, 0, buf); err != nil {
+		t.Fatal(err)
+	}
+	if want := bytes.Repeat([]byte{byte(gocw.ReqMemReadCtrl)}, 5); !bytes.Equal(buf, want) {
+		t.Errorf("Read %v, want %v", buf, want)
+	}
+	// And sent as is.
+	if err := dev.ControlOut(gocw.ReqMemWriteCtrl, 0, []byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tr.lastOut, []byte{1, 2, 3}) {
+		t.Errorf("Sent %v, want [1 2 3]", tr.lastOut)
+	}
+	// Structures are still encoded.
+	if err := dev.ControlOut(gocw.ReqMemWriteCtrl, 0, &gocw.AddressBlock{Dlen: 1, Addr: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{1, 0, 0, 0, 2, 0, 0, 0}; !bytes.Equal(tr.lastOut, want) {
+		t.Errorf("Sent %v, want %v", tr.lastOut, want)
+	}
+}
+
+func TestVendorRequest(t *testing.T) {
+	tr := &flakyTransport{}
+	dev := openFlakyDevice(t, tr)
+	defer dev.Close()
+
+	in := make([]byte, 2)
+	if err := gocw.VendorRequest(dev, 0x42, 1, []byte{7, 8}, in); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tr.lastOut, []byte{7, 8}) {
+		t.Errorf("Sent %v, want [7 8]", tr.lastOut)
+	}
+	if !bytes.Equal(in, []byte{0x42, 0x42}) {
+		t.Errorf("Read %v, want [66 66]", in)
+	}
+	// Requests without data are sent as empty OUT transfers.
+	if err := gocw.VendorRequest(dev, uint8(gocw.ReqSam3uConfig), 3, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.lastOut) != 0 {
+		t.Errorf("Sent %v, want no data", tr.lastOut)
+	}
+	if err := gocw.VendorRequest(dev, 0xff, 0, nil, in); err == nil {
+		t.Errorf("VendorRequest of a stalled request succeeded")
+	}
+}
+
+// Fails control transfers issued while another one is in progress, and memory
+// reads whose address block and data are interleaved with another read.
+type sequenceTransport struct {
+	loopbackTransport
+	mu       sync.Mutex
+	busy     bool
+	pending  bool
+	failures int
+}
+
+func (t *sequenceTransport) Control(rType, request uint8, val, idx uint16, data []byte) (int, error) {
+	t.mu.Lock()
+	busy, out := t.busy, rType&0x80 == 0
+	t.busy = true
+	ok := !busy
+	if request == uint8(gocw.ReqMemReadCtrl) {
+		ok = ok && t.pending != out
+		t.pending = out
+	}
+	if !ok {
+		t.failures++
+	}
+	t.mu.Unlock()
+	// Widens the window for overlapping transfers.
+	time.Sleep(10 * time.Microsecond)
+	t.mu.Lock()
+	t.busy = false
+	t.mu.Unlock()
+	if out {
+		return len(data), nil
+	}
+	for i := range data {
+		data[i] = request
+	}
+	return len(data), nil
+}
+
+func TestUsbDeviceConcurrentUse(t *testing.T) {
+	tr := &sequenceTransport{}
+	gocw.RegisterTransport("test_sequence", func(address string, vid, pid uint16, inEp, outEp int) (gocw.UsbTransport, error) {
+		return tr, nil
+	})
+	dev, err := gocw.OpenModelUsbDevice("test_sequence", gocw.DeviceModelCw305)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	usart, err := gocw.NewUsart(dev, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mems := []*gocw.Memory{gocw.NewMemory(dev), gocw.NewMemory(dev)}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for _, m := range mems {
+		wg.Add(1)
+		go func(m *gocw.Memory) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if _, err := m.ReadU32(0x10); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(m)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if _, err := usart.Write([]byte("p")); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if tr.failures > 0 {
+		t.Errorf("%d control transfers overlapped or interleaved", tr.failures)
+	}
+}
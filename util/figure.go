@@ -0,0 +1,193 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"fmt"
+	"image/color"
+	"io"
+
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/plotutil"
+	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/draw"
+	"gonum.org/v1/plot/vg/vgimg"
+	"gonum.org/v1/plot/vg/vgsvg"
+)
+
+// Supported figure formats.
+const (
+	FigureSvg = "svg"
+	FigurePng = "png"
+)
+
+// Largest number of bins a series is reduced to. Each bin is drawn as its
+// lowest and highest values, like RenderThumbnail, so peaks stay visible and
+// SVG files stay small however long the traces are.
+const figureBins = 2000
+
+// A line of a figure, e.g. a trace or a correlation trace.
+type FigureSeries struct {
+	// Legend entry, empty for none.
+	Name string
+	// Values of consecutive samples, from sample Start.
+	Y     []float64
+	Start int
+	// Half width of a band drawn around Y, e.g. the standard deviation. Empty
+	// for no band.
+	Spread []float64
+}
+
+// A figure of series against sample indices, for reports.
+type Figure struct {
+	Title  string
+	XLabel string
+	YLabel string
+	// Maps sample indices to X values, e.g. time since the trigger. Nil to
+	// plot sample indices.
+	X      func(sample int) float64
+	Series []FigureSeries
+}
+
+func (f *Figure) x(sample int) float64 {
+	if f.X == nil {
+		return float64(sample)
+	}
+	return f.X(sample)
+}
+
+// Returns the indices of the lowest and highest values of each of at most
+// bins bins of y, in order.
+func envelope(y []float64, bins int) []int {
+	var idx []int
+	if len(y) <= 2*bins {
+		for i := range y {
+			idx = append(idx, i)
+		}
+		return idx
+	}
+	for b := 0; b < bins; b++ {
+		i0, i1 := b*len(y)/bins, (b+1)*len(y)/bins
+		lo, hi := i0, i0
+		for i := i0; i < i1; i++ {
+			if y[i] < y[lo] {
+				lo = i
+			}
+			if y[i] > y[hi] {
+				hi = i
+			}
+		}
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		idx = append(idx, lo)
+		if hi != lo {
+			idx = append(idx, hi)
+		}
+	}
+	return idx
+}
+
+// Returns the points of y at the envelope indices, offset by start samples.
+func (f *Figure) points(y []float64, start int) plotter.XYs {
+	idx := envelope(y, figureBins)
+	xys := make(plotter.XYs, len(idx))
+	for i, s := range idx {
+		xys[i] = plotter.XY{X: f.x(start + s), Y: y[s]}
+	}
+	return xys
+}
+
+// Returns the band of s, its upper edge followed by its lower edge reversed.
+func (f *Figure) band(s FigureSeries) plotter.XYs {
+	upper := make([]float64, len(s.Y))
+	lower := make([]float64, len(s.Y))
+	for i, y := range s.Y {
+		upper[i], lower[i] = y+s.Spread[i], y-s.Spread[i]
+	}
+	xys := f.points(upper, s.Start)
+	low := f.points(lower, s.Start)
+	for i := len(low) - 1; i >= 0; i-- {
+		xys = append(xys, low[i])
+	}
+	return xys
+}
+
+func (f *Figure) plot() (*plot.Plot, error) {
+	p := plot.New()
+	p.Title.Text = f.Title
+	p.X.Label.Text = f.XLabel
+	p.Y.Label.Text = f.YLabel
+	p.Legend.Top = true
+	p.Add(plotter.NewGrid())
+	for i, s := range f.Series {
+		if len(s.Y) == 0 {
+			return nil, fmt.Errorf("Series %d is empty", i)
+		}
+		c := plotutil.Color(i)
+		if len(s.Spread) > 0 {
+			if len(s.Spread) != len(s.Y) {
+				return nil, fmt.Errorf("Series %d has %d values and %d spreads", i, len(s.Y), len(s.Spread))
+			}
+			band, err := plotter.NewPolygon(f.band(s))
+			if err != nil {
+				return nil, err
+			}
+			// The band is a lighter shade of its line.
+			r, g, b, _ := c.RGBA()
+			band.Color = color.NRGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), 0x40}
+			band.LineStyle.Width = 0
+			p.Add(band)
+		}
+		line, err := plotter.NewLine(f.points(s.Y, s.Start))
+		if err != nil {
+			return nil, err
+		}
+		line.LineStyle.Color = c
+		line.LineStyle.Width = vg.Points(0.75)
+		p.Add(line)
+		if len(s.Name) > 0 {
+			p.Legend.Add(s.Name, line)
+		}
+	}
+	return p, nil
+}
+
+// Renders the figure in format (FigureSvg or FigurePng), width by height
+// inches. dpi is the resolution of PNG figures.
+func (f *Figure) Render(w io.Writer, format string, width, height float64, dpi int) error {
+	if format != FigureSvg && format != FigurePng {
+		return fmt.Errorf("Unsupported figure format %q", format)
+	}
+	if width <= 0 || height <= 0 || dpi <= 0 {
+		return fmt.Errorf("Invalid figure size %gx%g inches at %d dpi", width, height, dpi)
+	}
+	p, err := f.plot()
+	if err != nil {
+		return err
+	}
+	wl, hl := vg.Length(width)*vg.Inch, vg.Length(height)*vg.Inch
+	if format == FigureSvg {
+		c := vgsvg.New(wl, hl)
+		p.Draw(draw.New(c))
+		_, err = c.WriteTo(w)
+		return err
+	}
+	c := vgimg.NewWith(vgimg.UseWH(wl, hl), vgimg.UseDPI(dpi))
+	p.Draw(draw.New(c))
+	_, err = vgimg.PngCanvas{Canvas: c}.WriteTo(w)
+	return err
+}
@@ -0,0 +1,79 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util_test
+
+import (
+	"bytes"
+	"image/png"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/google/gocw/util"
+)
+
+func testFigure() *util.Figure {
+	y := make([]float64, 10000)
+	spread := make([]float64, len(y))
+	for i := range y {
+		y[i] = math.Sin(float64(i) / 100)
+		spread[i] = 0.1
+	}
+	return &util.Figure{
+		Title:  "Mean trace",
+		XLabel: "Time (µs)",
+		YLabel: "Power",
+		X:      func(sample int) float64 { return float64(sample) / 100 },
+		Series: []util.FigureSeries{{Name: "mean", Y: y, Spread: spread}, {Y: y[:100], Start: 50}},
+	}
+}
+
+func TestFigureRender(t *testing.T) {
+	f := testFigure()
+	var buf bytes.Buffer
+	if err := f.Render(&buf, util.FigureSvg, 6, 4, 300); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "<svg") {
+		t.Errorf("Not an SVG figure: %.40q", buf.String())
+	}
+
+	buf.Reset()
+	if err := f.Render(&buf, util.FigurePng, 6, 4, 300); err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 1800 || b.Dy() != 1200 {
+		t.Errorf("Figure is %v, expected 1800x1200 pixels", b)
+	}
+}
+
+func TestFigureRenderErrors(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testFigure().Render(&buf, "gif", 6, 4, 300); err == nil {
+		t.Error("Rendered an unsupported format")
+	}
+	if err := testFigure().Render(&buf, util.FigureSvg, 0, 4, 300); err == nil {
+		t.Error("Rendered an empty figure")
+	}
+	f := testFigure()
+	f.Series[0].Spread = f.Series[0].Spread[1:]
+	if err := f.Render(&buf, util.FigureSvg, 6, 4, 300); err == nil {
+		t.Error("Rendered a band of the wrong length")
+	}
+}
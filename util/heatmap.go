@@ -0,0 +1,100 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"sort"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// Anchor colors of the heatmap palette, from low to high amplitude.
+var heatmapPalette = []color.RGBA{
+	{0x44, 0x01, 0x54, 0xff},
+	{0x3b, 0x52, 0x8b, 0xff},
+	{0x21, 0x91, 0x8c, 0xff},
+	{0x5e, 0xc9, 0x62, 0xff},
+	{0xfd, 0xe7, 0x25, 0xff},
+}
+
+// Fraction of the binned values clipped at each end of the color scale, so a
+// few glitched samples don't wash out the rest of the image.
+const heatmapClip = 0.01
+
+func heatmapColor(v float64) color.RGBA {
+	if math.IsNaN(v) {
+		v = 0
+	}
+	v = math.Max(0, math.Min(1, v)) * float64(len(heatmapPalette)-1)
+	i := int(v)
+	if i >= len(heatmapPalette)-1 {
+		return heatmapPalette[len(heatmapPalette)-1]
+	}
+	f := v - float64(i)
+	lerp := func(a, b uint8) uint8 {
+		return uint8(float64(a) + f*(float64(b)-float64(a)) + 0.5)
+	}
+	a, b := heatmapPalette[i], heatmapPalette[i+1]
+	return color.RGBA{lerp(a.R, b.R), lerp(a.G, b.G), lerp(a.B, b.B), 0xff}
+}
+
+// Renders a (#traces) by (#samples) matrix as an image, one row per trace.
+// The matrix is averaged down to at most width by height pixels.
+func RenderHeatmap(M mat.Matrix, width, height int) *image.RGBA {
+	rows, cols := M.Dims()
+	if width <= 0 || width > cols {
+		width = cols
+	}
+	if height <= 0 || height > rows {
+		height = rows
+	}
+
+	// Average each bin of (rows/height) x (cols/width) values.
+	bins := make([]float64, width*height)
+	for y := 0; y < height; y++ {
+		r0, r1 := y*rows/height, (y+1)*rows/height
+		for x := 0; x < width; x++ {
+			c0, c1 := x*cols/width, (x+1)*cols/width
+			sum := 0.0
+			for i := r0; i < r1; i++ {
+				for j := c0; j < c1; j++ {
+					sum += M.At(i, j)
+				}
+			}
+			bins[y*width+x] = sum / float64((r1-r0)*(c1-c0))
+		}
+	}
+
+	sorted := make([]float64, len(bins))
+	copy(sorted, bins)
+	sort.Float64s(sorted)
+	lo := sorted[int(heatmapClip*float64(len(sorted)-1))]
+	hi := sorted[int((1-heatmapClip)*float64(len(sorted)-1))]
+	scale := 0.0
+	if hi > lo {
+		scale = 1 / (hi - lo)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, heatmapColor((bins[y*width+x]-lo)*scale))
+		}
+	}
+	return img
+}
@@ -0,0 +1,45 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util_test
+
+import (
+	"testing"
+
+	"github.com/google/gocw/util"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+func TestRenderHeatmapDownsamples(t *testing.T) {
+	// Left half low, right half high amplitude.
+	M := mat.NewDense(4, 8, nil)
+	for i := 0; i < 4; i++ {
+		for j := 4; j < 8; j++ {
+			M.Set(i, j, 1)
+		}
+	}
+	img := util.RenderHeatmap(M, 2, 2)
+	if b := img.Bounds(); b.Dx() != 2 || b.Dy() != 2 {
+		t.Fatalf("Heatmap is %v, expected 2x2", b)
+	}
+	for y := 0; y < 2; y++ {
+		if img.RGBAAt(0, y) == img.RGBAAt(1, y) {
+			t.Errorf("Row %d has the same color for low and high amplitude", y)
+		}
+		if img.RGBAAt(0, y) != img.RGBAAt(0, 0) || img.RGBAAt(1, y) != img.RGBAAt(1, 0) {
+			t.Errorf("Row %d differs from row 0", y)
+		}
+	}
+}
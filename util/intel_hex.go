@@ -16,6 +16,7 @@ package util
 
 import (
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/marcinbor85/gohex"
@@ -32,9 +33,13 @@ func LoadIntelHexFile(filename string) (*Segment, error) {
 		return nil, err
 	}
 	defer file.Close()
+	return LoadIntelHexIo(file)
+}
 
+// Parses Intel-Hex firmware holding a single segment.
+func LoadIntelHexIo(r io.Reader) (*Segment, error) {
 	mem := gohex.NewMemory()
-	if err = mem.ParseIntelHex(file); err != nil {
+	if err := mem.ParseIntelHex(r); err != nil {
 		return nil, err
 	}
 
@@ -16,56 +16,279 @@ package util
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"strings"
 
+	"github.com/google/gocw"
 	"github.com/google/gocw/programmer"
+	"github.com/google/gocw/programmer/sam"
 	"github.com/google/gocw/programmer/stm32f"
 	"github.com/google/gocw/programmer/xmega"
 
 	"github.com/golang/glog"
 )
 
+// Programming progress, reported by ProgramDeviceProgress.
+type ProgramProgress struct {
+	// One of "erase", "write", "verify" or "done".
+	Stage string
+	// Bytes written or verified so far, out of Total.
+	Done, Total int
+}
+
+// Bytes written or verified between progress reports.
+const programChunkSize = 1024
+
 // Writes firmware to flash.
-// Erases chip, writes contents to flash, reads and verifies the result.
+// Erases chip (only the pages of the firmware with a programmer.RangeEraser),
+// writes contents to flash, reads and verifies the result. Programmers
+// implementing programmer.Verifier verify with a checksum computed on the chip
+// instead, and read back only if it doesn't match or isn't supported.
 func ProgramDevice(prog programmer.ProgrammerInterface, firmware *Segment) error {
+	return ProgramDeviceProgress(prog, firmware, nil)
+}
+
+// Same as ProgramDevice, reporting progress to a callback (can be nil).
+// The flash is written and verified in chunks of programChunkSize.
+func ProgramDeviceProgress(prog programmer.ProgrammerInterface, firmware *Segment,
+	progress func(ProgramProgress)) error {
+	return ProgramDeviceContext(context.Background(), prog, firmware, progress)
+}
+
+// Same as ProgramDeviceProgress, stopping between chunks when ctx is done.
+// The flash is then left partially written. Programmers implementing
+// programmer.ContextProgrammer also stop in the middle of an operation, e.g.
+// on a wedged bootloader, and release the chip.
+func ProgramDeviceContext(ctx context.Context, prog programmer.ProgrammerInterface, firmware *Segment,
+	progress func(ProgramProgress)) error {
+	return ProgramDeviceOptions(ctx, prog, firmware, ProgramOptions{Progress: progress, VerifyErase: true})
+}
+
+// Options of ProgramDeviceOptions.
+type ProgramOptions struct {
+	// Progress callback (can be nil), see ProgramDeviceProgress.
+	Progress func(ProgramProgress)
+	// Checks that a sample of the flash reads erased before writing, with
+	// programmers implementing programmer.EraseVerifier.
+	VerifyErase bool
+}
+
+// Same as ProgramDeviceContext, with options.
+func ProgramDeviceOptions(ctx context.Context, prog programmer.ProgrammerInterface, firmware *Segment,
+	opts ProgramOptions) error {
+	report := func(stage string, done int) {
+		if opts.Progress != nil {
+			opts.Progress(ProgramProgress{stage, done, len(firmware.Data)})
+		}
+	}
 	var err error
 	glog.Info("Erasing chip")
-	if err = prog.Erase(); err != nil {
+	report("erase", 0)
+	cprog, hasContext := prog.(programmer.ContextProgrammer)
+	if eraser, ok := prog.(programmer.ContextRangeEraser); ok {
+		err = eraser.EraseRangeContext(ctx, firmware.Address, uint32(len(firmware.Data)))
+	} else if eraser, ok := prog.(programmer.RangeEraser); ok {
+		err = eraser.EraseRange(firmware.Address, uint32(len(firmware.Data)))
+	} else if hasContext {
+		err = cprog.EraseContext(ctx)
+	} else {
+		err = prog.Erase()
+	}
+	if err != nil {
 		return fmt.Errorf("Failed to erase chip: %v", err)
 	}
+	if v, ok := prog.(programmer.EraseVerifier); ok && opts.VerifyErase && !gocw.DryRun() {
+		glog.Info("Checking erased flash")
+		if err = v.VerifyErase(ctx, firmware.Address, uint32(len(firmware.Data))); err != nil {
+			return fmt.Errorf("Erase verification failed (protected or failing flash?): %v", err)
+		}
+	}
 	glog.Info("Programming flash")
-	w := prog.NewMemoryWriter(firmware.Address)
-	if _, err = w.Write(firmware.Data); err != nil {
-		return fmt.Errorf("Failed to write to flash: %v", err)
+	var w io.Writer
+	if hasContext {
+		w = cprog.NewMemoryWriterContext(ctx, firmware.Address)
+	} else {
+		w = prog.NewMemoryWriter(firmware.Address)
+	}
+	for done := 0; done < len(firmware.Data); {
+		if err = ctx.Err(); err != nil {
+			return fmt.Errorf("Programming stopped at %d of %d bytes: %v", done, len(firmware.Data), err)
+		}
+		report("write", done)
+		end := done + programChunkSize
+		if end > len(firmware.Data) {
+			end = len(firmware.Data)
+		}
+		if _, err = w.Write(firmware.Data[done:end]); err != nil {
+			return fmt.Errorf("Failed to write to flash: %v", err)
+		}
+		done = end
+	}
+	if gocw.DryRun() {
+		report("done", len(firmware.Data))
+		glog.Info("Dry run, skipping verification")
+		return nil
 	}
 	glog.Info("Verifying contents")
-	r := prog.NewMemoryReader(firmware.Address)
+	if v, ok := prog.(programmer.Verifier); ok {
+		report("verify", 0)
+		match, err := v.Verify(ctx, firmware.Address, firmware.Data)
+		switch {
+		case err == nil && match:
+			report("done", len(firmware.Data))
+			glog.Info("Device programmed successfully, checksum verified")
+			return nil
+		case err == nil:
+			// Reading back tells a failed write from a checksum variant.
+			glog.Warning("Checksum mismatch, reading back the flash")
+		case errors.Is(err, programmer.ErrVerifyUnsupported):
+			glog.V(1).Infof("%v, reading back the flash", err)
+		default:
+			glog.Warningf("Checksum verification failed, reading back the flash: %v", err)
+		}
+	}
+	var r io.Reader
+	if hasContext {
+		r = cprog.NewMemoryReaderContext(ctx, firmware.Address)
+	} else {
+		r = prog.NewMemoryReader(firmware.Address)
+	}
 	mem := make([]byte, len(firmware.Data))
-	if _, err = r.Read(mem); err != nil {
-		return fmt.Errorf("Failed to read flash contents: %v", err)
+	for done := 0; done < len(mem); {
+		if err = ctx.Err(); err != nil {
+			return fmt.Errorf("Verification stopped at %d of %d bytes: %v", done, len(mem), err)
+		}
+		report("verify", done)
+		end := done + programChunkSize
+		if end > len(mem) {
+			end = len(mem)
+		}
+		if _, err = r.Read(mem[done:end]); err != nil {
+			return fmt.Errorf("Failed to read flash contents: %v", err)
+		}
+		done = end
 	}
 	if !bytes.Equal(firmware.Data, mem) {
 		return fmt.Errorf("Data verification failed")
 	}
+	report("done", len(firmware.Data))
 	glog.Info("Device programmed successfully")
 	return nil
 }
 
-func ProgramFlashFile(filename string) error {
-	var err error
-	var firmware *Segment
-	if firmware, err = LoadIntelHexFile(filename); err != nil {
-		glog.Fatalf("Failed loading hex file: %v", err)
+// Programmer backends, in auto detection order.
+var programmerBackends = []struct {
+	name string
+	open func() (programmer.ProgrammerInterface, error)
+}{
+	{"xmega", func() (programmer.ProgrammerInterface, error) { return xmega.NewProgrammer() }},
+	{"stm32f", func() (programmer.ProgrammerInterface, error) { return stm32f.NewProgrammer() }},
+	{"sam4s", func() (programmer.ProgrammerInterface, error) { return sam.NewProgrammer() }},
+}
+
+// Returns the names of the programmer backends, in auto detection order.
+func ProgrammerBackends() []string {
+	var names []string
+	for _, b := range programmerBackends {
+		names = append(names, b.name)
+	}
+	return names
+}
+
+// Starts the firmware written by ProgramDevice without a reset, see
+// programmer.Runner. Fails if the programmer doesn't support it, its Close
+// then resets the chip into the firmware.
+func RunFirmware(prog programmer.ProgrammerInterface) error {
+	r, ok := prog.(programmer.Runner)
+	if !ok {
+		return fmt.Errorf("Programmer can't start the firmware")
+	}
+	glog.Info("Starting firmware")
+	return r.Run()
+}
+
+// Opens a programmer backend by name. An empty name tries each backend in
+// turn, and returns the first one that finds a supported chip along with its
+// name.
+func OpenProgrammer(name string) (programmer.ProgrammerInterface, string, error) {
+	var errs []string
+	for _, b := range programmerBackends {
+		if name != "" && name != b.name {
+			continue
+		}
+		prog, err := b.open()
+		if err == nil {
+			return prog, b.name, nil
+		}
+		if name != "" {
+			return nil, "", fmt.Errorf("Failed opening %s programmer: %v", name, err)
+		}
+		glog.Warningf("Failed opening %s programmer: %v", b.name, err)
+		errs = append(errs, fmt.Sprintf("%s: %v", b.name, err))
+	}
+	if name != "" {
+		return nil, "", fmt.Errorf("Unknown programmer %s", name)
+	}
+	return nil, "", fmt.Errorf("No programmer found (%s)", strings.Join(errs, "; "))
+}
+
+// Returns the chip name of a programmer, empty if the backend doesn't report it.
+func ChipName(prog programmer.ProgrammerInterface) string {
+	if p, ok := prog.(interface{ ChipName() string }); ok {
+		return p.ChipName()
 	}
+	return ""
+}
 
-	var prog programmer.ProgrammerInterface
-	if prog, err = xmega.NewProgrammer(); err != nil {
-		glog.Warningf("Failed opening XMEGA device: %v", err)
-		if prog, err = stm32f.NewProgrammer(); err != nil {
-			glog.Fatalf("Failed opening STM device: %v", err)
+// A programmer backend found by DetectProgrammers.
+type DetectedProgrammer struct {
+	Backend string
+	Chip    string
+	Error   string `json:",omitempty"`
+}
+
+// Opens each programmer backend in turn to report whether it finds a
+// supported chip. The programmers are closed before returning.
+func DetectProgrammers() []DetectedProgrammer {
+	var res []DetectedProgrammer
+	for _, name := range ProgrammerBackends() {
+		d := DetectedProgrammer{Backend: name}
+		if prog, _, err := OpenProgrammer(name); err != nil {
+			d.Error = err.Error()
+		} else {
+			d.Chip = ChipName(prog)
+			prog.Close()
 		}
+		res = append(res, d)
+	}
+	return res
+}
+
+func ProgramFlashFile(filename string) error {
+	return ProgramFlashFileContext(context.Background(), filename)
+}
+
+// Same as ProgramFlashFile, stopping when ctx is done, see
+// ProgramDeviceContext.
+func ProgramFlashFileContext(ctx context.Context, filename string) error {
+	return ProgramFlashFileProgress(ctx, filename, nil)
+}
+
+// Same as ProgramFlashFileContext, reporting progress to a callback (can be
+// nil), see ProgramDeviceProgress.
+func ProgramFlashFileProgress(ctx context.Context, filename string, progress func(ProgramProgress)) error {
+	firmware, err := LoadIntelHexFile(filename)
+	if err != nil {
+		return fmt.Errorf("Failed loading hex file: %v", err)
+	}
+	prog, _, err := OpenProgrammer("")
+	if err != nil {
+		return err
 	}
 	defer prog.Close()
 
-	return ProgramDevice(prog, firmware)
+	return ProgramDeviceContext(ctx, prog, firmware, progress)
 }
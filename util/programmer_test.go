@@ -15,10 +15,14 @@
 package util_test
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"reflect"
 	"strings"
 	"testing"
 
+	"github.com/google/gocw/programmer"
 	"github.com/google/gocw/programmer/mocks"
 	"github.com/google/gocw/util"
 
@@ -41,3 +45,108 @@ func TestProgrammerFailsIfEraseFails(t *testing.T) {
 		t.Errorf("ProgramDevice did not fail as expected. Err: %v", err)
 	}
 }
+
+func TestProgramDeviceProgress(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	data := make([]byte, 2500)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	var flash bytes.Buffer
+	prog := mocks.NewMockProgrammerInterface(mockCtrl)
+	gomock.InOrder(
+		prog.EXPECT().Erase().Return(nil),
+		prog.EXPECT().NewMemoryWriter(uint32(0x800)).Return(&flash),
+		prog.EXPECT().NewMemoryReader(uint32(0x800)).
+			DoAndReturn(func(uint32) *bytes.Reader { return bytes.NewReader(flash.Bytes()) }),
+	)
+
+	var got []util.ProgramProgress
+	err := util.ProgramDeviceProgress(prog, &util.Segment{0x800, data}, func(p util.ProgramProgress) {
+		got = append(got, p)
+	})
+	if err != nil {
+		t.Fatalf("ProgramDeviceProgress failed: %v", err)
+	}
+	if !bytes.Equal(flash.Bytes(), data) {
+		t.Errorf("Flash contents don't match the firmware")
+	}
+	want := []util.ProgramProgress{
+		{"erase", 0, 2500},
+		{"write", 0, 2500}, {"write", 1024, 2500}, {"write", 2048, 2500},
+		{"verify", 0, 2500}, {"verify", 1024, 2500}, {"verify", 2048, 2500},
+		{"done", 2500, 2500},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Progress = %v, want %v", got, want)
+	}
+}
+
+func TestProgramDeviceContextCancelled(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	var flash bytes.Buffer
+	prog := mocks.NewMockProgrammerInterface(mockCtrl)
+	gomock.InOrder(
+		prog.EXPECT().Erase().Return(nil),
+		prog.EXPECT().NewMemoryWriter(uint32(0x800)).Return(&flash),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := util.ProgramDeviceContext(ctx, prog, &util.Segment{0x800, make([]byte, 2500)}, func(p util.ProgramProgress) {
+		if p.Stage == "write" && p.Done > 0 {
+			cancel()
+		}
+	})
+	if err == nil || !strings.Contains(err.Error(), "stopped at 2048") {
+		t.Errorf("ProgramDeviceContext did not stop as expected. Err: %v", err)
+	}
+	if flash.Len() != 2048 {
+		t.Errorf("Wrote %d bytes, expected 2048", flash.Len())
+	}
+}
+
+// Programmer verifying with a checksum.
+type verifyingProgrammer struct {
+	*mocks.MockProgrammerInterface
+	match bool
+	err   error
+}
+
+func (p *verifyingProgrammer) Verify(ctx context.Context, addr uint32, data []byte) (bool, error) {
+	return p.match, p.err
+}
+
+var _ programmer.Verifier = &verifyingProgrammer{}
+
+func TestProgramDeviceVerify(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	data := []byte{1, 2, 3}
+	for _, test := range []struct {
+		match    bool
+		err      error
+		readBack bool
+	}{
+		{true, nil, false},
+		{false, nil, true},
+		{false, programmer.ErrVerifyUnsupported, true},
+		{false, fmt.Errorf("no ack"), true},
+	} {
+		var flash bytes.Buffer
+		prog := &verifyingProgrammer{mocks.NewMockProgrammerInterface(mockCtrl), test.match, test.err}
+		prog.EXPECT().Erase().Return(nil)
+		prog.EXPECT().NewMemoryWriter(uint32(0x800)).Return(&flash)
+		if test.readBack {
+			prog.EXPECT().NewMemoryReader(uint32(0x800)).
+				DoAndReturn(func(uint32) *bytes.Reader { return bytes.NewReader(flash.Bytes()) })
+		}
+		if err := util.ProgramDevice(prog, &util.Segment{0x800, data}); err != nil {
+			t.Errorf("ProgramDevice() with Verify() = %v, %v failed: %v", test.match, test.err, err)
+		}
+	}
+}
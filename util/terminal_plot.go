@@ -0,0 +1,108 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"math"
+	"strings"
+)
+
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// Braille dot bits, indexed by [dot column][dot row].
+// See https://en.wikipedia.org/wiki/Braille_Patterns.
+var brailleDots = [2][4]rune{
+	{0x01, 0x02, 0x04, 0x40},
+	{0x08, 0x10, 0x20, 0x80},
+}
+
+const brailleBase = 0x2800
+
+// Scales v from [lo, hi] to [0, 1], clamped.
+func scale(v, lo, hi float64) float64 {
+	if hi <= lo {
+		return 0.5
+	}
+	return math.Max(0, math.Min(1, (v-lo)/(hi-lo)))
+}
+
+// Returns the min and max of y.
+func MinMax(y []float64) (lo, hi float64) {
+	lo, hi = math.Inf(1), math.Inf(-1)
+	for _, v := range y {
+		lo = math.Min(lo, v)
+		hi = math.Max(hi, v)
+	}
+	return lo, hi
+}
+
+// Renders y as a line of block characters, scaled to [lo, hi].
+// y is averaged down to at most width characters.
+func Sparkline(y []float64, width int, lo, hi float64) string {
+	n := len(y)
+	if width <= 0 || width > n {
+		width = n
+	}
+	var sb strings.Builder
+	for x := 0; x < width; x++ {
+		i0, i1 := x*n/width, (x+1)*n/width
+		sum := 0.0
+		for _, v := range y[i0:i1] {
+			sum += v
+		}
+		s := scale(sum/float64(i1-i0), lo, hi)
+		sb.WriteRune(sparkBlocks[int(s*float64(len(sparkBlocks)-1)+0.5)])
+	}
+	return sb.String()
+}
+
+// Renders y as a braille plot of at most width by height characters, scaled
+// to [lo, hi]. Each character holds 2x4 dots. Every dot column spans the min
+// to max of its samples, so short spikes remain visible.
+func BraillePlot(y []float64, width, height int, lo, hi float64) []string {
+	n := len(y)
+	dotsW := 2 * width
+	if dotsW <= 0 || dotsW > n {
+		dotsW = n
+	}
+	width = (dotsW + 1) / 2
+	dotsH := 4 * height
+	if dotsH <= 0 {
+		return nil
+	}
+
+	row := func(v float64) int {
+		return int((1-scale(v, lo, hi))*float64(dotsH-1) + 0.5)
+	}
+	cells := make([][]rune, height)
+	for r := range cells {
+		cells[r] = make([]rune, width)
+		for c := range cells[r] {
+			cells[r][c] = brailleBase
+		}
+	}
+	for x := 0; x < dotsW; x++ {
+		bmin, bmax := MinMax(y[x*n/dotsW : (x+1)*n/dotsW])
+		for d := row(bmax); d <= row(bmin); d++ {
+			cells[d/4][x/2] |= brailleDots[x%2][d%4]
+		}
+	}
+
+	lines := make([]string, height)
+	for r := range cells {
+		lines[r] = string(cells[r])
+	}
+	return lines
+}
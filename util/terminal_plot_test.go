@@ -0,0 +1,48 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/gocw/util"
+)
+
+func TestSparkline(t *testing.T) {
+	y := []float64{0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7}
+	if actual, expected := util.Sparkline(y, 8, 0, 7), "▁▂▃▄▅▆▇█"; actual != expected {
+		t.Errorf("Sparkline %q did not match expected %q", actual, expected)
+	}
+	// Width larger than the trace is reduced to one character per sample.
+	if actual, expected := util.Sparkline([]float64{-1, 1}, 10, 0, 1), "▁█"; actual != expected {
+		t.Errorf("Sparkline %q did not match expected %q", actual, expected)
+	}
+}
+
+func TestBraillePlot(t *testing.T) {
+	// Rising ramp over 2 characters (4 dot columns), 1 character high.
+	y := []float64{0, 1, 2, 3}
+	expected := []string{"⡠⠊"}
+	if actual := util.BraillePlot(y, 2, 1, 0, 3); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("BraillePlot %q did not match expected %q", actual, expected)
+	}
+	// A single spike is kept by the min/max envelope.
+	y = []float64{0, 0, 0, 9, 0, 0, 0, 0}
+	expected = []string{"⣸⣀"}
+	if actual := util.BraillePlot(y, 2, 1, 0, 9); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("BraillePlot %q did not match expected %q", actual, expected)
+	}
+}
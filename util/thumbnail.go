@@ -0,0 +1,63 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// Colors of trace thumbnails.
+var (
+	thumbnailBackground = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	thumbnailForeground = color.RGBA{0x3b, 0x52, 0x8b, 0xff}
+)
+
+// Renders a trace as a width by height line plot, scaled to its own range.
+// Each column covers a bin of samples, from the lowest to the highest one, so
+// peaks stay visible however many samples are binned.
+func RenderThumbnail(trace []float64, width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, thumbnailBackground)
+		}
+	}
+	if len(trace) == 0 || width <= 0 || height <= 0 {
+		return img
+	}
+	lo, hi := MinMax(trace)
+	scale := 0.0
+	if hi > lo {
+		scale = float64(height-1) / (hi - lo)
+	}
+	// Row of a value, the highest values at the top.
+	row := func(v float64) int {
+		return height - 1 - int(math.Round((v-lo)*scale))
+	}
+	for x := 0; x < width; x++ {
+		s0, s1 := x*len(trace)/width, (x+1)*len(trace)/width
+		if s1 <= s0 {
+			// More columns than samples.
+			s1 = s0 + 1
+		}
+		binLo, binHi := MinMax(trace[s0:s1])
+		for y := row(binHi); y <= row(binLo); y++ {
+			img.SetRGBA(x, y, thumbnailForeground)
+		}
+	}
+	return img
+}
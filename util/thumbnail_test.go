@@ -0,0 +1,43 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util_test
+
+import (
+	"testing"
+
+	"github.com/google/gocw/util"
+)
+
+func TestRenderThumbnail(t *testing.T) {
+	// Low first half, high second half.
+	trace := []float64{0, 0, 0, 0, 1, 1, 1, 1}
+	img := util.RenderThumbnail(trace, 4, 3)
+	if b := img.Bounds(); b.Dx() != 4 || b.Dy() != 3 {
+		t.Fatalf("Thumbnail is %v, expected 4x3", b)
+	}
+	bg := img.RGBAAt(0, 0)
+	for x, line := range []int{2, 2, 0, 0} {
+		for y := 0; y < 3; y++ {
+			if on := img.RGBAAt(x, y) != bg; on != (y == line) {
+				t.Errorf("Pixel (%d, %d) set: %v, expected line at row %d", x, y, on, line)
+			}
+		}
+	}
+	// A flat trace is drawn at the bottom.
+	img = util.RenderThumbnail([]float64{0.5, 0.5}, 4, 3)
+	if img.RGBAAt(3, 2) == img.RGBAAt(3, 0) {
+		t.Error("Flat trace not drawn")
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Target output validation.
+// A glitched or misbehaving target returns wrong outputs, and its traces
+// pollute the dataset. CaptureOptions.Validator checks each trace against a
+// reference implementation, and CaptureOptions.ValidationPolicy discards or
+// tags the traces that fail.
+package gocw
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/elliptic"
+	"fmt"
+	"math/big"
+)
+
+// Returns an error if the target output of a trace is wrong.
+type TraceValidator func(t *Trace) error
+
+//go:generate stringer -type ValidationPolicy
+type ValidationPolicy int
+
+const (
+	// Drops traces with wrong outputs, and captures replacements. The
+	// capture fails after MaxValidationDiscards consecutive wrong outputs.
+	ValidationDiscard ValidationPolicy = iota
+	// Keeps traces with wrong outputs, tagged with Trace.InvalidOutput.
+	ValidationTag ValidationPolicy = iota
+)
+
+// Checks that Ct is the AES encryption of a single block Pt with Key, as
+// computed by the tiny_aes firmware.
+func AesValidator(t *Trace) error {
+	block, err := aes.NewCipher(t.Key)
+	if err != nil {
+		return err
+	}
+	if len(t.Pt) != aes.BlockSize {
+		return fmt.Errorf("Plaintext is %d bytes, expected %d", len(t.Pt), aes.BlockSize)
+	}
+	expected := make([]byte, aes.BlockSize)
+	block.Encrypt(expected, t.Pt)
+	if !bytes.Equal(t.Ct, expected) {
+		return fmt.Errorf("Ciphertext %x, expected %x", t.Ct, expected)
+	}
+	return nil
+}
+
+// Checks that Ct is the P256 point Pt multiplied by the scalar Key, as
+// computed by the cryptoc_ecdh firmware. Scalars and coordinates are 32 byte
+// big-endian, points are x followed by y.
+func P256Validator(t *Trace) error {
+	const n = 32
+	if len(t.Key) != n || len(t.Pt) != 2*n {
+		return fmt.Errorf("Unexpected key (%d bytes) or point (%d bytes) length", len(t.Key), len(t.Pt))
+	}
+	curve := elliptic.P256()
+	x, y := new(big.Int).SetBytes(t.Pt[:n]), new(big.Int).SetBytes(t.Pt[n:])
+	if !curve.IsOnCurve(x, y) {
+		// The firmware leaves invalid points unchanged.
+		if !bytes.Equal(t.Ct, t.Pt) {
+			return fmt.Errorf("Output %x for invalid input point", t.Ct)
+		}
+		return nil
+	}
+	rx, ry := curve.ScalarMult(x, y, t.Key)
+	expected := make([]byte, 2*n)
+	rx.FillBytes(expected[:n])
+	ry.FillBytes(expected[n:])
+	if !bytes.Equal(t.Ct, expected) {
+		return fmt.Errorf("Output point %x, expected %x", t.Ct, expected)
+	}
+	return nil
+}
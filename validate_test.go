@@ -0,0 +1,72 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocw_test
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/google/gocw"
+)
+
+func TestAesValidator(t *testing.T) {
+	// FIPS-197 appendix B.
+	key, _ := hex.DecodeString("2b7e151628aed2a6abf7158809cf4f3c")
+	pt, _ := hex.DecodeString("3243f6a8885a308d313198a2e0370734")
+	ct, _ := hex.DecodeString("3925841d02dc09fbdc118597196a0b32")
+	trace := gocw.Trace{Key: key, Pt: pt, Ct: ct}
+	if err := gocw.AesValidator(&trace); err != nil {
+		t.Errorf("Valid ciphertext rejected: %v", err)
+	}
+	trace.Ct = append([]byte(nil), ct...)
+	trace.Ct[3] ^= 0x10
+	if err := gocw.AesValidator(&trace); err == nil {
+		t.Error("Faulty ciphertext accepted")
+	}
+	trace.Ct = nil
+	if err := gocw.AesValidator(&trace); err == nil {
+		t.Error("Missing ciphertext accepted")
+	}
+}
+
+func TestP256Validator(t *testing.T) {
+	gx, _ := hex.DecodeString("6b17d1f2e12c4247f8bce6e563a440f277037d812deb33a0f4a13945d898c296")
+	gy, _ := hex.DecodeString("4fe342e2fe1a7f9b8ee7eb4a7c0f9e162bce33576b315ececbb6406837bf51f5")
+	// 2G.
+	rx, _ := hex.DecodeString("7cf27b188d034f7e8a52380304b51ac3c08969e277f21b35a60b48fc47669978")
+	ry, _ := hex.DecodeString("07775510db8ed040293d9ac69f7430dbba7dade63ce982299e04b79d227873d1")
+	key := make([]byte, 32)
+	key[31] = 2
+	trace := gocw.Trace{
+		Key: key,
+		Pt:  append(gx, gy...),
+		Ct:  append(rx, ry...),
+	}
+	if err := gocw.P256Validator(&trace); err != nil {
+		t.Errorf("Valid point rejected: %v", err)
+	}
+	trace.Ct = append(append([]byte(nil), gx...), gy...)
+	if err := gocw.P256Validator(&trace); err == nil {
+		t.Error("Faulty point accepted")
+	}
+
+	// The firmware returns invalid points unchanged.
+	invalid := make([]byte, 64)
+	invalid[63] = 1
+	trace = gocw.Trace{Key: key, Pt: invalid, Ct: invalid}
+	if err := gocw.P256Validator(&trace); err != nil {
+		t.Errorf("Unchanged invalid point rejected: %v", err)
+	}
+}
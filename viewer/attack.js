@@ -0,0 +1,189 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+var selected_capture;
+var selected_byte = 0;
+var poll_timer;
+var convergence_dygraph;
+var correlation_dygraph;
+
+var PlotConvergence = function(history) {
+    if (history.length == 0) {
+        return;
+    }
+    var labels = ["traces"];
+    for (var i = 1; i < history[0].length; i++) {
+        labels.push("byte " + (i - 1));
+    }
+    if (convergence_dygraph) {
+        convergence_dygraph.updateOptions({file: history});
+        return;
+    }
+    convergence_dygraph = new Dygraph(
+        document.getElementById("convergence_plot"),
+        history, {
+            legend: "follow",
+            title: "Best guess correlation vs. number of traces",
+            labels: labels,
+        });
+};
+
+var LoadCorrelation = function() {
+    $.ajax({
+        url: "/attack/" + selected_capture + "/" + selected_byte,
+        method: "GET",
+        dataType: "json",
+        success: function(d) {
+            var data = d.map(function(v, i) { return [i, v]; });
+            if (data.length == 0) {
+                return;
+            }
+            var title = "Correlation of byte " + selected_byte + " best guess";
+            if (correlation_dygraph) {
+                correlation_dygraph.updateOptions({file: data, title: title});
+                return;
+            }
+            correlation_dygraph = new Dygraph(
+                document.getElementById("correlation_plot"),
+                data, {
+                    legend: "always",
+                    title: title,
+                    labels: ["sample", "correlation"],
+                    axes: SampleAxes(),
+                });
+        }
+    });
+};
+
+// Downloads the correlation plot as a figure rendered by the server, within
+// the zoomed sample range if any.
+var ExportCorrelation = function(format) {
+    if (!selected_capture) {
+        return;
+    }
+    var params = {"format": format};
+    if (correlation_dygraph && correlation_dygraph.isZoomed("x")) {
+        var range = correlation_dygraph.xAxisRange();
+        params.start = Math.round(range[0]);
+        params.end = Math.round(range[1]);
+    }
+    $("<a>").attr("href", "/attack/" + selected_capture + "/" + selected_byte + "/figure?" + $.param(params))
+        .attr("download", selected_capture + "_byte" + selected_byte + "." + format)[0].click();
+};
+
+var PollAttack = function() {
+    $.ajax({
+        url: "/attack/" + selected_capture,
+        method: "GET",
+        dataType: "json",
+        success: function(d) {
+            var key = (d.Bytes || []).map(function(b) { return b.Key; }).join("");
+            $("#recovered_key").text(key);
+            $("#key_bytes").bootstrapTable("load", d.Bytes || []);
+            PlotConvergence(d.History || []);
+            LoadCorrelation();
+
+            var status = d.NumTraces + " traces";
+            if (d.Error) {
+                status = "Error: " + d.Error;
+            } else if (d.Done) {
+                status += ", done";
+            }
+            $("#attack_status").text(status);
+            if (!d.Done) {
+                poll_timer = setTimeout(PollAttack, 1000);
+            }
+        }
+    });
+};
+
+var StartAttack = function() {
+    clearTimeout(poll_timer);
+    if (convergence_dygraph) {
+        convergence_dygraph.destroy();
+        convergence_dygraph = null;
+    }
+    $.ajax({
+        url: "/attack/" + selected_capture + "?" + $.param({
+            "batch": $("#batch").val(),
+            "live": $("#live").is(":checked"),
+            "mask": $("#mask").val(),
+        }),
+        method: "POST",
+        success: function() {
+            PollAttack();
+        },
+        error: function(xhr) {
+            $("#attack_status").text("Error: " + xhr.responseText);
+        },
+    });
+};
+
+var LoadCaptures = function() {
+    $.ajax({
+        url: "/captures",
+        method: "GET",
+        data: {
+            "wait": false
+        },
+        dataType: "json",
+        success: function(d) {
+            $("#captures").empty();
+            d.forEach(function(value, i) {
+                $("#captures")
+                    .append($("<li>").attr("class", "nav-item")
+                        .append($("<a>").attr("class", "nav-link")
+                            .attr('id', "cap_" + value)
+                            .attr("href", "#" + value)
+                            .append($("<span>").attr("data-feather", "file-text"))
+                            .append(value)));
+            })
+            feather.replace();
+            if (d.length > 0) {
+                selected_capture = d[0];
+                LoadTimeBase(selected_capture);
+                $("#cap_" + selected_capture).addClass("active");
+            }
+
+            $("a.nav-link").click(function(event) {
+                event.preventDefault();
+                $("#cap_" + selected_capture).removeClass("active");
+                selected_capture = $(this).attr("href").substring(1);
+                LoadTimeBase(selected_capture);
+                $("#cap_" + selected_capture).addClass("active");
+                clearTimeout(poll_timer);
+                PollAttack();
+            });
+        }
+    });
+};
+
+$(document).ready(function() {
+    "use strict"
+    $("#key_bytes").bootstrapTable({
+        onClickRow: function(row, elm, field) {
+            selected_byte = row.Index;
+            LoadCorrelation();
+        },
+    });
+    $("#attack_form").submit(function(event) {
+        event.preventDefault();
+        StartAttack();
+    });
+    $(".export").click(function() {
+        ExportCorrelation($(this).data("format"));
+    });
+    feather.replace();
+    LoadCaptures();
+})
@@ -0,0 +1,109 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+var poll_timer;
+
+var DetectProgrammers = function() {
+    $("#detect").prop("disabled", true);
+    $.ajax({
+        url: "/programmers",
+        method: "GET",
+        dataType: "json",
+        success: function(d) {
+            var backend = $("#backend").val();
+            $("#backend").find("option:gt(0)").remove();
+            $("#programmers tbody").empty();
+            d.forEach(function(p) {
+                var label = p.Backend;
+                if (!p.Error) {
+                    label += " (" + p.Chip + ")";
+                }
+                $("#backend").append($("<option>").val(p.Backend).text(label));
+                $("#programmers tbody").append($("<tr>")
+                    .append($("<td>").text(p.Backend))
+                    .append($("<td>").text(p.Chip))
+                    .append($("<td>").text(p.Error || "Found")));
+            });
+            $("#backend").val(backend);
+        },
+        error: function(xhr) {
+            $("#program_status").text("Error: " + xhr.responseText);
+        },
+        complete: function() {
+            $("#detect").prop("disabled", false);
+        },
+    });
+};
+
+var PollProgram = function() {
+    $.ajax({
+        url: "/program/status",
+        method: "GET",
+        dataType: "json",
+        success: function(d) {
+            var percent = d.Total > 0 ? Math.round(100 * d.Done / d.Total) : 0;
+            $("#program_progress").css("width", percent + "%").text(d.Stage);
+            $("#program_progress").toggleClass("bg-danger", !!d.Error);
+            $("#program_progress").toggleClass("bg-success", d.Verified);
+
+            var status = d.Firmware + ": " + d.Total + " bytes at 0x" + d.Address.toString(16);
+            if (d.Backend) {
+                status += ", " + d.Backend;
+            }
+            if (d.Chip) {
+                status += " (" + d.Chip + ")";
+            }
+            if (d.Error) {
+                status += ". Error: " + d.Error;
+            } else if (d.Verified) {
+                status += ". Programmed and verified.";
+            }
+            $("#program_status").text(status);
+            $("#program").prop("disabled", !d.Finished);
+            if (!d.Finished) {
+                poll_timer = setTimeout(PollProgram, 500);
+            }
+        },
+    });
+};
+
+var StartProgram = function() {
+    clearTimeout(poll_timer);
+    var data = new FormData();
+    data.append("firmware", $("#firmware")[0].files[0]);
+    data.append("backend", $("#backend").val());
+    $.ajax({
+        url: "/program",
+        method: "POST",
+        data: data,
+        processData: false,
+        contentType: false,
+        success: function() {
+            PollProgram();
+        },
+        error: function(xhr) {
+            $("#program_status").text("Error: " + xhr.responseText);
+        },
+    });
+};
+
+$(document).ready(function() {
+    "use strict"
+    $("#program_form").submit(function(event) {
+        event.preventDefault();
+        StartProgram();
+    });
+    $("#detect").click(DetectProgrammers);
+    PollProgram();
+})
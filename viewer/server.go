@@ -15,19 +15,33 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/gocw"
+	"github.com/google/gocw/analysis"
 	"github.com/google/gocw/util"
 
 	"github.com/fsnotify/fsnotify"
@@ -36,12 +50,18 @@ import (
 )
 
 var (
+	listenFlag = flag.String("listen", "localhost",
+		"Address to listen on. Anyone reaching it can flash the target: bind other interfaces only on trusted networks")
 	portFlag = flag.Int("port", 8080, "Server HTTP port number")
 	dirFlag  = flag.String("dir", "captures", "Input captures directory to display")
 )
 
 const (
 	capExt = ".json.gz"
+	// Trace streams of the captures being written, see cmd/capture.go -stream.
+	streamExt = ".pb"
+	// Number of key bytes attacked by the dashboard (AES-128).
+	attackKeyBytes = 16
 )
 
 type TraceMetadata struct {
@@ -89,7 +109,7 @@ func watchDirectoryChanges(broker *util.Broker) {
 				event.Op&fsnotify.Create == fsnotify.Create ||
 				event.Op&fsnotify.Remove == fsnotify.Remove ||
 				event.Op&fsnotify.Rename == fsnotify.Rename {
-				if strings.HasSuffix(event.Name, capExt) {
+				if strings.HasSuffix(event.Name, capExt) || strings.HasSuffix(event.Name, streamExt) {
 					broker.Publish(event)
 				}
 			}
@@ -132,8 +152,878 @@ func waitForCaptures(c echo.Context, watcher *util.Broker) error {
 	return nil
 }
 
-func loadCapture(filename string) (gocw.Capture, error) {
-	return gocw.LoadCapture(path.Join(capturesDirectory(), filename+capExt))
+// Names may be globs (e.g. run_*), loaded as a single capture set.
+func streamFile(name string) string {
+	return path.Join(capturesDirectory(), name+streamExt)
+}
+
+// A capture still being written only has its trace stream.
+func isStreaming(name string) bool {
+	files, _ := filepath.Glob(path.Join(capturesDirectory(), name+capExt))
+	if len(files) > 0 {
+		return false
+	}
+	_, err := os.Stat(streamFile(name))
+	return err == nil
+}
+
+// Returns the file a capture is loaded from, see loadCapture.
+func captureFile(name string) string {
+	if isStreaming(name) {
+		return streamFile(name)
+	}
+	return path.Join(capturesDirectory(), name+capExt)
+}
+
+func loadCapture(name string) (gocw.Capture, error) {
+	if isStreaming(name) {
+		c, _, err := readStream(name, 0)
+		return c, err
+	}
+	return gocw.LoadCaptureSet(path.Join(capturesDirectory(), name+capExt))
+}
+
+// Reads the complete traces of a trace stream from offset. Returns them with
+// the offset of the end of the last one, to resume reading once the stream
+// has grown.
+func readStream(name string, offset int64) (gocw.Capture, int64, error) {
+	f, err := os.Open(streamFile(name))
+	if err != nil {
+		return nil, offset, err
+	}
+	defer f.Close()
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return nil, offset, err
+	}
+	var c gocw.Capture
+	d := gocw.NewTraceDecoder(f)
+	for {
+		var t gocw.Trace
+		err = d.Decode(&t)
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			// The last record may still be being written.
+			return c, offset + d.Offset(), nil
+		} else if err != nil {
+			return nil, offset, fmt.Errorf("%s: %v", streamFile(name), err)
+		}
+		c = append(c, t)
+	}
+}
+
+type Comparison struct {
+	MeanDiff  []float64 `json:"MeanDiff"`
+	T         []float64 `json:"T"`
+	Threshold float64   `json:"Threshold"`
+	// Samples where |T| exceeds Threshold.
+	Leaking []int `json:"Leaking"`
+}
+
+type KeyByteStatus struct {
+	Index    int     `json:"Index"`
+	Key      string  `json:"Key"`
+	Corr     float64 `json:"Corr"`
+	Location int     `json:"Location"`
+	// Location as time since the trigger, see gocw.TimeBase.Format.
+	Time string `json:"Time"`
+	// Correlation of the runner-up guess, to judge how distinct the best guess is.
+	NextCorr float64 `json:"NextCorr"`
+}
+
+type AttackStatus struct {
+	NumTraces int             `json:"NumTraces"`
+	Done      bool            `json:"Done"`
+	Error     string          `json:"Error,omitempty"`
+	Bytes     []KeyByteStatus `json:"Bytes"`
+	// Convergence: the trace count and best correlation of each byte, after each batch.
+	History [][]float64 `json:"History"`
+}
+
+// A CPA attack running against a single capture file.
+type attackSession struct {
+	mu       sync.Mutex
+	cpa      *analysis.CPA
+	timeBase gocw.TimeBase
+	status   AttackStatus
+	cancel   chan struct{}
+}
+
+var (
+	attacksMu sync.Mutex
+	attacks   = map[string]*attackSession{}
+)
+
+func (s *attackSession) snapshot() AttackStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := s.status
+	res.History = append([][]float64(nil), s.status.History...)
+	return res
+}
+
+// Updates the status after a batch of traces was added. Must hold s.mu.
+func (s *attackSession) updateStatus() {
+	s.status.NumTraces = s.cpa.NumTraces()
+	s.status.Bytes = make([]KeyByteStatus, attackKeyBytes)
+	point := []float64{float64(s.status.NumTraces)}
+	for b := 0; b < attackKeyBytes; b++ {
+		ranking := s.cpa.Ranking(b)
+		s.status.Bytes[b] = KeyByteStatus{b,
+			fmt.Sprintf("%02x", ranking[0].Key),
+			ranking[0].Corr,
+			ranking[0].Location,
+			s.timeBase.Format(ranking[0].Location),
+			ranking[1].Corr}
+		point = append(point, ranking[0].Corr)
+	}
+	s.status.History = append(s.status.History, point)
+}
+
+func (s *attackSession) fail(err error) {
+	glog.Errorf("Attack failed: %v", err)
+	s.mu.Lock()
+	s.status.Error = err.Error()
+	s.status.Done = true
+	s.mu.Unlock()
+}
+
+// Reads the traces of a capture as it grows: from its trace stream if it has
+// one, e.g. while it's being written, otherwise from the capture files.
+type captureFollower struct {
+	name   string
+	stream bool
+	// Of the next trace stream record.
+	offset int64
+	// Traces read so far from the capture files.
+	read int
+}
+
+func newCaptureFollower(name string) *captureFollower {
+	_, err := os.Stat(streamFile(name))
+	return &captureFollower{name: name, stream: err == nil}
+}
+
+// Returns the traces added since the last call, without baselines.
+func (f *captureFollower) next() (gocw.Capture, error) {
+	if f.stream {
+		c, offset, err := readStream(f.name, f.offset)
+		if err != nil {
+			return nil, err
+		}
+		f.offset = offset
+		return c.WithoutBaselines(), nil
+	}
+	c, err := loadCapture(f.name)
+	if err != nil {
+		return nil, err
+	}
+	c = c.WithoutBaselines()
+	if len(c) < f.read {
+		return nil, fmt.Errorf("Capture %s shrank from %d to %d traces", f.name, f.read, len(c))
+	}
+	added := c[f.read:]
+	f.read = len(c)
+	return added, nil
+}
+
+// Feeds the traces to the CPA engine in batches, starting with capture. If
+// live is set, keeps following the capture until the session is cancelled.
+// Read errors are then retried on the next change, as files may be caught
+// while being written.
+func (s *attackSession) run(f *captureFollower, capture gocw.Capture, batch int, live bool, broker *util.Broker) {
+	var dirChanged chan interface{}
+	if live {
+		dirChanged = broker.Subscribe()
+		defer broker.Unsubscribe(dirChanged)
+	}
+	for {
+		for next := 0; next < len(capture); next += batch {
+			select {
+			case <-s.cancel:
+				return
+			default:
+			}
+			end := next + batch
+			if end > len(capture) {
+				end = len(capture)
+			}
+			s.mu.Lock()
+			err := s.cpa.Add(capture[next:end]...)
+			if err == nil {
+				s.updateStatus()
+			}
+			s.mu.Unlock()
+			if err != nil {
+				s.fail(err)
+				return
+			}
+		}
+		if !live {
+			break
+		}
+		select {
+		case <-s.cancel:
+			return
+		case <-dirChanged:
+		}
+		var err error
+		if capture, err = f.next(); err != nil {
+			glog.Warningf("Failed reading %s, retrying on the next change: %v", f.name, err)
+		}
+	}
+	s.mu.Lock()
+	s.status.Done = true
+	s.mu.Unlock()
+}
+
+// Starts a new attack on a capture, replacing any running attack on it.
+// If maskName is set, only the samples selected by that mask file in the
+// captures directory are attacked.
+func startAttack(name, maskName string, batch int, live bool, broker *util.Broker) error {
+	f := newCaptureFollower(name)
+	capture, err := f.next()
+	if err != nil {
+		return err
+	}
+	if len(capture) == 0 {
+		return fmt.Errorf("Capture %s has no traces", name)
+	}
+	numSamples := len(capture[0].PowerMeasurements)
+	var mask *gocw.SampleMask
+	if len(maskName) > 0 {
+		if mask, err = gocw.LoadSampleMask(path.Join(capturesDirectory(), filepath.Base(maskName))); err != nil {
+			return err
+		}
+		if len(mask.Indices(numSamples)) == 0 {
+			return fmt.Errorf("Mask %s selects none of the %d samples", maskName, numSamples)
+		}
+	}
+	s := &attackSession{
+		cpa:      analysis.NewMaskedCPA(analysis.SboxHammingWeight, analysis.PlaintextInput, attackKeyBytes, numSamples, mask),
+		timeBase: gocw.LoadTimeBase(path.Join(capturesDirectory(), name+capExt)),
+		cancel:   make(chan struct{}),
+	}
+	attacksMu.Lock()
+	if old, ok := attacks[name]; ok {
+		close(old.cancel)
+	}
+	attacks[name] = s
+	attacksMu.Unlock()
+	go s.run(f, capture, batch, live, broker)
+	return nil
+}
+
+// Returns true if hostname may be used to reach a server listening on
+// listen. Loopback servers only answer loopback names, so that other sites
+// can't reach them by resolving their own names to 127.0.0.1.
+func allowedHost(hostname, listen string) bool {
+	isLoopback := func(host string) bool {
+		ip := net.ParseIP(host)
+		return host == "localhost" || (ip != nil && ip.IsLoopback())
+	}
+	if isLoopback(listen) {
+		return isLoopback(hostname)
+	}
+	if ip := net.ParseIP(listen); len(listen) == 0 || (ip != nil && ip.IsUnspecified()) {
+		return true
+	}
+	return isLoopback(hostname) || strings.EqualFold(hostname, listen)
+}
+
+// Returns an error unless r may change the server state: its Host matches
+// the listen address, and its Origin, if any, is the server itself. Browsers
+// send the Origin of cross-site form posts and scripts.
+func checkSameOrigin(r *http.Request, listen string) error {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if !allowedHost(host, listen) {
+		return fmt.Errorf("Unexpected host %q", r.Host)
+	}
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return nil
+	}
+	if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+		return fmt.Errorf("Cross-origin request from %q", origin)
+	}
+	return nil
+}
+
+// Rejects state changing requests from other sites, see checkSameOrigin.
+func rejectCrossSite(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		r := c.Request()
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			return next(c)
+		}
+		if err := checkSameOrigin(r, *listenFlag); err != nil {
+			glog.Warningf("Rejected %s %s: %v", r.Method, r.URL.Path, err)
+			return c.String(http.StatusForbidden, err.Error())
+		}
+		return next(c)
+	}
+}
+
+// Size of the capture thumbnails, in pixels.
+const thumbnailWidth, thumbnailHeight = 160, 32
+
+type thumbnail struct {
+	// Of the capture file the thumbnail was rendered from.
+	modTime time.Time
+	png     []byte
+}
+
+var (
+	thumbnailsMu sync.Mutex
+	thumbnails   = map[string]thumbnail{}
+	// Held while refreshing, so scans don't render the same thumbnails twice.
+	refreshMu sync.Mutex
+)
+
+// Renders the mean trace of a capture file as a PNG. Baseline traces are left
+// out.
+func renderThumbnail(name string) ([]byte, error) {
+	capture, err := loadCapture(name)
+	if err != nil {
+		return nil, err
+	}
+	var sum []float64
+	var count []int
+	for _, t := range capture {
+		if t.Baseline {
+			continue
+		}
+		for i, s := range t.PowerMeasurements {
+			if i == len(sum) {
+				sum = append(sum, 0)
+				count = append(count, 0)
+			}
+			sum[i] += float64(s)
+			count[i]++
+		}
+	}
+	for i := range sum {
+		sum[i] /= float64(count[i])
+	}
+	var buf bytes.Buffer
+	if err = png.Encode(&buf, util.RenderThumbnail(sum, thumbnailWidth, thumbnailHeight)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Returns the PNG thumbnail of a capture file. Thumbnails are cached until the
+// file changes.
+func captureThumbnail(name string) ([]byte, error) {
+	info, err := os.Stat(captureFile(name))
+	if err != nil {
+		return nil, err
+	}
+	thumbnailsMu.Lock()
+	t, ok := thumbnails[name]
+	thumbnailsMu.Unlock()
+	if ok && t.modTime.Equal(info.ModTime()) {
+		return t.png, nil
+	}
+	glog.V(1).Infof("Rendering thumbnail of %s", name)
+	if t.png, err = renderThumbnail(name); err != nil {
+		return nil, err
+	}
+	t.modTime = info.ModTime()
+	thumbnailsMu.Lock()
+	thumbnails[name] = t
+	thumbnailsMu.Unlock()
+	return t.png, nil
+}
+
+// Renders the thumbnails of new or changed capture files after a directory
+// scan, and drops the ones of removed files.
+func refreshThumbnails(names []string) {
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+	listed := make(map[string]bool)
+	for _, name := range names {
+		listed[name] = true
+		if _, err := captureThumbnail(name); err != nil {
+			// e.g. a capture being written.
+			glog.V(1).Infof("Failed rendering thumbnail of %s: %v", name, err)
+		}
+	}
+	thumbnailsMu.Lock()
+	for name := range thumbnails {
+		if !listed[name] {
+			delete(thumbnails, name)
+		}
+	}
+	thumbnailsMu.Unlock()
+}
+
+// Viewer UI state, shared by short ID so links open the exact same view.
+type ViewState struct {
+	Capture string `json:"Capture"`
+	// Overlaid traces.
+	Traces []int `json:"Traces"`
+	// Zoomed sample range [start, end] of the trace plot, empty if not zoomed.
+	Zoom []float64 `json:"Zoom,omitempty"`
+	// Capture compared with, empty for none.
+	Compare string `json:"Compare,omitempty"`
+}
+
+// Saved view states, by ID. Persisted in the captures directory, so links
+// survive server restarts.
+const viewStatesFile = ".viewer_states.json"
+
+var (
+	viewStatesMu sync.Mutex
+	viewStates   map[string]ViewState
+)
+
+// Loads the saved states on first use. Must hold viewStatesMu.
+func loadViewStates() {
+	if viewStates != nil {
+		return
+	}
+	viewStates = map[string]ViewState{}
+	buf, err := ioutil.ReadFile(path.Join(capturesDirectory(), viewStatesFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			glog.Warningf("Failed reading saved view states: %v", err)
+		}
+		return
+	}
+	if err = json.Unmarshal(buf, &viewStates); err != nil {
+		glog.Warningf("Failed decoding saved view states: %v", err)
+	}
+}
+
+// Saves a state, and returns its ID. IDs are derived from the state, so
+// sharing the same view twice gives the same link.
+func saveViewState(state ViewState) (string, error) {
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256(buf)
+	id := hex.EncodeToString(digest[:])[:10]
+
+	viewStatesMu.Lock()
+	defer viewStatesMu.Unlock()
+	loadViewStates()
+	if _, ok := viewStates[id]; ok {
+		return id, nil
+	}
+	viewStates[id] = state
+	if buf, err = json.Marshal(viewStates); err != nil {
+		return "", err
+	}
+	// Written to a temporary file first, so a crash doesn't lose older states.
+	filename := path.Join(capturesDirectory(), viewStatesFile)
+	if err = ioutil.WriteFile(filename+".tmp", buf, 0644); err != nil {
+		return "", err
+	}
+	return id, os.Rename(filename+".tmp", filename)
+}
+
+func viewState(id string) (ViewState, bool) {
+	viewStatesMu.Lock()
+	defer viewStatesMu.Unlock()
+	loadViewStates()
+	state, ok := viewStates[id]
+	return state, ok
+}
+
+// Default size and resolution of exported figures, fitting a report column.
+const (
+	figureWidth  = 6.0
+	figureHeight = 4.0
+	figureDpi    = 300
+	// Bounds of the requested figure size and resolution. PNG figures are
+	// rendered in memory, so their pixel count is bounded too.
+	maxFigureSize   = 50.0
+	maxFigureDpi    = 1200
+	maxFigurePixels = 50e6
+)
+
+// Returns the X axis label and sample index mapping of the figures of a
+// capture: time since the trigger when the time base is known, else sample
+// indices.
+func figureAxis(tb gocw.TimeBase) (string, func(sample int) float64) {
+	if !tb.Known() {
+		return "Sample", nil
+	}
+	return "Time since trigger (µs)", func(sample int) float64 {
+		return tb.Seconds(sample) * 1e6
+	}
+}
+
+// Returns the zoomed sample range [start, end) of n samples, from the start
+// and end query parameters. Missing or invalid bounds select all samples.
+func figureRange(c echo.Context, n int) (int, int) {
+	start, end := 0, n
+	if v, err := strconv.ParseFloat(c.QueryParam("start"), 64); err == nil && v > 0 {
+		start = int(v)
+	}
+	if v, err := strconv.ParseFloat(c.QueryParam("end"), 64); err == nil && int(v)+1 < end {
+		end = int(v) + 1
+	}
+	if start >= end {
+		return 0, n
+	}
+	return start, end
+}
+
+// Parses a positive query parameter no larger than max, def if missing.
+func figureParam(c echo.Context, name string, def, max float64) (float64, error) {
+	s := c.QueryParam(name)
+	if len(s) == 0 {
+		return def, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || !(v > 0 && v <= max) {
+		return 0, fmt.Errorf("Invalid %s %q, must be in (0, %g]", name, s, max)
+	}
+	return v, nil
+}
+
+// Renders a figure, in the format, size and resolution of the query
+// parameters: format (svg or png), width and height (inches, at most
+// maxFigureSize), dpi (at most maxFigureDpi). Out of range values are
+// rejected with 400 Bad Request.
+func writeFigure(c echo.Context, f *util.Figure) error {
+	format := c.QueryParam("format")
+	if len(format) == 0 {
+		format = util.FigureSvg
+	}
+	width, err := figureParam(c, "width", figureWidth, maxFigureSize)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	height, err := figureParam(c, "height", figureHeight, maxFigureSize)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	dpi, err := figureParam(c, "dpi", figureDpi, maxFigureDpi)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	if format == util.FigurePng && width*height*dpi*dpi > maxFigurePixels {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("Figure of %gx%g inches at %g dpi is too large", width, height, dpi))
+	}
+	var buf bytes.Buffer
+	if err = f.Render(&buf, format, width, height, int(dpi)); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	contentType := "image/png"
+	if format == util.FigureSvg {
+		contentType = "image/svg+xml"
+	}
+	return c.Blob(http.StatusOK, contentType, buf.Bytes())
+}
+
+// Returns a figure of traces of a capture file, for reports.
+// Query parameters: traces (comma separated indices), stat=mean (mean and
+// standard deviation of all the traces instead), start, end (sample range),
+// and the figure format, see writeFigure.
+func captureFigure(c echo.Context) error {
+	name := c.Param("capture")
+	capture, err := loadCapture(name)
+	if err != nil {
+		glog.Errorf("Error loading capture file: %v", err)
+		return err
+	}
+	if len(capture) == 0 {
+		return c.String(http.StatusNotFound, "Empty capture")
+	}
+	var traces []int
+	for _, v := range strings.Split(c.QueryParam("traces"), ",") {
+		if len(v) == 0 {
+			continue
+		}
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid traces")
+		}
+		traces = append(traces, i)
+	}
+	start, end := figureRange(c, len(capture[0].PowerMeasurements))
+	f, err := traceFigure(name, capture, traces, c.QueryParam("stat") == "mean", start, end)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	return writeFigure(c, f)
+}
+
+// Returns the figure of traces of a capture, over samples [start, end). With
+// stat, plots the mean and standard deviation of all the traces but the
+// baselines instead.
+func traceFigure(name string, capture gocw.Capture, traces []int, stat bool, start, end int) (*util.Figure, error) {
+	xlabel, x := figureAxis(gocw.LoadTimeBase(path.Join(capturesDirectory(), name+capExt)))
+	f := &util.Figure{Title: name, XLabel: xlabel, YLabel: "Power", X: x}
+	if stat {
+		var mean, std []float64
+		n := 0
+		for _, t := range capture.WithoutBaselines() {
+			if len(t.PowerMeasurements) < end {
+				return nil, fmt.Errorf("Traces have fewer than %d samples", end)
+			}
+			if mean == nil {
+				mean, std = make([]float64, end-start), make([]float64, end-start)
+			}
+			// Welford's online mean and variance.
+			n++
+			for i, s := range t.PowerMeasurements[start:end] {
+				d := float64(s) - mean[i]
+				mean[i] += d / float64(n)
+				std[i] += d * (float64(s) - mean[i])
+			}
+		}
+		if n < 2 {
+			return nil, fmt.Errorf("Capture %s has fewer than 2 traces", name)
+		}
+		for i := range std {
+			std[i] = math.Sqrt(std[i] / float64(n-1))
+		}
+		f.Title = fmt.Sprintf("%s, mean ± std of %d traces", name, n)
+		f.Series = []util.FigureSeries{{Y: mean, Start: start, Spread: std}}
+		return f, nil
+	}
+	for _, i := range traces {
+		if i < 0 || i >= len(capture) {
+			return nil, fmt.Errorf("Invalid trace %d", i)
+		}
+		y := make([]float64, 0, end-start)
+		for j := start; j < end && j < len(capture[i].PowerMeasurements); j++ {
+			y = append(y, float64(capture[i].PowerMeasurements[j]))
+		}
+		f.Series = append(f.Series, util.FigureSeries{Name: fmt.Sprintf("trace %d", i), Y: y, Start: start})
+	}
+	if len(f.Series) == 0 {
+		return nil, fmt.Errorf("No traces selected")
+	}
+	return f, nil
+}
+
+type ProgramStatus struct {
+	Backend  string `json:"Backend"`
+	Chip     string `json:"Chip"`
+	Firmware string `json:"Firmware"`
+	Address  uint32 `json:"Address"`
+	// Current stage and progress, see util.ProgramProgress.
+	Stage    string `json:"Stage"`
+	Done     int    `json:"Done"`
+	Total    int    `json:"Total"`
+	Verified bool   `json:"Verified"`
+	Finished bool   `json:"Finished"`
+	Error    string `json:"Error,omitempty"`
+}
+
+// The last programming job. Only one job runs at a time, as it owns the
+// device.
+var (
+	programMu     sync.Mutex
+	programStatus *ProgramStatus
+)
+
+func updateProgramStatus(update func(s *ProgramStatus)) {
+	programMu.Lock()
+	update(programStatus)
+	programMu.Unlock()
+}
+
+// Flashes firmware to the target, reporting progress in programStatus.
+func runProgram(backend string, firmware *util.Segment) {
+	prog, name, err := util.OpenProgrammer(backend)
+	if err == nil {
+		defer prog.Close()
+		updateProgramStatus(func(s *ProgramStatus) {
+			s.Backend = name
+			s.Chip = util.ChipName(prog)
+		})
+		err = util.ProgramDeviceProgress(prog, firmware, func(p util.ProgramProgress) {
+			updateProgramStatus(func(s *ProgramStatus) {
+				s.Stage, s.Done, s.Total = p.Stage, p.Done, p.Total
+			})
+		})
+	}
+	if err != nil {
+		glog.Errorf("Programming failed: %v", err)
+	}
+	updateProgramStatus(func(s *ProgramStatus) {
+		if err != nil {
+			s.Error = err.Error()
+		} else {
+			s.Verified = true
+		}
+		s.Finished = true
+	})
+}
+
+// Starts flashing firmware, unless a programming job is already running.
+func startProgram(backend, filename string, firmware *util.Segment) error {
+	programMu.Lock()
+	defer programMu.Unlock()
+	if programStatus != nil && !programStatus.Finished {
+		return fmt.Errorf("Already programming %s", programStatus.Firmware)
+	}
+	programStatus = &ProgramStatus{
+		Backend:  backend,
+		Firmware: filename,
+		Address:  firmware.Address,
+		Total:    len(firmware.Data),
+	}
+	go runProgram(backend, firmware)
+	return nil
+}
+
+func programming() bool {
+	programMu.Lock()
+	defer programMu.Unlock()
+	return programStatus != nil && !programStatus.Finished
+}
+
+// The device panel. The device is opened for each read and closed after, so
+// captures can use it, and polled only while clients wait for changes. While
+// the device can't be read, e.g. in use by a capture or unplugged, polls back
+// off up to maxDevicePollInterval.
+const (
+	devicePollInterval    = 2 * time.Second
+	maxDevicePollInterval = 30 * time.Second
+)
+
+type DeviceStatus struct {
+	Info  *gocw.DeviceInfo  `json:"Info,omitempty"`
+	State *gocw.DeviceState `json:"State,omitempty"`
+	// Why the device couldn't be read, e.g. not connected or busy.
+	Error string `json:"Error,omitempty"`
+}
+
+var (
+	deviceMu       sync.Mutex
+	deviceStatus   *DeviceStatus
+	deviceUpdated  time.Time
+	deviceWatchers int
+	// Delay before the next poll, see nextDevicePoll.
+	devicePoll = devicePollInterval
+)
+
+// Reads the status of the device. The info of the previous status is reused
+// if it has the same serial number, as it doesn't change while plugged.
+func readDeviceStatus(prev *DeviceStatus) DeviceStatus {
+	if programming() {
+		return DeviceStatus{Error: "Device is busy programming"}
+	}
+	dev, err := gocw.OpenUsbDevice()
+	if err != nil {
+		return DeviceStatus{Error: err.Error()}
+	}
+	defer dev.Close()
+	var info gocw.DeviceInfo
+	if sn, err := dev.SerialNumber(); err == nil && prev != nil && prev.Info != nil &&
+		prev.Info.Model == dev.Model() && prev.Info.Serial == sn {
+		info = *prev.Info
+	} else if info, err = dev.Info(); err != nil {
+		return DeviceStatus{Error: err.Error()}
+	}
+	fpga, err := gocw.AttachFpga(dev)
+	if err != nil {
+		return DeviceStatus{Error: err.Error()}
+	}
+	adc, err := gocw.AttachAdc(fpga)
+	if err != nil {
+		return DeviceStatus{Error: err.Error()}
+	}
+	state := adc.DeviceState()
+	return DeviceStatus{Info: &info, State: &state}
+}
+
+// Returns the delay before polling again after reading s: doubled while the
+// device can't be read, reset once it can.
+func nextDevicePoll(delay time.Duration, s DeviceStatus) time.Duration {
+	if len(s.Error) == 0 {
+		return devicePollInterval
+	}
+	if delay *= 2; delay > maxDevicePollInterval {
+		delay = maxDevicePollInterval
+	}
+	return delay
+}
+
+// Reads the device status, and schedules the next poll. Must be called with
+// deviceMu held.
+func updateDeviceStatus() DeviceStatus {
+	s := readDeviceStatus(deviceStatus)
+	deviceStatus, deviceUpdated = &s, time.Now()
+	devicePoll = nextDevicePoll(devicePoll, s)
+	return s
+}
+
+// Returns the device status, read again unless polled recently.
+func currentDeviceStatus() DeviceStatus {
+	deviceMu.Lock()
+	defer deviceMu.Unlock()
+	if deviceStatus == nil || time.Since(deviceUpdated) > devicePoll {
+		updateDeviceStatus()
+	}
+	return *deviceStatus
+}
+
+// Whether the settings or health of the device changed. Measured clock
+// frequencies jitter, and are ignored.
+func deviceChanged(a, b DeviceStatus) bool {
+	settings := func(s DeviceStatus) DeviceStatus {
+		if s.State != nil {
+			state := *s.State
+			state.Config.AdcFreq = 0
+			state.Clock.AdcFreq = 0
+			state.Clock.FreqCounter = 0
+			s.State = &state
+		}
+		return s
+	}
+	return !reflect.DeepEqual(settings(a), settings(b))
+}
+
+// A go-routine that polls the device while clients wait for changes.
+// Notifies changes by publishing the new status via broker.
+func watchDevice(broker *util.Broker) {
+	delay := devicePollInterval
+	for {
+		time.Sleep(delay)
+		deviceMu.Lock()
+		if deviceWatchers == 0 {
+			delay = devicePollInterval
+			deviceMu.Unlock()
+			continue
+		}
+		prev := deviceStatus
+		s := updateDeviceStatus()
+		delay = devicePoll
+		changed := prev == nil || deviceChanged(*prev, s)
+		deviceMu.Unlock()
+		if changed {
+			broker.Publish(s)
+		}
+	}
+}
+
+func waitForDevice(c echo.Context, watcher *util.Broker) {
+	deviceMu.Lock()
+	deviceWatchers++
+	deviceMu.Unlock()
+	defer func() {
+		deviceMu.Lock()
+		deviceWatchers--
+		deviceMu.Unlock()
+	}()
+
+	changed := watcher.Subscribe()
+	defer watcher.Unsubscribe(changed)
+	select {
+	case <-time.After(time.Minute):
+	case <-c.Request().Context().Done():
+	case <-changed:
+	}
 }
 
 func main() {
@@ -142,13 +1032,22 @@ func main() {
 	watchBroker := util.NewBroker()
 	go watchBroker.Start()
 	go watchDirectoryChanges(watchBroker)
+	deviceBroker := util.NewBroker()
+	go deviceBroker.Start()
+	go watchDevice(deviceBroker)
 
 	e := echo.New()
+	e.Use(rejectCrossSite)
 
 	// Static files.
 	e.File("/", "viewer/index.html")
 	e.File("/viewer.js", "viewer/viewer.js")
 	e.File("/viewer.css", "viewer/viewer.css")
+	e.File("/attack", "viewer/attack.html")
+	e.File("/attack.js", "viewer/attack.js")
+	e.File("/program", "viewer/program.html")
+	e.File("/program.js", "viewer/program.js")
+	e.File("/timebase.js", "viewer/timebase.js")
 
 	// Returns list of capture files in directory.
 	e.GET("/captures", func(c echo.Context) error {
@@ -163,8 +1062,25 @@ func main() {
 		for i, f := range files {
 			files[i] = strings.TrimSuffix(filepath.Base(f), capExt)
 		}
+		// Captures still being written.
+		streams, _ := filepath.Glob(path.Join(capturesDirectory(), "*"+streamExt))
+		for _, f := range streams {
+			if name := strings.TrimSuffix(filepath.Base(f), streamExt); isStreaming(name) {
+				files = append(files, name)
+			}
+		}
+		sort.Strings(files)
+		go refreshThumbnails(files)
 		return c.JSON(http.StatusOK, files)
 	})
+	// Returns a PNG thumbnail of the mean trace of a capture file.
+	e.GET("/thumbnail/:capture", func(c echo.Context) error {
+		buf, err := captureThumbnail(c.Param("capture"))
+		if err != nil {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		return c.Blob(http.StatusOK, "image/png", buf)
+	})
 
 	// Returns trace data from a single capture file.
 	e.GET("/data/:capture", func(c echo.Context) error {
@@ -197,5 +1113,204 @@ func main() {
 		return c.JSON(http.StatusOK, capture[trace].PowerMeasurements)
 	})
 
-	glog.Fatal(e.Start(fmt.Sprintf(":%d", *portFlag)))
+	// Returns the time base of a capture file, to label sample indices. The
+	// SampleRate is zero if the capture has no recorded scope configuration.
+	e.GET("/timebase/:capture", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, gocw.LoadTimeBase(path.Join(capturesDirectory(), c.Param("capture")+capExt)))
+	})
+
+	// Returns a PNG heatmap of all the traces in a capture file.
+	// Query parameters: width, height (maximum image size in pixels).
+	e.GET("/heatmap/:capture", func(c echo.Context) error {
+		capture, err := loadCapture(c.Param("capture"))
+		if err != nil {
+			glog.Errorf("Error loading capture file: %v", err)
+			return err
+		}
+		if len(capture) == 0 {
+			return c.String(http.StatusNotFound, "Empty capture")
+		}
+		width, _ := strconv.Atoi(c.QueryParam("width"))
+		height, _ := strconv.Atoi(c.QueryParam("height"))
+		img := util.RenderHeatmap(capture.SamplesMatrix(), width, height)
+		c.Response().Header().Set(echo.HeaderContentType, "image/png")
+		return png.Encode(c.Response(), img)
+	})
+
+	// Returns a figure of traces of a capture file, for reports.
+	e.GET("/figure/:capture", captureFigure)
+
+	// Compares two capture files with Welch's t-test.
+	e.GET("/compare/:a/:b", func(c echo.Context) error {
+		var captures [2]gocw.Capture
+		for i, name := range []string{c.Param("a"), c.Param("b")} {
+			var err error
+			if captures[i], err = loadCapture(name); err != nil {
+				glog.Errorf("Error loading capture file: %v", err)
+				return err
+			}
+			if len(captures[i]) < 2 {
+				return c.String(http.StatusBadRequest, "Captures must have at least 2 traces")
+			}
+		}
+		A, B := captures[0].SamplesMatrix(), captures[1].SamplesMatrix()
+		if _, ca := A.Dims(); ca != len(captures[1][0].PowerMeasurements) {
+			return c.String(http.StatusBadRequest, "Captures have different number of samples")
+		}
+		t := analysis.WelchT(A, B)
+		return c.JSON(http.StatusOK, Comparison{analysis.MeanDiff(A, B), t,
+			analysis.TVLAThreshold, analysis.LeakingSamples(t, analysis.TVLAThreshold)})
+	})
+
+	// Saves the posted ViewState, and returns its ID.
+	e.POST("/state", func(c echo.Context) error {
+		var state ViewState
+		if err := c.Bind(&state); err != nil || len(state.Capture) == 0 {
+			return c.String(http.StatusBadRequest, "Invalid view state")
+		}
+		id, err := saveViewState(state)
+		if err != nil {
+			glog.Errorf("Error saving view state: %v", err)
+			return err
+		}
+		return c.JSON(http.StatusOK, map[string]string{"Id": id})
+	})
+	// Returns a saved ViewState.
+	e.GET("/state/:id", func(c echo.Context) error {
+		state, ok := viewState(c.Param("id"))
+		if !ok {
+			return c.String(http.StatusNotFound, "Unknown view state")
+		}
+		return c.JSON(http.StatusOK, state)
+	})
+
+	// Starts a CPA attack on a capture file.
+	// Query parameters: batch (traces per update), live (follow file changes),
+	// mask (sample mask file in the captures directory).
+	e.POST("/attack/:capture", func(c echo.Context) error {
+		batch, err := strconv.Atoi(c.QueryParam("batch"))
+		if err != nil || batch <= 0 {
+			batch = 10
+		}
+		err = startAttack(c.Param("capture"), c.QueryParam("mask"), batch, c.QueryParam("live") == "true", watchBroker)
+		if err != nil {
+			glog.Errorf("Error starting attack: %v", err)
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		return c.NoContent(http.StatusAccepted)
+	})
+	// Returns the current status of an attack.
+	e.GET("/attack/:capture", func(c echo.Context) error {
+		attacksMu.Lock()
+		s, ok := attacks[c.Param("capture")]
+		attacksMu.Unlock()
+		if !ok {
+			return c.String(http.StatusNotFound, "No attack running")
+		}
+		return c.JSON(http.StatusOK, s.snapshot())
+	})
+	// Returns the correlation trace of the best guess of a key byte.
+	e.GET("/attack/:capture/:byte", func(c echo.Context) error {
+		attacksMu.Lock()
+		s, ok := attacks[c.Param("capture")]
+		attacksMu.Unlock()
+		b, err := strconv.Atoi(c.Param("byte"))
+		if !ok || err != nil || b < 0 || b >= attackKeyBytes {
+			return c.String(http.StatusNotFound, "Invalid attack or key byte")
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.cpa.NumTraces() == 0 {
+			return c.JSON(http.StatusOK, []float64{})
+		}
+		return c.JSON(http.StatusOK, s.cpa.Correlation(b, s.cpa.Ranking(b)[0].Key))
+	})
+
+	// Returns a figure of the correlation traces of the best two guesses of a
+	// key byte. Query parameters: start, end (sample range), and the figure
+	// format, see writeFigure.
+	e.GET("/attack/:capture/:byte/figure", func(c echo.Context) error {
+		name := c.Param("capture")
+		attacksMu.Lock()
+		s, ok := attacks[name]
+		attacksMu.Unlock()
+		b, err := strconv.Atoi(c.Param("byte"))
+		if !ok || err != nil || b < 0 || b >= attackKeyBytes {
+			return c.String(http.StatusNotFound, "Invalid attack or key byte")
+		}
+		xlabel, x := figureAxis(s.timeBase)
+		f := &util.Figure{
+			Title:  fmt.Sprintf("%s, key byte %d", name, b),
+			XLabel: xlabel,
+			YLabel: "Correlation",
+			X:      x,
+		}
+		s.mu.Lock()
+		if s.cpa.NumTraces() > 0 {
+			f.Title += fmt.Sprintf(", %d traces", s.cpa.NumTraces())
+			for _, guess := range s.cpa.Ranking(b)[:2] {
+				corr := s.cpa.Correlation(b, guess.Key)
+				start, end := figureRange(c, len(corr))
+				f.Series = append(f.Series, util.FigureSeries{
+					Name:  fmt.Sprintf("guess %02x", guess.Key),
+					Y:     corr[start:end],
+					Start: start,
+				})
+			}
+		}
+		s.mu.Unlock()
+		if len(f.Series) == 0 {
+			return c.String(http.StatusNotFound, "No traces attacked yet")
+		}
+		return writeFigure(c, f)
+	})
+
+	// Lists the programmer backends, and the chip each one detects.
+	e.GET("/programmers", func(c echo.Context) error {
+		if programming() {
+			return c.String(http.StatusConflict, "Device is busy programming")
+		}
+		return c.JSON(http.StatusOK, util.DetectProgrammers())
+	})
+	// Flashes an uploaded Intel-Hex file (form file "firmware") to the target.
+	// Form value backend selects the programmer, empty for auto detection.
+	e.POST("/program", func(c echo.Context) error {
+		fh, err := c.FormFile("firmware")
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Missing firmware file")
+		}
+		f, err := fh.Open()
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		defer f.Close()
+		firmware, err := util.LoadIntelHexIo(f)
+		if err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("Invalid hex file: %v", err))
+		}
+		if err = startProgram(c.FormValue("backend"), fh.Filename, firmware); err != nil {
+			return c.String(http.StatusConflict, err.Error())
+		}
+		return c.NoContent(http.StatusAccepted)
+	})
+	// Returns the status of the last programming job.
+	e.GET("/program/status", func(c echo.Context) error {
+		programMu.Lock()
+		defer programMu.Unlock()
+		if programStatus == nil {
+			return c.String(http.StatusNotFound, "No programming job")
+		}
+		return c.JSON(http.StatusOK, *programStatus)
+	})
+
+	// Returns the live device settings, clocks, versions and health. With
+	// wait=true, returns once they change, or after a minute.
+	e.GET("/device", func(c echo.Context) error {
+		if c.QueryParam("wait") == "true" {
+			waitForDevice(c, deviceBroker)
+		}
+		return c.JSON(http.StatusOK, currentDeviceStatus())
+	})
+
+	glog.Fatal(e.Start(net.JoinHostPort(*listenFlag, strconv.Itoa(*portFlag))))
 }
@@ -0,0 +1,183 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gocw"
+	"github.com/labstack/echo"
+)
+
+// Points the captures directory to a temporary one, and returns it.
+func tempCapturesDir(t *testing.T) string {
+	dir := t.TempDir()
+	rel, err := filepath.Rel(projectRoot(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := *dirFlag
+	*dirFlag = rel
+	t.Cleanup(func() { *dirFlag = old })
+	return dir
+}
+
+// Serves captureFigure from a captures directory holding capture "test".
+func figureServer(t *testing.T) *echo.Echo {
+	dir := tempCapturesDir(t)
+	var capture gocw.Capture
+	for i := 0; i < 4; i++ {
+		capture = append(capture, gocw.Trace{
+			Key:               make([]byte, 16),
+			Pt:                []byte{byte(i)},
+			PowerMeasurements: []gocw.Sample{0.1, gocw.Sample(i) / 10, 0.2, 0.1},
+		})
+	}
+	if err := capture.Save(path.Join(dir, "test"+capExt)); err != nil {
+		t.Fatal(err)
+	}
+	e := echo.New()
+	e.GET("/figure/:capture", captureFigure)
+	return e
+}
+
+func TestCaptureFigure(t *testing.T) {
+	e := figureServer(t)
+	for _, test := range []struct {
+		query       string
+		code        int
+		contentType string
+	}{
+		{"traces=0,1", http.StatusOK, "image/svg+xml"},
+		{"stat=mean&start=1&end=2", http.StatusOK, "image/svg+xml"},
+		{"traces=0&format=png&width=2&height=1&dpi=50", http.StatusOK, "image/png"},
+		{"traces=x", http.StatusBadRequest, ""},
+		{"traces=0&format=gif", http.StatusBadRequest, ""},
+		// Sizes and resolutions out of range.
+		{"traces=0&width=0", http.StatusBadRequest, ""},
+		{"traces=0&height=-1", http.StatusBadRequest, ""},
+		{"traces=0&width=1e9", http.StatusBadRequest, ""},
+		{"traces=0&width=NaN", http.StatusBadRequest, ""},
+		{"traces=0&dpi=100000", http.StatusBadRequest, ""},
+		{"traces=0&format=png&width=50&height=50&dpi=1200", http.StatusBadRequest, ""},
+	} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/figure/test?"+test.query, nil))
+		if rec.Code != test.code {
+			t.Errorf("%s: status %d, want %d: %s", test.query, rec.Code, test.code, rec.Body)
+			continue
+		}
+		if ct := rec.Header().Get(echo.HeaderContentType); !strings.HasPrefix(ct, test.contentType) {
+			t.Errorf("%s: content type %q, want %q", test.query, ct, test.contentType)
+		}
+	}
+}
+
+func TestNextDevicePoll(t *testing.T) {
+	busy := DeviceStatus{Error: "busy"}
+	delay := devicePollInterval
+	for _, want := range []time.Duration{4 * time.Second, 8 * time.Second, 16 * time.Second,
+		maxDevicePollInterval, maxDevicePollInterval} {
+		if delay = nextDevicePoll(delay, busy); delay != want {
+			t.Errorf("Polling after %v, want %v", delay, want)
+		}
+	}
+	if delay = nextDevicePoll(delay, DeviceStatus{}); delay != devicePollInterval {
+		t.Errorf("Polling after %v once read, want %v", delay, devicePollInterval)
+	}
+}
+
+func TestCaptureFollowerReadsGrowingStream(t *testing.T) {
+	dir := tempCapturesDir(t)
+	f, err := os.Create(path.Join(dir, "live"+streamExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var record bytes.Buffer
+	e := gocw.NewTraceEncoder(&record)
+	write := func(key byte, partial bool) {
+		record.Reset()
+		if err := e.Encode(&gocw.Trace{Key: []byte{key}, PowerMeasurements: []gocw.Sample{1}}); err != nil {
+			t.Fatal(err)
+		}
+		b := record.Bytes()
+		if partial {
+			b = b[:len(b)/2]
+		}
+		if _, err := f.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !isStreaming("live") {
+		t.Fatal("Capture with only a trace stream isn't streaming")
+	}
+	follower := newCaptureFollower("live")
+	write(1, false)
+	write(2, false)
+	// Half of the third trace is written.
+	write(3, true)
+	if c, err := follower.next(); err != nil || len(c) != 2 {
+		t.Fatalf("Read %d traces, %v, want 2", len(c), err)
+	}
+	if c, err := follower.next(); err != nil || len(c) != 0 {
+		t.Fatalf("Read %d traces, %v without changes", len(c), err)
+	}
+	// Completes the third trace.
+	half := record.Len() / 2
+	if _, err = f.Write(record.Bytes()[half:]); err != nil {
+		t.Fatal(err)
+	}
+	write(4, false)
+	c, err := follower.next()
+	if err != nil || len(c) != 2 || c[0].Key[0] != 3 || c[1].Key[0] != 4 {
+		t.Errorf("Read %+v, %v, want traces 3 and 4", c, err)
+	}
+}
+
+func TestCheckSameOrigin(t *testing.T) {
+	for _, test := range []struct {
+		listen, host, origin string
+		ok                   bool
+	}{
+		{"localhost", "localhost:8080", "", true},
+		{"localhost", "127.0.0.1:8080", "http://127.0.0.1:8080", true},
+		{"localhost", "localhost:8080", "http://evil.example", false},
+		// DNS rebinding of another site to the loopback address.
+		{"localhost", "evil.example:8080", "http://evil.example:8080", false},
+		{"lab-pc", "lab-pc:8080", "http://lab-pc:8080", true},
+		{"lab-pc", "other:8080", "", false},
+		{"0.0.0.0", "lab-pc:8080", "http://lab-pc:8080", true},
+		{"0.0.0.0", "lab-pc:8080", "null", false},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "http://"+test.host+"/program", nil)
+		if len(test.origin) > 0 {
+			r.Header.Set("Origin", test.origin)
+		}
+		if err := checkSameOrigin(r, test.listen); (err == nil) != test.ok {
+			t.Errorf("checkSameOrigin(%s, Origin %q) listening on %s returned %v, want ok %v",
+				test.host, test.origin, test.listen, err, test.ok)
+		}
+	}
+}
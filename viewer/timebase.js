@@ -0,0 +1,70 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Labels sample indices as time since the trigger, see gocw.TimeBase.
+
+// Time base of the selected capture. SampleRate is zero if unknown.
+var time_base = {SampleRate: 0, TargetClock: 0, Start: 0};
+
+var LoadTimeBase = function(capture, done) {
+    $.ajax({
+        url: "/timebase/" + capture,
+        method: "GET",
+        dataType: "json",
+        success: function(d) {
+            time_base = d;
+        },
+        error: function() {
+            time_base = {SampleRate: 0, TargetClock: 0, Start: 0};
+        },
+        complete: done,
+    });
+};
+
+// Formats the time of a sample, or the sample index if unknown.
+var FormatTime = function(sample) {
+    if (!time_base.SampleRate) {
+        return String(sample);
+    }
+    var s = time_base.Start + sample / time_base.SampleRate;
+    if (Math.abs(s) < 1e-6) {
+        return (s * 1e9).toFixed(1) + "ns";
+    } else if (Math.abs(s) < 1e-3) {
+        return (s * 1e6).toFixed(3) + "µs";
+    }
+    return (s * 1e3).toFixed(3) + "ms";
+};
+
+// Formats a sample index with its time and target clock cycle, if known.
+var FormatSample = function(sample) {
+    var res = "sample " + sample;
+    if (time_base.SampleRate) {
+        res += ", " + FormatTime(sample);
+        if (time_base.TargetClock) {
+            var s = time_base.Start + sample / time_base.SampleRate;
+            res += ", " + (s * time_base.TargetClock).toFixed(1) + " cycles";
+        }
+    }
+    return res;
+};
+
+// Dygraph axes options for plots of samples.
+var SampleAxes = function() {
+    return {
+        x: {
+            valueFormatter: FormatSample,
+            axisLabelFormatter: FormatTime,
+        },
+    };
+};
@@ -15,6 +15,9 @@
 var selected_capture;
 var selected_traces = {};
 var trace_dygraph;
+var compare_dygraph;
+// Shared view being restored, see LoadSharedState.
+var shared_state;
 
 var PlotTraceData = function() {
     var max_samples = 0;
@@ -51,7 +54,11 @@ var PlotTraceData = function() {
             animatedZooms: true,
             title: selected_capture + " power trace",
             labels: labels,
+            axes: SampleAxes(),
         });
+    if (shared_state && shared_state.Zoom && shared_state.Zoom.length == 2) {
+        trace_dygraph.updateOptions({dateWindow: shared_state.Zoom});
+    }
 };
 
 var LoadTraceData = function(capture, trace) {
@@ -66,7 +73,61 @@ var LoadTraceData = function(capture, trace) {
     });
 };
 
+var LoadHeatmap = function(capture) {
+    var width = $("#heatmap").parent().width();
+    $("#heatmap").attr("src", "/heatmap/" + capture + "?" + $.param({
+        "width": Math.round(width),
+        "height": 600,
+    }));
+};
+
+// Plots Welch's t-statistic between the selected capture and another one.
+var LoadComparison = function() {
+    var other = $("#compare_with").val();
+    if (compare_dygraph) {
+        compare_dygraph.destroy();
+        compare_dygraph = null;
+    }
+    $("#compare_status").text("");
+    if (!other || !selected_capture) {
+        return;
+    }
+    $.ajax({
+        url: "/compare/" + selected_capture + "/" + other,
+        method: "GET",
+        dataType: "json",
+        success: function(d) {
+            var data = d.T.map(function(t, i) {
+                return [i, t, d.MeanDiff[i], d.Threshold, -d.Threshold];
+            });
+            compare_dygraph = new Dygraph(
+                document.getElementById("compare_plot"),
+                data, {
+                    legend: "always",
+                    title: selected_capture + " vs. " + other,
+                    labels: ["sample", "t", "mean diff", "+threshold", "-threshold"],
+                    series: {
+                        "mean diff": {axis: "y2"},
+                    },
+                    axes: SampleAxes(),
+                });
+            $("#compare_status").text((d.Leaking || []).length + " samples exceed |t| > " + d.Threshold);
+        },
+        error: function(xhr) {
+            $("#compare_status").text("Error: " + xhr.responseText);
+        },
+    });
+};
+
 var LoadTraces = function(capture) {
+    LoadTimeBase(capture, function() {
+        LoadTraceList(capture);
+    });
+};
+
+var LoadTraceList = function(capture) {
+    LoadComparison();
+    LoadHeatmap(capture);
     if (trace_dygraph) {
         trace_dygraph.destroy();
         trace_dygraph = null;
@@ -77,11 +138,19 @@ var LoadTraces = function(capture) {
         method: "GET",
         dataType: "json",
         success: function(d) {
-            // Automatically load the first trace.
-            if (d.length > 0) {
-                d[0]["Selected"] = true;
-                LoadTraceData(selected_capture, d[0]["Id"]);
+            var traces = [];
+            if (shared_state && shared_state.Capture == capture) {
+                traces = shared_state.Traces || [];
+            } else if (d.length > 0) {
+                // Automatically load the first trace.
+                traces = [d[0]["Id"]];
             }
+            d.forEach(function(row) {
+                if (traces.indexOf(row["Id"]) >= 0) {
+                    row["Selected"] = true;
+                    LoadTraceData(capture, row["Id"]);
+                }
+            });
             $("#traces").bootstrapTable("load", d);
         },
         error: function() {
@@ -100,6 +169,9 @@ var LoadCaptures = function(wait) {
         dataType: "json",
         success: function(d) {
             $("#captures").empty();
+            // Thumbnails are re-fetched on each change of the directory, the
+            // server renders them again if the capture changed.
+            var version = Date.now();
             d.forEach(function(value, i) {
                 $("#captures")
                     .append($("<li>").attr("class", "nav-item")
@@ -107,11 +179,29 @@ var LoadCaptures = function(wait) {
                             .attr('id', "cap_" + value)
                             .attr("href", "#" + value)
                             .append($("<span>").attr("data-feather", "file-text"))
-                            .append(value)));
+                            .append(value)
+                            .append($("<img>").attr("class", "thumbnail")
+                                .attr("src", "/thumbnail/" + value + "?v=" + version)
+                                .attr("alt", "")
+                                .on("error", function() {
+                                    $(this).hide();
+                                }))));
             })
             feather.replace();
-            // Automatically load the first capture.
-            if (!wait && d.length > 0) {
+            var compare_with = $("#compare_with").val();
+            $("#compare_with").empty().append($("<option>").attr("value", "").text("None"));
+            d.forEach(function(value, i) {
+                $("#compare_with").append($("<option>").attr("value", value).text(value));
+            });
+            $("#compare_with").val(compare_with || "");
+            if (!wait && shared_state && d.indexOf(shared_state.Capture) >= 0) {
+              selected_capture = shared_state.Capture;
+              $("#compare_with").val(shared_state.Compare || "");
+              $("#cap_" + selected_capture).addClass("active");
+              LoadTraces(selected_capture);
+            } else if (!wait && d.length > 0) {
+              // Automatically load the first capture.
+              shared_state = null;
               selected_capture = d[0];
               $("#cap_" + selected_capture).addClass("active");
               LoadTraces(d[0]);
@@ -125,6 +215,7 @@ var LoadCaptures = function(wait) {
         var url = $(this).attr("href");
         var new_selected_capture = url.substring(1);
         if (selected_capture != new_selected_capture) {
+            shared_state = null;
             $("#cap_" + selected_capture).removeClass("active");
             selected_capture = new_selected_capture;
             $("#cap_" + selected_capture).addClass("active");
@@ -135,10 +226,137 @@ var LoadCaptures = function(wait) {
     });
 };
 
+// Shows the live device state in the sidebar, and waits for changes.
+var LoadDevice = function(wait) {
+    $.ajax({
+        url: "/device",
+        method: "GET",
+        data: {
+            "wait": wait
+        },
+        dataType: "json",
+        success: function(d) {
+            $("#device").empty();
+            var add = function(name, value, cls) {
+                $("#device").append($("<dt>").text(name))
+                    .append($("<dd>").attr("class", cls || "").text(value));
+            };
+            if (d.Error) {
+                add("Unavailable", d.Error, "text-muted");
+            } else {
+                var s = d.State;
+                add("Model", s.Model + " " + s.Config.Serial);
+                if (d.Info.Description) {
+                    add("Product", d.Info.Description +
+                        (d.Info.Manufacturer ? ", " + d.Info.Manufacturer : ""));
+                }
+                add("Firmware", s.Config.Fw.Major + "." + s.Config.Fw.Minor + "." + s.Config.Fw.Debug +
+                    (d.Info.FwBuildDate ? " (" + d.Info.FwBuildDate + ")" : ""));
+                add("FPGA", s.Config.Hw.HwType + ", registers v" + s.Config.Hw.RegVersion);
+                add("Gain", s.Config.Gain + " (" + s.Config.GainMode + ")");
+                add("Samples", s.Config.TotalSamples + ", offset " + s.Config.TriggerOffset);
+                add("ADC clock", (s.Clock.AdcFreq / 1e6).toFixed(3) + " MHz" +
+                    (s.Clock.DcmLocked ? "" : " (unlocked)"));
+                add("Target clock", (s.ClkGenOutputFreq / 1e6).toFixed(3) + " MHz" +
+                    (s.Clock.ClkGenDcmLocked ? "" : " (unlocked)"));
+                (s.Problems || []).forEach(function(p) {
+                    add("Problem", p, "text-danger");
+                });
+            }
+            $.when().then(LoadDevice(true));
+        },
+        error: function() {
+            // Retry later, e.g. after the server restarted.
+            setTimeout(function() {
+                LoadDevice(false);
+            }, 10000);
+        },
+    });
+};
+
+// Returns the current view, to be shared with ShareView.
+var CurrentState = function() {
+    var state = {
+        Capture: selected_capture,
+        Traces: Object.keys(selected_traces).map(Number),
+        Compare: $("#compare_with").val() || "",
+    };
+    if (trace_dygraph && trace_dygraph.isZoomed("x")) {
+        state.Zoom = trace_dygraph.xAxisRange();
+    }
+    return state;
+};
+
+// Saves the current view on the server, and shows a link to it.
+var ShareView = function() {
+    if (!selected_capture) {
+        return;
+    }
+    $.ajax({
+        url: "/state",
+        method: "POST",
+        contentType: "application/json",
+        data: JSON.stringify(CurrentState()),
+        dataType: "json",
+        success: function(d) {
+            var url = location.pathname + "?" + $.param({"s": d.Id}) + "#" + selected_capture;
+            history.replaceState(null, "", url);
+            $("#share_link").val(location.href).removeClass("d-none").select();
+        },
+        error: function(xhr) {
+            $("#share_link").val("Error: " + xhr.responseText).removeClass("d-none");
+        },
+    });
+};
+
+// Downloads the current trace plot as a figure rendered by the server, of the
+// selected traces, or of the mean and standard deviation of all the traces
+// with stat "mean".
+var ExportFigure = function(format, stat) {
+    if (!selected_capture) {
+        return;
+    }
+    var state = CurrentState();
+    var params = {"format": format};
+    if (stat) {
+        params.stat = stat;
+    } else {
+        params.traces = state.Traces.join(",");
+    }
+    if (state.Zoom) {
+        params.start = Math.round(state.Zoom[0]);
+        params.end = Math.round(state.Zoom[1]);
+    }
+    $("<a>").attr("href", "/figure/" + selected_capture + "?" + $.param(params))
+        .attr("download", selected_capture + (stat ? "_" + stat : "") + "." + format)[0].click();
+};
+
+// Restores the view shared in the "s" URL parameter, if any, then loads the
+// captures.
+var LoadSharedState = function() {
+    var id = new URLSearchParams(location.search).get("s");
+    if (!id) {
+        LoadCaptures(false);
+        return;
+    }
+    $.ajax({
+        url: "/state/" + encodeURIComponent(id),
+        method: "GET",
+        dataType: "json",
+        success: function(d) {
+            shared_state = d;
+        },
+        complete: function() {
+            LoadCaptures(false);
+        },
+    });
+};
+
 $(document).ready(function() {
     "use strict"
     $("#traces").bootstrapTable({
         onClickRow: function(row, elm, field) {
+            shared_state = null;
             if (row.Selected) {
                 delete selected_traces[row.Id];
                 PlotTraceData();
@@ -147,6 +365,12 @@ $(document).ready(function() {
             }
         },
     });
+    $("#compare_with").change(LoadComparison);
+    $("#share").click(ShareView);
+    $(".export").click(function() {
+        ExportFigure($(this).data("format"), $(this).data("stat"));
+    });
     feather.replace();
-    LoadCaptures(false);
+    LoadSharedState();
+    LoadDevice(false);
 })